@@ -3,11 +3,8 @@ module github.com/tannerklineintz/triedis
 go 1.24.2
 
 require (
-	github.com/tannerklineintz/pytricia-go v0.1.6
+	github.com/tidwall/match v1.1.1
 	github.com/tidwall/redcon v1.6.2
 )
 
-require (
-	github.com/tidwall/btree v1.1.0 // indirect
-	github.com/tidwall/match v1.1.1 // indirect
-)
+require github.com/tidwall/btree v1.1.0 // indirect
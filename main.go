@@ -0,0 +1,182 @@
+// Command triedis serves the triedis RESP protocol. The server itself is
+// package server, which other programs can embed.
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/tannerklineintz/triedis/server"
+)
+
+// addrList is the repeatable -addr flag; each value may also be a
+// comma-separated list. Setting it replaces the default.
+type addrList struct {
+	addrs []string
+	set   bool
+}
+
+func (a *addrList) String() string { return strings.Join(a.addrs, ",") }
+
+func (a *addrList) Set(v string) error {
+	if !a.set {
+		a.addrs, a.set = nil, true
+	}
+	for _, addr := range strings.Split(v, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			a.addrs = append(a.addrs, addr)
+		}
+	}
+	return nil
+}
+
+// fatal logs at error level and exits, for failures during startup.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func main() {
+	o := server.DefaultOptions()
+	addrs := &addrList{addrs: []string{"0.0.0.0:6379"}}
+	flag.Var(addrs, "addr", "listen address; repeat or comma-separate for several (empty disables plaintext)")
+	flag.IntVar(&o.TLSPort, "tls-port", o.TLSPort, "TLS port, bound on every -addr host (0 disables TLS)")
+	flag.StringVar(&o.TLSCertFile, "tls-cert-file", o.TLSCertFile, "TLS server certificate (PEM)")
+	flag.StringVar(&o.TLSKeyFile, "tls-key-file", o.TLSKeyFile, "TLS server private key (PEM)")
+	flag.StringVar(&o.TLSCACertFile, "tls-ca-cert-file", o.TLSCACertFile, "CA bundle used to verify client certificates (PEM)")
+	flag.StringVar(&o.TLSAuthClients, "tls-auth-clients", o.TLSAuthClients, "require client certificates: yes, no or optional")
+	flag.StringVar(&o.TLSIdentityMap, "tls-identity-map", o.TLSIdentityMap, "certificate identity permissions, e.g. loader=readwrite,lookup=readonly")
+	flag.StringVar(&o.TLSDefaultPermission, "tls-default-permission", o.TLSDefaultPermission, "permission of clients without a certificate once tls-identity-map has entries")
+	flag.Int64Var(&o.Timeout, "timeout", o.Timeout, "close clients idle for this many seconds (0 disables)")
+	flag.Int64Var(&o.TCPKeepAlive, "tcp-keepalive", o.TCPKeepAlive, "TCP keepalive period for client sockets in seconds (0 disables)")
+	flag.Int64Var(&o.WriteTimeout, "write-timeout", o.WriteTimeout, "drop clients whose replies cannot be flushed within this many seconds (0 disables)")
+	flag.Int64Var(&o.MaxClients, "maxclients", o.MaxClients, "refuse connections beyond this many open clients")
+	flag.Int64Var(&o.MaxClientsPerIP, "maxclients-per-ip", o.MaxClientsPerIP, "refuse connections beyond this many open clients from one IP (0 disables)")
+	flag.StringVar(&o.ClientOutputBufferLimit, "client-output-buffer-limit", o.ClientOutputBufferLimit, "close clients whose pending output exceeds these limits: class hard soft soft-seconds, ...")
+	flag.Int64Var(&o.RateLimit, "ratelimit", o.RateLimit, "commands per second each client may send (0 disables)")
+	flag.Int64Var(&o.RateLimitBurst, "ratelimit-burst", o.RateLimitBurst, "commands a client may send at once before ratelimit applies (0 means one second's worth)")
+	flag.StringVar(&o.RateLimitMode, "ratelimit-mode", o.RateLimitMode, "over ratelimit, refuse commands (hard) or delay them (soft)")
+	flag.StringVar(&o.RateLimitUsers, "ratelimit-users", o.RateLimitUsers, "per-user ratelimit overrides, 0 exempting, e.g. loader=0,lookup=500")
+	flag.StringVar(&o.NoEvictUsers, "no-evict-users", o.NoEvictUsers, "users whose clients are never closed or rate limited to protect the server, e.g. monitor,repl")
+	flag.StringVar(&o.MaxClientsPerIPExempt, "maxclients-per-ip-exempt", o.MaxClientsPerIPExempt, "CIDRs maxclients-per-ip does not apply to, e.g. 127.0.0.1/32,10.0.0.0/8")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics over HTTP on this address (empty disables)")
+	httpAddr := flag.String("http-addr", "", "serve the read-only HTTP/JSON lookup API on this address (empty disables)")
+	debugAddr := flag.String("debug-addr", "", "serve pprof and expvar over HTTP on this address (empty disables)")
+	mutexFraction := flag.Int("mutex-profile-fraction", 0, "report 1/n of mutex contention events to pprof (0 disables)")
+	blockRate := flag.Int("block-profile-rate", 0, "sample one blocking event per n nanoseconds blocked (0 disables)")
+	flag.IntVar(&o.DBShards, "db-shards", o.DBShards, "independently locked shards per database and address family, a power of two up to 256")
+	flag.BoolVar(&o.ValueInterning, "value-interning", o.ValueInterning, "share one copy of identical values between prefixes in a DB")
+	flag.BoolVar(&o.ValueIndex, "value-index", o.ValueIndex, "index prefixes by value for VKEYS and VCOUNT, at the cost of memory per prefix")
+	flag.BoolVar(&o.RejectHostBits, "reject-host-bits", o.RejectHostBits, "make SET of a prefix with host bits set, like 10.1.2.3/8, an error instead of masking it")
+	flag.StringVar(&o.IPv4Mapped, "ipv4-mapped", o.IPv4Mapped, "IPv4-mapped IPv6 (::ffff:a.b.c.d) handling: convert to IPv4, reject as keys but unmap lookups, or native IPv6")
+	flag.BoolVar(&o.HotkeysTracking, "hotkeys-tracking", o.HotkeysTracking, "track the most matched prefixes of each DB for HOTKEYS")
+	flag.Int64Var(&o.HotkeysSampleRate, "hotkeys-sample-rate", o.HotkeysSampleRate, "observe one lookup match in this many for hotkeys-tracking")
+	flag.Int64Var(&o.LPMCacheSize, "lpm-cache-size", o.LPMCacheSize, "longest-match lookups each DB caches, dropped by writes covering them (0 disables)")
+	flag.BoolVar(&o.ReadOnly, "read-only", o.ReadOnly, "refuse every write command, leaving lookups, INFO and CONFIG available")
+	flag.BoolVar(&o.LazyfreeUserFlush, "lazyfree-lazy-user-flush", o.LazyfreeUserFlush, "make FLUSHDB and DROPDB free the old data in the background")
+	flag.StringVar(&o.MaxMemory, "maxmemory", o.MaxMemory, "limit on the dataset estimate (used_memory_dataset), e.g. 2gb; writes over it evict or fail (0 disables)")
+	flag.StringVar(&o.MaxMemoryPolicy, "maxmemory-policy", o.MaxMemoryPolicy, "writes over maxmemory: noeviction refuses them, most-specific-first evicts the longest prefixes")
+	flag.Int64Var(&o.MaxMemorySamples, "maxmemory-samples", o.MaxMemorySamples, "prefixes sampled per eviction")
+	flag.BoolVar(&o.MaxMemoryLossless, "maxmemory-lossless", o.MaxMemoryLossless, "only evict prefixes whose covering prefix holds an identical value")
+	flag.BoolVar(&o.LFUTracking, "lfu-tracking", o.LFUTracking, "count accesses per prefix for OBJECT FREQ, at the cost of extra writes on the lookup path")
+	flag.StringVar(&o.Dir, "dir", o.Dir, "directory snapshots are written to and loaded from")
+	flag.StringVar(&o.DBFilename, "dbfilename", o.DBFilename, "snapshot file name in -dir, loaded at startup if present; a %d in it saves each DB to its own file")
+	flag.StringVar(&o.JournalFile, "journal-file", o.JournalFile, "operation journal in -dir recording IMPORT, DBMERGE and DELVALUE as they run, to find those a crash interrupted (empty disables)")
+	flag.StringVar(&o.JournalRecovery, "journal-recovery", o.JournalRecovery, "databases an interrupted operation may have left partly written: refuse them until JOURNAL RESOLVE, serve them as they are, or complete the operation")
+	flag.BoolVar(&o.RDBCompression, "rdbcompression", o.RDBCompression, "gzip snapshot files as they are saved; compressed files are recognised when loaded either way")
+	flag.Int64Var(&o.RDBCompressionLevel, "rdbcompression-level", o.RDBCompressionLevel, "gzip level of compressed snapshots, from 1 (fastest) to 9 (smallest)")
+	flag.StringVar(&o.Import, "import", o.Import, "load this CSV or TSV file of prefix,value lines, optionally gzipped, before serving")
+	flag.IntVar(&o.ImportDB, "import-db", o.ImportDB, "database -import and -import-mrt load into")
+	flag.StringVar(&o.ImportMRT, "import-mrt", o.ImportMRT, "load this MRT TABLE_DUMP_V2 RIB dump, optionally gzipped or bzip2ed, before serving")
+	flag.StringVar(&o.ImportMRTTemplate, "import-mrt-template", o.ImportMRTTemplate, "value -import-mrt stores per prefix; {origin}, {path}, {peer} and {peer-as} are replaced")
+	flag.StringVar(&o.ImportMRTMultipath, "import-mrt-multipath", o.ImportMRTMultipath, "value of a prefix whose -import-mrt paths differ: shortest (the shortest path's) or all (a set)")
+	flag.StringVar(&o.ReloadFile, "reload-file", o.ReloadFile, "keep a DB in step with this CSV or TSV file, reloading it whenever it changes")
+	flag.DurationVar(&o.ReloadInterval, "reload-interval", o.ReloadInterval, "how often -reload-file is checked for changes")
+	flag.IntVar(&o.ReloadDB, "reload-db", o.ReloadDB, "database -reload-file loads into")
+	flag.StringVar(&o.DBNames, "db-names", o.DBNames, "database names for SELECT and INFO, e.g. 3=geo,4=asn")
+	flag.StringVar(&o.DBReadOnly, "db-readonly", o.DBReadOnly, "databases refusing writes, as index yes|no pairs, e.g. '0 yes'")
+	flag.StringVar(&o.DBTombstones, "db-tombstones", o.DBTombstones, "databases keeping what DEL deletes for RESTOREKEY, as index yes|no pairs, e.g. '0 yes'")
+	flag.Int64Var(&o.TombstoneMaxEntries, "tombstone-max-entries", o.TombstoneMaxEntries, "tombstones kept per database with db-tombstones, the oldest dropped first")
+	flag.Int64Var(&o.TombstoneMaxAge, "tombstone-max-age", o.TombstoneMaxAge, "seconds a tombstone is kept (0 without limit)")
+	flag.StringVar(&o.DBMaxKeys, "db-max-keys", o.DBMaxKeys, "per-database caps on stored prefixes, as index limit pairs, e.g. '2 500000'")
+	flag.StringVar(&o.DBMaxBytes, "db-max-bytes", o.DBMaxBytes, "per-database caps on value bytes, as index limit pairs, e.g. '2 512mb'")
+	flag.StringVar(&o.DBDefaultValue, "db-default-value", o.DBDefaultValue, "value GET and SPM answer when nothing covers the address, as index value pairs, e.g. '0 unknown'")
+	flag.BoolVar(&o.RequirePrefixLength, "require-prefix-length", o.RequirePrefixLength, "refuse bare IP addresses as keys in SET, DEL and friends; GET still takes addresses")
+	flag.StringVar(&o.EnableDebugCommand, "enable-debug-command", o.EnableDebugCommand, "allow DEBUG SLEEP, ERROR and POPULATE: yes, no or local (loopback clients only)")
+	flag.StringVar(&o.LogFormat, "log-format", o.LogFormat, "log output format: text (key=value) or json")
+	flag.StringVar(&o.LogFile, "logfile", o.LogFile, "append logs to this file instead of stderr")
+	logLevel := flag.String("loglevel", "info", "log level: debug, info, warn or error")
+	flag.Int64Var(&o.LogSlowerThan, "log-slower-than", o.LogSlowerThan, "log commands slower than this many microseconds (-1 disables)")
+	flag.Int64Var(&o.CommandTimeout, "command-timeout", o.CommandTimeout, "abort traversals such as SUBNETS, KEYS and DBDIFF running longer than this many milliseconds (0 disables)")
+	flag.StringVar(&o.CommandTimeoutClasses, "command-timeout-classes", o.CommandTimeoutClasses, "command-timeout overrides by command class, e.g. admin=60000,write=1000")
+	flag.StringVar(&o.ShardMap, "shard-map", o.ShardMap, "address ranges each node of a sharded deployment owns, for OWNER, e.g. 0.0.0.0/1=node-a,128.0.0.0/1=node-b")
+	flag.Int64Var(&o.SubtreeMaxEntries, "subtree-max-entries", o.SubtreeMaxEntries, "refuse SUBNETS and TREEGET replies larger than this without CURSOR (0 unlimited)")
+	flag.StringVar(&o.AuditLogFile, "audit-log-file", o.AuditLogFile, "append an audit record of every successful write to this file")
+	flag.Int64Var(&o.AuditLogMaxSize, "audit-log-max-size", o.AuditLogMaxSize, "rotate the audit log after this many bytes (0 never)")
+	flag.IntVar(&o.AuditLogMaxFiles, "audit-log-max-files", o.AuditLogMaxFiles, "rotated audit log files to keep")
+	flag.StringVar(&o.WebhookURLs, "webhook-urls", o.WebhookURLs, "post a JSON event of every successful write to these URLs, separated by commas")
+	flag.StringVar(&o.WebhookFilter, "webhook-filter", o.WebhookFilter, "only send webhook events of prefixes within these CIDRs, separated by commas")
+	flag.Int64Var(&o.WebhookBatchSize, "webhook-batch-size", o.WebhookBatchSize, "webhook events posted at most in one request")
+	flag.Int64Var(&o.WebhookMaxPending, "webhook-max-pending", o.WebhookMaxPending, "webhook events queued per URL before more are dropped")
+	flag.Int64Var(&o.WebhookMaxRetries, "webhook-max-retries", o.WebhookMaxRetries, "retries of a failed webhook post before its events are dropped")
+	flag.StringVar(&o.Preload, "preload", o.Preload, "JSON manifest of files to load into DBs before listening")
+	flag.BoolVar(&o.PreloadDegraded, "preload-degraded", o.PreloadDegraded, "start read-only instead of exiting when a -preload source fails")
+	flag.StringVar(&o.OTelEndpoint, "otel-endpoint", o.OTelEndpoint, "export OpenTelemetry spans of sampled commands to this OTLP/HTTP collector, e.g. localhost:4318")
+	flag.StringVar(&o.OTelServiceName, "otel-service-name", o.OTelServiceName, "service.name of exported spans")
+	flag.Float64Var(&o.OTelSampleRatio, "otel-sample-ratio", o.OTelSampleRatio, "fraction of commands traced, from 0 to 1; commands with a sampled CLIENT TRACEPARENT always are")
+	flag.StringVar(&o.OTelKeyRedaction, "otel-key-redaction", o.OTelKeyRedaction, "key attribute of spans: mask (to /24 or /48), none or drop")
+	flag.Parse()
+
+	if err := server.SetupLogging(o.LogFormat, o.LogFile, *logLevel); err != nil {
+		fatal("invalid logging options", "err", err)
+	}
+	if len(addrs.addrs) == 0 && o.TLSPort == 0 {
+		fatal("nothing to listen on: set -addr and/or -tls-port")
+	}
+
+	// Load the data before binding, so clients never reach an empty
+	// dataset while it loads.
+	srv, err := server.Open(o)
+	if err != nil {
+		fatal("startup failed", "err", err)
+	}
+
+	// Bind everything before serving so a bad address fails startup.
+	if err := srv.Listen(addrs.addrs); err != nil {
+		fatal("listen failed", "err", err)
+	}
+
+	if *metricsAddr != "" {
+		if err := srv.ServeMetrics(*metricsAddr); err != nil {
+			fatal("metrics listen failed", "err", err)
+		}
+		slog.Info("Serving metrics", "url", "http://"+*metricsAddr+"/metrics")
+	}
+
+	if *httpAddr != "" {
+		if err := srv.ServeGateway(*httpAddr); err != nil {
+			fatal("HTTP gateway listen failed", "err", err)
+		}
+		slog.Info("Serving HTTP gateway", "url", "http://"+*httpAddr+"/")
+	}
+
+	if *debugAddr != "" {
+		runtime.SetMutexProfileFraction(*mutexFraction)
+		server.SetBlockProfileRate(*blockRate)
+		if err := srv.ServeDebug(*debugAddr); err != nil {
+			fatal("debug listen failed", "err", err)
+		}
+		slog.Info("Serving pprof", "url", "http://"+*debugAddr+"/debug/pprof/")
+	}
+
+	srv.Start()
+
+	// Serve until a listener fails or we are asked to stop. redcon handles
+	// concurrency and RESP framing for each of them.
+	if err := srv.Serve(); err != nil {
+		fatal("server stopped", "err", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAddrList(t *testing.T) {
+	for _, tc := range []struct {
+		values []string
+		want   []string
+	}{
+		{values: nil, want: []string{"0.0.0.0:6379"}},
+		{values: []string{"127.0.0.1:6379"}, want: []string{"127.0.0.1:6379"}},
+		{values: []string{"127.0.0.1:6379", "[::1]:6379"}, want: []string{"127.0.0.1:6379", "[::1]:6379"}},
+		{values: []string{"127.0.0.1:6379, 10.0.0.1:6379,"}, want: []string{"127.0.0.1:6379", "10.0.0.1:6379"}},
+		{values: []string{""}, want: nil},
+	} {
+		a := &addrList{addrs: []string{"0.0.0.0:6379"}}
+		for _, v := range tc.values {
+			a.Set(v)
+		}
+		if !slices.Equal(a.addrs, tc.want) {
+			t.Errorf("-addr %q = %q, want %q", tc.values, a.addrs, tc.want)
+		}
+	}
+}
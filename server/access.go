@@ -0,0 +1,117 @@
+package server
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// accessClock is a coarse clock, in unix seconds, for access tracking.
+// statsCron advances it, so the read path never calls time.Now.
+var accessClock atomic.Uint32
+
+func init() {
+	tickAccessClock(time.Now())
+}
+
+func tickAccessClock(now time.Time) {
+	accessClock.Store(uint32(now.Unix()))
+}
+
+// The access-frequency counter follows Redis's LFU: a logarithmic 8-bit
+// counter that new values start at lfuInitVal and that loses one point
+// per lfuDecayMinutes without access.
+const (
+	lfuInitVal      = 5
+	lfuLogFactor    = 10
+	lfuDecayMinutes = 1
+)
+
+// access records when a stored value was last read or written and, with
+// lfu-tracking on, how often. Reads update it under the shard read lock,
+// so it is atomic. It is not part of the value's data: touching a prefix
+// is not a write.
+type access struct {
+	last atomic.Uint32 // accessClock reading
+	lfu  atomic.Uint32 // minute of the last decay << 8 | counter
+}
+
+func newAccess() *access {
+	a := new(access)
+	now := accessClock.Load()
+	a.last.Store(now)
+	a.lfu.Store(lfuMinutes(now)<<8 | lfuInitVal)
+	return a
+}
+
+// lfuMinutes is the 24-bit minute clock the counter's decay runs on.
+func lfuMinutes(clock uint32) uint32 { return clock / 60 & 0xffffff }
+
+// freq returns the access-frequency counter with any decay due applied.
+func (a *access) freq() uint32 {
+	packed := a.lfu.Load()
+	counter, then := packed&0xff, packed>>8
+	elapsed := (lfuMinutes(accessClock.Load()) - then) & 0xffffff
+	periods := elapsed / lfuDecayMinutes
+	if periods >= counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// countAccess bumps the counter with a probability falling as it grows,
+// so it takes some 300,000 accesses to reach 255.
+func (a *access) countAccess() {
+	counter := a.freq()
+	if counter < 255 {
+		base := max(float64(counter)-lfuInitVal, 0)
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	if packed := lfuMinutes(accessClock.Load())<<8 | counter; a.lfu.Load() != packed {
+		a.lfu.Store(packed)
+	}
+}
+
+// idle returns how many seconds ago v was last accessed.
+func (v value) idle() uint32 {
+	if v.access == nil {
+		return 0
+	}
+	return accessClock.Load() - v.access.last.Load()
+}
+
+// touch marks v as accessed now. The clock only moves once a second, so
+// most touches are a load and no store, keeping hot prefixes' cache lines
+// clean.
+func (d *database) touch(v value) {
+	if v.access == nil {
+		return
+	}
+	if now := accessClock.Load(); v.access.last.Load() != now {
+		v.access.last.Store(now)
+	}
+	if d.opts.lfu.Load() {
+		v.access.countAccess()
+	}
+}
+
+// handleTouch implements TOUCH cidr [cidr ...]: it marks the prefixes
+// stored at exactly those keys accessed and replies with how many exist.
+func (s *TrieServer) handleTouch(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'TOUCH'")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	n := 0
+	for _, arg := range cmd.Args[1:] {
+		if _, ok := db.lookupExact(string(arg)); ok {
+			n++
+		}
+	}
+	conn.WriteInt(n)
+}
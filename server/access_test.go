@@ -0,0 +1,124 @@
+package server
+
+import "testing"
+
+func TestAccessTracking(t *testing.T) {
+	start := accessClock.Load()
+	t.Cleanup(func() { accessClock.Store(start) })
+	ss := newTestSession(t, newTestServer(t))
+	db := ss.s.getDB(0)
+	lastAccess := func(cidr string) uint32 {
+		t.Helper()
+		v, ok := db.peekExact(cidr)
+		if !ok {
+			t.Fatalf("%s is not stored", cidr)
+		}
+		return v.access.last.Load()
+	}
+	mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+	mustDo(t, ss, "HSET", "192.0.2.0/24", "f", "v")
+	mustDo(t, ss, "SADD", "198.51.100.0/24", "m")
+
+	for i, tc := range []struct {
+		args    []string
+		cidr    string
+		touches bool
+	}{
+		{[]string{"GET", "10.1.2.3"}, "10.0.0.0/8", true},
+		{[]string{"GET", "10.0.0.0/8"}, "10.0.0.0/8", true},
+		{[]string{"TYPE", "10.0.0.0/8"}, "10.0.0.0/8", false},
+		{[]string{"OBJECT", "ENCODING", "10.0.0.0/8"}, "10.0.0.0/8", false},
+		{[]string{"MEMORY", "USAGE", "10.0.0.0/8"}, "10.0.0.0/8", false},
+		{[]string{"STRLEN", "10.0.0.0/8"}, "10.0.0.0/8", true},
+		{[]string{"TOUCH", "10.0.0.0/8"}, "10.0.0.0/8", true},
+		{[]string{"HGET", "192.0.2.0/24", "f"}, "192.0.2.0/24", true},
+		{[]string{"HLOOKUP", "192.0.2.1"}, "192.0.2.0/24", true},
+		{[]string{"SMEMBERS", "198.51.100.0/24"}, "198.51.100.0/24", true},
+		{[]string{"SMATCH", "198.51.100.1"}, "198.51.100.0/24", true},
+		{[]string{"SET", "10.0.0.0/8", "b"}, "10.0.0.0/8", true}, // a write starts a new record
+	} {
+		before := lastAccess(tc.cidr)
+		now := start + uint32(i+1)*100
+		accessClock.Store(now)
+		mustDo(t, ss, tc.args...)
+		got, want := lastAccess(tc.cidr), before
+		if tc.touches {
+			want = now
+		}
+		if got != want {
+			t.Errorf("%q: last access %d, want %d", tc.args, got-start, want-start)
+		}
+	}
+
+	writes := dbStats(t, ss)["writes"]
+	if r := mustDo(t, ss, "TOUCH", "10.0.0.0/8", "10.1.0.0/16", "192.0.2.0/24", "not-a-prefix"); r.Int != 2 {
+		t.Errorf("TOUCH = %d, want 2", r.Int)
+	}
+	if got := dbStats(t, ss)["writes"]; got != writes {
+		t.Errorf("TOUCH counted as a write: writes %d, then %d", writes, got)
+	}
+	if err := ss.Do("TOUCH").Err(); err == nil {
+		t.Error("TOUCH without keys succeeded")
+	}
+}
+
+func TestIdleTimeAndFreq(t *testing.T) {
+	start := accessClock.Load()
+	t.Cleanup(func() { accessClock.Store(start) })
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+	mustDo(t, ss, "SET", "192.0.2.0/24", "b")
+	accessClock.Store(start + 90)
+	runSteps(t, ss, []replyStep{
+		{[]string{"OBJECT", "IDLETIME", "10.0.0.0/8"}, "90"},
+		{[]string{"GET", "10.1.2.3"}, "a"},
+		{[]string{"OBJECT", "IDLETIME", "10.0.0.0/8"}, "0"},
+		{[]string{"OBJECT", "IDLETIME", "192.0.2.0/24"}, "90"},
+		{[]string{"SCAN", "0", "IDLE", "60"}, "[0 [192.0.2.0/24]]"},
+		{[]string{"SCAN", "0", "IDLE", "91"}, "[0 []]"},
+		{[]string{"SCAN", "0", "IDLE", "0"}, "[0 [10.0.0.0/8 192.0.2.0/24]]"},
+		{[]string{"SCAN", "0", "IDLE", "-1"}, "ERR value is not an integer or out of range"},
+		{[]string{"OBJECT", "FREQ", "10.0.0.0/8"}, "ERR lfu-tracking is off"},
+		{[]string{"CONFIG", "SET", "lfu-tracking", "yes"}, "OK"},
+		{[]string{"SET", "198.51.100.0/24", "c"}, "OK"},
+		{[]string{"OBJECT", "FREQ", "198.51.100.0/24"}, "5"}, // lfuInitVal
+		{[]string{"OBJECT", "IDLETIME", "10.9.0.0/16"}, "ERR no such key"},
+	})
+
+	// The counter decays one point per idle minute and grows slower as it
+	// gets higher.
+	accessClock.Store(start + 90 + 3*60)
+	runSteps(t, ss, []replyStep{{[]string{"OBJECT", "FREQ", "198.51.100.0/24"}, "2"}})
+	for range 1000 {
+		mustDo(t, ss, "GET", "198.51.100.1")
+	}
+	if f := mustDo(t, ss, "OBJECT", "FREQ", "198.51.100.0/24").Int; f <= 5 || f >= 30 {
+		t.Errorf("OBJECT FREQ after 1000 hits = %d, want a logarithmic count above 5", f)
+	}
+}
+
+func TestAccessFreq(t *testing.T) {
+	start := accessClock.Load()
+	t.Cleanup(func() { accessClock.Store(start) })
+	for _, tc := range []struct {
+		idleMinutes uint32
+		counter     uint32
+		want        uint32
+	}{
+		{0, 5, 5},
+		{1, 5, 4},
+		{4, 5, 1},
+		{5, 5, 0},
+		{50, 5, 0},
+		{10, 255, 245},
+	} {
+		accessClock.Store(start)
+		a := newAccess()
+		a.lfu.Store(lfuMinutes(start)<<8 | tc.counter)
+		accessClock.Store(start + tc.idleMinutes*60)
+		if got := a.freq(); got != tc.want {
+			t.Errorf("counter %d idle %d minutes: freq %d, want %d", tc.counter, tc.idleMinutes, got, tc.want)
+		}
+	}
+}
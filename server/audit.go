@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Addr     string    `json:"addr"`
+	User     string    `json:"user"`
+	DB       int       `json:"db"`
+	Cmd      string    `json:"cmd"`
+	Prefixes []string  `json:"prefixes,omitempty"`
+}
+
+// auditLog appends successful write commands to a JSON-lines file. The
+// command path only does a non-blocking channel send; a single goroutine
+// does the I/O and size-based rotation. Entries that arrive while the
+// queue is full are dropped and counted rather than stalling clients.
+type auditLog struct {
+	enabled atomic.Bool
+	dropped atomic.Int64
+	ch      chan auditEntry
+	start   sync.Once
+
+	mu      sync.Mutex // guards the fields below
+	path    string
+	maxSize int64 // rotate once the file would exceed this many bytes, 0 never
+	keep    int   // rotated files kept as path.1 ... path.N
+	f       *os.File
+	size    int64
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{
+		ch:      make(chan auditEntry, 4096),
+		maxSize: 100 << 20,
+		keep:    5,
+	}
+}
+
+// record queues an entry if the audit log is enabled.
+func (a *auditLog) record(e auditEntry) {
+	if !a.enabled.Load() {
+		return
+	}
+	select {
+	case a.ch <- e:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// enable starts the writer goroutine the first time it is called.
+func (a *auditLog) enable() error {
+	a.mu.Lock()
+	path := a.path
+	a.mu.Unlock()
+	if path == "" {
+		return errors.New("audit-log-file must be set first")
+	}
+	a.start.Do(func() { go a.run() })
+	a.enabled.Store(true)
+	return nil
+}
+
+func (a *auditLog) run() {
+	for e := range a.ch {
+		line, _ := json.Marshal(e)
+		line = append(line, '\n')
+		a.mu.Lock()
+		if err := a.write(line); err != nil {
+			slog.Error("audit log write failed", "path", a.path, "err", err)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// write appends one line, opening and rotating the file as needed.
+func (a *auditLog) write(line []byte) error {
+	if a.f != nil && a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		a.f.Close()
+		a.f = nil
+		a.rotate()
+	}
+	if a.f == nil {
+		f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		a.f, a.size = f, st.Size()
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N-1 to path.N and so on, then moves path to path.1.
+// The oldest file falls off the end.
+func (a *auditLog) rotate() {
+	if a.keep <= 0 {
+		os.Remove(a.path)
+		return
+	}
+	for i := a.keep - 1; i >= 1; i-- {
+		os.Rename(a.path+"."+strconv.Itoa(i), a.path+"."+strconv.Itoa(i+1))
+	}
+	os.Rename(a.path, a.path+".1")
+	slog.Info("audit log rotated", "path", a.path)
+}
+
+// audit records a successful write by c. Reads are never audited.
+func (s *TrieServer) audit(c *client, cmd string, prefixes ...string) {
+	s.auditDB(c, int(c.db.Load()), cmd, prefixes...)
+}
+
+// auditDB is audit for a command acting on a database other than the
+// client's current one. It also sends the write's webhook events.
+func (s *TrieServer) auditDB(c *client, db int, cmd string, prefixes ...string) {
+	s.notifyWebhooks(db, cmd, prefixes)
+	if !s.auditLog.enabled.Load() {
+		return
+	}
+	user, _ := s.userFor(c)
+	s.auditLog.record(auditEntry{
+		Time:     time.Now().UTC(),
+		Addr:     c.addr,
+		User:     user,
+		DB:       db,
+		Cmd:      cmd,
+		Prefixes: prefixes,
+	})
+}
+
+// registerAuditConfig exposes the audit log settings. audit-log toggles
+// it at runtime; changing the file takes effect on the next entry.
+func (s *TrieServer) registerAuditConfig() {
+	a := s.auditLog
+	s.addConfig("audit-log",
+		func() string {
+			if a.enabled.Load() {
+				return "yes"
+			}
+			return "no"
+		},
+		func(v string) error {
+			switch v {
+			case "yes":
+				return a.enable()
+			case "no":
+				a.enabled.Store(false)
+				return nil
+			}
+			return errors.New("argument must be 'yes' or 'no'")
+		})
+	s.addConfig("audit-log-file",
+		func() string {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			return a.path
+		},
+		func(v string) error {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if v == "" && a.enabled.Load() {
+				return errors.New("disable audit-log first")
+			}
+			if a.f != nil {
+				a.f.Close()
+				a.f = nil
+			}
+			a.path = v
+			return nil
+		})
+	intParam := func(name string, get func() int64, set func(int64)) {
+		s.addConfig(name,
+			func() string {
+				a.mu.Lock()
+				defer a.mu.Unlock()
+				return strconv.FormatInt(get(), 10)
+			},
+			func(v string) error {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil || n < 0 {
+					return fmt.Errorf("argument must be a non-negative integer")
+				}
+				a.mu.Lock()
+				defer a.mu.Unlock()
+				set(n)
+				return nil
+			})
+	}
+	intParam("audit-log-max-size",
+		func() int64 { return a.maxSize },
+		func(n int64) { a.maxSize = n })
+	intParam("audit-log-max-files",
+		func() int64 { return int64(a.keep) },
+		func(n int64) { a.keep = int(n) })
+}
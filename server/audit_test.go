@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAudit waits for n entries in the audit log at path and returns them.
+func readAudit(t *testing.T, path string, n int) []auditEntry {
+	t.Helper()
+	var entries []auditEntry
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		entries = entries[:0]
+		if f, err := os.Open(path); err == nil {
+			sc := bufio.NewScanner(f)
+			for sc.Scan() {
+				var e auditEntry
+				if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+					t.Fatalf("audit line %q: %v", sc.Text(), err)
+				}
+				entries = append(entries, e)
+			}
+			f.Close()
+		}
+		if len(entries) >= n || time.Now().After(deadline) {
+			return entries
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	mustDo(t, ss, "CONFIG", "SET", "audit-log-file", path, "audit-log", "yes")
+
+	type entry struct {
+		db       int
+		cmd      string
+		prefixes []string
+	}
+	var want []entry
+	for _, tc := range []struct {
+		args  []string
+		audit *entry // nil when the command is not audited
+	}{
+		{args: []string{"SET", "10.0.0.0/8", "a"}, audit: &entry{0, "SET", []string{"10.0.0.0/8"}}},
+		{args: []string{"GET", "10.1.2.3"}},
+		{args: []string{"SET", "not-a-prefix", "a"}},
+		{args: []string{"SET", "192.168.0.0/16", "b"}, audit: &entry{0, "SET", []string{"192.168.0.0/16"}}},
+		{args: []string{"DEL", "10.0.0.0/8", "172.16.0.0/12"}, audit: &entry{0, "DEL", []string{"10.0.0.0/8"}}},
+		{args: []string{"DEL", "172.16.0.0/12"}},
+		{args: []string{"SELECT", "3"}},
+		{args: []string{"FLUSHDB"}, audit: &entry{3, "FLUSHDB", nil}},
+	} {
+		ss.Do(tc.args...)
+		if tc.audit != nil {
+			want = append(want, *tc.audit)
+		}
+	}
+
+	got := readAudit(t, path, len(want))
+	if len(got) != len(want) {
+		t.Fatalf("%d audit entries, want %d: %+v", len(got), len(want), got)
+	}
+	for i, e := range got {
+		w := want[i]
+		if e.DB != w.db || e.Cmd != w.cmd || !slices.Equal(e.Prefixes, w.prefixes) || e.User != "default" || e.Addr == "" || e.Time.IsZero() {
+			t.Errorf("entry %d = %+v, want %+v", i, e, w)
+		}
+	}
+
+	mustDo(t, ss, "CONFIG", "SET", "audit-log", "no")
+	mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+	mustDo(t, ss, "CONFIG", "SET", "audit-log", "yes")
+	mustDo(t, ss, "SET", "10.0.0.0/9", "a")
+	if got := readAudit(t, path, len(want)+1); len(got) != len(want)+1 || got[len(want)].Prefixes[0] != "10.0.0.0/9" {
+		t.Errorf("audit entries after a pause: %+v", got[len(want):])
+	}
+}
+
+func TestAuditConfig(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	for _, tc := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{args: []string{"audit-log", "yes"}, wantErr: true}, // no file yet
+		{args: []string{"audit-log", "on"}, wantErr: true},
+		{args: []string{"audit-log-max-size", "-1"}, wantErr: true},
+		{args: []string{"audit-log-max-files", "3"}},
+		{args: []string{"audit-log-file", path, "audit-log", "yes"}},
+		{args: []string{"audit-log-file", ""}, wantErr: true}, // while enabled
+		{args: []string{"audit-log", "no", "audit-log-file", ""}},
+	} {
+		if err := ss.Do(append([]string{"CONFIG", "SET"}, tc.args...)...).Err(); (err != nil) != tc.wantErr {
+			t.Errorf("CONFIG SET %q: %v, want error %v", tc.args, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAuditRotate(t *testing.T) {
+	for _, tc := range []struct {
+		maxSize int64
+		keep    int
+		want    []string // files left in the directory
+	}{
+		{maxSize: 0, keep: 2, want: []string{"audit"}},
+		{maxSize: 25, keep: 2, want: []string{"audit", "audit.1", "audit.2"}},
+		{maxSize: 25, keep: 0, want: []string{"audit"}},
+		{maxSize: 1000, keep: 2, want: []string{"audit"}},
+	} {
+		dir := t.TempDir()
+		a := newAuditLog()
+		a.path, a.maxSize, a.keep = filepath.Join(dir, "audit"), tc.maxSize, tc.keep
+		for range 5 {
+			if err := a.write([]byte(strings.Repeat("x", 9) + "\n")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		a.f.Close()
+		ents, _ := os.ReadDir(dir)
+		var got []string
+		for _, e := range ents {
+			got = append(got, e.Name())
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("max size %d, keep %d: files %q, want %q", tc.maxSize, tc.keep, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// permission is the access level granted to a certificate identity.
+type permission int
+
+const (
+	permNone permission = iota
+	permReadOnly
+	permReadWrite
+	permAdmin
+)
+
+var permissionNames = []string{"none", "readonly", "readwrite", "admin"}
+
+func (p permission) String() string { return permissionNames[p] }
+
+// errNoPerm is the error of a command user may not run, named as Redis
+// names it, e.g. client|kill.
+func errNoPerm(user, cmd string) *Error {
+	return errorf(ClassNoPerm, "User %s has no permissions to run the '%s' command", user, cmd)
+}
+
+// allows reports whether p may run a command with the given flags.
+func (p permission) allows(f cmdFlags) bool {
+	switch {
+	case f&cmdAdmin != 0:
+		return p >= permAdmin
+	case f&cmdWrite != 0:
+		return p >= permReadWrite
+	default:
+		return p >= permReadOnly
+	}
+}
+
+// identityMap maps certificate identities (subject CN or a SAN) to the
+// permission they are granted, e.g. "loader=readwrite,lookup=readonly".
+type identityMap map[string]permission
+
+func parseIdentityMap(s string) (identityMap, error) {
+	m := make(identityMap)
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		name, level, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid identity mapping %q, expected name=permission", entry)
+		}
+		p, ok := parsePermission(level)
+		if !ok {
+			return nil, fmt.Errorf("unknown permission %q for %q", level, name)
+		}
+		m[name] = p
+	}
+	return m, nil
+}
+
+// parsePermission parses a permission name, e.g. readonly.
+func parsePermission(s string) (permission, bool) {
+	for i, pn := range permissionNames {
+		if strings.EqualFold(s, pn) {
+			return permission(i), true
+		}
+	}
+	return permNone, false
+}
+
+func (m identityMap) String() string {
+	entries := make([]string, 0, len(m))
+	for name, p := range m {
+		entries = append(entries, name+"="+p.String())
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// certIdentities returns the names a client certificate can be mapped by:
+// its subject CN followed by its DNS, email and URI SANs.
+func certIdentities(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// identify records the verified certificate identity of a TLS client. It
+// runs before the client's first command, by which point the handshake
+// has completed.
+func (s *TrieServer) identify(c *client) {
+	c.identified = true
+	if c.tlsConn == nil {
+		return
+	}
+	state := c.tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return // no certificate, or one we did not verify
+	}
+	names := certIdentities(state.PeerCertificates[0])
+	c.mu.Lock()
+	c.certNames = names
+	if len(names) > 0 {
+		c.identity = names[0]
+	}
+	c.mu.Unlock()
+}
+
+// userFor resolves the user and permission for c against the current
+// identity map. While the map is empty every client runs as the
+// unrestricted default user. Once it has entries, clients without a
+// verified certificate run as the default user with tls-default-permission,
+// and certificates that match no entry get no access.
+func (s *TrieServer) userFor(c *client) (string, permission) {
+	m := *s.identities.Load()
+	if len(m) == 0 {
+		return "default", permAdmin
+	}
+	if len(c.certNames) == 0 {
+		return "default", permission(s.defaultPermission.Load())
+	}
+	for _, name := range c.certNames {
+		if p, ok := m[name]; ok {
+			return name, p
+		}
+	}
+	return c.certNames[0], permNone
+}
+
+// registerAuthConfig exposes the identity map and the permission of
+// clients without a certificate through CONFIG GET/SET. Changes apply to
+// connected clients from their next command.
+func (s *TrieServer) registerAuthConfig() {
+	s.addConfig("tls-default-permission",
+		func() string { return permission(s.defaultPermission.Load()).String() },
+		func(v string) error {
+			p, ok := parsePermission(v)
+			if !ok {
+				return fmt.Errorf("unknown permission %q", v)
+			}
+			s.defaultPermission.Store(int32(p))
+			return nil
+		})
+	s.addConfig("tls-identity-map",
+		func() string { return s.identities.Load().String() },
+		func(v string) error {
+			m, err := parseIdentityMap(v)
+			if err != nil {
+				return err
+			}
+			s.identities.Store(&m)
+			return nil
+		})
+}
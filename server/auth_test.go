@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+// tlsClient sends commands over a TLS connection and reads their replies.
+type tlsClient struct {
+	conn *tls.Conn
+	r    *bufio.Reader
+}
+
+// dialTLSTest connects to addr presenting a certificate for cn issued by
+// ca, or none if cn is empty.
+func dialTLSTest(t testing.TB, addr string, ca *testCA, cn string) *tlsClient {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: pool}
+	if cn != "" {
+		cert, err := tls.LoadX509KeyPair(ca.issue(t, cn, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &tlsClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do runs args and returns the first line of the reply, or the string of
+// a bulk reply, without its CRLF.
+func (tc *tlsClient) do(t testing.TB, args ...string) string {
+	t.Helper()
+	buf := redcon.AppendArray(nil, len(args))
+	for _, a := range args {
+		buf = redcon.AppendBulkString(buf, a)
+	}
+	if _, err := tc.conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	line, err := tc.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line[0] == '$' && line != "$-1\r\n" {
+		if line, err = tc.r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func TestIdentityPermissions(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server", false)
+	for _, tc := range []struct {
+		name        string
+		identityMap string
+		defaultPerm string // tls-default-permission, if set
+		cn          string // client certificate, none if empty
+		allowed     []string
+		refused     []string
+	}{
+		{name: "empty map, no certificate", allowed: []string{"GET", "SET", "CONFIG"}},
+		{name: "empty map, any certificate", cn: "stranger", allowed: []string{"GET", "SET", "CONFIG"}},
+		{name: "readonly", identityMap: "lookup=readonly", cn: "lookup", allowed: []string{"GET"}, refused: []string{"SET", "CONFIG"}},
+		{name: "readwrite", identityMap: "loader=readwrite", cn: "loader", allowed: []string{"GET", "SET"}, refused: []string{"CONFIG"}},
+		{name: "admin", identityMap: "ops=admin", cn: "ops", allowed: []string{"GET", "SET", "CONFIG"}},
+		{name: "unmapped certificate", identityMap: "ops=admin", cn: "stranger", refused: []string{"GET", "SET", "CONFIG"}},
+		{name: "no certificate", identityMap: "ops=admin", allowed: []string{"GET"}, refused: []string{"SET", "CONFIG"}},
+		{name: "no certificate, readwrite default", identityMap: "ops=admin", defaultPerm: "readwrite", allowed: []string{"GET", "SET"}, refused: []string{"CONFIG"}},
+		{name: "no certificate, no default access", identityMap: "ops=admin", defaultPerm: "none", refused: []string{"GET", "SET", "CONFIG"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.tls.port = 1
+			s.tls.certFile, s.tls.keyFile, s.tls.caCertFile = serverCert, serverKey, ca.file
+			s.tls.authClients = "optional"
+			ss := newTestSession(t, s)
+			if tc.defaultPerm != "" {
+				mustDo(t, ss, "CONFIG", "SET", "tls-default-permission", tc.defaultPerm)
+			}
+			mustDo(t, ss, "CONFIG", "SET", "tls-identity-map", tc.identityMap)
+			c := dialTLSTest(t, serveTLSTest(t, s), ca, tc.cn)
+			commands := map[string][]string{
+				"GET":    {"GET", "10.1.2.3"},
+				"SET":    {"SET", "10.0.0.0/8", "a"},
+				"CONFIG": {"CONFIG", "GET", "tls-port"},
+			}
+			for _, name := range tc.allowed {
+				if r := c.do(t, commands[name]...); strings.HasPrefix(r, "-") {
+					t.Errorf("%s = %s, want it allowed", name, r)
+				}
+			}
+			for _, name := range tc.refused {
+				if r := c.do(t, commands[name]...); !strings.HasPrefix(r, "-NOPERM") {
+					t.Errorf("%s = %s, want NOPERM", name, r)
+				}
+			}
+		})
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	s := newTestServer(t)
+	s.tls.port = 1
+	s.tls.certFile, s.tls.keyFile = ca.issue(t, "server", false)
+	s.tls.caCertFile = ca.file
+	ss := newTestSession(t, s)
+	mustDo(t, ss, "CONFIG", "SET", "tls-identity-map", "loader=readwrite")
+	c := dialTLSTest(t, serveTLSTest(t, s), ca, "loader")
+	info := c.do(t, "CLIENT", "INFO")
+	for _, field := range []string{"user=loader", "identity=loader"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("CLIENT INFO %q lacks %s", info, field)
+		}
+	}
+	if r := mustDo(t, ss, "CLIENT", "INFO"); !strings.Contains(r.Str, "user=default") || !strings.Contains(r.Str, "identity= ") {
+		t.Errorf("CLIENT INFO of a plaintext client %q, want user=default and no identity", r.Str)
+	}
+}
+
+func TestParseIdentityMap(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "", want: ""},
+		{in: "loader=readwrite,lookup=readonly", want: "loader=readwrite,lookup=readonly"},
+		{in: "ops=ADMIN lookup=ReadOnly", want: "lookup=readonly,ops=admin"},
+		{in: "banned=none", want: "banned=none"},
+		{in: "loader", wantErr: true},
+		{in: "=admin", wantErr: true},
+		{in: "loader=superuser", wantErr: true},
+	} {
+		m, err := parseIdentityMap(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseIdentityMap(%q) = %v, want an error", tc.in, m)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseIdentityMap(%q): %v", tc.in, err)
+		} else if m.String() != tc.want {
+			t.Errorf("parseIdentityMap(%q) = %q, want %q", tc.in, m, tc.want)
+		}
+	}
+}
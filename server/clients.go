@@ -0,0 +1,445 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// client is the per-connection state kept in the redcon connection context.
+type client struct {
+	id      int64
+	addr    string
+	peer    netip.Addr // remote IP; invalid for Unix sockets
+	laddr   string
+	created time.Time
+	netConn net.Conn
+	tlsConn *tls.Conn   // nil for plaintext connections
+	out     *outputConn // the connection commands reply through
+
+	db          atomic.Int64  // SELECTed database index
+	lpm         atomic.Bool   // CLIENT LPM on
+	lastActive  atomic.Int64  // unix nanoseconds of the last command
+	killed      atomic.Bool   // the server has closed this connection
+	omem        atomic.Int64  // reply bytes written and not yet flushed
+	softSince   atomic.Int64  // unix nanoseconds omem reached the soft output limit, 0 if below it
+	noEvict     atomic.Bool   // CLIENT NO-EVICT on
+	userNoEvict atomic.Bool   // the user of the last command is in no-evict-users
+	identified  bool          // TLS peer identity has been resolved
+	loading     *loadState    // a LOADALL in progress, which reads every command
+	traceParent *traceContext // trace context CLIENT TRACEPARENT set for the next command
+	held        heldShards    // read locks the pipeline batch running holds
+	budget      budget        // of the command running
+
+	// Written only by the connection's own goroutine, under mu so that
+	// CLIENT LIST on other connections can read them.
+	mu        sync.Mutex
+	name      string
+	lastCmd   string
+	identity  string   // certificate identity the client authenticated with
+	certNames []string // every name on the verified client certificate
+	bucket    tokenBucket
+}
+
+// clientRegistry tracks every open connection, like Redis's client list.
+type clientRegistry struct {
+	mu      sync.Mutex
+	nextID  int64
+	clients map[int64]*client
+	perIP   map[netip.Addr]int // open clients by remote IP
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: make(map[int64]*client), perIP: make(map[netip.Addr]int)}
+}
+
+// peerAddr returns the IP of a RemoteAddr, IPv4-mapped addresses
+// unmapped, or the zero Addr for one without an IP such as a Unix socket.
+func peerAddr(addr string) netip.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
+
+// add creates the client state for a freshly accepted connection, or
+// returns nil if peer already has perIP clients open; perIP 0 means no
+// limit. The check and the count share the lock, so connections arriving
+// together on several listeners cannot all slip under the limit.
+func (r *clientRegistry) add(conn redcon.Conn, peer netip.Addr, perIP int64) *client {
+	c := &client{
+		addr:    conn.RemoteAddr(),
+		peer:    peer,
+		created: time.Now(),
+	}
+	c.lastActive.Store(c.created.UnixNano())
+	if nc := conn.NetConn(); nc != nil {
+		c.netConn = nc
+		c.laddr = nc.LocalAddr().String()
+		c.tlsConn, _ = unwrapInline(nc).(*tls.Conn)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if peer.IsValid() {
+		if perIP > 0 && int64(r.perIP[peer]) >= perIP {
+			return nil
+		}
+		r.perIP[peer]++
+	}
+	r.nextID++
+	c.id = r.nextID
+	r.clients[c.id] = c
+	return c
+}
+
+func (r *clientRegistry) remove(c *client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, c.id)
+	if c.peer.IsValid() {
+		if r.perIP[c.peer]--; r.perIP[c.peer] <= 0 {
+			delete(r.perIP, c.peer)
+		}
+	}
+}
+
+// count returns the number of open clients.
+func (r *clientRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.clients)
+}
+
+// list returns the open clients ordered by id.
+func (r *clientRegistry) list() []*client {
+	r.mu.Lock()
+	out := make([]*client, 0, len(r.clients))
+	for _, c := range r.clients {
+		out = append(out, c)
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+// clientOf returns the state attached to conn by the accept callback.
+func clientOf(conn redcon.Conn) *client {
+	if c, ok := conn.Context().(*client); ok {
+		return c
+	}
+	return nil
+}
+
+// clientInfo formats c the way CLIENT LIST and CLIENT INFO report it.
+func (s *TrieServer) clientInfo(c *client) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	user, _ := s.userFor(c)
+	db := c.db.Load()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d dbname=%s lpm=%s user=%s identity=%s omem=%d cmd=%s %s",
+		c.id, c.addr, c.laddr, c.name, int64(time.Since(c.created).Seconds()),
+		int64(c.idle().Seconds()), clientFlags(c), db, s.names.name(int(db)), onOff(c.lpm.Load()), user, c.identity, c.omem.Load(),
+		strings.ToLower(c.lastCmd), s.bucketInfo(c, user))
+}
+
+// idle returns how long ago the client last sent a command.
+func (c *client) idle() time.Duration {
+	return time.Since(time.Unix(0, c.lastActive.Load()))
+}
+
+// accept is the redcon accept callback.
+func (s *TrieServer) accept(conn redcon.Conn) bool {
+	if limit := s.maxClients.Load(); int64(s.clients.count()) >= limit {
+		s.stats.rejectedConns.Add(1)
+		refuse(conn, "ERR max number of clients reached")
+		slog.Warn("rejecting client, maxclients reached", "addr", conn.RemoteAddr(), "maxclients", limit)
+		return false
+	}
+	peer := peerAddr(conn.RemoteAddr())
+	perIP := s.maxClientsPerIP.Load()
+	if perIP > 0 && s.perIPExempt.Load().contains(peer) {
+		perIP = 0
+	}
+	c := s.clients.add(conn, peer, perIP)
+	if c == nil {
+		s.stats.rejectedConns.Add(1)
+		s.stats.rejectedPerIP.Add(1)
+		refuse(conn, "ERR max number of clients per IP reached")
+		slog.Warn("rejecting client, maxclients-per-ip reached", "addr", conn.RemoteAddr(), "maxclients-per-ip", perIP)
+		return false
+	}
+	s.stats.connections.Add(1)
+	c.out = &outputConn{Conn: conn, s: s, c: c}
+	if cc := c.countedConn(); cc != nil {
+		cc.client = c
+	}
+	s.setSocketOptions(c)
+	conn.SetContext(c)
+	slog.Debug("client connected", "client", c.id, "addr", c.addr, "laddr", c.laddr)
+	return true
+}
+
+// refuse tells a connection the accept callback turns away why. redcon
+// flushes the error as it closes the connection. TLS clients are dropped
+// without one, as writing would run their handshake on the accept loop.
+func refuse(conn redcon.Conn, msg string) {
+	if _, isTLS := unwrapInline(conn.NetConn()).(*tls.Conn); !isTLS {
+		conn.WriteError(msg)
+	}
+}
+
+// prefixList is a set of networks, as the maxclients-per-ip-exempt
+// setting lists them.
+type prefixList []netip.Prefix
+
+// parsePrefixList parses CIDRs or bare addresses separated by spaces or
+// commas.
+func parsePrefixList(s string) (prefixList, error) {
+	var l prefixList
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		p, err := netip.ParsePrefix(f)
+		if err != nil {
+			a, aerr := netip.ParseAddr(f)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid CIDR '%s'", f)
+			}
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		l = append(l, p.Masked())
+	}
+	return l, nil
+}
+
+// contains reports whether some network in l holds a, which is never the
+// case for the zero Addr.
+func (l prefixList) contains(a netip.Addr) bool {
+	for _, p := range l {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l prefixList) String() string {
+	parts := make([]string, len(l))
+	for i, p := range l {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// countedConn returns the countedConn under c's connection, or nil for
+// one not accepted by a countingListener.
+func (c *client) countedConn() *countedConn {
+	nc := unwrapInline(c.netConn)
+	if c.tlsConn != nil {
+		nc = c.tlsConn.NetConn()
+	}
+	cc, _ := nc.(*countedConn)
+	return cc
+}
+
+// setSocketOptions applies tcp-keepalive to a newly accepted socket.
+// Changing the setting later only affects new connections.
+func (s *TrieServer) setSocketOptions(c *client) {
+	cc := c.countedConn()
+	if cc == nil {
+		return
+	}
+	tcp, ok := cc.Conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if secs := s.tcpKeepAlive.Load(); secs > 0 {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(time.Duration(secs) * time.Second)
+	} else {
+		tcp.SetKeepAlive(false)
+	}
+}
+
+// extendWriteDeadline gives the replies to the current pipeline
+// write-timeout seconds to reach the client. redcon flushes after the
+// pipeline, and a flush that misses the deadline fails and drops the
+// connection instead of the reply piling up behind a stalled peer.
+func (s *TrieServer) extendWriteDeadline(c *client) {
+	if secs := s.writeTimeout.Load(); secs > 0 && c.netConn != nil {
+		c.netConn.SetWriteDeadline(time.Now().Add(time.Duration(secs) * time.Second))
+	}
+}
+
+// closed is the redcon close callback.
+func (s *TrieServer) closed(conn redcon.Conn, err error) {
+	if c := clientOf(conn); c != nil {
+		s.clients.remove(c)
+		s.forgetThrottled(c)
+		if err != nil {
+			slog.Debug("client disconnected", "client", c.id, "addr", c.addr, "err", err)
+		} else {
+			slog.Debug("client disconnected", "client", c.id, "addr", c.addr)
+		}
+	}
+}
+
+// handleClient implements the CLIENT subcommands.
+func (s *TrieServer) handleClient(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'CLIENT'")
+		return
+	}
+	c := clientOf(conn)
+	sub := strings.ToUpper(string(cmd.Args[1]))
+
+	switch sub {
+	case "ID":
+		conn.WriteInt64(c.id)
+
+	case "INFO":
+		conn.WriteBulkString(s.clientInfo(c) + "\n")
+
+	case "LIST":
+		var b strings.Builder
+		for _, other := range s.clients.list() {
+			b.WriteString(s.clientInfo(other))
+			b.WriteByte('\n')
+		}
+		conn.WriteBulkString(b.String())
+
+	case "SETNAME":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'CLIENT SETNAME'")
+			return
+		}
+		name := string(cmd.Args[2])
+		if strings.ContainsAny(name, " \n") {
+			conn.WriteError("ERR Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		c.mu.Lock()
+		c.name = name
+		c.mu.Unlock()
+		writeOK(conn)
+
+	case "TRACEPARENT":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'CLIENT TRACEPARENT'")
+			return
+		}
+		tc, err := parseTraceParent(string(cmd.Args[2]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		c.traceParent = &tc
+		writeOK(conn)
+
+	case "NO-EVICT":
+		s.handleClientNoEvict(conn, c, cmd)
+
+	case "LPM":
+		s.handleClientLPM(conn, c, cmd)
+
+	case "KILL":
+		s.handleClientKill(conn, c, cmd)
+
+	case "GETNAME":
+		c.mu.Lock()
+		name := c.name
+		c.mu.Unlock()
+		if name == "" {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteBulkString(name)
+
+	default:
+		conn.WriteError("ERR unknown subcommand '" + sub + "' for 'CLIENT'")
+	}
+}
+
+// clientsCron runs once a second for the life of the server and closes
+// clients other than no-evict ones that have been idle longer than the
+// timeout setting, or whose
+// output has sat over the soft output limit too long without a write to
+// notice, as when a flush is stalled on a client that stopped reading.
+func (s *TrieServer) clientsCron() {
+	for range time.Tick(time.Second) {
+		timeout := time.Duration(s.timeout.Load()) * time.Second
+		for _, c := range s.clients.list() {
+			if pending := c.omem.Load(); pending > 0 {
+				s.checkOutputLimit(c, pending)
+			}
+			if timeout <= 0 || c.exempt() {
+				continue
+			}
+			if c.idle() > timeout && c.netConn != nil && c.killed.CompareAndSwap(false, true) {
+				// Closing the socket ends the connection's read loop, which
+				// then runs the close callback and unregisters the client.
+				c.netConn.Close()
+				s.idleClosed.Add(1)
+				slog.Debug("closing idle client", "client", c.id, "addr", c.addr, "idle", c.idle().Round(time.Second))
+			}
+		}
+	}
+}
+
+// registerClientConfig exposes the client settings through CONFIG GET/SET.
+func (s *TrieServer) registerClientConfig() {
+	seconds := func(name string, v *atomic.Int64) {
+		s.addConfig(name,
+			func() string { return strconv.FormatInt(v.Load(), 10) },
+			func(arg string) error {
+				n, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil || n < 0 {
+					return fmt.Errorf("argument must be a non-negative number of seconds")
+				}
+				v.Store(n)
+				return nil
+			})
+	}
+	seconds("timeout", &s.timeout)
+	seconds("tcp-keepalive", &s.tcpKeepAlive)
+	seconds("write-timeout", &s.writeTimeout)
+	s.addConfig("maxclients",
+		func() string { return strconv.FormatInt(s.maxClients.Load(), 10) },
+		func(arg string) error {
+			n, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil || n < 1 {
+				return fmt.Errorf("argument must be a positive number of clients")
+			}
+			s.maxClients.Store(n)
+			return nil
+		})
+	s.addConfig("maxclients-per-ip",
+		func() string { return strconv.FormatInt(s.maxClientsPerIP.Load(), 10) },
+		func(arg string) error {
+			n, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("argument must be a non-negative number of clients")
+			}
+			s.maxClientsPerIP.Store(n)
+			return nil
+		})
+	s.addConfig("maxclients-per-ip-exempt",
+		func() string { return s.perIPExempt.Load().String() },
+		func(arg string) error {
+			l, err := parsePrefixList(arg)
+			if err != nil {
+				return err
+			}
+			s.perIPExempt.Store(&l)
+			return nil
+		})
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveTest(t, s)
+	go s.clientsCron()
+	ss := newTestSession(t, s)
+	mustDo(t, ss, "CONFIG", "SET", "timeout", "1")
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, bufio.NewReader(conn)
+	}
+	ping := func(conn net.Conn, r *bufio.Reader) error {
+		if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+			return err
+		}
+		_, err := r.ReadString('\n')
+		return err
+	}
+	idle, idleR := dial()
+	active, activeR := dial()
+	for _, c := range []struct {
+		conn net.Conn
+		r    *bufio.Reader
+	}{{idle, idleR}, {active, activeR}} {
+		if err := ping(c.conn, c.r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+		if err := ping(active, activeR); err != nil {
+			t.Fatalf("active client closed: %v", err)
+		}
+	}
+
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idleR.ReadByte(); err == nil {
+		t.Error("idle client still open past the timeout")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("idle client still open past the timeout")
+	}
+	if info := mustDo(t, ss, "INFO", "stats").Str; !strings.Contains(info, "idle_timeout_disconnections:1\r\n") {
+		t.Errorf("INFO stats %q, want one idle disconnection", info)
+	}
+}
+
+func TestTimeoutConfig(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, tc := range []struct {
+		value   string
+		wantErr bool
+	}{
+		{"0", false},
+		{"300", false},
+		{"-1", true},
+		{"1.5", true},
+		{"soon", true},
+	} {
+		err := ss.Do("CONFIG", "SET", "timeout", tc.value).Err()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("CONFIG SET timeout %s: %v, want error %v", tc.value, err, tc.wantErr)
+		}
+		if err == nil {
+			if got := mustDo(t, ss, "CONFIG", "GET", "timeout").strs(); got[1] != tc.value {
+				t.Errorf("CONFIG GET timeout = %s, want %s", got[1], tc.value)
+			}
+		}
+	}
+}
+
+func TestClientListIdle(t *testing.T) {
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	clientOf(ss.conn).lastActive.Store(time.Now().Add(-90 * time.Second).UnixNano())
+	if r := mustDo(t, newTestSession(t, s), "CLIENT", "LIST"); !strings.Contains(r.Str, " idle=90 ") {
+		t.Errorf("CLIENT LIST %q, want a client idle=90", r.Str)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		writeTimeout string
+		wantDropped  bool
+	}{
+		{"0", false},
+		{"1", true},
+	} {
+		t.Run("write-timeout="+tc.writeTimeout, func(t *testing.T) {
+			t.Parallel()
+			s := newTestServer(t)
+			ss := newTestSession(t, s)
+			mustDo(t, ss, "CONFIG", "SET", "write-timeout", tc.writeTimeout)
+			mustDo(t, ss, "SET", "10.0.0.0/8", strings.Repeat("x", 100<<10))
+
+			// A client that sends a pipeline of large replies and never
+			// reads them stalls the server's flush.
+			conn, err := net.Dial("tcp", serveTest(t, s))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.(*net.TCPConn).SetReadBuffer(4096)
+			if _, err := conn.Write([]byte(strings.Repeat("GET 10.1.2.3\r\n", 200))); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2500 * time.Millisecond)
+			if n := strings.Count(mustDo(t, ss, "CLIENT", "LIST").Str, "\n"); (n == 1) != tc.wantDropped {
+				t.Errorf("%d clients listed, want the stalled one dropped: %v", n, tc.wantDropped)
+			}
+		})
+	}
+}
+
+func TestSocketConfig(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, tc := range []struct {
+		name, value string
+		wantErr     bool
+	}{
+		{"tcp-keepalive", "60", false},
+		{"tcp-keepalive", "0", false},
+		{"tcp-keepalive", "-5", true},
+		{"write-timeout", "10", false},
+		{"write-timeout", "never", true},
+	} {
+		err := ss.Do("CONFIG", "SET", tc.name, tc.value).Err()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("CONFIG SET %s %s: %v, want error %v", tc.name, tc.value, err, tc.wantErr)
+		}
+		if err == nil {
+			if got := mustDo(t, ss, "CONFIG", "GET", tc.name).strs(); got[1] != tc.value {
+				t.Errorf("CONFIG GET %s = %s, want %s", tc.name, got[1], tc.value)
+			}
+		}
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveTest(t, s)
+	ss := newTestSession(t, s)
+	mustDo(t, ss, "CONFIG", "SET", "maxclients", "3")
+	for i, want := range []string{"+PONG\r\n", "+PONG\r\n", "-ERR max number of clients reached\r\n"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("PING\r\n"))
+		if got, _ := bufio.NewReader(conn).ReadString('\n'); got != want {
+			t.Errorf("connection %d: %q, want %q", i+2, got, want)
+		}
+	}
+	fields := infoFields(mustDo(t, ss, "INFO").Str)
+	for field, want := range map[string]string{"connected_clients": "3", "maxclients": "3", "rejected_connections": "1"} {
+		if fields[field] != want {
+			t.Errorf("%s:%s, want %s", field, fields[field], want)
+		}
+	}
+	if err := ss.Do("CONFIG", "SET", "maxclients", "0").Err(); err == nil {
+		t.Error("CONFIG SET maxclients 0 succeeded")
+	}
+}
+
+func TestRecentPeak(t *testing.T) {
+	base := time.Unix(1000, 0)
+	var p recentPeak
+	for _, tc := range []struct {
+		observe int64 // 0 observes nothing
+		at      int   // seconds after base
+		want    int64
+	}{
+		{observe: 100, at: 0, want: 100},
+		{observe: 50, at: 1, want: 100},
+		{observe: 0, at: 7, want: 100},
+		{observe: 0, at: 8, want: 50},
+		{observe: 70, at: 9, want: 70},
+		{observe: 0, at: 30, want: 0},
+	} {
+		now := base.Add(time.Duration(tc.at) * time.Second)
+		if tc.observe > 0 {
+			p.observe(tc.observe, now)
+		}
+		if got := p.value(now); got != tc.want {
+			t.Errorf("peak at +%ds = %d, want %d", tc.at, got, tc.want)
+		}
+	}
+}
+
+func TestParsePrefixList(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string // String() of the list
+		wantErr bool
+	}{
+		{in: "", want: ""},
+		{in: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{in: "10.1.2.3/8, 192.0.2.1 2001:db8::1", want: "10.0.0.0/8,192.0.2.1/32,2001:db8::1/128"},
+		{in: "10.0.0.0/8,,127.0.0.1", want: "10.0.0.0/8,127.0.0.1/32"},
+		{in: "10.0.0.0/33", wantErr: true},
+		{in: "localhost", wantErr: true},
+	} {
+		l, err := parsePrefixList(tc.in)
+		if (err != nil) != tc.wantErr || err == nil && l.String() != tc.want {
+			t.Errorf("parsePrefixList(%q) = %q, %v; want %q", tc.in, l, err, tc.want)
+		}
+	}
+	l, _ := parsePrefixList("10.0.0.0/8,2001:db8::/32")
+	for a, want := range map[string]bool{"10.1.2.3": true, "11.0.0.1": false, "2001:db8::5": true, "::ffff:10.1.2.3": false} {
+		if got := l.contains(netip.MustParseAddr(a)); got != want {
+			t.Errorf("contains(%s) = %v, want %v", a, got, want)
+		}
+	}
+	if l.contains(netip.Addr{}) {
+		t.Error("contains the zero Addr, as of a Unix socket client")
+	}
+}
+
+// TestMaxClientsPerIPRace opens connections from one IP all at once over
+// two listeners, whose accept callbacks run concurrently, and checks that
+// exactly maxclients-per-ip of them get in.
+func TestMaxClientsPerIPRace(t *testing.T) {
+	for _, exempt := range []string{"", "127.0.0.0/8"} {
+		const limit, dials = 5, 40
+		s := newTestServer(t)
+		ss := newTestSession(t, s)
+		mustDo(t, ss, "CONFIG", "SET", "maxclients-per-ip", strconv.Itoa(limit), "maxclients-per-ip-exempt", exempt)
+		if err := s.Listen([]string{"127.0.0.1:0", "127.0.0.1:0"}); err != nil {
+			t.Fatal(err)
+		}
+		ls := s.listeners
+		for _, l := range ls {
+			go l.srv.Serve(l.ln)
+			t.Cleanup(func() { l.srv.Close() })
+		}
+
+		var mu sync.Mutex
+		var in []net.Conn
+		refused := 0
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := range dials {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				conn, err := net.Dial("tcp", ls[i%2].addr)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				t.Cleanup(func() { conn.Close() })
+				conn.Write([]byte("PING\r\n"))
+				reply, err := bufio.NewReader(conn).ReadString('\n')
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case reply == "+PONG\r\n":
+					in = append(in, conn)
+				case strings.HasPrefix(reply, "-ERR max number of clients per IP"):
+					refused++
+				default:
+					t.Errorf("PING: %q, %v", reply, err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		want := limit - 1 // the test session counts as a client from 127.0.0.1
+		if exempt != "" {
+			want = dials
+		}
+		if len(in) != want || refused != dials-want {
+			t.Fatalf("exempt %q: %d of %d connections got in and %d were refused, want %d in", exempt, len(in), dials, refused, want)
+		}
+		fields := infoFields(mustDo(t, ss, "INFO", "stats").Str)
+		if got := fields["rejected_connections_per_ip"]; got != strconv.Itoa(dials-want) {
+			t.Fatalf("exempt %q: rejected_connections_per_ip:%s, want %d", exempt, got, dials-want)
+		}
+		if exempt != "" {
+			continue
+		}
+
+		// Closing a connection frees its slot for the next one.
+		open := s.clients.count()
+		in[0].Close()
+		for deadline := time.Now().Add(5 * time.Second); s.clients.count() == open; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("the closed connection was never removed")
+			}
+		}
+		conn, err := net.Dial("tcp", ls[0].addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("PING\r\n"))
+		if reply, err := bufio.NewReader(conn).ReadString('\n'); reply != "+PONG\r\n" {
+			t.Fatalf("PING after a connection closed: %q, %v", reply, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import "strings"
+
+// cmdFlags classify commands for permission checks.
+type cmdFlags uint8
+
+const (
+	cmdRead  cmdFlags = 1 << iota // needs no more than read access
+	cmdWrite                      // modifies the dataset, refused in read-only mode
+	cmdAdmin                      // reconfigures or inspects the server
+	cmdDBArg                      // a write whose target DB is an argument, checked by the handler
+	cmdFrees                      // a write that only frees memory, allowed over maxmemory
+)
+
+// commandTable lists every command HandleCommand understands.
+var commandTable = map[string]cmdFlags{
+	"PING":         cmdRead,
+	"ECHO":         cmdRead,
+	"SELECT":       cmdRead,
+	"GET":          cmdRead,
+	"MGET":         cmdRead,
+	"SPM":          cmdRead,
+	"MATCHDBS":     cmdRead,
+	"OWNER":        cmdRead,
+	"SHARDMAP":     cmdRead,
+	"TOMBSTONES":   cmdRead,
+	"LCP":          cmdRead,
+	"LCPKEYS":      cmdRead,
+	"DBSIZE":       cmdRead,
+	"INFO":         cmdRead,
+	"CLIENT":       cmdRead,
+	"RESET":        cmdRead,
+	"PREFIXSTATS":  cmdRead,
+	"HOTKEYS":      cmdRead,
+	"DBDIFF":       cmdRead,
+	"DBSTATS":      cmdRead,
+	"SHOWDBS":      cmdRead,
+	"KEYS":         cmdRead,
+	"SCAN":         cmdRead,
+	"FIRSTKEY":     cmdRead,
+	"NEXTKEY":      cmdRead,
+	"SUBNETS":      cmdRead,
+	"TREEGET":      cmdRead,
+	"VKEYS":        cmdRead,
+	"VCOUNT":       cmdRead,
+	"TAG":          cmdRead, // ADD and DEL check for write access in handleTag
+	"TAGKEYS":      cmdRead,
+	"MEMORY":       cmdRead,
+	"JGET":         cmdRead,
+	"HGET":         cmdRead,
+	"HMGET":        cmdRead,
+	"HGETALL":      cmdRead,
+	"HEXISTS":      cmdRead,
+	"HLOOKUP":      cmdRead,
+	"STRLEN":       cmdRead,
+	"GETRANGE":     cmdRead,
+	"OBJECT":       cmdRead,
+	"TOUCH":        cmdRead,
+	"TYPE":         cmdRead,
+	"SMEMBERS":     cmdRead,
+	"SCARD":        cmdRead,
+	"SISMEMBER":    cmdRead,
+	"SMATCH":       cmdRead,
+	"TTL":          cmdRead,
+	"PTTL":         cmdRead,
+	"SET":          cmdWrite,
+	"SETEX":        cmdWrite,
+	"PSETEX":       cmdWrite,
+	"SETIF":        cmdWrite,
+	"JSET":         cmdWrite,
+	"JDEL":         cmdWrite | cmdFrees,
+	"HSET":         cmdWrite,
+	"HDEL":         cmdWrite | cmdFrees,
+	"INCR":         cmdWrite,
+	"DECR":         cmdWrite,
+	"INCRBY":       cmdWrite,
+	"DECRBY":       cmdWrite,
+	"INCRBYFLOAT":  cmdWrite,
+	"APPEND":       cmdWrite,
+	"SADD":         cmdWrite,
+	"SREM":         cmdWrite | cmdFrees,
+	"DEL":          cmdWrite | cmdFrees,
+	"DELVALUE":     cmdWrite | cmdFrees,
+	"TREEEXPIRE":   cmdWrite | cmdFrees,
+	"RESTOREKEY":   cmdWrite,
+	"FLUSHDB":      cmdWrite | cmdFrees,
+	"FLUSHFAMILY":  cmdWrite | cmdFrees,
+	"DBMERGE":      cmdWrite | cmdDBArg,
+	"DROPDB":       cmdWrite | cmdDBArg | cmdFrees,
+	"CONFIG":       cmdAdmin,
+	"DEBUG":        cmdAdmin,
+	"NAMEDB":       cmdAdmin,
+	"DBREADONLY":   cmdAdmin,
+	"SETDEFAULT":   cmdAdmin,
+	"SAVE":         cmdAdmin,
+	"BGSAVE":       cmdAdmin,
+	"LASTSAVE":     cmdRead,
+	"WAITAOF":      cmdRead,
+	"SNAPSHOTINFO": cmdAdmin,
+	"JOURNAL":      cmdAdmin,
+	"RESTOREDB":    cmdAdmin | cmdWrite | cmdDBArg,
+	"IMPORT":       cmdAdmin | cmdWrite | cmdDBArg,
+	"LOADALL":      cmdAdmin | cmdWrite | cmdDBArg,
+	"LOADSTAGE":    cmdAdmin | cmdWrite | cmdDBArg,
+	"COMMITSTAGE":  cmdAdmin | cmdWrite | cmdDBArg,
+	"ABORTSTAGE":   cmdAdmin,
+	"EXPORT":       cmdAdmin,
+	"DUMPALL":      cmdAdmin,
+}
+
+// commandNames maps each command's name, uppercase or lowercase, to the
+// uppercase string commandTable holds, so the usual spellings are
+// resolved without allocating.
+var commandNames = func() map[string]string {
+	m := make(map[string]string, 2*len(commandTable))
+	for name := range commandTable {
+		m[name] = name
+		m[strings.ToLower(name)] = name
+	}
+	return m
+}()
+
+// commandName returns arg, a command's first argument, uppercased.
+func commandName(arg []byte) string {
+	if name, ok := commandNames[string(arg)]; ok {
+		return name
+	}
+	return strings.ToUpper(string(arg))
+}
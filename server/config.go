@@ -0,0 +1,142 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// configParam is a single parameter exposed through CONFIG GET/SET.
+type configParam struct {
+	get func() string
+	set func(value string) error // nil when the parameter is fixed at startup
+
+	// apply, when non-nil, runs once after every value in a CONFIG SET call
+	// has been stored. Parameters that must change together (a certificate
+	// and its key) share one apply hook.
+	apply *configApply
+}
+
+// configApply is a hook shared by related parameters.
+type configApply struct {
+	fn func() error
+}
+
+// addConfig registers a CONFIG parameter. Names are matched lowercase.
+func (s *TrieServer) addConfig(name string, get func() string, set func(string) error) *configParam {
+	p := &configParam{get: get, set: set}
+	s.config[strings.ToLower(name)] = p
+	return p
+}
+
+// handleConfig implements CONFIG GET <pattern> and
+// CONFIG SET <name> <value> [<name> <value> ...].
+func (s *TrieServer) handleConfig(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'CONFIG'")
+		return
+	}
+	sub := strings.ToUpper(string(cmd.Args[1]))
+
+	switch sub {
+	case "GET":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'CONFIG GET'")
+			return
+		}
+		pattern := strings.ToLower(string(cmd.Args[2]))
+		var names []string
+		for name := range s.config {
+			if match.Match(name, pattern) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		conn.WriteArray(len(names) * 2)
+		for _, name := range names {
+			conn.WriteBulkString(name)
+			conn.WriteBulkString(s.config[name].get())
+		}
+
+	case "SET":
+		if len(cmd.Args) < 4 || len(cmd.Args)%2 != 0 {
+			conn.WriteError("ERR wrong number of arguments for 'CONFIG SET'")
+			return
+		}
+		if err := s.setConfig(cmd.Args[2:]); err != nil {
+			writeError(conn, err)
+			return
+		}
+		writeOK(conn)
+
+	case "RESETSTAT":
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for 'CONFIG RESETSTAT'")
+			return
+		}
+		s.resetStats()
+		writeOK(conn)
+
+	default:
+		conn.WriteError("ERR unknown subcommand '" + sub + "' for 'CONFIG'")
+	}
+}
+
+// setConfig stores every name/value pair and then runs the apply hooks,
+// rolling all values back if any step fails so CONFIG SET is all-or-nothing.
+func (s *TrieServer) setConfig(pairs [][]byte) error {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	type change struct {
+		name string
+		p    *configParam
+		old  string
+	}
+	var changes []change
+	rollback := func() {
+		for i := len(changes) - 1; i >= 0; i-- {
+			changes[i].p.set(changes[i].old)
+		}
+	}
+	failed := func(name, reason string) error {
+		return newError(ClassErr, "CONFIG SET failed (possibly related to argument '"+name+"') - "+reason)
+	}
+
+	for i := 0; i < len(pairs); i += 2 {
+		name := strings.ToLower(string(pairs[i]))
+		p, ok := s.config[name]
+		if !ok {
+			rollback()
+			return newError(ClassErr, "Unknown option or number of arguments for CONFIG SET - '"+name+"'")
+		}
+		if p.set == nil {
+			rollback()
+			return failed(name, "can't set immutable config")
+		}
+		old := p.get()
+		if err := p.set(string(pairs[i+1])); err != nil {
+			rollback()
+			return failed(name, err.Error())
+		}
+		changes = append(changes, change{name, p, old})
+	}
+
+	applied := make(map[*configApply]bool)
+	for _, c := range changes {
+		if c.p.apply == nil || applied[c.p.apply] {
+			continue
+		}
+		applied[c.p.apply] = true
+		if err := c.p.apply.fn(); err != nil {
+			rollback()
+			for a := range applied {
+				a.fn()
+			}
+			return failed(c.name, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConfigSet(t *testing.T) {
+	ca := newTestCA(t)
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		wantErr string            // prefix of the error, if any
+		want    map[string]string // CONFIG GET afterwards
+	}{
+		{
+			name: "one parameter",
+			args: []string{"tls-auth-clients", "optional"},
+			want: map[string]string{"tls-auth-clients": "optional"},
+		},
+		{
+			name: "names are case-insensitive",
+			args: []string{"TLS-Auth-Clients", "no"},
+			want: map[string]string{"tls-auth-clients": "no"},
+		},
+		{
+			name: "several parameters",
+			args: []string{"tls-ca-cert-file", ca.file, "tls-auth-clients", "no"},
+			want: map[string]string{"tls-ca-cert-file": ca.file, "tls-auth-clients": "no"},
+		},
+		{
+			name:    "unknown parameter",
+			args:    []string{"tls-auth-clients", "no", "no-such-option", "1"},
+			wantErr: "ERR Unknown option",
+			want:    map[string]string{"tls-auth-clients": "yes"},
+		},
+		{
+			name:    "immutable parameter",
+			args:    []string{"tls-port", "6380"},
+			wantErr: "ERR CONFIG SET failed",
+			want:    map[string]string{"tls-port": "0"},
+		},
+		{
+			name:    "bad value rolls back earlier pairs",
+			args:    []string{"tls-ca-cert-file", ca.file, "tls-auth-clients", "maybe"},
+			wantErr: "ERR CONFIG SET failed (possibly related to argument 'tls-auth-clients')",
+			want:    map[string]string{"tls-ca-cert-file": "", "tls-auth-clients": "yes"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := newTestSession(t, newTestServer(t))
+			r := ss.Do(append([]string{"CONFIG", "SET"}, tc.args...)...)
+			if err := r.Err(); tc.wantErr == "" && err != nil {
+				t.Fatal(err)
+			} else if tc.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.wantErr)) {
+				t.Fatalf("CONFIG SET = %v, want %q", err, tc.wantErr)
+			}
+			for name, want := range tc.want {
+				if got := mustDo(t, ss, "CONFIG", "GET", name).strs(); !slices.Equal(got, []string{name, want}) {
+					t.Errorf("CONFIG GET %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigGetPattern(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"tls-port", []string{"tls-port"}},
+		{"tls-*-file", []string{"tls-ca-cert-file", "tls-cert-file", "tls-key-file"}},
+		{"TLS-AUTH-*", []string{"tls-auth-clients"}},
+		{"nothing*", nil},
+	} {
+		r := mustDo(t, ss, "CONFIG", "GET", tc.pattern).strs()
+		var names []string
+		for i := 0; i < len(r); i += 2 {
+			names = append(names, r[i])
+		}
+		if !slices.Equal(names, tc.want) {
+			t.Errorf("CONFIG GET %s names %q, want %q", tc.pattern, names, tc.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"net/netip"
+	"runtime"
+
+	"github.com/tannerklineintz/triedis/trie"
+)
+
+// Snapshots are written without stopping writers. Starting one briefly
+// write-locks every shard of the databases being saved, notes their key
+// counts and arms the shards. From then on the first write to a prefix
+// the walk has not reached yet keeps the value it replaces. The walk
+// copies each shard a chunk at a time under its read lock, using a kept
+// value in place of the live one, and ends with the kept values of
+// prefixes deleted before it got to them. The file thus holds every
+// database as it was when the snapshot started, and the extra memory is
+// one kept value per prefix written during the save, not a copy of the
+// dataset.
+
+// snapshotChunk is how many prefixes the walk copies per lock hold.
+const snapshotChunk = 1024
+
+// preimage is a prefix's content when the snapshot started.
+type preimage struct {
+	v  value
+	ok bool // false if the prefix was not stored then
+}
+
+// shardSnapshot is a snapshot's progress through one shard. Writers only
+// touch it under the shard's write lock; the walk, the only other user,
+// advances it under the read lock.
+type shardSnapshot struct {
+	cursor netip.Prefix              // the last prefix the walk copied; invalid before the first
+	before map[netip.Prefix]preimage // kept values of prefixes written ahead of the cursor
+	frozen *trie.Trie[value]         // the trie as a FLUSHDB during the walk left it
+}
+
+// preserve keeps p's current content for an armed snapshot before a
+// write changes it. The caller holds sh write-locked.
+func (sh *shard) preserve(p netip.Prefix) {
+	sn := sh.snap
+	if sn == nil || sn.frozen != nil {
+		return // no snapshot, or one reading a trie no longer written to
+	}
+	if sn.cursor.IsValid() && comparePrefixes(p, sn.cursor) <= 0 {
+		return // already copied
+	}
+	if _, kept := sn.before[p]; kept {
+		return // only the first write counts
+	}
+	v, ok := sh.trie.Get(p)
+	sn.before[p] = preimage{v, ok}
+}
+
+// detach empties sh for FLUSHDB, returning the old trie for the caller to
+// dispose of. An armed snapshot keeps the old trie to itself instead, so
+// the flush copies nothing, and detach returns nil.
+func (sh *shard) detach() *trie.Trie[value] {
+	old := sh.trie
+	sh.trie = trie.New[value]()
+	if sn := sh.snap; sn != nil && sn.frozen == nil {
+		sn.frozen = old
+		return nil
+	}
+	return old
+}
+
+// dbSnapshot is one database being saved.
+type dbSnapshot struct {
+	db     *database
+	keys   int64       // prefixes stored when the snapshot started
+	graves []tombstone // its tombstones then
+}
+
+// beginSnapshot arms every shard of dbs, which are ordered by id, at one
+// instant, so the databases are saved as they were at the same moment.
+func beginSnapshot(dbs []*database) map[int]*dbSnapshot {
+	unlocks := make([]func(), 0, len(dbs))
+	for _, db := range dbs {
+		unlocks = append(unlocks, db.lockAll())
+	}
+	out := make(map[int]*dbSnapshot, len(dbs))
+	for _, db := range dbs {
+		for _, sh := range db.allShards() {
+			sh.snap = &shardSnapshot{before: make(map[netip.Prefix]preimage)}
+		}
+		out[db.id] = &dbSnapshot{db: db, keys: db.keyCount(), graves: db.graves.list(netip.Prefix{})}
+	}
+	for _, unlock := range unlocks {
+		unlock()
+	}
+	return out
+}
+
+// each calls fn, outside any lock, for every prefix stored when the
+// snapshot started, with the value it had then, disarming each shard
+// once it is done.
+func (ds *dbSnapshot) each(fn func(entry)) {
+	buf := make([]entry, 0, snapshotChunk)
+	for _, sh := range ds.db.allShards() {
+		for more := true; more; {
+			buf, more = buf[:0], false
+			sh.mu.RLock()
+			sn := sh.snap
+			t := sh.trie
+			if sn.frozen != nil {
+				t = sn.frozen
+			}
+			t.Ascend(sn.cursor, func(p netip.Prefix, v value) bool {
+				if len(buf) == snapshotChunk {
+					more = true
+					return false
+				}
+				sn.cursor = p
+				if pre, kept := sn.before[p]; kept {
+					delete(sn.before, p)
+					if !pre.ok {
+						return true // stored since the snapshot started
+					}
+					v = pre.v
+				}
+				buf = append(buf, entry{p, v})
+				return true
+			})
+			sh.mu.RUnlock()
+			for _, e := range buf {
+				fn(e)
+			}
+			runtime.Gosched() // let clients in between chunks, even on one CPU
+		}
+		// What is still kept was deleted before the walk reached it.
+		buf = buf[:0]
+		sh.mu.Lock()
+		for p, pre := range sh.snap.before {
+			if pre.ok {
+				buf = append(buf, entry{p, pre.v})
+			}
+		}
+		sh.snap = nil
+		sh.mu.Unlock()
+		for _, e := range buf {
+			fn(e)
+		}
+	}
+}
+
+// end disarms the shards of a snapshot abandoned before each finished.
+func (ds *dbSnapshot) end() {
+	for _, sh := range ds.db.allShards() {
+		sh.mu.Lock()
+		sh.snap = nil
+		sh.mu.Unlock()
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"maps"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+)
+
+func TestSnapshotIsolation(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// write changes the database, given every prefix stored when the
+		// snapshot started.
+		write func(ss *testSession, keys []string)
+		// during runs write from within the walk, after its first prefix,
+		// instead of before it.
+		during bool
+	}{
+		{name: "nothing", write: func(*testSession, []string) {}},
+		{name: "overwrite", write: func(ss *testSession, keys []string) {
+			for _, k := range keys {
+				ss.Do("SET", k, "new")
+			}
+		}},
+		{name: "overwrite during walk", during: true, write: func(ss *testSession, keys []string) {
+			for _, k := range keys {
+				ss.Do("SET", k, "new")
+			}
+		}},
+		{name: "delete", write: func(ss *testSession, keys []string) {
+			for _, k := range keys {
+				ss.Do("DEL", k)
+			}
+		}},
+		{name: "delete during walk", during: true, write: func(ss *testSession, keys []string) {
+			for _, k := range keys {
+				ss.Do("DEL", k)
+			}
+		}},
+		{name: "new prefixes during walk", during: true, write: func(ss *testSession, keys []string) {
+			for i := range 1000 {
+				ss.Do("SET", netip.PrefixFrom(netip.AddrFrom4([4]byte{240, byte(i >> 8), byte(i), 0}), 24).String(), "new")
+			}
+		}},
+		{name: "overwrite then delete", during: true, write: func(ss *testSession, keys []string) {
+			for _, k := range keys {
+				ss.Do("HSET", k, "f", "v")
+				ss.Do("DEL", k)
+			}
+		}},
+		{name: "flushdb", write: func(ss *testSession, _ []string) { ss.Do("FLUSHDB") }},
+		{name: "flushdb during walk", during: true, write: func(ss *testSession, _ []string) { ss.Do("FLUSHDB") }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			ss := newTestSession(t, s)
+			db := s.getDB(0)
+			r := rand.New(rand.NewPCG(1, 2))
+			want := make(map[netip.Prefix]string)
+			var keys []string
+			for len(want) < 3*snapshotChunk {
+				p := randomPrefix(r, 4, 8)
+				if _, dup := want[p]; !dup {
+					want[p] = p.String()
+					keys = append(keys, p.String())
+					db.store(p, stringValue([]byte(p.String())), true)
+				}
+			}
+
+			ds := beginSnapshot([]*database{db})[0]
+			if ds.keys != int64(len(want)) {
+				t.Errorf("snapshot of %d keys, want %d", ds.keys, len(want))
+			}
+			if !tc.during {
+				tc.write(ss, keys)
+			}
+			got := make(map[netip.Prefix]string)
+			ds.each(func(e entry) {
+				if _, dup := got[e.prefix]; dup {
+					t.Errorf("%s written twice", e.prefix)
+				}
+				got[e.prefix] = string(e.value.str)
+				if tc.during && len(got) == 1 {
+					tc.write(ss, keys)
+				}
+			})
+			if !maps.Equal(got, want) {
+				t.Errorf("snapshot holds %d prefixes, %d of them as stored when it started", len(got), countEqual(got, want))
+			}
+			for _, sh := range db.allShards() {
+				if sh.snap != nil {
+					t.Fatal("a shard is still armed after the walk")
+				}
+			}
+		})
+	}
+}
+
+// countEqual counts the prefixes got and want agree on.
+func countEqual(got, want map[netip.Prefix]string) int {
+	n := 0
+	for p, v := range got {
+		if w, ok := want[p]; ok && w == v {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,1147 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tannerklineintz/triedis/trie"
+)
+
+// entryOverhead estimates the bytes a stored prefix costs beyond its value
+// data: its trie node, the glue node a path-compressed trie adds for at
+// most every stored prefix, the value's headers, which the node holds
+// apart from itself, and its access record.
+const entryOverhead = 216
+
+// entrySize estimates the memory attributable to one stored prefix. The
+// key itself is encoded in the trie path, so it costs no bytes of its own.
+// MEMORY USAGE and the dataset totals both use it, so they always agree.
+func entrySize(v value) int64 {
+	return entryOverhead + v.size()
+}
+
+var (
+	errInvalidPrefix = errors.New("invalid IP/CIDR")
+	errBareIP        = errors.New("bare IP address not allowed, add a prefix length such as /32 or /128")
+	errMappedKey     = errors.New("IPv4-mapped IPv6 prefix not allowed, use the IPv4 form")
+)
+
+// ipv4-mapped modes: how ::ffff:a.b.c.d addresses and prefixes of /96 and
+// longer are treated. Lookups unmap them in every mode but native.
+const (
+	mappedConvert int32 = iota // store and look up as the IPv4 prefix
+	mappedReject               // look up as IPv4, refuse as a key
+	mappedNative               // genuinely IPv6, never matching IPv4
+)
+
+var mappedModes = []string{"convert", "reject", "native"}
+
+// unmap returns the IPv4 prefix an IPv4-mapped one stands for, and
+// whether p was one.
+func unmap(p netip.Prefix) (netip.Prefix, bool) {
+	if !p.Addr().Is4In6() || p.Bits() < 96 {
+		return p, false
+	}
+	return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96), true
+}
+
+// parsePrefix parses a CIDR or a bare address, which stands for its host
+// prefix, into canonical form: host bits masked off and any IPv6 zone
+// dropped. Every spelling of a prefix netip accepts, uppercase or
+// uncompressed IPv6 included, yields the same key, and so do IPv4 octets
+// and prefix lengths with leading zeros, which netip refuses:
+// 010.00.0.0/08 is 10.0.0.0/8. The octets are read as decimal, never as
+// the octal inet_aton would take them for.
+func parsePrefix(key string) (netip.Prefix, error) {
+	p, err := parseUnmasked(key)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Masked(), nil
+}
+
+// parseUnmasked is parsePrefix without the masking.
+func parseUnmasked(key string) (netip.Prefix, error) {
+	addrPart, lenPart, hasLen := strings.Cut(key, "/")
+	addr, err := netip.ParseAddr(addrPart)
+	if err != nil {
+		if addr, err = netip.ParseAddr(trimOctetZeros(addrPart)); err != nil {
+			return netip.Prefix{}, errInvalidPrefix
+		}
+	}
+	addr = addr.WithZone("")
+	if !hasLen {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	// Decimal digits only, no sign.
+	n, err := strconv.Atoi(lenPart)
+	if err != nil || lenPart[0] < '0' || lenPart[0] > '9' {
+		return netip.Prefix{}, errInvalidPrefix
+	}
+	p := netip.PrefixFrom(addr, n)
+	if !p.IsValid() {
+		return netip.Prefix{}, errInvalidPrefix
+	}
+	return p, nil
+}
+
+// trimOctetZeros drops the leading zeros of the dotted IPv4 octets in an
+// address, the whole address or the tail of an IPv6 one, so 010.0.0.1
+// becomes 10.0.0.1 and ::ffff:010.0.0.1 becomes ::ffff:10.0.0.1.
+func trimOctetZeros(addr string) string {
+	head, quad := "", addr
+	if i := strings.LastIndexByte(addr, ':'); i >= 0 {
+		head, quad = addr[:i+1], addr[i+1:]
+	}
+	if !strings.Contains(quad, ".") {
+		return addr
+	}
+	octets := strings.Split(quad, ".")
+	for i, o := range octets {
+		if t := strings.TrimLeft(o, "0"); t != o {
+			if t == "" {
+				t = "0"
+			}
+			octets[i] = t
+		}
+	}
+	return head + strings.Join(octets, ".")
+}
+
+// v6ShardSkip is how many leading bits IPv6 shard selection skips. Nearly
+// all routed IPv6 space sits in 2000::/3, so the top bits would put almost
+// every prefix in the same shard.
+//
+// The price is that IPv6 shard order is not address order. The shards
+// split each /3 in order, but every shard holds a range of every /3:
+// 2000::/16 and 4000::/16 share the first shard, while 3000::/16, between
+// them, is in a later one. Anything listing IPv6 prefixes in address order
+// merges the shards' walks.
+const v6ShardSkip = 3
+
+// storeOptions are the server-wide storage settings every database reads.
+type storeOptions struct {
+	shardBits  int          // each database has 1<<shardBits shards per family; fixed at startup
+	interning  atomic.Bool  // share identical values between prefixes
+	requireLen atomic.Bool  // refuse bare addresses as keys
+	rejectHost atomic.Bool  // refuse SET of a prefix with host bits set
+	mapped     atomic.Int32 // one of the mapped* modes
+	lfu        atomic.Bool  // count accesses for OBJECT FREQ
+	lazyFlush  atomic.Bool  // FLUSHDB and DROPDB free in the background
+	valueIndex atomic.Bool  // index prefixes by value for VKEYS
+
+	hotKeys     atomic.Bool  // track the most matched prefixes for HOTKEYS
+	hotKeysRate atomic.Int64 // observing one match in this many
+
+	lpmCacheSize atomic.Int64 // longest-match lookups cached per database, 0 disables
+
+	tombstoneMax atomic.Int64 // tombstones kept per database
+	tombstoneAge atomic.Int64 // seconds a tombstone is kept, 0 without limit
+
+	maxKeys  dbLimits // db-max-keys
+	maxBytes dbLimits // db-max-bytes
+}
+
+// shard is one independently locked slice of a database's address space.
+type shard struct {
+	mu   sync.RWMutex // guards trie and snap
+	trie *trie.Trie[value]
+	snap *shardSnapshot // while a snapshot is being written
+}
+
+func newShard() *shard {
+	return &shard{trie: trie.New[value]()}
+}
+
+// database is one logical DB: its prefixes split across shards plus
+// counters kept current on every write, so INFO and friends never have to
+// walk it.
+//
+// A prefix lives in exactly one trie. Prefixes long enough to fix the
+// shard bits go to the shard those bits select, so writes to disjoint
+// parts of the address space do not contend. The IPv4 shards use the top
+// shardBits bits, so they split IPv4 space in address order; the IPv6
+// shards use the shardBits bits after the first v6ShardSkip, which does
+// not. Shorter prefixes, which span shards, go to the shared wide trie. A
+// lookup consults the address's shard and falls back to wide, whose
+// prefixes are all less specific.
+type database struct {
+	id        int
+	opts      *storeOptions
+	shardBits int // copied from opts, which never changes it
+	v4, v6    []*shard
+	wide      *shard
+	pool      *internPool
+	index     atomic.Pointer[prefixIndex] // with value-index on
+	tags      *prefixIndex
+	expiries  expiryQueue // deadlines of the prefixes with a TTL
+	graves    graveyard   // what DEL deleted, with db-tombstones on
+	lpm       *lpmCache   // with lpm-cache-size set
+
+	keys4 atomic.Int64 // stored prefixes by family; DBSIZE and INFO read
+	keys6 atomic.Int64 // these, never the tries
+	bytes atomic.Int64 // entrySize of every stored prefix
+
+	quotaMu sync.Mutex // held by writes admitted under a quota until applied
+
+	lengths4 [33]atomic.Int64  // stored prefixes by family and length
+	lengths6 [129]atomic.Int64 // for DBSTATS and PREFIXSTATS
+
+	lastWrite atomic.Int64  // unix time the data last changed; 0 if never
+	changes   atomic.Uint64 // writes applied, so DEBUG VERIFY can tell a quiet walk
+
+	// Access counters. FLUSHDB keeps them; CONFIG RESETSTAT clears them.
+	hits   stripedCounter // lookups that matched a prefix
+	misses stripedCounter
+	writes stripedCounter // write commands that changed the DB
+	hot    hotKeys        // with hotkeys-tracking on
+}
+
+func newDatabase(id int, opts *storeOptions) *database {
+	shardBits := opts.shardBits
+	d := &database{id: id, opts: opts, shardBits: shardBits, wide: newShard(), pool: newInternPool(),
+		tags: newPrefixIndex(), lpm: newLPMCache()}
+	d.v4 = make([]*shard, 1<<shardBits)
+	d.v6 = make([]*shard, 1<<shardBits)
+	for i := range d.v4 {
+		d.v4[i], d.v6[i] = newShard(), newShard()
+	}
+	if opts.valueIndex.Load() {
+		d.index.Store(newPrefixIndex())
+	}
+	return d
+}
+
+// shardFor returns the trie that holds, or would hold, p.
+func (d *database) shardFor(p netip.Prefix) *shard {
+	skip, shards := 0, d.v4
+	if p.Addr().Is6() {
+		skip, shards = v6ShardSkip, d.v6
+	}
+	if p.Bits() < skip+d.shardBits {
+		return d.wide
+	}
+	i := 0
+	for b := skip; b < skip+d.shardBits; b++ {
+		i = i<<1 | bitAt(p.Addr(), b)
+	}
+	return shards[i]
+}
+
+// allShards returns every shard, wide first, in the order multi-shard
+// writers lock them.
+func (d *database) allShards() []*shard {
+	out := make([]*shard, 0, 1+len(d.v4)+len(d.v6))
+	out = append(out, d.wide)
+	out = append(out, d.v4...)
+	return append(out, d.v6...)
+}
+
+// bitAt returns bit i of a, counting from the most significant.
+func bitAt(a netip.Addr, i int) int {
+	b := a.As16()
+	if a.Is4() {
+		i += 96
+	}
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// countKey adjusts the key counters for p, which was stored (delta 1) or
+// removed (delta -1).
+func (d *database) countKey(p netip.Prefix, delta int64) {
+	if p.Addr().Is4() {
+		d.keys4.Add(delta)
+		d.lengths4[p.Bits()].Add(delta)
+	} else {
+		d.keys6.Add(delta)
+		d.lengths6[p.Bits()].Add(delta)
+	}
+}
+
+// wrote records that the data changed just now.
+func (d *database) wrote() {
+	d.lastWrite.Store(int64(accessClock.Load()))
+	d.changes.Add(1)
+}
+
+// keyCount returns the number of stored prefixes of both families.
+func (d *database) keyCount() int64 {
+	return d.keys4.Load() + d.keys6.Load()
+}
+
+// parseKey parses a prefix used as a key, as opposed to an address being
+// looked up, refusing a bare address when require-prefix-length is on.
+func (d *database) parseKey(key string) (netip.Prefix, error) {
+	if d.opts.requireLen.Load() && !strings.Contains(key, "/") {
+		if _, err := netip.ParseAddr(key); err == nil {
+			return netip.Prefix{}, errBareIP
+		}
+	}
+	p, err := parsePrefix(key)
+	if err != nil {
+		return p, err
+	}
+	switch d.opts.mapped.Load() {
+	case mappedConvert:
+		p, _ = unmap(p)
+	case mappedReject:
+		if _, ok := unmap(p); ok {
+			return netip.Prefix{}, errMappedKey
+		}
+	}
+	return p, nil
+}
+
+// parseLookup parses an address or prefix being looked up.
+func (d *database) parseLookup(key string) (netip.Prefix, error) {
+	p, err := parsePrefix(key)
+	if err == nil && d.opts.mapped.Load() != mappedNative {
+		p, _ = unmap(p)
+	}
+	return p, err
+}
+
+// lookupExact returns the value stored at exactly cidr, marking it
+// accessed.
+func (d *database) lookupExact(cidr string) (value, bool) {
+	v, ok := d.peekExact(cidr)
+	if ok {
+		d.touch(v)
+	}
+	return v, ok
+}
+
+// peekExact is lookupExact for commands that inspect a prefix rather than
+// read it, such as TYPE and OBJECT, which must not mark it accessed.
+func (d *database) peekExact(cidr string) (value, bool) {
+	p, err := d.parseKey(cidr)
+	if err != nil {
+		return value{}, false
+	}
+	sh := d.shardFor(p)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	if v, ok := sh.trie.Get(p); ok && !v.expired() {
+		return v, true
+	}
+	return value{}, false
+}
+
+// get returns the value of the longest stored prefix containing key.
+// Stored values are never modified in place, so it stays valid after the
+// lock is released.
+func (d *database) get(key string) (value, bool) {
+	_, v, ok := d.longestMatch(key)
+	return v, ok
+}
+
+// longestMatch returns the longest stored prefix containing key and its
+// value, marking it accessed.
+func (d *database) longestMatch(key string) (netip.Prefix, value, bool) {
+	p, err := d.parseLookup(key)
+	if err != nil {
+		return netip.Prefix{}, value{}, false
+	}
+	return d.longestMatchWithin(p, 0, p.Bits())
+}
+
+// getHeld is get for a caller holding the wide shard and held read
+// locked, as a pipeline batch does.
+func (d *database) getHeld(key string, held *shard) (value, bool) {
+	p, err := d.parseLookup(key)
+	if err != nil {
+		return value{}, false
+	}
+	_, v, ok := d.matchWithin(p, 0, p.Bits(), held)
+	return v, ok
+}
+
+// longestMatchWithin is longestMatch for a parsed key, considering only
+// stored prefixes from minLen to maxLen bits long. Matching the key cut
+// to maxLen bits finds the longest of them without visiting any longer.
+func (d *database) longestMatchWithin(p netip.Prefix, minLen, maxLen int) (netip.Prefix, value, bool) {
+	return d.matchWithin(p, minLen, maxLen, nil)
+}
+
+// matchWithin is longestMatchWithin for a caller that holds the wide shard
+// and held read locked, or none when held is nil. A shard other than held
+// is locked as usual; after wide, that keeps to the order lockAll takes.
+func (d *database) matchWithin(p netip.Prefix, minLen, maxLen int, held *shard) (netip.Prefix, value, bool) {
+	cached, limit := minLen == 0 && maxLen >= p.Bits(), d.opts.lpmCacheSize.Load()
+	if maxLen < p.Bits() {
+		p = netip.PrefixFrom(p.Addr(), maxLen).Masked()
+	}
+	var gen uint64
+	if cached {
+		if r, hit := d.lpm.get(p, limit); hit {
+			if r.ok {
+				d.matched(r.match, r.value)
+			}
+			return r.match, r.value, r.ok
+		}
+		gen = d.lpm.generation()
+	}
+	var m netip.Prefix
+	var v value
+	ok := false
+	if sh := d.shardFor(p); sh == held {
+		m, v, ok = liveMatch(sh.trie, p)
+	} else if sh != d.wide {
+		sh.mu.RLock()
+		m, v, ok = liveMatch(sh.trie, p)
+		sh.mu.RUnlock()
+	}
+	if !ok && held != nil {
+		m, v, ok = liveMatch(d.wide.trie, p)
+	} else if !ok {
+		d.wide.mu.RLock()
+		m, v, ok = liveMatch(d.wide.trie, p)
+		d.wide.mu.RUnlock()
+	}
+	if cached {
+		d.lpm.put(lpmResult{key: p, match: m, value: v, ok: ok}, gen, limit)
+	}
+	if !ok || m.Bits() < minLen {
+		return netip.Prefix{}, value{}, false
+	}
+	d.matched(m, v)
+	return m, v, true
+}
+
+// parseLengthBounds parses [MINLEN n] [MAXLEN n] in either order. An
+// absent MAXLEN is returned as -1.
+func parseLengthBounds(args [][]byte) (minLen, maxLen int, err error) {
+	maxLen = -1
+	if len(args)%2 != 0 {
+		return 0, 0, errSyntax
+	}
+	for i := 0; i < len(args); i += 2 {
+		n, ok := parseInteger(args[i+1])
+		if !ok || n < 0 || n > 128 {
+			return 0, 0, newError(ClassErr, "value is not an integer or out of range")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MINLEN":
+			minLen = int(n)
+		case "MAXLEN":
+			maxLen = int(n)
+		default:
+			return 0, 0, errSyntax
+		}
+	}
+	if maxLen >= 0 && minLen > maxLen {
+		return 0, 0, newError(ClassErr, "MINLEN must not be greater than MAXLEN")
+	}
+	return minLen, maxLen, nil
+}
+
+// shortestMatch returns the least specific stored prefix containing key
+// and its value, marking it accessed. The wide trie's prefixes are all
+// less specific than those of the address's shard, so it is tried first.
+func (d *database) shortestMatch(key string) (netip.Prefix, value, bool) {
+	p, err := d.parseLookup(key)
+	if err != nil {
+		return netip.Prefix{}, value{}, false
+	}
+	shards := []*shard{d.wide}
+	if sh := d.shardFor(p); sh != d.wide {
+		shards = append(shards, sh)
+	}
+	for _, sh := range shards {
+		sh.mu.RLock()
+		m, v, ok := liveShortest(sh.trie, p)
+		sh.mu.RUnlock()
+		if ok {
+			d.matched(m, v)
+			return m, v, true
+		}
+	}
+	return netip.Prefix{}, value{}, false
+}
+
+// matched records a lookup's match: the value was accessed and, with
+// hotkeys-tracking on, the prefix may be sampled.
+func (d *database) matched(p netip.Prefix, v value) {
+	d.touch(v)
+	if d.opts.hotKeys.Load() {
+		d.hot.sample(p, d.opts.hotKeysRate.Load())
+	}
+}
+
+// supernets returns every stored prefix containing key, from the least to
+// the most specific. The wide trie's prefixes are all shorter than those
+// of the address's shard, so they come first.
+func (d *database) supernets(key string) ([]entry, error) {
+	p, err := d.parseLookup(key)
+	if err != nil {
+		return nil, err
+	}
+	var out []entry
+	collect := func(q netip.Prefix, v value) bool {
+		if !v.expired() {
+			d.touch(v)
+			out = append(out, entry{q, v})
+		}
+		return true
+	}
+	d.wide.mu.RLock()
+	d.wide.trie.Supernets(p, collect)
+	d.wide.mu.RUnlock()
+	if sh := d.shardFor(p); sh != d.wide {
+		sh.mu.RLock()
+		sh.trie.Supernets(p, collect)
+		sh.mu.RUnlock()
+	}
+	return out, nil
+}
+
+// parseSetKey is parseKey plus the checks only writes apply.
+func (d *database) parseSetKey(cidr string) (netip.Prefix, error) {
+	p, err := d.parseKey(cidr)
+	if err != nil {
+		return p, err
+	}
+	if d.opts.rejectHost.Load() {
+		if raw, _ := parseUnmasked(cidr); raw != raw.Masked() {
+			return netip.Prefix{}, fmt.Errorf("host bits set in %s, did you mean %s?", raw, p)
+		}
+	}
+	return p, nil
+}
+
+// store puts value at p. When p is already stored it replaces the value
+// if replace is set and otherwise leaves it be; existed reports whether
+// it was. An expired value counts as not stored.
+func (d *database) store(p netip.Prefix, v value, replace bool) (existed bool) {
+	sh := d.shardFor(p)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return d.storeLocked(sh, p, v, replace)
+}
+
+// storeLocked is store for callers already holding sh, p's shard, write
+// locked.
+func (d *database) storeLocked(sh *shard, p netip.Prefix, v value, replace bool) (existed bool) {
+	live := value{}
+	if old, ok := sh.trie.Get(p); ok && !old.expired() {
+		if !replace {
+			return true
+		}
+		live = old
+	}
+	v = d.intern(inheritTags(v, live))
+	v.access = newAccess()
+	d.wrote()
+	sh.preserve(p)
+	old, replaced := sh.trie.Insert(p, v)
+	d.lpm.invalidate(p)
+	d.trackExpiry(p, old, v)
+	d.reindex(p, old, replaced, v)
+	if replaced {
+		d.release(old)
+		d.bytes.Add(entrySize(v) - entrySize(old))
+		return !old.expired()
+	}
+	d.countKey(p, 1)
+	d.bytes.Add(entrySize(v))
+	return false
+}
+
+// storeChecked is store for writes d's quotas apply to, failing with a
+// *quotaError rather than exceed them.
+func (d *database) storeChecked(p netip.Prefix, v value, replace bool) (existed bool, err error) {
+	sh := d.shardFor(p)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	old, had := sh.trie.Get(p)
+	live := value{}
+	if had && !old.expired() {
+		if !replace {
+			return true, nil
+		}
+		live = old
+	}
+	done, err := d.admit(old, had, inheritTags(v, live))
+	if err != nil {
+		return false, err
+	}
+	defer done()
+	return d.storeLocked(sh, p, v, replace), nil
+}
+
+// intern swaps a string for its pooled copy when value-interning is on.
+func (d *database) intern(v value) value {
+	if d.opts.interning.Load() && v.isString() {
+		v.str = d.pool.intern(v.str)
+	}
+	return v
+}
+
+// release drops a replaced or deleted value's claim on the pool.
+func (d *database) release(v value) {
+	d.pool.release(v.str)
+}
+
+// del removes the value stored at exactly cidr and reports whether there
+// was one that had not expired. Unless by is empty, it keeps a tombstone
+// of it, recording by as the deleting client.
+func (d *database) del(cidr, by string) bool {
+	p, err := d.parseKey(cidr)
+	if err != nil {
+		return false
+	}
+	sh := d.shardFor(p)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	old, ok := sh.trie.Get(p)
+	if ok {
+		d.buryLocked(sh, p, old, by)
+	}
+	return ok && !old.expired()
+}
+
+// removeLocked deletes p, whose value is old, for callers holding sh, p's
+// shard, write locked.
+func (d *database) removeLocked(sh *shard, p netip.Prefix, old value) {
+	d.wrote()
+	sh.preserve(p)
+	sh.trie.Delete(p)
+	d.forget(p, old)
+}
+
+// forget updates everything but the trie for the removal of p, whose
+// value was old.
+func (d *database) forget(p netip.Prefix, old value) {
+	d.lpm.invalidate(p)
+	d.release(old)
+	d.trackExpiry(p, old, value{})
+	d.reindex(p, old, true, value{})
+	d.countKey(p, -1)
+	d.bytes.Add(-entrySize(old))
+}
+
+// errUnchanged is returned by an update function to leave the value as
+// it was without failing the update.
+var errUnchanged = errors.New("unchanged")
+
+// update replaces the value stored at exactly cidr with what fn returns
+// for the current one, holding the shard lock throughout so the
+// read-modify-write is atomic. ok tells fn whether there was a value,
+// an expired one counting as none; returning the zero value deletes it.
+// An error, errUnchanged excepted, leaves it as it was and is returned.
+// fn must not modify old in place. The new value keeps old's expiry.
+func (d *database) update(cidr string, fn func(old value, ok bool) (value, error)) error {
+	return d.modify(cidr, true, fn)
+}
+
+// modify is update, keeping old's expiry only if keepTTL is set and
+// otherwise storing the expiry fn returns, as SET does.
+func (d *database) modify(cidr string, keepTTL bool, fn func(old value, ok bool) (value, error)) error {
+	p, err := d.parseSetKey(cidr)
+	if err != nil {
+		return err
+	}
+	sh := d.shardFor(p)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	old, had := sh.trie.Get(p)
+	live, ok := old, had
+	if had && old.expired() {
+		live, ok = value{}, false
+	}
+	v, err := fn(live, ok)
+	switch {
+	case err == errUnchanged:
+		return nil
+	case err != nil:
+		return err
+	case v.isNone():
+		if had {
+			d.removeLocked(sh, p, old)
+		}
+	default:
+		if keepTTL {
+			v.expireAt = live.expireAt
+		}
+		v = inheritTags(v, live)
+		done, err := d.admit(old, had, v)
+		if err != nil {
+			return err
+		}
+		defer done()
+		d.wrote()
+		v = d.intern(v)
+		v.access = newAccess()
+		sh.preserve(p)
+		sh.trie.Insert(p, v)
+		d.lpm.invalidate(p)
+		d.trackExpiry(p, old, v)
+		d.reindex(p, old, had, v)
+		if had {
+			d.release(old)
+			d.bytes.Add(entrySize(v) - entrySize(old))
+		} else {
+			d.countKey(p, 1)
+			d.bytes.Add(entrySize(v))
+		}
+	}
+	return nil
+}
+
+// datasetBytes estimates the memory held by the stored prefixes.
+func (d *database) datasetBytes() int64 {
+	return d.bytes.Load()
+}
+
+// entry is one stored prefix and its value.
+type entry struct {
+	prefix netip.Prefix
+	value  value
+}
+
+// comparePrefixes orders prefixes as trie walks do: IPv4 first, then by
+// address, then shorter first.
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// snapshot returns every stored prefix covered by within, or every prefix
+// when within is invalid, in comparePrefixes order. All shards are
+// read-locked together while it copies, so the result is the database as
+// it was at one instant; values are shared, as they are never modified.
+func (d *database) snapshot(within netip.Prefix) []entry {
+	shards := d.allShards()
+	for _, sh := range shards {
+		sh.mu.RLock()
+	}
+	var out []entry
+	collect := func(p netip.Prefix, v value) bool {
+		out = append(out, entry{p, v})
+		return true
+	}
+	for _, sh := range shards {
+		if within.IsValid() {
+			sh.trie.Subnets(within, collect)
+		} else {
+			sh.trie.Walk(collect)
+		}
+	}
+	for _, sh := range shards {
+		sh.mu.RUnlock()
+	}
+	slices.SortFunc(out, func(a, b entry) int { return comparePrefixes(a.prefix, b.prefix) })
+	return out
+}
+
+// lockAll write-locks every shard and returns the matching unlock.
+func (d *database) lockAll() (unlock func()) {
+	shards := d.allShards()
+	for _, sh := range shards {
+		sh.mu.Lock()
+	}
+	return func() {
+		for _, sh := range shards {
+			sh.mu.Unlock()
+		}
+	}
+}
+
+// rlockAll read-locks every shard and returns the matching unlock.
+func (d *database) rlockAll() (unlock func()) {
+	shards := d.allShards()
+	for _, sh := range shards {
+		sh.mu.RLock()
+	}
+	return func() {
+		for _, sh := range shards {
+			sh.mu.RUnlock()
+		}
+	}
+}
+
+// flush removes every prefix. The old data is handed to lf to free in the
+// background or, when lf is nil, freed before flush returns.
+func (d *database) flush(lf *lazyFreer) {
+	defer d.lockAll()()
+	j := lazyFreeJob{keys: d.keyCount()}
+	for _, sh := range d.allShards() {
+		if t := sh.detach(); t != nil {
+			j.tries = append(j.tries, t)
+		}
+	}
+	j.entries = d.pool.detach()
+	d.lpm.clear()
+	d.expiries.clear()
+	d.tags.reset()
+	if ix := d.index.Load(); ix != nil {
+		ix.reset()
+	}
+	if lf != nil {
+		lf.free(j)
+	} else {
+		j.free()
+	}
+	d.keys4.Store(0)
+	d.keys6.Store(0)
+	d.bytes.Store(0)
+	for i := range d.lengths4 {
+		d.lengths4[i].Store(0)
+	}
+	for i := range d.lengths6 {
+		d.lengths6[i].Store(0)
+	}
+	d.wrote()
+}
+
+// flushFamily removes every prefix of family f, which is family4 or
+// family6, at one instant, and returns how many it removed. The family's
+// own shards are swapped for empty ones, their old tries handed to lf as
+// flush does; its prefixes in the wide trie, which both families share,
+// are deleted one by one and freed at once.
+func (d *database) flushFamily(f family, lf *lazyFreer) int64 {
+	defer d.lockAll()()
+	shards := d.v4
+	if f == family6 {
+		shards = d.v6
+	}
+	var n int64
+	j := lazyFreeJob{}
+	for _, sh := range shards {
+		if sh.trie.Len() == 0 {
+			continue
+		}
+		sh.trie.Walk(func(p netip.Prefix, v value) bool {
+			d.forget(p, v)
+			n++
+			return true
+		})
+		if t := sh.detach(); t != nil {
+			j.tries = append(j.tries, t)
+		}
+	}
+	j.keys = n
+	var wide []entry
+	d.wide.trie.Walk(func(p netip.Prefix, v value) bool {
+		if f.matches(p) {
+			wide = append(wide, entry{p, v})
+		}
+		return true
+	})
+	for _, e := range wide {
+		d.removeLocked(d.wide, e.prefix, e.value)
+	}
+	n += int64(len(wide))
+	if lf != nil {
+		lf.free(j)
+	} else {
+		j.free()
+	}
+	if n > 0 {
+		d.wrote()
+	}
+	return n
+}
+
+// stall holds the write lock of every shard in d, simulating a write that
+// stalls the whole DB.
+func (d *database) stall(dur time.Duration) {
+	defer d.lockAll()()
+	time.Sleep(dur)
+}
+
+// resetStats zeroes the access counters.
+func (d *database) resetStats() {
+	d.hits.reset()
+	d.misses.reset()
+	d.writes.reset()
+	d.hot.reset()
+	d.lpm.hits.Store(0)
+	d.lpm.misses.Store(0)
+}
+
+// family selects IPv4, IPv6 or both in commands that walk a database.
+type family int
+
+const (
+	familyAny family = iota
+	family4
+	family6
+)
+
+func (f family) matches(p netip.Prefix) bool {
+	return f == familyAny || (f == family4) == p.Addr().Is4()
+}
+
+// parseFamily parses the argument of a FAMILY option.
+func parseFamily(s string) (family, bool) {
+	switch strings.ToLower(s) {
+	case "v4", "ipv4", "4":
+		return family4, true
+	case "v6", "ipv6", "6":
+		return family6, true
+	}
+	return familyAny, false
+}
+
+// scanPos is where a walk over a database resumes: the index of a trie in
+// allShards order and the last prefix already visited in it, if any.
+type scanPos struct {
+	shard int
+	after netip.Prefix
+}
+
+// scan visits up to count stored prefixes of family f from pos, calling fn
+// for each unexpired one, and returns where to resume, or done once the
+// database is exhausted. Expired prefixes expireCron has yet to delete
+// count towards count but are not passed to fn. Each shard is read-locked
+// only while it is visited, so
+// prefixes written during a long scan may or may not be seen, but prefixes
+// present throughout are always visited exactly once.
+func (d *database) scan(pos scanPos, f family, count int, fn func(netip.Prefix, value)) (next scanPos, done bool) {
+	shards := d.allShards()
+	for ; pos.shard < len(shards); pos.shard++ {
+		if f != familyAny && pos.shard > 0 && (pos.shard <= len(d.v4)) != (f == family4) {
+			pos.after = netip.Prefix{}
+			continue // a per-family shard of the other family
+		}
+		sh := shards[pos.shard]
+		sh.mu.RLock()
+		sh.trie.Ascend(pos.after, func(p netip.Prefix, v value) bool {
+			pos.after = p
+			if f.matches(p) && !v.expired() {
+				fn(p, v)
+			}
+			count--
+			return count > 0
+		})
+		sh.mu.RUnlock()
+		if count <= 0 {
+			return pos, false
+		}
+		pos.after = netip.Prefix{}
+	}
+	return pos, true
+}
+
+// nextKey returns the first unexpired stored prefix after the given one
+// in comparePrefixes order, covered by within unless within is invalid.
+// An invalid after starts from the beginning.
+func (d *database) nextKey(after, within netip.Prefix) (netip.Prefix, bool) {
+	if es, _ := d.entriesAfter(after, within, 1, nil); len(es) == 1 {
+		return es[0].prefix, true
+	}
+	return netip.Prefix{}, false
+}
+
+// entriesAfter returns up to limit unexpired stored entries after the
+// given prefix in comparePrefixes order, covered by within unless within
+// is invalid. Each shard is searched on its own under its read lock, so a
+// prefix stored concurrently is seen if it sorts after the cursor and the
+// search reaches its shard later. It stops with b's error once b runs
+// out.
+//
+// The IPv4 shards split their space in order, so once they have yielded
+// limit entries the later ones, and every IPv6 shard, hold only later
+// prefixes. The IPv6 shards are not in order (see v6ShardSkip): any of
+// them may hold the next prefix, so each is searched.
+func (d *database) entriesAfter(after, within netip.Prefix, limit int, b *budget) ([]entry, error) {
+	lists := make([][]entry, 0, 2+len(d.v6))
+	d.wide.mu.RLock()
+	lists = append(lists, collectAfter(nil, d.wide.trie, after, within, limit, b))
+	d.wide.mu.RUnlock()
+	var v4 []entry
+	for _, sh := range d.v4 {
+		if len(v4) >= limit || b.exceeded() {
+			break
+		}
+		sh.mu.RLock()
+		v4 = collectAfter(v4, sh.trie, after, within, limit-len(v4), b)
+		sh.mu.RUnlock()
+	}
+	lists = append(lists, v4)
+	for _, sh := range d.v6 {
+		if len(v4) >= limit || b.exceeded() {
+			break
+		}
+		sh.mu.RLock()
+		lists = append(lists, collectAfter(nil, sh.trie, after, within, limit, b))
+		sh.mu.RUnlock()
+	}
+	if b.exceeded() {
+		return nil, b.err()
+	}
+	out := mergeAll(lists, entryPrefix)
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// collectAfter is entriesAfter for one trie, appending to out.
+func collectAfter(out []entry, t *trie.Trie[value], after, within netip.Prefix, limit int, b *budget) []entry {
+	n := 0
+	collect := func(p netip.Prefix, v value) bool {
+		if b.exceeded() {
+			return false
+		}
+		if v.expired() {
+			return true
+		}
+		out = append(out, entry{p, v})
+		n++
+		return n < limit
+	}
+	if within.IsValid() && (!after.IsValid() || comparePrefixes(after, within) < 0) {
+		t.Subnets(within, collect)
+		return out
+	}
+	t.Ascend(after, func(p netip.Prefix, v value) bool {
+		if within.IsValid() && !within.Contains(p.Addr()) {
+			return false // past within
+		}
+		return collect(p, v)
+	})
+	return out
+}
+
+// registerDBConfig exposes the storage settings. Turning value-interning
+// off keeps existing sharing; turning it on only affects later writes.
+// Likewise ::ffff: keys stored while ipv4-mapped was native stay IPv6.
+func (s *TrieServer) registerDBConfig() {
+	s.addConfig("db-shards", func() string { return strconv.Itoa(1 << s.store.shardBits) }, nil)
+	s.addConfig("db-names", s.names.String, s.names.Set)
+	s.addConfig("db-readonly", s.readOnlyDBs.String, s.readOnlyDBs.Set)
+	s.addConfig("db-default-value", s.defaults.String, s.defaults.Set)
+	s.addConfig("value-interning", yesNoGet(&s.store.interning), yesNoSet(&s.store.interning))
+	s.addConfig("require-prefix-length", yesNoGet(&s.store.requireLen), yesNoSet(&s.store.requireLen))
+	s.addConfig("reject-host-bits", yesNoGet(&s.store.rejectHost), yesNoSet(&s.store.rejectHost))
+	s.addConfig("read-only", yesNoGet(&s.readOnly), yesNoSet(&s.readOnly))
+	s.addConfig("lazyfree-lazy-user-flush", yesNoGet(&s.store.lazyFlush), yesNoSet(&s.store.lazyFlush))
+	s.addConfig("lfu-tracking", yesNoGet(&s.store.lfu), yesNoSet(&s.store.lfu))
+	s.addConfig("hotkeys-tracking", yesNoGet(&s.store.hotKeys), yesNoSet(&s.store.hotKeys))
+	s.addConfig("hotkeys-sample-rate",
+		func() string { return strconv.FormatInt(s.store.hotKeysRate.Load(), 10) },
+		func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 {
+				return errors.New("argument must be a positive number of matches per sample")
+			}
+			s.store.hotKeysRate.Store(n)
+			return nil
+		})
+	s.addConfig("lpm-cache-size",
+		func() string { return strconv.FormatInt(s.store.lpmCacheSize.Load(), 10) },
+		func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return errors.New("argument must be a non-negative number of lookups")
+			}
+			s.store.lpmCacheSize.Store(n)
+			for _, db := range s.databases() {
+				db.lpm.clear()
+			}
+			return nil
+		})
+	s.addConfig("ipv4-mapped",
+		func() string { return mappedModes[s.store.mapped.Load()] },
+		func(v string) error {
+			mode, ok := parseMappedMode(v)
+			if !ok {
+				return errors.New("argument must be 'convert', 'reject' or 'native'")
+			}
+			s.store.mapped.Store(mode)
+			return nil
+		})
+}
+
+func parseMappedMode(v string) (int32, bool) {
+	for i, name := range mappedModes {
+		if v == name {
+			return int32(i), true
+		}
+	}
+	return 0, false
+}
+
+// yesNoGet and yesNoSet adapt a boolean setting to CONFIG's yes/no values.
+func yesNoGet(b *atomic.Bool) func() string {
+	return func() string {
+		if b.Load() {
+			return "yes"
+		}
+		return "no"
+	}
+}
+
+func yesNoSet(b *atomic.Bool) func(string) error {
+	return func(v string) error {
+		switch v {
+		case "yes", "no":
+			b.Store(v == "yes")
+			return nil
+		}
+		return errors.New("argument must be 'yes' or 'no'")
+	}
+}
+
+// maxDescendants caps the descendant count DEBUG OBJECT reports, so the
+// command stays cheap on a prefix like 0.0.0.0/0.
+const maxDescendants = 10000
+
+// objectInfo is what DEBUG OBJECT reports about one stored prefix.
+type objectInfo struct {
+	prefix      netip.Prefix
+	value       value
+	parent      netip.Prefix // invalid when there is none
+	descendants int          // capped at maxDescendants
+	depth       int          // nodes above this one in its shard's trie, glue included
+}
+
+// describe returns trie internals for the prefix stored at exactly cidr.
+func (d *database) describe(cidr string) (objectInfo, bool) {
+	p, err := d.parseKey(cidr)
+	if err != nil {
+		return objectInfo{}, false
+	}
+	home := d.shardFor(p)
+	home.mu.RLock()
+	v, ok := home.trie.Get(p)
+	info := objectInfo{prefix: p, value: v}
+	info.parent, _, _ = home.trie.Parent(p)
+	info.depth, _ = home.trie.Depth(p)
+	home.mu.RUnlock()
+	if !ok {
+		return objectInfo{}, false
+	}
+	if !info.parent.IsValid() && home != d.wide {
+		d.wide.mu.RLock()
+		info.parent, _, _ = d.wide.trie.LongestMatch(p)
+		d.wide.mu.RUnlock()
+	}
+
+	// A prefix in a shard only has descendants there; a wide one may have
+	// them anywhere.
+	shards := []*shard{home}
+	if home == d.wide {
+		shards = d.allShards()
+	}
+	for _, sh := range shards {
+		sh.mu.RLock()
+		info.descendants += sh.trie.CountSubnets(p, maxDescendants-info.descendants)
+		sh.mu.RUnlock()
+		if info.descendants >= maxDescendants {
+			break
+		}
+	}
+	return info, true
+}
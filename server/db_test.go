@@ -0,0 +1,504 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// randomPrefix returns a random prefix of the family of an address
+// bytesLen bytes long, at least minBits long.
+func randomPrefix(r *rand.Rand, bytesLen, minBits int) netip.Prefix {
+	var b [16]byte
+	for i := range b {
+		b[i] = byte(r.Uint32())
+	}
+	a := netip.AddrFrom16(b)
+	if bytesLen == 4 {
+		a = netip.AddrFrom4([4]byte(b[:4]))
+	}
+	bits := minBits + r.IntN(a.BitLen()-minBits+1)
+	return netip.PrefixFrom(a, bits).Masked()
+}
+
+// storedPrefixes lists every prefix in d's shards.
+func storedPrefixes(d *database) []netip.Prefix {
+	var out []netip.Prefix
+	for _, sh := range d.allShards() {
+		sh.mu.RLock()
+		sh.trie.Walk(func(p netip.Prefix, _ value) bool {
+			out = append(out, p)
+			return true
+		})
+		sh.mu.RUnlock()
+	}
+	return out
+}
+
+// lastAddr returns the last address of p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+func TestShardRanges(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for _, shardBits := range []int{0, 1, 4, 8} {
+		d := newDatabase(0, &storeOptions{shardBits: shardBits})
+		index := func(p netip.Prefix) int {
+			if p.Addr().Is4() {
+				return slices.Index(d.v4, d.shardFor(p))
+			}
+			return slices.Index(d.v6, d.shardFor(p))
+		}
+		for _, family := range []struct {
+			bytesLen, skip int
+		}{{4, 0}, {16, v6ShardSkip}} {
+			var sharded []netip.Prefix
+			for range 5000 {
+				p := randomPrefix(r, family.bytesLen, 0)
+				sh := d.shardFor(p)
+				if p.Bits() < family.skip+shardBits {
+					if sh != d.wide {
+						t.Fatalf("db-shards %d: %s is not in the wide shard", 1<<shardBits, p)
+					}
+					continue
+				}
+				// A prefix lies in the range of one shard, so the
+				// shards' ranges do not overlap.
+				first := netip.PrefixFrom(p.Addr(), p.Addr().BitLen())
+				last := netip.PrefixFrom(lastAddr(p), p.Addr().BitLen())
+				if sh == d.wide || d.shardFor(first) != sh || d.shardFor(last) != sh {
+					t.Fatalf("db-shards %d: %s spans shards", 1<<shardBits, p)
+				}
+				sharded = append(sharded, p)
+			}
+			// Within a /skip, here all of IPv4 or each IPv6 /3, the
+			// shards split the space in address order.
+			slices.SortFunc(sharded, func(a, b netip.Prefix) int { return a.Addr().Compare(b.Addr()) })
+			for i := 1; i < len(sharded); i++ {
+				a, b := sharded[i-1], sharded[i]
+				if family.skip > 0 && bitsFrom(a.Addr(), 0, family.skip) != bitsFrom(b.Addr(), 0, family.skip) {
+					continue
+				}
+				if index(a) > index(b) {
+					t.Fatalf("db-shards %d: %s is in shard %d, after %s in shard %d",
+						1<<shardBits, a, index(a), b, index(b))
+				}
+			}
+		}
+		// Across /3s IPv6 shard order is not address order.
+		if shardBits > 0 {
+			lo, mid, hi := netip.MustParsePrefix("2000::/16"), netip.MustParsePrefix("3000::/16"), netip.MustParsePrefix("4000::/16")
+			if index(lo) != index(hi) || index(mid) <= index(hi) {
+				t.Fatalf("db-shards %d: %s, %s and %s in shards %d, %d and %d",
+					1<<shardBits, lo, mid, hi, index(lo), index(mid), index(hi))
+			}
+		}
+	}
+}
+
+// bitsFrom returns bits [from, to) of a as an integer.
+func bitsFrom(a netip.Addr, from, to int) int {
+	n := 0
+	for b := from; b < to; b++ {
+		n = n<<1 | bitAt(a, b)
+	}
+	return n
+}
+
+// setString stores str at cidr, replacing any value already there, as a
+// plain SET does.
+func setString(d *database, cidr string, str []byte) error {
+	p, err := d.parseSetKey(cidr)
+	if err != nil {
+		return err
+	}
+	d.store(p, stringValue(str), true)
+	return nil
+}
+
+// BenchmarkShardedMixed runs a 90% lookup, 10% write load over a
+// database of one shard per family, which is one lock, and over
+// sharded ones.
+func BenchmarkShardedMixed(b *testing.B) {
+	r := rand.New(rand.NewPCG(3, 4))
+	keys := make([]string, 1<<16)
+	for i := range keys {
+		keys[i] = randomPrefix(r, 4, 24).String()
+	}
+	for _, shardBits := range []int{0, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", 1<<shardBits), func(b *testing.B) {
+			d := newDatabase(0, &storeOptions{shardBits: shardBits})
+			v := []byte("AS64500")
+			for _, k := range keys {
+				setString(d, k, v)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewPCG(rand.Uint64(), 0))
+				for pb.Next() {
+					k := keys[r.IntN(len(keys))]
+					if r.IntN(10) == 0 {
+						setString(d, k, v)
+					} else {
+						d.get(k)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestDatabaseCounters(t *testing.T) {
+	db := newDatabase(0, &storeOptions{shardBits: 4})
+	for _, tc := range []struct {
+		op, cidr, value string
+		wantKeys        int64
+		wantBytes       int64 // of the values
+	}{
+		{"set", "10.0.0.0/8", "abc", 1, 3},
+		{"set", "10.1.0.0/16", "de", 2, 5},
+		{"set", "10.0.0.0/8", "a", 2, 3}, // overwrite
+		{"set", "2001:db8::/32", "v6", 3, 5},
+		{"del", "10.0.0.0/16", "", 3, 5}, // not stored, only covered
+		{"del", "10.1.0.0/16", "", 2, 3},
+		{"del", "10.1.0.0/16", "", 2, 3},
+		{"flush", "", "", 0, 0},
+		{"set", "192.168.0.0/16", "xyz", 1, 3},
+	} {
+		switch tc.op {
+		case "set":
+			if err := setString(db, tc.cidr, []byte(tc.value)); err != nil {
+				t.Fatal(err)
+			}
+		case "del":
+			db.del(tc.cidr, "")
+		case "flush":
+			db.flush(nil)
+		}
+		if keys, bytes := db.keyCount(), db.bytes.Load()-db.keyCount()*entryOverhead; keys != tc.wantKeys || bytes != tc.wantBytes {
+			t.Errorf("after %s %s: %d keys, %d value bytes; want %d, %d", tc.op, tc.cidr, keys, bytes, tc.wantKeys, tc.wantBytes)
+		}
+		if n := int64(len(storedPrefixes(db))); n != db.keyCount() {
+			t.Errorf("after %s %s: counted %d keys, the trie holds %d", tc.op, tc.cidr, db.keyCount(), n)
+		}
+	}
+	if got, want := db.datasetBytes(), int64(3+entryOverhead); got != want {
+		t.Errorf("datasetBytes() = %d, want %d", got, want)
+	}
+}
+
+// TestConcurrentWorkload runs clients writing, reading and flushing in
+// several databases at once, some of them created by the first client to
+// select them. It is meant for go test -race; afterwards every database's
+// count must still agree with its shards.
+func TestConcurrentWorkload(t *testing.T) {
+	s := newTestServer(t)
+	const clients, dbs, steps = 8, 3, 400
+	sessions := make([]*testSession, clients)
+	for i := range sessions {
+		sessions[i] = newTestSession(t, s)
+	}
+	var wg sync.WaitGroup
+	for i, ss := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewPCG(uint64(i), 9))
+			for step := range steps {
+				if step%50 == 0 {
+					ss.Do("SELECT", strconv.Itoa(r.IntN(dbs)))
+				}
+				k := randomPrefix(r, []int{4, 16}[r.IntN(2)], 0).String()
+				var err error
+				switch op := r.IntN(100); {
+				case op < 40:
+					err = ss.Do("SET", k, "v").Err()
+				case op < 70:
+					err = ss.Do("GET", k).Err()
+				case op < 85:
+					err = ss.Do("DEL", k).Err()
+				case op < 92:
+					err = ss.Do("DBSIZE").Err()
+				case op < 99:
+					err = ss.Do("INFO", "keyspace").Err()
+				default:
+					err = ss.Do("FLUSHDB").Err()
+				}
+				if err != nil {
+					t.Errorf("client %d step %d: %v", i, step, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	ss := newTestSession(t, s)
+	for db := range dbs {
+		mustDo(t, ss, "SELECT", strconv.Itoa(db))
+		keys, n := len(storedPrefixes(s.getDB(db))), mustDo(t, ss, "DBSIZE").Int
+		if n != int64(keys) {
+			t.Errorf("db%d: DBSIZE = %d, the shards hold %d", db, n, keys)
+		}
+	}
+}
+
+func TestDelOfCoveredPrefix(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+	for _, tc := range []struct {
+		args []string
+		want int64
+	}{
+		{[]string{"DEL", "10.1.0.0/16"}, 0},
+		{[]string{"DEL", "10.0.0.0/8", "10.0.0.0/8"}, 1},
+		{[]string{"DEL", "10.0.0.0/8"}, 0},
+	} {
+		if r := mustDo(t, ss, tc.args...); r.Int != tc.want {
+			t.Errorf("%q = %d, want %d", tc.args, r.Int, tc.want)
+		}
+	}
+}
+
+func TestInfoMemory(t *testing.T) {
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	mustDo(t, ss, "SET", "10.0.0.0/8", "abcd")
+	mustDo(t, ss, "SELECT", "1")
+	mustDo(t, ss, "SET", "10.0.0.0/8", "ef")
+	fields := infoFields(mustDo(t, ss, "INFO", "memory").Str)
+	for field, want := range map[string]int64{
+		"dataset_keys":         2,
+		"dataset_key_overhead": 2 * entryOverhead,
+		"used_memory_dataset":  6 + 2*entryOverhead,
+	} {
+		if got, err := strconv.ParseInt(fields[field], 10, 64); err != nil || got != want {
+			t.Errorf("%s:%s, want %d", field, fields[field], want)
+		}
+	}
+	for _, field := range []string{"used_memory", "used_memory_human", "used_memory_sys", "used_memory_dataset_perc", "heap_objects", "gc_cycles"} {
+		if fields[field] == "" {
+			t.Errorf("INFO memory lacks %s", field)
+		}
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	for _, tc := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.00K"},
+		{1536, "1.50K"},
+		{5 << 20, "5.00M"},
+		{3 << 30, "3.00G"},
+		{2 << 40, "2.00T"},
+	} {
+		if got := humanBytes(tc.n); got != tc.want {
+			t.Errorf("humanBytes(%d) = %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestRequirePrefixLength(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	mustDo(t, ss, "SET", "192.0.2.1", "bare") // stored as 192.0.2.1/32
+	mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+	mustDo(t, ss, "CONFIG", "SET", "require-prefix-length", "yes")
+	for _, tc := range []struct {
+		args []string
+		want ReplyType
+	}{
+		{[]string{"SET", "192.0.2.2", "v"}, ErrorReply},
+		{[]string{"SET", "2001:db8::1", "v"}, ErrorReply},
+		{[]string{"SET", "192.0.2.2/32", "v"}, StatusReply},
+		{[]string{"GET", "192.0.2.1"}, BulkReply}, // a lookup, not a key
+		{[]string{"MEMORY", "USAGE", "192.0.2.1"}, NullReply},
+		{[]string{"MEMORY", "USAGE", "192.0.2.1/32"}, IntReply},
+		{[]string{"DEBUG", "OBJECT", "192.0.2.1"}, ErrorReply},
+		{[]string{"DEL", "10.0.0.0/8", "192.0.2.1"}, ErrorReply},
+	} {
+		if r := ss.Do(tc.args...); r.Type != tc.want {
+			t.Errorf("%q = %c%s, want a %c reply", tc.args, r.Type, r.Str, tc.want)
+		}
+	}
+	// The refused DEL removed nothing.
+	if n := mustDo(t, ss, "DBSIZE").Int; n != 3 {
+		t.Errorf("DBSIZE = %d, want 3", n)
+	}
+	mustDo(t, ss, "CONFIG", "SET", "require-prefix-length", "no")
+	if n := mustDo(t, ss, "DEL", "192.0.2.1", "192.0.2.2").Int; n != 2 {
+		t.Errorf("DEL of bare addresses removed %d, want 2", n)
+	}
+}
+
+// TestGetLengthBounds checks GET with MINLEN and MAXLEN where each bound
+// changes the answer.
+func TestGetLengthBounds(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for k, v := range map[string]string{
+		"0.0.0.0/0": "any", "10.0.0.0/8": "a", "10.1.0.0/16": "b", "10.1.2.0/24": "c", "10.1.2.128/25": "d",
+		"::/0": "any6", "2001:db8::/32": "x",
+	} {
+		mustDo(t, ss, "SET", k, v)
+	}
+	var steps []replyStep
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"10.1.2.200"}, "d"},
+		{[]string{"10.1.2.200", "MAXLEN", "24"}, "c"},
+		{[]string{"10.1.2.200", "MAXLEN", "20"}, "b"},
+		{[]string{"10.1.2.200", "MAXLEN", "0"}, "any"},
+		{[]string{"10.1.2.200", "MINLEN", "1", "MAXLEN", "8"}, "a"},
+		{[]string{"10.1.2.200", "maxlen", "12", "minlen", "1"}, "a"},
+		{[]string{"10.1.2.200", "MINLEN", "9", "MAXLEN", "15"}, "nil"},
+		{[]string{"10.1.2.200", "MINLEN", "26"}, "nil"},
+		{[]string{"10.1.2.1", "MINLEN", "25"}, "nil"},
+		{[]string{"11.0.0.1"}, "any"},
+		{[]string{"11.0.0.1", "MINLEN", "1"}, "nil"},
+		{[]string{"10.1.2.128/25", "MINLEN", "9", "MAXLEN", "24"}, "c"},
+		{[]string{"10.1.2.0/24", "MINLEN", "1"}, "c"},
+		{[]string{"2001:db8::1", "MINLEN", "1"}, "x"},
+		{[]string{"2001:db8::1", "MAXLEN", "31"}, "any6"},
+		{[]string{"2001:db8::1", "MINLEN", "33", "MAXLEN", "128"}, "nil"},
+		{[]string{"10.1.2.200", "MAXLEN", "33"}, "ERR MINLEN and MAXLEN must be between 0 and 32"},
+		{[]string{"2001:db8::1", "MINLEN", "129"}, "ERR"},
+		{[]string{"10.1.2.200", "MINLEN", "9", "MAXLEN", "8"}, "ERR MINLEN must not be greater than MAXLEN"},
+		{[]string{"10.1.2.200", "MAXLEN", "-1"}, "ERR"},
+		{[]string{"10.1.2.200", "MAXLEN"}, "ERR"},
+		{[]string{"10.1.2.200", "LEN", "8"}, "ERR"},
+	} {
+		steps = append(steps, replyStep{append([]string{"GET"}, tc.args...), tc.want})
+	}
+	runSteps(t, ss, steps)
+}
+
+func TestParsePrefix(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"010.0.0.0/8", "10.0.0.0/8"},
+		{"10.00.0.0/8", "10.0.0.0/8"},
+		{"010.001.002.003", "10.1.2.3/32"},
+		{"10.0.0.0/08", "10.0.0.0/8"},
+		{"2001:DB8::/32", "2001:db8::/32"},
+		{"2001:0db8:0000:0000:0000:0000:0000:0000/32", "2001:db8::/32"},
+		{"fe80::1%eth0/64", "fe80::/64"},
+		{"fe80::1%eth0", "fe80::1/128"},
+		{"::ffff:10.0.0.0/104", "::ffff:10.0.0.0/104"},
+		{"::ffff:010.000.0.0/104", "::ffff:10.0.0.0/104"},
+		{"256.0.0.0/8", ""},
+		{"0256.0.0.0/8", ""},
+		{"10.0.0.0/33", ""},
+		{"10.0.0.0/+8", ""},
+		{"10.0.0/8", ""},
+		{"", ""},
+	} {
+		p, err := parsePrefix(tc.in)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("parsePrefix(%q) = %s, want an error", tc.in, p)
+			}
+			continue
+		}
+		if err != nil || p.String() != tc.want {
+			t.Errorf("parsePrefix(%q) = %s, %v; want %s", tc.in, p, err, tc.want)
+		}
+	}
+}
+
+func TestKeyNormalization(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	mustDo(t, ss, "SET", "010.1.2.3/8", "a")
+	mustDo(t, ss, "SET", "2001:DB8:0::1/32", "b")
+	want := []string{"10.0.0.0/8", "2001:db8::/32"}
+	if got := mustDo(t, ss, "KEYS", "*").strs(); !slices.Equal(slices.Sorted(slices.Values(got)), want) {
+		t.Fatalf("KEYS * = %q, want %q", got, want)
+	}
+	for _, key := range []string{"10.0.0.0/8", "10.00.0.0/8", "10.9.9.9/8", "10.0.0.0/08"} {
+		if r := mustDo(t, ss, "MEMORY", "USAGE", key); r.Type != IntReply {
+			t.Errorf("MEMORY USAGE %s = %c%s, want the size of 10.0.0.0/8", key, r.Type, r.Str)
+		}
+	}
+	if r := mustDo(t, ss, "GET", "fe80::1%eth0"); r.Type != NullReply {
+		t.Errorf("GET fe80::1%%eth0 = %+v, want null", r)
+	}
+	if r := mustDo(t, ss, "GET", "2001:0db8::5%eth0"); r.Str != "b" {
+		t.Errorf("GET 2001:0db8::5%%eth0 = %+v, want b", r)
+	}
+	if r := mustDo(t, ss, "DEL", "2001:db8:0:0::/32"); r.Int != 1 {
+		t.Errorf("DEL 2001:db8:0:0::/32 = %d, want 1", r.Int)
+	}
+
+	mustDo(t, ss, "CONFIG", "SET", "reject-host-bits", "yes")
+	if err := ss.Do("SET", "10.1.2.3/8", "a").Err(); err == nil || !strings.Contains(err.Error(), "10.0.0.0/8") {
+		t.Errorf("SET 10.1.2.3/8 with reject-host-bits = %v, want an error naming 10.0.0.0/8", err)
+	}
+	mustDo(t, ss, "SET", "010.0.0.0/8", "a")
+	if r := mustDo(t, ss, "GET", "10.1.2.3/8"); r.Str != "a" {
+		t.Errorf("GET 10.1.2.3/8 with reject-host-bits = %+v, want a", r)
+	}
+	if r := mustDo(t, ss, "DEL", "10.1.2.3/8"); r.Int != 1 {
+		t.Errorf("DEL 10.1.2.3/8 with reject-host-bits = %d, want 1", r.Int)
+	}
+}
+
+func TestIPv4Mapped(t *testing.T) {
+	for _, tc := range []struct {
+		mode      string
+		setErr    bool   // SET ::ffff:192.0.2.0/120 fails
+		key       string // what it is stored as
+		getV4     string // GET 192.0.2.7
+		getMapped string // GET ::ffff:192.0.2.7
+	}{
+		{mode: "convert", key: "192.0.2.0/24", getV4: "mapped", getMapped: "mapped"},
+		{mode: "reject", setErr: true, getV4: "v4", getMapped: "v4"},
+		{mode: "native", key: "::ffff:192.0.2.0/120", getV4: "v4", getMapped: "mapped"},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			ss := newTestSession(t, newTestServer(t))
+			mustDo(t, ss, "CONFIG", "SET", "ipv4-mapped", tc.mode)
+			mustDo(t, ss, "SET", "192.0.0.0/16", "v4")
+			err := ss.Do("SET", "::ffff:192.0.2.0/120", "mapped").Err()
+			if (err != nil) != tc.setErr {
+				t.Fatalf("SET ::ffff:192.0.2.0/120 = %v, want an error: %v", err, tc.setErr)
+			}
+			if tc.key != "" {
+				if got := mustDo(t, ss, "KEYS", tc.key).strs(); len(got) != 1 {
+					t.Errorf("KEYS %s = %q, want it stored", tc.key, got)
+				}
+			}
+			for addr, want := range map[string]string{"192.0.2.7": tc.getV4, "::ffff:192.0.2.7": tc.getMapped} {
+				if r := mustDo(t, ss, "GET", addr); r.Str != want {
+					t.Errorf("GET %s = %q, want %q", addr, r.Str, want)
+				}
+			}
+			// Shorter than /96, ::ffff:0:0/95 is genuinely IPv6.
+			mustDo(t, ss, "SET", "::fffe:0:0/95", "v6")
+			if got := mustDo(t, ss, "KEYS", "::fffe:0:0/95").strs(); len(got) != 1 {
+				t.Errorf("::fffe:0:0/95 was not stored as IPv6: %q", mustDo(t, ss, "KEYS", "*").strs())
+			}
+		})
+	}
+	ss := newTestSession(t, newTestServer(t))
+	if err := ss.Do("CONFIG", "SET", "ipv4-mapped", "maybe").Err(); err == nil {
+		t.Error("CONFIG SET ipv4-mapped maybe succeeded")
+	}
+	if got := mustDo(t, ss, "CONFIG", "GET", "ipv4-mapped").strs(); !slices.Equal(got, []string{"ipv4-mapped", "convert"}) {
+		t.Errorf("CONFIG GET ipv4-mapped = %q, want convert", got)
+	}
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// blockProfileRate mirrors the last runtime.SetBlockProfileRate value,
+// which the runtime offers no way to read back.
+var blockProfileRate atomic.Int64
+
+// ServeDebug serves net/http/pprof and expvar on a dedicated HTTP
+// listener. It must never share a port with RESP, so it only ever binds
+// the -debug-addr it is given.
+func (s *TrieServer) ServeDebug(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	// /debug/vars carries the same fields INFO reports, grouped by section.
+	expvar.Publish("triedis", expvar.Func(func() any {
+		out := make(map[string]map[string]string)
+		for _, sec := range infoSections {
+			var b strings.Builder
+			sec.render(s, &b)
+			fields := make(map[string]string)
+			for _, line := range strings.Split(b.String(), "\r\n") {
+				if k, v, ok := strings.Cut(line, ":"); ok {
+					fields[k] = v
+				}
+			}
+			out[strings.ToLower(sec.name)] = fields
+		}
+		return out
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index) // heap, goroutine, mutex, block, ...
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("debug listener stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// handleDebug implements the DEBUG subcommands.
+func (s *TrieServer) handleDebug(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'DEBUG'")
+		return
+	}
+	sub := strings.ToUpper(string(cmd.Args[1]))
+
+	switch sub {
+	case "OBJECT":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'DEBUG OBJECT'")
+			return
+		}
+		info, ok := s.getDB(currentDB(conn)).describe(string(cmd.Args[2]))
+		if !ok {
+			writeError(conn, errNoSuchKey)
+			return
+		}
+		parent := "none"
+		if info.parent.IsValid() {
+			parent = info.parent.String()
+		}
+		descendants := strconv.Itoa(info.descendants)
+		if info.descendants >= maxDescendants {
+			descendants += "+"
+		}
+		family := "ipv4"
+		if info.prefix.Addr().Is6() {
+			family = "ipv6"
+		}
+		ttl := info.value.ttl()
+		if ttl > 0 {
+			ttl = (ttl + 500) / 1000
+		}
+		conn.WriteString(fmt.Sprintf("Value at:%s exact:1 type:%s encoding:%s serializedlength:%d "+
+			"lru_seconds_idle:%d family:%s prefixlen:%d parent:%s descendants:%s depth:%d ttl:%d",
+			info.prefix, info.value.typeName(), info.value.encoding(), info.value.size(),
+			info.value.idle(), family, info.prefix.Bits(), parent, descendants, info.depth, ttl))
+
+	case "VERIFY":
+		s.handleDebugVerify(conn, cmd)
+
+	case "DIGEST":
+		s.handleDebugDigest(conn, cmd)
+
+	case "DIGEST-VALUE":
+		s.handleDebugDigestValue(conn, cmd)
+
+	case "SLEEP":
+		if !s.debugAllowed(conn) {
+			return
+		}
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'DEBUG SLEEP'")
+			return
+		}
+		secs, err := strconv.ParseFloat(string(cmd.Args[2]), 64)
+		if err != nil || secs < 0 || math.IsInf(secs, 0) || math.IsNaN(secs) {
+			conn.WriteError("ERR value is not a valid float")
+			return
+		}
+		// Hold the current DB's write lock, as a write command would, so
+		// other clients of that DB stall too.
+		s.getDB(currentDB(conn)).stall(time.Duration(secs * float64(time.Second)))
+		writeOK(conn)
+
+	case "ERROR":
+		if !s.debugAllowed(conn) {
+			return
+		}
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'DEBUG ERROR'")
+			return
+		}
+		conn.WriteError(string(cmd.Args[2]))
+
+	case "POPULATE":
+		if !s.debugAllowed(conn) {
+			return
+		}
+		id := currentDB(conn)
+		err := s.writable(id)
+		if s.readOnly.Load() {
+			err = newError(ClassReadOnly, "You can't write against a read only server")
+		}
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		d := s.getDB(id)
+		opts, err := parsePopulate(d, cmd.Args[2:])
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		conn.WriteInt64(d.populate(opts))
+
+	default:
+		conn.WriteError("ERR unknown subcommand '" + sub + "' for 'DEBUG'")
+	}
+}
+
+// populateOptions are DEBUG POPULATE's arguments.
+type populateOptions struct {
+	count     int64
+	within    netip.Prefix
+	bits      int
+	valueSize int // 0 leaves values unpadded
+	seed      uint64
+}
+
+// parsePopulate parses count [WITHIN cidr] [PREFIXLEN n] [VALUESIZE bytes]
+// [SEED n]. WITHIN defaults to 0.0.0.0/0, and PREFIXLEN to the first of
+// 24 and 32, or for IPv6 of 48, 64 and 128, longer than WITHIN's.
+func parsePopulate(d *database, args [][]byte) (populateOptions, error) {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return populateOptions{}, newError(ClassErr, "wrong number of arguments for 'DEBUG POPULATE'")
+	}
+	opts := populateOptions{within: netip.PrefixFrom(netip.IPv4Unspecified(), 0), bits: -1}
+	var err error
+	if opts.count, err = strconv.ParseInt(string(args[0]), 10, 64); err != nil || opts.count < 0 {
+		return opts, newError(ClassErr, "count must be a non-negative integer")
+	}
+	for i := 1; i < len(args); i += 2 {
+		arg := string(args[i+1])
+		switch strings.ToUpper(string(args[i])) {
+		case "WITHIN":
+			if opts.within, err = d.parseKey(arg); err != nil {
+				return opts, newError(ClassErr, err.Error())
+			}
+		case "PREFIXLEN":
+			if opts.bits, err = strconv.Atoi(arg); err != nil || opts.bits < 0 {
+				return opts, newError(ClassErr, "PREFIXLEN must be a non-negative integer")
+			}
+		case "VALUESIZE":
+			if opts.valueSize, err = strconv.Atoi(arg); err != nil || opts.valueSize < 0 || opts.valueSize > 512<<20 {
+				return opts, newError(ClassErr, "VALUESIZE must be a non-negative number of bytes")
+			}
+		case "SEED":
+			if opts.seed, err = strconv.ParseUint(arg, 10, 64); err != nil {
+				return opts, newError(ClassErr, "SEED must be a non-negative integer")
+			}
+		default:
+			return opts, errSyntax
+		}
+	}
+	w, maxBits := opts.within.Bits(), opts.within.Addr().BitLen()
+	if opts.bits < 0 {
+		defaults := []int{24, 32}
+		if maxBits == 128 {
+			defaults = []int{48, 64, 128}
+		}
+		for _, opts.bits = range defaults {
+			if opts.bits > w {
+				break
+			}
+		}
+	}
+	if opts.bits < w || opts.bits > maxBits {
+		return opts, errorf(ClassErr, "PREFIXLEN must be between %d and %d for %s", w, maxBits, opts.within)
+	}
+	return opts, nil
+}
+
+// populate stores opts.count random prefixes of opts.bits within
+// opts.within, the same ones for the same options and seed, and returns
+// how many were new: draws of a prefix already stored are skipped. The
+// value of the i-th is "value:i", padded with x or cut to opts.valueSize.
+func (d *database) populate(opts populateOptions) int64 {
+	rng := rand.New(rand.NewPCG(opts.seed, uint64(opts.bits)))
+	base := opts.within.Addr().As16()
+	w := opts.within.Bits()
+	if opts.within.Addr().Is4() {
+		w += 96
+	}
+	end := opts.bits + 128 - opts.within.Addr().BitLen()
+	var inserted int64
+	for i := range opts.count {
+		if i > 0 && i%importBatch == 0 {
+			runtime.Gosched()
+		}
+		b := base
+		var r uint64
+		for bit := w; bit < end; bit++ {
+			if (bit-w)%64 == 0 {
+				r = rng.Uint64()
+			}
+			b[bit/8] |= byte(r&1) << (7 - bit%8)
+			r >>= 1
+		}
+		a := netip.AddrFrom16(b)
+		if opts.within.Addr().Is4() {
+			a = a.Unmap()
+		}
+		v := "value:" + strconv.FormatInt(i, 10)
+		if opts.valueSize > 0 {
+			v = (v + strings.Repeat("x", max(opts.valueSize-len(v), 0)))[:opts.valueSize]
+		}
+		if !d.store(netip.PrefixFrom(a, opts.bits), stringValue([]byte(v)), false) {
+			inserted++
+		}
+	}
+	return inserted
+}
+
+// debugAllowed applies -enable-debug-command to the DEBUG subcommands
+// that can disrupt the server, writing the refusal when it says no.
+func (s *TrieServer) debugAllowed(conn redcon.Conn) bool {
+	switch s.debugCommand {
+	case "yes":
+		return true
+	case "local":
+		if ap, err := netip.ParseAddrPort(conn.RemoteAddr()); err == nil && ap.Addr().IsLoopback() {
+			return true
+		}
+	}
+	conn.WriteError("ERR DEBUG command not allowed. If the enable-debug-command option is set to " +
+		"\"local\", you can run it from a local connection, otherwise you need to set this option " +
+		"at startup, and then restart the server.")
+	return false
+}
+
+// registerDebugConfig exposes the mutex and block profiling rates, which
+// are both off unless set here or with the matching flags.
+func (s *TrieServer) registerDebugConfig() {
+	s.addConfig("enable-debug-command", func() string { return s.debugCommand }, nil)
+	rate := func(name string, get func() int, set func(int)) {
+		s.addConfig(name,
+			func() string { return strconv.Itoa(get()) },
+			func(v string) error {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					return fmt.Errorf("argument must be a non-negative integer")
+				}
+				set(n)
+				return nil
+			})
+	}
+	rate("mutex-profile-fraction",
+		func() int { return runtime.SetMutexProfileFraction(-1) },
+		func(n int) { runtime.SetMutexProfileFraction(n) })
+	rate("block-profile-rate",
+		func() int { return int(blockProfileRate.Load()) },
+		SetBlockProfileRate)
+}
+
+// SetBlockProfileRate sets the runtime's block profile rate, as CONFIG SET
+// block-profile-rate does.
+func SetBlockProfileRate(n int) {
+	runtime.SetBlockProfileRate(n)
+	blockProfileRate.Store(int64(n))
+}
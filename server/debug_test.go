@@ -0,0 +1,266 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeDebug(t *testing.T) {
+	s := newTestServer(t)
+	mustDo(t, newTestSession(t, s), "SET", "10.0.0.0/8", "a")
+	addr := "127.0.0.1:" + strconv.Itoa(freePort(t))
+	if err := s.ServeDebug(addr); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline", "/debug/vars"} {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: %s", path, resp.Status)
+		}
+	}
+
+	resp, err := http.Get("http://" + addr + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var vars struct {
+		Triedis map[string]map[string]string `json:"triedis"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	for _, sec := range infoSections {
+		if _, ok := vars.Triedis[strings.ToLower(sec.name)]; !ok {
+			t.Errorf("/debug/vars lacks the %s section", sec.name)
+		}
+	}
+	if got := vars.Triedis["keyspace"]["db0"]; !strings.HasPrefix(got, "keys=1,") {
+		t.Errorf("/debug/vars keyspace db0 = %q", got)
+	}
+}
+
+func TestProfileRateConfig(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	defer mustDo(t, ss, "CONFIG", "SET", "mutex-profile-fraction", "0", "block-profile-rate", "0")
+	for _, tc := range []struct {
+		name, value string
+		wantErr     bool
+	}{
+		{"mutex-profile-fraction", "5", false},
+		{"mutex-profile-fraction", "-1", true},
+		{"block-profile-rate", "1000", false},
+		{"block-profile-rate", "often", true},
+	} {
+		err := ss.Do("CONFIG", "SET", tc.name, tc.value).Err()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("CONFIG SET %s %s: %v, want error %v", tc.name, tc.value, err, tc.wantErr)
+		}
+		if err == nil {
+			if got := mustDo(t, ss, "CONFIG", "GET", tc.name).strs(); got[1] != tc.value {
+				t.Errorf("CONFIG GET %s = %s, want %s", tc.name, got[1], tc.value)
+			}
+		}
+	}
+}
+
+func TestDebugObject(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "2001:db8::/32", "2001:db8:1::/48"} {
+		mustDo(t, ss, "SET", cidr, "v-"+cidr)
+	}
+	for _, tc := range []struct {
+		cidr string
+		want string // fields after "Value at:", before ttl
+	}{
+		// depth counts trie nodes, so 10.1.0.0/16 is below the glue
+		// node joining it to 10.2.0.0/16.
+		{"10.0.0.0/8", "10.0.0.0/8 exact:1 type:string encoding:raw serializedlength:12 lru_seconds_idle:0 family:ipv4 prefixlen:8 parent:none descendants:3 depth:0"},
+		{"10.1.0.0/16", "10.1.0.0/16 exact:1 type:string encoding:raw serializedlength:13 lru_seconds_idle:0 family:ipv4 prefixlen:16 parent:10.0.0.0/8 descendants:1 depth:2"},
+		{"10.1.2.0/24", "10.1.2.0/24 exact:1 type:string encoding:raw serializedlength:13 lru_seconds_idle:0 family:ipv4 prefixlen:24 parent:10.1.0.0/16 descendants:0 depth:3"},
+		{"2001:db8::/32", "2001:db8::/32 exact:1 type:string encoding:raw serializedlength:15 lru_seconds_idle:0 family:ipv6 prefixlen:32 parent:none descendants:1 depth:0"},
+		{"2001:db8:1::/48", "2001:db8:1::/48 exact:1 type:string encoding:raw serializedlength:17 lru_seconds_idle:0 family:ipv6 prefixlen:48 parent:2001:db8::/32 descendants:0 depth:1"},
+	} {
+		r := mustDo(t, ss, "DEBUG", "OBJECT", tc.cidr)
+		if want := "Value at:" + tc.want + " ttl:-1"; r.Str != want {
+			t.Errorf("DEBUG OBJECT %s = %q, want %q", tc.cidr, r.Str, want)
+		}
+	}
+	for _, cidr := range []string{"10.3.0.0/16", "10.1.2.3", "not-a-cidr"} {
+		if err := ss.Do("DEBUG", "OBJECT", cidr).Err(); err == nil || err.Error() != "ERR no such key" {
+			t.Errorf("DEBUG OBJECT %s = %v, want ERR no such key", cidr, err)
+		}
+	}
+}
+
+// remoteConn is a testConn seen from another address.
+type remoteConn struct {
+	*testConn
+	addr string
+}
+
+func (rc remoteConn) RemoteAddr() string { return rc.addr }
+
+func TestDebugAllowed(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct {
+		mode, addr string
+		want       bool
+	}{
+		{"yes", "192.0.2.1:5000", true},
+		{"local", "127.0.0.1:5000", true},
+		{"local", "[::1]:5000", true},
+		{"local", "192.0.2.1:5000", false},
+		{"no", "127.0.0.1:5000", false},
+		{"", "127.0.0.1:5000", false},
+	} {
+		s.debugCommand = tc.mode
+		conn := remoteConn{&testConn{}, tc.addr}
+		if got := s.debugAllowed(conn); got != tc.want {
+			t.Errorf("enable-debug-command %q from %s allowed %v, want %v", tc.mode, tc.addr, got, tc.want)
+		}
+		if refused := len(conn.buf) > 0; refused == tc.want {
+			t.Errorf("enable-debug-command %q from %s wrote %q", tc.mode, tc.addr, conn.buf)
+		}
+	}
+}
+
+func TestDebugSleepAndError(t *testing.T) {
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	if err := ss.Do("DEBUG", "ERROR", "boom").Err(); err == nil || !strings.HasPrefix(err.Error(), "ERR DEBUG command not allowed") {
+		t.Errorf("DEBUG ERROR with enable-debug-command no = %v", err)
+	}
+	s.debugCommand = "yes"
+	for _, tc := range []struct {
+		args    []string
+		wantErr string // the error, if any
+	}{
+		{args: []string{"ERROR", "WRONGTYPE oops"}, wantErr: "WRONGTYPE oops"},
+		{args: []string{"ERROR"}, wantErr: "ERR wrong number of arguments for 'DEBUG ERROR'"},
+		{args: []string{"SLEEP", "0"}},
+		{args: []string{"SLEEP", "0.01"}},
+		{args: []string{"SLEEP", "-1"}, wantErr: "ERR value is not a valid float"},
+		{args: []string{"SLEEP", "inf"}, wantErr: "ERR value is not a valid float"},
+		{args: []string{"SLEEP", "soon"}, wantErr: "ERR value is not a valid float"},
+	} {
+		err := ss.Do(append([]string{"DEBUG"}, tc.args...)...).Err()
+		if got := fmt.Sprint(err); (tc.wantErr == "" && err != nil) || (tc.wantErr != "" && got != tc.wantErr) {
+			t.Errorf("DEBUG %q = %v, want %q", tc.args, err, tc.wantErr)
+		}
+	}
+
+	// A sleep holds the DB's write lock, so a write waits it out.
+	done := make(chan error)
+	go func() { done <- ss.Do("DEBUG", "SLEEP", "0.2").Err() }()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	mustDo(t, newTestSession(t, s), "SET", "10.0.0.0/8", "a")
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("SET during DEBUG SLEEP returned after %v", waited)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDebugPopulate(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		want     string // the reply
+		wantBits int    // the length of every stored prefix
+		within   string
+	}{
+		{args: []string{"100"}, want: "100", wantBits: 24, within: "0.0.0.0/0"},
+		{args: []string{"0"}, want: "0"},
+		{args: []string{"50", "WITHIN", "10.0.0.0/8"}, want: "50", wantBits: 24, within: "10.0.0.0/8"},
+		{args: []string{"5", "within", "10.1.0.0/24"}, want: "5", wantBits: 32, within: "10.1.0.0/24"},
+		{args: []string{"50", "WITHIN", "2001:db8::/32"}, want: "50", wantBits: 48, within: "2001:db8::/32"},
+		{args: []string{"50", "WITHIN", "2001:db8::/48", "PREFIXLEN", "64"}, want: "50", wantBits: 64, within: "2001:db8::/48"},
+		// Only four /26s fit in a /24, so most draws repeat one.
+		{args: []string{"100", "WITHIN", "192.0.2.0/24", "PREFIXLEN", "26"}, want: "4", wantBits: 26, within: "192.0.2.0/24"},
+		{args: []string{"3", "WITHIN", "192.0.2.0/24", "PREFIXLEN", "24"}, want: "1", wantBits: 24, within: "192.0.2.0/24"},
+		{args: []string{}, want: "ERR wrong number of arguments for 'DEBUG POPULATE'"},
+		{args: []string{"10", "SEED"}, want: "ERR wrong number of arguments for 'DEBUG POPULATE'"},
+		{args: []string{"-1"}, want: "ERR count must be a non-negative integer"},
+		{args: []string{"10", "WITHIN", "10.0.0.0/8", "PREFIXLEN", "4"}, want: "ERR PREFIXLEN must be between 8 and 32 for 10.0.0.0/8"},
+		{args: []string{"10", "PREFIXLEN", "33"}, want: "ERR PREFIXLEN must be between 0 and 32 for 0.0.0.0/0"},
+		{args: []string{"10", "VALUESIZE", "big"}, want: "ERR VALUESIZE must be a non-negative number of bytes"},
+		{args: []string{"10", "SEED", "-1"}, want: "ERR SEED must be a non-negative integer"},
+		{args: []string{"10", "SOON", "1"}, want: "ERR syntax error"},
+	} {
+		s := newTestServer(t)
+		s.debugCommand = "yes"
+		ss := newTestSession(t, s)
+		runSteps(t, ss, []replyStep{{append([]string{"DEBUG", "POPULATE"}, tc.args...), tc.want}})
+		if tc.wantBits == 0 {
+			continue
+		}
+		within := netip.MustParsePrefix(tc.within)
+		keys := mustDo(t, ss, "KEYS", "*").strs()
+		if strconv.Itoa(len(keys)) != tc.want {
+			t.Errorf("DEBUG POPULATE %q stored %d prefixes, replied %s", tc.args, len(keys), tc.want)
+		}
+		for _, k := range keys {
+			p := netip.MustParsePrefix(k)
+			if p.Bits() != tc.wantBits || !within.Contains(p.Addr()) {
+				t.Errorf("DEBUG POPULATE %q stored %s, want a /%d inside %s", tc.args, p, tc.wantBits, within)
+			}
+		}
+	}
+}
+
+func TestDebugPopulateDeterministic(t *testing.T) {
+	populate := func(args ...string) ([]string, map[string]string) {
+		s := newTestServer(t)
+		s.debugCommand = "yes"
+		ss := newTestSession(t, s)
+		mustDo(t, ss, append([]string{"DEBUG", "POPULATE"}, args...)...)
+		keys := mustDo(t, ss, "KEYS", "*").strs()
+		slices.Sort(keys)
+		values := make(map[string]string)
+		for _, k := range keys {
+			values[k] = mustDo(t, ss, "GET", k).Str
+		}
+		return keys, values
+	}
+	a, values := populate("200", "SEED", "7", "VALUESIZE", "12")
+	b, _ := populate("200", "SEED", "7", "VALUESIZE", "12")
+	c, _ := populate("200", "SEED", "8", "VALUESIZE", "12")
+	if !slices.Equal(a, b) {
+		t.Error("the same seed populated different prefixes")
+	}
+	if slices.Equal(a, c) {
+		t.Error("different seeds populated the same prefixes")
+	}
+	for k, v := range values {
+		if len(v) != 12 || !strings.HasPrefix(v, "value:") {
+			t.Errorf("%s = %q, want a 12-byte value:i", k, v)
+		}
+	}
+}
+
+func TestDebugPopulateRefused(t *testing.T) {
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	if err := ss.Do("DEBUG", "POPULATE", "10").Err(); err == nil || !strings.HasPrefix(err.Error(), "ERR DEBUG command not allowed") {
+		t.Errorf("DEBUG POPULATE with enable-debug-command no = %v", err)
+	}
+	s.debugCommand = "yes"
+	s.readOnly.Store(true)
+	if err := ss.Do("DEBUG", "POPULATE", "10").Err(); err == nil || !strings.HasPrefix(err.Error(), "READONLY") {
+		t.Errorf("DEBUG POPULATE on a read-only server = %v", err)
+	}
+	runSteps(t, ss, []replyStep{{[]string{"DBSIZE"}, "0"}})
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+)
+
+// dbDefaults records, per database, the value GET and SPM answer with
+// when no stored prefix covers the address, in place of nil. Like a name,
+// it belongs to the index, so it survives FLUSHDB, DROPDB and a committed
+// stage replacing the database. Exact lookups, which ask whether a prefix
+// is stored, never see it.
+type dbDefaults struct {
+	mu   sync.RWMutex
+	byID map[int][]byte
+}
+
+func newDBDefaults() *dbDefaults {
+	return &dbDefaults{byID: make(map[int][]byte)}
+}
+
+func (d *dbDefaults) get(id int) ([]byte, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	v, ok := d.byID[id]
+	return v, ok
+}
+
+// set makes v database id's default, or clears it if v is nil.
+func (d *dbDefaults) set(id int, v []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v != nil {
+		d.byID[id] = v
+	} else {
+		delete(d.byID, id)
+	}
+}
+
+// ids returns the indices with a default, in no particular order.
+func (d *dbDefaults) ids() []int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ids := make([]int, 0, len(d.byID))
+	for id := range d.byID {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// String formats the defaults as the db-default-value setting takes them,
+// e.g. `0 unknown 3 "no route"`.
+func (d *dbDefaults) String() string {
+	ids := d.ids()
+	sort.Ints(ids)
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		v, _ := d.get(id)
+		parts[i] = strconv.Itoa(id) + " " + quoteArg(v)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Set replaces every default with spec, a list of "index value" pairs
+// separated by spaces, with values quoted as redis-cli quotes arguments,
+// leaving them unchanged if spec is invalid. Databases not listed get no
+// default.
+func (d *dbDefaults) Set(spec string) error {
+	fields, err := splitArgs([]byte(spec))
+	if err != nil {
+		return err
+	}
+	if len(fields)%2 != 0 {
+		return errors.New("expected index value pairs, e.g. '0 unknown'")
+	}
+	byID := make(map[int][]byte)
+	for i := 0; i < len(fields); i += 2 {
+		id, err := strconv.Atoi(string(fields[i]))
+		if err != nil || id < 0 {
+			return fmt.Errorf("invalid database index '%s'", fields[i])
+		}
+		byID[id] = fields[i+1]
+	}
+	d.mu.Lock()
+	d.byID = byID
+	d.mu.Unlock()
+	return nil
+}
+
+// quoteArg returns b as one splitArgs argument: itself if it needs no
+// quoting, else double-quoted with escapes.
+func quoteArg(b []byte) string {
+	plain := len(b) > 0
+	for _, ch := range b {
+		if ch <= ' ' || ch >= 0x7f || ch == '"' || ch == '\'' || ch == '\\' {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return string(b)
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, ch := range b {
+		switch {
+		case ch == '"' || ch == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(ch)
+		case ch == '\n':
+			sb.WriteString(`\n`)
+		case ch == '\r':
+			sb.WriteString(`\r`)
+		case ch == '\t':
+			sb.WriteString(`\t`)
+		case ch < ' ' || ch >= 0x7f:
+			fmt.Fprintf(&sb, `\x%02x`, ch)
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// missDefault returns the default db answers a lookup of key with when
+// nothing covers it, or false if db has none or key is not an address or
+// prefix, which stays an error or nil as before.
+func (s *TrieServer) missDefault(db *database, key string) ([]byte, bool) {
+	v, ok := s.defaults.get(db.id)
+	if !ok {
+		return nil, false
+	}
+	if _, err := db.parseLookup(key); err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// handleSetDefault implements SETDEFAULT index|name [value]. Without a
+// value it clears the database's default, so misses answer nil again.
+func (s *TrieServer) handleSetDefault(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for 'SETDEFAULT'")
+		return
+	}
+	id, err := s.resolveDB(string(cmd.Args[1]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	var v []byte
+	if len(cmd.Args) == 3 {
+		v = append([]byte{}, cmd.Args[2]...) // args share redcon's read buffer
+	}
+	s.defaults.set(id, v)
+	writeOK(conn)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDBDefaults(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"GET", "192.0.2.1"}, "nil"},
+		{[]string{"SETDEFAULT", "0", "unknown"}, "OK"},
+		{[]string{"GET", "192.0.2.1"}, "unknown"},
+		{[]string{"GET", "192.0.2.0/24"}, "unknown"},
+		{[]string{"GET", "10.1.2.3"}, "a"},
+		{[]string{"GET", "10.1.2.3", "MAXLEN", "4"}, "unknown"},
+		{[]string{"GET", "not-an-ip"}, "nil"},
+		{[]string{"SPM", "192.0.2.1"}, "unknown"},
+		{[]string{"SPM", "192.0.2.1", "WITHPREFIX"}, "[nil unknown]"},
+		{[]string{"SPM", "10.1.2.3", "WITHPREFIX"}, "[10.0.0.0/8 a]"},
+		{[]string{"HGET", "192.0.2.0/24", "f"}, "nil"}, // exact lookups never see it
+		{[]string{"FLUSHDB"}, "OK"},
+		{[]string{"GET", "10.1.2.3"}, "unknown"}, // the default outlives the data
+		{[]string{"NAMEDB", "3", "geo"}, "OK"},
+		{[]string{"SETDEFAULT", "geo", "no route"}, "OK"},
+		{[]string{"SELECT", "geo"}, "OK"},
+		{[]string{"GET", "10.1.2.3"}, "no route"},
+		{[]string{"CONFIG", "GET", "db-default-value"}, `[db-default-value 0 unknown 3 "no route"]`},
+		{[]string{"SETDEFAULT", "0"}, "OK"},
+		{[]string{"SELECT", "0"}, "OK"},
+		{[]string{"GET", "10.1.2.3"}, "nil"},
+		{[]string{"SETDEFAULT", "nosuch", "x"}, "ERR unknown database name"},
+		{[]string{"SETDEFAULT"}, "ERR wrong number of arguments for 'SETDEFAULT'"},
+		{[]string{"SETDEFAULT", "0", "a", "b"}, "ERR wrong number of arguments for 'SETDEFAULT'"},
+	})
+
+	// A miss answered with the default still counts as one.
+	ss = newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"SETDEFAULT", "0", "unknown"}, "OK"},
+		{[]string{"GET", "192.0.2.1"}, "unknown"},
+	})
+	if got := infoFields(mustDo(t, ss, "INFO", "stats").Str)["keyspace_misses"]; got != "1" {
+		t.Errorf("keyspace_misses = %s, want 1", got)
+	}
+}
+
+func TestDBDefaultsSet(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		want    string // String afterwards
+		wantErr bool
+	}{
+		{spec: "", want: ""},
+		{spec: "0 unknown", want: "0 unknown"},
+		{spec: `3 "no route" 0 x`, want: `0 x 3 "no route"`},
+		{spec: `1 'it''s'`, wantErr: true},
+		{spec: `1 "tab\there" 2 "q\"uote" 4 "\x00"`, want: `1 "tab\there" 2 "q\"uote" 4 "\x00"`},
+		{spec: `1 ""`, want: `1 ""`},
+		{spec: `0`, wantErr: true},
+		{spec: `x y`, wantErr: true},
+		{spec: `-1 y`, wantErr: true},
+		{spec: `0 "open`, wantErr: true},
+	} {
+		d := newDBDefaults()
+		d.set(9, []byte("before"))
+		err := d.Set(tc.spec)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Set(%q): %v, want error %v", tc.spec, err, tc.wantErr)
+			continue
+		}
+		want := tc.want
+		if err != nil {
+			want = "9 before" // unchanged
+		}
+		if got := d.String(); got != want {
+			t.Errorf("after Set(%q) String() = %q, want %q", tc.spec, got, want)
+		}
+		// What String writes, Set reads back.
+		again := newDBDefaults()
+		if err := again.Set(d.String()); err != nil || again.String() != d.String() {
+			t.Errorf("Set(%q) = %v, then String() = %q", d.String(), err, again.String())
+		}
+	}
+}
+
+func TestDBDefaultsSaved(t *testing.T) {
+	s := newTestServer(t)
+	s.snapshots.dir = t.TempDir()
+	ss := newTestSession(t, s)
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"SETDEFAULT", "0", "unknown\x00"}, "OK"},
+		{[]string{"SAVE"}, "OK"},
+	})
+	path := filepath.Join(s.snapshots.dir, s.snapshots.dbFilename)
+	for _, tc := range []struct {
+		defaults bool // take the default from the snapshot
+		want     string
+	}{
+		{true, "unknown\x00"},
+		{false, "nil"},
+	} {
+		loaded := newTestServer(t)
+		loaded.snapshots.dir, loaded.snapshots.dbFilename = filepath.Split(path)
+		if _, _, err := loaded.loadSnapshots(true, true, tc.defaults); err != nil {
+			t.Fatal(err)
+		}
+		runSteps(t, newTestSession(t, loaded), []replyStep{
+			{[]string{"GET", "10.1.2.3"}, "a"},
+			{[]string{"GET", "192.0.2.1"}, tc.want},
+		})
+	}
+	if got := mustDo(t, ss, "SNAPSHOTINFO", s.snapshots.dbFilename).String(); !strings.Contains(got, "default unknown\x00") {
+		t.Errorf("SNAPSHOTINFO = %s, want the default reported", got)
+	}
+}
+
+func TestGatewayDefault(t *testing.T) {
+	s := newTestServer(t)
+	addr := "127.0.0.1:" + strconv.Itoa(freePort(t))
+	if err := s.ServeGateway(addr); err != nil {
+		t.Fatal(err)
+	}
+	ss := newTestSession(t, s)
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"SETDEFAULT", "0", "unknown"}, "OK"},
+		{[]string{"SETDEFAULT", "5", "empty"}, "OK"},
+	})
+	for _, tc := range []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/lookup/10.1.2.3", 200, `{"prefix":"10.0.0.0/8","value":"a"}`},
+		{"/lookup/192.0.2.1", 200, `{"default":true,"prefix":null,"value":"unknown"}`},
+		{"/lookup/192.0.2.1?db=5", 200, `{"default":true,"prefix":null,"value":"empty"}`}, // a DB that holds nothing
+		{"/lookup/192.0.2.1?db=6", 404, `{"error":"not found"}`},
+		{"/lookup/not-an-ip", 400, `{"error":"invalid IP/CIDR"}`},
+		{"/match/192.0.2.1", 404, `{"error":"not found"}`},
+		{"/key/192.0.2.0/24", 404, `{"error":"not found"}`},
+	} {
+		resp, err := http.Get("http://" + addr + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || strings.TrimSpace(string(body)) != tc.want {
+			t.Errorf("GET %s: %d %s, want %d %s", tc.path, resp.StatusCode, body, tc.status, tc.want)
+		}
+	}
+	if _, ok := s.dbs[5]; ok {
+		t.Error("a gateway lookup created database 5")
+	}
+}
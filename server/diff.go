@@ -0,0 +1,194 @@
+package server
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// diffOptions are the settings of one DBDIFF.
+type diffOptions struct {
+	within netip.Prefix // compare only the prefixes it covers, if valid
+	values bool         // also count prefixes whose values differ
+	limit  int          // prefixes to list of each kind; 0 lists none
+}
+
+// diffResult is what DBDIFF found. The key lists hold at most
+// diffOptions.limit prefixes each, the first ones found.
+type diffResult struct {
+	onlyA, onlyB, changed             int64
+	onlyAKeys, onlyBKeys, changedKeys []string
+}
+
+// diffDBs compares a and b. Both are read-locked as a whole for the
+// duration, so the result describes one instant; nothing is copied, each
+// prefix of either side is just looked up in the other, so memory use is
+// bounded by the key lists. a and b must differ. It stops with bud's
+// error once bud runs out.
+func diffDBs(a, b *database, opts diffOptions, bud *budget) (diffResult, error) {
+	// Lock in id order, so two commands locking the same pair never wait
+	// on each other.
+	first, second := a, b
+	if second.id < first.id {
+		first, second = second, first
+	}
+	defer first.rlockAll()()
+	defer second.rlockAll()()
+
+	var res diffResult
+	note := func(list *[]string, p netip.Prefix) {
+		if len(*list) < opts.limit {
+			*list = append(*list, p.String())
+		}
+	}
+	// Both databases split the address space the same way, as shardBits
+	// is server-wide, so each prefix lives in the same shard of either.
+	shardsA, shardsB := a.allShards(), b.allShards()
+	if opts.within.IsValid() {
+		if home := a.shardFor(opts.within); home != a.wide {
+			shardsA, shardsB = []*shard{home}, []*shard{b.shardFor(opts.within)}
+		}
+	}
+	walk := func(t *shard, fn func(netip.Prefix, value) bool) {
+		if opts.within.IsValid() {
+			t.trie.Subnets(opts.within, fn)
+		} else {
+			t.trie.Walk(fn)
+		}
+	}
+	for i := range shardsA {
+		shA, shB := shardsA[i], shardsB[i]
+		walk(shA, func(p netip.Prefix, v value) bool {
+			if bud.exceeded() {
+				return false
+			}
+			w, ok := shB.trie.Get(p)
+			switch {
+			case !ok:
+				res.onlyA++
+				note(&res.onlyAKeys, p)
+			case opts.values && !v.equal(w):
+				res.changed++
+				note(&res.changedKeys, p)
+			}
+			return true
+		})
+		walk(shB, func(p netip.Prefix, _ value) bool {
+			if bud.exceeded() {
+				return false
+			}
+			if _, ok := shA.trie.Get(p); !ok {
+				res.onlyB++
+				note(&res.onlyBKeys, p)
+			}
+			return true
+		})
+		if bud.exceeded() {
+			return diffResult{}, bud.err()
+		}
+	}
+	return res, nil
+}
+
+// handleDBDiff implements DBDIFF a b [WITHIN cidr] [VALUES] [LIMIT n]
+// [SUMMARY]. It replies with the counts of prefixes only in a, only in b
+// and, with VALUES, in both with different values; LIMIT adds up to n
+// prefixes of each kind. SUMMARY replies with the counts alone.
+func (s *TrieServer) handleDBDiff(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		conn.WriteError("ERR wrong number of arguments for 'DBDIFF'")
+		return
+	}
+	var ids [2]int
+	for i := range ids {
+		id, err := s.resolveDB(string(cmd.Args[1+i]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		ids[i] = id
+	}
+	var opts diffOptions
+	summary := false
+	for i := 3; i < len(cmd.Args); i++ {
+		switch arg := strings.ToUpper(string(cmd.Args[i])); arg {
+		case "VALUES":
+			opts.values = true
+		case "SUMMARY":
+			summary = true
+		case "WITHIN", "LIMIT":
+			if i+1 == len(cmd.Args) {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			i++
+			val := string(cmd.Args[i])
+			if arg == "LIMIT" {
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 {
+					conn.WriteError("ERR value is not an integer or out of range")
+					return
+				}
+				opts.limit = n
+			} else {
+				p, err := parsePrefix(val)
+				if err != nil {
+					writeError(conn, err)
+					return
+				}
+				opts.within = p
+			}
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	if summary {
+		opts.limit = 0
+	}
+
+	var res diffResult
+	if ids[0] != ids[1] {
+		var dbs [2]*database
+		for i, id := range ids {
+			// An unused index compares as empty without being created.
+			if dbs[i] = s.existingDB(id); dbs[i] == nil {
+				dbs[i] = newDatabase(id, &s.store)
+			}
+		}
+		var err error
+		if res, err = diffDBs(dbs[0], dbs[1], opts, &c.budget); err != nil {
+			writeError(conn, err)
+			return
+		}
+	}
+	type field struct {
+		name  string
+		count int64
+		keys  []string
+	}
+	fields := []field{{"only-a", res.onlyA, res.onlyAKeys}, {"only-b", res.onlyB, res.onlyBKeys}}
+	if opts.values {
+		fields = append(fields, field{"changed", res.changed, res.changedKeys})
+	}
+	n := len(fields) * 2
+	if opts.limit > 0 {
+		n *= 2
+	}
+	conn.WriteArray(n)
+	for _, f := range fields {
+		conn.WriteBulkString(f.name)
+		conn.WriteInt64(f.count)
+	}
+	if opts.limit > 0 {
+		for _, f := range fields {
+			conn.WriteBulkString(f.name + "-keys")
+			conn.WriteArray(len(f.keys))
+			for _, k := range f.keys {
+				conn.WriteBulkString(k)
+			}
+		}
+	}
+}
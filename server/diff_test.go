@@ -0,0 +1,85 @@
+package server
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+func TestDBDiff(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	mustDo(t, ss, "NAMEDB", "1", "next")
+	for _, kv := range [][2]string{
+		{"10.0.0.0/8", "a"}, {"10.1.0.0/16", "b"}, {"192.0.2.0/24", "c"}, {"2001:db8::/32", "d"}, {"0.0.0.0/0", "e"},
+	} {
+		mustDo(t, ss, "SET", kv[0], kv[1])
+	}
+	mustDo(t, ss, "SELECT", "next")
+	for _, kv := range [][2]string{
+		{"10.0.0.0/8", "a"}, {"10.1.0.0/16", "B"}, {"198.51.100.0/24", "f"}, {"2001:db8::/32", "d"}, {"0.0.0.0/0", "E"},
+	} {
+		mustDo(t, ss, "SET", kv[0], kv[1])
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"DBDIFF", "0", "next"}, "[only-a 1 only-b 1]"},
+		{[]string{"DBDIFF", "next", "0"}, "[only-a 1 only-b 1]"},
+		{[]string{"DBDIFF", "0", "1", "VALUES"}, "[only-a 1 only-b 1 changed 2]"},
+		{[]string{"DBDIFF", "0", "1", "VALUES", "LIMIT", "5"}, "[only-a 1 only-b 1 changed 2 only-a-keys [192.0.2.0/24] only-b-keys [198.51.100.0/24] changed-keys [0.0.0.0/0 10.1.0.0/16]]"},
+		{[]string{"DBDIFF", "0", "1", "VALUES", "LIMIT", "1"}, "[only-a 1 only-b 1 changed 2 only-a-keys [192.0.2.0/24] only-b-keys [198.51.100.0/24] changed-keys [0.0.0.0/0]]"},
+		{[]string{"DBDIFF", "0", "1", "VALUES", "LIMIT", "5", "SUMMARY"}, "[only-a 1 only-b 1 changed 2]"},
+		{[]string{"DBDIFF", "0", "1", "VALUES", "WITHIN", "10.0.0.0/8"}, "[only-a 0 only-b 0 changed 1]"},
+		{[]string{"DBDIFF", "0", "1", "VALUES", "WITHIN", "192.0.0.0/4"}, "[only-a 1 only-b 1 changed 0]"},
+		{[]string{"DBDIFF", "0", "1", "WITHIN", "::/0"}, "[only-a 0 only-b 0]"},
+		{[]string{"DBDIFF", "0", "0", "VALUES"}, "[only-a 0 only-b 0 changed 0]"},
+		{[]string{"DBDIFF", "0", "7", "LIMIT", "1"}, "[only-a 5 only-b 0 only-a-keys [0.0.0.0/0] only-b-keys []]"},
+		{[]string{"DBDIFF", "0"}, "ERR wrong number of arguments for 'DBDIFF'"},
+		{[]string{"DBDIFF", "0", "nosuch"}, "ERR unknown database name"},
+		{[]string{"DBDIFF", "0", "1", "LIMIT"}, "ERR syntax error"},
+		{[]string{"DBDIFF", "0", "1", "LIMIT", "-1"}, "ERR value is not an integer or out of range"},
+		{[]string{"DBDIFF", "0", "1", "WITHIN", "nonsense"}, "ERR invalid"},
+		{[]string{"DBDIFF", "0", "1", "FAST"}, "ERR syntax error"},
+	})
+	if got := showDBs(t, ss, "ALL"); len(got) != 2 {
+		t.Errorf("DBDIFF created a database: SHOWDBS ALL = %q", got)
+	}
+}
+
+// TestDBDiffRandom compares random databases against counts worked out
+// from the prefixes themselves.
+func TestDBDiffRandom(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	r := rand.New(rand.NewPCG(7, 7))
+	in := [2]map[string]string{{}, {}}
+	for range 3000 {
+		p := randomPrefix(r, 4, 0).String()
+		v := string(rune('a' + r.IntN(3)))
+		side := r.IntN(3) // 0 or 1 alone, or both
+		for db := range 2 {
+			if side == db || side == 2 {
+				in[db][p] = v
+			}
+		}
+	}
+	for db := range 2 {
+		mustDo(t, ss, "SELECT", string(rune('0'+db)))
+		for p, v := range in[db] {
+			mustDo(t, ss, "SET", p, v)
+		}
+	}
+	var onlyA, onlyB, changed int64
+	for p, v := range in[0] {
+		if w, ok := in[1][p]; !ok {
+			onlyA++
+		} else if w != v {
+			changed++
+		}
+	}
+	for p := range in[1] {
+		if _, ok := in[0][p]; !ok {
+			onlyB++
+		}
+	}
+	r2 := mustDo(t, ss, "DBDIFF", "0", "1", "VALUES", "SUMMARY")
+	if got := [3]int64{r2.Array[1].Int, r2.Array[3].Int, r2.Array[5].Int}; got != [3]int64{onlyA, onlyB, changed} {
+		t.Errorf("DBDIFF = %v, want %v", got, [3]int64{onlyA, onlyB, changed})
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"maps"
+	"net/netip"
+	"slices"
+
+	"github.com/tidwall/redcon"
+)
+
+// DEBUG DIGEST hashes the whole dataset so that two servers can check
+// they hold the same data without transferring it, as Redis's does: each
+// prefix is hashed with its database index, value, tags and expiry, and
+// the hashes are XORed together, so the digest does not depend on the
+// order anything was inserted or is walked in. Within a value, hash
+// fields, set members and tags are hashed sorted. Prefixes past their
+// deadline and not yet deleted count as gone, and empty databases as
+// absent. A dataset with nothing in it digests to forty zeros.
+
+// digest is a SHA-1 sum, or the XOR of several.
+type digest [sha1.Size]byte
+
+func (dg *digest) mix(other digest) {
+	for i := range dg {
+		dg[i] ^= other[i]
+	}
+}
+
+func (dg digest) String() string { return hex.EncodeToString(dg[:]) }
+
+// appendDigestValue appends v's canonical encoding: its type, expiry,
+// tags and data, each string length-prefixed.
+func appendDigestValue(b []byte, v value) []byte {
+	str := func(s []byte) { b = append(binary.AppendUvarint(b, uint64(len(s))), s...) }
+	switch {
+	case v.isHash():
+		b = append(b, snapshotHash)
+	case v.isSet():
+		b = append(b, snapshotSet)
+	default:
+		b = append(b, snapshotString)
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(v.expireAt))
+	b = binary.AppendUvarint(b, uint64(len(v.tags)))
+	for _, t := range v.tags {
+		str([]byte(t))
+	}
+	switch {
+	case v.isHash():
+		b = binary.AppendUvarint(b, uint64(len(v.hash)))
+		for _, f := range slices.Sorted(maps.Keys(v.hash)) {
+			str([]byte(f))
+			str(v.hash[f])
+		}
+	case v.isSet():
+		b = binary.AppendUvarint(b, uint64(len(v.set)))
+		for _, m := range v.members() {
+			str([]byte(m))
+		}
+	default:
+		str(v.str)
+	}
+	return b
+}
+
+// digestPrefix hashes p, stored in database id with value v.
+func digestPrefix(buf []byte, id int, p netip.Prefix, v value) ([]byte, digest) {
+	buf = binary.AppendUvarint(buf[:0], uint64(id))
+	buf = p.Addr().AppendTo(buf)
+	buf = append(buf, byte(p.Bits()))
+	buf = appendDigestValue(buf, v)
+	return buf, sha1.Sum(buf)
+}
+
+// digest hashes every live prefix of d into one digest. Shards are read
+// locked a batch at a time, so a prefix written during the walk may or
+// may not count, and only a dataset left alone meanwhile digests the same
+// every time.
+func (d *database) digest() digest {
+	var dg digest
+	var buf []byte
+	d.walkBatches(func(_ *shard, p netip.Prefix, v value) {
+		if v.expired() {
+			return
+		}
+		var sum digest
+		buf, sum = digestPrefix(buf, d.id, p, v)
+		dg.mix(sum)
+	})
+	return dg
+}
+
+// handleDebugDigest implements DEBUG DIGEST: the digest of every
+// database.
+func (s *TrieServer) handleDebugDigest(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for 'DEBUG DIGEST'")
+		return
+	}
+	var dg digest
+	for _, db := range s.databases() {
+		dg.mix(db.digest())
+	}
+	conn.WriteString(dg.String())
+}
+
+// handleDebugDigestValue implements DEBUG DIGEST-VALUE cidr [cidr ...]:
+// for each prefix stored at exactly cidr in the current database, the
+// digest of its value, tags and expiry, or forty zeros if there is none.
+// Unlike DEBUG DIGEST's, it leaves out the prefix and database, so equal
+// values digest the same wherever they are stored.
+func (s *TrieServer) handleDebugDigestValue(conn redcon.Conn, cmd redcon.Command) {
+	db := s.getDB(currentDB(conn))
+	conn.WriteArray(len(cmd.Args) - 2)
+	var buf []byte
+	for _, arg := range cmd.Args[2:] {
+		var dg digest
+		if v, ok := db.peekExact(string(arg)); ok {
+			buf = appendDigestValue(buf[:0], v)
+			dg = sha1.Sum(buf)
+		}
+		conn.WriteString(dg.String())
+	}
+}
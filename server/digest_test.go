@@ -0,0 +1,143 @@
+package server
+
+import (
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// digestOf runs cmds on a fresh server and returns its DEBUG DIGEST.
+func digestOf(t *testing.T, cmds [][]string) string {
+	t.Helper()
+	ss := newTestSession(t, newTestServer(t))
+	for _, args := range cmds {
+		mustDo(t, ss, args...)
+	}
+	return mustDo(t, ss, "DEBUG", "DIGEST").Str
+}
+
+func TestDebugDigest(t *testing.T) {
+	deadline := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	base := [][]string{
+		{"SET", "10.0.0.0/8", "a"},
+		{"HSET", "192.0.2.0/24", "asn", "64500", "cc", "NO"},
+		{"SADD", "2001:db8::/32", "tor", "vpn"},
+		{"TAG", "10.0.0.0/8", "ADD", "edge", "core"},
+		{"SET", "172.16.0.0/12", "ttl", "PXAT", deadline},
+		{"SELECT", "3"},
+		{"SET", "10.0.0.0/8", "three"},
+	}
+	want := digestOf(t, base)
+	if len(want) != 40 || want == strings.Repeat("0", 40) {
+		t.Fatalf("DEBUG DIGEST = %q", want)
+	}
+	for _, tc := range []struct {
+		name string
+		cmds [][]string
+		same bool
+	}{
+		{"same data", base, true},
+		{"inserted in another order", [][]string{
+			{"SELECT", "3"},
+			{"SET", "10.0.0.0/8", "three"},
+			{"SELECT", "0"},
+			{"SADD", "2001:db8::/32", "vpn"},
+			{"SET", "172.16.0.0/12", "ttl", "PXAT", deadline},
+			{"HSET", "192.0.2.0/24", "cc", "NO"},
+			{"SET", "10.0.0.0/8", "a"},
+			{"TAG", "10.0.0.0/8", "ADD", "core"},
+			{"SADD", "2001:db8::/32", "tor"},
+			{"HSET", "192.0.2.0/24", "asn", "64500"},
+			{"TAG", "10.0.0.0/8", "ADD", "edge"},
+		}, true},
+		{"an empty database and an expired prefix", append(base[:len(base):len(base)],
+			[]string{"SELECT", "5"}, []string{"SET", "10.0.0.0/8", "x"}, []string{"DEL", "10.0.0.0/8"},
+			[]string{"SELECT", "0"}, []string{"SET", "198.51.100.0/24", "gone", "PX", "1"}), true},
+		{"another value", append(base[:len(base):len(base)], []string{"SET", "10.0.0.0/8", "b"}), false},
+		{"another prefix length", append(base[:len(base):len(base)], []string{"DEL", "10.0.0.0/8"}, []string{"SET", "10.0.0.0/9", "three"}), false},
+		{"another database", append(base[:len(base)-2:len(base)-2], []string{"SELECT", "4"}, []string{"SET", "10.0.0.0/8", "three"}), false},
+		{"another hash field", append(base[:len(base):len(base)], []string{"SELECT", "0"}, []string{"HSET", "192.0.2.0/24", "cc", "SE"}), false},
+		{"another set member", append(base[:len(base):len(base)], []string{"SELECT", "0"}, []string{"SREM", "2001:db8::/32", "vpn"}), false},
+		{"another tag", append(base[:len(base):len(base)], []string{"SELECT", "0"}, []string{"TAG", "10.0.0.0/8", "DEL", "core"}), false},
+		{"another expiry", append(base[:len(base):len(base)], []string{"SELECT", "0"}, []string{"SET", "172.16.0.0/12", "ttl", "PXAT", deadline + "1"}), false},
+		{"a string holding a set's member", append(base[:len(base):len(base)], []string{"SELECT", "0"},
+			[]string{"DEL", "2001:db8::/32"}, []string{"SET", "2001:db8::/32", "tor"}), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if !strings.Contains(tc.name, "expired") {
+				if got := digestOf(t, tc.cmds); (got == want) != tc.same {
+					t.Errorf("DEBUG DIGEST = %s, base %s, want same %v", got, want, tc.same)
+				}
+				return
+			}
+			ss := newTestSession(t, newTestServer(t))
+			for _, args := range tc.cmds {
+				mustDo(t, ss, args...)
+			}
+			time.Sleep(5 * time.Millisecond) // past the PX deadline, not yet reaped
+			if got := mustDo(t, ss, "DEBUG", "DIGEST").Str; got != want {
+				t.Errorf("DEBUG DIGEST = %s, want %s", got, want)
+			}
+		})
+	}
+
+	runSteps(t, newTestSession(t, newTestServer(t)), []replyStep{
+		{[]string{"DEBUG", "DIGEST"}, strings.Repeat("0", 40)},
+		{[]string{"DEBUG", "DIGEST", "x"}, "ERR wrong number of arguments for 'DEBUG DIGEST'"},
+	})
+}
+
+// TestDebugDigestOrder loads one random dataset into two servers in
+// different orders, over every shard, and compares their digests.
+func TestDebugDigestOrder(t *testing.T) {
+	r := rand.New(rand.NewPCG(18, 7))
+	var cmds [][]string
+	for i := range 3000 {
+		cmds = append(cmds, []string{"SET", randomPrefix(r, 16, 8).String(), "v" + strconv.Itoa(i%7)})
+	}
+	shuffled := append([][]string(nil), cmds...)
+	r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	// A later SET of a prefix wins, so only keep the last of each.
+	last := make(map[string]string)
+	for _, c := range cmds {
+		last[c[1]] = c[2]
+	}
+	for i, c := range shuffled {
+		shuffled[i] = []string{"SET", c[1], last[c[1]]}
+	}
+	if a, b := digestOf(t, cmds), digestOf(t, shuffled); a != b {
+		t.Errorf("DEBUG DIGEST %s after one order, %s after another", a, b)
+	}
+}
+
+func TestDebugDigestValue(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"SET", "192.0.2.0/24", "a"}, "OK"},
+		{[]string{"SET", "198.51.100.0/24", "b"}, "OK"},
+		{[]string{"SELECT", "1"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+	})
+	in1 := mustDo(t, ss, "DEBUG", "DIGEST-VALUE", "10.0.0.0/8").strs()
+	mustDo(t, ss, "SELECT", "0")
+	r := mustDo(t, ss, "DEBUG", "DIGEST-VALUE", "10.0.0.0/8", "192.0.2.0/24", "198.51.100.0/24", "10.0.0.0/16", "nope").strs()
+	zeros := strings.Repeat("0", 40)
+	switch {
+	case len(r) != 5 || len(r[0]) != 40 || r[0] == zeros:
+		t.Fatalf("DEBUG DIGEST-VALUE = %q", r)
+	case r[1] != r[0] || in1[0] != r[0]:
+		t.Errorf("equal values digest %s, %s and %s elsewhere, want one digest", r[0], r[1], in1[0])
+	case r[2] == r[0]:
+		t.Errorf("values a and b both digest %s", r[0])
+	case r[3] != zeros || r[4] != zeros:
+		t.Errorf("missing keys digest %s and %s, want zeros", r[3], r[4])
+	}
+	mustDo(t, ss, "TAG", "192.0.2.0/24", "ADD", "edge")
+	if got := mustDo(t, ss, "DEBUG", "DIGEST-VALUE", "192.0.2.0/24").strs(); got[0] == r[0] {
+		t.Error("a tag does not change DEBUG DIGEST-VALUE")
+	}
+	runSteps(t, ss, []replyStep{{[]string{"DEBUG", "DIGEST-VALUE"}, "[]"}})
+}
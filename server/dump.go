@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// DUMPALL streams a database to the client over its connection, and
+// LOADALL takes the stream back, for backups and seeding without server
+// file paths. The stream is one RESP array of bulk strings per prefix,
+//
+//	prefix type expire-at tag-count [tag ...] payload ...
+//
+// where type is string, hash or set, expire-at is unix milliseconds or
+// 0, and the payload is the string, the hash's field/value pairs or the
+// set's members, followed by END and the number of entries. Every reply
+// is shaped like a command, so a client loads a dump by sending LOADALL
+// and then the bytes DUMPALL sent it, unchanged.
+
+// dumpChunk is how many bytes of DUMPALL output are buffered between
+// writes to the client.
+const dumpChunk = 64 << 10
+
+// appendDumpEntry appends e to b as a DUMPALL entry.
+func appendDumpEntry(b []byte, e entry) []byte {
+	v := e.value
+	typ, n := "string", 1
+	switch {
+	case v.isHash():
+		typ, n = "hash", 2*len(v.hash)
+	case v.isSet():
+		typ, n = "set", len(v.set)
+	}
+	b = redcon.AppendArray(b, 4+len(v.tags)+n)
+	b = redcon.AppendBulkString(b, e.prefix.String())
+	b = redcon.AppendBulkString(b, typ)
+	b = redcon.AppendBulkInt(b, v.expireAt)
+	b = redcon.AppendBulkInt(b, int64(len(v.tags)))
+	for _, t := range v.tags {
+		b = redcon.AppendBulkString(b, t)
+	}
+	switch typ {
+	case "hash":
+		for _, f := range slices.Sorted(maps.Keys(v.hash)) {
+			b = redcon.AppendBulkString(b, f)
+			b = redcon.AppendBulk(b, v.hash[f])
+		}
+	case "set":
+		for _, m := range v.members() {
+			b = redcon.AppendBulkString(b, m)
+		}
+	default:
+		b = redcon.AppendBulk(b, v.str)
+	}
+	return b
+}
+
+// parseDumpEntry parses the arguments of a DUMPALL entry. The tags of an
+// entry without any are an empty slice, so loading it over a tagged
+// prefix clears them; see inheritTags.
+func (d *database) parseDumpEntry(args [][]byte) (entry, error) {
+	if len(args) < 5 {
+		return entry{}, errors.New("expected prefix, type, expire-at, tag count and payload")
+	}
+	p, err := d.parseSetKey(string(args[0]))
+	if err != nil {
+		return entry{}, err
+	}
+	e := entry{prefix: p}
+	if e.value.expireAt, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil || e.value.expireAt < 0 {
+		return entry{}, errors.New("invalid expire-at")
+	}
+	ntags, err := strconv.Atoi(string(args[3]))
+	if err != nil || ntags < 0 || ntags > len(args)-5 {
+		return entry{}, errors.New("invalid tag count")
+	}
+	e.value.tags = make([]string, 0, ntags)
+	for _, t := range args[4 : 4+ntags] {
+		if len(t) == 0 {
+			return entry{}, errors.New("empty tag")
+		}
+		e.value.tags = append(e.value.tags, string(t))
+	}
+	slices.Sort(e.value.tags)
+	e.value.tags = slices.Compact(e.value.tags)
+	payload := args[4+ntags:]
+	switch typ := string(args[1]); typ {
+	case "string":
+		if len(payload) != 1 {
+			return entry{}, errors.New("a string takes one payload argument")
+		}
+		e.value.str = append([]byte{}, payload[0]...) // args share redcon's read buffer
+	case "hash":
+		if len(payload)%2 != 0 {
+			return entry{}, errors.New("a hash takes field/value pairs")
+		}
+		e.value.hash = make(map[string][]byte, len(payload)/2)
+		for i := 0; i < len(payload); i += 2 {
+			e.value.hash[string(payload[i])] = bytes.Clone(payload[i+1])
+		}
+	case "set":
+		e.value.set = make(map[string]struct{}, len(payload))
+		for _, m := range payload {
+			e.value.set[string(m)] = struct{}{}
+		}
+	default:
+		return entry{}, fmt.Errorf("invalid type '%s'", typ)
+	}
+	return e, nil
+}
+
+// handleDumpAll implements DUMPALL [DB index|name]. The database is read
+// from a copy-on-write snapshot, as BGSAVE reads it, so the stream is the
+// database as it was when the command started however long the client
+// takes to read it. The stream is written straight to the connection in
+// dumpChunk pieces rather than through redcon's buffer, which would hold
+// all of it, so DUMPALL cannot follow unflushed replies in a pipeline.
+// It shares the snapshot slot with SAVE and BGSAVE, which wait for it.
+func (s *TrieServer) handleDumpAll(conn redcon.Conn, c *client, cmd redcon.Command) {
+	id := currentDB(conn)
+	switch {
+	case len(cmd.Args) == 3 && strings.EqualFold(string(cmd.Args[1]), "DB"):
+		n, err := s.resolveDB(string(cmd.Args[2]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		id = n
+	case len(cmd.Args) != 1:
+		conn.WriteError("ERR syntax error")
+		return
+	}
+	if c.netConn == nil {
+		conn.WriteError("ERR DUMPALL needs a network connection")
+		return
+	}
+	if c.omem.Load() != 0 {
+		conn.WriteError("ERR DUMPALL cannot follow other commands in a pipeline")
+		return
+	}
+	st := &s.snapshots
+	if !st.saving.TryLock() {
+		conn.WriteError("ERR Background save in progress, try DUMPALL again later")
+		return
+	}
+	defer st.saving.Unlock()
+
+	var buf []byte
+	var werr error
+	flush := func() {
+		if werr == nil {
+			s.extendWriteDeadline(c)
+			c.lastActive.Store(time.Now().UnixNano())
+			_, werr = c.netConn.Write(buf)
+		}
+		buf = buf[:0]
+	}
+	count := 0
+	if db := s.existingDB(id); db != nil {
+		ds := beginSnapshot([]*database{db})[id]
+		defer ds.end()
+		ds.each(func(e entry) {
+			if werr != nil || e.value.expired() {
+				return
+			}
+			buf = appendDumpEntry(buf, e)
+			count++
+			if len(buf) >= dumpChunk {
+				flush()
+				runtime.Gosched()
+			}
+		})
+	}
+	buf = redcon.AppendArray(buf, 2)
+	buf = redcon.AppendBulkString(buf, "END")
+	buf = redcon.AppendBulkInt(buf, int64(count))
+	flush()
+	if werr != nil {
+		c.netConn.Close()
+	}
+}
+
+// loadState is a LOADALL in progress on one connection.
+type loadState struct {
+	db       *database
+	id       int
+	conflict conflictMode
+	res      importResult
+	aborted  *importConflict // ended by ABORT; later entries are read and dropped
+}
+
+// handleLoadAll implements LOADALL [DB index|name] [REPLACE|SKIP|ABORT].
+// It replies OK, then reads every following command on the connection as
+// a DUMPALL entry, without replying, until END, when it replies with the
+// tally IMPORT gives. Prefixes already stored are replaced by default.
+// Entries are stored as they arrive, so an ABORT leaves those before the
+// conflict loaded.
+func (s *TrieServer) handleLoadAll(conn redcon.Conn, c *client, cmd redcon.Command) {
+	id := currentDB(conn)
+	conflict := conflictReplace
+	for i := 1; i < len(cmd.Args); i++ {
+		switch arg := strings.ToUpper(string(cmd.Args[i])); arg {
+		case "REPLACE":
+			conflict = conflictReplace
+		case "SKIP":
+			conflict = conflictSkip
+		case "ABORT":
+			conflict = conflictAbort
+		case "DB":
+			if i+1 == len(cmd.Args) {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			i++
+			n, err := s.resolveDB(string(cmd.Args[i]))
+			if err != nil {
+				writeError(conn, err)
+				return
+			}
+			id = n
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	if err := s.writable(id); err != nil {
+		writeError(conn, err)
+		return
+	}
+	c.loading = &loadState{db: s.getDB(id), id: id, conflict: conflict}
+	writeOK(conn)
+}
+
+// loadEntry handles one command of a connection in LOADALL.
+func (s *TrieServer) loadEntry(conn redcon.Conn, c *client, cmd redcon.Command) {
+	ld := c.loading
+	if strings.EqualFold(string(cmd.Args[0]), "END") && len(cmd.Args) == 2 {
+		c.loading = nil
+		if changed := ld.res.inserted + ld.res.replaced; changed > 0 {
+			ld.db.writes.add(uint64(c.id), 1)
+			s.auditDB(c, ld.id, "LOADALL")
+		}
+		if ld.aborted != nil {
+			conn.WriteError(fmt.Sprintf("ERR load aborted at entry %d: %s is already stored (%d inserted before it)",
+				ld.aborted.line, ld.aborted.prefix, ld.res.inserted))
+			return
+		}
+		if n, err := strconv.Atoi(string(cmd.Args[1])); err != nil || n != ld.res.lines {
+			conn.WriteError(fmt.Sprintf("ERR stream ended after %d entries, expected %s", ld.res.lines, cmd.Args[1]))
+			return
+		}
+		writeImportResult(conn, ld.res)
+		return
+	}
+	ld.res.lines++
+	if ld.aborted != nil {
+		return
+	}
+	fail := func(msg string) {
+		ld.res.errors++
+		if len(ld.res.firstErrors) < maxImportErrors {
+			ld.res.firstErrors = append(ld.res.firstErrors, fmt.Sprintf("entry %d: %s", ld.res.lines, msg))
+		}
+	}
+	e, err := ld.db.parseDumpEntry(cmd.Args)
+	if err == nil {
+		err = s.freeMemory()
+	}
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	if e.value.expired() {
+		ld.res.skipped++
+		return
+	}
+	existed := ld.db.store(e.prefix, e.value, ld.conflict == conflictReplace)
+	switch {
+	case !existed:
+		ld.res.inserted++
+	case ld.conflict == conflictReplace:
+		ld.res.replaced++
+	case ld.conflict == conflictSkip:
+		ld.res.skipped++
+	default:
+		ld.aborted = &importConflict{line: ld.res.lines, prefix: e.prefix.String()}
+	}
+}
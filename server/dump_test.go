@@ -0,0 +1,303 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+func TestParseDumpEntry(t *testing.T) {
+	d := newTestServer(t).getDB(0)
+	for _, tc := range []struct {
+		args    []string
+		want    string // the entry as DUMPALL writes it, if it parses
+		wantErr string
+	}{
+		{args: []string{"10.0.0.0/8", "string", "0", "0", "v"}},
+		{args: []string{"10.0.0.0/8", "string", "0", "0", ""}},
+		{args: []string{"10.0.0.0/8", "string", "1700000000000", "2", "b", "a", "v"}, want: "10.0.0.0/8 string 1700000000000 2 a b v"},
+		{args: []string{"10.0.0.0/8", "string", "0", "2", "a", "a", "v"}, want: "10.0.0.0/8 string 0 1 a v"},
+		{args: []string{"10.0.0.9/8", "string", "0", "0", "v"}, want: "10.0.0.0/8 string 0 0 v"},
+		{args: []string{"2001:db8::/32", "hash", "0", "0", "f", "1", "g", "2"}},
+		{args: []string{"10.0.0.0/8", "hash", "0", "1", "t", "f", "1"}},
+		{args: []string{"10.0.0.0/8", "set", "0", "0", "b", "a"}, want: "10.0.0.0/8 set 0 0 a b"},
+		{args: []string{"10.0.0.0/8", "string", "0", "0"}, wantErr: "expected prefix, type, expire-at, tag count and payload"},
+		{args: []string{"nope", "string", "0", "0", "v"}, wantErr: "invalid"},
+		{args: []string{"10.0.0.0/8", "string", "-1", "0", "v"}, wantErr: "invalid expire-at"},
+		{args: []string{"10.0.0.0/8", "string", "soon", "0", "v"}, wantErr: "invalid expire-at"},
+		{args: []string{"10.0.0.0/8", "string", "0", "1", "v"}, wantErr: "invalid tag count"},
+		{args: []string{"10.0.0.0/8", "string", "0", "-1", "v"}, wantErr: "invalid tag count"},
+		{args: []string{"10.0.0.0/8", "string", "0", "1", "", "v"}, wantErr: "empty tag"},
+		{args: []string{"10.0.0.0/8", "string", "0", "0", "v", "w"}, wantErr: "a string takes one payload argument"},
+		{args: []string{"10.0.0.0/8", "hash", "0", "0", "f"}, wantErr: "a hash takes field/value pairs"},
+		{args: []string{"10.0.0.0/8", "list", "0", "0", "v"}, wantErr: "invalid type 'list'"},
+	} {
+		args := make([][]byte, len(tc.args))
+		for i, a := range tc.args {
+			args[i] = []byte(a)
+		}
+		e, err := d.parseDumpEntry(args)
+		if tc.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Errorf("parseDumpEntry(%q): %v, want %q", tc.args, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDumpEntry(%q): %v", tc.args, err)
+			continue
+		}
+		want := tc.want
+		if want == "" {
+			want = strings.Join(tc.args, " ")
+		}
+		_, resp := redcon.ReadNextRESP(appendDumpEntry(nil, e))
+		if got := newReply(resp).String(); got != "["+want+"]" {
+			t.Errorf("parseDumpEntry(%q) dumps as %s, want [%s]", tc.args, got, want)
+		}
+	}
+}
+
+// readRESP reads one reply of any type from br and returns its bytes as
+// they came over the wire.
+func readRESP(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return line, err
+	}
+	switch line[0] {
+	case '$':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil || n < 0 {
+			return line, err
+		}
+		bulk := make([]byte, n+2)
+		_, err = io.ReadFull(br, bulk)
+		return append(line, bulk...), err
+	case '*':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		for range n {
+			if err != nil {
+				break
+			}
+			var elem []byte
+			elem, err = readRESP(br)
+			line = append(line, elem...)
+		}
+		return line, err
+	}
+	return line, nil
+}
+
+// replyString formats a reply read by readRESP the way Reply does.
+func replyString(b []byte) string {
+	_, resp := redcon.ReadNextRESP(b)
+	return newReply(resp).String()
+}
+
+func TestDumpAllRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveTest(t, s)
+	ss := newTestSession(t, s)
+	deadline := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	for _, args := range [][]string{
+		{"SET", "10.0.0.0/8", "a"},
+		{"SET", "10.1.0.0/16", ""},
+		{"SET", "10.2.0.0/16", "ttl", "PXAT", deadline},
+		{"HSET", "192.0.2.0/24", "asn", "AS64500", "cc", "NL"},
+		{"SADD", "2001:db8::/32", "tor", "vpn"},
+		{"TAG", "10.0.0.0/8", "ADD", "review", "acme"},
+		{"TAG", "2001:db8::/32", "ADD", "review"},
+	} {
+		mustDo(t, ss, args...)
+	}
+	for i := range 5000 {
+		mustDo(t, ss, "SET", fmt.Sprintf("172.%d.%d.0/24", 16+i>>8, i&255), strings.Repeat("x", 20))
+	}
+	want := 5005
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	conn, br := dial()
+	if _, err := conn.Write([]byte("DUMPALL\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	var stream []byte
+	entries := 0
+	for {
+		r, err := readRESP(br)
+		if err != nil {
+			t.Fatalf("reading the dump after %d entries: %v", entries, err)
+		}
+		stream = append(stream, r...)
+		if bytes.HasPrefix(r, []byte("*2\r\n$3\r\nEND\r\n")) {
+			if got := replyString(r); got != "[END "+strconv.Itoa(want)+"]" {
+				t.Fatalf("the dump ended with %s after %d entries", got, entries)
+			}
+			break
+		}
+		entries++
+	}
+	if entries != want {
+		t.Fatalf("DUMPALL sent %d entries, want %d", entries, want)
+	}
+
+	conn, br = dial()
+	if _, err := conn.Write(append([]byte("LOADALL DB 1\r\n"), stream...)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"OK", "[lines 5005 inserted 5005 replaced 0 skipped 0 errors 0 first-errors []]"} {
+		r, err := readRESP(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := replyString(r); got != want {
+			t.Fatalf("LOADALL replied %s, want %s", got, want)
+		}
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"DBDIFF", "0", "1", "VALUES"}, "[only-a 0 only-b 0 changed 0]"},
+		{[]string{"SELECT", "1"}, "OK"},
+		{[]string{"TAG", "10.0.0.0/8", "LIST"}, "[acme review]"},
+		{[]string{"TAG", "10.1.0.0/16", "LIST"}, "[]"},
+		{[]string{"TAGKEYS", "review"}, "[10.0.0.0/8 2001:db8::/32]"},
+		{[]string{"TTL", "10.2.0.0/16"}, "3600"},
+		{[]string{"TTL", "10.0.0.0/8"}, "-1"},
+		{[]string{"GET", "10.1.0.0/16"}, ""},
+		{[]string{"HGET", "192.0.2.0/24", "cc"}, "NL"},
+		{[]string{"SISMEMBER", "2001:db8::/32", "vpn"}, "1"},
+	})
+}
+
+func TestLoadAll(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string   // after LOADALL
+		entries [][]string // sent after it, END included
+		want    string     // the reply to END
+		after   []replyStep
+	}{
+		{
+			name: "replace",
+			entries: [][]string{
+				{"10.0.0.0/8", "string", "0", "0", "new"},
+				{"10.9.0.0/16", "string", "0", "1", "t", "v"},
+				{"END", "2"},
+			},
+			want: "[lines 2 inserted 0 replaced 2 skipped 0 errors 0 first-errors []]",
+			after: []replyStep{
+				{[]string{"GET", "10.0.0.0/8"}, "new"},
+				{[]string{"TAG", "10.0.0.0/8", "LIST"}, "[]"},
+				{[]string{"TAG", "10.9.0.0/16", "LIST"}, "[t]"},
+			},
+		},
+		{
+			name: "skip",
+			args: []string{"SKIP"},
+			entries: [][]string{
+				{"10.0.0.0/8", "string", "0", "0", "new"},
+				{"10.9.0.0/16", "string", "1", "0", "expired"},
+				{"END", "2"},
+			},
+			want:  "[lines 2 inserted 0 replaced 0 skipped 2 errors 0 first-errors []]",
+			after: []replyStep{{[]string{"GET", "10.0.0.0/8"}, "old"}, {[]string{"TAG", "10.0.0.0/8", "LIST"}, "[keep]"}},
+		},
+		{
+			name: "abort",
+			args: []string{"abort"},
+			entries: [][]string{
+				{"10.8.0.0/16", "string", "0", "0", "first"},
+				{"10.0.0.0/8", "string", "0", "0", "new"},
+				{"10.9.0.0/16", "string", "0", "0", "dropped"},
+				{"END", "3"},
+			},
+			want:  "ERR load aborted at entry 2: 10.0.0.0/8 is already stored (1 inserted before it)",
+			after: []replyStep{{[]string{"GET", "10.0.0.0/8"}, "old"}, {[]string{"GET", "10.8.0.0/16"}, "first"}, {[]string{"GET", "10.9.0.0/16"}, "old"}},
+		},
+		{
+			name: "bad entries",
+			entries: [][]string{
+				{"10.9.0.0/16", "list", "0", "0", "v"},
+				{"GET", "10.0.0.0/8"},
+				{"10.8.0.0/16", "string", "0", "0", "ok"},
+				{"END", "3"},
+			},
+			want:  "[lines 3 inserted 1 replaced 0 skipped 0 errors 2 first-errors [entry 1: invalid type 'list' entry 2: expected prefix, type, expire-at, tag count and payload]]",
+			after: []replyStep{{[]string{"GET", "10.8.0.0/16"}, "ok"}},
+		},
+		{
+			name:    "short stream",
+			entries: [][]string{{"10.8.0.0/16", "string", "0", "0", "ok"}, {"END", "2"}},
+			want:    "ERR stream ended after 1 entries, expected 2",
+		},
+		{
+			name:    "into another database",
+			args:    []string{"DB", "3"},
+			entries: [][]string{{"10.0.0.0/8", "string", "0", "0", "three"}, {"END", "1"}},
+			want:    "[lines 1 inserted 1 replaced 0 skipped 0 errors 0 first-errors []]",
+			after:   []replyStep{{[]string{"GET", "10.0.0.0/8"}, "old"}, {[]string{"SELECT", "3"}, "OK"}, {[]string{"GET", "10.0.0.0/8"}, "three"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := newTestSession(t, newTestServer(t))
+			runSteps(t, ss, []replyStep{
+				{[]string{"SET", "10.0.0.0/8", "old"}, "OK"},
+				{[]string{"SET", "10.9.0.0/16", "old"}, "OK"},
+				{[]string{"TAG", "10.0.0.0/8", "ADD", "keep"}, "1"},
+				{append([]string{"LOADALL"}, tc.args...), "OK"},
+			})
+			for _, e := range tc.entries[:len(tc.entries)-1] {
+				if ss.Do(e...); len(ss.conn.buf) != 0 {
+					t.Errorf("entry %q replied %q", e, ss.conn.buf)
+				}
+			}
+			runSteps(t, ss, []replyStep{{tc.entries[len(tc.entries)-1], tc.want}})
+			runSteps(t, ss, tc.after)
+		})
+	}
+}
+
+func TestDumpAllErrors(t *testing.T) {
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	runSteps(t, ss, []replyStep{
+		{[]string{"DUMPALL"}, "ERR DUMPALL needs a network connection"},
+		{[]string{"DUMPALL", "DB"}, "ERR syntax error"},
+		{[]string{"DUMPALL", "DB", "nosuch"}, "ERR unknown database name"},
+		{[]string{"LOADALL", "MERGE"}, "ERR syntax error"},
+		{[]string{"LOADALL", "DB"}, "ERR syntax error"},
+		{[]string{"DBREADONLY", "2", "yes"}, "OK"},
+		{[]string{"LOADALL", "DB", "2"}, "READONLY You can't write against read only db2"},
+	})
+
+	// A save in progress holds the snapshot slot DUMPALL needs.
+	addr := serveTest(t, s)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	s.snapshots.saving.Lock()
+	conn.Write([]byte("DUMPALL\r\n"))
+	r, err := readRESP(bufio.NewReader(conn))
+	s.snapshots.saving.Unlock()
+	if got := replyString(r); err != nil || got != "ERR Background save in progress, try DUMPALL again later" {
+		t.Errorf("DUMPALL during a save = %s, %v", got, err)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// Error classes, the first word of an error reply, which clients such as
+// go-redis and redis-py switch on. Where Redis has an equivalent the
+// class is Redis's, with its wording.
+const (
+	ClassErr        = "ERR"        // any failure without a class of its own
+	ClassWrongType  = "WRONGTYPE"  // a command against a value of another type
+	ClassNoPerm     = "NOPERM"     // the client's user may not run the command
+	ClassReadOnly   = "READONLY"   // a write to a read-only server or database
+	ClassOOM        = "OOM"        // a write over maxmemory
+	ClassBusyKey    = "BUSYKEY"    // a restore onto a stored prefix
+	ClassTimeout    = "TIMEOUT"    // a command aborted over its execution budget
+	ClassQuota      = "QUOTA"      // a write over db-max-keys or db-max-bytes
+	ClassJournal    = "JOURNAL"    // a database an interrupted operation may have left partial
+	ClassCrossShard = "CROSSSHARD" // a prefix spanning nodes of the shard map
+)
+
+// errNoSuchKey is the error of a command on a key that must be stored,
+// with Redis's ERR class and wording.
+var errNoSuchKey = newError(ClassErr, "no such key")
+
+// Error is an error reply: its class and the message after it.
+type Error struct {
+	Class string
+	Msg   string
+}
+
+func (e *Error) Error() string { return e.Class + " " + e.Msg }
+
+func (e *Error) class() string { return e.Class }
+
+// newError returns an error of class with the message msg.
+func newError(class, msg string) *Error {
+	return &Error{Class: class, Msg: msg}
+}
+
+// errorf returns an error of class with a formatted message.
+func errorf(class, format string, args ...any) *Error {
+	return &Error{Class: class, Msg: fmt.Sprintf(format, args...)}
+}
+
+// classified is an error of a class of its own, such as an *Error.
+type classified interface {
+	error
+	class() string
+}
+
+// errorReply returns the error reply of err. An error of no class, like a
+// prefix that does not parse, is an ERR; one wrapping a classified error,
+// as fmt.Errorf with %w does, keeps the class of the error it wraps.
+func errorReply(err error) string {
+	msg := err.Error()
+	var c classified
+	if !errors.As(err, &c) {
+		return ClassErr + " " + msg
+	}
+	class := c.class()
+	if strings.HasPrefix(msg, class+" ") {
+		return msg
+	}
+	return class + " " + strings.Replace(msg, class+" ", "", 1)
+}
+
+// writeError replies with err, classed as errorReply does.
+func writeError(conn redcon.Conn, err error) {
+	conn.WriteError(errorReply(err))
+}
+
+// parseError returns the Error of an error reply.
+func parseError(reply string) *Error {
+	class, msg, _ := strings.Cut(reply, " ")
+	return &Error{Class: class, Msg: msg}
+}
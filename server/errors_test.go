@@ -0,0 +1,72 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestErrorClasses checks the first word of the error reply of a command
+// failing for each reason a client switches on. TestCommandTimeout and
+// TestJournalRecovery cover TIMEOUT and JOURNAL.
+func TestErrorClasses(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		edit  func(*Options)
+		setup [][]string
+		args  []string
+		class string
+	}{
+		{name: "unknown command", args: []string{"NOSUCHCOMMAND"}, class: ClassErr},
+		{name: "arity", args: []string{"GET"}, class: ClassErr},
+		{name: "bad prefix", args: []string{"SET", "10.0.0.0/33", "a"}, class: ClassErr},
+		{name: "syntax", args: []string{"FLUSHDB", "NOW"}, class: ClassErr},
+		{name: "no such key", args: []string{"RENAME", "10.0.0.0/8", "11.0.0.0/8"}, class: ClassErr},
+		{name: "wrong type",
+			setup: [][]string{{"HSET", "10.0.0.0/8", "f", "v"}},
+			args:  []string{"GET", "10.1.2.3"}, class: ClassWrongType},
+		{name: "no permission",
+			edit: func(o *Options) { o.TLSIdentityMap = "loader=readwrite" },
+			args: []string{"SET", "10.0.0.0/8", "a"}, class: ClassNoPerm},
+		{name: "read-only database",
+			setup: [][]string{{"DBREADONLY", "0", "yes"}},
+			args:  []string{"SET", "10.0.0.0/8", "a"}, class: ClassReadOnly},
+		{name: "maxmemory",
+			edit:  func(o *Options) { o.MaxMemory = "1" },
+			setup: [][]string{{"SET", "10.0.0.0/8", "a"}},
+			args:  []string{"SET", "11.0.0.0/8", "b"}, class: ClassOOM},
+		{name: "restore onto a stored prefix",
+			edit:  func(o *Options) { o.DBTombstones = "0 yes" },
+			setup: [][]string{{"SET", "10.0.0.0/8", "a"}, {"DEL", "10.0.0.0/8"}, {"SET", "10.0.0.0/8", "b"}},
+			args:  []string{"RESTOREKEY", "10.0.0.0/8"}, class: ClassBusyKey},
+		{name: "db-max-keys",
+			edit:  func(o *Options) { o.DBMaxKeys = "0 1" },
+			setup: [][]string{{"SET", "10.0.0.0/8", "a"}},
+			args:  []string{"SET", "11.0.0.0/8", "b"}, class: ClassQuota},
+		{name: "prefix spanning shards",
+			edit: func(o *Options) { o.ShardMap = "0.0.0.0/1=a,128.0.0.0/1=b,::/0=a" },
+			args: []string{"OWNER", "0.0.0.0/0"}, class: ClassCrossShard},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := DefaultOptions()
+			o.LogSlowerThan = -1
+			if tc.edit != nil {
+				tc.edit(&o)
+			}
+			s, err := NewTrieServer(o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ss := newTestSession(t, s)
+			for _, args := range tc.setup {
+				mustDo(t, ss, args...)
+			}
+			r := ss.Do(tc.args...)
+			if r.Type != ErrorReply || !strings.HasPrefix(r.Str, tc.class+" ") {
+				t.Fatalf("%q = %+v, want a %s error", tc.args, r, tc.class)
+			}
+			if err := r.Err(); err == nil || err.(*Error).Class != tc.class {
+				t.Fatalf("%q: Err() = %v, want class %s", tc.args, err, tc.class)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxmemory-policy values.
+const (
+	evictNone         int32 = iota // refuse writes over maxmemory
+	evictMostSpecific              // drop the most specific sampled prefixes
+)
+
+var evictPolicies = []string{"noeviction", "most-specific-first"}
+
+var errOOM = newError(ClassOOM, "command not allowed when used memory > 'maxmemory'.")
+
+// evictor holds the maxmemory settings. The limit applies to
+// used_memory_dataset, the estimate DBSTATS and MEMORY USAGE add up,
+// rather than to the heap: the heap only shrinks after a garbage
+// collection, so evicting until it drops would evict far too much.
+//
+// most-specific-first suits routing-style data, where a covering prefix
+// still answers tolerably for the addresses of a dropped more specific
+// one. Each eviction samples maxmemory-samples leaves, prefixes with
+// nothing stored below them, and drops the longest, the least recently
+// used on a tie. With maxmemory-lossless on only a leaf whose covering
+// prefix holds an identical value qualifies, so every lookup answers as
+// before; a write is refused when the sample finds none. Read-only
+// databases are never evicted from.
+type evictor struct {
+	maxMemory atomic.Int64 // bytes; 0 disables the limit
+	policy    atomic.Int32 // one of the evict* policies
+	samples   atomic.Int64
+	lossless  atomic.Bool
+
+	mu sync.Mutex // one writer evicts at a time
+}
+
+// freeMemory evicts until the dataset fits maxmemory, or returns errOOM
+// when it cannot. Write commands that may grow the dataset call it first.
+func (s *TrieServer) freeMemory() error {
+	limit := s.evict.maxMemory.Load()
+	if limit <= 0 || s.datasetBytes() <= limit {
+		return nil
+	}
+	if s.evict.policy.Load() == evictNone {
+		return errOOM
+	}
+	s.evict.mu.Lock()
+	defer s.evict.mu.Unlock()
+	for s.datasetBytes() > limit {
+		db, e, ok := s.evictionCandidate()
+		if !ok {
+			return errOOM
+		}
+		if db.evict(e) {
+			s.stats.evictedKeys.Add(1)
+		}
+	}
+	return nil
+}
+
+// datasetBytes sums the dataset estimate of every database.
+func (s *TrieServer) datasetBytes() int64 {
+	s.dbsMu.RLock()
+	defer s.dbsMu.RUnlock()
+	var n int64
+	for _, db := range s.dbs {
+		n += db.datasetBytes()
+	}
+	return n
+}
+
+// evictionCandidate samples leaves across the writable databases and
+// returns the one most-specific-first drops.
+func (s *TrieServer) evictionCandidate() (*database, entry, bool) {
+	var dbs []*database
+	for _, db := range s.databases() {
+		if db.keyCount() > 0 && !s.readOnlyDBs.has(db.id) {
+			dbs = append(dbs, db)
+		}
+	}
+	if len(dbs) == 0 {
+		return nil, entry{}, false
+	}
+	lossless := s.evict.lossless.Load()
+	var best entry
+	var bestDB *database
+	for range s.evict.samples.Load() {
+		db := dbs[rand.IntN(len(dbs))]
+		e, ok := db.sampleLeaf()
+		if !ok || lossless && !db.redundant(e) {
+			continue
+		}
+		if bestDB == nil || moreSpecific(e, best) {
+			best, bestDB = e, db
+		}
+	}
+	return bestDB, best, bestDB != nil
+}
+
+// moreSpecific reports whether a is a better eviction than b: a longer
+// prefix, IPv4 lengths counted as their IPv4-mapped IPv6 ones, or on a
+// tie the longer idle.
+func moreSpecific(a, b entry) bool {
+	la, lb := specificity(a.prefix), specificity(b.prefix)
+	if la != lb {
+		return la > lb
+	}
+	return a.value.idle() > b.value.idle()
+}
+
+func specificity(p netip.Prefix) int {
+	if p.Addr().Is4() {
+		return p.Bits() + 96
+	}
+	return p.Bits()
+}
+
+// sampleLeaf returns a random leaf of a shard picked in proportion to its
+// size.
+func (d *database) sampleLeaf() (entry, bool) {
+	shards := d.allShards()
+	sizes := make([]int, len(shards))
+	total := 0
+	for i, sh := range shards {
+		sh.mu.RLock()
+		sizes[i] = sh.trie.Len()
+		sh.mu.RUnlock()
+		total += sizes[i]
+	}
+	if total == 0 {
+		return entry{}, false
+	}
+	n := rand.IntN(total)
+	for i, sh := range shards {
+		if n -= sizes[i]; n >= 0 {
+			continue
+		}
+		sh.mu.RLock()
+		p, v, ok := sh.trie.SampleLeaf()
+		sh.mu.RUnlock()
+		return entry{p, v}, ok
+	}
+	return entry{}, false
+}
+
+// redundant reports whether dropping e would change no lookup: the most
+// specific prefix covering it holds an identical value.
+func (d *database) redundant(e entry) bool {
+	home := d.shardFor(e.prefix)
+	home.mu.RLock()
+	_, v, ok := home.trie.Parent(e.prefix)
+	home.mu.RUnlock()
+	if !ok && home != d.wide {
+		d.wide.mu.RLock()
+		_, v, ok = d.wide.trie.LongestMatch(e.prefix)
+		d.wide.mu.RUnlock()
+	}
+	return ok && !v.expired() && v.equal(e.value)
+}
+
+// evict deletes e unless it was rewritten since it was sampled.
+func (d *database) evict(e entry) bool {
+	sh := d.shardFor(e.prefix)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	v, ok := sh.trie.Get(e.prefix)
+	if !ok || v.access != e.value.access {
+		return false
+	}
+	d.removeLocked(sh, e.prefix, v)
+	return true
+}
+
+// parseMemory parses a byte count the way Redis's config does: a plain
+// number or one with a k, kb, m, mb, g or gb suffix, the b forms powers
+// of 1024 and the others of 1000.
+func parseMemory(v string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1}}
+	lower := strings.ToLower(v)
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, mul = strings.TrimSuffix(lower, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/mul {
+		return 0, errors.New("argument must be a memory value, e.g. 100mb")
+	}
+	return n * mul, nil
+}
+
+func parseEvictPolicy(v string) (int32, bool) {
+	for i, name := range evictPolicies {
+		if strings.EqualFold(v, name) {
+			return int32(i), true
+		}
+	}
+	return 0, false
+}
+
+// registerEvictionConfig exposes the maxmemory settings.
+func (s *TrieServer) registerEvictionConfig() {
+	e := &s.evict
+	s.addConfig("maxmemory",
+		func() string { return strconv.FormatInt(e.maxMemory.Load(), 10) },
+		func(v string) error {
+			n, err := parseMemory(v)
+			if err != nil {
+				return err
+			}
+			e.maxMemory.Store(n)
+			return nil
+		})
+	s.addConfig("maxmemory-policy",
+		func() string { return evictPolicies[e.policy.Load()] },
+		func(v string) error {
+			policy, ok := parseEvictPolicy(v)
+			if !ok {
+				return errors.New("argument must be 'noeviction' or 'most-specific-first'")
+			}
+			e.policy.Store(policy)
+			return nil
+		})
+	s.addConfig("maxmemory-samples",
+		func() string { return strconv.FormatInt(e.samples.Load(), 10) },
+		func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 || n > 64 {
+				return errors.New("argument must be between 1 and 64")
+			}
+			e.samples.Store(n)
+			return nil
+		})
+	s.addConfig("maxmemory-lossless", yesNoGet(&e.lossless), yesNoSet(&e.lossless))
+}
+
+func (s *TrieServer) infoEviction(b *strings.Builder) {
+	limit := s.evict.maxMemory.Load()
+	fmt.Fprintf(b, "maxmemory:%d\r\n", limit)
+	fmt.Fprintf(b, "maxmemory_human:%s\r\n", humanBytes(limit))
+	fmt.Fprintf(b, "maxmemory_policy:%s\r\n", evictPolicies[s.evict.policy.Load()])
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1048576", 1 << 20, true},
+		{"100b", 100, true},
+		{"1k", 1000, true},
+		{"1kb", 1 << 10, true},
+		{"2MB", 2 << 20, true},
+		{"3m", 3e6, true},
+		{"1gb", 1 << 30, true},
+		{"4g", 4e9, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"1tb", 0, false},
+		{"1.5gb", 0, false},
+		{"9223372036854775807kb", 0, false},
+	} {
+		got, err := parseMemory(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseMemory(%q) = %d, %v; want %d, ok %v", tc.in, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	key := entryOverhead + 1 // the memory of one prefix with a 1-byte value
+	limit := func(n int) string { return strconv.Itoa(n * key) }
+	const oom = "OOM command not allowed"
+	for _, tc := range []struct {
+		name        string
+		steps       []replyStep
+		wantKeys    []string
+		wantEvicted string
+	}{
+		{
+			name: "noeviction refuses growing writes but not freeing ones",
+			steps: []replyStep{
+				{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "b"}, "OK"},
+				{[]string{"CONFIG", "SET", "maxmemory", limit(1)}, "OK"},
+				{[]string{"SET", "10.2.0.0/16", "c"}, oom},
+				{[]string{"HSET", "10.0.0.0/8", "f", "v"}, oom},
+				{[]string{"GET", "10.1.2.3"}, "b"},
+				{[]string{"DEL", "10.1.0.0/16"}, "1"},
+				{[]string{"SET", "10.2.0.0/16", "c"}, "OK"},
+			},
+			wantKeys:    []string{"10.0.0.0/8", "10.2.0.0/16"},
+			wantEvicted: "0",
+		},
+		{
+			name: "most-specific-first drops the longest leaf",
+			steps: []replyStep{
+				{[]string{"CONFIG", "SET", "maxmemory-policy", "most-specific-first"}, "OK"},
+				{[]string{"CONFIG", "SET", "maxmemory-samples", "64"}, "OK"},
+				{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "b"}, "OK"},
+				{[]string{"SET", "10.1.2.0/24", "c"}, "OK"},
+				{[]string{"CONFIG", "SET", "maxmemory", limit(3)}, "OK"},
+				{[]string{"SET", "10.2.0.0/16", "d"}, "OK"}, // fits before it is written
+				{[]string{"SET", "10.3.0.0/16", "e"}, "OK"},
+				{[]string{"GET", "10.1.2.3"}, "b"},
+			},
+			wantKeys:    []string{"10.0.0.0/8", "10.1.0.0/16", "10.2.0.0/16", "10.3.0.0/16"},
+			wantEvicted: "1",
+		},
+		{
+			name: "lossless only drops leaves their cover answers for",
+			steps: []replyStep{
+				{[]string{"CONFIG", "SET", "maxmemory-policy", "most-specific-first"}, "OK"},
+				{[]string{"CONFIG", "SET", "maxmemory-samples", "64"}, "OK"},
+				{[]string{"CONFIG", "SET", "maxmemory-lossless", "yes"}, "OK"},
+				{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "a"}, "OK"},
+				{[]string{"SET", "10.2.0.0/16", "b"}, "OK"},
+				{[]string{"CONFIG", "SET", "maxmemory", limit(2)}, "OK"},
+				{[]string{"SET", "10.3.0.0/16", "c"}, "OK"},
+				{[]string{"SET", "10.4.0.0/16", "d"}, oom},
+				{[]string{"GET", "10.1.2.3"}, "a"},
+			},
+			wantKeys:    []string{"10.0.0.0/8", "10.2.0.0/16", "10.3.0.0/16"},
+			wantEvicted: "1",
+		},
+		{
+			name: "read-only databases are not evicted from",
+			steps: []replyStep{
+				{[]string{"CONFIG", "SET", "maxmemory-policy", "most-specific-first"}, "OK"},
+				{[]string{"SELECT", "1"}, "OK"},
+				{[]string{"SET", "10.1.2.0/24", "r"}, "OK"},
+				{[]string{"DBREADONLY", "1", "yes"}, "OK"},
+				{[]string{"SELECT", "0"}, "OK"},
+				{[]string{"CONFIG", "SET", "maxmemory", limit(1)}, "OK"},
+				{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "b"}, "OK"}, // evicts 10.0.0.0/8, the only candidate
+				{[]string{"SET", "10.2.0.0/16", "c"}, "OK"},
+			},
+			wantKeys:    []string{"10.2.0.0/16"},
+			wantEvicted: "2",
+		},
+		{
+			name: "bad settings",
+			steps: []replyStep{
+				{[]string{"CONFIG", "SET", "maxmemory", "lots"}, "ERR CONFIG SET failed"},
+				{[]string{"CONFIG", "SET", "maxmemory-policy", "allkeys-lru"}, "ERR CONFIG SET failed"},
+				{[]string{"CONFIG", "SET", "maxmemory-samples", "0"}, "ERR CONFIG SET failed"},
+				{[]string{"CONFIG", "SET", "maxmemory-samples", "65"}, "ERR CONFIG SET failed"},
+				{[]string{"CONFIG", "GET", "maxmemory*"}, "[maxmemory 0 maxmemory-lossless no maxmemory-policy noeviction maxmemory-samples 5]"},
+			},
+			wantEvicted: "0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := newTestSession(t, newTestServer(t))
+			runSteps(t, ss, tc.steps)
+			if got := mustDo(t, ss, "KEYS", "*").strs(); !slices.Equal(got, tc.wantKeys) {
+				t.Errorf("KEYS * = %q, want %q", got, tc.wantKeys)
+			}
+			if got := infoFields(mustDo(t, ss, "INFO", "stats").Str)["evicted_keys"]; got != tc.wantEvicted {
+				t.Errorf("evicted_keys = %s, want %s", got, tc.wantEvicted)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"container/heap"
+	"net/netip"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tannerklineintz/triedis/trie"
+	"github.com/tidwall/redcon"
+)
+
+// A prefix given a TTL carries its deadline in its value. Storing a new
+// value, as SET does, drops the TTL unless told to keep it; modifying the
+// value, as HSET or INCR do, keeps it, both as in Redis. Exact reads and
+// longest-prefix matches skip a value past its deadline, so it stops
+// matching on time and a lookup falls back to the next less specific
+// prefix. KEYS and SCAN skip it too. expireCron deletes it soon after,
+// which is when the remaining walks, such as snapshots, stop seeing it.
+
+// expireInterval is how often expireCron deletes expired prefixes.
+const expireInterval = 100 * time.Millisecond
+
+// expiryHeapSlack is how many stale entries an expiryQueue tolerates
+// beyond its live deadlines before it rebuilds its heap.
+const expiryHeapSlack = 1024
+
+func nowMillis() int64 { return time.Now().UnixMilli() }
+
+// expired reports whether v's deadline has passed. The clock is only read
+// for values that have one.
+func (v value) expired() bool {
+	return v.expireAt != 0 && v.expireAt <= nowMillis()
+}
+
+// ttl returns v's remaining time to live in milliseconds, or -1 if it
+// does not expire.
+func (v value) ttl() int64 {
+	if v.expireAt == 0 {
+		return -1
+	}
+	return max(v.expireAt-nowMillis(), 0)
+}
+
+// expiry is a deadline in an expiryQueue.
+type expiry struct {
+	at int64
+	p  netip.Prefix
+}
+
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiry)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// expiryQueue holds a database's deadlines, earliest first. Writers update
+// it under the prefix's shard lock, so for any one prefix it agrees with
+// the trie. A rewritten prefix leaves its old heap entry behind; it is
+// skipped when it comes due, and the heap is rebuilt once such entries
+// pile up.
+type expiryQueue struct {
+	mu sync.Mutex
+	at map[netip.Prefix]int64 // every prefix with a deadline
+	h  expiryHeap
+}
+
+// set records p's deadline, or that it has none when at is 0.
+func (q *expiryQueue) set(p netip.Prefix, at int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if at == 0 {
+		delete(q.at, p)
+		return
+	}
+	if q.at == nil {
+		q.at = make(map[netip.Prefix]int64)
+	}
+	q.at[p] = at
+	heap.Push(&q.h, expiry{at, p})
+	if len(q.h) > 2*len(q.at)+expiryHeapSlack {
+		q.h = q.h[:0]
+		for p, at := range q.at {
+			q.h = append(q.h, expiry{at, p})
+		}
+		heap.Init(&q.h)
+	}
+}
+
+// due removes and returns the prefixes whose deadlines have passed by now.
+// They stay recorded until they are deleted.
+func (q *expiryQueue) due(now int64) []netip.Prefix {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []netip.Prefix
+	for len(q.h) > 0 && q.h[0].at <= now {
+		e := heap.Pop(&q.h).(expiry)
+		if q.at[e.p] == e.at {
+			out = append(out, e.p)
+		}
+	}
+	return out
+}
+
+// len returns how many prefixes have a deadline.
+func (q *expiryQueue) len() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int64(len(q.at))
+}
+
+// avgTTLSamples is how many deadlines avgTTL averages at most.
+const avgTTLSamples = 1024
+
+// avgTTL returns the mean time to live, in milliseconds, of prefixes with
+// a deadline still ahead of now, or 0 if there are none. Like Redis's
+// avg_ttl it is an estimate: of a large queue only avgTTLSamples
+// deadlines are read, those map iteration happens to start from.
+func (q *expiryQueue) avgTTL(now int64) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var sum, n, seen int64
+	for _, at := range q.at {
+		if at > now {
+			sum += at - now
+			n++
+		}
+		if seen++; seen == avgTTLSamples {
+			break
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / n
+}
+
+// deadline returns the deadline recorded for p, if any.
+func (q *expiryQueue) deadline(p netip.Prefix) (int64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	at, ok := q.at[p]
+	return at, ok
+}
+
+// prefixes returns every prefix with a recorded deadline.
+func (q *expiryQueue) prefixes() []netip.Prefix {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]netip.Prefix, 0, len(q.at))
+	for p := range q.at {
+		out = append(out, p)
+	}
+	return out
+}
+
+func (q *expiryQueue) clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.at, q.h = nil, nil
+}
+
+// trackExpiry keeps the queue current as p's value goes from old to v;
+// the zero value stands for none. The caller holds p's shard write locked.
+func (d *database) trackExpiry(p netip.Prefix, old, v value) {
+	if old.expireAt != v.expireAt {
+		d.expiries.set(p, v.expireAt)
+	}
+}
+
+// expire deletes prefixes whose deadline has passed, returning how many.
+func (d *database) expire(now int64) int64 {
+	var n int64
+	for _, p := range d.expiries.due(now) {
+		sh := d.shardFor(p)
+		sh.mu.Lock()
+		if v, ok := sh.trie.Get(p); ok && v.expireAt != 0 && v.expireAt <= now {
+			d.removeLocked(sh, p, v)
+			n++
+		}
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// expireCron deletes expired prefixes, and tombstones past their age,
+// for the life of the server.
+func (s *TrieServer) expireCron() {
+	for now := range time.Tick(expireInterval) {
+		for _, db := range s.databases() {
+			s.stats.expiredKeys.Add(db.expire(now.UnixMilli()))
+			db.purgeTombstones(now)
+		}
+	}
+}
+
+// liveMatch is t.LongestMatch passing over prefixes that have expired but
+// are still in the trie.
+func liveMatch(t *trie.Trie[value], p netip.Prefix) (netip.Prefix, value, bool) {
+	m, v, ok := t.LongestMatch(p)
+	if !ok || !v.expired() {
+		return m, v, ok
+	}
+	m, v, ok = netip.Prefix{}, value{}, false
+	t.Supernets(p, func(q netip.Prefix, w value) bool {
+		if !w.expired() {
+			m, v, ok = q, w, true // the last one is the most specific
+		}
+		return true
+	})
+	return m, v, ok
+}
+
+// liveShortest is t.ShortestMatch passing over expired prefixes.
+func liveShortest(t *trie.Trie[value], p netip.Prefix) (netip.Prefix, value, bool) {
+	m, v, ok := t.ShortestMatch(p)
+	if !ok || !v.expired() {
+		return m, v, ok
+	}
+	m, v, ok = netip.Prefix{}, value{}, false
+	t.Supernets(p, func(q netip.Prefix, w value) bool {
+		if w.expired() {
+			return true
+		}
+		m, v, ok = q, w, true
+		return false
+	})
+	return m, v, ok
+}
+
+// handleTTL implements TTL and PTTL cidr: the remaining time to live of
+// exactly cidr, -1 if it does not expire or -2 if it is not stored.
+func (s *TrieServer) handleTTL(conn redcon.Conn, name string, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "'")
+		return
+	}
+	v, ok := s.getDB(currentDB(conn)).peekExact(string(cmd.Args[1]))
+	switch ttl := v.ttl(); {
+	case !ok:
+		conn.WriteInt(-2)
+	case ttl < 0 || name == "PTTL":
+		conn.WriteInt64(ttl)
+	default:
+		conn.WriteInt64((ttl + 500) / 1000)
+	}
+}
+
+// treeExpireBatch is how many prefixes TREEEXPIRE reads under one shard
+// lock while finding the subtree, and updates under one while setting
+// their deadline.
+const treeExpireBatch = 256
+
+// subtreeKeys returns the unexpired stored prefixes that within covers,
+// itself included, in address order. It reads them treeExpireBatch at a
+// time, so no shard stays locked for the whole subtree, and stops with
+// b's error once b runs out.
+func (d *database) subtreeKeys(within netip.Prefix, b *budget) ([]netip.Prefix, error) {
+	var keys []netip.Prefix
+	var after netip.Prefix
+	for {
+		page, err := d.entriesAfter(after, within, treeExpireBatch, b)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page {
+			keys = append(keys, e.prefix)
+		}
+		if len(page) < treeExpireBatch {
+			return keys, nil
+		}
+		after = page[len(page)-1].prefix
+		runtime.Gosched()
+	}
+}
+
+// expireTree sets the deadline at on the prefixes in keys that are still
+// stored, unexpired, and without a TTL for only ONLYPERSISTENT or with
+// one for ONLYVOLATILE, and returns those it set. Consecutive prefixes of
+// one shard are updated under one lock, treeExpireBatch at most, so other
+// clients get in between.
+func (d *database) expireTree(keys []netip.Prefix, at int64, only string) []netip.Prefix {
+	var set []netip.Prefix
+	for i := 0; i < len(keys); {
+		sh := d.shardFor(keys[i])
+		sh.mu.Lock()
+		for n := 0; i < len(keys) && n < treeExpireBatch && d.shardFor(keys[i]) == sh; i, n = i+1, n+1 {
+			p := keys[i]
+			old, ok := sh.trie.Get(p)
+			if !ok || old.expired() || only == "ONLYPERSISTENT" && old.expireAt != 0 || only == "ONLYVOLATILE" && old.expireAt == 0 {
+				continue
+			}
+			v := old
+			v.expireAt = at
+			d.wrote()
+			sh.preserve(p)
+			sh.trie.Insert(p, v)
+			d.lpm.invalidate(p)
+			d.trackExpiry(p, old, v)
+			set = append(set, p)
+		}
+		sh.mu.Unlock()
+		runtime.Gosched()
+	}
+	return set
+}
+
+// handleTreeExpire implements TREEEXPIRE cidr seconds [ONLYPERSISTENT|
+// ONLYVOLATILE]: every stored prefix cidr covers, itself included, or
+// only those without or with a TTL, expires in seconds, and the reply is
+// how many were set. Like DELVALUE it finds them first and then updates
+// them in batches, not at one instant, and the audit log names each one.
+// The journal records the deadline rather than seconds, so a rerun sets
+// the one the interrupted run did.
+func (s *TrieServer) handleTreeExpire(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) != 3 && len(cmd.Args) != 4 {
+		conn.WriteError("ERR wrong number of arguments for 'TREEEXPIRE'")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	within, err := db.parseLookup(string(cmd.Args[1]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	at, err := parseExpireTime("EX", cmd.Args[2], "treeexpire")
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	var only string
+	if len(cmd.Args) == 4 {
+		only = strings.ToUpper(string(cmd.Args[3]))
+		if only != "ONLYPERSISTENT" && only != "ONLYVOLATILE" {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	keys, err := db.subtreeKeys(within, &c.budget)
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	jid, err := s.journal.begin("TREEEXPIRE", db.id, journalParams("within", within.String(),
+		"at", strconv.FormatInt(at, 10), "only", only))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	set := db.expireTree(keys, at, only)
+	s.journal.end(jid)
+	if len(set) > 0 {
+		db.writes.add(uint64(c.id), 1)
+		keys := make([]string, len(set))
+		for i, p := range set {
+			keys[i] = p.String()
+		}
+		s.audit(c, "TREEEXPIRE", keys...)
+	}
+	conn.WriteInt(len(set))
+}
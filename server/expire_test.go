@@ -0,0 +1,203 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSetOptions(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	k := "10.0.0.0/8"
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", k, "a", "XX"}, "nil"},
+		{[]string{"GET", k}, "nil"},
+		{[]string{"SET", k, "a", "NX"}, "OK"},
+		{[]string{"SET", k, "b", "NX"}, "nil"},
+		{[]string{"SET", k, "b", "XX", "GET"}, "a"},
+		{[]string{"SET", k, "c", "GET"}, "b"},
+		{[]string{"SET", "10.1.0.0/16", "x", "GET"}, "nil"},
+		{[]string{"TTL", k}, "-1"},
+		{[]string{"SET", k, "c", "EX", "100"}, "OK"},
+		{[]string{"TTL", k}, "100"},
+		{[]string{"SET", k, "d", "KEEPTTL"}, "OK"},
+		{[]string{"TTL", k}, "100"},
+		{[]string{"APPEND", k, "e"}, "2"}, // modifying keeps the TTL
+		{[]string{"TTL", k}, "100"},
+		{[]string{"SET", k, "d"}, "OK"}, // a plain SET clears it
+		{[]string{"TTL", k}, "-1"},
+		{[]string{"SET", k, "d", "px", "100000"}, "OK"},
+		{[]string{"TTL", k}, "100"},
+		{[]string{"SET", k, "d", "PXAT", future}, "OK"},
+		{[]string{"TTL", k}, "3600"},
+		{[]string{"SET", k, "d", "EXAT", past}, "OK"}, // a deadline in the past deletes
+		{[]string{"GET", k}, "nil"},
+		{[]string{"TTL", k}, "-2"},
+		{[]string{"SETEX", k, "50", "e"}, "OK"},
+		{[]string{"TTL", k}, "50"},
+		{[]string{"PSETEX", k, "50000", "f"}, "OK"},
+		{[]string{"TTL", k}, "50"},
+		{[]string{"GET", k}, "f"},
+		{[]string{"HSET", "10.2.0.0/16", "f", "v"}, "1"},
+		{[]string{"SET", "10.2.0.0/16", "s", "GET"}, "WRONGTYPE"},
+		{[]string{"SET", k, "a", "NX", "XX"}, "ERR syntax error"},
+		{[]string{"SET", k, "a", "EX", "1", "PX", "1"}, "ERR syntax error"},
+		{[]string{"SET", k, "a", "EX", "1", "KEEPTTL"}, "ERR syntax error"},
+		{[]string{"SET", k, "a", "EX"}, "ERR syntax error"},
+		{[]string{"SET", k, "a", "SOON"}, "ERR syntax error"},
+		{[]string{"SET", k, "a", "EX", "0"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"SET", k, "a", "EX", "-5"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"SET", k, "a", "EX", "9223372036854775807"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"SET", k, "a", "PX", "ten"}, "ERR value is not an integer"},
+		{[]string{"SETEX", k, "0", "a"}, "ERR invalid expire time in 'setex' command"},
+		{[]string{"PSETEX", k, "a"}, "ERR wrong number of arguments for 'PSETEX'"},
+		{[]string{"GET", k}, "f"}, // unchanged by the failures
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "wide"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", "narrow", "PX", "20"}, "OK"},
+		{[]string{"SET", "2001:db8::/32", "six", "PX", "20"}, "OK"},
+		{[]string{"GET", "10.1.2.3"}, "narrow"},
+	})
+	if got := keyspaceField(t, ss, 0, "expires"); got != "2" {
+		t.Errorf("expires = %s, want 2", got)
+	}
+	time.Sleep(30 * time.Millisecond) // past the deadline, but expireCron is not running
+
+	runSteps(t, ss, []replyStep{
+		{[]string{"GET", "10.1.2.3"}, "wide"}, // falls back to the less specific prefix
+		{[]string{"GET", "10.1.0.0/16"}, "wide"},
+		{[]string{"TTL", "10.1.0.0/16"}, "-2"},
+		{[]string{"PTTL", "2001:db8::/32"}, "-2"},
+		{[]string{"TTL", "10.0.0.0/8"}, "-1"},
+		{[]string{"PTTL", "10.0.0.0/8"}, "-1"},
+		{[]string{"TTL"}, "ERR wrong number of arguments for 'TTL'"},
+	})
+	want := []string{"10.0.0.0/8"}
+	if got := mustDo(t, ss, "KEYS", "*").strs(); !slices.Equal(got, want) {
+		t.Errorf("KEYS * = %q, want %q", got, want)
+	}
+	r := mustDo(t, ss, "SCAN", "0", "COUNT", "100")
+	if got := r.Array[1].strs(); r.Array[0].Str != "0" || !slices.Equal(got, want) {
+		t.Errorf("SCAN 0 = %s %q, want 0 %q", r.Array[0].Str, got, want)
+	}
+
+	if got := s.getDB(0).expire(nowMillis()); got != 2 {
+		t.Errorf("expire deleted %d prefixes, want 2", got)
+	}
+	if got := s.getDB(0).expire(nowMillis()); got != 0 {
+		t.Errorf("a second pass deleted %d more", got)
+	}
+	runSteps(t, ss, []replyStep{{[]string{"DBSIZE"}, "1"}})
+	if got := keyspaceField(t, ss, 0, "expires"); got != "0" {
+		t.Errorf("expires after deletion = %s, want 0", got)
+	}
+}
+
+func TestTreeExpire(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		steps []replyStep
+	}{
+		{"whole subtree", []replyStep{
+			{[]string{"TREEEXPIRE", "10.0.0.0/8", "100"}, "3"},
+			{[]string{"TTL", "10.0.0.0/8"}, "100"},
+			{[]string{"TTL", "10.1.0.0/16"}, "100"},
+			{[]string{"TTL", "10.1.2.0/24"}, "100"},
+			{[]string{"TTL", "11.0.0.0/8"}, "-1"},
+			{[]string{"TTL", "0.0.0.0/0"}, "-1"}, // covers the CIDR, not within it
+		}},
+		{"within a prefix", []replyStep{
+			{[]string{"TREEEXPIRE", "10.1.0.0/16", "100"}, "2"},
+			{[]string{"TTL", "10.0.0.0/8"}, "50"},
+		}},
+		{"nothing stored there", []replyStep{
+			{[]string{"TREEEXPIRE", "192.0.2.0/24", "100"}, "0"},
+		}},
+		{"only persistent", []replyStep{
+			{[]string{"TREEEXPIRE", "10.0.0.0/8", "100", "onlypersistent"}, "2"},
+			{[]string{"TTL", "10.0.0.0/8"}, "50"},
+			{[]string{"TTL", "10.1.2.0/24"}, "100"},
+		}},
+		{"only volatile", []replyStep{
+			{[]string{"TREEEXPIRE", "10.0.0.0/8", "100", "ONLYVOLATILE"}, "1"},
+			{[]string{"TTL", "10.0.0.0/8"}, "100"},
+			{[]string{"TTL", "10.1.0.0/16"}, "-1"},
+		}},
+		{"errors", []replyStep{
+			{[]string{"TREEEXPIRE", "10.0.0.0/8"}, "ERR wrong number of arguments for 'TREEEXPIRE'"},
+			{[]string{"TREEEXPIRE", "10.0.0.0/8", "100", "NX"}, "ERR syntax error"},
+			{[]string{"TREEEXPIRE", "10.0.0.0/8", "0"}, "ERR invalid expire time in 'treeexpire' command"},
+			{[]string{"TREEEXPIRE", "10.0.0.0/8", "soon"}, "ERR"},
+			{[]string{"TREEEXPIRE", "not-a-prefix", "100"}, "ERR"},
+			{[]string{"TTL", "10.1.0.0/16"}, "-1"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := newTestSession(t, newTestServer(t))
+			for _, k := range []string{"0.0.0.0/0", "10.1.0.0/16", "10.1.2.0/24", "11.0.0.0/8"} {
+				mustDo(t, ss, "SET", k, "v")
+			}
+			mustDo(t, ss, "SET", "10.0.0.0/8", "v", "EX", "50")
+			runSteps(t, ss, tc.steps)
+		})
+	}
+}
+
+// TestTreeExpireIPv6 expires a subtree of more than one batch spread over
+// the IPv6 shards, next to 4000::/16, which shares a shard with 2000::/16
+// but lies outside 2000::/3.
+func TestTreeExpireIPv6(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	within := netip.MustParsePrefix("2000::/3")
+	r := rand.New(rand.NewPCG(7, 8))
+	inside := map[netip.Prefix]bool{within: true}
+	shards := make(map[*shard]bool)
+	db := ss.s.getDB(0)
+	for len(inside) < 3*treeExpireBatch {
+		p := randomPrefix(r, 16, 8)
+		a := p.Addr().As16()
+		a[0] = a[0]&0x1f | 0x20 // into 2000::/3
+		p = netip.PrefixFrom(netip.AddrFrom16(a), p.Bits()).Masked()
+		inside[p] = true
+		shards[db.shardFor(p)] = true
+	}
+	if len(shards) < 2 {
+		t.Fatalf("the subtree lies in %d shard, want several", len(shards))
+	}
+	outside := []string{"4000::/16", "::/0", "10.0.0.0/8"}
+	for _, k := range outside {
+		mustDo(t, ss, "SET", k, "v")
+	}
+	for p := range inside {
+		mustDo(t, ss, "SET", p.String(), "v")
+	}
+	mustDo(t, ss, "SET", within.String(), "v", "EX", "10")
+
+	if r := mustDo(t, ss, "TREEEXPIRE", within.String(), "100", "ONLYPERSISTENT"); r.Int != int64(len(inside)-1) {
+		t.Fatalf("TREEEXPIRE ONLYPERSISTENT = %d, want %d", r.Int, len(inside)-1)
+	}
+	if r := mustDo(t, ss, "TREEEXPIRE", within.String(), "100"); r.Int != int64(len(inside)) {
+		t.Fatalf("TREEEXPIRE = %d, want %d", r.Int, len(inside))
+	}
+	for p := range inside {
+		if r := mustDo(t, ss, "TTL", p.String()); r.Int != 100 {
+			t.Fatalf("TTL %s = %d, want 100", p, r.Int)
+		}
+	}
+	for _, k := range outside {
+		if r := mustDo(t, ss, "TTL", k); r.Int != -1 {
+			t.Errorf("TTL %s = %d, want -1", k, r.Int)
+		}
+	}
+}
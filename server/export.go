@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// exportFile writes entries to path in format, csv or json. CSV is what
+// IMPORT reads back; it has no room for a type, so a hash is written as a
+// JSON object of its fields. JSON is one {"prefix","value"} or
+// {"prefix","hash"} object per line, so it streams. The file is written under a temporary name and renamed into
+// place, so readers never see a partial export.
+func exportFile(path, format string, entries []entry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	w := bufio.NewWriterSize(tmp, 1<<16)
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			if err = enc.Encode(newGatewayEntry(e)); err != nil {
+				break
+			}
+		}
+	default:
+		cw := csv.NewWriter(w)
+		for _, e := range entries {
+			if err = cw.Write([]string{e.prefix.String(), e.value.text()}); err != nil {
+				break
+			}
+		}
+		cw.Flush()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// handleExport implements EXPORT path [FORMAT csv|json] [WITHIN cidr]
+// [DB index|name], replying with the number of entries written. The
+// format defaults from the file extension. The file is written by the
+// server, relative to dir, and may not lead out of it. There is no expiry
+// column: exported prefixes are loaded back without a TTL.
+func (s *TrieServer) handleExport(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'EXPORT'")
+		return
+	}
+	path, err := s.snapshots.inDir(string(cmd.Args[1]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	format := "csv"
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		format = "json"
+	}
+	id := currentDB(conn)
+	var within string
+	for i := 2; i < len(cmd.Args); i += 2 {
+		if i+1 == len(cmd.Args) {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		val := string(cmd.Args[i+1])
+		switch strings.ToUpper(string(cmd.Args[i])) {
+		case "FORMAT":
+			if format = strings.ToLower(val); format != "csv" && format != "json" {
+				conn.WriteError("ERR FORMAT must be csv or json")
+				return
+			}
+		case "WITHIN":
+			within = val
+		case "DB":
+			n, err := s.resolveDB(val)
+			if err != nil {
+				writeError(conn, err)
+				return
+			}
+			id = n
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	db := s.existingDB(id)
+	if db == nil { // export an empty file rather than create the DB
+		db = newDatabase(id, &s.store)
+	}
+	var scope netip.Prefix // everything
+	if within != "" {
+		p, err := db.parseLookup(within)
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		scope = p
+	}
+	entries := db.snapshot(scope)
+	if err := exportFile(path, format, entries); err != nil {
+		conn.WriteError(fmt.Sprintf("ERR export failed: %v", err))
+		return
+	}
+	conn.WriteInt(len(entries))
+}
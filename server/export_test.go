@@ -0,0 +1,119 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ss := newTestSession(t, newTestServer(t))
+	for k, v := range map[string]string{
+		"2001:db8::/32":  "v6",
+		"10.1.0.0/16":    "b",
+		"10.0.0.0/8":     "a,with comma",
+		"192.168.0.0/16": "c",
+	} {
+		mustDo(t, ss, "SET", k, v)
+	}
+	mustDo(t, ss, "NAMEDB", "3", "geo")
+	for _, tc := range []struct {
+		args []string // after EXPORT
+		file string
+		want string
+	}{
+		{
+			args: []string{"all.csv"},
+			file: "all.csv",
+			want: "10.0.0.0/8,\"a,with comma\"\n10.1.0.0/16,b\n192.168.0.0/16,c\n2001:db8::/32,v6\n",
+		},
+		{
+			args: []string{"all.json"},
+			file: "all.json",
+			want: `{"prefix":"10.0.0.0/8","value":"a,with comma"}` + "\n" + `{"prefix":"10.1.0.0/16","value":"b"}` + "\n" +
+				`{"prefix":"192.168.0.0/16","value":"c"}` + "\n" + `{"prefix":"2001:db8::/32","value":"v6"}` + "\n",
+		},
+		{
+			args: []string{"within.dump", "WITHIN", "10.0.0.0/8", "FORMAT", "JSON"},
+			file: "within.dump",
+			want: `{"prefix":"10.0.0.0/8","value":"a,with comma"}` + "\n" + `{"prefix":"10.1.0.0/16","value":"b"}` + "\n",
+		},
+		{
+			args: []string{"v6.csv", "WITHIN", "::/0"},
+			file: "v6.csv",
+			want: "2001:db8::/32,v6\n",
+		},
+		{
+			args: []string{"empty.csv", "DB", "geo"},
+			file: "empty.csv",
+			want: "",
+		},
+	} {
+		r := mustDo(t, ss, append([]string{"EXPORT"}, tc.args...)...)
+		b, err := os.ReadFile(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.want {
+			t.Errorf("EXPORT %q wrote\n%s\nwant\n%s", tc.args, b, tc.want)
+		}
+		if n := int64(strings.Count(tc.want, "\n")); r.Int != n {
+			t.Errorf("EXPORT %q = %d, want %d", tc.args, r.Int, n)
+		}
+	}
+	if st := dbStats(t, ss); st["keys"] != 4 {
+		t.Errorf("DBSTATS after EXPORT = %v", st)
+	}
+	if got := showDBs(t, ss, "ALL"); len(got) != 1 {
+		t.Errorf("EXPORT of an empty database created it: SHOWDBS ALL = %q", got)
+	}
+
+	// IMPORT reads a CSV export back.
+	mustDo(t, ss, "SELECT", "geo")
+	counts, _ := importFields(t, ss.Do("IMPORT", "all.csv"))
+	if counts["inserted"] != 4 || counts["errors"] != 0 {
+		t.Errorf("IMPORT of the export = %v", counts)
+	}
+	if r := mustDo(t, ss, "GET", "10.2.3.4"); r.Str != "a,with comma" {
+		t.Errorf("GET after the round trip = %q", r.Str)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	ss := newTestSession(t, newTestServer(t))
+	mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+	outside := t.TempDir()
+	rel, err := filepath.Rel(dir, filepath.Join(outside, "dump.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"EXPORT"}, "ERR wrong number of arguments"},
+		{[]string{"EXPORT", filepath.Join(outside, "dump.csv")}, "ERR path must be relative"},
+		{[]string{"EXPORT", rel}, "ERR path must be relative"},
+		{[]string{"EXPORT", "../dump.csv"}, "ERR path must be relative"},
+		{[]string{"EXPORT", "sub/../../dump.csv"}, "ERR path must be relative"},
+		{[]string{"EXPORT", "no/such/dir.csv"}, "ERR export failed"},
+		{[]string{"EXPORT", "dump.csv", "FORMAT"}, "ERR syntax error"},
+		{[]string{"EXPORT", "dump.csv", "FORMAT", "tsv"}, "ERR FORMAT must be csv or json"},
+		{[]string{"EXPORT", "dump.csv", "WITHIN", "nonsense"}, "ERR invalid"},
+		{[]string{"EXPORT", "dump.csv", "DB", "nosuch"}, "ERR unknown database name"},
+		{[]string{"EXPORT", "dump.csv", "LIMIT", "1"}, "ERR syntax error"},
+	} {
+		if err := ss.Do(tc.args...).Err(); err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+			t.Errorf("%q = %v, want %q", tc.args, err, tc.wantErr)
+		}
+	}
+	for _, d := range []string{dir, outside} {
+		if entries, _ := os.ReadDir(d); len(entries) != 0 {
+			t.Errorf("failed EXPORTs left %d files in %s", len(entries), d)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// gatewayEntry is one prefix in a gateway reply, with a string value, a
+// hash or a set. Values are sent as JSON strings, so bytes that are not
+// UTF-8 arrive as U+FFFD.
+type gatewayEntry struct {
+	Prefix string            `json:"prefix"`
+	Value  *string           `json:"value,omitempty"`
+	Hash   map[string]string `json:"hash,omitempty"`
+	Set    []string          `json:"set,omitempty"`
+}
+
+func newGatewayEntry(e entry) gatewayEntry {
+	out := gatewayEntry{Prefix: e.prefix.String()}
+	switch {
+	case e.value.isHash():
+		out.Hash = e.value.fieldStrings()
+	case e.value.isSet():
+		out.Set = e.value.members()
+	default:
+		str := string(e.value.str)
+		out.Value = &str
+	}
+	return out
+}
+
+// ServeGateway serves the read-only HTTP/JSON API on addr for clients
+// that cannot speak RESP:
+//
+//	GET /lookup/{ip}   longest stored prefix containing ip, else the
+//	                   DB's default value with a null prefix
+//	GET /match/{ip}    every stored prefix containing ip, least specific first
+//	GET /key/{cidr}    the prefix stored at exactly cidr
+//	GET /healthz       200 once the server is up
+//
+// Each takes an optional ?db= index or name, DB 0 by default. Lookups go
+// through the same shard read locks and key parsing as the RESP commands.
+func (s *TrieServer) ServeGateway(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /lookup/{ip...}", s.gatewayHandler("ip", func(id int, db *database, arg string) (any, bool) {
+		if db != nil {
+			p, v, ok := db.longestMatch(arg)
+			if ok {
+				db.hits.add(0, 1)
+				return newGatewayEntry(entry{p, v}), true
+			}
+			db.misses.add(0, 1)
+		}
+		if def, ok := s.defaults.get(id); ok {
+			return map[string]any{"prefix": nil, "value": string(def), "default": true}, true
+		}
+		return nil, false
+	}))
+	mux.HandleFunc("GET /match/{ip...}", s.gatewayHandler("ip", func(_ int, db *database, arg string) (any, bool) {
+		if db == nil {
+			return nil, false
+		}
+		matches, _ := db.supernets(arg)
+		out := make([]gatewayEntry, len(matches))
+		for i, e := range matches {
+			out[i] = newGatewayEntry(e)
+		}
+		return map[string]any{"matches": out}, len(out) > 0
+	}))
+	mux.HandleFunc("GET /key/{cidr...}", s.gatewayHandler("cidr", func(_ int, db *database, arg string) (any, bool) {
+		if db == nil {
+			return nil, false
+		}
+		p, err := db.parseKey(arg)
+		if err != nil {
+			return nil, false
+		}
+		v, ok := db.lookupExact(arg)
+		return newGatewayEntry(entry{p, v}), ok
+	}))
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("HTTP gateway stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// gatewayHandler adapts a lookup to HTTP: it resolves ?db=, validates the
+// path argument and answers 404 for a miss. The lookup is given a nil
+// database when the index holds none.
+func (s *TrieServer) gatewayHandler(wildcard string, lookup func(id int, db *database, arg string) (any, bool)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		arg := r.PathValue(wildcard)
+		id := 0
+		if name := r.URL.Query().Get("db"); name != "" {
+			n, err := s.resolveDB(name)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": strings.TrimPrefix(err.Error(), "ERR ")})
+				return
+			}
+			id = n
+		}
+		if _, err := parsePrefix(arg); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		db := s.existingDB(id) // a lookup never creates a DB
+		reply, ok := lookup(id, db, arg)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, reply)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGateway(t *testing.T) {
+	s := newTestServer(t)
+	addr := "127.0.0.1:" + strconv.Itoa(freePort(t))
+	if err := s.ServeGateway(addr); err != nil {
+		t.Fatal(err)
+	}
+	ss := newTestSession(t, s)
+	for k, v := range map[string]string{
+		"10.0.0.0/8":    "a",
+		"10.1.0.0/16":   "b",
+		"2001:db8::/32": "v6",
+	} {
+		mustDo(t, ss, "SET", k, v)
+	}
+	mustDo(t, ss, "NAMEDB", "2", "geo")
+	mustDo(t, ss, "SELECT", "geo")
+	mustDo(t, ss, "SET", "10.0.0.0/8", "in geo")
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		want   string // the JSON body
+	}{
+		{"/healthz", 200, ""},
+		{"/lookup/10.1.2.3", 200, `{"prefix":"10.1.0.0/16","value":"b"}`},
+		{"/lookup/10.2.0.1", 200, `{"prefix":"10.0.0.0/8","value":"a"}`},
+		{"/lookup/2001:db8::1", 200, `{"prefix":"2001:db8::/32","value":"v6"}`},
+		{"/lookup/192.0.2.1", 404, `{"error":"not found"}`},
+		{"/lookup/10.1.2.3?db=geo", 200, `{"prefix":"10.0.0.0/8","value":"in geo"}`},
+		{"/lookup/10.1.2.3?db=2", 200, `{"prefix":"10.0.0.0/8","value":"in geo"}`},
+		{"/lookup/10.1.2.3?db=5", 404, `{"error":"not found"}`},
+		{"/lookup/10.1.2.3?db=nosuch", 400, `{"error":"unknown database name 'nosuch'"}`},
+		{"/lookup/not-an-ip", 400, `{"error":"invalid IP/CIDR"}`},
+		{"/match/10.1.2.3", 200, `{"matches":[{"prefix":"10.0.0.0/8","value":"a"},{"prefix":"10.1.0.0/16","value":"b"}]}`},
+		{"/match/192.0.2.1", 404, `{"error":"not found"}`},
+		{"/key/10.1.0.0/16", 200, `{"prefix":"10.1.0.0/16","value":"b"}`},
+		{"/key/10.1.0.0/24", 404, `{"error":"not found"}`},
+		{"/key/10.0.0.0/8?db=geo", 200, `{"prefix":"10.0.0.0/8","value":"in geo"}`},
+	} {
+		resp, err := http.Get("http://" + addr + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("GET %s: status %d, want %d", tc.path, resp.StatusCode, tc.status)
+		}
+		if tc.want != "" && strings.TrimSpace(string(body)) != tc.want {
+			t.Errorf("GET %s = %s, want %s", tc.path, body, tc.want)
+		} else if tc.want != "" && !json.Valid(body) {
+			t.Errorf("GET %s: invalid JSON %s", tc.path, body)
+		}
+	}
+
+	// Lookups count like GET, and a lookup in a missing database does not
+	// create it.
+	if st := dbStats(t, ss, "0"); st["hits"] != 3 || st["misses"] != 1 {
+		t.Errorf("DBSTATS 0 after the gateway lookups = %v, want 3 hits and 1 miss", st)
+	}
+	if got := showDBs(t, ss, "ALL"); len(got) != 2 {
+		t.Errorf("SHOWDBS ALL = %q, want only db 0 and geo", got)
+	}
+}
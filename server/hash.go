@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+
+	"github.com/tidwall/redcon"
+)
+
+// hashWith returns a copy of old's fields with the given field/value
+// pairs set, and how many of the fields are new. A string old counts as
+// absent, so callers check the type first.
+func hashWith(old value, pairs [][]byte) (value, int) {
+	fields := make(map[string][]byte, len(old.hash)+len(pairs)/2)
+	maps.Copy(fields, old.hash)
+	added := 0
+	for i := 0; i < len(pairs); i += 2 {
+		f := string(pairs[i])
+		if _, ok := fields[f]; !ok {
+			added++
+		}
+		// redcon reuses its read buffer, so the stored value is a copy.
+		fields[f] = bytes.Clone(pairs[i+1])
+	}
+	return value{hash: fields}, added
+}
+
+// writeHash writes a hash's fields as a flat field/value array, sorted by
+// field so replies are stable.
+func writeHash(conn redcon.Conn, v value) {
+	names := slices.Sorted(maps.Keys(v.hash))
+	conn.WriteArray(len(names) * 2)
+	for _, f := range names {
+		conn.WriteBulkString(f)
+		conn.WriteBulk(v.hash[f])
+	}
+}
+
+// handleHash implements the hash commands:
+//
+//	HSET cidr field value [field value ...]  fields added
+//	HGET cidr field
+//	HMGET cidr field [field ...]
+//	HGETALL cidr
+//	HDEL cidr field [field ...]              fields removed
+//	HEXISTS cidr field
+//	HLOOKUP ip                               [prefix, fields] of the longest match
+//
+// HDEL of a hash's last field deletes the prefix, as in Redis.
+func (s *TrieServer) handleHash(conn redcon.Conn, c *client, name string, cmd redcon.Command) {
+	minArgs := map[string]int{"HSET": 4, "HGET": 3, "HMGET": 3, "HGETALL": 2, "HDEL": 3, "HEXISTS": 3, "HLOOKUP": 2}[name]
+	exact := name == "HGET" || name == "HGETALL" || name == "HEXISTS" || name == "HLOOKUP"
+	if len(cmd.Args) < minArgs || exact && len(cmd.Args) != minArgs || name == "HSET" && len(cmd.Args)%2 != 0 {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "'")
+		return
+	}
+	cidr := string(cmd.Args[1])
+	db := s.getDB(currentDB(conn))
+
+	switch name {
+	case "HSET":
+		var added int
+		err := db.update(cidr, func(old value, ok bool) (value, error) {
+			if ok && !old.isHash() {
+				return value{}, errWrongType
+			}
+			var v value
+			v, added = hashWith(old, cmd.Args[2:])
+			return v, nil
+		})
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		db.writes.add(uint64(c.id), 1)
+		s.audit(c, name, cidr)
+		conn.WriteInt(added)
+
+	case "HDEL":
+		removed := 0
+		err := db.update(cidr, func(old value, ok bool) (value, error) {
+			if !ok {
+				return value{}, errUnchanged
+			}
+			if !old.isHash() {
+				return value{}, errWrongType
+			}
+			fields := maps.Clone(old.hash)
+			for _, f := range cmd.Args[2:] {
+				if _, ok := fields[string(f)]; ok {
+					delete(fields, string(f))
+					removed++
+				}
+			}
+			switch {
+			case removed == 0:
+				return value{}, errUnchanged
+			case len(fields) == 0:
+				return value{}, nil
+			}
+			return value{hash: fields}, nil
+		})
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		if removed > 0 {
+			db.writes.add(uint64(c.id), 1)
+			s.audit(c, name, cidr)
+		}
+		conn.WriteInt(removed)
+
+	case "HLOOKUP":
+		p, v, ok := db.longestMatch(cidr)
+		if !ok {
+			db.misses.add(uint64(c.id), 1)
+			conn.WriteNull()
+			return
+		}
+		db.hits.add(uint64(c.id), 1)
+		if !v.isHash() {
+			writeError(conn, errWrongType)
+			return
+		}
+		conn.WriteArray(2)
+		conn.WriteBulkString(p.String())
+		writeHash(conn, v)
+
+	default: // reads of exactly one prefix
+		v, ok := db.lookupExact(cidr)
+		if ok && !v.isHash() {
+			writeError(conn, errWrongType)
+			return
+		}
+		switch name {
+		case "HGET":
+			if fv, found := v.hash[string(cmd.Args[2])]; found {
+				conn.WriteBulk(fv)
+			} else {
+				conn.WriteNull()
+			}
+		case "HMGET":
+			conn.WriteArray(len(cmd.Args) - 2)
+			for _, f := range cmd.Args[2:] {
+				if fv, found := v.hash[string(f)]; found {
+					conn.WriteBulk(fv)
+				} else {
+					conn.WriteNull()
+				}
+			}
+		case "HGETALL":
+			writeHash(conn, v)
+		case "HEXISTS":
+			if _, found := v.hash[string(cmd.Args[2])]; found {
+				conn.WriteInt(1)
+			} else {
+				conn.WriteInt(0)
+			}
+		}
+	}
+}
+
+// handleType implements TYPE cidr: string, hash, set, or none if nothing
+// is stored at exactly cidr.
+func (s *TrieServer) handleType(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for 'TYPE'")
+		return
+	}
+	if v, ok := s.getDB(currentDB(conn)).peekExact(string(cmd.Args[1])); ok {
+		conn.WriteString(v.typeName())
+	} else {
+		conn.WriteString("none")
+	}
+}
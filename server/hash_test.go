@@ -0,0 +1,68 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHashCommands(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ss := newTestSession(t, newTestServer(t))
+	const k = "10.0.0.0/8"
+	for _, tc := range []struct {
+		args []string
+		want string // the reply as Reply.String renders it; an error by its prefix
+	}{
+		{[]string{"TYPE", k}, "none"},
+		{[]string{"HGET", k, "asn"}, "nil"},
+		{[]string{"HGETALL", k}, "[]"},
+		{[]string{"HSET", k, "asn", "64500", "cc", "NO"}, "2"},
+		{[]string{"HSET", k, "asn", "64501", "city", "Oslo"}, "1"},
+		{[]string{"TYPE", k}, "hash"},
+		{[]string{"HGET", k, "asn"}, "64501"},
+		{[]string{"HMGET", k, "cc", "nope", "city"}, "[NO nil Oslo]"},
+		{[]string{"HGETALL", k}, "[asn 64501 cc NO city Oslo]"},
+		{[]string{"HEXISTS", k, "cc"}, "1"},
+		{[]string{"HEXISTS", k, "zip"}, "0"},
+		{[]string{"HLOOKUP", "10.1.2.3"}, "[10.0.0.0/8 [asn 64501 cc NO city Oslo]]"},
+		{[]string{"HLOOKUP", "192.0.2.1"}, "nil"},
+		{[]string{"GET", "10.1.2.3"}, "WRONGTYPE"},
+		{[]string{"JGET", k}, "WRONGTYPE"},
+		{[]string{"MEMORY", "USAGE", "10.0.0.0/8"}, ""}, // checked below
+		{[]string{"EXPORT", "h.csv"}, "1"},
+		{[]string{"HDEL", k, "cc", "nope"}, "1"},
+		{[]string{"HDEL", k, "asn", "city"}, "2"},
+		{[]string{"TYPE", k}, "none"}, // the last field took the prefix with it
+		{[]string{"DBSIZE"}, "0"},
+		{[]string{"SET", k, "plain"}, "OK"},
+		{[]string{"TYPE", k}, "string"},
+		{[]string{"HSET", k, "a", "1"}, "WRONGTYPE"},
+		{[]string{"HGET", k, "a"}, "WRONGTYPE"},
+		{[]string{"HLOOKUP", "10.1.2.3"}, "WRONGTYPE"},
+		{[]string{"HSET", k, "a", "1", "b"}, "ERR wrong number of arguments for 'HSET'"},
+		{[]string{"HGETALL", k, "x"}, "ERR wrong number of arguments for 'HGETALL'"},
+		{[]string{"HSET", "192.0.2.0/24", "a", "1"}, "1"},
+		{[]string{"SET", "192.0.2.0/24", "replaced"}, "OK"}, // SET overwrites a hash
+		{[]string{"GET", "192.0.2.1"}, "replaced"},
+	} {
+		r := ss.Do(tc.args...)
+		got := r.String()
+		switch {
+		case tc.want == "":
+			if r.Type != IntReply || r.Int <= int64(hashFieldOverhead)*3 {
+				t.Errorf("%q = %s, want at least the overhead of three fields", tc.args, got)
+			}
+		case r.Type == ErrorReply:
+			if !strings.HasPrefix(got, tc.want) {
+				t.Errorf("%q = error %q, want %q", tc.args, got, tc.want)
+			}
+		case got != tc.want:
+			t.Errorf("%q = %s, want %s", tc.args, got, tc.want)
+		}
+	}
+	// EXPORT wrote the hash as a JSON object of its fields.
+	if b, err := os.ReadFile("h.csv"); err != nil || string(b) != `10.0.0.0/8,"{""asn"":""64501"",""cc"":""NO"",""city"":""Oslo""}"`+"\n" {
+		t.Errorf("exported hash: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// hotKeySlots is how many prefixes a hot-key tracker follows, and so the
+// most HOTKEYS can report.
+const hotKeySlots = 128
+
+// hotKeys approximates the most matched prefixes of one database with the
+// space-saving algorithm: a fixed set of slots, where a prefix not yet
+// followed takes over the least counted slot and inherits its count. Any
+// prefix matched more often than 1/hotKeySlots of the time is sure to be
+// followed, and its count is over by at most the inherited part, err.
+//
+// Only one match in hotkeys-sample-rate is observed, so the lock is rarely
+// taken on a busy server; counts are scaled back up when reported.
+type hotKeys struct {
+	mu    sync.Mutex
+	since time.Time // first observation since the last reset
+	slot  map[netip.Prefix]int
+	keys  [hotKeySlots]netip.Prefix
+	count [hotKeySlots]int64
+	err   [hotKeySlots]int64
+}
+
+// hotKey is one HOTKEYS entry.
+type hotKey struct {
+	prefix     netip.Prefix
+	count, err int64
+}
+
+// sample observes a match of p with probability 1/rate.
+func (h *hotKeys) sample(p netip.Prefix, rate int64) {
+	if rate > 1 && rand.Int64N(rate) != 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.slot == nil {
+		h.slot = make(map[netip.Prefix]int, hotKeySlots)
+		h.since = time.Now()
+	}
+	if i, ok := h.slot[p]; ok {
+		h.count[i]++
+		return
+	}
+	i := len(h.slot)
+	if i == hotKeySlots {
+		i = 0
+		for j := range h.count {
+			if h.count[j] < h.count[i] {
+				i = j
+			}
+		}
+		delete(h.slot, h.keys[i])
+		h.err[i] = h.count[i]
+	}
+	h.slot[p], h.keys[i] = i, p
+	h.count[i]++
+}
+
+// top returns the n most counted prefixes, most counted first, and when
+// counting started.
+func (h *hotKeys) top(n int) ([]hotKey, time.Time) {
+	h.mu.Lock()
+	out := make([]hotKey, 0, len(h.slot))
+	for p, i := range h.slot {
+		out = append(out, hotKey{p, h.count[i], h.err[i]})
+	}
+	since := h.since
+	h.mu.Unlock()
+	slices.SortFunc(out, func(a, b hotKey) int {
+		if c := cmp.Compare(b.count, a.count); c != 0 {
+			return c
+		}
+		return comparePrefixes(a.prefix, b.prefix)
+	})
+	return out[:min(n, len(out))], since
+}
+
+// reset forgets everything, for CONFIG RESETSTAT.
+func (h *hotKeys) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.slot = nil
+	h.since = time.Time{}
+	h.count, h.err = [hotKeySlots]int64{}, [hotKeySlots]int64{}
+}
+
+// handleHotKeys implements HOTKEYS [count], replying with the current
+// DB's most matched prefixes as [prefix, hits, error] triples, hits and
+// error being scaled estimates, along with the window they cover.
+func (s *TrieServer) handleHotKeys(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) > 2 {
+		conn.WriteError("ERR wrong number of arguments for 'HOTKEYS'")
+		return
+	}
+	n := 10
+	if len(cmd.Args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(string(cmd.Args[1])); err != nil || n < 1 {
+			conn.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+	}
+	if !s.store.hotKeys.Load() {
+		conn.WriteError("ERR hotkeys-tracking is off")
+		return
+	}
+	rate := max(s.store.hotKeysRate.Load(), 1)
+	keys, since := s.getDB(currentDB(conn)).hot.top(n)
+	var window int64
+	if !since.IsZero() {
+		window = int64(time.Since(since).Seconds())
+	}
+	conn.WriteArray(8)
+	conn.WriteBulkString("since")
+	conn.WriteInt64(max(since.Unix(), 0))
+	conn.WriteBulkString("window-seconds")
+	conn.WriteInt64(window)
+	conn.WriteBulkString("sample-rate")
+	conn.WriteInt64(rate)
+	conn.WriteBulkString("keys")
+	conn.WriteArray(len(keys))
+	for _, k := range keys {
+		conn.WriteArray(3)
+		conn.WriteBulkString(k.prefix.String())
+		conn.WriteInt64(k.count * rate)
+		conn.WriteInt64(k.err * rate)
+	}
+}
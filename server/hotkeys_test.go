@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/netip"
+	"strconv"
+	"testing"
+)
+
+func TestHotKeysSpaceSaving(t *testing.T) {
+	var h hotKeys
+	p := func(i int) netip.Prefix {
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24)
+	}
+	// Three heavy hitters among twice as many one-off prefixes as there
+	// are slots, interleaved so they are always competing.
+	for i := range 2 * hotKeySlots {
+		h.sample(p(1000+i), 1)
+		for heavy, every := range []int{1, 2, 4} {
+			if i%every == 0 {
+				h.sample(p(heavy), 1)
+			}
+		}
+	}
+	top, since := h.top(3)
+	if since.IsZero() {
+		t.Error("no start of the window")
+	}
+	for i, want := range []int64{2 * hotKeySlots, hotKeySlots, hotKeySlots / 2} {
+		if i >= len(top) || top[i].prefix != p(i) || top[i].count-top[i].err > want || top[i].count < want {
+			t.Fatalf("top 3 = %+v, want %v with %d hits first", top, p(i), want)
+		}
+	}
+	if all, _ := h.top(1000); len(all) != hotKeySlots {
+		t.Errorf("%d prefixes followed, want %d", len(all), hotKeySlots)
+	}
+	h.reset()
+	if top, since := h.top(10); len(top) != 0 || !since.IsZero() {
+		t.Errorf("after reset: %+v since %v", top, since)
+	}
+}
+
+func TestHotKeysCommand(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"HOTKEYS"}, "ERR hotkeys-tracking is off"},
+		{[]string{"CONFIG", "SET", "hotkeys-tracking", "yes", "hotkeys-sample-rate", "1"}, "OK"},
+		{[]string{"HOTKEYS", "0"}, "ERR value is not an integer or out of range"},
+		{[]string{"HOTKEYS", "1", "2"}, "ERR wrong number of arguments for 'HOTKEYS'"},
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", "b"}, "OK"},
+		{[]string{"HSET", "192.0.2.0/24", "f", "v"}, "1"},
+	})
+	for i := range 30 {
+		mustDo(t, ss, "GET", "10.1.0."+strconv.Itoa(i))
+		if i%3 == 0 {
+			mustDo(t, ss, "GET", "10.2.0.1")
+			mustDo(t, ss, "HLOOKUP", "192.0.2.1")
+		}
+	}
+	mustDo(t, ss, "GET", "172.16.0.1") // a miss is not a hot key
+	r := mustDo(t, ss, "HOTKEYS", "2")
+	if got := r.Array[7].String(); got != "[[10.1.0.0/16 30 0] [10.0.0.0/8 10 0]]" {
+		t.Errorf("HOTKEYS 2 keys = %s", got)
+	}
+	if r.Array[4].Str != "sample-rate" || r.Array[5].Int != 1 || r.Array[1].Int == 0 {
+		t.Errorf("HOTKEYS = %s", r.String())
+	}
+	if got := mustDo(t, ss, "HOTKEYS").Array[7].Array; len(got) != 3 {
+		t.Errorf("HOTKEYS = %d keys, want 3", len(got))
+	}
+	mustDo(t, ss, "CONFIG", "RESETSTAT")
+	if got := mustDo(t, ss, "HOTKEYS").String(); got != "[since 0 window-seconds 0 sample-rate 1 keys []]" {
+		t.Errorf("HOTKEYS after CONFIG RESETSTAT = %s", got)
+	}
+}
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// importBatch is how many lines IMPORT loads between yields. Every
+// insert takes only its own shard's lock, so clients are never locked out
+// for longer than one insert, and yielding keeps a big load from starving
+// their goroutines.
+const importBatch = 1000
+
+// maxImportErrors is how many parse errors an IMPORT reply quotes.
+const maxImportErrors = 5
+
+// conflictMode is what a bulk load does with a prefix already stored.
+type conflictMode int
+
+const (
+	conflictReplace conflictMode = iota // overwrite it, like SET
+	conflictSkip                        // keep the stored value
+	conflictAbort                       // stop loading
+)
+
+// importOptions are the settings of one IMPORT.
+type importOptions struct {
+	path     string
+	format   string // csv, tsv, json or mrt
+	conflict conflictMode
+
+	template  string // the value an mrt route is stored as; see parseMRTTemplate
+	multipath string // shortest or all; see importMRT
+}
+
+// importResult tallies one IMPORT. Lines that fail to parse are counted
+// in errors and quoted, up to maxImportErrors, in firstErrors.
+type importResult struct {
+	lines, inserted, replaced, skipped, errors int
+	firstErrors                                []string
+	routes                                     int // MRT peer paths read
+}
+
+// importConflict is the error ending an IMPORT in ABORT mode.
+type importConflict struct {
+	line   int
+	record bool // line counts MRT records
+	prefix string
+}
+
+func (e *importConflict) Error() string {
+	unit := "line"
+	if e.record {
+		unit = "record"
+	}
+	return fmt.Sprintf("%s %d: %s is already stored", unit, e.line, e.prefix)
+}
+
+// formatFor guesses a file's format from its name, compression suffix
+// aside. RouteViews and RIPE RIS name their RIB dumps rib.* and bview.*.
+func formatFor(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".bz2")
+	switch {
+	case strings.HasSuffix(name, ".tsv"):
+		return "tsv"
+	case strings.HasSuffix(name, ".json"), strings.HasSuffix(name, ".jsonl"), strings.HasSuffix(name, ".ndjson"):
+		return "json"
+	case strings.HasSuffix(name, ".mrt"), strings.HasPrefix(name, "rib."), strings.HasPrefix(name, "bview."):
+		return "mrt"
+	}
+	return "csv"
+}
+
+// validImportFormat checks a FORMAT argument.
+func validImportFormat(format string) error {
+	switch format {
+	case "csv", "tsv", "json", "mrt":
+		return nil
+	}
+	return newError(ClassErr, "FORMAT must be csv, tsv, json or mrt")
+}
+
+// openImport opens path, transparently decompressing gzip files.
+func openImport(path string) (io.Reader, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := importReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return r, f.Close, nil
+}
+
+// importReader buffers r, decompressing it if it is gzipped or bzip2ed,
+// which is recognized by content rather than by name.
+func importReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, 1<<16)
+	magic, _ := br.Peek(3)
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		return gzip.NewReader(br)
+	case string(magic) == "BZh":
+		return bufio.NewReaderSize(bzip2.NewReader(br), 1<<16), nil
+	}
+	return br, nil
+}
+
+// importFile loads prefix,value lines from opts.path into d.
+func (d *database) importFile(opts importOptions) (importResult, error) {
+	r, closeFile, err := openImport(opts.path)
+	if err != nil {
+		return importResult{}, err
+	}
+	defer closeFile()
+	return d.importFrom(r, opts)
+}
+
+// importFrom loads prefix,value lines from r into d, one record per line,
+// or with the json format EXPORT's JSON lines, or with the mrt format an
+// MRT dump; see importMRT. Lines starting with # are comments. A CSV
+// value containing a comma must be quoted; a TSV value is everything
+// after the first tab.
+func (d *database) importFrom(r io.Reader, opts importOptions) (importResult, error) {
+	switch opts.format {
+	case "mrt":
+		return d.importMRT(r, opts)
+	case "json":
+		return d.importJSON(r, opts)
+	}
+	var res importResult
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	if opts.format == "tsv" {
+		cr.Comma = '\t'
+		cr.LazyQuotes = true
+	}
+	fail := func(line int, msg string) {
+		res.errors++
+		if len(res.firstErrors) < maxImportErrors {
+			res.firstErrors = append(res.firstErrors, fmt.Sprintf("line %d: %s", line, msg))
+		}
+	}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return res, nil
+		}
+		res.lines++
+		if res.lines%importBatch == 0 {
+			runtime.Gosched()
+		}
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			fail(perr.Line, perr.Err.Error())
+			continue
+		} else if err != nil {
+			return res, err
+		}
+		line, _ := cr.FieldPos(0)
+		if opts.format == "tsv" && len(rec) > 2 {
+			rec = append(rec[:1], strings.Join(rec[1:], "\t"))
+		}
+		if len(rec) != 2 {
+			fail(line, fmt.Sprintf("expected prefix and value, got %d fields", len(rec)))
+			continue
+		}
+		p, err := d.parseSetKey(rec[0])
+		if err != nil {
+			fail(line, err.Error())
+			continue
+		}
+		existed, err := d.storeChecked(p, stringValue([]byte(rec[1])), opts.conflict == conflictReplace)
+		if err != nil {
+			return res, err
+		}
+		switch {
+		case !existed:
+			res.inserted++
+		case opts.conflict == conflictReplace:
+			res.replaced++
+		case opts.conflict == conflictSkip:
+			res.skipped++
+		default:
+			return res, &importConflict{line: line, prefix: p.String()}
+		}
+	}
+}
+
+// maxJSONLine bounds one line of a JSON import, as a large hash or set
+// is written on one line.
+const maxJSONLine = 64 << 20
+
+// importJSON loads the JSON lines EXPORT writes, one object per line
+// with a prefix and a value, hash or set, into d. Blank lines and lines
+// starting with # are skipped.
+func (d *database) importJSON(r io.Reader, opts importOptions) (importResult, error) {
+	var res importResult
+	fail := func(line int, msg string) {
+		res.errors++
+		if len(res.firstErrors) < maxImportErrors {
+			res.firstErrors = append(res.firstErrors, fmt.Sprintf("line %d: %s", line, msg))
+		}
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), maxJSONLine)
+	for line := 1; sc.Scan(); line++ {
+		text := bytes.TrimSpace(sc.Bytes())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		res.lines++
+		if res.lines%importBatch == 0 {
+			runtime.Gosched()
+		}
+		var e gatewayEntry
+		if err := json.Unmarshal(text, &e); err != nil {
+			fail(line, err.Error())
+			continue
+		}
+		p, err := d.parseSetKey(e.Prefix)
+		if err != nil {
+			fail(line, err.Error())
+			continue
+		}
+		var v value
+		switch {
+		case e.Value != nil && e.Hash == nil && e.Set == nil:
+			v = stringValue([]byte(*e.Value))
+		case e.Value == nil && e.Hash != nil && e.Set == nil:
+			v.hash = make(map[string][]byte, len(e.Hash))
+			for f, fv := range e.Hash {
+				v.hash[f] = []byte(fv)
+			}
+		case e.Value == nil && e.Hash == nil && e.Set != nil:
+			v.set = make(map[string]struct{}, len(e.Set))
+			for _, m := range e.Set {
+				v.set[m] = struct{}{}
+			}
+		default:
+			fail(line, "expected exactly one of value, hash and set")
+			continue
+		}
+		existed, err := d.storeChecked(p, v, opts.conflict == conflictReplace)
+		if err != nil {
+			return res, err
+		}
+		switch {
+		case !existed:
+			res.inserted++
+		case opts.conflict == conflictReplace:
+			res.replaced++
+		case opts.conflict == conflictSkip:
+			res.skipped++
+		default:
+			return res, &importConflict{line: line, prefix: p.String()}
+		}
+	}
+	return res, sc.Err()
+}
+
+// handleImport implements IMPORT path [FORMAT csv|tsv|json|mrt] [DB index|name]
+// [REPLACE|SKIP|ABORT] [TEMPLATE template] [MULTIPATH shortest|all], the
+// last two for MRT dumps only. The path is read by the server, relative
+// to dir, and may not lead out of it. Prefixes already stored are replaced
+// by default. An MRT import also replies with the routes it read.
+func (s *TrieServer) handleImport(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'IMPORT'")
+		return
+	}
+	path, err := s.snapshots.inDir(string(cmd.Args[1]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	opts := importOptions{path: path}
+	opts.format = formatFor(opts.path)
+	id := currentDB(conn)
+	for i := 2; i < len(cmd.Args); i++ {
+		switch arg := strings.ToUpper(string(cmd.Args[i])); arg {
+		case "REPLACE":
+			opts.conflict = conflictReplace
+		case "SKIP":
+			opts.conflict = conflictSkip
+		case "ABORT":
+			opts.conflict = conflictAbort
+		case "FORMAT", "DB", "TEMPLATE", "MULTIPATH":
+			if i+1 == len(cmd.Args) {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			i++
+			val := string(cmd.Args[i])
+			switch arg {
+			case "DB":
+				n, err := s.resolveDB(val)
+				if err != nil {
+					writeError(conn, err)
+					return
+				}
+				id = n
+			case "FORMAT":
+				opts.format = strings.ToLower(val)
+				if err := validImportFormat(opts.format); err != nil {
+					writeError(conn, err)
+					return
+				}
+			case "TEMPLATE":
+				if _, err := parseMRTTemplate(val); err != nil {
+					writeError(conn, err)
+					return
+				}
+				opts.template = val
+			case "MULTIPATH":
+				if opts.multipath = strings.ToLower(val); opts.multipath != "shortest" && opts.multipath != "all" {
+					conn.WriteError("ERR MULTIPATH must be shortest or all")
+					return
+				}
+			}
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	if opts.format != "mrt" && (opts.template != "" || opts.multipath != "") {
+		conn.WriteError("ERR TEMPLATE and MULTIPATH are only for FORMAT mrt")
+		return
+	}
+
+	if err := s.writable(id); err != nil {
+		writeError(conn, err)
+		return
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs // a rerun at startup may not share this working directory
+	}
+	jid, err := s.journal.begin("IMPORT", id, journalParams("path", path, "format", opts.format,
+		"conflict", conflictNames[opts.conflict], "template", opts.template, "multipath", opts.multipath))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	db := s.getDB(id)
+	res, err := db.importFile(opts)
+	s.journal.end(jid)
+	if changed := res.inserted + res.replaced; changed > 0 {
+		db.writes.add(uint64(c.id), 1)
+		s.auditDB(c, id, "IMPORT")
+	}
+	var conflict *importConflict
+	var quota *quotaError
+	switch {
+	case errors.As(err, &conflict):
+		conn.WriteError(fmt.Sprintf("ERR import aborted at %s (%d inserted before it)", conflict, res.inserted))
+		return
+	case errors.As(err, &quota):
+		conn.WriteError(fmt.Sprintf("%s (%d inserted before it)", quota, res.inserted))
+		return
+	case err != nil:
+		writeError(conn, err)
+		return
+	}
+	if opts.format == "mrt" {
+		writeImportResult(conn, res, memField{"routes", int64(res.routes)})
+		return
+	}
+	writeImportResult(conn, res)
+}
+
+// writeImportResult replies with the tally of an IMPORT, followed by any
+// extra counts.
+func writeImportResult(conn redcon.Conn, res importResult, extra ...memField) {
+	conn.WriteArray(12 + 2*len(extra))
+	for _, f := range []struct {
+		name  string
+		value int
+	}{{"lines", res.lines}, {"inserted", res.inserted}, {"replaced", res.replaced},
+		{"skipped", res.skipped}, {"errors", res.errors}} {
+		conn.WriteBulkString(f.name)
+		conn.WriteInt(f.value)
+	}
+	conn.WriteBulkString("first-errors")
+	conn.WriteArray(len(res.firstErrors))
+	for _, e := range res.firstErrors {
+		conn.WriteBulkString(e)
+	}
+	for _, f := range extra {
+		conn.WriteBulkString(f.name)
+		conn.WriteInt64(f.value.(int64))
+	}
+}
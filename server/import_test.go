@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// importFields returns the counts of an IMPORT reply by name and its
+// quoted errors.
+func importFields(t testing.TB, r Reply) (map[string]int64, []string) {
+	t.Helper()
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int64)
+	var quoted []string
+	for i := 0; i+1 < len(r.Array); i += 2 {
+		if r.Array[i].Str == "first-errors" {
+			quoted = r.Array[i+1].strs()
+			continue
+		}
+		counts[r.Array[i].Str] = r.Array[i+1].Int
+	}
+	return counts, quoted
+}
+
+func TestImport(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("10.0.0.0/8,zipped\n"))
+	zw.Close()
+	files := map[string]string{
+		"routes.csv":           "# comment\n10.0.0.0/8,a\n192.168.0.0/16,\"b,c\"\n2001:db8::/32,d\n",
+		"routes.tsv":           "10.0.0.0/8\tx\ty\n",
+		"routes.txt":           "10.0.0.0/8\tnot csv\n",
+		"bad.csv":              "10.0.0.0/8,a\nnot-a-prefix,b\n1.2.3.0/24\n10.0.0.0/33,c\n",
+		"compressed":           gz.String(),
+		"more.csv":             "10.0.0.0/8,new\n172.16.0.0/12,e\n",
+		"sub/nested.csv":       "198.51.100.0/24,f\n",
+		"sub/../flattened.csv": "203.0.113.0/24,g\n",
+		"export.jsonl": `{"prefix":"10.0.0.0/8","value":"j"}` + "\n\n# comment\n" +
+			`{"prefix":"192.0.2.0/24","hash":{"asn":"64500"}}` + "\n" + `{"prefix":"2001:db8::/32","set":["tor"]}` + "\n",
+		"bad.json": `{"prefix":"10.0.0.0/8"}` + "\n" + `{"prefix":"10.0.0.0/8","value":"a","set":["b"]}` + "\n" +
+			`{"prefix":"nope","value":"a"}` + "\n" + "not json\n" + `{"prefix":"172.16.0.0/12","value":"ok"}` + "\n",
+	}
+	if err := os.Mkdir("sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		args   []string // after IMPORT
+		want   string   // lines/inserted/replaced/skipped/errors
+		quoted int
+		get    map[string]string // GETs afterwards
+	}{
+		{
+			name: "csv",
+			args: []string{"routes.csv"},
+			want: "3/2/1/0/0",
+			get:  map[string]string{"10.1.2.3": "a", "192.168.1.1": "b,c", "2001:db8::1": "d"},
+		},
+		{
+			name: "tsv keeps tabs in values",
+			args: []string{"routes.tsv"},
+			want: "1/0/1/0/0",
+			get:  map[string]string{"10.1.2.3": "x\ty"},
+		},
+		{
+			name: "format overrides the extension",
+			args: []string{"routes.txt", "FORMAT", "TSV"},
+			want: "1/0/1/0/0",
+			get:  map[string]string{"10.1.2.3": "not csv"},
+		},
+		{
+			name:   "bad lines are counted and quoted",
+			args:   []string{"bad.csv"},
+			want:   "4/0/1/0/3",
+			quoted: 3,
+			get:    map[string]string{"10.1.2.3": "a"},
+		},
+		{
+			name: "gzip is detected by content",
+			args: []string{"compressed"},
+			want: "1/0/1/0/0",
+			get:  map[string]string{"10.1.2.3": "zipped"},
+		},
+		{
+			name: "replace",
+			args: []string{"more.csv", "REPLACE"},
+			want: "2/1/1/0/0",
+			get:  map[string]string{"10.1.2.3": "new", "172.16.1.1": "e"},
+		},
+		{
+			name: "skip",
+			args: []string{"more.csv", "SKIP"},
+			want: "2/1/0/1/0",
+			get:  map[string]string{"10.1.2.3": "a", "172.16.1.1": "e"},
+		},
+		{
+			name: "into a database by name",
+			args: []string{"sub/nested.csv", "DB", "geo"},
+			want: "1/1/0/0/0",
+		},
+		{
+			name: "a local path may use .. inside the directory",
+			args: []string{"sub/../flattened.csv"},
+			want: "1/1/0/0/0",
+			get:  map[string]string{"203.0.113.1": "g"},
+		},
+		{
+			name: "json lines as EXPORT writes them",
+			args: []string{"export.jsonl"},
+			want: "3/2/1/0/0",
+			get:  map[string]string{"10.1.2.3": "j"},
+		},
+		{
+			name:   "bad json lines",
+			args:   []string{"bad.json", "FORMAT", "JSON"},
+			want:   "5/1/0/0/4",
+			quoted: 4,
+			get:    map[string]string{"10.1.2.3": "a", "172.16.1.1": "ok"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := newTestSession(t, newTestServer(t))
+			mustDo(t, ss, "NAMEDB", "2", "geo")
+			mustDo(t, ss, "SET", "10.0.0.0/8", "a") // replaced by default
+			counts, quoted := importFields(t, ss.Do(append([]string{"IMPORT"}, tc.args...)...))
+			var got []string
+			for _, name := range []string{"lines", "inserted", "replaced", "skipped", "errors"} {
+				got = append(got, strconv.FormatInt(counts[name], 10))
+			}
+			if strings.Join(got, "/") != tc.want {
+				t.Errorf("IMPORT %q counts %s, want %s", tc.args, strings.Join(got, "/"), tc.want)
+			}
+			if len(quoted) != tc.quoted {
+				t.Errorf("quoted errors %q, want %d", quoted, tc.quoted)
+			}
+			for addr, want := range tc.get {
+				if r := mustDo(t, ss, "GET", addr); r.Str != want {
+					t.Errorf("GET %s = %q, want %q", addr, r.Str, want)
+				}
+			}
+		})
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile("routes.csv", []byte("10.0.0.0/8,b\n192.0.2.0/24,c\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "outside.csv")
+	if err := os.WriteFile(outside, []byte("192.0.2.0/24,b\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(dir, outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := newTestSession(t, newTestServer(t))
+	mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+	for _, tc := range []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"IMPORT"}, "ERR wrong number of arguments"},
+		{[]string{"IMPORT", outside}, "ERR path must be relative"},
+		{[]string{"IMPORT", rel}, "ERR path must be relative"},
+		{[]string{"IMPORT", "../outside.csv"}, "ERR path must be relative"},
+		{[]string{"IMPORT", ""}, "ERR path must be relative"},
+		{[]string{"IMPORT", "missing.csv"}, "ERR open missing.csv"},
+		{[]string{"IMPORT", "routes.csv", "FORMAT"}, "ERR syntax error"},
+		{[]string{"IMPORT", "routes.csv", "FORMAT", "xml"}, "ERR FORMAT must be csv, tsv, json or mrt"},
+		{[]string{"IMPORT", "routes.csv", "DB", "nosuch"}, "ERR unknown database name"},
+		{[]string{"IMPORT", "routes.csv", "MERGE"}, "ERR syntax error"},
+		{[]string{"IMPORT", "routes.csv", "ABORT"}, "ERR import aborted at line 1: 10.0.0.0/8 is already stored (0 inserted before it)"},
+	} {
+		if err := ss.Do(tc.args...).Err(); err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+			t.Errorf("%q = %v, want %q", tc.args, err, tc.wantErr)
+		}
+	}
+	if got := mustDo(t, ss, "KEYS", "*").strs(); !slices.Equal(got, []string{"10.0.0.0/8"}) {
+		t.Errorf("KEYS after the failed imports = %q, want only 10.0.0.0/8", got)
+	}
+}
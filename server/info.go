@@ -0,0 +1,247 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// infoSection is one "# Name" block of the INFO reply.
+type infoSection struct {
+	name   string
+	render func(s *TrieServer, b *strings.Builder)
+	extra  bool // left out of INFO and INFO DEFAULT, as in Redis
+}
+
+// infoSections are emitted in this order by INFO and INFO ALL.
+var infoSections = []infoSection{
+	{"Server", (*TrieServer).infoServer, false},
+	{"Clients", (*TrieServer).infoClients, false},
+	{"Memory", (*TrieServer).infoMemory, false},
+	{"Persistence", (*TrieServer).infoPersistence, false},
+	{"Stats", (*TrieServer).infoStats, false},
+	{"Commandstats", (*TrieServer).infoCommandstats, true},
+	{"Latencystats", (*TrieServer).infoLatencystats, true},
+	{"Keyspace", (*TrieServer).infoKeyspace, false},
+}
+
+// handleInfo implements INFO [section].
+func (s *TrieServer) handleInfo(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) > 2 {
+		conn.WriteError("ERR wrong number of arguments for 'INFO'")
+		return
+	}
+	want := "default"
+	if len(cmd.Args) == 2 {
+		want = strings.ToLower(string(cmd.Args[1]))
+	}
+
+	var b strings.Builder
+	for _, sec := range infoSections {
+		switch want {
+		case "all", "everything":
+		case "default":
+			if sec.extra {
+				continue
+			}
+		default:
+			if want != strings.ToLower(sec.name) {
+				continue
+			}
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + sec.name + "\r\n")
+		sec.render(s, &b)
+	}
+	conn.WriteBulkString(b.String())
+}
+
+func (s *TrieServer) infoServer(b *strings.Builder) {
+	fmt.Fprintf(b, "triedis_version:%s\r\n", version)
+	fmt.Fprintf(b, "git_sha:%s\r\n", buildSHA())
+	fmt.Fprintf(b, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(b, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(b, "arch_bits:%d\r\n", strconv.IntSize)
+	fmt.Fprintf(b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(b, "run_id:%s\r\n", s.runID)
+	fmt.Fprintf(b, "tcp_port:%d\r\n", s.tcpPort())
+	uptime := time.Since(s.started)
+	fmt.Fprintf(b, "uptime_in_seconds:%d\r\n", int64(uptime.Seconds()))
+	fmt.Fprintf(b, "uptime_in_days:%d\r\n", int64(uptime.Hours()/24))
+	fmt.Fprintf(b, "config_file:%s\r\n", s.configFile)
+	readOnly := 0
+	if s.readOnly.Load() {
+		readOnly = 1
+	}
+	fmt.Fprintf(b, "read_only:%d\r\n", readOnly)
+	fmt.Fprintf(b, "listen_addrs:%s\r\n", s.listenAddrs(false))
+	fmt.Fprintf(b, "tls_listen_addrs:%s\r\n", s.listenAddrs(true))
+	s.preloadState.info(b)
+}
+
+// infoClients reports the connection registry. No command blocks yet, so
+// blocked_clients is always 0.
+func (s *TrieServer) infoClients(b *strings.Builder) {
+	now := time.Now()
+	fmt.Fprintf(b, "connected_clients:%d\r\n", s.clients.count())
+	fmt.Fprintf(b, "maxclients:%d\r\n", s.maxClients.Load())
+	fmt.Fprintf(b, "client_recent_max_input_buffer:%d\r\n", s.inputPeak.value(now))
+	fmt.Fprintf(b, "client_recent_max_output_buffer:%d\r\n", s.outputPeak.value(now))
+	fmt.Fprintf(b, "blocked_clients:0\r\n")
+	fmt.Fprintf(b, "throttled_clients:%d\r\n", s.rateLimit.throttled.Load())
+}
+
+// infoMemory reports the Go heap alongside the dataset estimate each
+// database maintains on write, so polling it never walks a trie.
+func (s *TrieServer) infoMemory(b *strings.Builder) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var keys, dataset int64
+	for _, db := range s.databases() {
+		keys += db.keyCount()
+		dataset += db.datasetBytes()
+	}
+	used := int64(ms.HeapAlloc)
+	fmt.Fprintf(b, "used_memory:%d\r\n", used)
+	fmt.Fprintf(b, "used_memory_human:%s\r\n", humanBytes(used))
+	s.observeMemory(used)
+	peak := s.stats.peakMemory.Load()
+	fmt.Fprintf(b, "used_memory_peak:%d\r\n", peak)
+	fmt.Fprintf(b, "used_memory_peak_human:%s\r\n", humanBytes(peak))
+	fmt.Fprintf(b, "used_memory_sys:%d\r\n", ms.Sys)
+	fmt.Fprintf(b, "used_memory_sys_human:%s\r\n", humanBytes(int64(ms.Sys)))
+	fmt.Fprintf(b, "used_memory_overhead:%d\r\n", max(used-dataset, 0))
+	fmt.Fprintf(b, "used_memory_dataset:%d\r\n", dataset)
+	fmt.Fprintf(b, "used_memory_dataset_human:%s\r\n", humanBytes(dataset))
+	perc := 0.0
+	if used > 0 {
+		perc = float64(dataset) * 100 / float64(used)
+	}
+	fmt.Fprintf(b, "used_memory_dataset_perc:%.2f%%\r\n", perc)
+	fmt.Fprintf(b, "dataset_keys:%d\r\n", keys)
+	fmt.Fprintf(b, "dataset_key_overhead:%d\r\n", keys*entryOverhead)
+	fmt.Fprintf(b, "heap_objects:%d\r\n", ms.HeapObjects)
+	fmt.Fprintf(b, "gc_cycles:%d\r\n", ms.NumGC)
+	s.infoEviction(b)
+	fmt.Fprintf(b, "lazyfree_pending_objects:%d\r\n", s.lazyFree.pending.Load())
+	fmt.Fprintf(b, "lazyfreed_objects:%d\r\n", s.lazyFree.freed.Load())
+}
+
+// humanBytes formats n the way Redis's *_human fields do.
+func humanBytes(n int64) string {
+	f := float64(n)
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%dB", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.2fK", f/(1<<10))
+	case n < 1<<30:
+		return fmt.Sprintf("%.2fM", f/(1<<20))
+	case n < 1<<40:
+		return fmt.Sprintf("%.2fG", f/(1<<30))
+	}
+	return fmt.Sprintf("%.2fT", f/(1<<40))
+}
+
+func (s *TrieServer) infoStats(b *strings.Builder) {
+	st := &s.stats
+	fmt.Fprintf(b, "total_connections_received:%d\r\n", st.connections.Load())
+	fmt.Fprintf(b, "total_commands_processed:%d\r\n", s.cmdStats.totalCalls())
+	fmt.Fprintf(b, "instantaneous_ops_per_sec:%d\r\n", int64(st.opsPerSec.perSecond()))
+	fmt.Fprintf(b, "total_net_input_bytes:%d\r\n", st.netInput.load())
+	fmt.Fprintf(b, "total_net_output_bytes:%d\r\n", st.netOutput.load())
+	fmt.Fprintf(b, "instantaneous_input_kbps:%.2f\r\n", st.inputPerSec.perSecond()/1024)
+	fmt.Fprintf(b, "instantaneous_output_kbps:%.2f\r\n", st.outputPerSec.perSecond()/1024)
+	fmt.Fprintf(b, "rejected_connections:%d\r\n", st.rejectedConns.Load())
+	fmt.Fprintf(b, "rejected_connections_per_ip:%d\r\n", st.rejectedPerIP.Load())
+	fmt.Fprintf(b, "expired_keys:%d\r\n", st.expiredKeys.Load())
+	fmt.Fprintf(b, "evicted_keys:%d\r\n", st.evictedKeys.Load())
+	fmt.Fprintf(b, "client_output_buffer_limit_disconnections:%d\r\n", st.outputClosed.Load())
+	fmt.Fprintf(b, "aborted_commands:%d\r\n", st.abortedCmds.Load())
+	var hits, misses, cacheHits, cacheMisses int64
+	for _, db := range s.databases() {
+		hits += db.hits.load()
+		misses += db.misses.load()
+		cacheHits += db.lpm.hits.Load()
+		cacheMisses += db.lpm.misses.Load()
+	}
+	fmt.Fprintf(b, "keyspace_hits:%d\r\n", hits)
+	fmt.Fprintf(b, "keyspace_misses:%d\r\n", misses)
+	fmt.Fprintf(b, "lpm_cache_hits:%d\r\n", cacheHits)
+	fmt.Fprintf(b, "lpm_cache_misses:%d\r\n", cacheMisses)
+	fmt.Fprintf(b, "idle_timeout_disconnections:%d\r\n", s.idleClosed.Load())
+	fmt.Fprintf(b, "audit_log_dropped:%d\r\n", s.auditLog.dropped.Load())
+	fmt.Fprintf(b, "otel_spans_exported:%d\r\n", s.tracing.exported.Load())
+	fmt.Fprintf(b, "otel_spans_dropped:%d\r\n", s.tracing.dropped.Load())
+	fmt.Fprintf(b, "webhook_events_delivered:%d\r\n", s.webhooks.delivered.Load())
+	fmt.Fprintf(b, "webhook_events_dropped:%d\r\n", s.webhooks.dropped.Load())
+	fmt.Fprintf(b, "webhook_events_pending:%d\r\n", s.webhooks.pending.Load())
+}
+
+// infoCommandstats reads the same per-command counters as the Prometheus
+// histogram, for every command called since start or CONFIG RESETSTAT.
+func (s *TrieServer) infoCommandstats(b *strings.Builder) {
+	for _, name := range s.cmdStats.names() {
+		st := s.cmdStats[name]
+		calls, rejected := st.calls.Load(), st.rejected.Load()
+		if calls == 0 && rejected == 0 {
+			continue
+		}
+		usec := st.nanos.Load() / 1e3
+		perCall := 0.0
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		fmt.Fprintf(b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d\r\n",
+			strings.ToLower(name), calls, usec, perCall, rejected)
+	}
+}
+
+// infoLatencystats reports latencyPercentiles of every command called
+// since start or CONFIG RESETSTAT, in Redis's format.
+func (s *TrieServer) infoLatencystats(b *strings.Builder) {
+	for _, name := range s.cmdStats.names() {
+		ds, ok := s.cmdStats[name].latency.percentiles(latencyPercentiles[:])
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(b, "latency_percentiles_usec_%s:", strings.ToLower(name))
+		for i, p := range latencyPercentiles {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "p%s=%.3f", strconv.FormatFloat(p, 'f', -1, 64), float64(ds[i])/1e3)
+		}
+		b.WriteString("\r\n")
+	}
+}
+
+// infoKeyspace ends each line with name= for named databases, so parsers
+// expecting Redis's leading fields keep working.
+func (s *TrieServer) infoKeyspace(b *strings.Builder) {
+	for _, db := range s.databases() {
+		fmt.Fprintf(b, "db%d:keys=%d,expires=%d,avg_ttl=%d,hits=%d,misses=%d,keys4=%d,keys6=%d",
+			db.id, db.keyCount(), db.expiries.len(), db.expiries.avgTTL(nowMillis()),
+			db.hits.load(), db.misses.load(), db.keys4.Load(), db.keys6.Load())
+		if n := db.graves.len(); n > 0 {
+			fmt.Fprintf(b, ",tombstones=%d", n)
+		}
+		if n := s.store.maxKeys.get(db.id); n > 0 {
+			fmt.Fprintf(b, ",max_keys=%d", n)
+		}
+		if n := s.store.maxBytes.get(db.id); n > 0 {
+			fmt.Fprintf(b, ",value_bytes=%d,max_bytes=%d", db.valueBytes(), n)
+		}
+		if name := s.names.name(db.id); name != "" {
+			b.WriteString(",name=" + name)
+		}
+		b.WriteString("\r\n")
+	}
+}
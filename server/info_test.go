@@ -0,0 +1,199 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// keyspaceField returns field of db's INFO keyspace line.
+func keyspaceField(t *testing.T, ss *testSession, db int, field string) string {
+	t.Helper()
+	info := mustDo(t, ss, "INFO", "keyspace").Str
+	for _, line := range strings.Split(info, "\r\n") {
+		rest, ok := strings.CutPrefix(line, "db"+strconv.Itoa(db)+":")
+		if !ok {
+			continue
+		}
+		for _, kv := range strings.Split(rest, ",") {
+			if k, v, _ := strings.Cut(kv, "="); k == field {
+				return v
+			}
+		}
+	}
+	t.Fatalf("INFO keyspace has no %s for db%d:\n%s", field, db, info)
+	return ""
+}
+
+// infoFields returns the fields of an INFO reply by name.
+func infoFields(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+func TestInfoServer(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveTest(t, s)
+	_, port, _ := strings.Cut(addr, ":")
+	fields := infoFields(mustDo(t, newTestSession(t, s), "INFO", "server").Str)
+	for _, tc := range []struct {
+		field string
+		want  string // a regular expression the whole value must match
+	}{
+		{"triedis_version", regexp.QuoteMeta(version)},
+		{"go_version", regexp.QuoteMeta(runtime.Version())},
+		{"os", regexp.QuoteMeta(runtime.GOOS + " " + runtime.GOARCH)},
+		{"arch_bits", strconv.Itoa(strconv.IntSize)},
+		{"process_id", strconv.Itoa(os.Getpid())},
+		{"run_id", "[0-9a-f]{40}"},
+		{"tcp_port", port},
+		{"uptime_in_seconds", "[0-9]+"},
+		{"uptime_in_days", "0"},
+		{"config_file", ""},
+		{"listen_addrs", regexp.QuoteMeta(addr)},
+	} {
+		v, ok := fields[tc.field]
+		if !ok {
+			t.Errorf("INFO server lacks %s", tc.field)
+		} else if !regexp.MustCompile("^" + tc.want + "$").MatchString(v) {
+			t.Errorf("%s:%s, want %s", tc.field, v, tc.want)
+		}
+	}
+	if other := newTestServer(t); other.runID == s.runID {
+		t.Error("two servers share a run_id")
+	}
+}
+
+func TestBuildSHA(t *testing.T) {
+	defer func(sha string) { gitSHA = sha }(gitSHA)
+	gitSHA = "0123abcd"
+	if got := buildSHA(); got != "0123abcd" {
+		t.Errorf("buildSHA() = %q, want the -ldflags value", got)
+	}
+}
+
+func TestInfoCommandstats(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	calls := regexp.MustCompile(`^calls=(\d+),usec=\d+,usec_per_call=[\d.]+,rejected_calls=(\d+)$`)
+	for _, tc := range []struct {
+		name string
+		run  [][]string
+		want map[string][2]string // calls and rejected_calls by field
+	}{
+		{
+			name: "calls",
+			run:  [][]string{{"SET", "10.0.0.0/8", "a"}, {"SET", "10.0.0.0/16", "b"}, {"GET", "10.0.0.1"}},
+			want: map[string][2]string{"cmdstat_set": {"2", "0"}, "cmdstat_get": {"1", "0"}},
+		},
+		{
+			name: "reset",
+			// A command is counted once it returns, so RESETSTAT
+			// counts itself and not the INFO before it.
+			run:  [][]string{{"CONFIG", "RESETSTAT"}},
+			want: map[string][2]string{"cmdstat_config": {"1", "0"}},
+		},
+		{
+			// Without a certificate the session is readonly once
+			// identities exist.
+			name: "rejected",
+			run:  [][]string{{"CONFIG", "SET", "tls-identity-map", "loader=readwrite"}, {"SET", "10.0.0.0/24", "c"}},
+			want: map[string][2]string{"cmdstat_config": {"2", "0"}, "cmdstat_info": {"1", "0"}, "cmdstat_set": {"0", "1"}},
+		},
+	} {
+		for _, args := range tc.run {
+			ss.Do(args...)
+		}
+		got := infoFields(mustDo(t, ss, "INFO", "commandstats").Str)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: INFO commandstats = %v, want %d commands", tc.name, got, len(tc.want))
+		}
+		for field, want := range tc.want {
+			m := calls.FindStringSubmatch(got[field])
+			if m == nil || m[1] != want[0] || m[2] != want[1] {
+				t.Errorf("%s: %s:%s, want calls=%s and rejected_calls=%s", tc.name, field, got[field], want[0], want[1])
+			}
+		}
+	}
+}
+
+// TestKeyCounters checks the counters DBSIZE and INFO keyspace read
+// against a full listing through a random workload that overwrites
+// prefixes and deletes ones that are not stored.
+func TestKeyCounters(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	r := rand.New(rand.NewPCG(3, 4))
+	pool := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	for range 100 {
+		pool = append(pool, randomPrefix(r, 4, 0), randomPrefix(r, 16, 0))
+	}
+	check := func(step int) {
+		t.Helper()
+		keys := mustDo(t, ss, "KEYS", "*").strs()
+		var v4 int
+		for _, k := range keys {
+			if netip.MustParsePrefix(k).Addr().Is4() {
+				v4++
+			}
+		}
+		if n := mustDo(t, ss, "DBSIZE").Int; n != int64(len(keys)) {
+			t.Fatalf("step %d: DBSIZE = %d, KEYS * lists %d", step, n, len(keys))
+		}
+		for field, want := range map[string]int{"keys": len(keys), "keys4": v4, "keys6": len(keys) - v4} {
+			if got := keyspaceField(t, ss, 0, field); got != strconv.Itoa(want) {
+				t.Fatalf("step %d: INFO keyspace %s = %s, want %d", step, field, got, want)
+			}
+		}
+	}
+	mustDo(t, ss, "SET", "10.0.0.0/8", "v")
+	for step := range 2000 {
+		k := pool[r.IntN(len(pool))].String()
+		switch op := r.IntN(20); {
+		case op < 10:
+			mustDo(t, ss, "SET", k, strconv.Itoa(step))
+		case op < 19:
+			mustDo(t, ss, "DEL", k, pool[r.IntN(len(pool))].String(), "192.0.2.0/24")
+		default:
+			if r.IntN(10) == 0 {
+				mustDo(t, ss, "FLUSHDB")
+			}
+		}
+		if step%50 == 0 {
+			check(step)
+		}
+	}
+	check(2000)
+	if n := mustDo(t, ss, "DBSIZE").Int; n == 0 {
+		t.Fatal("the workload left nothing stored to flush")
+	}
+	mustDo(t, ss, "FLUSHDB")
+	check(2001)
+}
+
+func TestInfoAvgTTL(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, tc := range []struct {
+		set      []string // SET arguments
+		min, max int64    // avg_ttl afterwards, in milliseconds
+	}{
+		{[]string{"10.0.0.0/8", "a"}, 0, 0},
+		{[]string{"10.1.0.0/16", "b", "EX", "100"}, 99000, 100000},
+		{[]string{"10.2.0.0/16", "c", "EX", "200"}, 149000, 150000},
+		{[]string{"10.1.0.0/16", "b"}, 199000, 200000}, // a plain SET drops the TTL
+	} {
+		mustDo(t, ss, append([]string{"SET"}, tc.set...)...)
+		avg, err := strconv.ParseInt(keyspaceField(t, ss, 0, "avg_ttl"), 10, 64)
+		if err != nil || avg < tc.min || avg > tc.max {
+			t.Errorf("after SET %q: avg_ttl = %d, %v; want %d to %d", tc.set, avg, err, tc.min, tc.max)
+		}
+	}
+}
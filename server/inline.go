@@ -0,0 +1,313 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// Inline commands, a line of space-separated arguments as typed into nc
+// or telnet, are turned into RESP arrays before redcon reads them. Its
+// own inline parser splits on spaces only and knows fewer escapes than
+// Redis's, and it buffers a line without a newline however long it
+// grows. inlineConn splits lines the way Redis's sdssplitargs does,
+// caps them at Redis's 64KB and passes RESP through untouched.
+
+// maxInlineLen is the longest inline command accepted, Redis's
+// PROTO_INLINE_MAX_SIZE.
+const maxInlineLen = 64 << 10
+
+var (
+	errUnbalancedQuotes = errors.New("unbalanced quotes in request")
+	errInlineTooBig     = errors.New("too big inline request")
+)
+
+// inlineListener wraps accepted connections in inlineConns.
+type inlineListener struct {
+	net.Listener
+}
+
+func (l inlineListener) Accept() (net.Conn, error) {
+	nc, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &inlineConn{Conn: nc}, nil
+}
+
+// unwrapInline returns the connection under nc if it is an inlineConn.
+func unwrapInline(nc net.Conn) net.Conn {
+	if ic, ok := nc.(*inlineConn); ok {
+		return ic.Conn
+	}
+	return nc
+}
+
+// Where inlineConn is in the byte stream.
+const (
+	frameStart   = iota // at the start of a command
+	frameInline         // in an inline command
+	frameArray          // in a *count header
+	frameBulk           // at a $length header
+	frameBulkLen        // in a $length header
+	frameBody           // in a bulk string and its CRLF
+	frameRaw            // past a malformed RESP command, passing bytes as they are
+)
+
+// inlineConn rewrites inline commands on a client connection as RESP.
+// It reads ahead into buf, tracking just enough of each RESP command to
+// know where the next one starts, and hands redcon the result from out.
+// A malformed inline command is answered with a protocol error, once the
+// commands before it have been served, and ends the connection, as in
+// Redis.
+type inlineConn struct {
+	net.Conn
+	buf  []byte
+	out  []byte
+	off  int    // bytes of out already read
+	line []byte // the inline command read so far
+
+	state int
+	num   int64 // the header being read
+	neg   bool
+	bulks int64 // bulk strings left in the command
+	left  int64 // bytes left in the bulk string, CRLF included
+
+	err  error // from the last Read of Conn, returned once out drains
+	perr error // protocol error to answer with once out drains
+}
+
+func (c *inlineConn) Read(p []byte) (int, error) {
+	for c.off == len(c.out) {
+		c.out, c.off = c.out[:0], 0
+		if c.perr != nil {
+			c.Conn.Write([]byte("-ERR Protocol error: " + c.perr.Error() + "\r\n"))
+			return 0, c.perr
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.buf == nil {
+			c.buf = make([]byte, 16<<10)
+		}
+		n, err := c.Conn.Read(c.buf)
+		c.err = err
+		c.frame(c.buf[:n])
+	}
+	n := copy(p, c.out[c.off:])
+	c.off += n
+	return n, nil
+}
+
+// frame appends b to out, rewriting any inline commands in it.
+func (c *inlineConn) frame(b []byte) {
+	for i := 0; i < len(b) && c.perr == nil; i++ {
+		switch ch := b[i]; c.state {
+		case frameStart:
+			if ch == '*' {
+				c.out = append(c.out, ch)
+				c.state, c.num, c.neg = frameArray, 0, false
+			} else {
+				c.state = frameInline
+				i-- // the byte starts the line
+			}
+		case frameInline:
+			if ch != '\n' {
+				if c.line = append(c.line, ch); len(c.line) > maxInlineLen {
+					c.perr = errInlineTooBig
+				}
+				continue
+			}
+			args, err := splitArgs(c.line)
+			if err != nil {
+				c.perr = err
+				continue
+			}
+			if len(args) > 0 {
+				c.out = appendCommand(c.out, args)
+			}
+			c.line, c.state = c.line[:0], frameStart
+		case frameBulk:
+			c.out = append(c.out, ch)
+			if ch != '$' {
+				c.state = frameRaw
+				continue
+			}
+			c.state, c.num, c.neg = frameBulkLen, 0, false
+		case frameArray, frameBulkLen:
+			c.out = append(c.out, ch)
+			if !c.header(ch) {
+				c.state = frameRaw
+				continue
+			}
+			if ch != '\n' {
+				continue
+			}
+			if c.state == frameArray {
+				if c.bulks = c.num; c.bulks > 0 {
+					c.state = frameBulk
+				} else {
+					c.state = frameStart
+				}
+			} else if c.num < 0 {
+				c.state = frameRaw // redcon rejects negative lengths
+			} else {
+				c.state, c.left = frameBody, c.num+2
+			}
+		case frameBody:
+			n := min(c.left, int64(len(b)-i))
+			c.out = append(c.out, b[i:i+int(n)]...)
+			i += int(n) - 1
+			if c.left -= n; c.left == 0 {
+				if c.bulks--; c.bulks > 0 {
+					c.state = frameBulk
+				} else {
+					c.state = frameStart
+				}
+			}
+		case frameRaw:
+			c.out = append(c.out, b[i:]...)
+			return
+		}
+	}
+}
+
+// header reads one byte of a *count or $length line into num, reporting
+// false for one that cannot be part of it.
+func (c *inlineConn) header(ch byte) bool {
+	switch {
+	case ch >= '0' && ch <= '9':
+		c.num = c.num*10 + int64(ch-'0')
+		if c.num > 1<<40 {
+			return false
+		}
+	case ch == '-' && c.num == 0 && !c.neg:
+		c.neg = true
+	case ch == '\r':
+	case ch == '\n':
+		if c.neg {
+			c.num = -c.num
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// appendCommand appends args to b as a RESP array.
+func appendCommand(b []byte, args [][]byte) []byte {
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, '\r', '\n')
+	for _, arg := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(arg)), 10)
+		b = append(b, '\r', '\n')
+		b = append(b, arg...)
+		b = append(b, '\r', '\n')
+	}
+	return b
+}
+
+// splitArgs splits an inline command as Redis's sdssplitargs does.
+// Arguments are separated by whitespace and may be quoted: in double
+// quotes \n, \r, \t, \b, \a and \xHH are escapes and a backslash takes
+// the next byte literally; in single quotes only \' is an escape. A
+// closing quote must be followed by whitespace or the end of the line.
+func splitArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		arg := []byte{}
+		inDouble, inSingle := false, false
+		for done := false; !done; i++ {
+			if i == len(line) {
+				if inDouble || inSingle {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
+			ch := line[i]
+			switch {
+			case inDouble:
+				switch {
+				case ch == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					arg = append(arg, hexVal(line[i+2])<<4|hexVal(line[i+3]))
+					i += 3
+				case ch == '\\' && i+1 < len(line):
+					i++
+					switch ch = line[i]; ch {
+					case 'n':
+						ch = '\n'
+					case 'r':
+						ch = '\r'
+					case 't':
+						ch = '\t'
+					case 'b':
+						ch = '\b'
+					case 'a':
+						ch = '\a'
+					}
+					arg = append(arg, ch)
+				case ch == '"':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					arg = append(arg, ch)
+				}
+			case inSingle:
+				switch {
+				case ch == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					arg = append(arg, '\'')
+					i++
+				case ch == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					arg = append(arg, ch)
+				}
+			case isSpace(ch):
+				done = true
+			case ch == '"':
+				inDouble = true
+			case ch == '\'':
+				inSingle = true
+			default:
+				arg = append(arg, ch)
+			}
+		}
+		args = append(args, arg)
+	}
+}
+
+func isSpace(ch byte) bool {
+	switch ch {
+	case ' ', '\t', '\n', '\r', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+func isHex(ch byte) bool {
+	return ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'f' || ch >= 'A' && ch <= 'F'
+}
+
+func hexVal(ch byte) byte {
+	switch {
+	case ch >= 'a':
+		return ch - 'a' + 10
+	case ch >= 'A':
+		return ch - 'A' + 10
+	}
+	return ch - '0'
+}
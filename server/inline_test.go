@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for _, tc := range []struct {
+		line    string
+		want    []string
+		wantErr error
+	}{
+		{line: "", want: nil},
+		{line: "  \t ", want: nil},
+		{line: "GET 10.0.0.0/8", want: []string{"GET", "10.0.0.0/8"}},
+		{line: "  SET\t10.0.0.0/8 \v a\r", want: []string{"SET", "10.0.0.0/8", "a"}},
+		{line: `SET k "two words"`, want: []string{"SET", "k", "two words"}},
+		{line: `SET k ""`, want: []string{"SET", "k", ""}},
+		{line: `SET k "a\nb\r\t\b\a"`, want: []string{"SET", "k", "a\nb\r\t\b\a"}},
+		{line: `SET k "\x41\x7a\xZZ"`, want: []string{"SET", "k", "AzxZZ"}},
+		{line: `SET k "say \"hi\" \\ \q"`, want: []string{"SET", "k", `say "hi" \ q`}},
+		{line: `SET k 'it\'s \n "raw"'`, want: []string{"SET", "k", `it's \n "raw"`}},
+		{line: `SET k ab"c d"`, want: []string{"SET", "k", "abc d"}},
+		{line: `SET k "open`, wantErr: errUnbalancedQuotes},
+		{line: `SET k 'open`, wantErr: errUnbalancedQuotes},
+		{line: `SET k "closed"tail`, wantErr: errUnbalancedQuotes},
+		{line: `SET k 'closed'tail`, wantErr: errUnbalancedQuotes},
+	} {
+		args, err := splitArgs([]byte(tc.line))
+		if err != tc.wantErr {
+			t.Errorf("splitArgs(%q): %v, want %v", tc.line, err, tc.wantErr)
+			continue
+		}
+		var got []string
+		for _, a := range args {
+			got = append(got, string(a))
+		}
+		if strings.Join(got, "\x00") != strings.Join(tc.want, "\x00") || len(got) != len(tc.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+// chunkConn is a connection reading back data in the given chunks and
+// recording what is written to it.
+type chunkConn struct {
+	net.Conn
+	chunks  [][]byte
+	written bytes.Buffer
+}
+
+func (c *chunkConn) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	if c.chunks[0] = c.chunks[0][n:]; len(c.chunks[0]) == 0 {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func (c *chunkConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func TestInlineConn(t *testing.T) {
+	resp := func(args ...string) string {
+		var b [][]byte
+		for _, a := range args {
+			b = append(b, []byte(a))
+		}
+		return string(appendCommand(nil, b))
+	}
+	for _, tc := range []struct {
+		name    string
+		in      string
+		want    string // what redcon reads
+		wantErr string // the protocol error written back, if any
+	}{
+		{name: "inline", in: "GET 10.0.0.0/8\r\n", want: resp("GET", "10.0.0.0/8")},
+		{name: "blank lines", in: "\r\n\nPING\n", want: resp("PING")},
+		{name: "quoted", in: "SET k \"a b\\x00\"\r\n", want: resp("SET", "k", "a b\x00")},
+		{name: "resp", in: resp("SET", "k", "v\r\n*1\r\nstill the value"), want: resp("SET", "k", "v\r\n*1\r\nstill the value")},
+		{name: "mixed", in: "PING\r\n" + resp("GET", "k") + "GET 'x y'\r\n",
+			want: resp("PING") + resp("GET", "k") + resp("GET", "x y")},
+		{name: "empty array", in: "*0\r\nPING\r\n", want: "*0\r\n" + resp("PING")},
+		{name: "malformed resp passes through", in: "*1\r\n+PING\r\nGET k\r\n", want: "*1\r\n+PING\r\nGET k\r\n"},
+		{name: "negative length passes through", in: "*1\r\n$-1\r\nGET k\r\n", want: "*1\r\n$-1\r\nGET k\r\n"},
+		{name: "unbalanced", in: "PING\r\nGET \"k\r\nPING\r\n", want: resp("PING"), wantErr: "-ERR Protocol error: unbalanced quotes in request\r\n"},
+		{name: "too big", in: "PING\r\nSET k " + strings.Repeat("x", maxInlineLen), want: resp("PING"), wantErr: "-ERR Protocol error: too big inline request\r\n"},
+		{name: "unterminated", in: "PING\r\nGET k", want: resp("PING")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := rand.New(rand.NewPCG(1, 2))
+			for range 50 {
+				// Split the input at random, down to single bytes.
+				cc := &chunkConn{}
+				for in := []byte(tc.in); len(in) > 0; {
+					n := min(1+r.IntN(8), len(in))
+					cc.chunks = append(cc.chunks, append([]byte(nil), in[:n]...))
+					in = in[n:]
+				}
+				got, err := io.ReadAll(&inlineConn{Conn: cc})
+				if string(got) != tc.want {
+					t.Fatalf("read %q, want %q", got, tc.want)
+				}
+				if tc.wantErr == "" && err != nil {
+					t.Fatalf("read error %v", err)
+				}
+				if cc.written.String() != tc.wantErr {
+					t.Fatalf("wrote %q, want %q", cc.written.String(), tc.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestInlineCommands(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveTest(t, s)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, tc := range []struct {
+		send string
+		want []string // reply lines
+	}{
+		{"SET 10.0.0.0/8 \"two words\"\r\n", []string{"+OK"}},
+		{"GET 10.1.2.3\n", []string{"$9", "two words"}},
+		{"  HSET\t10.0.0.0/16 'f' \"\\x76\"\r\n", []string{":1"}},
+		{"HGET 10.0.0.0/16 f\r\n", []string{"$1", "v"}},
+		{"GET 10.0.0.0/8 \"unterminated\r\n", []string{"-ERR Protocol error: unbalanced quotes in request"}},
+	} {
+		if _, err := conn.Write([]byte(tc.send)); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tc.want {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("after %q: %v", tc.send, err)
+			}
+			if line != want+"\r\n" {
+				t.Errorf("after %q read %q, want %q", tc.send, line, want)
+			}
+		}
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("the connection stayed open after a protocol error")
+	}
+}
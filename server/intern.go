@@ -0,0 +1,101 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// internPool lets prefixes with identical values share one slice. Entries
+// are reference counted and dropped when the last prefix using them goes.
+// Stored values are never modified in place, so sharing needs no
+// copy-on-write beyond what SET already does by storing a fresh slice.
+type internPool struct {
+	mu      sync.Mutex
+	entries map[string]*internEntry
+
+	distinct atomic.Int64 // pooled values
+	saved    atomic.Int64 // bytes not duplicated thanks to sharing
+}
+
+type internEntry struct {
+	value []byte
+	refs  int64
+}
+
+func newInternPool() *internPool {
+	return &internPool{entries: make(map[string]*internEntry)}
+}
+
+// intern returns the pooled slice equal to v, adding v if there is none.
+func (ip *internPool) intern(v []byte) []byte {
+	if len(v) == 0 {
+		return v
+	}
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	if e := ip.entries[string(v)]; e != nil {
+		e.refs++
+		ip.saved.Add(int64(len(v)))
+		return e.value
+	}
+	ip.entries[string(v)] = &internEntry{value: v, refs: 1}
+	ip.distinct.Add(1)
+	return v
+}
+
+// release drops one reference to v if v is the pooled slice. Values stored
+// while interning was off are not in the pool and are ignored.
+func (ip *internPool) release(v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	e := ip.entries[string(v)]
+	if e == nil || &e.value[0] != &v[0] {
+		return
+	}
+	if e.refs--; e.refs == 0 {
+		delete(ip.entries, string(v))
+		ip.distinct.Add(-1)
+	} else {
+		ip.saved.Add(-int64(len(v)))
+	}
+}
+
+// refs returns how many prefixes share v, or 0 if v is not the pooled
+// slice.
+func (ip *internPool) refs(v []byte) int64 {
+	if len(v) == 0 {
+		return 0
+	}
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	if e := ip.entries[string(v)]; e != nil && &e.value[0] == &v[0] {
+		return e.refs
+	}
+	return 0
+}
+
+// counts returns every pooled value's reference count.
+func (ip *internPool) counts() map[string]int64 {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	out := make(map[string]int64, len(ip.entries))
+	for k, e := range ip.entries {
+		out[k] = e.refs
+	}
+	return out
+}
+
+// detach empties the pool, for FLUSHDB, returning the old entries for the
+// caller to dispose of.
+func (ip *internPool) detach() map[string]*internEntry {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	old := ip.entries
+	ip.entries = make(map[string]*internEntry)
+	ip.distinct.Store(0)
+	ip.saved.Store(0)
+	return old
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestInternPool(t *testing.T) {
+	ip := newInternPool()
+	a1, a2 := []byte("AS64500"), []byte("AS64500")
+	stray := []byte("AS64500") // stored while interning was off
+	var pooled []byte
+	for _, tc := range []struct {
+		op              string
+		v               []byte
+		distinct, saved int64
+	}{
+		{"intern", a1, 1, 0},
+		{"intern", a2, 1, 7},
+		{"intern", []byte("AS64501"), 2, 7},
+		{"intern", nil, 2, 7}, // empty values are never pooled
+		{"release", stray, 2, 7},
+		{"release", a1, 2, 0},
+		{"release", a1, 1, 0},
+		{"release", a1, 1, 0}, // no longer pooled
+	} {
+		switch tc.op {
+		case "intern":
+			got := ip.intern(tc.v)
+			if pooled == nil && len(tc.v) > 0 {
+				pooled = got
+			}
+			if string(got) != string(tc.v) {
+				t.Fatalf("intern(%q) = %q", tc.v, got)
+			}
+		case "release":
+			ip.release(tc.v)
+		}
+		if d, s := ip.distinct.Load(), ip.saved.Load(); d != tc.distinct || s != tc.saved {
+			t.Errorf("after %s(%q): %d distinct, %d saved; want %d, %d", tc.op, tc.v, d, s, tc.distinct, tc.saved)
+		}
+	}
+	if &pooled[0] != &a1[0] {
+		t.Error("the first value interned is not the pooled one")
+	}
+}
+
+func TestValueInterning(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	dbStats := func() map[string]Reply {
+		t.Helper()
+		return memFields(memFields(mustDo(t, ss, "MEMORY", "STATS"))["db.0"])
+	}
+	mustDo(t, ss, "SET", "192.0.2.0/24", "AS64500") // not pooled
+	mustDo(t, ss, "CONFIG", "SET", "value-interning", "yes")
+	for i := range 10 {
+		mustDo(t, ss, "SET", "10."+strconv.Itoa(i)+".0.0/16", "AS64500")
+	}
+	mustDo(t, ss, "SET", "10.0.0.0/16", "AS64501")
+	for _, tc := range []struct {
+		args            []string
+		distinct, saved int64
+	}{
+		{nil, 2, 8 * 7},
+		{[]string{"DEL", "192.0.2.0/24"}, 2, 8 * 7},
+		{[]string{"DEL", "10.1.0.0/16"}, 2, 7 * 7},
+		{[]string{"SET", "10.2.0.0/16", "AS64501"}, 2, 7 * 7},
+		{[]string{"CONFIG", "SET", "value-interning", "no"}, 2, 7 * 7},
+		{[]string{"SET", "10.3.0.0/16", "AS64500"}, 2, 6 * 7},
+		{[]string{"FLUSHDB"}, 0, 0},
+	} {
+		if tc.args != nil {
+			mustDo(t, ss, tc.args...)
+		}
+		st := dbStats()
+		if d, s := st["interned.values"].Int, st["interned.bytes-saved"].Int; d != tc.distinct || s != tc.saved {
+			t.Errorf("after %q: interned.values %d, interned.bytes-saved %d; want %d, %d", tc.args, d, s, tc.distinct, tc.saved)
+		}
+	}
+	if err := ss.Do("CONFIG", "SET", "value-interning", "maybe").Err(); err == nil {
+		t.Error("CONFIG SET value-interning maybe succeeded")
+	}
+}
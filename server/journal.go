@@ -0,0 +1,443 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// The bulk operations that write as they go, IMPORT, DBMERGE, DELVALUE
+// and TREEEXPIRE, are recorded in an operation journal, journal-file in dir:
+// before one starts, a line with the operation, its target database and
+// its parameters, and a second once it ends, each synced to disk before
+// going on. An operation whose journal line cannot be written is refused.
+//
+// A crash during one leaves an entry without its end. At startup, such an
+// entry whose database was last saved before the operation started has
+// left no trace in the data loaded, which is logged and forgotten: the
+// operation has to be run again. One whose database was saved while it
+// ran may have been saved half done, so its database is refused, for
+// reads and writes alike, until an operator settles it with JOURNAL
+// RESOLVE, or the server settles it at startup as journal-recovery says:
+// refuse, the default, waits for the operator; serve accepts the data as
+// it is; complete runs the operation again, for those whose rerun ends in
+// the state the whole run would have, given the same input: IMPORT with
+// REPLACE or SKIP, DBMERGE, DELVALUE without LIMIT and TREEEXPIRE. Nothing is rolled
+// back, as the journal keeps no copy of what an operation overwrote.
+// INFO persistence lists the unresolved entries and JOURNAL the same.
+
+// journalEntry is one line of the journal: an operation starting, or with
+// done set, the end of the one with its id.
+type journalEntry struct {
+	ID       int64             `json:"id"`
+	Op       string            `json:"op,omitempty"`
+	DB       int               `json:"db"`
+	Params   map[string]string `json:"params,omitempty"`
+	Started  int64             `json:"started,omitempty"` // unix milliseconds
+	Done     int64             `json:"done,omitempty"`
+	Resolved string            `json:"resolved,omitempty"` // how an interrupted operation was settled
+}
+
+// opJournal is the operation journal.
+type opJournal struct {
+	mu          sync.Mutex
+	path        string
+	recovery    string // journal-recovery
+	f           *os.File
+	nextID      int64
+	interrupted map[int64]journalEntry // unresolved, refusing their databases
+	held        atomic.Int64           // len(interrupted), read on every command
+}
+
+// journalExempt are the commands other than admin ones a database
+// refused for an interrupted operation still serves, as they read none
+// of its data.
+var journalExempt = map[string]bool{
+	"PING": true, "ECHO": true, "SELECT": true, "INFO": true, "CLIENT": true, "LCP": true,
+	"DBSIZE": true, "DBSTATS": true, "SHOWDBS": true, "OWNER": true, "SHARDMAP": true,
+	"LASTSAVE": true, "WAITAOF": true,
+}
+
+// journalRecoveryModes are the values of journal-recovery.
+var journalRecoveryModes = []string{"refuse", "serve", "complete"}
+
+func newOpJournal() *opJournal {
+	return &opJournal{recovery: "refuse", nextID: 1, interrupted: make(map[int64]journalEntry)}
+}
+
+// appendLocked writes e to the journal and syncs it.
+func (j *opJournal) appendLocked(e journalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// begin records that op is starting on database db and returns the id to
+// pass to end. Without a journal it records nothing and returns 0.
+func (j *opJournal) begin(op string, db int, params map[string]string) (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return 0, nil
+	}
+	e := journalEntry{ID: j.nextID, Op: op, DB: db, Params: params, Started: time.Now().UnixMilli()}
+	if err := j.appendLocked(e); err != nil {
+		return 0, errorf(ClassErr, "cannot record %s in the operation journal: %v", op, err)
+	}
+	j.nextID++
+	return e.ID, nil
+}
+
+// end records that the operation begin returned id for has ended.
+func (j *opJournal) end(id int64) {
+	if id == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.appendLocked(journalEntry{ID: id, Done: time.Now().UnixMilli()}); err != nil {
+		slog.Error("operation journal write failed", "path", j.path, "id", id, "err", err)
+	}
+}
+
+// refusal returns the error of a command against database db while an
+// interrupted operation on it is unresolved, or nil.
+func (j *opJournal) refusal(db int) error {
+	if j.held.Load() == 0 {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, e := range j.interrupted {
+		if e.DB == db {
+			return errorf(ClassJournal, "db%d may hold a partial %s interrupted at startup, see JOURNAL, then JOURNAL RESOLVE %d",
+				db, e.Op, e.ID)
+		}
+	}
+	return nil
+}
+
+// resolveLocked settles interrupted entry e as how says.
+func (j *opJournal) resolveLocked(e journalEntry, how string) error {
+	if err := j.appendLocked(journalEntry{ID: e.ID, Done: time.Now().UnixMilli(), Resolved: how}); err != nil {
+		return err
+	}
+	delete(j.interrupted, e.ID)
+	j.held.Store(int64(len(j.interrupted)))
+	slog.Info("interrupted operation resolved", "id", e.ID, "op", e.Op, "db", e.DB, "how", how)
+	return nil
+}
+
+// list returns the unresolved entries by id.
+func (j *opJournal) list() []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	out := make([]journalEntry, 0, len(j.interrupted))
+	for _, e := range j.interrupted {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].ID < out[b].ID })
+	return out
+}
+
+// readJournal returns the entries of the journal at path that never
+// ended, and the highest id in it.
+func readJournal(path string) ([]journalEntry, int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	open := make(map[int64]journalEntry)
+	var last int64
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		var e journalEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// A crash can cut the last line short; one before it is damage.
+			slog.Warn("skipping unreadable operation journal line", "path", path, "line", n, "err", err)
+			continue
+		}
+		last = max(last, e.ID)
+		if e.Done != 0 {
+			delete(open, e.ID)
+		} else {
+			open[e.ID] = e
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, 0, err
+	}
+	entries := make([]journalEntry, 0, len(open))
+	for _, e := range open {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].ID < entries[b].ID })
+	return entries, last, nil
+}
+
+// openJournal reads the journal left by the last run once its snapshots,
+// infos, are loaded, settles the operations it interrupted, and starts a
+// new journal holding only those left unresolved.
+func (s *TrieServer) openJournal(infos []*snapshotInfo) error {
+	j := s.journal
+	if j.path == "" {
+		return nil
+	}
+	path := filepath.Join(s.snapshots.dir, j.path)
+	entries, last, err := readJournal(path)
+	if err != nil {
+		return err
+	}
+	var unresolved []journalEntry
+	for _, e := range entries {
+		saved := s.savedAt(infos, e.DB)
+		started := time.UnixMilli(e.Started)
+		if saved.Before(started) {
+			slog.Warn("interrupted operation started after its database was last saved, so none of it was loaded; run it again",
+				"id", e.ID, "op", e.Op, "db", e.DB, "params", e.Params, "started", started.Format(time.RFC3339))
+			continue
+		}
+		slog.Warn("interrupted operation started before its database was last saved, so the data loaded may hold part of it",
+			"id", e.ID, "op", e.Op, "db", e.DB, "params", e.Params, "started", started.Format(time.RFC3339),
+			"saved", saved.Format(time.RFC3339), "journal-recovery", j.recovery)
+		unresolved = append(unresolved, e)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.f, j.nextID = f, last+1
+	for _, e := range unresolved {
+		if err := j.appendLocked(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		f.Close()
+		return err
+	}
+	for _, e := range unresolved {
+		j.interrupted[e.ID] = e
+	}
+	j.held.Store(int64(len(j.interrupted)))
+	for _, e := range unresolved {
+		switch j.recovery {
+		case "serve":
+			err = j.resolveLocked(e, "served")
+		case "complete":
+			if rerr := s.rerun(e); rerr != nil {
+				slog.Error("cannot complete interrupted operation, refusing its database", "id", e.ID, "op", e.Op,
+					"db", e.DB, "err", rerr)
+				continue
+			}
+			err = j.resolveLocked(e, "completed")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// savedAt returns when the snapshot loaded for database id, one of
+// infos, was taken, or the zero Time if there was none.
+func (s *TrieServer) savedAt(infos []*snapshotInfo, id int) time.Time {
+	perDB := s.snapshots.perDB()
+	for _, info := range infos {
+		if !perDB || len(info.dbs) == 1 && info.dbs[0].id == id {
+			return info.created
+		}
+	}
+	return time.Time{}
+}
+
+// journalParams builds the parameters of a journal entry from key value
+// pairs, leaving out empty values.
+func journalParams(kv ...string) map[string]string {
+	p := make(map[string]string)
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] != "" {
+			p[kv[i]] = kv[i+1]
+		}
+	}
+	return p
+}
+
+// conflictNames name the conflict modes in journal parameters.
+var conflictNames = []string{"replace", "skip", "abort"}
+
+func parseConflictName(v string) (conflictMode, bool) {
+	for i, name := range conflictNames {
+		if v == name {
+			return conflictMode(i), true
+		}
+	}
+	return 0, false
+}
+
+// rerun runs interrupted operation e again, for journal-recovery complete,
+// if running it again ends where the whole run would have.
+func (s *TrieServer) rerun(e journalEntry) error {
+	p := e.Params
+	mode, _ := parseConflictName(p["conflict"])
+	switch e.Op {
+	case "IMPORT":
+		if mode == conflictAbort {
+			return errors.New("an IMPORT with ABORT cannot be run again, as it would stop at what it imported")
+		}
+		res, err := s.getDB(e.DB).importFile(importOptions{path: p["path"], format: p["format"], conflict: mode,
+			template: p["template"], multipath: p["multipath"]})
+		if err != nil {
+			return err
+		}
+		slog.Info("interrupted IMPORT run again", "id", e.ID, "db", e.DB, "inserted", res.inserted, "replaced", res.replaced)
+	case "DBMERGE":
+		src, err := strconv.Atoi(p["src"])
+		if err != nil {
+			return errors.New("no source database recorded")
+		}
+		if mode == conflictAbort {
+			// It had found no conflicts before writing, so src overwrites
+			// only what it copied itself.
+			mode = conflictReplace
+		}
+		if _, err := mergeDBs(s.getDB(src), s.getDB(e.DB), mode); err != nil {
+			return err
+		}
+	case "DELVALUE":
+		if p["limit"] != "" {
+			return errors.New("a DELVALUE with LIMIT cannot be run again, as what it deleted is not known")
+		}
+		var within netip.Prefix
+		if p["within"] != "" {
+			w, err := parsePrefix(p["within"])
+			if err != nil {
+				return err
+			}
+			within = w
+		}
+		db := s.getDB(e.DB)
+		keys, err := db.valueMatches([]byte(p["value"]), within, nil)
+		if err != nil {
+			return err
+		}
+		db.deleteValue(keys, []byte(p["value"]), -1, "")
+	case "TREEEXPIRE":
+		within, err := parsePrefix(p["within"])
+		if err != nil {
+			return err
+		}
+		at, err := strconv.ParseInt(p["at"], 10, 64)
+		if err != nil {
+			return errors.New("no deadline recorded")
+		}
+		db := s.getDB(e.DB)
+		keys, err := db.subtreeKeys(within, nil)
+		if err != nil {
+			return err
+		}
+		db.expireTree(keys, at, p["only"])
+	default:
+		return fmt.Errorf("unknown operation %s", e.Op)
+	}
+	return nil
+}
+
+// handleJournal implements JOURNAL, which lists the interrupted operations
+// not yet resolved, each a map of its id, operation, database, parameters
+// and start in unix milliseconds, and JOURNAL RESOLVE id, which accepts
+// the database the operation was interrupted in as it is, serving it
+// again.
+func (s *TrieServer) handleJournal(conn redcon.Conn, cmd redcon.Command) {
+	j := s.journal
+	switch {
+	case len(cmd.Args) == 1 || len(cmd.Args) == 2 && strings.EqualFold(string(cmd.Args[1]), "LIST"):
+		entries := j.list()
+		conn.WriteArray(len(entries))
+		for _, e := range entries {
+			conn.WriteArray(10)
+			conn.WriteBulkString("id")
+			conn.WriteInt64(e.ID)
+			conn.WriteBulkString("op")
+			conn.WriteBulkString(e.Op)
+			conn.WriteBulkString("db")
+			conn.WriteInt(e.DB)
+			conn.WriteBulkString("params")
+			keys := make([]string, 0, len(e.Params))
+			for k := range e.Params {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			conn.WriteArray(2 * len(keys))
+			for _, k := range keys {
+				conn.WriteBulkString(k)
+				conn.WriteBulkString(e.Params[k])
+			}
+			conn.WriteBulkString("started")
+			conn.WriteInt64(e.Started)
+		}
+	case len(cmd.Args) == 3 && strings.EqualFold(string(cmd.Args[1]), "RESOLVE"):
+		id, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+		if err != nil {
+			conn.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		e, ok := j.interrupted[id]
+		if !ok {
+			conn.WriteError("ERR no unresolved journal entry " + strconv.FormatInt(id, 10))
+			return
+		}
+		if err := j.resolveLocked(e, "operator"); err != nil {
+			writeError(conn, err)
+			return
+		}
+		writeOK(conn)
+	default:
+		conn.WriteError("ERR syntax error")
+	}
+}
+
+// infoJournal adds the unresolved journal entries to INFO persistence.
+func (s *TrieServer) infoJournal(b *strings.Builder) {
+	entries := s.journal.list()
+	fmt.Fprintf(b, "journal_unresolved:%d\r\n", len(entries))
+	for _, e := range entries {
+		fmt.Fprintf(b, "journal_entry_%d:op=%s,db=%d,started=%d\r\n", e.ID, e.Op, e.DB, e.Started)
+	}
+}
+
+// registerJournalConfig exposes the journal settings, fixed at startup.
+func (s *TrieServer) registerJournalConfig() {
+	s.addConfig("journal-file", func() string { return s.journal.path }, nil)
+	s.addConfig("journal-recovery", func() string { return s.journal.recovery }, nil)
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// journalFixture saves a snapshot in a new directory, with db0 holding
+// 10.0.0.0/8 = x and 192.0.2.0/24 = keep and db1 198.51.100.0/24 = merged,
+// and writes routes.csv next to it.
+func journalFixture(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	runSteps(t, newTestSession(t, newTestServer(t)), []replyStep{
+		{[]string{"CONFIG", "SET", "dir", dir}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "x"}, "OK"},
+		{[]string{"SET", "192.0.2.0/24", "keep"}, "OK"},
+		{[]string{"SELECT", "1"}, "OK"},
+		{[]string{"SET", "198.51.100.0/24", "merged"}, "OK"},
+		{[]string{"SAVE"}, "OK"},
+	})
+	if err := os.WriteFile(filepath.Join(dir, "routes.csv"), []byte("203.0.113.0/24,imported\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeJournal writes entries to the journal file in dir.
+func writeJournal(t *testing.T, dir string, entries ...journalEntry) {
+	t.Helper()
+	var b strings.Builder
+	for _, e := range entries {
+		line, _ := json.Marshal(e)
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	if err := os.WriteFile(filepath.Join(dir, "journal.jsonl"), []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startWithJournal loads the snapshot in dir into a new server and opens
+// its journal as startup does.
+func startWithJournal(t *testing.T, dir, recovery string) *TrieServer {
+	t.Helper()
+	s := newTestServer(t)
+	infos, err := loadSnapshotFile(s, filepath.Join(dir, "dump.tdb"), true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.journal.path, s.journal.recovery = "journal.jsonl", recovery
+	if err := s.openJournal(infos); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.journal.f.Close() })
+	return s
+}
+
+func TestJournalRecovery(t *testing.T) {
+	before := time.Now().Add(-time.Hour).UnixMilli()
+	after := time.Now().Add(time.Hour).UnixMilli()
+	const refused = "JOURNAL db0 may hold a partial"
+	for _, tc := range []struct {
+		name     string
+		recovery string
+		entry    journalEntry
+		steps    []replyStep // on db0 after startup
+		pending  string      // journal_unresolved afterwards
+	}{
+		{
+			name:     "started after the save",
+			recovery: "refuse",
+			entry:    journalEntry{ID: 4, Op: "DELVALUE", Params: map[string]string{"value": "x"}, Started: after},
+			steps:    []replyStep{{[]string{"GET", "10.1.2.3"}, "x"}},
+			pending:  "0",
+		},
+		{
+			name:     "refuse",
+			recovery: "refuse",
+			entry:    journalEntry{ID: 4, Op: "DELVALUE", Params: map[string]string{"value": "x"}, Started: before},
+			steps: []replyStep{
+				{[]string{"GET", "10.1.2.3"}, refused},
+				{[]string{"SET", "10.0.0.0/8", "y"}, refused},
+				{[]string{"DBSIZE"}, "2"},
+				{[]string{"SELECT", "1"}, "OK"},
+				{[]string{"GET", "198.51.100.1"}, "merged"}, // other databases are served
+			},
+			pending: "1",
+		},
+		{
+			name:     "serve",
+			recovery: "serve",
+			entry:    journalEntry{ID: 4, Op: "DELVALUE", Params: map[string]string{"value": "x"}, Started: before},
+			steps:    []replyStep{{[]string{"GET", "10.1.2.3"}, "x"}},
+			pending:  "0",
+		},
+		{
+			name:     "complete DELVALUE",
+			recovery: "complete",
+			entry:    journalEntry{ID: 4, Op: "DELVALUE", Params: map[string]string{"value": "x", "within": "10.0.0.0/8"}, Started: before},
+			steps:    []replyStep{{[]string{"GET", "10.1.2.3"}, "nil"}, {[]string{"GET", "192.0.2.1"}, "keep"}},
+			pending:  "0",
+		},
+		{
+			name:     "complete DBMERGE",
+			recovery: "complete",
+			entry:    journalEntry{ID: 4, Op: "DBMERGE", Params: map[string]string{"src": "1", "conflict": "abort"}, Started: before},
+			steps:    []replyStep{{[]string{"GET", "198.51.100.1"}, "merged"}, {[]string{"DBSIZE"}, "3"}},
+			pending:  "0",
+		},
+		{
+			name:     "complete IMPORT",
+			recovery: "complete",
+			entry:    journalEntry{ID: 4, Op: "IMPORT", Params: map[string]string{"path": "routes.csv", "format": "csv", "conflict": "skip"}, Started: before},
+			steps:    []replyStep{{[]string{"GET", "203.0.113.1"}, "imported"}},
+			pending:  "0",
+		},
+		{
+			name:     "an IMPORT with ABORT cannot be completed",
+			recovery: "complete",
+			entry:    journalEntry{ID: 4, Op: "IMPORT", Params: map[string]string{"path": "routes.csv", "format": "csv", "conflict": "abort"}, Started: before},
+			steps:    []replyStep{{[]string{"GET", "203.0.113.1"}, refused}},
+			pending:  "1",
+		},
+		{
+			name:     "a DELVALUE with LIMIT cannot be completed",
+			recovery: "complete",
+			entry:    journalEntry{ID: 4, Op: "DELVALUE", Params: map[string]string{"value": "x", "limit": "1"}, Started: before},
+			steps:    []replyStep{{[]string{"GET", "10.1.2.3"}, refused}},
+			pending:  "1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := journalFixture(t)
+			if tc.entry.Op == "IMPORT" {
+				tc.entry.Params["path"] = filepath.Join(dir, tc.entry.Params["path"])
+			}
+			writeJournal(t, dir,
+				journalEntry{ID: 2, Op: "IMPORT", Params: map[string]string{"path": "gone.csv"}, Started: before},
+				journalEntry{ID: 2, Done: before + 1},
+				tc.entry)
+			s := startWithJournal(t, dir, tc.recovery)
+			ss := newTestSession(t, s)
+			runSteps(t, ss, tc.steps)
+			if got := infoFields(mustDo(t, ss, "INFO", "persistence").Str)["journal_unresolved"]; got != tc.pending {
+				t.Errorf("journal_unresolved = %s, want %s", got, tc.pending)
+			}
+			// The new journal holds only what is left unresolved, and new
+			// entries carry on from the old ids.
+			entries, last, err := readJournal(filepath.Join(dir, "journal.jsonl"))
+			if err != nil || strconv.Itoa(len(entries)) != tc.pending || last != 4 && tc.pending == "1" {
+				t.Errorf("journal afterwards %v, last id %d, %v", entries, last, err)
+			}
+			if s.journal.nextID != 5 {
+				t.Errorf("next id %d, want 5", s.journal.nextID)
+			}
+		})
+	}
+}
+
+func TestJournalResolve(t *testing.T) {
+	dir := journalFixture(t)
+	writeJournal(t, dir, journalEntry{ID: 7, Op: "DBMERGE", DB: 0, Params: map[string]string{"src": "1"},
+		Started: time.Now().Add(-time.Hour).UnixMilli()})
+	s := startWithJournal(t, dir, "refuse")
+	ss := newTestSession(t, s)
+	r := mustDo(t, ss, "JOURNAL")
+	if got := r.String(); !strings.HasPrefix(got, "[[id 7 op DBMERGE db 0 params [src 1] started ") {
+		t.Errorf("JOURNAL = %s", got)
+	}
+	if info := infoFields(mustDo(t, ss, "INFO", "persistence").Str); !strings.HasPrefix(info["journal_entry_7"], "op=DBMERGE,db=0,started=") {
+		t.Errorf("journal_entry_7 = %q", info["journal_entry_7"])
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"SELECT", "1"}, "OK"},
+		{[]string{"DBMERGE", "1", "0"}, "JOURNAL db0"},
+		{[]string{"SELECT", "0"}, "OK"},
+		{[]string{"PING"}, "PONG"},
+		{[]string{"JOURNAL", "RESOLVE", "8"}, "ERR no unresolved journal entry 8"},
+		{[]string{"JOURNAL", "RESOLVE", "x"}, "ERR value is not an integer or out of range"},
+		{[]string{"JOURNAL", "DROP", "7"}, "ERR syntax error"},
+		{[]string{"JOURNAL", "RESOLVE", "7"}, "OK"},
+		{[]string{"GET", "10.1.2.3"}, "x"},
+		{[]string{"JOURNAL", "LIST"}, "[]"},
+		{[]string{"JOURNAL", "RESOLVE", "7"}, "ERR no unresolved journal entry 7"},
+		{[]string{"CONFIG", "GET", "journal-recovery"}, "[journal-recovery refuse]"},
+	})
+	// A restart finds the entry settled.
+	if entries, _, err := readJournal(filepath.Join(dir, "journal.jsonl")); len(entries) != 0 || err != nil {
+		t.Errorf("after JOURNAL RESOLVE the journal holds %v, %v", entries, err)
+	}
+}
+
+func TestJournalRecord(t *testing.T) {
+	dir := journalFixture(t)
+	os.Remove(filepath.Join(dir, "journal.jsonl"))
+	s := startWithJournal(t, dir, "refuse")
+	ss := newTestSession(t, s)
+	runSteps(t, ss, []replyStep{
+		{[]string{"IMPORT", "routes.csv", "SKIP"}, "[lines 1 inserted 1 replaced 0 skipped 0 errors 0 first-errors []]"},
+		{[]string{"DBMERGE", "1", "0"}, "[copied 1 overwritten 0 skipped 0]"},
+		{[]string{"DELVALUE", "x", "WITHIN", "10.0.0.0/8"}, "1"},
+		{[]string{"GET", "10.1.2.3"}, "nil"},
+	})
+	b, err := os.ReadFile(filepath.Join(dir, "journal.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var e journalEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Done != 0 {
+			got = append(got, "end "+strconv.FormatInt(e.ID, 10))
+			continue
+		}
+		params, _ := json.Marshal(e.Params)
+		got = append(got, strconv.FormatInt(e.ID, 10)+" "+e.Op+" "+strconv.Itoa(e.DB)+" "+string(params))
+	}
+	want := []string{
+		`1 IMPORT 0 {"conflict":"skip","format":"csv","path":"` + filepath.Join(dir, "routes.csv") + `"}`, "end 1",
+		`2 DBMERGE 0 {"conflict":"replace","src":"1"}`, "end 2",
+		`3 DELVALUE 0 {"value":"x","within":"10.0.0.0/8"}`, "end 3",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("journal:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// JSON values are stored as their text, like any other value, and parsed
+// on each JSON command. Parsing keeps object members in document order, so
+// a partial update changes only what it touches.
+
+var (
+	errNewAtRoot = newError(ClassErr, "new objects must be created at the root")
+	errBadPath   = newError(ClassErr, "invalid JSON path")
+)
+
+// jsonObject is a JSON object with its members in document order. A
+// parsed JSON value is a jsonObject, []any, string, json.Number, bool or
+// nil.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	key   string
+	value any
+}
+
+// parseJSON parses one JSON document.
+func parseJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return v, nil
+}
+
+func decodeJSON(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := jsonObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, jsonMember{key.(string), v})
+		}
+		_, err := dec.Token() // '}'
+		return obj, err
+	case json.Delim('['):
+		arr := []any{}
+		for dec.More() {
+			v, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err := dec.Token() // ']'
+		return arr, err
+	}
+	return tok, nil
+}
+
+// appendJSON appends the compact encoding of v to b.
+func appendJSON(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case jsonObject:
+		b = append(b, '{')
+		for i, m := range v {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendJSON(b, m.key)
+			b = append(b, ':')
+			b = appendJSON(b, m.value)
+		}
+		return append(b, '}')
+	case []any:
+		b = append(b, '[')
+		for i, e := range v {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendJSON(b, e)
+		}
+		return append(b, ']')
+	case json.Number:
+		return append(b, v...)
+	default:
+		enc, _ := json.Marshal(v) // string, bool or nil
+		return append(b, enc...)
+	}
+}
+
+// pathStep is one step of a JSON path: an object member or, when key is
+// empty and isIndex is set, an array element. Negative indices count
+// from the end.
+type pathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parseJSONPath parses a path such as $.geo.city, .tags[0] or
+// $["odd key"], with $ or . alone meaning the whole document.
+func parseJSONPath(path string) ([]pathStep, error) {
+	rest := strings.TrimPrefix(path, "$")
+	if rest == "" || rest == "." {
+		return nil, nil
+	}
+	if rest == path && rest[0] != '.' && rest[0] != '[' {
+		rest = "." + rest // a bare member name, as in JGET k name
+	}
+	var steps []pathStep
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			n := strings.IndexAny(rest, ".[")
+			if n < 0 {
+				n = len(rest)
+			}
+			if n == 0 {
+				return nil, errBadPath
+			}
+			steps = append(steps, pathStep{key: rest[:n]})
+			rest = rest[n:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errBadPath
+			}
+			inner := rest[1:end]
+			if key, err := strconv.Unquote(inner); err == nil && strings.HasPrefix(inner, `"`) {
+				steps = append(steps, pathStep{key: key})
+			} else if i, err := strconv.Atoi(inner); err == nil {
+				steps = append(steps, pathStep{index: i, isIndex: true})
+			} else {
+				return nil, errBadPath
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, errBadPath
+		}
+	}
+	return steps, nil
+}
+
+// jsonChild returns the element v holds at step, and its position.
+func jsonChild(v any, step pathStep) (any, int, bool) {
+	switch v := v.(type) {
+	case jsonObject:
+		if step.isIndex {
+			return nil, 0, false
+		}
+		for i, m := range v {
+			if m.key == step.key {
+				return m.value, i, true
+			}
+		}
+	case []any:
+		i := step.index
+		if i < 0 {
+			i += len(v)
+		}
+		if step.isIndex && i >= 0 && i < len(v) {
+			return v[i], i, true
+		}
+	}
+	return nil, 0, false
+}
+
+// jsonFind returns the element at path.
+func jsonFind(v any, path []pathStep) (any, bool) {
+	for _, step := range path {
+		var ok bool
+		if v, _, ok = jsonChild(v, step); !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// jsonSet returns root with the element at path replaced by value, adding
+// it when path names a missing member of an existing object. The slices
+// along path are copied, so root itself is never modified.
+func jsonSet(root any, path []pathStep, value any) (any, bool) {
+	if len(path) == 0 {
+		return value, true
+	}
+	child, i, found := jsonChild(root, path[0])
+	switch v := root.(type) {
+	case jsonObject:
+		if !found {
+			if len(path) > 1 || path[0].isIndex {
+				return nil, false
+			}
+			return append(v[:len(v):len(v)], jsonMember{path[0].key, value}), true
+		}
+		updated, ok := jsonSet(child, path[1:], value)
+		if !ok {
+			return nil, false
+		}
+		out := append(jsonObject(nil), v...)
+		out[i].value = updated
+		return out, true
+	case []any:
+		if !found {
+			return nil, false
+		}
+		updated, ok := jsonSet(child, path[1:], value)
+		if !ok {
+			return nil, false
+		}
+		out := append([]any(nil), v...)
+		out[i] = updated
+		return out, true
+	}
+	return nil, false
+}
+
+// jsonDelete returns root without the element at path, which must not be
+// empty, and whether there was one.
+func jsonDelete(root any, path []pathStep) (any, bool) {
+	child, i, found := jsonChild(root, path[0])
+	if !found {
+		return root, false
+	}
+	if len(path) > 1 {
+		updated, ok := jsonDelete(child, path[1:])
+		if !ok {
+			return root, false
+		}
+		return jsonSet(root, path[:1], updated)
+	}
+	switch v := root.(type) {
+	case jsonObject:
+		return append(append(jsonObject(nil), v[:i]...), v[i+1:]...), true
+	case []any:
+		return append(append([]any(nil), v[:i]...), v[i+1:]...), true
+	}
+	return root, false
+}
+
+// storedJSON parses a stored value for a JSON command, which only works
+// on strings holding a JSON document.
+func storedJSON(old value) (any, error) {
+	if !old.isString() {
+		return nil, errWrongType
+	}
+	doc, err := parseJSON(old.str)
+	if err != nil {
+		return nil, errWrongType
+	}
+	return doc, nil
+}
+
+// handleJSON implements JSET cidr path json, JGET cidr [path] and
+// JDEL cidr path.
+func (s *TrieServer) handleJSON(conn redcon.Conn, c *client, name string, cmd redcon.Command) {
+	want := map[string]int{"JSET": 4, "JGET": 3, "JDEL": 3}[name]
+	if len(cmd.Args) != want && !(name == "JGET" && len(cmd.Args) == 2) {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "'")
+		return
+	}
+	cidr := string(cmd.Args[1])
+	pathText := "$"
+	if len(cmd.Args) > 2 {
+		pathText = string(cmd.Args[2])
+	}
+	path, err := parseJSONPath(pathText)
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	db := s.getDB(currentDB(conn))
+
+	switch name {
+	case "JGET":
+		v, ok := db.lookupExact(cidr)
+		if !ok {
+			conn.WriteNull()
+			return
+		}
+		doc, err := storedJSON(v)
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		if elem, ok := jsonFind(doc, path); ok {
+			conn.WriteBulk(appendJSON(nil, elem))
+		} else {
+			conn.WriteNull()
+		}
+
+	case "JSET":
+		doc, err := parseJSON(cmd.Args[3])
+		if err != nil {
+			conn.WriteError("ERR invalid JSON: " + err.Error())
+			return
+		}
+		missing := false
+		err = db.update(cidr, func(old value, ok bool) (value, error) {
+			if !ok {
+				if len(path) > 0 {
+					return value{}, errNewAtRoot
+				}
+				return stringValue(appendJSON(nil, doc)), nil
+			}
+			stored, err := storedJSON(old)
+			if err != nil && len(path) > 0 {
+				return value{}, err // any value may be replaced as a whole
+			}
+			updated, found := jsonSet(stored, path, doc)
+			if !found {
+				missing = true
+				return value{}, errUnchanged
+			}
+			return stringValue(appendJSON(nil, updated)), nil
+		})
+		switch {
+		case err != nil:
+			writeError(conn, err)
+		case missing:
+			conn.WriteNull()
+		default:
+			db.writes.add(uint64(c.id), 1)
+			s.audit(c, name, cidr)
+			writeOK(conn)
+		}
+
+	case "JDEL":
+		deleted := false
+		err := db.update(cidr, func(old value, ok bool) (value, error) {
+			if !ok {
+				return value{}, errUnchanged
+			}
+			stored, err := storedJSON(old)
+			if err != nil {
+				return value{}, err
+			}
+			if len(path) == 0 {
+				deleted = true
+				return value{}, nil
+			}
+			updated, found := jsonDelete(stored, path)
+			if !found {
+				return value{}, errUnchanged
+			}
+			deleted = true
+			return stringValue(appendJSON(nil, updated)), nil
+		})
+		switch {
+		case err != nil:
+			writeError(conn, err)
+		default:
+			if deleted {
+				db.writes.add(uint64(c.id), 1)
+				s.audit(c, name, cidr)
+				conn.WriteInt(1)
+			} else {
+				conn.WriteInt(0)
+			}
+		}
+	}
+}
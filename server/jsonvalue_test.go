@@ -0,0 +1,106 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestJSONCommands(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	const k = "10.0.0.0/8"
+	for _, tc := range []struct {
+		args []string
+		want string // the reply: a bulk, an integer, OK, "nil" or an error prefix
+	}{
+		{[]string{"JGET", k}, "nil"},
+		{[]string{"JSET", k, "$.geo", `{"city":"x"}`}, "ERR new objects must be created at the root"},
+		{[]string{"JSET", k, "$", `{"geo": {"city": "Oslo", "cc": "NO"}, "asn": 64500.0, "tags": ["a", "b"]}`}, "OK"},
+		{[]string{"GET", "10.1.2.3"}, `{"geo":{"city":"Oslo","cc":"NO"},"asn":64500.0,"tags":["a","b"]}`},
+		{[]string{"JGET", k, "$.geo.city"}, `"Oslo"`},
+		{[]string{"JGET", k, "geo"}, `{"city":"Oslo","cc":"NO"}`},
+		{[]string{"JGET", k, ".tags[-1]"}, `"b"`},
+		{[]string{"JGET", k, `$["asn"]`}, "64500.0"},
+		{[]string{"JGET", k, "$.nope"}, "nil"},
+		{[]string{"JGET", k, ".tags[2]"}, "nil"},
+		{[]string{"JGET", k, "$.tags[x]"}, "ERR invalid JSON path"},
+		{[]string{"JGET", k, "$..geo"}, "ERR invalid JSON path"},
+		{[]string{"JSET", k, "$.geo.city", `"Bergen"`}, "OK"},
+		{[]string{"JSET", k, "$.geo.zip", `"5003"`}, "OK"},
+		{[]string{"JSET", k, ".tags[0]", `{"z":1}`}, "OK"},
+		{[]string{"JSET", k, ".tags[5]", "1"}, "nil"},
+		{[]string{"JSET", k, "$.no.such", "1"}, "nil"},
+		{[]string{"JSET", k, "$.asn", "{bad"}, "ERR invalid JSON"},
+		{[]string{"JGET", k}, `{"geo":{"city":"Bergen","cc":"NO","zip":"5003"},"asn":64500.0,"tags":[{"z":1},"b"]}`},
+		{[]string{"JDEL", k, "$.geo.cc"}, "1"},
+		{[]string{"JDEL", k, "$.geo.cc"}, "0"},
+		{[]string{"JDEL", k, ".tags[0]"}, "1"},
+		{[]string{"JGET", k}, `{"geo":{"city":"Bergen","zip":"5003"},"asn":64500.0,"tags":["b"]}`},
+		{[]string{"JDEL", k, "$"}, "1"},
+		{[]string{"JGET", k}, "nil"},
+		{[]string{"JDEL", k, "$"}, "0"},
+		{[]string{"SET", k, "plain"}, "OK"},
+		{[]string{"JGET", k}, "WRONGTYPE"},
+		{[]string{"JSET", k, "$.a", "1"}, "WRONGTYPE"},
+		{[]string{"JDEL", k, "$.a"}, "WRONGTYPE"},
+		{[]string{"JSET", k, "$", "[1, 2]"}, "OK"},
+		{[]string{"JGET", k, "[1]"}, "2"},
+		{[]string{"JSET", "not-a-prefix", "$", "1"}, "ERR invalid"},
+		{[]string{"JGET", k, "$", "extra"}, "ERR wrong number of arguments for 'JGET'"},
+		{[]string{"JDEL", k}, "ERR wrong number of arguments for 'JDEL'"},
+		{[]string{"PING"}, "PONG"}, // one reply per command, even after errors
+	} {
+		r := ss.Do(tc.args...)
+		var got string
+		switch r.Type {
+		case NullReply:
+			got = "nil"
+		case IntReply:
+			got = strconv.FormatInt(r.Int, 10)
+		default:
+			got = r.Str
+		}
+		if r.Type == ErrorReply {
+			if !strings.HasPrefix(got, tc.want) {
+				t.Errorf("%q = error %q, want %q", tc.args, got, tc.want)
+			}
+		} else if got != tc.want {
+			t.Errorf("%q = %s, want %s", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want []pathStep
+		err  bool
+	}{
+		{path: "$"},
+		{path: "."},
+		{path: "$.a.b", want: []pathStep{{key: "a"}, {key: "b"}}},
+		{path: "a", want: []pathStep{{key: "a"}}},
+		{path: ".a[3][-1]", want: []pathStep{{key: "a"}, {index: 3, isIndex: true}, {index: -1, isIndex: true}}},
+		{path: `$["odd key"].x`, want: []pathStep{{key: "odd key"}, {key: "x"}}},
+		{path: "$.a.", err: true},
+		{path: "$[", err: true},
+		{path: "$[x]", err: true},
+		{path: "$a", err: true},
+	} {
+		got, err := parseJSONPath(tc.path)
+		if (err != nil) != tc.err {
+			t.Errorf("parseJSONPath(%q) error %v, want one: %v", tc.path, err, tc.err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("parseJSONPath(%q) = %+v, want %+v", tc.path, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("parseJSONPath(%q) = %+v, want %+v", tc.path, got, tc.want)
+				break
+			}
+		}
+	}
+}
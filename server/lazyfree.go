@@ -0,0 +1,127 @@
+package server
+
+import (
+	"log/slog"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tannerklineintz/triedis/trie"
+	"github.com/tidwall/redcon"
+)
+
+// lazyFreeQueue is how many flushes may wait for the lazy-free worker;
+// beyond it a flush frees synchronously rather than blocking.
+const lazyFreeQueue = 64
+
+// lazyFreer tears down flushed data off the command path. A flush with
+// lazyfree-lazy-user-flush on only detaches its tries and intern entries
+// under the database's locks, which takes constant time, and queues them
+// here. The worker then clears them, leaving the memory to the garbage
+// collector, which reclaims it concurrently.
+type lazyFreer struct {
+	jobs    chan lazyFreeJob
+	pending atomic.Int64 // prefixes detached and not yet freed
+	freed   atomic.Int64 // prefixes freed by the worker since startup
+}
+
+// lazyFreeJob is what one flush detached.
+type lazyFreeJob struct {
+	tries   []*trie.Trie[value]
+	entries map[string]*internEntry
+	keys    int64
+}
+
+func newLazyFreer() *lazyFreer {
+	return &lazyFreer{jobs: make(chan lazyFreeJob, lazyFreeQueue)}
+}
+
+func (j lazyFreeJob) free() {
+	for _, t := range j.tries {
+		t.Clear()
+	}
+	clear(j.entries)
+}
+
+// free queues j for the worker, or frees it at once if the queue is full.
+func (lf *lazyFreer) free(j lazyFreeJob) {
+	lf.pending.Add(j.keys)
+	select {
+	case lf.jobs <- j:
+	default:
+		j.free()
+		lf.pending.Add(-j.keys)
+	}
+}
+
+// run is the worker, started once for the life of the server.
+func (lf *lazyFreer) run() {
+	for j := range lf.jobs {
+		j.free()
+		lf.pending.Add(-j.keys)
+		lf.freed.Add(j.keys)
+	}
+}
+
+// abandon reports what is left at shutdown. Pending frees are never
+// waited for: the process exiting releases their memory anyway, so
+// shutdown takes the same time however much is queued.
+func (lf *lazyFreer) abandon() {
+	if n := lf.pending.Load(); n > 0 {
+		slog.Info("Abandoning pending lazy frees", "objects", n)
+	}
+}
+
+// parseFlushMode parses FLUSHDB's optional ASYNC or SYNC argument, which
+// overrides lazyfree-lazy-user-flush for one call.
+func (s *TrieServer) parseFlushMode(args [][]byte) (lazy, ok bool) {
+	switch {
+	case len(args) == 0:
+		return s.store.lazyFlush.Load(), true
+	case len(args) > 1:
+		return false, false
+	}
+	switch strings.ToUpper(string(args[0])) {
+	case "ASYNC":
+		return true, true
+	case "SYNC":
+		return false, true
+	}
+	return false, false
+}
+
+// handleFlushFamily implements FLUSHFAMILY v4|v6 [ASYNC|SYNC], which
+// removes every prefix of one address family from the current database
+// at one instant and replies with how many it removed. ASYNC and SYNC
+// are as for FLUSHDB.
+func (s *TrieServer) handleFlushFamily(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'FLUSHFAMILY'")
+		return
+	}
+	fam, ok := parseFamily(string(cmd.Args[1]))
+	if !ok {
+		conn.WriteError("ERR FAMILY must be v4 or v6")
+		return
+	}
+	lazy, ok := s.parseFlushMode(cmd.Args[2:])
+	if !ok {
+		conn.WriteError("ERR syntax error")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	n := db.flushFamily(fam, s.freer(lazy))
+	if n > 0 {
+		db.writes.add(uint64(c.id), 1)
+		s.audit(c, "FLUSHFAMILY")
+	}
+	conn.WriteInt64(n)
+}
+
+// freer returns the lazy-free worker when lazy is set, and otherwise nil,
+// which makes a flush free synchronously.
+func (s *TrieServer) freer(lazy bool) *lazyFreer {
+	if lazy {
+		return s.lazyFree
+	}
+	return nil
+}
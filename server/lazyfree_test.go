@@ -0,0 +1,134 @@
+package server
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLazyFlush(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		lazyDefault string   // lazyfree-lazy-user-flush
+		flush       []string // the command emptying the database
+		want        string
+		wantPending int64 // prefixes queued for the worker, which is not running
+	}{
+		{"default sync", "no", []string{"FLUSHDB"}, "OK", 0},
+		{"default lazy", "yes", []string{"FLUSHDB"}, "OK", 3},
+		{"ASYNC", "no", []string{"FLUSHDB", "ASYNC"}, "OK", 3},
+		{"SYNC overrides", "yes", []string{"FLUSHDB", "sync"}, "OK", 0},
+		{"DROPDB follows the setting", "yes", []string{"DROPDB", "0"}, "1", 3},
+		{"DROPDB sync", "no", []string{"DROPDB", "0"}, "1", 0},
+		{"bad mode", "yes", []string{"FLUSHDB", "NOW"}, "ERR syntax error", 0},
+		{"too many", "yes", []string{"FLUSHDB", "ASYNC", "SYNC"}, "ERR syntax error", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			ss := newTestSession(t, s)
+			runSteps(t, ss, []replyStep{
+				{[]string{"CONFIG", "SET", "lazyfree-lazy-user-flush", tc.lazyDefault}, "OK"},
+				{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+				{[]string{"HSET", "10.1.0.0/16", "f", "v"}, "1"},
+				{[]string{"SADD", "2001:db8::/32", "m"}, "1"},
+				{tc.flush, tc.want},
+			})
+			info := infoFields(mustDo(t, ss, "INFO", "memory").Str)
+			if got := info["lazyfree_pending_objects"]; got != strconv.FormatInt(tc.wantPending, 10) {
+				t.Errorf("lazyfree_pending_objects = %s, want %d", got, tc.wantPending)
+			}
+			if tc.want == "OK" || tc.want == "1" {
+				runSteps(t, ss, []replyStep{{[]string{"DBSIZE"}, "0"}, {[]string{"GET", "10.1.2.3"}, "nil"}})
+			}
+
+			go s.lazyFree.run()
+			t.Cleanup(func() { close(s.lazyFree.jobs) })
+			for deadline := time.Now().Add(5 * time.Second); s.lazyFree.pending.Load() != 0; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("the lazy-free worker did not drain its queue")
+				}
+			}
+			if got := s.lazyFree.freed.Load(); got != tc.wantPending {
+				t.Errorf("lazyfreed_objects = %d, want %d", got, tc.wantPending)
+			}
+		})
+	}
+}
+
+// TestLazyFlushQueueFull checks that a flush frees synchronously rather
+// than block when the worker has fallen behind.
+func TestLazyFlushQueueFull(t *testing.T) {
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	for range lazyFreeQueue + 2 {
+		mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+		mustDo(t, ss, "FLUSHDB", "ASYNC")
+	}
+	if got := s.lazyFree.pending.Load(); got != lazyFreeQueue {
+		t.Errorf("%d prefixes pending, want the %d the queue holds", got, lazyFreeQueue)
+	}
+}
+
+func TestFlushFamily(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		flush       []string
+		want        string
+		left        []string // KEYS * afterwards
+		wantPending int64
+	}{
+		{"v4", []string{"FLUSHFAMILY", "v4"}, "4", []string{"2001:db8::/32", "::/1"}, 0},
+		{"v6", []string{"FLUSHFAMILY", "V6", "SYNC"}, "2", []string{"0.0.0.0/1", "10.0.0.0/8", "10.1.0.0/16", "192.0.2.0/24"}, 0},
+		// 0.0.0.0/1 sits in the wide shard and is deleted in place.
+		{"v4 ASYNC", []string{"FLUSHFAMILY", "v4", "ASYNC"}, "4", []string{"2001:db8::/32", "::/1"}, 3},
+		{"bad family", []string{"FLUSHFAMILY", "v5"}, "ERR FAMILY must be v4 or v6", nil, 0},
+		{"bad mode", []string{"FLUSHFAMILY", "v4", "NOW"}, "ERR syntax error", nil, 0},
+		{"no family", []string{"FLUSHFAMILY"}, "ERR wrong number of arguments for 'FLUSHFAMILY'", nil, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.store.valueIndex.Store(true)
+			ss := newTestSession(t, s)
+			runSteps(t, ss, []replyStep{
+				{[]string{"SET", "10.0.0.0/8", "a", "EX", "100"}, "OK"},
+				{[]string{"HSET", "10.1.0.0/16", "f", "v"}, "1"},
+				{[]string{"SET", "192.0.2.0/24", "a"}, "OK"},
+				{[]string{"SET", "0.0.0.0/1", "wide"}, "OK"},
+				{[]string{"SADD", "2001:db8::/32", "m"}, "1"},
+				{[]string{"SET", "::/1", "wide"}, "OK"},
+				{[]string{"GET", "10.1.2.3"}, "WRONGTYPE"}, // fills the lookup cache
+				{[]string{"SELECT", "1"}, "OK"},
+				{[]string{"SET", "10.0.0.0/8", "other"}, "OK"},
+				{[]string{"SELECT", "0"}, "OK"},
+				{tc.flush, tc.want},
+			})
+			if got := s.lazyFree.pending.Load(); got != tc.wantPending {
+				t.Errorf("%d prefixes pending, want %d", got, tc.wantPending)
+			}
+			if tc.left == nil {
+				runSteps(t, ss, []replyStep{{[]string{"DBSIZE"}, "6"}})
+				return
+			}
+			got := mustDo(t, ss, "KEYS", "*").strs()
+			slices.Sort(got)
+			if !slices.Equal(got, tc.left) {
+				t.Errorf("KEYS * = %q, want %q", got, tc.left)
+			}
+			res := verifyReply(t, ss)
+			if n := res["discrepancies"].Int; n != 0 {
+				t.Errorf("DEBUG VERIFY found %d discrepancies: %q", n, res["details"].strs())
+			}
+			lookup := "nil"
+			if tc.name == "v6" {
+				lookup = "WRONGTYPE"
+			}
+			runSteps(t, ss, []replyStep{
+				{[]string{"DBSIZE"}, strconv.Itoa(len(tc.left))},
+				{[]string{"GET", "10.1.2.3"}, lookup},
+				{[]string{"SELECT", "1"}, "OK"},
+				{[]string{"GET", "10.1.2.3"}, "other"},
+			})
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/netip"
+
+	"github.com/tannerklineintz/triedis/trie"
+	"github.com/tidwall/redcon"
+)
+
+// handleLCP implements LCP a b, the longest prefix covering both a and b,
+// each an address or a prefix: LCP 10.0.0.0/24 10.0.3.0/24 is 10.0.0.0/22.
+// It reads no database.
+func (s *TrieServer) handleLCP(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for 'LCP'")
+		return
+	}
+	var ps [2]netip.Prefix
+	for i, arg := range cmd.Args[1:] {
+		p, err := parsePrefix(string(arg))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		ps[i] = p
+	}
+	if ps[0].Addr().Is4() != ps[1].Addr().Is4() {
+		conn.WriteError("ERR cannot take the common prefix of an IPv4 and an IPv6 address")
+		return
+	}
+	conn.WriteBulkString(trie.Common(ps[0], ps[1]).String())
+}
+
+// handleLCPKeys implements LCPKEYS cidr: the stored prefix of the current
+// database, other than cidr itself, sharing the longest prefix with cidr,
+// and that prefix, as a two-element array of the common prefix then the
+// neighbor. It answers nil if the database holds no other prefix of
+// cidr's family.
+func (s *TrieServer) handleLCPKeys(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for 'LCPKEYS'")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	p, err := db.parseLookup(string(cmd.Args[1]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	q, ok := db.nearest(p)
+	if !ok {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteArray(2)
+	conn.WriteBulkString(trie.Common(p, q).String())
+	conn.WriteBulkString(q.String())
+}
+
+// nearest returns the unexpired stored prefix other than p sharing the
+// longest prefix with p. A prefix in another shard than p's differs from
+// p in the bits that pick the shard, so once p's own shard has one
+// sharing all those bits the rest are not searched. An IPv4 shard's
+// prefixes always do; an IPv6 shard's need not, as the bits skipped (see
+// v6ShardSkip) may differ.
+func (d *database) nearest(p netip.Prefix) (netip.Prefix, bool) {
+	best, found := netip.Prefix{}, false
+	search := func(sh *shard) {
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+		sh.trie.Neighbors(p, func(q netip.Prefix, v value) bool {
+			if v.expired() {
+				return true
+			}
+			if !found || trie.Common(p, q).Bits() > trie.Common(p, best).Bits() {
+				best, found = q, true
+			}
+			return false
+		})
+	}
+	skip, shards := 0, d.v4
+	if p.Addr().Is6() {
+		skip, shards = v6ShardSkip, d.v6
+	}
+	own := d.shardFor(p)
+	search(own)
+	if own != d.wide && found && trie.Common(p, best).Bits() >= skip+d.shardBits {
+		return best, true
+	}
+	if own != d.wide {
+		search(d.wide)
+	}
+	for _, sh := range shards {
+		if found && trie.Common(p, best).Bits() == p.Bits() {
+			break // nothing can share more than all of p
+		}
+		if sh != own {
+			search(sh)
+		}
+	}
+	return best, found
+}
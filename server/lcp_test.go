@@ -0,0 +1,79 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/tannerklineintz/triedis/trie"
+)
+
+func TestLCP(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/24", "a"}, "OK"},
+		{[]string{"SET", "10.0.4.0/24", "b"}, "OK"},
+		{[]string{"SET", "10.0.1.0/24", "gone", "PX", "1"}, "OK"},
+		{[]string{"SET", "4000::/16", "c"}, "OK"},
+		{[]string{"SET", "2800::/16", "d"}, "OK"},
+	})
+	time.Sleep(5 * time.Millisecond)
+	runSteps(t, ss, []replyStep{
+		{[]string{"LCP", "10.0.0.0/24", "10.0.3.0/24"}, "10.0.0.0/22"},
+		{[]string{"LCP", "10.1.2.3", "10.1.2.3"}, "10.1.2.3/32"},
+		{[]string{"LCP", "10.0.0.0/8", "192.0.2.1"}, "0.0.0.0/0"},
+		{[]string{"LCP", "2001:db8::1", "2001:db8::/32"}, "2001:db8::/32"},
+		{[]string{"LCP", "10.0.0.1", "::1"}, "ERR cannot take the common prefix of an IPv4 and an IPv6 address"},
+		{[]string{"LCP", "10.0.0.1", "nope"}, "ERR"},
+		{[]string{"LCP", "10.0.0.1"}, "ERR wrong number of arguments for 'LCP'"},
+
+		{[]string{"LCPKEYS", "10.0.0.0/24"}, "[10.0.0.0/21 10.0.4.0/24]"}, // 10.0.1.0/24 has expired
+		{[]string{"LCPKEYS", "10.0.4.7"}, "[10.0.4.0/24 10.0.4.0/24]"},
+		{[]string{"LCPKEYS", "10.0.0.0/8"}, "[10.0.0.0/8 10.0.0.0/24]"},
+		// 4000::/16 shares 2000::/16's shard but 2800::/16 more of it.
+		{[]string{"LCPKEYS", "2000::/16"}, "[2000::/4 2800::/16]"},
+		{[]string{"LCPKEYS", "4001::/16"}, "[4000::/15 4000::/16]"},
+		{[]string{"LCPKEYS", "nope"}, "ERR"},
+		{[]string{"LCPKEYS"}, "ERR wrong number of arguments for 'LCPKEYS'"},
+		{[]string{"SELECT", "1"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "only"}, "OK"},
+		{[]string{"LCPKEYS", "10.0.0.0/8"}, "nil"},
+		{[]string{"LCPKEYS", "2001:db8::1"}, "nil"},
+	})
+}
+
+// TestLCPKeysShards checks LCPKEYS against every stored prefix for keys
+// spread over every shard.
+func TestLCPKeysShards(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	all := mixedKeys(t, ss)
+	r := rand.New(rand.NewPCG(7, 8))
+	for range 300 {
+		p := randomPrefix(r, 16, 0)
+		if r.IntN(2) == 0 {
+			p = randomPrefix(r, 4, 0)
+		}
+		share := -1
+		for _, q := range all {
+			if q != p && q.Addr().Is4() == p.Addr().Is4() {
+				share = max(share, trie.Common(p, q).Bits())
+			}
+		}
+		got := ss.Do("LCPKEYS", p.String())
+		if share < 0 {
+			if got.String() != "nil" {
+				t.Errorf("LCPKEYS %s = %s, want nil", p, got)
+			}
+			continue
+		}
+		if len(got.Array) != 2 {
+			t.Errorf("LCPKEYS %s = %s, want a neighbor sharing %d bits", p, got, share)
+			continue
+		}
+		q := netip.MustParsePrefix(got.Array[1].Str)
+		if common := trie.Common(p, q); got.Array[0].Str != common.String() || common.Bits() != share {
+			t.Errorf("LCPKEYS %s = %s, want a neighbor sharing %d bits", p, got, share)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// listener is one bound RESP endpoint.
+type listener struct {
+	addr string
+	tls  bool
+	ln   net.Listener
+	srv  *redcon.Server
+}
+
+// countingListener wraps accepted sockets in countedConns.
+type countingListener struct {
+	net.Listener
+	s   *TrieServer
+	seq atomic.Uint64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	nc, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countedConn{Conn: nc, s: l.s, stripe: l.seq.Add(1)}, nil
+}
+
+// countedConn observes the traffic on a client socket. redcon flushes a
+// whole pipeline's replies in one Write, so each Write is the size of
+// that client's output buffer at the time. On TLS listeners it sits below
+// the TLS layer and counts the bytes on the wire.
+type countedConn struct {
+	net.Conn
+	s      *TrieServer
+	stripe uint64  // stripedCounter hint
+	client *client // set by the accept callback; nil until then
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.s.stats.netInput.add(c.stripe, int64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	c.s.outputPeak.observe(int64(len(p)), time.Now())
+	n, err := c.Conn.Write(p)
+	c.s.stats.netOutput.add(c.stripe, int64(n))
+	if c.client != nil {
+		c.client.flushed(n)
+	}
+	return n, err
+}
+
+// Listen binds every plaintext address, plus the TLS port on each of their
+// hosts when TLS is enabled. All addresses are bound before anything is
+// served, so one bad address fails startup instead of leaving a partially
+// reachable server.
+func (s *TrieServer) Listen(addrs []string) error {
+	if len(addrs) == 0 && !s.tls.enabled() {
+		return errors.New("nothing to listen on: set -addr and/or -tls-port")
+	}
+	var ls []*listener
+	bind := func(addr string, useTLS bool) error {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		ln = &countingListener{Listener: ln, s: s}
+		if useTLS {
+			ln = tls.NewListener(ln, s.tls.listenerConfig())
+		}
+		ln = inlineListener{ln}
+		ls = append(ls, &listener{
+			addr: ln.Addr().String(),
+			tls:  useTLS,
+			ln:   ln,
+			srv:  redcon.NewServer(addr, s.HandleCommand, s.accept, s.closed),
+		})
+		return nil
+	}
+	closeAll := func() {
+		for _, l := range ls {
+			l.ln.Close()
+		}
+	}
+
+	for _, addr := range addrs {
+		if err := bind(addr, false); err != nil {
+			closeAll()
+			return err
+		}
+	}
+	if s.tls.enabled() {
+		hosts := []string{"0.0.0.0"}
+		if len(addrs) > 0 {
+			hosts = hosts[:0]
+			seen := make(map[string]bool)
+			for _, addr := range addrs {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					closeAll()
+					return err
+				}
+				if !seen[host] {
+					seen[host] = true
+					hosts = append(hosts, host)
+				}
+			}
+		}
+		for _, host := range hosts {
+			if err := bind(net.JoinHostPort(host, strconv.Itoa(s.tls.port)), true); err != nil {
+				closeAll()
+				return err
+			}
+		}
+	}
+	s.listeners = ls
+	return nil
+}
+
+// Start runs the background work of a server, such as deleting expired
+// prefixes, closing idle clients, exporting spans and reloading files, for
+// the life of the process. Open and NewTrieServer start no goroutines, so a
+// server that is never started can be used and dropped, as tests and
+// embedders do: it still answers commands, expiring prefixes as they are
+// read.
+func (s *TrieServer) Start() {
+	go s.clientsCron()
+	go s.statsCron()
+	go s.lazyFree.run()
+	go s.expireCron()
+	if e := s.tracing.exporter.Load(); e != nil {
+		go e.run(&s.tracing)
+	}
+	if s.tls.enabled() {
+		go s.tls.reloadOnSIGHUP()
+	}
+	if s.reloader != nil {
+		go s.reloadCron(s.reloader)
+	}
+}
+
+// Serve runs every listener Listen bound until one of them fails or the
+// process receives SIGINT/SIGTERM, then closes all of them and waits for
+// them to stop.
+func (s *TrieServer) Serve() error {
+	defer s.lazyFree.abandon()
+	ls := s.listeners
+	errc := make(chan error, len(ls))
+	for _, l := range ls {
+		if l.tls {
+			slog.Info("Starting to serve TLS requests", "addr", l.addr)
+		} else {
+			slog.Info("Starting to serve requests", "addr", l.addr)
+		}
+		go func() {
+			err := l.srv.Serve(l.ln)
+			if err == nil {
+				err = fmt.Errorf("listener on %s stopped", l.addr)
+			}
+			errc <- err
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	var err error
+	select {
+	case err = <-errc:
+	case sig := <-stop:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+	for _, l := range ls {
+		l.srv.Close()
+		l.ln.Close() // in case Serve has not picked the listener up yet
+	}
+	remaining := len(ls)
+	if err != nil {
+		remaining--
+	}
+	for ; remaining > 0; remaining-- {
+		<-errc
+	}
+	return err
+}
+
+// tcpPort returns the port of the first plaintext listener, or 0 when only
+// TLS is served, matching Redis's single tcp_port field.
+func (s *TrieServer) tcpPort() int {
+	for _, l := range s.listeners {
+		if !l.tls {
+			if addr, ok := l.ln.Addr().(*net.TCPAddr); ok {
+				return addr.Port
+			}
+		}
+	}
+	return 0
+}
+
+// listenAddrs returns the bound addresses of one kind, for INFO.
+func (s *TrieServer) listenAddrs(useTLS bool) string {
+	var addrs []string
+	for _, l := range s.listeners {
+		if l.tls == useTLS {
+			addrs = append(addrs, l.addr)
+		}
+	}
+	return strings.Join(addrs, ",")
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serveTest serves s on a loopback port until the test ends and returns
+// its address.
+func serveTest(t testing.TB, s *TrieServer) string {
+	t.Helper()
+	if err := s.Listen([]string{"127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	ls := s.listeners
+	go ls[0].srv.Serve(ls[0].ln)
+	t.Cleanup(func() { ls[0].srv.Close() })
+	return ls[0].addr
+}
+
+// freePort returns a loopback port nothing listens on.
+func freePort(t testing.TB) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestListen(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	for _, tc := range []struct {
+		name      string
+		addrs     []string
+		tls       bool
+		wantPlain int
+		wantTLS   int
+		wantErr   bool
+	}{
+		{name: "one address", addrs: []string{"127.0.0.1:0"}, wantPlain: 1},
+		{name: "several addresses", addrs: []string{"127.0.0.1:0", "127.0.0.1:0"}, wantPlain: 2},
+		{name: "TLS once per host", addrs: []string{"127.0.0.1:0", "127.0.0.1:0"}, tls: true, wantPlain: 2, wantTLS: 1},
+		{name: "address in use", addrs: []string{"127.0.0.1:0", busy.Addr().String()}, wantErr: true},
+		{name: "address without port", addrs: []string{"127.0.0.1"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			if tc.tls {
+				s.tls.port = freePort(t)
+			}
+			err := s.Listen(tc.addrs)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Listen succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ls := s.listeners
+			defer func() {
+				for _, l := range ls {
+					l.ln.Close()
+				}
+			}()
+			info := mustDo(t, newTestSession(t, s), "INFO", "server").Str
+			for _, field := range []struct {
+				name string
+				tls  bool
+				want int
+			}{{"listen_addrs", false, tc.wantPlain}, {"tls_listen_addrs", true, tc.wantTLS}} {
+				var got []string
+				for _, l := range ls {
+					if l.tls == field.tls {
+						got = append(got, l.addr)
+					}
+				}
+				if len(got) != field.want {
+					t.Errorf("%d listeners with tls=%v, want %d", len(got), field.tls, field.want)
+				}
+				if line := field.name + ":" + strings.Join(got, ",") + "\r\n"; !strings.Contains(info, "\n"+line) && !strings.HasPrefix(info, line) {
+					t.Errorf("INFO server %q lacks %q", info, line)
+				}
+			}
+			if tc.tls && !strings.HasSuffix(s.listenAddrs(true), ":"+strconv.Itoa(s.tls.port)) {
+				t.Errorf("TLS listener %s not on tls-port %d", s.listenAddrs(true), s.tls.port)
+			}
+		})
+	}
+}
+
+func TestInfoSections(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	var def, all []string
+	for _, sec := range infoSections {
+		if !sec.extra {
+			def = append(def, "# "+sec.name)
+		}
+		all = append(all, "# "+sec.name)
+	}
+	for _, tc := range []struct {
+		section string
+		want    []string
+	}{
+		{"", def},
+		{"default", def},
+		{"all", all},
+		{"commandstats", []string{"# Commandstats"}},
+		{"SERVER", []string{"# Server"}},
+		{"keyspace", []string{"# Keyspace"}},
+		{"nosuchsection", nil},
+	} {
+		args := []string{"INFO"}
+		if tc.section != "" {
+			args = append(args, tc.section)
+		}
+		var got []string
+		for _, line := range strings.Split(mustDo(t, ss, args...).Str, "\r\n") {
+			if strings.HasPrefix(line, "# ") {
+				got = append(got, line)
+			}
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%q sections %q, want %q", args, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// logLevel is shared by the active handler so CONFIG SET loglevel takes
+// effect immediately.
+var logLevel = new(slog.LevelVar)
+
+// SetupLogging installs the default slog logger. Logs go to stderr unless
+// a file is given; format is "text" (key=value) or "json".
+func SetupLogging(format, file, level string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(lvl)
+
+	var w io.Writer = os.Stderr
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, opts)))
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	return nil
+}
+
+// parseLogLevel accepts debug, info, warn and error, plus Redis's own
+// verbose, notice and warning spellings.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug", "verbose":
+		return slog.LevelDebug, nil
+	case "info", "notice":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", s)
+}
+
+// registerLogConfig exposes the log level, and the fixed-at-startup
+// format and file, through CONFIG GET/SET.
+func (s *TrieServer) registerLogConfig(format, file string) {
+	s.addConfig("loglevel",
+		func() string { return strings.ToLower(logLevel.Level().String()) },
+		func(v string) error {
+			lvl, err := parseLogLevel(v)
+			if err != nil {
+				return err
+			}
+			logLevel.Set(lvl)
+			return nil
+		})
+	s.addConfig("log-format", func() string { return format }, nil)
+	s.addConfig("logfile", func() string { return file }, nil)
+	s.addConfig("log-slower-than",
+		func() string { return strconv.FormatInt(s.slowLogUsec.Load(), 10) },
+		func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < -1 {
+				return fmt.Errorf("argument must be microseconds, or -1 to disable")
+			}
+			s.slowLogUsec.Store(n)
+			return nil
+		})
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    slog.Level
+		wantErr bool
+	}{
+		{in: "debug", want: slog.LevelDebug},
+		{in: "verbose", want: slog.LevelDebug},
+		{in: "INFO", want: slog.LevelInfo},
+		{in: "notice", want: slog.LevelInfo},
+		{in: "warn", want: slog.LevelWarn},
+		{in: "warning", want: slog.LevelWarn},
+		{in: "error", want: slog.LevelError},
+		{in: "trace", wantErr: true},
+		{in: "", wantErr: true},
+	} {
+		got, err := parseLogLevel(tc.in)
+		if (err != nil) != tc.wantErr || err == nil && got != tc.want {
+			t.Errorf("parseLogLevel(%q) = %v, %v; want %v, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+// captureLogs points the default logger at a file for the rest of the
+// test, in format at level, and returns a function reading what it got.
+func captureLogs(t *testing.T, format, level string) func() string {
+	t.Helper()
+	prev, prevLevel := slog.Default(), logLevel.Level()
+	t.Cleanup(func() {
+		slog.SetDefault(prev)
+		logLevel.Set(prevLevel)
+	})
+	file := filepath.Join(t.TempDir(), "triedis.log")
+	if err := SetupLogging(format, file, level); err != nil {
+		t.Fatal(err)
+	}
+	return func() string {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	for _, tc := range []struct {
+		format, level string
+		want          []string // messages logged, of debug, info, warn and error
+	}{
+		{"text", "debug", []string{"d", "i", "w", "e"}},
+		{"text", "info", []string{"i", "w", "e"}},
+		{"json", "warning", []string{"w", "e"}},
+		{"json", "error", []string{"e"}},
+	} {
+		t.Run(tc.format+"/"+tc.level, func(t *testing.T) {
+			logs := captureLogs(t, tc.format, tc.level)
+			slog.Debug("d")
+			slog.Info("i")
+			slog.Warn("w")
+			slog.Error("e", "key", "value")
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(logs()), "\n") {
+				if tc.format == "json" {
+					var rec map[string]any
+					if err := json.Unmarshal([]byte(line), &rec); err != nil {
+						t.Fatalf("%q is not JSON: %v", line, err)
+					}
+					got = append(got, rec["msg"].(string))
+					continue
+				}
+				_, msg, _ := strings.Cut(line, " msg=")
+				msg, _, _ = strings.Cut(msg, " ")
+				got = append(got, msg)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("logged %q, want %q", got, tc.want)
+			}
+		})
+	}
+	if err := SetupLogging("xml", "", "info"); err == nil {
+		t.Error("SetupLogging accepted log format xml")
+	}
+}
+
+func TestLogConfig(t *testing.T) {
+	logs := captureLogs(t, "text", "info")
+	s := newTestServer(t)
+	s.registerLogConfig("text", "triedis.log")
+	ss := newTestSession(t, s)
+	for _, tc := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{args: []string{"loglevel", "warning"}},
+		{args: []string{"loglevel", "loud"}, wantErr: true},
+		{args: []string{"log-format", "json"}, wantErr: true},
+		{args: []string{"logfile", ""}, wantErr: true},
+		{args: []string{"log-slower-than", "-2"}, wantErr: true},
+		{args: []string{"log-slower-than", "0"}},
+	} {
+		if err := ss.Do(append([]string{"CONFIG", "SET"}, tc.args...)...).Err(); (err != nil) != tc.wantErr {
+			t.Errorf("CONFIG SET %q: %v, want error %v", tc.args, err, tc.wantErr)
+		}
+	}
+	if got := mustDo(t, ss, "CONFIG", "GET", "log*").strs(); strings.Join(got, " ") != "log-format text log-slower-than 0 logfile triedis.log loglevel warn" {
+		t.Errorf("CONFIG GET log* = %q", got)
+	}
+	mustDo(t, ss, "PING")
+	slog.Info("not logged at warn")
+	if out := logs(); !strings.Contains(out, `msg="slow command"`) || !strings.Contains(out, "cmd=PING") || strings.Contains(out, "not logged") {
+		t.Errorf("log:\n%s\nwant the slow PING at warn and nothing at info", out)
+	}
+}
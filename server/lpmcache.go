@@ -0,0 +1,148 @@
+package server
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tannerklineintz/triedis/trie"
+)
+
+// With lpm-cache-size set, each database remembers the answers of its
+// most recent longest-match lookups, those of GET without a MINLEN or
+// MAXLEN that narrows the match, HLOOKUP, MATCHDBS and the HTTP gateway:
+// the lookup, the prefix it matched and its value, or that it matched
+// none. Reads of an exact prefix, such as HGET, do not use it. A cached
+// answer is served without walking the trie, and still counts as a match
+// for OBJECT FREQ, HOTKEYS and the keyspace hits. Only a write to a
+// prefix covering a lookup can change its answer, so each write drops
+// the cached lookups within its prefix and no others; FLUSHDB drops them
+// all. The least recently used answer makes way once the cache is full.
+// A cached match that has since expired is looked up again.
+//
+// A lookup racing a write must not cache the answer from before it. Each
+// write bumps the cache's generation once applied, and a lookup caches
+// its answer only if the generation is still the one it saw before
+// reading the trie; a write that sees no answers cached skips dropping
+// them, so a lookup counts its answer in before checking the generation.
+
+// lpmResult is one cached lookup.
+type lpmResult struct {
+	key   netip.Prefix
+	match netip.Prefix
+	value value
+	ok    bool
+}
+
+// lpmCache is a database's cache of longest-match lookups.
+type lpmCache struct {
+	mu    sync.Mutex // guards byKey, keys and lru
+	byKey map[netip.Prefix]*list.Element
+	keys  *trie.Trie[struct{}] // the cached lookups, to find those a write covers
+	lru   list.List            // of *lpmResult, most recently used first
+
+	gen atomic.Uint64 // bumped by every write once applied
+	n   atomic.Int64  // answers cached, and being cached
+
+	hits, misses atomic.Int64
+}
+
+func newLPMCache() *lpmCache {
+	return &lpmCache{byKey: make(map[netip.Prefix]*list.Element), keys: trie.New[struct{}]()}
+}
+
+// generation returns the generation a lookup passes to put.
+func (c *lpmCache) generation() uint64 {
+	return c.gen.Load()
+}
+
+// get returns the cached answer for the lookup p, if any. limit is
+// lpm-cache-size; with 0 nothing is cached or counted.
+func (c *lpmCache) get(p netip.Prefix, limit int64) (r lpmResult, hit bool) {
+	if limit <= 0 {
+		return r, false
+	}
+	if c.n.Load() > 0 {
+		c.mu.Lock()
+		if e, ok := c.byKey[p]; ok {
+			r = *e.Value.(*lpmResult)
+			if r.ok && r.value.expired() {
+				c.removeLocked(e)
+			} else {
+				c.lru.MoveToFront(e)
+				hit = true
+			}
+		}
+		c.mu.Unlock()
+	}
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return r, hit
+}
+
+// put caches r, the answer read at generation gen, unless a write has
+// been applied since.
+func (c *lpmCache) put(r lpmResult, gen uint64, limit int64) {
+	if limit <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n.Add(1) // before checking gen, so that a racing write sees it
+	if _, dup := c.byKey[r.key]; dup || c.gen.Load() != gen {
+		c.n.Add(-1)
+		return
+	}
+	c.byKey[r.key] = c.lru.PushFront(&r)
+	c.keys.Insert(r.key, struct{}{})
+	for int64(c.lru.Len()) > limit {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// invalidate drops the cached lookups a write to p may have changed, those
+// within p, once the write is applied.
+func (c *lpmCache) invalidate(p netip.Prefix) {
+	c.gen.Add(1)
+	if c.n.Load() == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var stale []netip.Prefix
+	c.keys.Subnets(p, func(q netip.Prefix, _ struct{}) bool {
+		stale = append(stale, q)
+		return true
+	})
+	for _, q := range stale {
+		c.removeLocked(c.byKey[q])
+	}
+}
+
+// clear drops every cached lookup.
+func (c *lpmCache) clear() {
+	c.gen.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.byKey)
+	c.keys.Clear()
+	c.lru.Init()
+	c.n.Store(0)
+}
+
+func (c *lpmCache) removeLocked(e *list.Element) {
+	r := c.lru.Remove(e).(*lpmResult)
+	delete(c.byKey, r.key)
+	c.keys.Delete(r.key)
+	c.n.Add(-1)
+}
+
+func (c *lpmCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
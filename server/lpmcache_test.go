@@ -0,0 +1,246 @@
+package server
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestLPMCacheConcurrentWrites has clients reading hot addresses through
+// the cache while others store and delete the prefixes covering them.
+// Each /24 has one writer, which must read back every change it makes:
+// its own value after a SET, and after a DEL only an answer from a
+// shorter prefix, never a value it stored before. Once the writers stop,
+// every cached answer must match an uncached lookup.
+func TestLPMCache(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		size  string
+		steps []replyStep
+		stats string // lpm_cache_entries/hits/misses in DBSTATS afterwards
+	}{
+		{
+			name: "repeated lookups hit",
+			size: "64",
+			steps: []replyStep{
+				{[]string{"GET", "10.1.2.3"}, "ten"},
+				{[]string{"GET", "10.1.2.3"}, "ten"},
+				{[]string{"HLOOKUP", "10.1.2.3"}, "WRONGTYPE"},
+				{[]string{"GET", "192.0.2.1"}, "nil"},
+				{[]string{"GET", "192.0.2.1"}, "nil"}, // a miss is cached too
+			},
+			stats: "2/3/2",
+		},
+		{
+			name: "a covering write drops the lookup",
+			size: "64",
+			steps: []replyStep{
+				{[]string{"GET", "10.1.2.3"}, "ten"},
+				{[]string{"GET", "10.9.9.9"}, "ten"},
+				{[]string{"SET", "10.1.0.0/16", "narrower"}, "OK"},
+				{[]string{"GET", "10.1.2.3"}, "narrower"},
+				{[]string{"GET", "10.9.9.9"}, "ten"},
+				{[]string{"DEL", "10.1.0.0/16"}, "1"},
+				{[]string{"GET", "10.1.2.3"}, "ten"},
+			},
+			stats: "2/1/4",
+		},
+		{
+			name: "bounded lookups are not cached",
+			size: "64",
+			steps: []replyStep{
+				{[]string{"GET", "10.1.2.3", "MINLEN", "8"}, "ten"},
+				{[]string{"GET", "10.1.2.3", "MAXLEN", "16"}, "ten"},
+			},
+			stats: "0/0/0",
+		},
+		{
+			name: "the least recently used makes way",
+			size: "2",
+			steps: []replyStep{
+				{[]string{"GET", "10.0.0.1"}, "ten"},
+				{[]string{"GET", "10.0.0.2"}, "ten"},
+				{[]string{"GET", "10.0.0.1"}, "ten"},
+				{[]string{"GET", "10.0.0.3"}, "ten"},
+				{[]string{"GET", "10.0.0.2"}, "ten"},
+			},
+			stats: "2/1/4",
+		},
+		{
+			name:  "FLUSHDB empties it",
+			size:  "64",
+			steps: []replyStep{{[]string{"GET", "10.1.2.3"}, "ten"}, {[]string{"FLUSHDB"}, "OK"}, {[]string{"GET", "10.1.2.3"}, "nil"}},
+			stats: "1/0/2",
+		},
+		{
+			name:  "size 0 disables it",
+			size:  "0",
+			steps: []replyStep{{[]string{"GET", "10.1.2.3"}, "ten"}, {[]string{"GET", "10.1.2.3"}, "ten"}},
+			stats: "0/0/0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := newTestSession(t, newTestServer(t))
+			runSteps(t, ss, []replyStep{
+				{[]string{"CONFIG", "SET", "lpm-cache-size", tc.size}, "OK"},
+				{[]string{"SET", "10.0.0.0/8", "ten"}, "OK"},
+			})
+			runSteps(t, ss, tc.steps)
+			st := dbStats(t, ss, "0")
+			if got := strconv.FormatInt(st["lpm_cache_entries"], 10) + "/" + strconv.FormatInt(st["lpm_cache_hits"], 10) + "/" +
+				strconv.FormatInt(st["lpm_cache_misses"], 10); got != tc.stats {
+				t.Errorf("entries/hits/misses %s, want %s", got, tc.stats)
+			}
+		})
+	}
+
+	// A cached match that has since expired is looked up again.
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "lpm-cache-size", "64"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "ten"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", "brief", "PX", "5"}, "OK"},
+		{[]string{"GET", "10.1.2.3"}, "brief"},
+	})
+	time.Sleep(10 * time.Millisecond)
+	runSteps(t, ss, []replyStep{{[]string{"GET", "10.1.2.3"}, "ten"}})
+	if st := dbStats(t, ss, "0"); st["lpm_cache_hits"] != 0 || st["lpm_cache_misses"] != 2 {
+		t.Errorf("after an expiry: %d hits and %d misses, want 0 and 2", st["lpm_cache_hits"], st["lpm_cache_misses"])
+	}
+
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "lpm-cache-size", "-1"}, "ERR"},
+		{[]string{"CONFIG", "SET", "lpm-cache-size", "1000"}, "OK"},
+		{[]string{"CONFIG", "GET", "lpm-cache-size"}, "[lpm-cache-size 1000]"},
+	})
+}
+
+func TestLPMCacheConcurrentWrites(t *testing.T) {
+	s := newTestServer(t)
+	s.store.lpmCacheSize.Store(64)
+	nets := []string{"10.1.1", "10.1.2", "10.1.3", "2001:db8:0:1:"}
+	addr := func(i int) string {
+		if strings.HasSuffix(nets[i], ":") {
+			return nets[i] + ":5"
+		}
+		return nets[i] + ".5"
+	}
+	prefix := func(i int) string {
+		if strings.HasSuffix(nets[i], ":") {
+			return nets[i] + ":/64"
+		}
+		return nets[i] + ".0/24"
+	}
+	sessions := make(chan *testSession, 5+len(nets))
+	for range cap(sessions) {
+		sessions <- newTestSession(t, s)
+	}
+	stop := make(chan struct{})
+	var readers, writers sync.WaitGroup
+	for range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			ss := <-sessions
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ss.Do("GET", addr(i%len(nets)))
+			}
+		}()
+	}
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		ss := <-sessions
+		covering := []string{"10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32", "::/0"}
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			k := covering[i%len(covering)]
+			if i/len(covering)%2 == 0 {
+				ss.Do("SET", k, "short")
+			} else {
+				ss.Do("DEL", k)
+			}
+		}
+	}()
+	for i := range nets {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			ss := <-sessions
+			own := nets[i] + "#"
+			for n := range 500 {
+				v := own + strconv.Itoa(n)
+				if err := ss.Do("SET", prefix(i), v).Err(); err != nil {
+					t.Error(err)
+					return
+				}
+				if got := ss.Do("GET", addr(i)).Str; got != v {
+					t.Errorf("GET %s after SET %s %s = %q", addr(i), prefix(i), v, got)
+					return
+				}
+				if n%3 == 0 {
+					ss.Do("DEL", prefix(i))
+					if got := ss.Do("GET", addr(i)).Str; strings.HasPrefix(got, own) {
+						t.Errorf("GET %s after DEL %s = %q", addr(i), prefix(i), got)
+						return
+					}
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	ss := newTestSession(t, s)
+	cached := make([]Reply, len(nets))
+	for i := range nets {
+		cached[i] = mustDo(t, ss, "GET", addr(i))
+	}
+	if info := mustDo(t, ss, "INFO", "stats").Str; strings.Contains(info, "lpm_cache_hits:0\r\n") {
+		t.Fatalf("the lookups never hit the cache:\n%s", info)
+	}
+	mustDo(t, ss, "CONFIG", "SET", "lpm-cache-size", "0")
+	for i := range nets {
+		if uncached := mustDo(t, ss, "GET", addr(i)); cached[i].String() != uncached.String() {
+			t.Errorf("GET %s = %s from the cache, %s from the trie", addr(i), cached[i], uncached)
+		}
+	}
+}
+
+// TestLPMCacheStalePut makes the race the generation guards against
+// happen in order: a lookup reads the trie, a write covering it lands and
+// invalidates, and only then does the lookup cache what it read.
+func TestLPMCacheStalePut(t *testing.T) {
+	key := netip.MustParsePrefix("10.1.1.5/32")
+	stale := lpmResult{key: key, match: netip.MustParsePrefix("10.0.0.0/8"), value: stringValue([]byte("old")), ok: true}
+	for _, cached := range []bool{false, true} {
+		c := newLPMCache()
+		if cached {
+			// An answer for another lookup makes the write take the lock.
+			c.put(lpmResult{key: netip.MustParsePrefix("192.0.2.1/32")}, c.generation(), 64)
+		}
+		gen := c.generation()
+		c.invalidate(netip.MustParsePrefix("10.1.0.0/16"))
+		c.put(stale, gen, 64)
+		if _, hit := c.get(key, 64); hit {
+			t.Errorf("other answers cached %v: a lookup from before a covering write was cached", cached)
+		}
+		c.put(stale, c.generation(), 64)
+		if r, hit := c.get(key, 64); !hit || r.match != stale.match {
+			t.Errorf("other answers cached %v: a lookup after the write was not cached", cached)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// GET and MGET match the longest stored prefix whether they are given an
+// address or a CIDR. CLIENT LPM ON switches a connection to the split an
+// address lookup service makes, so an application moving from one keeps
+// its call sites: a bare address still matches the longest prefix, but a
+// CIDR reads the value stored at exactly that CIDR. GET with MINLEN
+// or MAXLEN asks for a match and always gets one. The mode is off for a
+// new connection and after RESET, and CLIENT INFO shows it as lpm=.
+
+// handleClientLPM implements CLIENT LPM on|off.
+func (s *TrieServer) handleClientLPM(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for 'CLIENT LPM'")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[2])) {
+	case "on":
+		c.lpm.Store(true)
+	case "off":
+		c.lpm.Store(false)
+	default:
+		conn.WriteError("ERR syntax error")
+		return
+	}
+	writeOK(conn)
+}
+
+// lookupGet returns the value plain GET or MGET key reads for c: the
+// longest match, or in CLIENT LPM mode the exact prefix of a CIDR key.
+func (c *client) lookupGet(db *database, key string) (value, bool) {
+	if c.lpm.Load() && strings.Contains(key, "/") {
+		return db.lookupExact(key)
+	}
+	return c.get(db, key)
+}
+
+// onOff formats a mode for CLIENT INFO.
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// handleReset implements RESET: the connection goes back to the state of
+// a new one, on database 0 with CLIENT LPM, CLIENT NO-EVICT and any
+// CLIENT TRACEPARENT cleared. Its name is kept, as Redis keeps it.
+func (s *TrieServer) handleReset(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		conn.WriteError("ERR wrong number of arguments for 'RESET'")
+		return
+	}
+	c.db.Store(0)
+	c.lpm.Store(false)
+	c.noEvict.Store(false)
+	c.traceParent = nil
+	conn.WriteString("RESET")
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+// clientField returns field of CLIENT INFO of ss.
+func clientField(t *testing.T, ss doer, field string) string {
+	t.Helper()
+	for _, kv := range strings.Fields(mustDo(t, ss, "CLIENT", "INFO").Str) {
+		if k, v, _ := strings.Cut(kv, "="); k == field {
+			return v
+		}
+	}
+	t.Fatalf("CLIENT INFO has no %s", field)
+	return ""
+}
+
+func TestClientLPM(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		ss := newTestSession(t, newTestServer(t))
+		if strict {
+			mustDo(t, ss, "CONFIG", "SET", "require-prefix-length", "yes")
+		}
+		mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+		mustDo(t, ss, "SET", "10.1.0.0/16", "b")
+
+		gets := []struct {
+			key      string
+			off, lpm string // "" for nil
+		}{
+			{"10.1.2.3", "b", "b"},
+			{"10.1.0.0/16", "b", "b"},
+			{"10.1.2.0/24", "b", ""},
+			{"10.0.0.0/8", "a", "a"},
+			{"10.2.0.0/16", "a", ""},
+			{"11.0.0.1", "", ""},
+		}
+		check := func(mode string) {
+			t.Helper()
+			if got := clientField(t, ss, "lpm"); got != mode {
+				t.Fatalf("strict %v: CLIENT INFO lpm=%s, want %s", strict, got, mode)
+			}
+			for _, g := range gets {
+				want := g.off
+				if mode == "on" {
+					want = g.lpm
+				}
+				if r := mustDo(t, ss, "GET", g.key); r.Str != want || (want == "") != (r.Type == NullReply) {
+					t.Errorf("strict %v, lpm %s: GET %s = %+v, want %q", strict, mode, g.key, r, want)
+				}
+			}
+			// Bounds ask for a match in either mode.
+			if r := mustDo(t, ss, "GET", "10.1.2.0/24", "MAXLEN", "24"); r.Str != "b" {
+				t.Errorf("strict %v, lpm %s: GET with MAXLEN = %+v, want b", strict, mode, r)
+			}
+		}
+		check("off")
+		mustDo(t, ss, "CLIENT", "LPM", "ON")
+		check("on")
+		mustDo(t, ss, "CLIENT", "LPM", "off")
+		check("off")
+		if err := ss.Do("CLIENT", "LPM", "maybe").Err(); err == nil {
+			t.Error("CLIENT LPM maybe succeeded")
+		}
+
+		// require-prefix-length refuses bare addresses as keys, not lookups.
+		if err := ss.Do("SET", "10.9.9.9", "c").Err(); (err != nil) != strict {
+			t.Errorf("strict %v: SET of a bare address: %v", strict, err)
+		}
+
+		mustDo(t, ss, "CLIENT", "LPM", "on")
+		mustDo(t, ss, "CLIENT", "SETNAME", "loader")
+		mustDo(t, ss, "CLIENT", "NO-EVICT", "on")
+		mustDo(t, ss, "SELECT", "1")
+		if r := mustDo(t, ss, "RESET"); r.Str != "RESET" {
+			t.Fatalf("RESET = %+v", r)
+		}
+		check("off")
+		if db, name := clientField(t, ss, "db"), clientField(t, ss, "name"); db != "0" || name != "loader" {
+			t.Errorf("strict %v: after RESET db=%s name=%s, want db=0 name=loader", strict, db, name)
+		}
+		if ss.conn.Context().(*client).noEvict.Load() {
+			t.Errorf("strict %v: RESET left CLIENT NO-EVICT on", strict)
+		}
+	}
+}
+
+func TestMGet(t *testing.T) {
+	s := newTestServer(t)
+	setup := newTestSession(t, s)
+	mustDo(t, setup, "SET", "10.0.0.0/8", "a")
+	mustDo(t, setup, "SET", "10.1.0.0/16", "b")
+	mustDo(t, setup, "SET", "2001:db8::/32", "v6")
+	mustDo(t, setup, "HSET", "192.0.2.0/24", "f", "v")
+	mustDo(t, setup, "SELECT", "1")
+	mustDo(t, setup, "SET", "10.0.0.0/8", "one")
+	mustDo(t, setup, "SETDEFAULT", "1", "unknown")
+
+	for _, tc := range []struct {
+		name  string
+		lpm   bool
+		steps []replyStep
+	}{
+		{"longest match", false, []replyStep{
+			{[]string{"MGET", "10.1.2.3", "10.2.0.1", "2001:db8::1", "11.0.0.1"}, "[b a v6 nil]"},
+			{[]string{"MGET", "10.1.2.0/24", "10.1.0.0/16", "10.0.0.0/8"}, "[b b a]"},
+		}},
+		{"exact CIDRs", true, []replyStep{
+			{[]string{"MGET", "10.1.2.3", "10.2.0.1", "2001:db8::1", "11.0.0.1"}, "[b a v6 nil]"},
+			{[]string{"MGET", "10.1.2.0/24", "10.1.0.0/16", "10.0.0.0/8", "2001:db8::/48"}, "[nil b a nil]"},
+		}},
+		{"wrong types read as nil", false, []replyStep{
+			{[]string{"MGET", "192.0.2.1", "10.1.2.3"}, "[nil b]"},
+			{[]string{"MGET", "192.0.2.0/24"}, "[nil]"},
+		}},
+		{"not an address", true, []replyStep{
+			{[]string{"MGET", "not-an-address", "10.0.0.1"}, "[nil a]"},
+		}},
+		{"default value", true, []replyStep{
+			{[]string{"SELECT", "1"}, "OK"},
+			{[]string{"MGET", "10.1.2.3", "11.0.0.1", "10.1.0.0/16", "not-an-address"}, "[one unknown unknown nil]"},
+		}},
+		{"arity", false, []replyStep{
+			{[]string{"MGET"}, "ERR wrong number of arguments for 'MGET'"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := newTestSession(t, s)
+			if tc.lpm {
+				mustDo(t, ss, "CLIENT", "LPM", "on")
+			}
+			runSteps(t, ss, tc.steps)
+		})
+	}
+}
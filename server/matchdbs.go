@@ -0,0 +1,99 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// handleMatchDBs implements MATCHDBS ip [DB index|name ...] [WITHMISSES]:
+// GET's longest match in each listed database, or every existing one, in
+// one round trip. The reply holds a [db, prefix, value] triple per
+// database that matched, in the order given or by index. With WITHMISSES
+// the others are included as [db, nil, default], the default being nil
+// unless the database has one. Hashes and sets have no single value and
+// are nil. Each database is searched under its own shard locks, so a
+// write to one never waits on the whole query.
+func (s *TrieServer) handleMatchDBs(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'MATCHDBS'")
+		return
+	}
+	key := string(cmd.Args[1])
+	if _, err := parsePrefix(key); err != nil {
+		writeError(conn, err)
+		return
+	}
+	var ids []int
+	listed, withMisses := false, false
+	for i := 2; i < len(cmd.Args); i++ {
+		switch arg := string(cmd.Args[i]); {
+		case strings.EqualFold(arg, "WITHMISSES"):
+			withMisses = true
+		case strings.EqualFold(arg, "DB") && !listed:
+			listed = true
+			for i+1 < len(cmd.Args) && !strings.EqualFold(string(cmd.Args[i+1]), "WITHMISSES") {
+				i++
+				id, err := s.resolveDB(string(cmd.Args[i]))
+				if err != nil {
+					writeError(conn, err)
+					return
+				}
+				ids = append(ids, id)
+			}
+			if len(ids) == 0 {
+				conn.WriteError("ERR DB needs at least one database")
+				return
+			}
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	if !listed {
+		for _, db := range s.databases() {
+			ids = append(ids, db.id)
+		}
+	}
+
+	type result struct {
+		id    int
+		entry *entry // nil on a miss
+	}
+	results := make([]result, 0, len(ids))
+	for _, id := range ids {
+		r := result{id: id}
+		if db := s.existingDB(id); db != nil {
+			p, _ := db.parseLookup(key)
+			if m, v, ok := db.longestMatchWithin(p, 0, p.Bits()); ok {
+				db.hits.add(uint64(c.id), 1)
+				r.entry = &entry{m, v}
+			} else {
+				db.misses.add(uint64(c.id), 1)
+			}
+		}
+		if r.entry != nil || withMisses {
+			results = append(results, r)
+		}
+	}
+	conn.WriteArray(len(results))
+	for _, r := range results {
+		conn.WriteArray(3)
+		conn.WriteInt(r.id)
+		if r.entry == nil {
+			conn.WriteNull()
+			if def, ok := s.defaults.get(r.id); ok {
+				conn.WriteBulk(def)
+			} else {
+				conn.WriteNull()
+			}
+			continue
+		}
+		conn.WriteBulkString(r.entry.prefix.String())
+		if r.entry.value.isString() {
+			conn.WriteBulk(r.entry.value.str)
+		} else {
+			conn.WriteNull()
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import "testing"
+
+func TestMatchDBs(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "blocked"}, "OK"},
+		{[]string{"SELECT", "1"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", "geo-a"}, "OK"},
+		{[]string{"SET", "10.1.2.0/24", "geo-b"}, "OK"},
+		{[]string{"SELECT", "2"}, "OK"},
+		{[]string{"HSET", "10.1.0.0/16", "asn", "64500"}, "1"},
+		{[]string{"NAMEDB", "1", "geo"}, "OK"},
+		{[]string{"SETDEFAULT", "5", "none"}, "OK"},
+		{[]string{"SELECT", "0"}, "OK"},
+	})
+	runSteps(t, ss, []replyStep{
+		{[]string{"MATCHDBS", "10.1.2.3"}, "[[0 10.0.0.0/8 blocked] [1 10.1.2.0/24 geo-b] [2 10.1.0.0/16 nil]]"},
+		{[]string{"MATCHDBS", "10.1.3.3"}, "[[0 10.0.0.0/8 blocked] [1 10.1.0.0/16 geo-a] [2 10.1.0.0/16 nil]]"},
+		{[]string{"MATCHDBS", "10.1.2.0/23"}, "[[0 10.0.0.0/8 blocked] [1 10.1.0.0/16 geo-a] [2 10.1.0.0/16 nil]]"},
+		{[]string{"MATCHDBS", "10.9.9.9", "DB", "geo", "0"}, "[[0 10.0.0.0/8 blocked]]"},
+		{[]string{"MATCHDBS", "10.9.9.9", "DB", "geo", "0", "WITHMISSES"}, "[[1 nil nil] [0 10.0.0.0/8 blocked]]"},
+		{[]string{"MATCHDBS", "10.9.9.9", "withmisses", "DB", "5", "7"}, "[[5 nil none] [7 nil nil]]"},
+		{[]string{"MATCHDBS", "192.0.2.1"}, "[]"},
+		{[]string{"MATCHDBS", "192.0.2.1", "WITHMISSES"}, "[[0 nil nil] [1 nil nil] [2 nil nil]]"}, // 5 and 7 were not created
+		{[]string{"MATCHDBS"}, "ERR wrong number of arguments for 'MATCHDBS'"},
+		{[]string{"MATCHDBS", "nope"}, "ERR"},
+		{[]string{"MATCHDBS", "10.1.2.3", "DB"}, "ERR DB needs at least one database"},
+		{[]string{"MATCHDBS", "10.1.2.3", "DB", "nosuch"}, "ERR unknown database name 'nosuch'"},
+		{[]string{"MATCHDBS", "10.1.2.3", "DB", "-1"}, "ERR invalid DB index"},
+		{[]string{"MATCHDBS", "10.1.2.3", "DB", "0", "WITHMISSES", "DB", "1"}, "ERR syntax error"},
+		{[]string{"MATCHDBS", "10.1.2.3", "LIMIT"}, "ERR syntax error"},
+	})
+
+	if st := dbStats(t, ss, "1"); st["hits"] != 3 || st["misses"] != 4 {
+		t.Errorf("DBSTATS 1 = %v, want 3 hits and 4 misses", st)
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// heapAlloc returns the bytes of live heap objects, the figure
+// runtime.MemStats calls HeapAlloc, without the stop-the-world pause
+// ReadMemStats costs, so the stats cron can sample it cheaply.
+func heapAlloc() int64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return int64(sample[0].Value.Uint64())
+}
+
+// observeMemory raises the recorded peak to n if it is higher.
+func (s *TrieServer) observeMemory(n int64) {
+	for {
+		cur := s.stats.peakMemory.Load()
+		if n <= cur || s.stats.peakMemory.CompareAndSwap(cur, n) {
+			return
+		}
+	}
+}
+
+// dbMemory is one database's share of the dataset estimate.
+type dbMemory struct {
+	id       int
+	keys     int64
+	dataset  int64 // entrySize of every prefix
+	overhead int64 // of which trie nodes and headers
+	distinct int64 // interned values
+	saved    int64 // bytes interning avoided; dataset counts them anyway
+
+	indexValues, indexKeys int64 // in the value index, with value-index on
+}
+
+func (m dbMemory) values() int64 { return m.dataset - m.overhead }
+
+// memoryByDB returns the dataset estimate of every database, by id.
+func (s *TrieServer) memoryByDB() []dbMemory {
+	var out []dbMemory
+	for _, db := range s.databases() {
+		keys := db.keyCount()
+		m := dbMemory{id: db.id, keys: keys, dataset: db.datasetBytes(), overhead: keys * entryOverhead,
+			distinct: db.pool.distinct.Load(), saved: db.pool.saved.Load()}
+		if ix := db.index.Load(); ix != nil {
+			m.indexValues, m.indexKeys = ix.distinct.Load(), ix.entries.Load()
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// memField is one name/value pair of the MEMORY STATS reply. value is an
+// int64, a float64 or a nested []memField.
+type memField struct {
+	name  string
+	value any
+}
+
+func writeMemFields(conn redcon.Conn, fields []memField) {
+	conn.WriteArray(len(fields) * 2)
+	for _, f := range fields {
+		conn.WriteBulkString(f.name)
+		switch v := f.value.(type) {
+		case int64:
+			conn.WriteInt64(v)
+		case float64:
+			conn.WriteBulkString(strconv.FormatFloat(v, 'f', 4, 64))
+		case []memField:
+			writeMemFields(conn, v)
+		}
+	}
+}
+
+// memoryStats builds the MEMORY STATS reply.
+func (s *TrieServer) memoryStats() []memField {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	used := int64(ms.HeapAlloc)
+	s.observeMemory(used)
+
+	var keys, dataset, saved int64
+	fields := []memField{
+		{"peak.allocated", s.stats.peakMemory.Load()},
+		{"total.allocated", used},
+		{"startup.allocated", s.startupMemory},
+	}
+	var dbs []memField
+	for _, m := range s.memoryByDB() {
+		keys += m.keys
+		dataset += m.dataset
+		saved += m.saved
+		dbs = append(dbs, memField{"db." + strconv.Itoa(m.id), []memField{
+			{"keys", m.keys},
+			{"dataset.bytes", m.dataset},
+			{"values.bytes", m.values()},
+			{"overhead.bytes", m.overhead},
+			{"interned.values", m.distinct},
+			{"interned.bytes-saved", m.saved},
+			{"value-index.values", m.indexValues},
+			{"value-index.keys", m.indexKeys},
+		}})
+	}
+	fields = append(fields, dbs...)
+	fields = append(fields,
+		memField{"overhead.total", max(used-dataset, 0)},
+		memField{"keys.count", keys},
+		memField{"keys.bytes-per-key", ratio(used, keys, 1)},
+		memField{"dataset.bytes", dataset},
+		memField{"dataset.percentage", ratio(dataset, used, 100)},
+		memField{"interned.bytes-saved", saved},
+		memField{"peak.percentage", ratio(used, s.stats.peakMemory.Load(), 100)},
+		memField{"allocator.allocated", used},
+		memField{"allocator.active", int64(ms.HeapInuse)},
+		memField{"allocator.resident", int64(ms.Sys - ms.HeapReleased)},
+		memField{"allocator.heap-objects", int64(ms.HeapObjects)},
+		memField{"allocator-fragmentation.ratio", ratio(int64(ms.HeapInuse), used, 1)},
+		memField{"allocator-fragmentation.bytes", int64(ms.HeapInuse) - used},
+		memField{"allocator.resident-overhead.ratio", ratio(int64(ms.Sys-ms.HeapReleased), int64(ms.HeapInuse), 1)},
+		memField{"gc.cycles", int64(ms.NumGC)},
+		memField{"gc.pause-total-ns", int64(ms.PauseTotalNs)},
+		memField{"gc.next-target", int64(ms.NextGC)},
+	)
+	return fields
+}
+
+// ratio returns a/b*scale, or 0 when b is 0.
+func ratio(a, b int64, scale float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b) * scale
+}
+
+// memoryDoctor returns human readable advice about the memory profile.
+func (s *TrieServer) memoryDoctor() string {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	used := int64(ms.HeapAlloc)
+	s.observeMemory(used)
+	peak := s.stats.peakMemory.Load()
+
+	byDB := s.memoryByDB()
+	var dataset int64
+	for _, m := range byDB {
+		dataset += m.dataset
+	}
+	if used < 5<<20 && dataset < 1<<20 {
+		return "This instance is empty or holds very little data, so there is nothing to diagnose.\n"
+	}
+
+	var advice []string
+	if peak > used*3/2 {
+		advice = append(advice, fmt.Sprintf("Peak memory was %s, more than 150%% of the %s in use now. "+
+			"A large delete or FLUSHDB freed it; the Go runtime returns it to the OS gradually.",
+			humanBytes(peak), humanBytes(used)))
+	}
+	if frag := ratio(int64(ms.HeapInuse), used, 1); frag > 1.4 {
+		advice = append(advice, fmt.Sprintf("Heap fragmentation is %.2f: %s of in-use spans hold no live objects.",
+			frag, humanBytes(int64(ms.HeapInuse)-used)))
+	}
+	if dataset > 0 && used > 64<<20 && ratio(dataset, used, 100) < 25 {
+		advice = append(advice, fmt.Sprintf("Only %.0f%% of the heap is accounted to the dataset; "+
+			"the rest is garbage awaiting collection, pipeline and reply buffers, or connection state.", ratio(dataset, used, 100)))
+	}
+	for _, m := range byDB {
+		if m.keys >= 10000 && ratio(m.values()-m.saved, m.dataset-m.saved, 100) >= 90 && !s.store.interning.Load() {
+			advice = append(advice, fmt.Sprintf("db%d has %d keys but %.0f%% of its memory is in values; "+
+				"consider value interning or storing shorter values.", m.id, m.keys, ratio(m.values(), m.dataset, 100)))
+		}
+		if m.keys >= 100000 && ratio(m.overhead, m.dataset, 100) >= 80 {
+			advice = append(advice, fmt.Sprintf("db%d has %d keys with tiny values, so %.0f%% of its memory is trie overhead.",
+				m.id, m.keys, ratio(m.overhead, m.dataset, 100)))
+		}
+	}
+	if len(advice) == 0 {
+		return "No memory issues found.\n"
+	}
+	return "Memory issues found:\n\n * " + strings.Join(advice, "\n\n * ") + "\n"
+}
+
+// handleMemory implements the MEMORY subcommands.
+func (s *TrieServer) handleMemory(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'MEMORY'")
+		return
+	}
+	sub := strings.ToUpper(string(cmd.Args[1]))
+
+	switch sub {
+	case "USAGE":
+		// MEMORY USAGE cidr [SAMPLES n]. Hashes and sets are sized by
+		// summing every entry, so there is nothing to sample; the option
+		// is accepted for compatibility.
+		if len(cmd.Args) != 3 && len(cmd.Args) != 5 {
+			conn.WriteError("ERR wrong number of arguments for 'MEMORY USAGE'")
+			return
+		}
+		if len(cmd.Args) == 5 {
+			n, err := strconv.Atoi(string(cmd.Args[4]))
+			if !strings.EqualFold(string(cmd.Args[3]), "SAMPLES") || err != nil || n < 0 {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+		}
+		v, ok := s.getDB(currentDB(conn)).peekExact(string(cmd.Args[2]))
+		if !ok {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteInt64(entrySize(v))
+
+	case "STATS":
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for 'MEMORY STATS'")
+			return
+		}
+		writeMemFields(conn, s.memoryStats())
+
+	case "DOCTOR":
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for 'MEMORY DOCTOR'")
+			return
+		}
+		conn.WriteBulkString(s.memoryDoctor())
+
+	default:
+		conn.WriteError("ERR unknown subcommand '" + sub + "' for 'MEMORY'")
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMemoryUsage(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	mustDo(t, ss, "SET", "10.0.0.0/8", "abcd")
+	mustDo(t, ss, "SET", "2001:db8::/32", "")
+	for _, tc := range []struct {
+		args    []string
+		want    int64
+		null    bool
+		wantErr bool
+	}{
+		{args: []string{"10.0.0.0/8"}, want: entryOverhead + 4},
+		{args: []string{"2001:db8::/32"}, want: entryOverhead},
+		{args: []string{"10.0.0.0/8", "SAMPLES", "5"}, want: entryOverhead + 4},
+		{args: []string{"10.0.0.0/8", "samples", "0"}, want: entryOverhead + 4},
+		{args: []string{"10.1.0.0/16"}, null: true}, // covered, not stored
+		{args: []string{"10.1.2.3"}, null: true},
+		{args: []string{"10.0.0.0/8", "SAMPLES", "-1"}, wantErr: true},
+		{args: []string{"10.0.0.0/8", "COUNT", "5"}, wantErr: true},
+		{args: []string{"10.0.0.0/8", "SAMPLES"}, wantErr: true},
+	} {
+		r := ss.Do(append([]string{"MEMORY", "USAGE"}, tc.args...)...)
+		switch {
+		case tc.wantErr:
+			if r.Err() == nil {
+				t.Errorf("MEMORY USAGE %q succeeded, want an error", tc.args)
+			}
+		case tc.null:
+			if r.Type != NullReply {
+				t.Errorf("MEMORY USAGE %q = %c%v, want null", tc.args, r.Type, r.Int)
+			}
+		case r.Int != tc.want:
+			t.Errorf("MEMORY USAGE %q = %d, want %d", tc.args, r.Int, tc.want)
+		}
+	}
+
+	// The keys' sizes add up to the dataset.
+	want := strconv.Itoa(2*entryOverhead + 4)
+	if got := infoFields(mustDo(t, ss, "INFO", "memory").Str)["used_memory_dataset"]; got != want {
+		t.Errorf("used_memory_dataset = %s, want %s", got, want)
+	}
+}
+
+// memFields returns the name/value pairs of a MEMORY STATS reply, nested
+// maps included.
+func memFields(r Reply) map[string]Reply {
+	out := map[string]Reply{}
+	for i := 0; i+1 < len(r.Array); i += 2 {
+		out[r.Array[i].Str] = r.Array[i+1]
+	}
+	return out
+}
+
+func TestMemoryStats(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	mustDo(t, ss, "SET", "10.0.0.0/8", "abcd")
+	mustDo(t, ss, "SET", "10.1.0.0/16", "ef")
+	mustDo(t, ss, "SELECT", "2")
+	mustDo(t, ss, "SET", "2001:db8::/32", "")
+
+	fields := memFields(mustDo(t, ss, "MEMORY", "STATS"))
+	for _, tc := range []struct {
+		db                                  string
+		keys, dataset, values, overheadSize int64
+	}{
+		{"db.0", 2, 2*entryOverhead + 6, 6, 2 * entryOverhead},
+		{"db.2", 1, entryOverhead, 0, entryOverhead},
+	} {
+		db := memFields(fields[tc.db])
+		for name, want := range map[string]int64{
+			"keys": tc.keys, "dataset.bytes": tc.dataset, "values.bytes": tc.values, "overhead.bytes": tc.overheadSize,
+		} {
+			if got := db[name].Int; got != want {
+				t.Errorf("%s %s = %d, want %d", tc.db, name, got, want)
+			}
+		}
+	}
+	if _, ok := fields["db.1"]; ok {
+		t.Error("MEMORY STATS lists db.1, which was never used")
+	}
+	if got := fields["keys.count"].Int; got != 3 {
+		t.Errorf("keys.count = %d, want 3", got)
+	}
+	if got, want := fields["dataset.bytes"].Int, int64(3*entryOverhead+6); got != want {
+		t.Errorf("dataset.bytes = %d, want %d", got, want)
+	}
+	if peak, total := fields["peak.allocated"].Int, fields["total.allocated"].Int; peak < total {
+		t.Errorf("peak.allocated %d is below total.allocated %d", peak, total)
+	}
+	if err := ss.Do("MEMORY", "STATS", "extra").Err(); err == nil {
+		t.Error("MEMORY STATS extra succeeded")
+	}
+}
+
+func TestMemoryDoctor(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	// What it finds depends on the test binary's heap; each reply is one
+	// of these.
+	got := mustDo(t, ss, "MEMORY", "DOCTOR").Str
+	if !strings.HasSuffix(got, "nothing to diagnose.\n") && got != "No memory issues found.\n" && !strings.HasPrefix(got, "Memory issues found:\n\n * ") {
+		t.Errorf("MEMORY DOCTOR = %q", got)
+	}
+}
+
+func TestObserveMemory(t *testing.T) {
+	s := newTestServer(t)
+	s.stats.peakMemory.Store(0)
+	for _, tc := range []struct{ n, want int64 }{
+		{100, 100},
+		{50, 100},
+		{300, 300},
+		{300, 300},
+	} {
+		s.observeMemory(tc.n)
+		if got := s.stats.peakMemory.Load(); got != tc.want {
+			t.Errorf("after observing %d the peak is %d, want %d", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestRatio(t *testing.T) {
+	for _, tc := range []struct {
+		a, b  int64
+		scale float64
+		want  float64
+	}{
+		{1, 4, 100, 25},
+		{3, 2, 1, 1.5},
+		{5, 0, 100, 0},
+		{0, 5, 100, 0},
+	} {
+		if got := ratio(tc.a, tc.b, tc.scale); got != tc.want {
+			t.Errorf("ratio(%d, %d, %v) = %v, want %v", tc.a, tc.b, tc.scale, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// mergeResult tallies one DBMERGE.
+type mergeResult struct {
+	copied, overwritten, skipped int64
+}
+
+// mergeDBs copies every prefix of src into dst, resolving prefixes stored
+// in both by mode. src is read-locked and dst write-locked as a whole
+// throughout, so readers of dst see it either before or after the merge,
+// never part way. In conflictAbort mode a first pass looks for conflicts,
+// and dst is left untouched if there is one. Values are shared, not
+// copied, as they are never modified in place.
+func mergeDBs(src, dst *database, mode conflictMode) (mergeResult, error) {
+	// Lock in id order, as DBDIFF does.
+	if src.id < dst.id {
+		defer src.rlockAll()()
+		defer dst.lockAll()()
+	} else {
+		defer dst.lockAll()()
+		defer src.rlockAll()()
+	}
+
+	var res mergeResult
+	srcShards, dstShards := src.allShards(), dst.allShards()
+	if mode == conflictAbort {
+		var conflict netip.Prefix
+		for i, sh := range srcShards {
+			sh.trie.Walk(func(p netip.Prefix, _ value) bool {
+				if _, ok := dstShards[i].trie.Get(p); ok {
+					conflict = p
+					return false
+				}
+				return true
+			})
+			if conflict.IsValid() {
+				return res, fmt.Errorf("%s is stored in both databases", conflict)
+			}
+		}
+	}
+	for i, sh := range srcShards {
+		sh.trie.Walk(func(p netip.Prefix, v value) bool {
+			switch existed := dst.storeLocked(dstShards[i], p, v, mode == conflictReplace); {
+			case !existed:
+				res.copied++
+			case mode == conflictReplace:
+				res.overwritten++
+			default:
+				res.skipped++
+			}
+			return true
+		})
+	}
+	return res, nil
+}
+
+// handleDBMerge implements DBMERGE src dst [OVERWRITE|SKIP|ERROR]. A
+// prefix stored in both gets src's value by default; SKIP keeps dst's and
+// ERROR refuses the whole merge.
+func (s *TrieServer) handleDBMerge(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) != 3 && len(cmd.Args) != 4 {
+		conn.WriteError("ERR wrong number of arguments for 'DBMERGE'")
+		return
+	}
+	var ids [2]int
+	for i := range ids {
+		id, err := s.resolveDB(string(cmd.Args[1+i]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		ids[i] = id
+	}
+	mode := conflictReplace
+	if len(cmd.Args) == 4 {
+		switch strings.ToUpper(string(cmd.Args[3])) {
+		case "OVERWRITE":
+			mode = conflictReplace
+		case "SKIP":
+			mode = conflictSkip
+		case "ERROR":
+			mode = conflictAbort
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	if ids[0] == ids[1] {
+		conn.WriteError("ERR source and destination databases are the same")
+		return
+	}
+	if err := s.writable(ids[1]); err != nil {
+		writeError(conn, err)
+		return
+	}
+	for _, id := range ids {
+		if err := s.journal.refusal(id); err != nil {
+			writeError(conn, err)
+			return
+		}
+	}
+	jid, err := s.journal.begin("DBMERGE", ids[1], journalParams("src", strconv.Itoa(ids[0]), "conflict", conflictNames[mode]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+
+	dst := s.getDB(ids[1])
+	res, err := mergeDBs(s.getDB(ids[0]), dst, mode)
+	s.journal.end(jid)
+	if err != nil {
+		conn.WriteError("ERR merge refused: " + err.Error())
+		return
+	}
+	if res.copied+res.overwritten > 0 {
+		dst.writes.add(uint64(c.id), 1)
+		s.auditDB(c, ids[1], "DBMERGE")
+	}
+	conn.WriteArray(6)
+	conn.WriteBulkString("copied")
+	conn.WriteInt64(res.copied)
+	conn.WriteBulkString("overwritten")
+	conn.WriteInt64(res.overwritten)
+	conn.WriteBulkString("skipped")
+	conn.WriteInt64(res.skipped)
+}
@@ -0,0 +1,53 @@
+package server
+
+import "testing"
+
+func TestDBMerge(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		mode  []string
+		want  string
+		after string // DBDIFF 0 1 VALUES afterwards
+		get   string // GET 10.1.2.3 in db 1 afterwards
+	}{
+		{name: "default", want: "[copied 2 overwritten 1 skipped 0]", after: "[only-a 0 only-b 1 changed 0]", get: "a"},
+		{name: "overwrite", mode: []string{"OVERWRITE"}, want: "[copied 2 overwritten 1 skipped 0]", after: "[only-a 0 only-b 1 changed 0]", get: "a"},
+		{name: "skip", mode: []string{"skip"}, want: "[copied 2 overwritten 0 skipped 1]", after: "[only-a 0 only-b 1 changed 1]", get: "old"},
+		{name: "error", mode: []string{"ERROR"}, want: "ERR merge refused", after: "[only-a 2 only-b 1 changed 1]", get: "old"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := newTestSession(t, newTestServer(t))
+			mustDo(t, ss, "NAMEDB", "1", "dst")
+			mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+			mustDo(t, ss, "SET", "192.0.2.0/24", "b")
+			mustDo(t, ss, "HSET", "2001:db8::/32", "f", "v")
+			mustDo(t, ss, "SELECT", "dst")
+			mustDo(t, ss, "SET", "10.0.0.0/8", "old")
+			mustDo(t, ss, "SET", "198.51.100.0/24", "c")
+			writes := dbStats(t, ss)["writes"]
+			runSteps(t, ss, []replyStep{
+				{append([]string{"DBMERGE", "0", "dst"}, tc.mode...), tc.want},
+				{[]string{"DBDIFF", "0", "1", "VALUES"}, tc.after},
+				{[]string{"GET", "10.1.2.3"}, tc.get},
+			})
+			if got, changed := dbStats(t, ss)["writes"], tc.name != "error"; (got > writes) != changed {
+				t.Errorf("writes %d, then %d", writes, got)
+			}
+			if tc.name != "error" {
+				runSteps(t, ss, []replyStep{
+					{[]string{"HGET", "2001:db8::/32", "f"}, "v"},
+					{[]string{"DBSIZE"}, "4"},
+				})
+			}
+		})
+	}
+
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"DBMERGE", "0", "0"}, "ERR source and destination databases are the same"},
+		{[]string{"DBMERGE", "0"}, "ERR wrong number of arguments for 'DBMERGE'"},
+		{[]string{"DBMERGE", "0", "1", "MAYBE"}, "ERR syntax error"},
+		{[]string{"DBMERGE", "0", "nosuch"}, "ERR unknown database name"},
+		{[]string{"DBMERGE", "5", "1"}, "[copied 0 overwritten 0 skipped 0]"},
+	})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+)
+
+// ServeMetrics serves Prometheus metrics on its own HTTP listener, never
+// on a RESP port. The address is bound before returning so a bad
+// -metrics-addr fails startup.
+func (s *TrieServer) ServeMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w)
+	})
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("metrics listener stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// writeMetrics renders every metric in the Prometheus text format.
+func (s *TrieServer) writeMetrics(w io.Writer) {
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("triedis_commands_total", "counter", "Commands processed, by command.")
+	for _, name := range s.cmdStats.names() {
+		if n := s.cmdStats[name].calls.Load(); n > 0 {
+			fmt.Fprintf(w, "triedis_commands_total{cmd=%q} %d\n", strings.ToLower(name), n)
+		}
+	}
+
+	metric("triedis_command_duration_seconds", "histogram", "Command execution latency, by command.")
+	for _, name := range s.cmdStats.names() {
+		st := s.cmdStats[name]
+		calls := st.calls.Load()
+		if calls == 0 {
+			continue
+		}
+		cmd := strings.ToLower(name)
+		var cum int64
+		for i, le := range latencyBuckets {
+			cum += st.buckets[i].Load()
+			fmt.Fprintf(w, "triedis_command_duration_seconds_bucket{cmd=%q,le=\"%g\"} %d\n",
+				cmd, float64(le)/1e6, cum)
+		}
+		cum += st.buckets[len(latencyBuckets)].Load()
+		fmt.Fprintf(w, "triedis_command_duration_seconds_bucket{cmd=%q,le=\"+Inf\"} %d\n", cmd, cum)
+		fmt.Fprintf(w, "triedis_command_duration_seconds_sum{cmd=%q} %g\n", cmd, float64(st.nanos.Load())/1e9)
+		fmt.Fprintf(w, "triedis_command_duration_seconds_count{cmd=%q} %d\n", cmd, cum)
+	}
+
+	metric("triedis_command_latency_seconds", "summary", "Command execution latency percentiles, by command.")
+	for _, name := range s.cmdStats.names() {
+		st := s.cmdStats[name]
+		ds, ok := st.latency.percentiles(latencyPercentiles[:])
+		if !ok {
+			continue
+		}
+		cmd := strings.ToLower(name)
+		for i, p := range latencyPercentiles {
+			fmt.Fprintf(w, "triedis_command_latency_seconds{cmd=%q,quantile=\"%.4g\"} %g\n", cmd, p/100, ds[i].Seconds())
+		}
+		fmt.Fprintf(w, "triedis_command_latency_seconds_sum{cmd=%q} %g\n", cmd, float64(st.nanos.Load())/1e9)
+		fmt.Fprintf(w, "triedis_command_latency_seconds_count{cmd=%q} %d\n", cmd, st.calls.Load())
+	}
+
+	metric("triedis_db_keys", "gauge", "Keys stored, by database.")
+	for _, db := range s.databases() {
+		fmt.Fprintf(w, "triedis_db_keys{db=\"%d\",family=\"ipv4\"} %d\n", db.id, db.keys4.Load())
+		fmt.Fprintf(w, "triedis_db_keys{db=\"%d\",family=\"ipv6\"} %d\n", db.id, db.keys6.Load())
+	}
+
+	metric("triedis_connected_clients", "gauge", "Open client connections.")
+	fmt.Fprintf(w, "triedis_connected_clients %d\n", s.clients.count())
+
+	metric("triedis_idle_timeout_disconnections_total", "counter", "Clients closed by the idle timeout.")
+	fmt.Fprintf(w, "triedis_idle_timeout_disconnections_total %d\n", s.idleClosed.Load())
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	for _, m := range []struct {
+		name, typ, help string
+		value           uint64
+	}{
+		{"triedis_memory_heap_alloc_bytes", "gauge", "Bytes of allocated heap objects.", ms.HeapAlloc},
+		{"triedis_memory_heap_inuse_bytes", "gauge", "Bytes in in-use heap spans.", ms.HeapInuse},
+		{"triedis_memory_sys_bytes", "gauge", "Bytes of memory obtained from the OS.", ms.Sys},
+		{"triedis_memory_heap_objects", "gauge", "Allocated heap objects.", ms.HeapObjects},
+		{"triedis_gc_cycles_total", "counter", "Completed GC cycles.", uint64(ms.NumGC)},
+	} {
+		metric(m.name, m.typ, m.help)
+		fmt.Fprintf(w, "%s %d\n", m.name, m.value)
+	}
+}
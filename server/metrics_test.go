@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyBuckets(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want int // bucket index, len(latencyBuckets) for +Inf
+	}{
+		{0, 0},
+		{5 * time.Microsecond, 0},
+		{10 * time.Microsecond, 0},
+		{11 * time.Microsecond, 1},
+		{time.Millisecond, 6},
+		{time.Second, len(latencyBuckets) - 1},
+		{2 * time.Second, len(latencyBuckets)},
+	} {
+		var st commandStat
+		st.record(tc.d)
+		for i := range st.buckets {
+			want := int64(0)
+			if i == tc.want {
+				want = 1
+			}
+			if n := st.buckets[i].Load(); n != want {
+				t.Errorf("%v: bucket %d holds %d, want %d", tc.d, i, n, want)
+			}
+		}
+		if st.calls.Load() != 1 || st.nanos.Load() != int64(tc.d) {
+			t.Errorf("%v: calls %d, nanos %d", tc.d, st.calls.Load(), st.nanos.Load())
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+	mustDo(t, ss, "SET", "10.1.0.0/16", "b")
+	mustDo(t, ss, "GET", "10.1.2.3")
+	mustDo(t, ss, "SELECT", "2")
+	mustDo(t, ss, "SET", "2001:db8::/32", "c")
+
+	var b bytes.Buffer
+	s.writeMetrics(&b)
+	lines := strings.Split(b.String(), "\n")
+	for _, tc := range []struct {
+		metric string
+		want   int64 // -1 for any value
+	}{
+		{`triedis_commands_total{cmd="set"}`, 3},
+		{`triedis_commands_total{cmd="get"}`, 1},
+		{`triedis_command_duration_seconds_count{cmd="set"}`, 3},
+		{`triedis_command_duration_seconds_bucket{cmd="get",le="+Inf"}`, 1},
+		{`triedis_db_keys{db="0",family="ipv4"}`, 2},
+		{`triedis_db_keys{db="0",family="ipv6"}`, 0},
+		{`triedis_db_keys{db="2",family="ipv4"}`, 0},
+		{`triedis_db_keys{db="2",family="ipv6"}`, 1},
+		{`triedis_connected_clients`, 1},
+		{`triedis_idle_timeout_disconnections_total`, 0},
+		{`triedis_memory_heap_alloc_bytes`, -1},
+		{`triedis_gc_cycles_total`, -1},
+	} {
+		found := false
+		for _, line := range lines {
+			v, ok := strings.CutPrefix(line, tc.metric+" ")
+			if !ok {
+				continue
+			}
+			found = true
+			if n, err := strconv.ParseInt(v, 10, 64); err != nil || tc.want >= 0 && n != tc.want {
+				t.Errorf("%s = %s, want %d", tc.metric, v, tc.want)
+			}
+		}
+		if !found {
+			t.Errorf("no %s in\n%s", tc.metric, b.String())
+		}
+	}
+	if strings.Contains(b.String(), `cmd="dbsize"`) {
+		t.Error("metrics list a command that never ran")
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	s := newTestServer(t)
+	addr := "127.0.0.1:" + strconv.Itoa(freePort(t))
+	if err := s.ServeMetrics(addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ServeMetrics(addr); err == nil {
+		t.Error("ServeMetrics on a bound address succeeded")
+	}
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q, want the Prometheus text format", ct)
+	}
+	if !strings.Contains(string(body), "# TYPE triedis_connected_clients gauge\n") {
+		t.Errorf("/metrics lacks triedis_connected_clients:\n%s", body)
+	}
+}
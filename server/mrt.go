@@ -0,0 +1,439 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IMPORT ... FORMAT mrt reads BGP routing tables as RouteViews and RIPE
+// RIS publish them: MRT TABLE_DUMP_V2 RIB dumps (RFC 6396, with the
+// ADD-PATH subtypes of RFC 8050), optionally gzipped or bzip2ed. Each
+// unicast prefix announced is stored with a value rendered from a
+// template, by default its origin AS. Multicast RIBs, RIB_GENERIC and
+// records of other types, such as BGP4MP updates, are skipped.
+//
+// A RIB record lists every collector peer's path to its prefix, and those
+// may disagree. With MULTIPATH shortest, the default, the prefix gets the
+// value of the shortest AS path, counted as BGP counts it (an AS_SET is
+// one hop, confederation segments none), the earliest in the record
+// winning a tie. With MULTIPATH all it gets a set of every distinct value
+// the paths render to, so an origin conflict is kept rather than decided.
+
+const (
+	mrtTableDumpV2 = 13
+
+	mrtPeerIndexTable     = 1
+	mrtRIBIPv4Unicast     = 2
+	mrtRIBIPv6Unicast     = 4
+	mrtRIBIPv4UnicastPath = 8 // ADD-PATH
+	mrtRIBIPv6UnicastPath = 10
+
+	bgpAttrExtendedLength = 0x10
+	bgpAttrASPath         = 2
+
+	asSet            = 1
+	asSequence       = 2
+	asConfedSequence = 3
+	asConfedSet      = 4
+
+	// maxMRTRecord bounds one record, far above the largest RIB entry a
+	// collector writes, so a corrupt length fails rather than allocates.
+	maxMRTRecord = 1 << 24
+
+	// mrtProgressEvery is how often a long MRT import logs its progress.
+	mrtProgressEvery = 10 * time.Second
+)
+
+var errMRTShort = errors.New("record too short")
+
+// mrtTemplate is a parsed TEMPLATE: literal text and fields alternating.
+type mrtTemplate []mrtPart
+
+type mrtPart struct {
+	text  string
+	field string // origin, path, peer or peer-as; empty for text
+}
+
+// parseMRTTemplate parses t, in which {origin}, {path}, {peer} and
+// {peer-as} stand for a route's origin AS, its AS path, and the address
+// and AS of the collector peer it was learned from.
+func parseMRTTemplate(t string) (mrtTemplate, error) {
+	var tmpl mrtTemplate
+	for t != "" {
+		i := strings.IndexByte(t, '{')
+		if i < 0 {
+			tmpl = append(tmpl, mrtPart{text: t})
+			break
+		}
+		if i > 0 {
+			tmpl = append(tmpl, mrtPart{text: t[:i]})
+		}
+		j := strings.IndexByte(t[i:], '}')
+		if j < 0 {
+			return nil, errors.New("unterminated '{' in TEMPLATE")
+		}
+		switch field := t[i+1 : i+j]; field {
+		case "origin", "path", "peer", "peer-as":
+			tmpl = append(tmpl, mrtPart{field: field})
+		default:
+			return nil, fmt.Errorf("unknown field '{%s}' in TEMPLATE, expected {origin}, {path}, {peer} or {peer-as}", field)
+		}
+		t = t[i+j+1:]
+	}
+	return tmpl, nil
+}
+
+// mrtPeer is one entry of a PEER_INDEX_TABLE.
+type mrtPeer struct {
+	addr netip.Addr
+	as   uint32
+}
+
+// asSegment is one segment of an AS_PATH attribute.
+type asSegment struct {
+	typ  byte
+	asns []uint32
+}
+
+// pathLength counts path's hops as BGP best-path selection does.
+func pathLength(path []asSegment) int {
+	n := 0
+	for _, seg := range path {
+		switch seg.typ {
+		case asSequence:
+			n += len(seg.asns)
+		case asSet:
+			n++
+		}
+	}
+	return n
+}
+
+// appendSegment appends seg as bgpdump prints it: a sequence as ASNs
+// separated by spaces, a set in braces separated by commas, and
+// confederation segments likewise in parentheses and brackets.
+func appendSegment(b []byte, seg asSegment) []byte {
+	start, sep, end := "", " ", ""
+	switch seg.typ {
+	case asSet:
+		start, sep, end = "{", ",", "}"
+	case asConfedSequence:
+		start, end = "(", ")"
+	case asConfedSet:
+		start, sep, end = "[", ",", "]"
+	}
+	b = append(b, start...)
+	for i, as := range seg.asns {
+		if i > 0 {
+			b = append(b, sep...)
+		}
+		b = strconv.AppendUint(b, uint64(as), 10)
+	}
+	return append(b, end...)
+}
+
+// render appends the value tmpl gives a route over path from peer.
+func (tmpl mrtTemplate) render(b []byte, path []asSegment, peer mrtPeer) []byte {
+	for _, part := range tmpl {
+		switch part.field {
+		case "":
+			b = append(b, part.text...)
+		case "path":
+			for i, seg := range path {
+				if i > 0 {
+					b = append(b, ' ')
+				}
+				b = appendSegment(b, seg)
+			}
+		case "origin":
+			// The last AS of the last non-confederation segment, or
+			// the whole set if the path ends in an aggregate's AS_SET.
+			for i := len(path) - 1; i >= 0; i-- {
+				if seg := path[i]; seg.typ == asSequence {
+					b = strconv.AppendUint(b, uint64(seg.asns[len(seg.asns)-1]), 10)
+					break
+				} else if seg.typ == asSet {
+					b = appendSegment(b, seg)
+					break
+				}
+			}
+		case "peer":
+			b = append(b, peer.addr.String()...)
+		case "peer-as":
+			b = strconv.AppendUint(b, uint64(peer.as), 10)
+		}
+	}
+	return b
+}
+
+// parsePeerIndex parses a PEER_INDEX_TABLE record.
+func parsePeerIndex(rec []byte) ([]mrtPeer, error) {
+	if len(rec) < 6 {
+		return nil, errMRTShort
+	}
+	viewLen := int(binary.BigEndian.Uint16(rec[4:]))
+	rec = rec[6:]
+	if len(rec) < viewLen+2 {
+		return nil, errMRTShort
+	}
+	count := int(binary.BigEndian.Uint16(rec[viewLen:]))
+	rec = rec[viewLen+2:]
+	peers := make([]mrtPeer, 0, count)
+	for range count {
+		if len(rec) < 5 {
+			return nil, errMRTShort
+		}
+		typ := rec[0]
+		rec = rec[5:] // type and BGP ID
+		n := 4
+		if typ&1 != 0 {
+			n = 16
+		}
+		asLen := 2
+		if typ&2 != 0 {
+			asLen = 4
+		}
+		if len(rec) < n+asLen {
+			return nil, errMRTShort
+		}
+		addr, _ := netip.AddrFromSlice(rec[:n])
+		var as uint32
+		if asLen == 4 {
+			as = binary.BigEndian.Uint32(rec[n:])
+		} else {
+			as = uint32(binary.BigEndian.Uint16(rec[n:]))
+		}
+		peers = append(peers, mrtPeer{addr: addr, as: as})
+		rec = rec[n+asLen:]
+	}
+	return peers, nil
+}
+
+// parseASPath finds the AS_PATH in a route's attributes, which TABLE_DUMP_V2
+// always encodes with four-byte ASNs. It returns nil if there is none.
+func parseASPath(attrs []byte) ([]asSegment, error) {
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return nil, errMRTShort
+		}
+		flags, typ := attrs[0], attrs[1]
+		n, hdr := int(attrs[2]), 3
+		if flags&bgpAttrExtendedLength != 0 {
+			if len(attrs) < 4 {
+				return nil, errMRTShort
+			}
+			n, hdr = int(binary.BigEndian.Uint16(attrs[2:])), 4
+		}
+		if len(attrs) < hdr+n {
+			return nil, errMRTShort
+		}
+		body := attrs[hdr : hdr+n]
+		attrs = attrs[hdr+n:]
+		if typ != bgpAttrASPath {
+			continue
+		}
+		var path []asSegment
+		for len(body) > 0 {
+			if len(body) < 2 || len(body) < 2+4*int(body[1]) || body[1] == 0 {
+				return nil, errors.New("malformed AS_PATH")
+			}
+			seg := asSegment{typ: body[0], asns: make([]uint32, body[1])}
+			if seg.typ < asSet || seg.typ > asConfedSet {
+				return nil, fmt.Errorf("unknown AS_PATH segment type %d", seg.typ)
+			}
+			for i := range seg.asns {
+				seg.asns[i] = binary.BigEndian.Uint32(body[2+4*i:])
+			}
+			path = append(path, seg)
+			body = body[2+4*len(seg.asns):]
+		}
+		return path, nil
+	}
+	return nil, nil
+}
+
+// mrtImport is the state of one MRT import.
+type mrtImport struct {
+	d     *database
+	opts  importOptions
+	tmpl  mrtTemplate
+	all   bool
+	peers []mrtPeer
+	res   importResult
+	buf   []byte
+}
+
+// rib loads one RIB record of the family with addrLen-byte addresses,
+// returning an error for a malformed one and an *importConflict or
+// *quotaError to stop.
+func (m *mrtImport) rib(rec []byte, addrLen int, addPath bool) error {
+	if len(rec) < 5 {
+		return errMRTShort
+	}
+	bits := int(rec[4])
+	n := (bits + 7) / 8
+	if bits > 8*addrLen || len(rec) < 5+n+2 {
+		return errMRTShort
+	}
+	var raw [16]byte
+	copy(raw[:], rec[5:5+n])
+	var addr netip.Addr
+	if addrLen == 4 {
+		addr = netip.AddrFrom4([4]byte(raw[:4]))
+	} else {
+		addr = netip.AddrFrom16(raw)
+	}
+	p := netip.PrefixFrom(addr, bits).Masked()
+	count := int(binary.BigEndian.Uint16(rec[5+n:]))
+	rec = rec[5+n+2:]
+
+	var best []byte
+	bestLen := -1
+	var set map[string]struct{}
+	for range count {
+		hdr := 8
+		if addPath {
+			hdr = 12
+		}
+		if len(rec) < hdr {
+			return errMRTShort
+		}
+		peerIndex := int(binary.BigEndian.Uint16(rec))
+		attrLen := int(binary.BigEndian.Uint16(rec[hdr-2:]))
+		if len(rec) < hdr+attrLen {
+			return errMRTShort
+		}
+		attrs := rec[hdr : hdr+attrLen]
+		rec = rec[hdr+attrLen:]
+		m.res.routes++
+		if peerIndex >= len(m.peers) {
+			return fmt.Errorf("peer index %d not in the peer index table", peerIndex)
+		}
+		path, err := parseASPath(attrs)
+		if err != nil {
+			return err
+		}
+		if len(path) == 0 {
+			continue // the collector's own route; it has no origin AS
+		}
+		if l := pathLength(path); m.all || bestLen < 0 || l < bestLen {
+			m.buf = m.tmpl.render(m.buf[:0], path, m.peers[peerIndex])
+			if m.all {
+				if set == nil {
+					set = make(map[string]struct{})
+				}
+				set[string(m.buf)] = struct{}{}
+			} else {
+				best, bestLen = append(best[:0], m.buf...), l
+			}
+		}
+	}
+	var v value
+	switch {
+	case set != nil:
+		v = value{set: set}
+	case bestLen >= 0:
+		v = stringValue(best)
+	default:
+		m.res.skipped++
+		return nil
+	}
+	existed, err := m.d.storeChecked(p, v, m.opts.conflict == conflictReplace)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !existed:
+		m.res.inserted++
+	case m.opts.conflict == conflictReplace:
+		m.res.replaced++
+	case m.opts.conflict == conflictSkip:
+		m.res.skipped++
+	default:
+		return &importConflict{line: m.res.lines, record: true, prefix: p.String()}
+	}
+	return nil
+}
+
+// importMRT loads the RIB records of an MRT dump from r into d. A
+// truncated file is an error; a malformed record is counted and quoted,
+// as a bad CSV line is, and skipped. Lines in the result are records and
+// routes the peer paths they held.
+func (d *database) importMRT(r io.Reader, opts importOptions) (importResult, error) {
+	m := &mrtImport{d: d, opts: opts, all: opts.multipath == "all"}
+	tmpl := opts.template
+	if tmpl == "" {
+		tmpl = "{origin}"
+	}
+	var err error
+	if m.tmpl, err = parseMRTTemplate(tmpl); err != nil {
+		return m.res, err
+	}
+	start, lastLog := time.Now(), time.Now()
+	var hdr [12]byte
+	var rec []byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			return m.res, nil
+		} else if err != nil {
+			return m.res, fmt.Errorf("truncated MRT record %d", m.res.lines+1)
+		}
+		m.res.lines++
+		if m.res.lines%importBatch == 0 {
+			runtime.Gosched()
+			if time.Since(lastLog) >= mrtProgressEvery {
+				lastLog = time.Now()
+				slog.Info("MRT import progress", "path", opts.path, "records", m.res.lines, "routes", m.res.routes,
+					"prefixes", m.res.inserted+m.res.replaced, "skipped", m.res.skipped, "errors", m.res.errors,
+					"elapsed", time.Since(start).Round(time.Second))
+			}
+		}
+		typ, subtype := binary.BigEndian.Uint16(hdr[4:]), binary.BigEndian.Uint16(hdr[6:])
+		n := binary.BigEndian.Uint32(hdr[8:])
+		if n > maxMRTRecord {
+			return m.res, fmt.Errorf("MRT record %d claims %d bytes", m.res.lines, n)
+		}
+		if cap(rec) < int(n) {
+			rec = make([]byte, n)
+		}
+		rec = rec[:n]
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return m.res, fmt.Errorf("truncated MRT record %d", m.res.lines)
+		}
+
+		if typ != mrtTableDumpV2 {
+			m.res.skipped++
+			continue
+		}
+		switch subtype {
+		case mrtPeerIndexTable:
+			m.peers, err = parsePeerIndex(rec)
+		case mrtRIBIPv4Unicast, mrtRIBIPv4UnicastPath:
+			err = m.rib(rec, 4, subtype == mrtRIBIPv4UnicastPath)
+		case mrtRIBIPv6Unicast, mrtRIBIPv6UnicastPath:
+			err = m.rib(rec, 16, subtype == mrtRIBIPv6UnicastPath)
+		default:
+			m.res.skipped++
+			continue
+		}
+		var conflict *importConflict
+		var quota *quotaError
+		if errors.As(err, &conflict) || errors.As(err, &quota) {
+			return m.res, err
+		}
+		if err != nil {
+			m.res.errors++
+			if len(m.res.firstErrors) < maxImportErrors {
+				m.res.firstErrors = append(m.res.firstErrors, fmt.Sprintf("record %d: %v", m.res.lines, err))
+			}
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// mrtRecord frames body as an MRT record of the given type and subtype.
+func mrtRecord(typ, subtype uint16, body []byte) []byte {
+	b := make([]byte, 12, 12+len(body))
+	binary.BigEndian.PutUint16(b[4:], typ)
+	binary.BigEndian.PutUint16(b[6:], subtype)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(body)))
+	return append(b, body...)
+}
+
+// mrtPeerTable builds a PEER_INDEX_TABLE of peers, with four-byte ASNs.
+func mrtPeerTable(peers ...mrtPeer) []byte {
+	b := []byte{0, 0, 0, 0, 0, 0, 0, byte(len(peers))} // collector ID, no view name
+	for _, p := range peers {
+		typ := byte(2)
+		if p.addr.Is6() {
+			typ |= 1
+		}
+		b = append(b, typ, 0, 0, 0, 0)
+		b = append(b, p.addr.AsSlice()...)
+		b = binary.BigEndian.AppendUint32(b, p.as)
+	}
+	return mrtRecord(mrtTableDumpV2, mrtPeerIndexTable, b)
+}
+
+// mrtRoute is one peer's path in a RIB record.
+type mrtRoute struct {
+	peer int
+	path []asSegment
+}
+
+// mrtRIB builds a unicast RIB record for prefix p, in the ADD-PATH form if
+// addPath is set.
+func mrtRIB(p string, addPath bool, routes ...mrtRoute) []byte {
+	prefix := netip.MustParsePrefix(p)
+	subtype := uint16(mrtRIBIPv4Unicast)
+	if prefix.Addr().Is6() {
+		subtype = mrtRIBIPv6Unicast
+	}
+	if addPath {
+		subtype += mrtRIBIPv4UnicastPath - mrtRIBIPv4Unicast
+	}
+	b := []byte{0, 0, 0, 1, byte(prefix.Bits())} // sequence number
+	b = append(b, prefix.Addr().AsSlice()[:(prefix.Bits()+7)/8]...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(routes)))
+	for i, r := range routes {
+		b = binary.BigEndian.AppendUint16(b, uint16(r.peer))
+		b = append(b, 0, 0, 0, 0) // originated time
+		if addPath {
+			b = binary.BigEndian.AppendUint32(b, uint32(i))
+		}
+		attrs := []byte{0x40, 1, 1, 0} // ORIGIN IGP ahead of the AS_PATH
+		var path []byte
+		for _, seg := range r.path {
+			path = append(path, seg.typ, byte(len(seg.asns)))
+			for _, as := range seg.asns {
+				path = binary.BigEndian.AppendUint32(path, as)
+			}
+		}
+		attrs = append(attrs, 0x50, bgpAttrASPath)
+		attrs = binary.BigEndian.AppendUint16(attrs, uint16(len(path)))
+		attrs = append(attrs, path...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(attrs)))
+		b = append(b, attrs...)
+	}
+	return mrtRecord(mrtTableDumpV2, subtype, b)
+}
+
+func seq(asns ...uint32) asSegment { return asSegment{typ: asSequence, asns: asns} }
+
+func TestParseMRTTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		tmpl    string
+		want    string // rendered for path 64500 64501 {64502,64503} from 192.0.2.1 AS64500
+		wantErr string
+	}{
+		{tmpl: "{origin}", want: "{64502,64503}"},
+		{tmpl: "AS{peer-as} via {peer}: {path}", want: "AS64500 via 192.0.2.1: 64500 64501 {64502,64503}"},
+		{tmpl: "fixed", want: "fixed"},
+		{tmpl: "", want: ""},
+		{tmpl: "{}", wantErr: "unknown field '{}' in TEMPLATE"},
+		{tmpl: "{asn}", wantErr: "unknown field '{asn}' in TEMPLATE"},
+		{tmpl: "x{origin", wantErr: "unterminated '{' in TEMPLATE"},
+	} {
+		tmpl, err := parseMRTTemplate(tc.tmpl)
+		if tc.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Errorf("parseMRTTemplate(%q): %v, want %q", tc.tmpl, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMRTTemplate(%q): %v", tc.tmpl, err)
+			continue
+		}
+		path := []asSegment{seq(64500, 64501), {typ: asSet, asns: []uint32{64502, 64503}}}
+		peer := mrtPeer{addr: netip.MustParseAddr("192.0.2.1"), as: 64500}
+		if got := string(tmpl.render(nil, path, peer)); got != tc.want {
+			t.Errorf("%q rendered %q, want %q", tc.tmpl, got, tc.want)
+		}
+	}
+}
+
+func TestMRTPath(t *testing.T) {
+	for _, tc := range []struct {
+		path   []asSegment
+		length int
+		origin string
+		text   string
+	}{
+		{[]asSegment{seq(1, 2, 3)}, 3, "3", "1 2 3"},
+		{[]asSegment{seq(1, 2), {typ: asSet, asns: []uint32{3, 4}}}, 3, "{3,4}", "1 2 {3,4}"},
+		{[]asSegment{{typ: asConfedSequence, asns: []uint32{65000, 65001}}, seq(1, 2)}, 2, "2", "(65000 65001) 1 2"},
+		{[]asSegment{seq(1), {typ: asConfedSet, asns: []uint32{65000, 65001}}}, 1, "1", "1 [65000,65001]"},
+		{[]asSegment{seq(4200000000)}, 1, "4200000000", "4200000000"},
+	} {
+		origin, _ := parseMRTTemplate("{origin}")
+		text, _ := parseMRTTemplate("{path}")
+		if n := pathLength(tc.path); n != tc.length {
+			t.Errorf("%s: length %d, want %d", tc.text, n, tc.length)
+		}
+		if got := string(origin.render(nil, tc.path, mrtPeer{})); got != tc.origin {
+			t.Errorf("%s: origin %q, want %q", tc.text, got, tc.origin)
+		}
+		if got := string(text.render(nil, tc.path, mrtPeer{})); got != tc.text {
+			t.Errorf("path rendered %q, want %q", got, tc.text)
+		}
+	}
+}
+
+func TestImportMRT(t *testing.T) {
+	t.Chdir(t.TempDir())
+	peers := mrtPeerTable(
+		mrtPeer{addr: netip.MustParseAddr("192.0.2.1"), as: 64500},
+		mrtPeer{addr: netip.MustParseAddr("2001:db8::1"), as: 64510},
+	)
+	dump := bytes.Join([][]byte{
+		peers,
+		mrtRIB("10.0.0.0/8", false, mrtRoute{0, []asSegment{seq(64500, 3, 1)}}, mrtRoute{1, []asSegment{seq(64510, 2)}}),
+		mrtRIB("10.1.0.0/16", true, mrtRoute{0, []asSegment{seq(64500, 5)}}, mrtRoute{1, []asSegment{seq(64510, 5)}}),
+		mrtRIB("2001:db8::/32", false, mrtRoute{1, []asSegment{seq(64510, 7)}}),
+		mrtRIB("192.0.2.0/24", false, mrtRoute{0, nil}), // the collector's own
+		mrtRecord(16, 4, []byte("a BGP4MP update")),
+		mrtRIB("198.51.100.0/24", false, mrtRoute{5, []asSegment{seq(1)}}), // no such peer
+		mrtRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, []byte{0, 0, 0, 1, 33}),
+	}, nil)
+	files := map[string][]byte{
+		"rib.20261014.0000": dump,
+		"truncated.mrt":     dump[:len(dump)-3],
+		"huge.mrt":          append(append(peers, mrtRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, nil)[:8]...), 0xff, 0, 0, 0),
+		"conflict.mrt":      bytes.Join([][]byte{peers, mrtRIB("192.0.2.0/24", false, mrtRoute{0, []asSegment{seq(9)}})}, nil),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		args    []string // after IMPORT
+		want    string   // lines/inserted/replaced/skipped/errors/routes
+		wantErr string
+		after   []replyStep
+	}{
+		{
+			name: "shortest path by default",
+			args: []string{"rib.20261014.0000"},
+			want: "8/3/0/2/2/7",
+			after: []replyStep{
+				{[]string{"GET", "10.1.2.3"}, "5"}, // the tie goes to the first path
+				{[]string{"GET", "10.0.0.1"}, "2"},
+				{[]string{"GET", "2001:db8::1"}, "7"},
+				{[]string{"GET", "192.0.2.1"}, "old"},
+				{[]string{"GET", "198.51.100.1"}, "nil"},
+			},
+		},
+		{
+			name: "all paths",
+			args: []string{"rib.20261014.0000", "FORMAT", "mrt", "MULTIPATH", "ALL"},
+			want: "8/3/0/2/2/7",
+			after: []replyStep{
+				{[]string{"SISMEMBER", "10.0.0.0/8", "1"}, "1"},
+				{[]string{"SISMEMBER", "10.0.0.0/8", "2"}, "1"},
+				{[]string{"SISMEMBER", "10.1.0.0/16", "5"}, "1"},
+				{[]string{"SMEMBERS", "2001:db8::/32"}, "[7]"},
+			},
+		},
+		{
+			name: "template",
+			args: []string{"rib.20261014.0000", "TEMPLATE", "AS{origin} from {peer-as}"},
+			want: "8/3/0/2/2/7",
+			after: []replyStep{
+				{[]string{"GET", "10.0.0.1"}, "AS2 from 64510"},
+				{[]string{"GET", "10.1.0.0/16"}, "AS5 from 64500"},
+			},
+		},
+		{
+			name:    "truncated",
+			args:    []string{"truncated.mrt"},
+			wantErr: "ERR truncated MRT record 8",
+		},
+		{
+			name:    "impossible record length",
+			args:    []string{"huge.mrt"},
+			wantErr: "ERR MRT record 2 claims 4278190080 bytes",
+		},
+		{
+			name:    "abort",
+			args:    []string{"conflict.mrt", "ABORT"},
+			wantErr: "ERR import aborted at record 2: 192.0.2.0/24 is already stored",
+		},
+		{
+			name: "skip",
+			args: []string{"conflict.mrt", "SKIP"},
+			want: "2/0/0/1/0/1",
+			after: []replyStep{
+				{[]string{"GET", "192.0.2.1"}, "old"},
+			},
+		},
+		{
+			name: "replace",
+			args: []string{"conflict.mrt"},
+			want: "2/0/1/0/0/1",
+			after: []replyStep{
+				{[]string{"GET", "192.0.2.1"}, "9"},
+			},
+		},
+		{
+			name:    "template needs mrt",
+			args:    []string{"conflict.mrt", "FORMAT", "csv", "TEMPLATE", "{path}"},
+			wantErr: "ERR TEMPLATE and MULTIPATH are only for FORMAT mrt",
+		},
+		{
+			name:    "bad template",
+			args:    []string{"conflict.mrt", "TEMPLATE", "{as}"},
+			wantErr: "ERR unknown field '{as}' in TEMPLATE",
+		},
+		{
+			name:    "bad multipath",
+			args:    []string{"conflict.mrt", "MULTIPATH", "longest"},
+			wantErr: "ERR MULTIPATH must be shortest or all",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := newTestSession(t, newTestServer(t))
+			mustDo(t, ss, "SET", "192.0.2.0/24", "old")
+			r := ss.Do(append([]string{"IMPORT"}, tc.args...)...)
+			if tc.wantErr != "" {
+				if err := r.Err(); err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Fatalf("IMPORT %q: %v, want %q", tc.args, err, tc.wantErr)
+				}
+				return
+			}
+			counts, _ := importFields(t, r)
+			var got []string
+			for _, name := range []string{"lines", "inserted", "replaced", "skipped", "errors", "routes"} {
+				got = append(got, strconv.FormatInt(counts[name], 10))
+			}
+			if strings.Join(got, "/") != tc.want {
+				t.Errorf("IMPORT %q counts %s, want %s", tc.args, strings.Join(got, "/"), tc.want)
+			}
+			runSteps(t, ss, tc.after)
+		})
+	}
+}
+
+func TestFormatFor(t *testing.T) {
+	for path, want := range map[string]string{
+		"routes.csv":                  "csv",
+		"routes":                      "csv",
+		"routes.TSV.gz":               "tsv",
+		"dumps/rib.20261014.0000.bz2": "mrt",
+		"bview.20261014.0800.gz":      "mrt",
+		"table.mrt":                   "mrt",
+		"dump.json":                   "json",
+		"dump.ndjson.gz":              "json",
+		"rib.d/routes.csv":            "csv",
+	} {
+		if got := formatFor(path); got != want {
+			t.Errorf("formatFor(%q) = %s, want %s", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+)
+
+// maxDBNameLen bounds database names so they stay readable in INFO.
+const maxDBNameLen = 64
+
+// dbNames maps database names to indices. A name is only a label: data
+// stays keyed by index, so naming or renaming a database never moves or
+// orphans it, and a name may be given to a database not yet created.
+type dbNames struct {
+	mu     sync.RWMutex
+	byID   map[int]string
+	byName map[string]int
+}
+
+func newDBNames() *dbNames {
+	return &dbNames{byID: make(map[int]string), byName: make(map[string]int)}
+}
+
+// validDBName reports why name cannot name a database, if it can't. A
+// name starts with a letter, so it can never be mistaken for an index.
+func validDBName(name string) error {
+	if name == "" || len(name) > maxDBNameLen {
+		return fmt.Errorf("database name must be 1 to %d characters", maxDBNameLen)
+	}
+	for i, r := range name {
+		letter := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+		if !letter && (i == 0 || !(r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.')) {
+			return errors.New("database name must start with a letter and use only letters, digits, '_', '-' and '.'")
+		}
+	}
+	return nil
+}
+
+// name returns the name of database id, or "" if it has none.
+func (n *dbNames) name(id int) string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.byID[id]
+}
+
+// lookup returns the index named name.
+func (n *dbNames) lookup(name string) (int, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	id, ok := n.byName[name]
+	return id, ok
+}
+
+// rename gives database id the name name, replacing any it had. An empty
+// name removes it. A name already given to another database is refused
+// rather than moved, so a typo cannot silently repoint clients.
+func (n *dbNames) rename(id int, name string) error {
+	if name != "" {
+		if err := validDBName(name); err != nil {
+			return err
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if other, ok := n.byName[name]; ok && other != id {
+		return fmt.Errorf("database name '%s' is already used by db%d", name, other)
+	}
+	delete(n.byName, n.byID[id])
+	delete(n.byID, id)
+	if name != "" {
+		n.byID[id], n.byName[name] = name, id
+	}
+	return nil
+}
+
+// ids returns the named indices, in no particular order.
+func (n *dbNames) ids() []int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	ids := make([]int, 0, len(n.byID))
+	for id := range n.byID {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// String formats the mapping as the db-names setting takes it, by index.
+func (n *dbNames) String() string {
+	ids := n.ids()
+	sort.Ints(ids)
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id) + "=" + n.byID[id]
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set replaces the whole mapping with spec, a comma-separated list of
+// index=name pairs, leaving it unchanged if spec is invalid.
+func (n *dbNames) Set(spec string) error {
+	byID, byName := make(map[int]string), make(map[string]int)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		idText, name, ok := strings.Cut(pair, "=")
+		id, err := strconv.Atoi(idText)
+		if !ok || err != nil || id < 0 {
+			return fmt.Errorf("invalid database name mapping '%s', expected index=name", pair)
+		}
+		if err := validDBName(name); err != nil {
+			return err
+		}
+		if _, dup := byID[id]; dup {
+			return fmt.Errorf("db%d is named twice", id)
+		}
+		if _, dup := byName[name]; dup {
+			return fmt.Errorf("database name '%s' is used twice", name)
+		}
+		byID[id], byName[name] = name, id
+	}
+	n.mu.Lock()
+	n.byID, n.byName = byID, byName
+	n.mu.Unlock()
+	return nil
+}
+
+// resolveDB parses a database given by index or by name, as SELECT and
+// friends take it. Unknown names are an error, never a new database.
+func (s *TrieServer) resolveDB(arg string) (int, error) {
+	if id, err := strconv.Atoi(arg); err == nil {
+		if id < 0 {
+			return 0, newError(ClassErr, "invalid DB index")
+		}
+		return id, nil
+	}
+	if id, ok := s.names.lookup(arg); ok {
+		return id, nil
+	}
+	return 0, errorf(ClassErr, "unknown database name '%s'", arg)
+}
+
+// handleNameDB implements NAMEDB index|name [newname]. Without newname it
+// removes the database's name.
+func (s *TrieServer) handleNameDB(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for 'NAMEDB'")
+		return
+	}
+	id, err := s.resolveDB(string(cmd.Args[1]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	var name string
+	if len(cmd.Args) == 3 {
+		name = string(cmd.Args[2])
+	}
+	if err := s.names.rename(id, name); err != nil {
+		writeError(conn, err)
+		return
+	}
+	writeOK(conn)
+}
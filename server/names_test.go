@@ -0,0 +1,200 @@
+package server
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidDBName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"geo", true},
+		{"ASN_v2.db-1", true},
+		{"a", true},
+		{strings.Repeat("a", maxDBNameLen), true},
+		{strings.Repeat("a", maxDBNameLen+1), false},
+		{"", false},
+		{"3geo", false},
+		{"_geo", false},
+		{"geo space", false},
+		{"géo", false},
+	} {
+		if err := validDBName(tc.name); (err == nil) != tc.ok {
+			t.Errorf("validDBName(%q) = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestDBNamesSet(t *testing.T) {
+	n := newDBNames()
+	for _, tc := range []struct {
+		spec    string
+		wantErr bool
+		want    string // String() afterwards
+	}{
+		{spec: "3=geo,4=asn", want: "3=geo,4=asn"},
+		{spec: " 10=b , 2=a ,", want: "2=a,10=b"},
+		{spec: "", want: ""},
+		{spec: "1=x", want: "1=x"},
+		{spec: "1=a,1=b", wantErr: true, want: "1=x"},
+		{spec: "1=a,2=a", wantErr: true, want: "1=x"},
+		{spec: "-1=a", wantErr: true, want: "1=x"},
+		{spec: "a=1", wantErr: true, want: "1=x"},
+		{spec: "1=9a", wantErr: true, want: "1=x"},
+	} {
+		if err := n.Set(tc.spec); (err != nil) != tc.wantErr {
+			t.Errorf("Set(%q) = %v, want an error: %v", tc.spec, err, tc.wantErr)
+		}
+		if got := n.String(); got != tc.want {
+			t.Errorf("after Set(%q): %q, want %q", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestNameDB(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, tc := range []struct {
+		args    []string
+		wantErr string // prefix of the error, if any
+	}{
+		{args: []string{"NAMEDB", "3", "geo"}},
+		{args: []string{"SELECT", "geo"}},
+		{args: []string{"SET", "10.0.0.0/8", "in geo"}},
+		{args: []string{"NAMEDB", "geo", "geo2"}}, // rename, by name
+		{args: []string{"SELECT", "geo"}, wantErr: "ERR unknown database name 'geo'"},
+		{args: []string{"NAMEDB", "4", "geo2"}, wantErr: "ERR database name 'geo2' is already used by db3"},
+		{args: []string{"NAMEDB", "4", "9lives"}, wantErr: "ERR database name must start with a letter"},
+		{args: []string{"NAMEDB", "nosuch", "x"}, wantErr: "ERR unknown database name"},
+		{args: []string{"SELECT", "-1"}, wantErr: "ERR invalid DB index"},
+		{args: []string{"SELECT", "0"}},
+		{args: []string{"SELECT", "geo2"}},
+	} {
+		err := ss.Do(tc.args...).Err()
+		if tc.wantErr == "" && err != nil {
+			t.Fatalf("%q: %v", tc.args, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.wantErr)) {
+			t.Fatalf("%q = %v, want %q", tc.args, err, tc.wantErr)
+		}
+	}
+	// The data stayed with db3 through the rename.
+	if r := mustDo(t, ss, "GET", "10.1.2.3"); r.Str != "in geo" {
+		t.Errorf("GET in geo2 = %q, want the value set in geo", r.Str)
+	}
+	if st := dbStats(t, ss, "geo2"); st["db"] != 3 || st["keys"] != 1 {
+		t.Errorf("DBSTATS geo2 = %v, want db 3 with one key", st)
+	}
+	if got := keyspaceField(t, ss, 3, "name"); got != "geo2" {
+		t.Errorf("INFO keyspace db3 name = %q, want geo2", got)
+	}
+	if got := mustDo(t, ss, "CLIENT", "INFO").Str; !strings.Contains(got, " db=3 dbname=geo2 ") {
+		t.Errorf("CLIENT INFO = %q, want db=3 dbname=geo2", got)
+	}
+	if got := mustDo(t, ss, "CONFIG", "GET", "db-names").strs(); !slices.Equal(got, []string{"db-names", "3=geo2"}) {
+		t.Errorf("CONFIG GET db-names = %q", got)
+	}
+
+	mustDo(t, ss, "NAMEDB", "3")
+	if err := ss.Do("SELECT", "geo2").Err(); err == nil {
+		t.Error("SELECT of a removed name succeeded")
+	}
+	mustDo(t, ss, "CONFIG", "SET", "db-names", "5=asn")
+	if st := dbStats(t, ss, "asn"); st["db"] != 5 {
+		t.Errorf("DBSTATS asn after CONFIG SET db-names = %v", st)
+	}
+}
+
+// showDBs returns the databases a SHOWDBS reply lists, as "db:name:keys"
+// with "-" for no name.
+func showDBs(t testing.TB, ss *testSession, args ...string) []string {
+	t.Helper()
+	var out []string
+	for _, e := range mustDo(t, ss, append([]string{"SHOWDBS"}, args...)...).Array {
+		name := e.Array[3].Str
+		if e.Array[3].Type == NullReply {
+			name = "-"
+		}
+		out = append(out, strconv.FormatInt(e.Array[1].Int, 10)+":"+name+":"+strconv.FormatInt(e.Array[5].Int, 10))
+		if e.Array[5].Int > 0 && e.Array[7].Int <= 0 {
+			t.Errorf("SHOWDBS db%d: memory %d with %d keys", e.Array[1].Int, e.Array[7].Int, e.Array[5].Int)
+		}
+	}
+	return out
+}
+
+func TestShowDBs(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, tc := range []struct {
+		args    []string // a command run first
+		want    []string
+		wantAll []string
+	}{
+		{args: []string{"PING"}, want: nil, wantAll: nil},
+		{args: []string{"SET", "10.0.0.0/8", "a"}, want: []string{"0:-:1"}, wantAll: []string{"0:-:1"}},
+		{args: []string{"SELECT", "7"}, want: []string{"0:-:1"}, wantAll: []string{"0:-:1"}},
+		{args: []string{"GET", "10.1.2.3"}, want: []string{"0:-:1"}, wantAll: []string{"0:-:1", "7:-:0"}},
+		{args: []string{"NAMEDB", "2", "geo"}, want: []string{"0:-:1"}, wantAll: []string{"0:-:1", "7:-:0"}},
+		{args: []string{"SELECT", "geo"}, want: []string{"0:-:1"}, wantAll: []string{"0:-:1", "7:-:0"}},
+		{args: []string{"SET", "::/0", "b"}, want: []string{"0:-:1", "2:geo:1"}, wantAll: []string{"0:-:1", "2:geo:1", "7:-:0"}},
+		{args: []string{"FLUSHDB"}, want: []string{"0:-:1"}, wantAll: []string{"0:-:1", "2:geo:0", "7:-:0"}},
+	} {
+		mustDo(t, ss, tc.args...)
+		if got := showDBs(t, ss); !slices.Equal(got, tc.want) {
+			t.Errorf("after %q: SHOWDBS = %q, want %q", tc.args, got, tc.want)
+		}
+		if got := showDBs(t, ss, "all"); !slices.Equal(got, tc.wantAll) {
+			t.Errorf("after %q: SHOWDBS ALL = %q, want %q", tc.args, got, tc.wantAll)
+		}
+	}
+	if err := ss.Do("SHOWDBS", "SOME").Err(); err == nil {
+		t.Error("SHOWDBS SOME succeeded")
+	}
+}
+
+func TestDropDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	s := newTestServer(t)
+	ss, other := newTestSession(t, s), newTestSession(t, s)
+	mustDo(t, ss, "CONFIG", "SET", "audit-log-file", path, "audit-log", "yes")
+	mustDo(t, ss, "NAMEDB", "4", "geo")
+	mustDo(t, other, "SELECT", "geo")
+	mustDo(t, other, "SET", "10.0.0.0/8", "a")
+	for _, tc := range []struct {
+		args    []string
+		want    int64
+		wantErr string // prefix of the error, if any
+	}{
+		{args: []string{"DROPDB", "geo"}, wantErr: "ERR db4 is selected by 1 other client(s)"},
+		{args: []string{"DROPDB", "4", "NOW"}, wantErr: "ERR syntax error"},
+		{args: []string{"DROPDB"}, wantErr: "ERR wrong number of arguments"},
+		{args: []string{"DROPDB", "nosuch"}, wantErr: "ERR unknown database name"},
+		{args: []string{"DROPDB", "9"}, want: 0},
+		{args: []string{"DROPDB", "geo", "force"}, want: 1},
+		{args: []string{"DROPDB", "4", "FORCE"}, want: 0},
+	} {
+		r := ss.Do(tc.args...)
+		if err := r.Err(); tc.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Errorf("%q = %v, want %q", tc.args, err, tc.wantErr)
+			}
+		} else if err != nil || r.Int != tc.want {
+			t.Errorf("%q = %d, %v, want %d", tc.args, r.Int, err, tc.want)
+		}
+	}
+	// The other client stays on the index, now an empty database under the
+	// same name.
+	if r := mustDo(t, other, "GET", "10.1.2.3"); r.Type != NullReply {
+		t.Errorf("GET in the dropped database = %q, want null", r.Str)
+	}
+	if st := dbStats(t, other, "geo"); st["db"] != 4 || st["keys"] != 0 {
+		t.Errorf("DBSTATS geo after the drop = %v", st)
+	}
+	if got := readAudit(t, path, 2); len(got) != 2 || got[1].Cmd != "DROPDB" || got[1].DB != 4 {
+		t.Errorf("audit log %+v, want the SET then one DROPDB of db 4", got)
+	}
+}
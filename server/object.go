@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <cidr>",
+	"    Return the kind of internal representation used for the value at <cidr>:",
+	"    raw, interned, json or hashtable.",
+	"FREQ <cidr>",
+	"    Return the access frequency counter of the value at <cidr>. Needs",
+	"    lfu-tracking.",
+	"IDLETIME <cidr>",
+	"    Return the seconds since the value at <cidr> was last read or written.",
+	"REFCOUNT <cidr>",
+	"    Return the number of prefixes sharing the value at <cidr> through",
+	"    value-interning, 1 if it is not shared.",
+	"HELP",
+	"    Print this help.",
+}
+
+// objectEncoding names how v is held: hashes and sets as hashtable, and
+// strings as interned if they share a pooled slice, json if they hold a
+// JSON object or array, and raw otherwise.
+func (d *database) objectEncoding(v value) string {
+	switch {
+	case !v.isString():
+		return v.encoding()
+	case d.pool.refs(v.str) > 0:
+		return "interned"
+	case len(v.str) > 0 && (v.str[0] == '{' || v.str[0] == '[') && json.Valid(v.str):
+		return "json"
+	}
+	return "raw"
+}
+
+// handleObject implements the OBJECT subcommands.
+func (s *TrieServer) handleObject(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'OBJECT'")
+		return
+	}
+	sub := strings.ToUpper(string(cmd.Args[1]))
+	if sub == "HELP" {
+		conn.WriteArray(len(objectHelp))
+		for _, line := range objectHelp {
+			conn.WriteString(line)
+		}
+		return
+	}
+	if sub != "ENCODING" && sub != "REFCOUNT" && sub != "IDLETIME" && sub != "FREQ" {
+		conn.WriteError("ERR unknown subcommand '" + sub + "' for 'OBJECT'")
+		return
+	}
+	if len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for 'OBJECT " + sub + "'")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	v, ok := db.peekExact(string(cmd.Args[2]))
+	if !ok {
+		writeError(conn, errNoSuchKey)
+		return
+	}
+	switch sub {
+	case "ENCODING":
+		conn.WriteBulkString(db.objectEncoding(v))
+	case "REFCOUNT":
+		conn.WriteInt64(max(db.pool.refs(v.str), 1))
+	case "IDLETIME":
+		conn.WriteInt64(int64(v.idle()))
+	case "FREQ":
+		if !db.opts.lfu.Load() {
+			conn.WriteError("ERR lfu-tracking is off, access frequency is not tracked")
+			return
+		}
+		conn.WriteInt64(int64(v.access.freq()))
+	}
+}
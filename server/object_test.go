@@ -0,0 +1,45 @@
+package server
+
+import "testing"
+
+func TestObject(t *testing.T) {
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "plain"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", `{"asn":64500}`}, "OK"},
+		{[]string{"SET", "10.2.0.0/16", "[1,2]"}, "OK"},
+		{[]string{"SET", "10.3.0.0/16", "{not json"}, "OK"},
+		{[]string{"HSET", "10.4.0.0/16", "f", "v"}, "1"},
+		{[]string{"SADD", "10.5.0.0/16", "m"}, "1"},
+		{[]string{"OBJECT", "ENCODING", "10.0.0.0/8"}, "raw"},
+		{[]string{"OBJECT", "ENCODING", "10.1.0.0/16"}, "json"},
+		{[]string{"OBJECT", "ENCODING", "10.2.0.0/16"}, "json"},
+		{[]string{"OBJECT", "ENCODING", "10.3.0.0/16"}, "raw"},
+		{[]string{"OBJECT", "ENCODING", "10.4.0.0/16"}, "hashtable"},
+		{[]string{"OBJECT", "ENCODING", "10.5.0.0/16"}, "hashtable"},
+		{[]string{"OBJECT", "REFCOUNT", "10.0.0.0/8"}, "1"},
+		{[]string{"OBJECT", "REFCOUNT", "10.4.0.0/16"}, "1"},
+		{[]string{"OBJECT", "ENCODING", "10.9.0.0/16"}, "ERR no such key"},
+		{[]string{"OBJECT", "REFCOUNT", "10.1.2.3"}, "ERR no such key"}, // exact, not a longest match
+		{[]string{"OBJECT", "ENCODING"}, "ERR wrong number of arguments for 'OBJECT ENCODING'"},
+		{[]string{"OBJECT", "SIZE", "10.0.0.0/8"}, "ERR unknown subcommand 'SIZE' for 'OBJECT'"},
+		{[]string{"OBJECT"}, "ERR wrong number of arguments for 'OBJECT'"},
+	})
+
+	// With value-interning, identical values share one pooled slice.
+	s.store.interning.Store(true)
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "192.0.2.0/24", "shared"}, "OK"},
+		{[]string{"SET", "198.51.100.0/24", "shared"}, "OK"},
+		{[]string{"SET", "203.0.113.0/24", "shared"}, "OK"},
+		{[]string{"OBJECT", "ENCODING", "192.0.2.0/24"}, "interned"},
+		{[]string{"OBJECT", "REFCOUNT", "192.0.2.0/24"}, "3"},
+		{[]string{"DEL", "203.0.113.0/24"}, "1"},
+		{[]string{"OBJECT", "REFCOUNT", "198.51.100.0/24"}, "2"},
+		{[]string{"OBJECT", "ENCODING", "10.0.0.0/8"}, "raw"}, // stored before interning was on
+	})
+	if help := mustDo(t, ss, "OBJECT", "HELP").strs(); len(help) != len(objectHelp) || help[0] != objectHelp[0] {
+		t.Errorf("OBJECT HELP = %q", help)
+	}
+}
@@ -0,0 +1,452 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"math/bits"
+	"slices"
+	"time"
+)
+
+// Options configures a server. Each field is the triedis flag, and where
+// there is one the CONFIG parameter, of the same name; DefaultOptions
+// holds the flags' defaults. The listen addresses are not among them, as
+// a server embedded in another process need not listen at all.
+type Options struct {
+	TLSPort        int    // tls-port, 0 disables TLS
+	TLSCertFile    string // tls-cert-file
+	TLSKeyFile     string // tls-key-file
+	TLSCACertFile  string // tls-ca-cert-file
+	TLSAuthClients string // tls-auth-clients: yes, no or optional
+	TLSIdentityMap string // tls-identity-map
+
+	TLSDefaultPermission string // tls-default-permission
+
+	Timeout                 int64  // timeout, in seconds
+	TCPKeepAlive            int64  // tcp-keepalive, in seconds
+	WriteTimeout            int64  // write-timeout, in seconds
+	MaxClients              int64  // maxclients
+	MaxClientsPerIP         int64  // maxclients-per-ip
+	MaxClientsPerIPExempt   string // maxclients-per-ip-exempt
+	ClientOutputBufferLimit string // client-output-buffer-limit
+	RateLimit               int64  // ratelimit
+	RateLimitBurst          int64  // ratelimit-burst
+	RateLimitMode           string // ratelimit-mode: hard or soft
+	RateLimitUsers          string // ratelimit-users
+	NoEvictUsers            string // no-evict-users
+
+	DBShards            int    // db-shards, a power of two up to 256
+	ValueInterning      bool   // value-interning
+	ValueIndex          bool   // value-index
+	RejectHostBits      bool   // reject-host-bits
+	IPv4Mapped          string // ipv4-mapped: convert, reject or native
+	RequirePrefixLength bool   // require-prefix-length
+	HotkeysTracking     bool   // hotkeys-tracking
+	HotkeysSampleRate   int64  // hotkeys-sample-rate
+	LPMCacheSize        int64  // lpm-cache-size
+	LFUTracking         bool   // lfu-tracking
+	ReadOnly            bool   // read-only
+	LazyfreeUserFlush   bool   // lazyfree-lazy-user-flush
+	MaxMemory           string // maxmemory, e.g. 2gb
+	MaxMemoryPolicy     string // maxmemory-policy
+	MaxMemorySamples    int64  // maxmemory-samples
+	MaxMemoryLossless   bool   // maxmemory-lossless
+
+	DBNames             string // db-names
+	DBReadOnly          string // db-readonly
+	DBTombstones        string // db-tombstones
+	TombstoneMaxEntries int64  // tombstone-max-entries
+	TombstoneMaxAge     int64  // tombstone-max-age, in seconds
+	DBMaxKeys           string // db-max-keys
+	DBMaxBytes          string // db-max-bytes
+	DBDefaultValue      string // db-default-value
+
+	Dir                 string // dir
+	DBFilename          string // dbfilename
+	RDBCompression      bool   // rdbcompression
+	RDBCompressionLevel int64  // rdbcompression-level
+	JournalFile         string // journal-file, relative to Dir
+	JournalRecovery     string // journal-recovery: refuse, serve or complete
+
+	Import             string        // import
+	ImportDB           int           // import-db
+	ImportMRT          string        // import-mrt
+	ImportMRTTemplate  string        // import-mrt-template
+	ImportMRTMultipath string        // import-mrt-multipath: shortest or all
+	ReloadFile         string        // reload-file
+	ReloadInterval     time.Duration // reload-interval
+	ReloadDB           int           // reload-db
+	Preload            string        // preload
+	PreloadDegraded    bool          // preload-degraded
+
+	EnableDebugCommand    string // enable-debug-command: yes, no or local
+	LogFormat             string // log-format, which SetupLogging applies
+	LogFile               string // logfile, which SetupLogging applies
+	LogSlowerThan         int64  // log-slower-than, in microseconds
+	CommandTimeout        int64  // command-timeout, in milliseconds
+	CommandTimeoutClasses string // command-timeout-classes
+	ShardMap              string // shard-map
+	SubtreeMaxEntries     int64  // subtree-max-entries
+
+	AuditLogFile     string // audit-log-file
+	AuditLogMaxSize  int64  // audit-log-max-size, in bytes
+	AuditLogMaxFiles int    // audit-log-max-files
+
+	WebhookURLs       string // webhook-urls
+	WebhookFilter     string // webhook-filter
+	WebhookBatchSize  int64  // webhook-batch-size
+	WebhookMaxPending int64  // webhook-max-pending
+	WebhookMaxRetries int64  // webhook-max-retries
+
+	OTelEndpoint     string  // otel-endpoint
+	OTelServiceName  string  // otel-service-name
+	OTelSampleRatio  float64 // otel-sample-ratio
+	OTelKeyRedaction string  // otel-key-redaction: mask, none or drop
+}
+
+// DefaultOptions returns the options of a triedis started without flags.
+func DefaultOptions() Options {
+	return Options{
+		TLSAuthClients:          "yes",
+		TLSDefaultPermission:    "readonly",
+		TCPKeepAlive:            300,
+		MaxClients:              10000,
+		ClientOutputBufferLimit: defaultOutputLimits,
+		RateLimitMode:           "hard",
+		DBShards:                16,
+		IPv4Mapped:              "convert",
+		HotkeysSampleRate:       16,
+		MaxMemory:               "0",
+		MaxMemoryPolicy:         "noeviction",
+		MaxMemorySamples:        5,
+		TombstoneMaxEntries:     10000,
+		TombstoneMaxAge:         86400,
+		Dir:                     ".",
+		DBFilename:              "dump.tdb",
+		RDBCompressionLevel:     6,
+		JournalFile:             "journal.jsonl",
+		JournalRecovery:         "refuse",
+		ImportMRTTemplate:       "{origin}",
+		ImportMRTMultipath:      "shortest",
+		ReloadInterval:          time.Minute,
+		EnableDebugCommand:      "no",
+		LogFormat:               "text",
+		LogSlowerThan:           10000,
+		SubtreeMaxEntries:       100000,
+		AuditLogMaxSize:         100 << 20,
+		AuditLogMaxFiles:        5,
+		WebhookBatchSize:        100,
+		WebhookMaxPending:       10000,
+		WebhookMaxRetries:       3,
+		OTelServiceName:         "triedis",
+		OTelSampleRatio:         0.01,
+		OTelKeyRedaction:        "mask",
+	}
+}
+
+// Open returns a server configured by o with its data loaded, as the
+// triedis command starts one: the snapshots found in o.Dir, then the
+// operation journal, Import and ImportMRT, Preload and ReloadFile. It
+// neither listens nor starts the background work; see Listen and Start.
+func Open(o Options) (*TrieServer, error) {
+	s, err := NewTrieServer(o)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.load(o); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewTrieServer returns a server configured by o, holding no data. Unlike
+// Open, it loads nothing, not even a snapshot in o.Dir.
+func NewTrieServer(o Options) (*TrieServer, error) {
+	s := newTrieServer()
+	if err := s.configure(o); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// configure applies o to a fresh server.
+func (s *TrieServer) configure(o Options) error {
+	s.registerLogConfig(o.LogFormat, o.LogFile)
+	s.slowLogUsec.Store(o.LogSlowerThan)
+	if o.CommandTimeout < 0 {
+		return fmt.Errorf("invalid command-timeout %d, expected a non-negative number of milliseconds", o.CommandTimeout)
+	}
+	s.cmdTimeout.Store(o.CommandTimeout)
+	if t, err := parseClassTimeouts(o.CommandTimeoutClasses); err != nil {
+		return fmt.Errorf("invalid command-timeout-classes: %w", err)
+	} else {
+		s.classTimeouts.Store(t)
+	}
+	if o.SubtreeMaxEntries < 0 {
+		return fmt.Errorf("invalid subtree-max-entries %d, expected a non-negative number", o.SubtreeMaxEntries)
+	}
+	s.subtreeMax.Store(o.SubtreeMaxEntries)
+	if m, err := parseShardMap(o.ShardMap); err != nil {
+		return fmt.Errorf("invalid shard-map: %w", err)
+	} else {
+		s.shards.Store(m)
+	}
+	if o.DBShards < 1 || o.DBShards > 256 || o.DBShards&(o.DBShards-1) != 0 {
+		return fmt.Errorf("invalid db-shards %d, expected a power of two from 1 to 256", o.DBShards)
+	}
+	s.store.shardBits = bits.TrailingZeros(uint(o.DBShards))
+	s.store.interning.Store(o.ValueInterning)
+	s.store.valueIndex.Store(o.ValueIndex)
+	if err := s.names.Set(o.DBNames); err != nil {
+		return fmt.Errorf("invalid db-names: %w", err)
+	}
+	if err := s.readOnlyDBs.Set(o.DBReadOnly); err != nil {
+		return fmt.Errorf("invalid db-readonly: %w", err)
+	}
+	if err := s.tombstoneDBs.Set(o.DBTombstones); err != nil {
+		return fmt.Errorf("invalid db-tombstones: %w", err)
+	}
+	if o.TombstoneMaxEntries < 1 {
+		return fmt.Errorf("invalid tombstone-max-entries %d, expected a positive number", o.TombstoneMaxEntries)
+	}
+	s.store.tombstoneMax.Store(o.TombstoneMaxEntries)
+	if o.TombstoneMaxAge < 0 {
+		return fmt.Errorf("invalid tombstone-max-age %d, expected a non-negative number of seconds", o.TombstoneMaxAge)
+	}
+	s.store.tombstoneAge.Store(o.TombstoneMaxAge)
+	if err := s.store.maxKeys.Set(o.DBMaxKeys, parseKeyLimit); err != nil {
+		return fmt.Errorf("invalid db-max-keys: %w", err)
+	}
+	if err := s.store.maxBytes.Set(o.DBMaxBytes, parseMemory); err != nil {
+		return fmt.Errorf("invalid db-max-bytes: %w", err)
+	}
+	if err := s.defaults.Set(o.DBDefaultValue); err != nil {
+		return fmt.Errorf("invalid db-default-value: %w", err)
+	}
+	s.store.requireLen.Store(o.RequirePrefixLength)
+	s.store.rejectHost.Store(o.RejectHostBits)
+	s.store.lfu.Store(o.LFUTracking)
+	s.store.lazyFlush.Store(o.LazyfreeUserFlush)
+	limit, err := parseMemory(o.MaxMemory)
+	if err != nil {
+		return fmt.Errorf("invalid maxmemory: %w", err)
+	}
+	s.evict.maxMemory.Store(limit)
+	policy, ok := parseEvictPolicy(o.MaxMemoryPolicy)
+	if !ok {
+		return fmt.Errorf("invalid maxmemory-policy '%s', expected noeviction or most-specific-first", o.MaxMemoryPolicy)
+	}
+	s.evict.policy.Store(policy)
+	if o.MaxMemorySamples < 1 || o.MaxMemorySamples > 64 {
+		return fmt.Errorf("invalid maxmemory-samples %d, expected 1 to 64", o.MaxMemorySamples)
+	}
+	s.evict.samples.Store(o.MaxMemorySamples)
+	s.evict.lossless.Store(o.MaxMemoryLossless)
+	s.readOnly.Store(o.ReadOnly)
+	s.store.hotKeys.Store(o.HotkeysTracking)
+	if o.HotkeysSampleRate < 1 {
+		return fmt.Errorf("invalid hotkeys-sample-rate %d, expected a positive number", o.HotkeysSampleRate)
+	}
+	s.store.hotKeysRate.Store(o.HotkeysSampleRate)
+	if o.LPMCacheSize < 0 {
+		return fmt.Errorf("invalid lpm-cache-size %d, expected a non-negative number", o.LPMCacheSize)
+	}
+	s.store.lpmCacheSize.Store(o.LPMCacheSize)
+	mode, ok := parseMappedMode(o.IPv4Mapped)
+	if !ok {
+		return fmt.Errorf("invalid ipv4-mapped '%s', expected convert, reject or native", o.IPv4Mapped)
+	}
+	s.store.mapped.Store(mode)
+	switch o.EnableDebugCommand {
+	case "yes", "no", "local":
+		s.debugCommand = o.EnableDebugCommand
+	default:
+		return fmt.Errorf("invalid enable-debug-command '%s', expected yes, no or local", o.EnableDebugCommand)
+	}
+	s.auditLog.path = o.AuditLogFile
+	s.auditLog.maxSize = o.AuditLogMaxSize
+	s.auditLog.keep = o.AuditLogMaxFiles
+	if o.AuditLogFile != "" {
+		s.auditLog.enable()
+	}
+	if o.WebhookBatchSize < 1 {
+		return fmt.Errorf("invalid webhook-batch-size %d, expected a positive number", o.WebhookBatchSize)
+	}
+	s.webhooks.batchSize.Store(o.WebhookBatchSize)
+	if o.WebhookMaxPending < 1 {
+		return fmt.Errorf("invalid webhook-max-pending %d, expected a positive number", o.WebhookMaxPending)
+	}
+	s.webhooks.maxPending.Store(o.WebhookMaxPending)
+	if o.WebhookMaxRetries < 0 {
+		return fmt.Errorf("invalid webhook-max-retries %d, expected a non-negative number", o.WebhookMaxRetries)
+	}
+	s.webhooks.maxRetries.Store(o.WebhookMaxRetries)
+	if l, err := parsePrefixList(o.WebhookFilter); err != nil {
+		return fmt.Errorf("invalid webhook-filter: %w", err)
+	} else {
+		s.webhooks.filter.Store(&l)
+	}
+	if urls, err := parseWebhookURLs(o.WebhookURLs); err != nil {
+		return fmt.Errorf("invalid webhook-urls: %w", err)
+	} else {
+		s.webhooks.setURLs(urls)
+	}
+	if o.OTelSampleRatio < 0 || o.OTelSampleRatio > 1 {
+		return fmt.Errorf("invalid otel-sample-ratio %v, expected a number from 0 to 1", o.OTelSampleRatio)
+	}
+	s.tracing.ratio.Store(math.Float64bits(o.OTelSampleRatio))
+	redact, ok := parseRedactMode(o.OTelKeyRedaction)
+	if !ok {
+		return fmt.Errorf("invalid otel-key-redaction '%s', expected mask, none or drop", o.OTelKeyRedaction)
+	}
+	s.tracing.redact.Store(redact)
+	if o.OTelEndpoint != "" {
+		if err := s.startTracing(o.OTelEndpoint, o.OTelServiceName); err != nil {
+			return fmt.Errorf("invalid otel-endpoint: %w", err)
+		}
+	}
+	s.tls.port = o.TLSPort
+	s.tls.certFile = o.TLSCertFile
+	s.tls.keyFile = o.TLSKeyFile
+	s.tls.caCertFile = o.TLSCACertFile
+	s.tls.authClients = o.TLSAuthClients
+	s.timeout.Store(o.Timeout)
+	s.tcpKeepAlive.Store(o.TCPKeepAlive)
+	s.writeTimeout.Store(o.WriteTimeout)
+	s.maxClients.Store(o.MaxClients)
+	s.maxClientsPerIP.Store(o.MaxClientsPerIP)
+	if l, err := parsePrefixList(o.MaxClientsPerIPExempt); err != nil {
+		return fmt.Errorf("invalid maxclients-per-ip-exempt: %w", err)
+	} else {
+		s.perIPExempt.Store(&l)
+	}
+	if l, err := parseOutputLimits(*s.outputLimits.Load(), o.ClientOutputBufferLimit); err != nil {
+		return fmt.Errorf("invalid client-output-buffer-limit: %w", err)
+	} else {
+		s.outputLimits.Store(&l)
+	}
+	s.rateLimit.rate.Store(o.RateLimit)
+	s.rateLimit.burst.Store(o.RateLimitBurst)
+	if soft, ok := parseRateLimitMode(o.RateLimitMode); !ok {
+		return fmt.Errorf("invalid ratelimit-mode '%s', expected soft or hard", o.RateLimitMode)
+	} else {
+		s.rateLimit.soft.Store(soft)
+	}
+	if m, err := parseRateOverrides(o.RateLimitUsers); err != nil {
+		return fmt.Errorf("invalid ratelimit-users: %w", err)
+	} else {
+		s.rateLimit.users.Store(&m)
+	}
+	if m := parseUserSet(o.NoEvictUsers); len(m) > 0 {
+		s.noEvictUsers.Store(&m)
+	}
+	if m, err := parseIdentityMap(o.TLSIdentityMap); err != nil {
+		return fmt.Errorf("invalid tls-identity-map: %w", err)
+	} else {
+		s.identities.Store(&m)
+	}
+	if p, ok := parsePermission(o.TLSDefaultPermission); !ok {
+		return fmt.Errorf("invalid tls-default-permission '%s'", o.TLSDefaultPermission)
+	} else {
+		s.defaultPermission.Store(int32(p))
+	}
+	if s.tls.enabled() {
+		if err := s.tls.reload(); err != nil {
+			return fmt.Errorf("TLS setup failed: %w", err)
+		}
+	}
+
+	s.snapshots.dir, s.snapshots.dbFilename = o.Dir, o.DBFilename
+	if !validCompressionLevel(o.RDBCompressionLevel) {
+		return fmt.Errorf("invalid rdbcompression-level %d, expected 1 to 9", o.RDBCompressionLevel)
+	}
+	s.snapshots.compression.Store(o.RDBCompression)
+	s.snapshots.compressionLevel.Store(o.RDBCompressionLevel)
+	if err := validDBFilename(o.DBFilename); err != nil {
+		return fmt.Errorf("invalid dbfilename: %w", err)
+	}
+	if !slices.Contains(journalRecoveryModes, o.JournalRecovery) {
+		return fmt.Errorf("invalid journal-recovery '%s', expected refuse, serve or complete", o.JournalRecovery)
+	}
+	s.journal.path, s.journal.recovery = o.JournalFile, o.JournalRecovery
+
+	if o.Import != "" || o.ImportMRT != "" {
+		if o.ImportDB < 0 {
+			return fmt.Errorf("invalid import-db %d", o.ImportDB)
+		}
+		if _, err := parseMRTTemplate(o.ImportMRTTemplate); err != nil {
+			return fmt.Errorf("invalid import-mrt-template: %w", err)
+		}
+		if o.ImportMRTMultipath != "shortest" && o.ImportMRTMultipath != "all" {
+			return fmt.Errorf("invalid import-mrt-multipath '%s', expected shortest or all", o.ImportMRTMultipath)
+		}
+	}
+	if o.ReloadFile != "" && (o.ReloadDB < 0 || o.ReloadInterval <= 0) {
+		return fmt.Errorf("invalid reload-db %d or reload-interval %v", o.ReloadDB, o.ReloadInterval)
+	}
+	return nil
+}
+
+// load loads the data o names into a server configure has set up.
+func (s *TrieServer) load(o Options) error {
+	paths, infos, err := s.loadSnapshots(o.DBNames == "", o.DBReadOnly == "", o.DBDefaultValue == "")
+	if err != nil {
+		return fmt.Errorf("snapshot load failed: %w", err)
+	}
+	for i, info := range infos {
+		slog.Info("Loaded snapshot", "path", paths[i], "dbs", len(info.dbs), "triedis_version", info.version,
+			"created", info.created.Format(time.RFC3339))
+	}
+	if err := s.openJournal(infos); err != nil {
+		return fmt.Errorf("operation journal %s failed: %w", o.JournalFile, err)
+	}
+
+	if o.Import != "" {
+		start := time.Now()
+		res, err := s.getDB(o.ImportDB).importFile(importOptions{path: o.Import, format: formatFor(o.Import)})
+		if err != nil {
+			return fmt.Errorf("import of %s failed: %w", o.Import, err)
+		}
+		slog.Info("Imported", "path", o.Import, "db", o.ImportDB, "lines", res.lines,
+			"inserted", res.inserted, "replaced", res.replaced, "errors", res.errors, "elapsed", time.Since(start))
+		for _, e := range res.firstErrors {
+			slog.Warn("Import error", "path", o.Import, "err", e)
+		}
+	}
+	if o.ImportMRT != "" {
+		start := time.Now()
+		res, err := s.getDB(o.ImportDB).importFile(importOptions{path: o.ImportMRT, format: "mrt",
+			template: o.ImportMRTTemplate, multipath: o.ImportMRTMultipath})
+		if err != nil {
+			return fmt.Errorf("MRT import of %s failed: %w", o.ImportMRT, err)
+		}
+		slog.Info("Imported MRT dump", "path", o.ImportMRT, "db", o.ImportDB, "records", res.lines, "routes", res.routes,
+			"inserted", res.inserted, "replaced", res.replaced, "skipped", res.skipped, "errors", res.errors,
+			"elapsed", time.Since(start))
+		for _, e := range res.firstErrors {
+			slog.Warn("MRT import error", "path", o.ImportMRT, "err", e)
+		}
+	}
+
+	if o.Preload != "" {
+		ok, err := s.preload(o.Preload)
+		switch {
+		case err != nil:
+			return fmt.Errorf("invalid preload manifest %s: %w", o.Preload, err)
+		case !ok && !o.PreloadDegraded:
+			return fmt.Errorf("preload failed, not starting; see the errors above or pass -preload-degraded")
+		case !ok:
+			s.readOnly.Store(true)
+			slog.Warn("Preload failed, starting read-only", "elapsed", s.preloadState.elapsed)
+		default:
+			slog.Info("Preload complete", "sources", len(s.preloadState.results), "elapsed", s.preloadState.elapsed)
+		}
+	}
+
+	if o.ReloadFile != "" {
+		s.reloader = &fileReloader{path: o.ReloadFile, db: o.ReloadDB, interval: o.ReloadInterval}
+		s.reload(s.reloader)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// KEYS, SUBNETS and TREEGET list prefixes in address order, shorter
+// prefixes first at the same address: IPv4 before IPv6, the order of
+// comparePrefixes and of a trie walk. SORT BY LENGTH orders by prefix
+// length instead, then by address; DESC reverses either order, so
+// SORT BY LENGTH DESC lists the most specific prefixes first.
+//
+// Neither order sorts. Each shard's trie walks in address order, so the
+// shards' lists are merged, as mergeAll does; length order buckets that
+// by length. Walking the shards one after another is not enough: the IPv4
+// shards split their space in address order, but the IPv6 ones skip the
+// top bits (see v6ShardSkip), so 2000::/16 and 4000::/16 share a shard
+// that 3000::/16 sorts between.
+
+// keyOrder is the order of a key listing, address order by default.
+type keyOrder struct {
+	byLength bool
+	desc     bool
+}
+
+// parseKeyOrder parses SORT BY ADDRESS|LENGTH [DESC] at the start of
+// args, returning the order and how many arguments it took.
+func parseKeyOrder(args [][]byte) (keyOrder, int, error) {
+	if len(args) < 3 || !strings.EqualFold(string(args[1]), "BY") {
+		return keyOrder{}, 0, errSyntax
+	}
+	var o keyOrder
+	switch strings.ToUpper(string(args[2])) {
+	case "ADDRESS":
+	case "LENGTH":
+		o.byLength = true
+	default:
+		return keyOrder{}, 0, newError(ClassErr, "SORT BY must be ADDRESS or LENGTH")
+	}
+	if len(args) > 3 && strings.EqualFold(string(args[3]), "DESC") {
+		o.desc = true
+		return o, 4, nil
+	}
+	return o, 3, nil
+}
+
+// arrange returns xs, which are in address order, in order o. prefix
+// gives the prefix of each.
+func arrange[T any](xs []T, o keyOrder, prefix func(T) netip.Prefix) []T {
+	if o.byLength {
+		var starts [129]int
+		for _, x := range xs {
+			if b := prefix(x).Bits(); b < 128 {
+				starts[b+1]++
+			}
+		}
+		for b := 1; b < len(starts); b++ {
+			starts[b] += starts[b-1]
+		}
+		out := make([]T, len(xs))
+		for _, x := range xs {
+			b := prefix(x).Bits()
+			out[starts[b]] = x
+			starts[b]++
+		}
+		xs = out
+	}
+	if o.desc {
+		slices.Reverse(xs)
+	}
+	return xs
+}
+
+// mergeOrdered merges a and b, each in address order, into one list in
+// address order.
+func mergeOrdered[T any](a, b []T, prefix func(T) netip.Prefix) []T {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	out := make([]T, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if comparePrefixes(prefix(a[0]), prefix(b[0])) <= 0 {
+			out, a = append(out, a[0]), a[1:]
+		} else {
+			out, b = append(out, b[0]), b[1:]
+		}
+	}
+	out = append(out, a...)
+	return append(out, b...)
+}
+
+// mergeAll merges lists, each in address order, into one list in address
+// order, merging them in pairs so each element is compared about log2 of
+// len(lists) times.
+func mergeAll[T any](lists [][]T, prefix func(T) netip.Prefix) []T {
+	if len(lists) == 0 {
+		return nil
+	}
+	for len(lists) > 1 {
+		next := lists[:0]
+		for i := 0; i < len(lists); i += 2 {
+			if i+1 == len(lists) {
+				next = append(next, lists[i])
+			} else {
+				next = append(next, mergeOrdered(lists[i], lists[i+1], prefix))
+			}
+		}
+		lists = next
+	}
+	return lists[0]
+}
+
+// entryPrefix is the prefix function of an entry list.
+func entryPrefix(e entry) netip.Prefix { return e.prefix }
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestSortBy(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, k := range []string{"10.0.0.0/8", "10.0.0.0/16", "10.1.0.0/16", "10.0.0.0/24", "9.0.0.0/8", "::/0", "2001:db8::/32"} {
+		mustDo(t, ss, "SET", k, "v")
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"KEYS", "*"}, "[9.0.0.0/8 10.0.0.0/8 10.0.0.0/16 10.0.0.0/24 10.1.0.0/16 ::/0 2001:db8::/32]"},
+		{[]string{"KEYS", "*", "SORT", "BY", "ADDRESS", "DESC"}, "[2001:db8::/32 ::/0 10.1.0.0/16 10.0.0.0/24 10.0.0.0/16 10.0.0.0/8 9.0.0.0/8]"},
+		{[]string{"KEYS", "*", "sort", "by", "length"}, "[::/0 9.0.0.0/8 10.0.0.0/8 10.0.0.0/16 10.1.0.0/16 10.0.0.0/24 2001:db8::/32]"},
+		{[]string{"KEYS", "*", "SORT", "BY", "LENGTH", "DESC"}, "[2001:db8::/32 10.0.0.0/24 10.1.0.0/16 10.0.0.0/16 10.0.0.0/8 9.0.0.0/8 ::/0]"},
+		{[]string{"KEYS", "*", "FAMILY", "v4", "SORT", "BY", "LENGTH"}, "[9.0.0.0/8 10.0.0.0/8 10.0.0.0/16 10.1.0.0/16 10.0.0.0/24]"},
+		{[]string{"KEYS", "*", "SORT", "BY", "LENGTH", "FAMILY", "v6"}, "[::/0 2001:db8::/32]"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "SORT", "BY", "LENGTH", "DESC"}, "[10.0.0.0/24 10.1.0.0/16 10.0.0.0/16 10.0.0.0/8]"},
+		{[]string{"TREEGET", "10.0.0.0/15", "SORT", "BY", "ADDRESS", "DESC"}, "[10.1.0.0/16 v 10.0.0.0/24 v 10.0.0.0/16 v]"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "CURSOR", "0", "COUNT", "2", "SORT", "BY", "ADDRESS"}, "[10.0.0.0/16 [10.0.0.0/8 10.0.0.0/16]]"},
+
+		{[]string{"SUBNETS", "10.0.0.0/8", "CURSOR", "0", "SORT", "BY", "LENGTH"}, "ERR CURSOR pages in address order"},
+		{[]string{"KEYS", "*", "SORT", "BY", "VALUE"}, "ERR SORT BY must be ADDRESS or LENGTH"},
+		{[]string{"KEYS", "*", "SORT", "LENGTH"}, "ERR syntax error"},
+		{[]string{"KEYS", "*", "SORT"}, "ERR syntax error"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "SORT", "BY"}, "ERR syntax error"},
+	})
+}
+
+func TestMergeAll(t *testing.T) {
+	self := func(p netip.Prefix) netip.Prefix { return p }
+	parse := func(ss ...string) []netip.Prefix {
+		var out []netip.Prefix
+		for _, s := range ss {
+			out = append(out, netip.MustParsePrefix(s))
+		}
+		return out
+	}
+	for _, tc := range []struct {
+		lists [][]netip.Prefix
+		want  []netip.Prefix
+	}{
+		{nil, nil},
+		{[][]netip.Prefix{parse("10.0.0.0/8")}, parse("10.0.0.0/8")},
+		{[][]netip.Prefix{parse("2000::/16", "4000::/16"), parse("3000::/16"), nil},
+			parse("2000::/16", "3000::/16", "4000::/16")},
+		{[][]netip.Prefix{parse("::/0"), parse("0.0.0.0/0", "10.0.0.0/8"), parse("10.0.0.0/16"), parse("10.0.0.0/8")},
+			parse("0.0.0.0/0", "10.0.0.0/8", "10.0.0.0/8", "10.0.0.0/16", "::/0")},
+	} {
+		if got := mergeAll(tc.lists, self); !slices.Equal(got, tc.want) {
+			t.Errorf("mergeAll(%v) = %v, want %v", tc.lists, got, tc.want)
+		}
+	}
+}
+
+// TestKeyListingOrder checks the address order of KEYS, SUBNETS and
+// TREEGET across IPv6 shards, which do not split the space in order:
+// 2000::/16 and 4000::/16 differ only in the top 3 bits, so they share a
+// shard, and 3000::/16 sorts between them from another.
+func TestKeyListingOrder(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	all := mixedKeys(t, ss)
+	var want []string
+	for _, p := range all {
+		if p.Addr().Is6() {
+			want = append(want, p.String())
+		}
+	}
+	for _, args := range [][]string{
+		{"KEYS", "*:*"},
+		{"KEYS", "*", "FAMILY", "v6"},
+		{"SUBNETS", "::/0"},
+	} {
+		if got := mustDo(t, ss, args...).strs(); !slices.Equal(got, want) {
+			t.Errorf("%q = %q, want %q", args, got, want)
+		}
+	}
+	if got := mustDo(t, ss, "KEYS", "*").strs(); len(got) != len(all) || !slices.Equal(got[len(got)-len(want):], want) {
+		t.Errorf("KEYS * does not end with the IPv6 prefixes in address order: %q", got)
+	}
+	var got []string
+	for i, s := range mustDo(t, ss, "TREEGET", "::/0").strs() {
+		if i%2 == 0 {
+			got = append(got, s)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("TREEGET ::/0 = %q, want %q", got, want)
+	}
+	got = got[:0]
+	for cursor := "0"; ; {
+		r := mustDo(t, ss, "SUBNETS", "::/0", "CURSOR", cursor, "COUNT", "7")
+		got = append(got, r.Array[1].strs()...)
+		if cursor = r.Array[0].Str; cursor == "0" || len(got) > len(want) {
+			break
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("SUBNETS ::/0 CURSOR paged %q, want %q", got, want)
+	}
+	byLength := slices.Clone(want)
+	slices.SortStableFunc(byLength, func(a, b string) int {
+		return netip.MustParsePrefix(a).Bits() - netip.MustParsePrefix(b).Bits()
+	})
+	slices.Reverse(byLength)
+	if got := mustDo(t, ss, "KEYS", "*:*", "SORT", "BY", "LENGTH", "DESC").strs(); !slices.Equal(got, byLength) {
+		t.Errorf("KEYS *:* SORT BY LENGTH DESC = %q, want %q", got, byLength)
+	}
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// With -otel-endpoint set, sampled commands are traced as OpenTelemetry
+// server spans and exported to a collector with OTLP over HTTP, in its
+// JSON encoding, so no SDK is needed. A span carries the command, the
+// database, the key when the command's first argument is an address or
+// prefix, and the kind of reply. A client joins the server's span to its
+// own trace by sending CLIENT TRACEPARENT with a W3C traceparent header
+// before the command; the context applies to that next command only.
+// Without an endpoint, tracing costs one pointer load per command.
+
+const (
+	// otelQueue is how many finished spans wait for export; more are
+	// dropped, so a slow collector never slows commands down.
+	otelQueue = 4096
+	// otelBatch is how many spans one export sends at most.
+	otelBatch = 512
+	// otelFlushEvery is the longest a finished span waits for export.
+	otelFlushEvery = 5 * time.Second
+	// otelTimeout bounds one export request.
+	otelTimeout = 10 * time.Second
+)
+
+// Key redaction modes, for otel-key-redaction.
+const (
+	redactMask = iota // cut to at most /24 or /48, the usual anonymization
+	redactNone        // the key as given
+	redactDrop        // no key attribute
+)
+
+var redactModes = []string{"mask", "none", "drop"}
+
+func parseRedactMode(v string) (int32, bool) {
+	for i, m := range redactModes {
+		if strings.EqualFold(v, m) {
+			return int32(i), true
+		}
+	}
+	return 0, false
+}
+
+// traceContext is a parsed W3C traceparent.
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceParent parses a traceparent header, version-traceid-spanid-flags.
+func parseTraceParent(h string) (traceContext, error) {
+	var tc traceContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, newError(ClassErr, "invalid traceparent, expected 00-<trace-id>-<span-id>-<flags>")
+	}
+	flags, err := hex.DecodeString(parts[3])
+	_, err1 := hex.Decode(tc.traceID[:], []byte(parts[1]))
+	_, err2 := hex.Decode(tc.spanID[:], []byte(parts[2]))
+	if err != nil || err1 != nil || err2 != nil || tc.traceID == [16]byte{} || tc.spanID == [8]byte{} {
+		return tc, newError(ClassErr, "invalid traceparent, expected 00-<trace-id>-<span-id>-<flags>")
+	}
+	tc.sampled = flags[0]&1 != 0
+	return tc, nil
+}
+
+// tracing holds the tracing settings; exporter is nil unless an
+// endpoint was given at startup.
+type tracing struct {
+	endpoint string
+	exporter atomic.Pointer[otlpExporter]
+	ratio    atomic.Uint64 // math.Float64bits of otel-sample-ratio
+	redact   atomic.Int32  // one of the redact* modes
+
+	exported atomic.Int64
+	dropped  atomic.Int64 // queue full or export failed
+}
+
+// otlpExporter sends finished spans to a collector in batches.
+type otlpExporter struct {
+	url     string
+	service string
+	queue   chan otlpSpan
+	client  *http.Client
+}
+
+// otlpSpan and the types below are the parts of the OTLP/JSON trace
+// encoding triedis writes. IDs are hex and times decimal strings.
+type otlpSpan struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         int         `json:"kind"`
+	Start        string      `json:"startTimeUnixNano"`
+	End          string      `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr  `json:"attributes"`
+	Status       *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpKindServer  = 2
+	otlpStatusError = 2
+)
+
+func stringAttr(k, v string) otlpAttr {
+	return otlpAttr{k, map[string]string{"stringValue": v}}
+}
+
+func intAttr(k string, v int64) otlpAttr {
+	return otlpAttr{k, map[string]string{"intValue": strconv.FormatInt(v, 10)}}
+}
+
+// tracesURL turns -otel-endpoint into the URL spans are posted to: a
+// bare host:port gets http://, and a URL without a path /v1/traces, as
+// OTEL_EXPORTER_OTLP_ENDPOINT is read.
+func tracesURL(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("invalid OTLP endpoint '%s', expected host:port or an http(s) URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// startTracing queues spans for export to endpoint. Start exports them;
+// until it runs, spans past the queue's capacity are dropped.
+func (s *TrieServer) startTracing(endpoint, service string) error {
+	u, err := tracesURL(endpoint)
+	if err != nil {
+		return err
+	}
+	s.tracing.endpoint = endpoint
+	e := &otlpExporter{url: u, service: service, queue: make(chan otlpSpan, otelQueue),
+		client: &http.Client{Timeout: otelTimeout}}
+	s.tracing.exporter.Store(e)
+	return nil
+}
+
+// run exports queued spans for the life of the server, a batch when one
+// fills or otelFlushEvery after the first span of it. A failing collector
+// is logged when it starts and stops failing, not on every export.
+func (e *otlpExporter) run(t *tracing) {
+	tick := time.NewTicker(otelFlushEvery)
+	defer tick.Stop()
+	batch := make([]otlpSpan, 0, otelBatch)
+	failing := false
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := e.export(batch)
+		switch {
+		case err != nil:
+			t.dropped.Add(int64(len(batch)))
+			if !failing {
+				slog.Warn("OTLP export failed, dropping spans until it recovers", "url", e.url, "err", err)
+			}
+		case failing:
+			slog.Info("OTLP export recovered", "url", e.url)
+			fallthrough
+		default:
+			t.exported.Add(int64(len(batch)))
+		}
+		failing = err != nil
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case sp := <-e.queue:
+			if batch = append(batch, sp); len(batch) == otelBatch {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// export posts one batch of spans.
+func (e *otlpExporter) export(spans []otlpSpan) error {
+	body, err := json.Marshal(map[string]any{"resourceSpans": []any{map[string]any{
+		"resource": map[string]any{"attributes": []otlpAttr{
+			stringAttr("service.name", e.service),
+			stringAttr("service.version", version),
+		}},
+		"scopeSpans": []any{map[string]any{
+			"scope": map[string]string{"name": "triedis", "version": version},
+			"spans": spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), otelTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// span is a command being traced. It stands in for the connection the
+// command replies through, to see what kind of reply it sends.
+type span struct {
+	redcon.Conn
+	name   string
+	parent *traceContext
+	start  time.Time
+	attrs  []otlpAttr
+	reply  string // the first reply's kind
+	errMsg string
+}
+
+// startSpan returns the span to run cmd under, or nil if tracing is off
+// or the command is not sampled. A sampled parent context is always
+// followed; without one, otel-sample-ratio of commands are sampled.
+func (s *TrieServer) startSpan(conn redcon.Conn, c *client, name string, cmd redcon.Command) *span {
+	e, parent := s.tracing.exporter.Load(), c.traceParent
+	if e == nil && parent == nil {
+		return nil
+	}
+	if name == "CLIENT" && len(cmd.Args) > 1 && strings.EqualFold(string(cmd.Args[1]), "TRACEPARENT") {
+		return nil // sets the context of the next command
+	}
+	c.traceParent = nil
+	switch {
+	case e == nil:
+		return nil
+	case parent != nil && !parent.sampled:
+		return nil
+	case parent == nil && rand.Float64() >= math.Float64frombits(s.tracing.ratio.Load()):
+		return nil
+	}
+	sp := &span{Conn: conn, name: name, parent: parent, start: time.Now()}
+	sp.attrs = append(sp.attrs,
+		stringAttr("db.system.name", "triedis"),
+		stringAttr("db.operation.name", name),
+		stringAttr("db.namespace", strconv.Itoa(currentDB(conn))),
+		intAttr("triedis.client.id", c.id))
+	if c.peer.IsValid() {
+		sp.attrs = append(sp.attrs, stringAttr("network.peer.address", c.peer.String()))
+	}
+	if len(cmd.Args) > 1 {
+		if key, ok := s.spanKey(string(cmd.Args[1])); ok {
+			sp.attrs = append(sp.attrs, stringAttr("triedis.key", key))
+		}
+	}
+	return sp
+}
+
+// spanKey returns the key attribute for a command's first argument, if
+// it is an address or prefix, as otel-key-redaction has it. Anything else,
+// such as a password or a file path, is never recorded.
+func (s *TrieServer) spanKey(arg string) (string, bool) {
+	mode := s.tracing.redact.Load()
+	if mode == redactDrop {
+		return "", false
+	}
+	p, err := parsePrefix(arg)
+	if err != nil {
+		return "", false
+	}
+	if mode == redactNone {
+		return arg, true
+	}
+	keep := 24
+	if p.Addr().Is6() && !p.Addr().Is4In6() {
+		keep = 48
+	}
+	if p.Bits() > keep {
+		p = netip.PrefixFrom(p.Addr(), keep).Masked()
+	}
+	return p.String(), true
+}
+
+// finish queues sp for export, or drops it if the queue is full.
+func (s *TrieServer) finish(sp *span) {
+	e := s.tracing.exporter.Load()
+	end := time.Now()
+	var traceID [16]byte
+	var spanID [8]byte
+	putRandom(spanID[:])
+	out := otlpSpan{Name: sp.name, Kind: otlpKindServer,
+		Start: strconv.FormatInt(sp.start.UnixNano(), 10), End: strconv.FormatInt(end.UnixNano(), 10)}
+	if sp.parent != nil {
+		traceID = sp.parent.traceID
+		out.ParentSpanID = hex.EncodeToString(sp.parent.spanID[:])
+	} else {
+		putRandom(traceID[:])
+	}
+	out.TraceID, out.SpanID = hex.EncodeToString(traceID[:]), hex.EncodeToString(spanID[:])
+	if sp.reply == "" {
+		sp.reply = "none"
+	}
+	out.Attributes = append(sp.attrs, stringAttr("triedis.reply.type", sp.reply))
+	if sp.reply == "error" {
+		out.Status = &otlpStatus{Code: otlpStatusError, Message: sp.errMsg}
+	}
+	select {
+	case e.queue <- out:
+	default:
+		s.tracing.dropped.Add(1)
+	}
+}
+
+// putRandom fills b with random bytes, never all zero, for trace and
+// span IDs.
+func putRandom(b []byte) {
+	for {
+		for i := range b {
+			b[i] = byte(rand.Uint32())
+		}
+		for _, x := range b {
+			if x != 0 {
+				return
+			}
+		}
+	}
+}
+
+func (sp *span) replied(kind string) {
+	if sp.reply == "" {
+		sp.reply = kind
+	}
+}
+
+func (sp *span) WriteString(str string)      { sp.replied("status"); sp.Conn.WriteString(str) }
+func (sp *span) WriteBulk(bulk []byte)       { sp.replied("bulk"); sp.Conn.WriteBulk(bulk) }
+func (sp *span) WriteBulkString(bulk string) { sp.replied("bulk"); sp.Conn.WriteBulkString(bulk) }
+func (sp *span) WriteInt(num int)            { sp.replied("integer"); sp.Conn.WriteInt(num) }
+func (sp *span) WriteInt64(num int64)        { sp.replied("integer"); sp.Conn.WriteInt64(num) }
+func (sp *span) WriteUint64(num uint64)      { sp.replied("integer"); sp.Conn.WriteUint64(num) }
+func (sp *span) WriteArray(count int)        { sp.replied("array"); sp.Conn.WriteArray(count) }
+func (sp *span) WriteNull()                  { sp.replied("null"); sp.Conn.WriteNull() }
+func (sp *span) WriteRaw(data []byte)        { sp.replied("raw"); sp.Conn.WriteRaw(data) }
+func (sp *span) WriteAny(v any)              { sp.replied("raw"); sp.Conn.WriteAny(v) }
+
+func (sp *span) WriteError(msg string) {
+	if sp.reply == "" {
+		sp.reply, sp.errMsg = "error", msg
+	}
+	sp.Conn.WriteError(msg)
+}
+
+// registerTracingConfig exposes the tracing settings. The endpoint is
+// fixed at startup; the others apply from the next command.
+func (s *TrieServer) registerTracingConfig() {
+	t := &s.tracing
+	s.addConfig("otel-endpoint", func() string { return t.endpoint }, nil)
+	s.addConfig("otel-sample-ratio",
+		func() string { return strconv.FormatFloat(math.Float64frombits(t.ratio.Load()), 'g', -1, 64) },
+		func(v string) error {
+			r, err := strconv.ParseFloat(v, 64)
+			if err != nil || r < 0 || r > 1 {
+				return errors.New("argument must be a number from 0 to 1")
+			}
+			t.ratio.Store(math.Float64bits(r))
+			return nil
+		})
+	s.addConfig("otel-key-redaction",
+		func() string { return redactModes[t.redact.Load()] },
+		func(v string) error {
+			mode, ok := parseRedactMode(v)
+			if !ok {
+				return errors.New("argument must be mask, none or drop")
+			}
+			t.redact.Store(mode)
+			return nil
+		})
+}
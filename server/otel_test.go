@@ -0,0 +1,253 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	for _, tc := range []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{" 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03 ", true, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true}, // a later version may add fields
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz", false, false},
+		{"", false, false},
+	} {
+		tc2, err := parseTraceParent(tc.header)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseTraceParent(%q): %v, want ok %v", tc.header, err, tc.ok)
+			continue
+		}
+		if err == nil && tc2.sampled != tc.sampled {
+			t.Errorf("parseTraceParent(%q) sampled %v, want %v", tc.header, tc2.sampled, tc.sampled)
+		}
+	}
+}
+
+func TestTracesURL(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint string
+		want     string // empty for an error
+	}{
+		{"localhost:4318", "http://localhost:4318/v1/traces"},
+		{"http://collector:4318/", "http://collector:4318/v1/traces"},
+		{"https://collector.example/otlp/v1/traces", "https://collector.example/otlp/v1/traces"},
+		{"ftp://collector:21", ""},
+		{"http://", ""},
+	} {
+		got, err := tracesURL(tc.endpoint)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("tracesURL(%q) = %s, want an error", tc.endpoint, got)
+			}
+		} else if err != nil || got != tc.want {
+			t.Errorf("tracesURL(%q) = %s, %v, want %s", tc.endpoint, got, err, tc.want)
+		}
+	}
+}
+
+func TestSpanKey(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct {
+		mode string
+		arg  string
+		want string // empty for no attribute
+	}{
+		{"mask", "192.0.2.77", "192.0.2.0/24"},
+		{"mask", "10.0.0.0/8", "10.0.0.0/8"},
+		{"mask", "2001:db8:1:2::5", "2001:db8:1::/48"},
+		{"mask", "2001:db8::/32", "2001:db8::/32"},
+		{"mask", "secret", ""},
+		{"mask", "/etc/passwd", ""},
+		{"none", "192.0.2.77", "192.0.2.77"},
+		{"drop", "192.0.2.77", ""},
+	} {
+		mode, _ := parseRedactMode(tc.mode)
+		s.tracing.redact.Store(mode)
+		if got, _ := s.spanKey(tc.arg); got != tc.want {
+			t.Errorf("%s: spanKey(%q) = %q, want %q", tc.mode, tc.arg, got, tc.want)
+		}
+	}
+}
+
+// spanAttrs returns sp's attributes by key.
+func spanAttrs(sp otlpSpan) map[string]string {
+	attrs := make(map[string]string)
+	for _, a := range sp.Attributes {
+		for _, v := range a.Value {
+			attrs[a.Key] = v
+		}
+	}
+	return attrs
+}
+
+func TestTracing(t *testing.T) {
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	for _, tc := range []struct {
+		name  string
+		ratio float64
+		steps [][]string // the last is the command checked
+		want  map[string]string
+		err   string // the span's status message
+	}{
+		{
+			name:  "sampled",
+			ratio: 1,
+			steps: [][]string{{"SET", "10.0.0.0/8", "a"}, {"GET", "10.1.2.3"}},
+			want: map[string]string{"db.operation.name": "GET", "db.namespace": "0", "triedis.key": "10.1.2.0/24",
+				"network.peer.address": "127.0.0.1", "triedis.reply.type": "bulk"},
+		},
+		{
+			name:  "selected database",
+			ratio: 1,
+			steps: [][]string{{"SELECT", "3"}, {"HGET", "10.0.0.0/8", "f"}},
+			want:  map[string]string{"db.operation.name": "HGET", "db.namespace": "3", "triedis.reply.type": "null"},
+		},
+		{
+			name:  "error status",
+			ratio: 1,
+			steps: [][]string{{"SET", "10.0.0.0/8"}},
+			want:  map[string]string{"db.operation.name": "SET", "triedis.reply.type": "error"},
+			err:   "ERR wrong number of arguments for 'SET'",
+		},
+		{
+			name:  "no key",
+			ratio: 1,
+			steps: [][]string{{"CONFIG", "GET", "port"}},
+			want:  map[string]string{"db.operation.name": "CONFIG", "triedis.key": "", "triedis.reply.type": "array"},
+		},
+		{
+			name:  "sampled parent overrides the ratio",
+			ratio: 0,
+			steps: [][]string{{"CLIENT", "TRACEPARENT", parent}, {"PING"}},
+			want:  map[string]string{"db.operation.name": "PING", "triedis.reply.type": "status"},
+		},
+		{
+			name:  "unsampled parent",
+			ratio: 1,
+			steps: [][]string{{"CLIENT", "TRACEPARENT", strings.TrimSuffix(parent, "1") + "0"}, {"PING"}},
+		},
+		{
+			name:  "ratio 0",
+			steps: [][]string{{"PING"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			e := &otlpExporter{queue: make(chan otlpSpan, 16)}
+			s.tracing.exporter.Store(e)
+			s.tracing.ratio.Store(math.Float64bits(tc.ratio))
+			ss := newTestSession(t, s)
+			for _, args := range tc.steps {
+				ss.Do(args...)
+			}
+			var sp otlpSpan
+			for len(e.queue) > 0 {
+				sp = <-e.queue // the last command's span
+			}
+			if tc.want == nil {
+				if sp.Name != "" {
+					t.Fatalf("%s was traced", sp.Name)
+				}
+				return
+			}
+			attrs := spanAttrs(sp)
+			for k, want := range tc.want {
+				if attrs[k] != want {
+					t.Errorf("%s = %q, want %q", k, attrs[k], want)
+				}
+			}
+			if tc.err != "" && (sp.Status == nil || sp.Status.Code != otlpStatusError || sp.Status.Message != tc.err) {
+				t.Errorf("status %+v, want error %q", sp.Status, tc.err)
+			}
+			if tc.err == "" && sp.Status != nil {
+				t.Errorf("status %+v, want none", sp.Status)
+			}
+			if tc.ratio == 0 && (sp.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || sp.ParentSpanID != "00f067aa0ba902b7") {
+				t.Errorf("span in trace %s under %s, want the parent's", sp.TraceID, sp.ParentSpanID)
+			}
+		})
+	}
+}
+
+func TestTracingExport(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	status := http.StatusOK
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s with %s", r.Method, r.URL, r.Header.Get("Content-Type"))
+		}
+		w.WriteHeader(status)
+		bodies <- b
+	}))
+	defer collector.Close()
+
+	s := newTestServer(t)
+	if err := s.startTracing(strings.TrimPrefix(collector.URL, "http://"), "edge-lookup"); err != nil {
+		t.Fatal(err)
+	}
+	e := s.tracing.exporter.Load()
+	spans := []otlpSpan{{TraceID: "01", SpanID: "02", Name: "GET", Kind: otlpKindServer}}
+	if err := e.export(spans); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttr `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(<-bodies, &got); err != nil {
+		t.Fatal(err)
+	}
+	rs := got.ResourceSpans
+	if len(rs) != 1 || len(rs[0].ScopeSpans) != 1 || len(rs[0].ScopeSpans[0].Spans) != 1 ||
+		rs[0].ScopeSpans[0].Spans[0].Name != "GET" || rs[0].Resource.Attributes[0].Value["stringValue"] != "edge-lookup" {
+		t.Errorf("exported %+v", got)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := e.export(spans); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("export to a failing collector: %v", err)
+	}
+	<-bodies
+
+	// A full queue drops spans rather than waiting.
+	full := &otlpExporter{queue: make(chan otlpSpan)}
+	s.tracing.exporter.Store(full)
+	s.tracing.ratio.Store(math.Float64bits(1))
+	ss := newTestSession(t, s)
+	runSteps(t, ss, []replyStep{{[]string{"PING"}, "PONG"}})
+	if got := infoFields(mustDo(t, ss, "INFO", "stats").Str)["otel_spans_dropped"]; got != "1" {
+		t.Errorf("otel_spans_dropped = %s, want 1", got)
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "otel-sample-ratio", "1.5"}, "ERR"},
+		{[]string{"CONFIG", "SET", "otel-key-redaction", "hash"}, "ERR"},
+		{[]string{"CONFIG", "SET", "otel-key-redaction", "DROP"}, "OK"},
+		{[]string{"CONFIG", "GET", "otel-key-redaction"}, "[otel-key-redaction drop]"},
+		{[]string{"CLIENT", "TRACEPARENT", "nope"}, "ERR invalid traceparent"},
+		{[]string{"CLIENT", "TRACEPARENT"}, "ERR wrong number of arguments for 'CLIENT TRACEPARENT'"},
+	})
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// Client classes client-output-buffer-limit sets limits for. This server
+// has no replicas or pub/sub clients, so every client is normal; the
+// other classes are accepted so that a setting written for Redis applies
+// unchanged.
+const (
+	classNormal = iota
+	classReplica
+	classPubSub
+)
+
+var clientClasses = [...]string{"normal", "replica", "pubsub"}
+
+// outputLimit is one class's client-output-buffer-limit: a client is
+// closed once its pending output reaches hard bytes, or has stayed at or
+// above soft bytes for longer than softSecs. 0 disables a limit.
+type outputLimit struct {
+	hard, soft, softSecs int64
+}
+
+type outputLimits [len(clientClasses)]outputLimit
+
+// defaultOutputLimits are Redis's.
+const defaultOutputLimits = "normal 0 0 0 replica 256mb 64mb 60 pubsub 32mb 8mb 60"
+
+// parseOutputLimits applies spec, one or more "class hard soft seconds"
+// groups, to a copy of base. Classes not listed keep their limits.
+func parseOutputLimits(base outputLimits, spec string) (outputLimits, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return base, errors.New("expected class hard-limit soft-limit soft-seconds groups")
+	}
+	for i := 0; i < len(fields); i += 4 {
+		class := -1
+		for j, name := range clientClasses {
+			if strings.EqualFold(fields[i], name) || j == classReplica && strings.EqualFold(fields[i], "slave") {
+				class = j
+			}
+		}
+		if class < 0 {
+			return base, fmt.Errorf("invalid client class '%s'", fields[i])
+		}
+		hard, err := parseMemory(fields[i+1])
+		if err != nil {
+			return base, err
+		}
+		soft, err := parseMemory(fields[i+2])
+		if err != nil {
+			return base, err
+		}
+		secs, err := strconv.ParseInt(fields[i+3], 10, 64)
+		if err != nil || secs < 0 {
+			return base, errors.New("soft-seconds must be a non-negative number of seconds")
+		}
+		base[class] = outputLimit{hard, soft, secs}
+	}
+	return base, nil
+}
+
+// String formats the limits as CONFIG GET reports them, in bytes.
+func (l outputLimits) String() string {
+	parts := make([]string, len(l))
+	for i, lim := range l {
+		parts[i] = fmt.Sprintf("%s %d %d %d", clientClasses[i], lim.hard, lim.soft, lim.softSecs)
+	}
+	return strings.Join(parts, " ")
+}
+
+// outputConn is the connection commands write their replies to. redcon
+// buffers every reply of a pipeline and flushes them together, so a KEYS
+// or TREEGET over a large trie, or a client that stops reading, would
+// otherwise let the buffer grow unbounded. outputConn counts what is
+// written into the client's omem, which countedConn takes back down as
+// the buffer is flushed, and closes the client once it passes its limit.
+// Replies to a closed client are dropped.
+type outputConn struct {
+	redcon.Conn
+	s *TrieServer
+	c *client
+}
+
+// grow adds n bytes to the client's pending output, reporting false if
+// the write should be dropped.
+func (o *outputConn) grow(n int) bool {
+	if o.c.killed.Load() {
+		return false
+	}
+	o.s.checkOutputLimit(o.c, o.c.omem.Add(int64(n)))
+	return true
+}
+
+func (o *outputConn) WriteString(str string) {
+	if o.grow(len(str) + 3) {
+		o.Conn.WriteString(str)
+	}
+}
+
+func (o *outputConn) WriteBulk(bulk []byte) {
+	if o.grow(bulkLen(len(bulk))) {
+		o.Conn.WriteBulk(bulk)
+	}
+}
+
+func (o *outputConn) WriteBulkString(bulk string) {
+	if o.grow(bulkLen(len(bulk))) {
+		o.Conn.WriteBulkString(bulk)
+	}
+}
+
+func (o *outputConn) WriteInt(num int) {
+	if o.grow(intLen(int64(num))) {
+		o.Conn.WriteInt(num)
+	}
+}
+
+func (o *outputConn) WriteInt64(num int64) {
+	if o.grow(intLen(num)) {
+		o.Conn.WriteInt64(num)
+	}
+}
+
+func (o *outputConn) WriteUint64(num uint64) {
+	if o.grow(len(strconv.FormatUint(num, 10)) + 3) {
+		o.Conn.WriteUint64(num)
+	}
+}
+
+func (o *outputConn) WriteError(msg string) {
+	if o.grow(len(msg) + 3) {
+		o.Conn.WriteError(msg)
+	}
+}
+
+func (o *outputConn) WriteArray(count int) {
+	if o.grow(intLen(int64(count))) {
+		o.Conn.WriteArray(count)
+	}
+}
+
+func (o *outputConn) WriteNull() {
+	if o.grow(5) {
+		o.Conn.WriteNull()
+	}
+}
+
+func (o *outputConn) WriteRaw(data []byte) {
+	if o.grow(len(data)) {
+		o.Conn.WriteRaw(data)
+	}
+}
+
+func (o *outputConn) WriteAny(v any) {
+	o.WriteRaw(redcon.AppendAny(nil, v))
+}
+
+// intLen is the encoded size of a RESP integer or array header.
+func intLen(n int64) int {
+	return len(strconv.FormatInt(n, 10)) + 3
+}
+
+// bulkLen is the encoded size of a RESP bulk string of n bytes.
+func bulkLen(n int) int {
+	return intLen(int64(n)) + n + 2
+}
+
+// flushed takes n bytes written to the socket off c's pending output.
+func (c *client) flushed(n int) {
+	if c.omem.Add(-int64(n)) <= 0 {
+		c.omem.Store(0)
+		c.softSince.Store(0)
+	}
+}
+
+// checkOutputLimit closes c if pending bytes of output break its limit,
+// unless it is a no-evict client.
+func (s *TrieServer) checkOutputLimit(c *client, pending int64) {
+	lim := s.outputLimits.Load()[classNormal]
+	over := ""
+	switch {
+	case lim.hard > 0 && pending >= lim.hard:
+		over = "hard"
+	case lim.soft > 0 && pending >= lim.soft:
+		now := time.Now().UnixNano()
+		if since := c.softSince.Load(); since == 0 {
+			c.softSince.CompareAndSwap(0, now)
+		} else if time.Duration(now-since) > time.Duration(lim.softSecs)*time.Second {
+			over = "soft"
+		}
+	default:
+		c.softSince.Store(0)
+	}
+	if over == "" || c.exempt() || c.netConn == nil || !c.killed.CompareAndSwap(false, true) {
+		return
+	}
+	// Closing the socket also fails a flush stalled on the client.
+	c.netConn.Close()
+	s.stats.outputClosed.Add(1)
+	slog.Warn("closing client, output buffer limit reached", "client", c.id, "addr", c.addr,
+		"omem", pending, "limit", over)
+}
+
+// registerOutputLimitConfig exposes client-output-buffer-limit.
+func (s *TrieServer) registerOutputLimitConfig() {
+	s.addConfig("client-output-buffer-limit",
+		func() string { return s.outputLimits.Load().String() },
+		func(v string) error {
+			l, err := parseOutputLimits(*s.outputLimits.Load(), v)
+			if err != nil {
+				return err
+			}
+			s.outputLimits.Store(&l)
+			return nil
+		})
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOutputLimits(t *testing.T) {
+	base, err := parseOutputLimits(outputLimits{}, defaultOutputLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		spec    string
+		want    string // as CONFIG GET reports it
+		wantErr bool
+	}{
+		{spec: "normal 1mb 512kb 10", want: "normal 1048576 524288 10 replica 268435456 67108864 60 pubsub 33554432 8388608 60"},
+		{spec: "NORMAL 100 50 0 pubsub 0 0 0", want: "normal 100 50 0 replica 268435456 67108864 60 pubsub 0 0 0"},
+		{spec: "slave 1gb 0 0", want: "normal 0 0 0 replica 1073741824 0 0 pubsub 33554432 8388608 60"},
+		{spec: "", wantErr: true},
+		{spec: "normal 1mb 512kb", wantErr: true},
+		{spec: "master 1mb 0 0", wantErr: true},
+		{spec: "normal lots 0 0", wantErr: true},
+		{spec: "normal 0 lots 0", wantErr: true},
+		{spec: "normal 0 0 -1", wantErr: true},
+		{spec: "normal 0 0 1.5", wantErr: true},
+	} {
+		got, err := parseOutputLimits(base, tc.spec)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseOutputLimits(%q): %v, want error %v", tc.spec, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			if got != base {
+				t.Errorf("parseOutputLimits(%q) changed the limits on error", tc.spec)
+			}
+			continue
+		}
+		if got.String() != tc.want {
+			t.Errorf("parseOutputLimits(%q) = %q, want %q", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		limit      string
+		valueSize  int
+		wantClosed bool
+	}{
+		{"no limit", "normal 0 0 0", 64 << 10, false},
+		{"under the hard limit", "normal 128kb 0 0", 64 << 10, false},
+		{"over the hard limit", "normal 16kb 0 0", 64 << 10, true},
+		{"soft limit not yet held", "normal 0 16kb 60", 64 << 10, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			addr := serveTest(t, s)
+			ss := newTestSession(t, s)
+			runSteps(t, ss, []replyStep{
+				{[]string{"CONFIG", "SET", "client-output-buffer-limit", tc.limit}, "OK"},
+				{[]string{"SET", "10.0.0.0/8", strings.Repeat("x", tc.valueSize)}, "OK"},
+			})
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("GET 10.1.2.3\r\nPING\r\n")); err != nil {
+				t.Fatal(err)
+			}
+			r := bufio.NewReader(conn)
+			header, err := r.ReadString('\n')
+			if tc.wantClosed {
+				if err == nil {
+					t.Errorf("read %q, want the connection closed", header)
+				}
+			} else {
+				body := make([]byte, tc.valueSize+2)
+				if err == nil {
+					_, err = io.ReadFull(r, body)
+				}
+				if err == nil {
+					var pong string
+					pong, err = r.ReadString('\n')
+					if pong != "+PONG\r\n" {
+						t.Errorf("reply to PING %q, want +PONG", pong)
+					}
+				}
+				if err != nil {
+					t.Fatalf("reading replies: %v", err)
+				}
+			}
+
+			want := "0"
+			if tc.wantClosed {
+				want = "1"
+			}
+			info := infoFields(mustDo(t, ss, "INFO", "stats").Str)
+			if got := info["client_output_buffer_limit_disconnections"]; got != want {
+				t.Errorf("client_output_buffer_limit_disconnections = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestClientListOmem(t *testing.T) {
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	mustDo(t, ss, "SET", "10.0.0.0/8", strings.Repeat("x", 1000))
+	mustDo(t, ss, "GET", "10.0.0.0/8")
+	// The test connection is never flushed, so everything it was sent is
+	// still pending.
+	info := mustDo(t, ss, "CLIENT", "INFO").Str
+	var omem int
+	for _, f := range strings.Fields(info) {
+		if v, ok := strings.CutPrefix(f, "omem="); ok {
+			omem, _ = strconv.Atoi(v)
+		}
+	}
+	if omem < 1000 {
+		t.Errorf("CLIENT INFO %q, want omem counting the 1000-byte reply", info)
+	}
+}
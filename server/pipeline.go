@@ -0,0 +1,106 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// redcon parses every command it has read from a connection before it
+// runs the first, so a pipelining client's commands arrive together. A
+// run of plain GETs in them that fall in one shard would each take and
+// drop the same read locks; handlePipeline instead runs up to
+// pipelineBatch of them holding the wide shard and theirs read locked the
+// whole time. Each still takes the path of a command sent alone, through
+// its checks, statistics and reply. Any other command, and a GET that
+// would wait under the locks, such as on a rate-limited client, runs on
+// its own.
+
+// pipelineBatch is the most commands a pipeline batch runs under its
+// locks, which writes to the shard wait behind. Below 2 nothing is
+// batched, as BenchmarkPipeline measures.
+var pipelineBatch = 64
+
+// heldShards are the locks of a pipeline batch: db's wide shard, and sh
+// if it is another, read locked.
+type heldShards struct {
+	db *database
+	sh *shard
+}
+
+// isPlainGet reports whether cmd is a GET of a key alone, the command a
+// pipeline batch runs.
+func isPlainGet(cmd redcon.Command) bool {
+	return len(cmd.Args) == 2 && commandName(cmd.Args[0]) == "GET"
+}
+
+// get returns the value GET key reads for c from db, under the locks of
+// the pipeline batch c is running if it is one of db's.
+func (c *client) get(db *database, key string) (value, bool) {
+	if c.held.db == db {
+		return db.getHeld(key, c.held.sh)
+	}
+	return db.get(key)
+}
+
+// handlePipeline runs cmds, a pipeline of c's read from conn, in order,
+// batching runs of GETs.
+func (s *TrieServer) handlePipeline(conn redcon.Conn, c *client, cmds []redcon.Command) {
+	for len(cmds) > 0 {
+		db, sh, n := s.getRun(c, cmds)
+		if n < 2 {
+			s.handleCommand(conn, cmds[0])
+			cmds = cmds[1:]
+			continue
+		}
+		db.wide.mu.RLock()
+		if sh != db.wide {
+			sh.mu.RLock()
+		}
+		c.held = heldShards{db, sh}
+		for _, cmd := range cmds[:n] {
+			s.handleCommand(conn, cmd)
+		}
+		c.held = heldShards{}
+		if sh != db.wide {
+			sh.mu.RUnlock()
+		}
+		db.wide.mu.RUnlock()
+		cmds = cmds[n:]
+	}
+}
+
+// getRun returns how many of the commands at the head of cmds, up to
+// pipelineBatch, are plain GETs longest-matching in one shard of c's
+// database, with the database and the shard.
+func (s *TrieServer) getRun(c *client, cmds []redcon.Command) (*database, *shard, int) {
+	if c.loading != nil || !c.identified {
+		return nil, nil, 0
+	}
+	user, _ := s.userFor(c)
+	if rate, _ := s.rateLimit.limits(user); rate > 0 && !c.exempt() {
+		return nil, nil, 0 // a throttled command may sleep
+	}
+	db := s.getDB(int(c.db.Load()))
+	var sh *shard
+	n := 0
+	for _, cmd := range cmds[:min(len(cmds), pipelineBatch)] {
+		if !isPlainGet(cmd) {
+			break
+		}
+		if c.lpm.Load() && strings.Contains(string(cmd.Args[1]), "/") {
+			break // an exact read, not a longest match
+		}
+		p, err := db.parseLookup(string(cmd.Args[1]))
+		if err != nil {
+			break
+		}
+		if home := db.shardFor(p); sh == nil {
+			sh = home
+		} else if home != sh {
+			break
+		}
+		n++
+	}
+	return db, sh, n
+}
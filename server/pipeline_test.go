@@ -0,0 +1,404 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// readReply reads one simple, error, integer or bulk string reply from br,
+// as it came over the wire.
+func readReply(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil || line[0] != '$' || line == "$-1\r\n" {
+		return line, err
+	}
+	n, err := strconv.Atoi(line[1 : len(line)-2])
+	if err != nil {
+		return line, err
+	}
+	bulk := make([]byte, n+2)
+	_, err = io.ReadFull(br, bulk)
+	return line + string(bulk), err
+}
+
+// massLoad sends n SETs of distinct /24s, every thousandth of them of a
+// bad prefix, as one stream the way redis-cli --pipe does: all of it
+// without waiting for a reply, then an ECHO of a random payload whose
+// reply marks the end. It returns how many replies were OK and errors.
+func massLoad(t testing.TB, addr string, n int) (ok, errs int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	payload := strconv.FormatUint(rand.Uint64(), 16)
+	go func() {
+		var buf []byte
+		for i := range n {
+			key := netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(i >> 16), byte(i >> 8), byte(i), 0}), 24).String()
+			if i%1000 == 999 {
+				key = "bad-" + key
+			}
+			buf = redcon.AppendArray(buf, 3)
+			buf = redcon.AppendBulkString(buf, "SET")
+			buf = redcon.AppendBulkString(buf, key)
+			buf = redcon.AppendBulkString(buf, "AS64500")
+			if len(buf) > 1<<16 || i == n-1 {
+				if i == n-1 {
+					buf = redcon.AppendArray(buf, 2)
+					buf = redcon.AppendBulkString(buf, "ECHO")
+					buf = redcon.AppendBulkString(buf, payload)
+				}
+				if _, err := conn.Write(buf); err != nil {
+					return // the reader fails too
+				}
+				buf = buf[:0]
+			}
+		}
+	}()
+	br := bufio.NewReader(conn)
+	for {
+		r, err := readReply(br)
+		switch {
+		case err != nil:
+			t.Fatalf("after %d OKs and %d errors: %v", ok, errs, err)
+		case r == "+OK\r\n":
+			ok++
+		case r[0] == '-':
+			errs++
+		case r == "$"+strconv.Itoa(len(payload))+"\r\n"+payload+"\r\n":
+			return ok, errs
+		default:
+			t.Fatalf("unexpected reply %q", r)
+		}
+	}
+}
+
+func TestEcho(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, tc := range []struct {
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{args: []string{"ECHO", "hello"}, want: "hello"},
+		{args: []string{"ECHO", ""}, want: ""},
+		{args: []string{"ECHO", "a\x00b\r\n"}, want: "a\x00b\r\n"},
+		{args: []string{"ECHO"}, wantErr: true},
+		{args: []string{"ECHO", "a", "b"}, wantErr: true},
+	} {
+		r := ss.Do(tc.args...)
+		if err := r.Err(); (err != nil) != tc.wantErr {
+			t.Errorf("%q: error %v, want one: %v", tc.args, err, tc.wantErr)
+		} else if !tc.wantErr && (r.Type != BulkReply || r.Str != tc.want) {
+			t.Errorf("%q = %c%q, want bulk %q", tc.args, r.Type, r.Str, tc.want)
+		}
+	}
+}
+
+// TestMassLoad loads prefixes as redis-cli --pipe does and checks that a
+// load eight times the size takes not much more than eight times as long
+// per prefix, with a wide margin for a busy machine.
+func TestMassLoad(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveTest(t, s)
+	ss := newTestSession(t, s)
+	n := 200000
+	if testing.Short() {
+		n = 16000
+	}
+	var perPrefix [2]time.Duration
+	for i, size := range []int{n / 8, n} {
+		mustDo(t, ss, "FLUSHDB")
+		start := time.Now()
+		ok, errs := massLoad(t, addr, size)
+		perPrefix[i] = time.Since(start) / time.Duration(size)
+		if ok != size-size/1000 || errs != size/1000 {
+			t.Fatalf("%d prefixes: %d OK and %d errors, want %d and %d", size, ok, errs, size-size/1000, size/1000)
+		}
+		if got := mustDo(t, ss, "DBSIZE").Int; got != int64(ok) {
+			t.Fatalf("%d prefixes: DBSIZE = %d, want %d", size, got, ok)
+		}
+	}
+	if !testing.Short() && perPrefix[1] > 3*perPrefix[0] {
+		t.Errorf("loading %d prefixes took %v each, %d took %v", n, perPrefix[1], n/8, perPrefix[0])
+	}
+}
+
+// BenchmarkMassLoad reports the time per prefix of mass loads of
+// growing size, which should stay about flat.
+func BenchmarkMassLoad(b *testing.B) {
+	for _, n := range []int{10000, 100000, 1000000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			s := newTestServer(b)
+			addr := serveTest(b, s)
+			ss := newTestSession(b, s)
+			b.ResetTimer()
+			for range b.N {
+				b.StopTimer()
+				mustDo(b, ss, "FLUSHDB")
+				b.StartTimer()
+				massLoad(b, addr, n)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/prefix")
+		})
+	}
+}
+
+// pipeClient sends commands in pipelines and reads back their replies.
+type pipeClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	buf  []byte
+}
+
+func dialTest(t testing.TB, addr string) *pipeClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &pipeClient{conn: conn, r: bufio.NewReaderSize(conn, 1<<16)}
+}
+
+// send writes cmds as one pipeline and returns their replies, none of
+// which may be an array, each as it came over the wire.
+func (pc *pipeClient) send(cmds [][]string) ([]string, error) {
+	pc.buf = pc.buf[:0]
+	for _, args := range cmds {
+		pc.buf = redcon.AppendArray(pc.buf, len(args))
+		for _, a := range args {
+			pc.buf = redcon.AppendBulkString(pc.buf, a)
+		}
+	}
+	if _, err := pc.conn.Write(pc.buf); err != nil {
+		return nil, err
+	}
+	replies := make([]string, len(cmds))
+	for i := range replies {
+		r, err := readReply(pc.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = r
+	}
+	return replies, nil
+}
+
+// newShardedServer returns a test server whose databases have the given
+// number of shards per family.
+func newShardedServer(t testing.TB, shards int) *TrieServer {
+	s := newTestServer(t)
+	s.store.shardBits = 0
+	for 1<<s.store.shardBits < shards {
+		s.store.shardBits++
+	}
+	return s
+}
+
+// BenchmarkPipeline runs a 90% GET, 10% SET load over one connection in
+// pipelines of 64, against 100k /24s, with GETs batched under their
+// shard's lock and not. With one shard per family every run of GETs is a
+// batch; with the default 16, consecutive GETs of random addresses seldom
+// share a shard.
+func BenchmarkPipeline(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		for _, batch := range []int{1, 64} {
+			b.Run(fmt.Sprintf("shards=%d/batch=%d", shards, batch), func(b *testing.B) {
+				defer func(n int) { pipelineBatch = n }(pipelineBatch)
+				pipelineBatch = batch
+				benchmarkPipeline(b, shards)
+			})
+		}
+	}
+}
+
+func benchmarkPipeline(b *testing.B, shards int) {
+	s := newShardedServer(b, shards)
+	r := rand.New(rand.NewPCG(7, 8))
+	keys := make([]string, 100000)
+	ss := newTestSession(b, s)
+	for i := range keys {
+		keys[i] = netip.PrefixFrom(randomPrefix(r, 4, 24).Addr(), 24).Masked().String()
+		mustDo(b, ss, "SET", keys[i], "AS64500")
+	}
+	pc := dialTest(b, serveTest(b, s))
+	const depth = 64
+	batch := make([][]string, depth)
+	b.ResetTimer()
+	for done := 0; done < b.N; done += depth {
+		for i := range batch {
+			k := keys[r.IntN(len(keys))]
+			if r.IntN(10) == 0 {
+				batch[i] = []string{"SET", k, "AS64501"}
+			} else {
+				batch[i] = []string{"GET", strings.Replace(k, ".0/24", "."+strconv.Itoa(r.IntN(256)), 1)}
+			}
+		}
+		if _, err := pc.send(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGetRun(t *testing.T) {
+	get := func(key string) []string { return []string{"GET", key} }
+	for _, tc := range []struct {
+		name   string
+		shards int
+		rate   string // ratelimit
+		cmds   [][]string
+		want   int
+	}{
+		{"one shard", 1, "0", [][]string{get("10.0.0.1"), get("192.0.2.1"), get("10.0.0.0/8")}, 3},
+		{"ends at another command", 1, "0", [][]string{get("10.0.0.1"), {"SET", "10.0.0.0/8", "a"}, get("10.0.0.2")}, 1},
+		{"ends at a GET with options", 1, "0", [][]string{get("10.0.0.1"), {"GET", "10.0.0.2", "MAXLEN", "8"}}, 1},
+		{"ends at a bad key", 1, "0", [][]string{get("10.0.0.1"), get("nope"), get("10.0.0.2")}, 1},
+		{"ends at another family", 1, "0", [][]string{get("10.0.0.1"), get("2001:db8::1")}, 1},
+		{"ends at another shard", 16, "0", [][]string{get("10.0.0.1"), get("10.0.0.2"), get("200.0.0.1")}, 2},
+		{"lowercase", 1, "0", [][]string{{"get", "10.0.0.1"}, {"Get", "10.0.0.2"}}, 2},
+		{"capped", 1, "0", slices.Repeat([][]string{get("10.0.0.1")}, 100), 64},
+		{"rate limited", 1, "1000", [][]string{get("10.0.0.1"), get("10.0.0.2")}, 0},
+		{"rate limited but no-evict", 1, "1000", [][]string{get("10.0.0.1"), get("10.0.0.2")}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newShardedServer(t, tc.shards)
+			ss := newTestSession(t, s)
+			mustDo(t, ss, "CONFIG", "SET", "ratelimit", tc.rate) // and identifies the client
+			if strings.Contains(tc.name, "no-evict") {
+				mustDo(t, ss, "CLIENT", "NO-EVICT", "on")
+			}
+			var cmds []redcon.Command
+			for _, args := range tc.cmds {
+				cmd := redcon.Command{}
+				for _, a := range args {
+					cmd.Args = append(cmd.Args, []byte(a))
+				}
+				cmds = append(cmds, cmd)
+			}
+			if _, _, n := s.getRun(clientOf(ss.conn), cmds); n != tc.want {
+				t.Errorf("getRun = %d, want %d", n, tc.want)
+			}
+		})
+	}
+}
+
+// pipelineScript is a pipeline mixing runs of GETs with the commands that
+// end them or change how they read.
+func pipelineScript(r *rand.Rand) [][]string {
+	var cmds [][]string
+	addr := func() string {
+		if r.IntN(4) == 0 {
+			return netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 15: byte(r.IntN(4))}).String()
+		}
+		return netip.AddrFrom4([4]byte{10, byte(r.IntN(4)), byte(r.IntN(4)), byte(r.IntN(4))}).String()
+	}
+	for range 400 {
+		switch n := r.IntN(20); {
+		case n < 12:
+			cmds = append(cmds, []string{"GET", addr()})
+		case n < 14:
+			cmds = append(cmds, []string{"GET", "10." + strconv.Itoa(r.IntN(4)) + ".0.0/16"})
+		case n < 17:
+			p := netip.PrefixFrom(netip.MustParseAddr(addr()), 8+r.IntN(17)).Masked()
+			if p.Addr().Is6() {
+				p = netip.PrefixFrom(p.Addr(), 32+r.IntN(97)).Masked()
+			}
+			cmds = append(cmds, []string{"SET", p.String(), strconv.Itoa(r.IntN(100))})
+		case n < 18:
+			cmds = append(cmds, []string{"DEL", "10." + strconv.Itoa(r.IntN(4)) + ".0.0/16"})
+		case n < 19:
+			if r.IntN(2) == 0 {
+				cmds = append(cmds, []string{"SELECT", strconv.Itoa(r.IntN(2))})
+			} else {
+				cmds = append(cmds, []string{"CLIENT", "LPM", []string{"on", "off"}[r.IntN(2)]})
+			}
+		default:
+			cmds = append(cmds, []string{"GET", "not-an-address"})
+		}
+	}
+	return cmds
+}
+
+func TestPipelineBatching(t *testing.T) {
+	for _, shards := range []int{1, 16} {
+		var replies [2][]string
+		for i, batch := range []int{1, 64} {
+			func() {
+				defer func(n int) { pipelineBatch = n }(pipelineBatch)
+				pipelineBatch = batch
+				pc := dialTest(t, serveTest(t, newShardedServer(t, shards)))
+				out, err := pc.send(pipelineScript(rand.New(rand.NewPCG(9, 10))))
+				if err != nil {
+					t.Fatal(err)
+				}
+				replies[i] = out
+			}()
+		}
+		for i := range replies[0] {
+			if replies[0][i] != replies[1][i] {
+				t.Fatalf("db-shards %d: reply %d batched is %q, unbatched %q", shards, i, replies[1][i], replies[0][i])
+			}
+		}
+	}
+}
+
+// TestPipelineBatchConcurrentWrites pipelines GETs while other clients
+// write to the same shards and to all of them at once.
+func TestPipelineBatchConcurrentWrites(t *testing.T) {
+	addr := serveTest(t, newShardedServer(t, 1))
+	stop := make(chan struct{})
+	errs := make(chan error, 2)
+	for _, writes := range [][]string{{"SET", "10.0.0.0/8", "a"}, {"FLUSHDB"}} {
+		pc := dialTest(t, addr)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					errs <- nil
+					return
+				default:
+				}
+				if _, err := pc.send([][]string{writes, {"SET", "10.1.0.0/16", "b"}}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	pc := dialTest(t, addr)
+	gets := make([][]string, 256)
+	for i := range gets {
+		gets[i] = []string{"GET", "10.1." + strconv.Itoa(i) + ".1"}
+	}
+	for range 200 {
+		out, err := pc.send(gets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range out {
+			if r != "$-1\r\n" && r != "$1\r\na\r\n" && r != "$1\r\nb\r\n" {
+				t.Fatalf("GET replied %q", r)
+			}
+		}
+	}
+	close(stop)
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
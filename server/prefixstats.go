@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net/netip"
+
+	"github.com/tidwall/redcon"
+)
+
+// prefixHistogram counts stored prefixes by family and prefix length.
+type prefixHistogram struct {
+	v4 [33]int64
+	v6 [129]int64
+}
+
+// histogram counts the stored prefixes covered by within, or all of them
+// when within is invalid. The whole database's counts are kept current on
+// every write; a subtree's take one pass over the tries, locking shards
+// one at a time so writers elsewhere are never held up by the walk. The
+// walk stops with b's error once b runs out.
+func (d *database) histogram(within netip.Prefix, b *budget) (*prefixHistogram, error) {
+	h := new(prefixHistogram)
+	if !within.IsValid() {
+		for i := range h.v4 {
+			h.v4[i] = d.lengths4[i].Load()
+		}
+		for i := range h.v6 {
+			h.v6[i] = d.lengths6[i].Load()
+		}
+		return h, nil
+	}
+	count := func(p netip.Prefix, _ value) bool {
+		if b.exceeded() {
+			return false
+		}
+		if p.Addr().Is4() {
+			h.v4[p.Bits()]++
+		} else {
+			h.v6[p.Bits()]++
+		}
+		return true
+	}
+	// A prefix in a shard only has subnets there; a wide one may have them
+	// anywhere.
+	shards := d.allShards()
+	if home := d.shardFor(within); home != d.wide {
+		shards = []*shard{home}
+	}
+	for _, sh := range shards {
+		sh.mu.RLock()
+		sh.trie.Subnets(within, count)
+		sh.mu.RUnlock()
+		if b.exceeded() {
+			return nil, b.err()
+		}
+	}
+	return h, nil
+}
+
+// lengthSummary returns the shortest, mean and longest prefix length in
+// counts, or zeros if it is empty.
+func lengthSummary(counts []int64) (minLen int64, avgLen float64, maxLen int64) {
+	var n, sum int64
+	minLen = -1
+	for bits, c := range counts {
+		if c > 0 {
+			if minLen < 0 {
+				minLen = int64(bits)
+			}
+			maxLen = int64(bits)
+			n += c
+			sum += c * int64(bits)
+		}
+	}
+	if n == 0 {
+		return 0, 0, 0
+	}
+	return minLen, float64(sum) / float64(n), maxLen
+}
+
+// writeLengths writes the nonzero counts as length, count pairs.
+func writeLengths(conn redcon.Conn, counts []int64) {
+	n := 0
+	for _, c := range counts {
+		if c > 0 {
+			n++
+		}
+	}
+	conn.WriteArray(n * 2)
+	for bits, c := range counts {
+		if c > 0 {
+			conn.WriteInt(bits)
+			conn.WriteInt64(c)
+		}
+	}
+}
+
+// handlePrefixStats implements PREFIXSTATS [cidr], replying with how many
+// prefixes are stored at each length, per family, as
+// ipv4 [len count ...] ipv6 [len count ...]. With cidr it counts only the
+// prefixes that cidr covers, itself included.
+func (s *TrieServer) handlePrefixStats(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) > 2 {
+		conn.WriteError("ERR wrong number of arguments for 'PREFIXSTATS'")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	var within netip.Prefix
+	if len(cmd.Args) == 2 {
+		var err error
+		if within, err = db.parseLookup(string(cmd.Args[1])); err != nil {
+			writeError(conn, err)
+			return
+		}
+	}
+	h, err := db.histogram(within, &c.budget)
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	conn.WriteArray(4)
+	conn.WriteBulkString("ipv4")
+	writeLengths(conn, h.v4[:])
+	conn.WriteBulkString("ipv6")
+	writeLengths(conn, h.v6[:])
+}
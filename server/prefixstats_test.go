@@ -0,0 +1,54 @@
+package server
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+func TestPrefixStats(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, k := range []string{
+		"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.2.0.0/16", "10.1.2.0/24",
+		"192.168.0.0/16", "192.168.1.1", "2001:db8::/32", "2001:db8:1::/48", "::/0",
+	} {
+		mustDo(t, ss, "SET", k, "v")
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"PREFIXSTATS"}, "[ipv4 [0 1 8 1 16 3 24 1 32 1] ipv6 [0 1 32 1 48 1]]"},
+		{[]string{"PREFIXSTATS", "10.0.0.0/8"}, "[ipv4 [8 1 16 2 24 1] ipv6 []]"},
+		{[]string{"PREFIXSTATS", "10.1.0.0/16"}, "[ipv4 [16 1 24 1] ipv6 []]"},
+		{[]string{"PREFIXSTATS", "10.0.0.0/7"}, "[ipv4 [8 1 16 2 24 1] ipv6 []]"}, // wider than a shard
+		{[]string{"PREFIXSTATS", "192.168.1.1"}, "[ipv4 [32 1] ipv6 []]"},
+		{[]string{"PREFIXSTATS", "172.16.0.0/12"}, "[ipv4 [] ipv6 []]"},
+		{[]string{"PREFIXSTATS", "2001:db8::/32"}, "[ipv4 [] ipv6 [32 1 48 1]]"},
+		{[]string{"PREFIXSTATS", "::/0"}, "[ipv4 [] ipv6 [0 1 32 1 48 1]]"},
+		{[]string{"PREFIXSTATS", "not-a-prefix"}, "ERR invalid"},
+		{[]string{"PREFIXSTATS", "10.0.0.0/8", "x"}, "ERR wrong number of arguments for 'PREFIXSTATS'"},
+	})
+}
+
+// TestPrefixStatsRandom checks the histogram of random prefixes against
+// one counted from the prefixes themselves.
+func TestPrefixStatsRandom(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	r := rand.New(rand.NewPCG(5, 5))
+	var want [33]int64
+	seen := make(map[string]bool)
+	for range 2000 {
+		p := randomPrefix(r, 4, 0)
+		if seen[p.String()] {
+			continue
+		}
+		seen[p.String()] = true
+		want[p.Bits()]++
+		mustDo(t, ss, "SET", p.String(), "v")
+	}
+	got := mustDo(t, ss, "PREFIXSTATS").Array[1].Array
+	var counted [33]int64
+	for i := 0; i+1 < len(got); i += 2 {
+		counted[got[i].Int] = got[i+1].Int
+	}
+	if counted != want {
+		t.Errorf("PREFIXSTATS ipv4 = %v, want %v", counted, want)
+	}
+}
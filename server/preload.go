@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A -preload manifest lists the files to load before the server listens,
+// so it never answers from an empty dataset while a loader catches up:
+//
+//	{"databases": [
+//	  {"db": 0, "source": "blocklist.csv", "min_keys": 1000},
+//	  {"db": "geo", "source": "geo.json"},
+//	  {"db": 2, "source": "rib.20240101.0000.bz2", "format": "mrt", "template": "{origin}"},
+//	  {"db": 3, "source": "asn.tdb", "format": "snapshot"}
+//	]}
+//
+// db is an index or a -db-names name. format is csv, tsv, json, mrt or
+// snapshot, guessed from the file name as IMPORT guesses it if absent,
+// with .tdb meaning snapshot; a snapshot must hold one database, as for
+// RESTOREDB. Relative sources are read from the manifest's directory. A
+// source fails if it cannot be read, or if min_keys is given and the
+// database holds fewer keys once it is loaded.
+
+// preloadSource is one entry of a manifest.
+type preloadSource struct {
+	DB        json.RawMessage `json:"db"`
+	Source    string          `json:"source"`
+	Format    string          `json:"format"`
+	MinKeys   int64           `json:"min_keys"`
+	Template  string          `json:"template"`
+	Multipath string          `json:"multipath"`
+
+	id int
+}
+
+// preloadResult is how one source loaded, for the log and INFO.
+type preloadResult struct {
+	src     preloadSource
+	keys    int64
+	elapsed time.Duration
+	err     error
+}
+
+// preloadState is what INFO reports of the preload.
+type preloadState struct {
+	manifest string
+	status   string // none, ok or degraded
+	elapsed  time.Duration
+	results  []preloadResult
+}
+
+// readPreloadManifest parses and checks the manifest at path.
+func (s *TrieServer) readPreloadManifest(path string) ([]preloadSource, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m struct {
+		Databases []preloadSource `json:"databases"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool)
+	for i := range m.Databases {
+		src := &m.Databases[i]
+		var id any
+		if err := json.Unmarshal(src.DB, &id); err != nil || id == nil {
+			return nil, fmt.Errorf("entry %d: db must be an index or a name", i+1)
+		}
+		if src.id, err = s.resolveDB(fmt.Sprint(id)); err != nil {
+			return nil, fmt.Errorf("entry %d: %s", i+1, strings.TrimPrefix(err.Error(), "ERR "))
+		}
+		if seen[src.id] {
+			return nil, fmt.Errorf("entry %d: db %d is listed twice", i+1, src.id)
+		}
+		seen[src.id] = true
+		if src.Source == "" {
+			return nil, fmt.Errorf("entry %d: no source", i+1)
+		}
+		if !filepath.IsAbs(src.Source) {
+			src.Source = filepath.Join(filepath.Dir(path), src.Source)
+		}
+		switch src.Format = strings.ToLower(src.Format); {
+		case src.Format == "" && strings.HasSuffix(strings.ToLower(src.Source), ".tdb"):
+			src.Format = "snapshot"
+		case src.Format == "":
+			src.Format = formatFor(src.Source)
+		case src.Format != "snapshot":
+			if err := validImportFormat(src.Format); err != nil {
+				return nil, fmt.Errorf("entry %d: format must be csv, tsv, json, mrt or snapshot", i+1)
+			}
+		}
+		if src.Format != "mrt" && (src.Template != "" || src.Multipath != "") {
+			return nil, fmt.Errorf("entry %d: template and multipath are only for format mrt", i+1)
+		}
+		if _, err := parseMRTTemplate(src.Template); err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i+1, err)
+		}
+		if src.Multipath != "" && src.Multipath != "shortest" && src.Multipath != "all" {
+			return nil, fmt.Errorf("entry %d: multipath must be shortest or all", i+1)
+		}
+		if src.MinKeys < 0 {
+			return nil, fmt.Errorf("entry %d: min_keys must not be negative", i+1)
+		}
+	}
+	return m.Databases, nil
+}
+
+// preload loads every source of the manifest at path, one after another,
+// and reports whether all of them passed. A failed source does not stop
+// the rest, so one start reports every problem.
+func (s *TrieServer) preload(path string) (bool, error) {
+	sources, err := s.readPreloadManifest(path)
+	if err != nil {
+		return false, err
+	}
+	st := &s.preloadState
+	st.manifest = path
+	start := time.Now()
+	ok := true
+	for i, src := range sources {
+		slog.Info("Preloading", "db", src.id, "source", src.Source, "format", src.Format,
+			"progress", fmt.Sprintf("%d/%d", i+1, len(sources)))
+		r := s.preloadOne(src)
+		st.results = append(st.results, r)
+		if r.err != nil {
+			ok = false
+			slog.Error("Preload failed", "db", src.id, "source", src.Source, "err", r.err, "elapsed", r.elapsed)
+			continue
+		}
+		slog.Info("Preloaded", "db", src.id, "source", src.Source, "keys", r.keys, "elapsed", r.elapsed)
+	}
+	st.elapsed = time.Since(start)
+	st.status = "ok"
+	if !ok {
+		st.status = "degraded"
+	}
+	return ok, nil
+}
+
+// preloadOne loads one source and checks it.
+func (s *TrieServer) preloadOne(src preloadSource) preloadResult {
+	r := preloadResult{src: src}
+	start := time.Now()
+	if src.Format == "snapshot" {
+		r.err = s.preloadSnapshot(src)
+	} else {
+		var res importResult
+		res, r.err = s.getDB(src.id).importFile(importOptions{path: src.Source, format: src.Format,
+			template: src.Template, multipath: src.Multipath})
+		for _, e := range res.firstErrors {
+			slog.Warn("Preload import error", "db", src.id, "source", src.Source, "err", e)
+		}
+	}
+	r.elapsed = time.Since(start)
+	if db := s.existingDB(src.id); db != nil {
+		r.keys = db.keyCount()
+	}
+	if r.err == nil && r.keys < src.MinKeys {
+		r.err = fmt.Errorf("loaded %d keys, expected at least %d", r.keys, src.MinKeys)
+	}
+	return r
+}
+
+// preloadSnapshot replaces a database with the one in a snapshot file.
+func (s *TrieServer) preloadSnapshot(src preloadSource) error {
+	info, err := s.readSnapshotFile(src.Source, true)
+	if err != nil {
+		return err
+	}
+	if len(info.dbs) != 1 {
+		return fmt.Errorf("snapshot holds %d databases, expected one", len(info.dbs))
+	}
+	db := info.dbs[0].db
+	db.id = src.id
+	s.swapInDB(src.id, db)
+	return nil
+}
+
+// info reports the preload for INFO server: its status and, per source,
+// how it loaded.
+func (ps *preloadState) info(b *strings.Builder) {
+	status := ps.status
+	if status == "" {
+		status = "none"
+	}
+	fmt.Fprintf(b, "preload_status:%s\r\n", status)
+	if ps.manifest == "" {
+		return
+	}
+	failed := 0
+	for _, r := range ps.results {
+		if r.err != nil {
+			failed++
+		}
+	}
+	fmt.Fprintf(b, "preload_manifest:%s\r\n", ps.manifest)
+	fmt.Fprintf(b, "preload_sources:%d\r\n", len(ps.results))
+	fmt.Fprintf(b, "preload_failed:%d\r\n", failed)
+	fmt.Fprintf(b, "preload_elapsed_ms:%d\r\n", ps.elapsed.Milliseconds())
+	for _, r := range ps.results {
+		status := "ok"
+		if r.err != nil {
+			status = "failed"
+		}
+		fmt.Fprintf(b, "preload_db%d:source=%s,format=%s,status=%s,keys=%d,elapsed_ms=%d\r\n",
+			r.src.id, r.src.Source, r.src.Format, status, r.keys, r.elapsed.Milliseconds())
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadPreloadManifest(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		manifest string
+		want     string // db/format/source of each entry, or the start of the error
+	}{
+		{`{"databases": []}`, ""},
+		{`{"databases": [{"db": 0, "source": "a.csv"}, {"db": "geo", "source": "/abs/geo.json"}]}`,
+			"0/csv/" + filepath.Join(dir, "a.csv") + " 3/json//abs/geo.json"},
+		{`{"databases": [{"db": 1, "source": "asn.tdb"}, {"db": 2, "source": "rib.20261014.0000.bz2", "template": "{origin}"}]}`,
+			"1/snapshot/" + filepath.Join(dir, "asn.tdb") + " 2/mrt/" + filepath.Join(dir, "rib.20261014.0000.bz2")},
+		{`{"databases": [{"db": 0, "source": "a.txt", "format": "TSV", "min_keys": 5}]}`, "0/tsv/" + filepath.Join(dir, "a.txt")},
+		{`{"databases": [{"db": 0, "source": "a.csv", "format": "xml"}]}`, "entry 1: format must be csv, tsv, json, mrt or snapshot"},
+		{`{"databases": [{"db": 0, "source": "a.csv"}, {"db": "0", "source": "b.csv"}]}`, "entry 2: db 0 is listed twice"},
+		{`{"databases": [{"db": "nosuch", "source": "a.csv"}]}`, "entry 1: unknown database name 'nosuch'"},
+		{`{"databases": [{"db": null, "source": "a.csv"}]}`, "entry 1: db must be an index or a name"},
+		{`{"databases": [{"source": "a.csv"}]}`, "entry 1: db must be an index or a name"},
+		{`{"databases": [{"db": 0}]}`, "entry 1: no source"},
+		{`{"databases": [{"db": 0, "source": "a.csv", "template": "{origin}"}]}`, "entry 1: template and multipath are only for format mrt"},
+		{`{"databases": [{"db": 0, "source": "a.mrt", "template": "{nope}"}]}`, "entry 1: "},
+		{`{"databases": [{"db": 0, "source": "a.mrt", "multipath": "any"}]}`, "entry 1: multipath must be shortest or all"},
+		{`{"databases": [{"db": 0, "source": "a.csv", "min_keys": -1}]}`, "entry 1: min_keys must not be negative"},
+		{`{"databases": [{"db": 0, "source": "a.csv", "minkeys": 1}]}`, "json: unknown field"},
+		{`not json`, "invalid character"},
+	} {
+		s := newTestServer(t)
+		mustDo(t, newTestSession(t, s), "NAMEDB", "3", "geo")
+		path := filepath.Join(dir, "preload.json")
+		if err := os.WriteFile(path, []byte(tc.manifest), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sources, err := s.readPreloadManifest(path)
+		var got []string
+		if err != nil {
+			got = []string{err.Error()}
+		}
+		for _, src := range sources {
+			got = append(got, strings.Join([]string{strconv.Itoa(src.id), src.Format, src.Source}, "/"))
+		}
+		if g := strings.Join(got, " "); !strings.HasPrefix(g, tc.want) || err == nil && g != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.manifest, g, tc.want)
+		}
+	}
+}
+
+func TestPreload(t *testing.T) {
+	dir := t.TempDir()
+	snap := newTestSession(t, newTestServer(t))
+	runSteps(t, snap, []replyStep{
+		{[]string{"CONFIG", "SET", "dir", dir}, "OK"},
+		{[]string{"CONFIG", "SET", "dbfilename", "asn-%d.tdb"}, "OK"},
+		{[]string{"SELECT", "4"}, "OK"},
+		{[]string{"SET", "198.51.100.0/24", "AS64501"}, "OK"},
+		{[]string{"SAVE", "4"}, "OK"},
+		{[]string{"SELECT", "5"}, "OK"},
+		{[]string{"SET", "203.0.113.0/24", "AS64502"}, "OK"},
+		{[]string{"CONFIG", "SET", "dbfilename", "dump.tdb"}, "OK"},
+		{[]string{"SAVE"}, "OK"},
+	})
+	for name, content := range map[string]string{
+		"block.csv": "10.0.0.0/8,blocked\n192.0.2.0/24,blocked\n",
+		"geo.json":  `{"prefix":"10.1.0.0/16","value":"NO"}` + "\n",
+		"few.csv":   "172.16.0.0/12,only one\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		sources string
+		ok      bool
+		info    map[string]string // INFO server fields afterwards
+		get     map[string]string // db:addr to its value afterwards
+	}{
+		{
+			name:    "every format",
+			sources: `{"db": 0, "source": "block.csv", "min_keys": 2}, {"db": "geo", "source": "geo.json"}, {"db": 2, "source": "asn-4.tdb"}`,
+			ok:      true,
+			info: map[string]string{"preload_status": "ok", "preload_sources": "3", "preload_failed": "0",
+				"preload_db0": "source=" + filepath.Join(dir, "block.csv") + ",format=csv,status=ok,keys=2",
+				"preload_db2": "source=" + filepath.Join(dir, "asn-4.tdb") + ",format=snapshot,status=ok,keys=1"},
+			get: map[string]string{"0:10.1.2.3": "blocked", "3:10.1.2.3": "NO", "2:198.51.100.7": "AS64501"},
+		},
+		{
+			name:    "a failed source does not stop the rest",
+			sources: `{"db": 0, "source": "few.csv", "min_keys": 2}, {"db": 1, "source": "missing.csv"}, {"db": 2, "source": "block.csv"}`,
+			info: map[string]string{"preload_status": "degraded", "preload_sources": "3", "preload_failed": "2",
+				"preload_db0": "source=" + filepath.Join(dir, "few.csv") + ",format=csv,status=failed,keys=1",
+				"preload_db1": "source=" + filepath.Join(dir, "missing.csv") + ",format=csv,status=failed,keys=0"},
+			get: map[string]string{"0:172.16.0.1": "only one", "2:10.1.2.3": "blocked"},
+		},
+		{
+			name:    "a snapshot of several databases",
+			sources: `{"db": 0, "source": "dump.tdb", "format": "snapshot"}`,
+			info:    map[string]string{"preload_status": "degraded", "preload_failed": "1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "preload.json")
+			if err := os.WriteFile(path, []byte(`{"databases": [`+tc.sources+`]}`), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			s := newTestServer(t)
+			ss := newTestSession(t, s)
+			mustDo(t, ss, "NAMEDB", "3", "geo")
+			ok, err := s.preload(path)
+			if err != nil || ok != tc.ok {
+				t.Fatalf("preload = %v, %v, want %v", ok, err, tc.ok)
+			}
+			info := infoFields(mustDo(t, ss, "INFO", "server").Str)
+			for field, want := range tc.info {
+				if !strings.HasPrefix(info[field], want) {
+					t.Errorf("INFO %s = %q, want %q", field, info[field], want)
+				}
+			}
+			for key, want := range tc.get {
+				db, addr, _ := strings.Cut(key, ":")
+				mustDo(t, ss, "SELECT", db)
+				if r := mustDo(t, ss, "GET", addr); r.Str != want {
+					t.Errorf("db %s: GET %s = %q, want %q", db, addr, r.Str, want)
+				}
+			}
+		})
+	}
+
+	if info := infoFields(mustDo(t, newTestSession(t, newTestServer(t)), "INFO", "server").Str); info["preload_status"] != "none" {
+		t.Errorf("preload_status without -preload = %q, want none", info["preload_status"])
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUserSet(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                "",
+		"monitor":         "monitor",
+		"repl, monitor,,": "monitor,repl",
+		"a b a":           "a,b",
+	} {
+		if got := parseUserSet(in).String(); got != want {
+			t.Errorf("parseUserSet(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNoEvict(t *testing.T) {
+	const limited = "RATELIMIT client exceeded 1 commands per second"
+	for _, tc := range []struct {
+		name  string
+		setup []string // CONFIG SET arguments
+		steps []replyStep
+		flags string // in CLIENT INFO afterwards
+	}{
+		{
+			name:  "not no-evict",
+			steps: []replyStep{{[]string{"PING"}, "PONG"}, {[]string{"PING"}, limited}},
+			flags: "flags=N",
+		},
+		{
+			name: "CLIENT NO-EVICT on",
+			steps: []replyStep{
+				{[]string{"CLIENT", "NO-EVICT", "on"}, "OK"},
+				{[]string{"PING"}, "PONG"},
+				{[]string{"PING"}, "PONG"},
+			},
+			flags: "flags=e",
+		},
+		{
+			name: "CLIENT NO-EVICT off again",
+			steps: []replyStep{
+				{[]string{"CLIENT", "NO-EVICT", "ON"}, "OK"},
+				{[]string{"CLIENT", "NO-EVICT", "off"}, "OK"},
+				{[]string{"PING"}, limited},
+			},
+			flags: "flags=N",
+		},
+		{
+			name:  "listed in no-evict-users",
+			setup: []string{"no-evict-users", "monitor,default"},
+			steps: []replyStep{{[]string{"PING"}, "PONG"}, {[]string{"PING"}, "PONG"}, {[]string{"PING"}, "PONG"}},
+			flags: "flags=e",
+		},
+		{
+			name:  "another user listed",
+			setup: []string{"no-evict-users", "monitor"},
+			steps: []replyStep{{[]string{"PING"}, "PONG"}, {[]string{"PING"}, limited}},
+			flags: "flags=N",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			admin := newTestSession(t, s)
+			mustDo(t, admin, append([]string{"CONFIG", "SET", "ratelimit", "1", "ratelimit-burst", "1"}, tc.setup...)...)
+			ss := newTestSession(t, s)
+			runSteps(t, ss, tc.steps)
+			if got := s.clientInfo(clientOf(ss.conn)); !strings.Contains(got, " "+tc.flags+" ") {
+				t.Errorf("CLIENT INFO %q, want %s", got, tc.flags)
+			}
+		})
+	}
+
+	s := newTestServer(t)
+	s.identities.Store(&identityMap{"ops": permAdmin})
+	s.defaultPermission.Store(int32(permReadWrite))
+	runSteps(t, newTestSession(t, s), []replyStep{
+		{[]string{"CLIENT", "NO-EVICT", "on"}, "NOPERM User default has no permissions to run the 'client|no-evict' command"},
+	})
+	runSteps(t, newTestSession(t, newTestServer(t)), []replyStep{
+		{[]string{"CLIENT", "NO-EVICT"}, "ERR wrong number of arguments for 'CLIENT NO-EVICT'"},
+		{[]string{"CLIENT", "NO-EVICT", "maybe"}, "ERR syntax error"},
+		{[]string{"CONFIG", "SET", "no-evict-users", "repl monitor"}, "OK"},
+		{[]string{"CONFIG", "GET", "no-evict-users"}, "[no-evict-users monitor,repl]"},
+	})
+}
+
+// TestNoEvictOutputLimit checks a no-evict client is not closed for
+// output over client-output-buffer-limit.
+func TestNoEvictOutputLimit(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveTest(t, s)
+	runSteps(t, newTestSession(t, s), []replyStep{
+		{[]string{"CONFIG", "SET", "client-output-buffer-limit", "normal 16kb 0 0"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", strings.Repeat("x", 64<<10)}, "OK"},
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("CLIENT NO-EVICT on\r\nGET 10.1.2.3\r\nPING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"+OK\r\n", "$65536\r\n"} {
+		if got, err := r.ReadString('\n'); got != want {
+			t.Fatalf("read %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := io.ReadFull(r, make([]byte, 64<<10+2)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.ReadString('\n'); got != "+PONG\r\n" {
+		t.Errorf("reply to PING %q, %v, want +PONG", got, err)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Quotas keep one tenant's database from crowding out another's:
+// db-max-keys caps the prefixes a database stores and db-max-bytes the
+// bytes of their values, tags included, as MEMORY USAGE counts them less
+// each prefix's fixed overhead. A write that would take a database past
+// either fails with a QUOTA error; one that adds no prefix and no bytes,
+// such as an overwrite with a value no larger, always goes through, so a
+// database over a lowered quota can still shrink. Quotas are checked
+// against the counters DBSIZE and DBSTATS read, which deletes and FLUSHDB
+// release at once and loading a snapshot rebuilds, and writes to a
+// database with a quota take turns so that they cannot overshoot it
+// together. SET and the other commands that modify a single value are
+// checked, as is every import: IMPORT, -import, -preload, -reload-file
+// and a stage's. Loading snapshots, RESTOREDB, DBMERGE and RESTOREKEY are
+// not, as they restore or combine data rather than add to it.
+
+// dbLimits records a per-database limit, such as db-max-keys. Like a
+// name, it belongs to the index, so it survives FLUSHDB, DROPDB and a
+// committed stage replacing the database.
+type dbLimits struct {
+	mu   sync.RWMutex
+	byID map[int]int64
+}
+
+// get returns database id's limit, or 0 if it has none.
+func (l *dbLimits) get(id int) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.byID[id]
+}
+
+// String formats the limits as settings like db-max-keys take them, e.g.
+// "2 500000 3 100000".
+func (l *dbLimits) String() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	ids := make([]int, 0, len(l.byID))
+	for id := range l.byID {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id) + " " + strconv.FormatInt(l.byID[id], 10)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Set replaces every limit with spec, a list of "index limit" pairs
+// separated by spaces or commas, each limit read by parse, leaving them
+// unchanged if spec is invalid. A limit of 0 and databases not listed
+// have none.
+func (l *dbLimits) Set(spec string, parse func(string) (int64, error)) error {
+	fields := strings.FieldsFunc(spec, func(c rune) bool { return c == ' ' || c == ',' })
+	if len(fields)%2 != 0 {
+		return errors.New("expected index limit pairs, e.g. '2 500000'")
+	}
+	byID := make(map[int]int64)
+	for i := 0; i < len(fields); i += 2 {
+		id, err := strconv.Atoi(fields[i])
+		if err != nil || id < 0 {
+			return fmt.Errorf("invalid database index '%s'", fields[i])
+		}
+		n, err := parse(fields[i+1])
+		if err != nil {
+			return fmt.Errorf("invalid limit '%s' for db%d", fields[i+1], id)
+		}
+		if n > 0 {
+			byID[id] = n
+		}
+	}
+	l.mu.Lock()
+	l.byID = byID
+	l.mu.Unlock()
+	return nil
+}
+
+func parseKeyLimit(v string) (int64, error) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid number of keys")
+	}
+	return n, nil
+}
+
+// quotaError is the error of a write refused over a database's quota.
+type quotaError struct {
+	db      int
+	setting string
+	limit   int64
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("%s command not allowed when db%d would exceed '%s' of %d", ClassQuota, e.db, e.setting, e.limit)
+}
+
+func (e *quotaError) class() string { return ClassQuota }
+
+// valueBytes returns the bytes db-max-bytes limits: the dataset estimate
+// less the fixed overhead of each prefix.
+func (d *database) valueBytes() int64 {
+	return d.datasetBytes() - entryOverhead*d.keyCount()
+}
+
+// admit checks that replacing old, what the trie holds at a prefix if
+// had, with v keeps d within its quotas. Callers hold the prefix's shard
+// write locked and, unless admit fails, call done once v is stored.
+func (d *database) admit(old value, had bool, v value) (done func(), err error) {
+	maxKeys, maxBytes := d.opts.maxKeys.get(d.id), d.opts.maxBytes.get(d.id)
+	if maxKeys == 0 && maxBytes == 0 {
+		return func() {}, nil
+	}
+	keys, size := int64(1), v.size()
+	if had {
+		keys, size = 0, size-old.size()
+	}
+	d.quotaMu.Lock()
+	switch {
+	case maxKeys > 0 && keys > 0 && d.keyCount()+keys > maxKeys:
+		err = &quotaError{db: d.id, setting: "db-max-keys", limit: maxKeys}
+	case maxBytes > 0 && size > 0 && d.valueBytes()+size > maxBytes:
+		err = &quotaError{db: d.id, setting: "db-max-bytes", limit: maxBytes}
+	}
+	if err != nil {
+		d.quotaMu.Unlock()
+		return nil, err
+	}
+	return d.quotaMu.Unlock, nil
+}
+
+// registerQuotaConfig exposes db-max-keys and db-max-bytes. A quota
+// lowered below what a database holds already refuses its next write
+// that would grow it, and evicts nothing.
+func (s *TrieServer) registerQuotaConfig() {
+	s.addConfig("db-max-keys", s.store.maxKeys.String,
+		func(v string) error { return s.store.maxKeys.Set(v, parseKeyLimit) })
+	s.addConfig("db-max-bytes", s.store.maxBytes.String,
+		func(v string) error { return s.store.maxBytes.Set(v, parseMemory) })
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDBLimitsSet(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		parse   func(string) (int64, error)
+		want    string // String afterwards
+		wantErr bool
+	}{
+		{spec: "", parse: parseKeyLimit, want: ""},
+		{spec: "2 500000", parse: parseKeyLimit, want: "2 500000"},
+		{spec: "3 10, 2 5", parse: parseKeyLimit, want: "2 5 3 10"},
+		{spec: "2 0 3 1", parse: parseKeyLimit, want: "3 1"}, // 0 is no limit
+		{spec: "2 1kb", parse: parseMemory, want: "2 1024"},
+		{spec: "2 1kb", parse: parseKeyLimit, wantErr: true},
+		{spec: "2", parse: parseKeyLimit, wantErr: true},
+		{spec: "-1 5", parse: parseKeyLimit, wantErr: true},
+		{spec: "x 5", parse: parseKeyLimit, wantErr: true},
+		{spec: "2 -5", parse: parseKeyLimit, wantErr: true},
+	} {
+		var l dbLimits
+		l.Set("9 9", parseKeyLimit)
+		err := l.Set(tc.spec, tc.parse)
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("Set(%q) succeeded", tc.spec)
+		case tc.wantErr && l.String() != "9 9":
+			t.Errorf("Set(%q) failed but changed the limits to %q", tc.spec, l.String())
+		case !tc.wantErr && (err != nil || l.String() != tc.want):
+			t.Errorf("Set(%q) = %v, limits %q, want %q", tc.spec, err, l.String(), tc.want)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	const keysErr = "QUOTA command not allowed when db0 would exceed 'db-max-keys' of 2"
+	const bytesErr = "QUOTA command not allowed when db0 would exceed 'db-max-bytes' of 10"
+	for _, tc := range []struct {
+		name   string
+		config []string
+		steps  []replyStep
+	}{
+		{
+			name:   "keys",
+			config: []string{"db-max-keys", "0 2"},
+			steps: []replyStep{
+				{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+				{[]string{"HSET", "10.1.0.0/16", "f", "v"}, "1"},
+				{[]string{"SET", "10.2.0.0/16", "c"}, keysErr},
+				{[]string{"SADD", "10.2.0.0/16", "m"}, keysErr},
+				{[]string{"SET", "10.0.0.0/8", "a much longer value"}, "OK"}, // no new prefix
+				{[]string{"HSET", "10.1.0.0/16", "g", "w"}, "1"},
+				{[]string{"DEL", "10.0.0.0/8"}, "1"},
+				{[]string{"SET", "10.2.0.0/16", "c"}, "OK"}, // released at once
+				{[]string{"DBSIZE"}, "2"},
+				{[]string{"SELECT", "1"}, "OK"}, // another database has no quota
+				{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "a"}, "OK"},
+				{[]string{"SET", "10.2.0.0/16", "a"}, "OK"},
+			},
+		},
+		{
+			name:   "bytes",
+			config: []string{"db-max-bytes", "0 10"},
+			steps: []replyStep{
+				{[]string{"SET", "10.0.0.0/8", "12345678"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "123"}, bytesErr},
+				{[]string{"APPEND", "10.0.0.0/8", "123"}, bytesErr},
+				{[]string{"SET", "10.0.0.0/8", "1234567890"}, "OK"}, // charged the size change
+				{[]string{"SET", "10.0.0.0/8", "12345678901"}, bytesErr},
+				{[]string{"SET", "10.0.0.0/8", "1"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "123456789"}, "OK"},
+				{[]string{"GET", "10.1.2.3"}, "123456789"},
+			},
+		},
+		{
+			name:   "flushdb releases the quota",
+			config: []string{"db-max-keys", "0 1"},
+			steps: []replyStep{
+				{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "b"}, "QUOTA"},
+				{[]string{"FLUSHDB"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "b"}, "OK"},
+			},
+		},
+		{
+			name: "a lowered quota still lets a database shrink",
+			steps: []replyStep{
+				{[]string{"SET", "10.0.0.0/8", "12345"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "12345"}, "OK"},
+				{[]string{"CONFIG", "SET", "db-max-keys", "0 1", "db-max-bytes", "0 4"}, "OK"},
+				{[]string{"SET", "10.0.0.0/8", "123"}, "OK"},
+				{[]string{"SET", "10.0.0.0/8", "1234"}, "QUOTA"},
+				{[]string{"SET", "10.2.0.0/16", "1"}, "QUOTA"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := newTestSession(t, newTestServer(t))
+			if tc.config != nil {
+				mustDo(t, ss, append([]string{"CONFIG", "SET"}, tc.config...)...)
+			}
+			runSteps(t, ss, tc.steps)
+		})
+	}
+}
+
+func TestQuotaReporting(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "db-max-keys", "0 100", "db-max-bytes", "0 1kb 3 5"}, "OK"},
+		{[]string{"CONFIG", "GET", "db-max-bytes"}, "[db-max-bytes 0 1024 3 5]"},
+		{[]string{"SET", "10.0.0.0/8", "abc"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", "de"}, "OK"},
+		{[]string{"CONFIG", "SET", "db-max-keys", "0 x"}, "ERR"},
+		{[]string{"CONFIG", "SET", "db-max-bytes", "1"}, "ERR"},
+	})
+	if st := dbStats(t, ss, "0"); st["value_bytes"] != 5 || st["max_keys"] != 100 || st["max_bytes"] != 1024 {
+		t.Errorf("DBSTATS 0 = %v, want 5 value bytes of 1024 and a 100 key quota", st)
+	}
+	if st := dbStats(t, ss, "1"); st["max_keys"] != 0 || st["max_bytes"] != 0 {
+		t.Errorf("DBSTATS 1 = %v, want no quota", st)
+	}
+	want := "keys=2,expires=0,avg_ttl=0,hits=0,misses=0,keys4=2,keys6=0,max_keys=100,value_bytes=5,max_bytes=1024"
+	if got := infoFields(mustDo(t, ss, "INFO", "keyspace").Str)["db0"]; got != want {
+		t.Errorf("INFO keyspace db0:%s, want %s", got, want)
+	}
+}
+
+func TestQuotaImport(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("routes.csv", []byte("10.0.0.0/8,a\n10.1.0.0/16,b\n10.2.0.0/16,c\n10.3.0.0/16,d\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("routes.json", []byte(`{"prefix":"10.0.0.0/8","value":"a"}`+"\n"+`{"prefix":"10.1.0.0/16","value":"b"}`+"\n"+
+		`{"prefix":"10.2.0.0/16","value":"c"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"routes.csv", "routes.json"} {
+		ss := newTestSession(t, newTestServer(t))
+		runSteps(t, ss, []replyStep{
+			{[]string{"CONFIG", "SET", "db-max-keys", "0 2"}, "OK"},
+			{[]string{"IMPORT", file}, "QUOTA command not allowed when db0 would exceed 'db-max-keys' of 2 (2 inserted before it)"},
+			{[]string{"DBSIZE"}, "2"},
+			{[]string{"IMPORT", file, "REPLACE"}, "QUOTA"}, // replacing what is there is free
+			{[]string{"DBSIZE"}, "2"},
+			{[]string{"LOADSTAGE", "0", file}, "QUOTA"},
+		})
+	}
+}
+
+// TestQuotaSnapshot checks the counters quotas are checked against are
+// rebuilt by loading a snapshot.
+func TestQuotaSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	ss := newTestSession(t, newTestServer(t))
+	mustDo(t, ss, "CONFIG", "SET", "dir", dir)
+	for i := range 5 {
+		mustDo(t, ss, "SET", "10."+strconv.Itoa(i)+".0.0/16", "1234")
+	}
+	mustDo(t, ss, "SAVE")
+	s := newTestServer(t)
+	if _, err := loadSnapshotFile(s, filepath.Join(dir, "dump.tdb"), true, true); err != nil {
+		t.Fatal(err)
+	}
+	runSteps(t, newTestSession(t, s), []replyStep{
+		{[]string{"CONFIG", "SET", "db-max-keys", "0 6", "db-max-bytes", "0 24"}, "OK"},
+		{[]string{"SET", "10.10.0.0/16", "1234"}, "OK"},
+		{[]string{"SET", "10.11.0.0/16", "1"}, "QUOTA command not allowed when db0 would exceed 'db-max-keys' of 6"},
+		{[]string{"SET", "10.0.0.0/16", "12345"}, "QUOTA command not allowed when db0 would exceed 'db-max-bytes' of 24"},
+		{[]string{"DEL", "10.0.0.0/16"}, "1"},
+		{[]string{"SET", "10.11.0.0/16", "12"}, "OK"},
+	})
+}
+
+// TestQuotaConcurrent runs writers against one quota at once and checks
+// that together they stop exactly at it.
+func TestQuotaConcurrent(t *testing.T) {
+	s := newTestServer(t)
+	mustDo(t, newTestSession(t, s), "CONFIG", "SET", "db-max-keys", "0 500")
+	var wg sync.WaitGroup
+	for w := range 8 {
+		ws := newTestSession(t, s)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				ws.Do("SET", "10."+strconv.Itoa(w)+"."+strconv.Itoa(i)+".0/24", "v")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := s.getDB(0).keyCount(); n != 500 {
+		t.Errorf("%d keys stored under a quota of 500", n)
+	}
+}
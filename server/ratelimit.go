@@ -0,0 +1,216 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// rateLimiter holds the per-client command rate limit. Every connection
+// has a token bucket that refills at ratelimit commands per second and
+// holds up to ratelimit-burst of them. A command arriving at an empty
+// bucket is refused with a RATELIMIT error in hard mode; in soft mode it
+// runs once its token would have arrived, the connection sleeping until
+// then, so a script that outpaces the limit slows down instead of
+// failing. ratelimit-users overrides the rate for users userFor names,
+// 0 exempting them.
+type rateLimiter struct {
+	rate  atomic.Int64 // commands per second per client; 0 disables
+	burst atomic.Int64 // bucket size; 0 means one second's worth
+	soft  atomic.Bool  // delay rather than refuse
+	users atomic.Pointer[rateOverrides]
+
+	throttled atomic.Int64 // clients whose last command was delayed or refused
+}
+
+// rateOverrides maps users to their own rate, e.g. "loader=0,lookup=500".
+type rateOverrides map[string]int64
+
+func parseRateOverrides(s string) (rateOverrides, error) {
+	m := make(rateOverrides)
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		name, rate, ok := strings.Cut(entry, "=")
+		n, err := strconv.ParseInt(rate, 10, 64)
+		if !ok || name == "" || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid rate override %q, expected user=commands-per-second", entry)
+		}
+		m[name] = n
+	}
+	return m, nil
+}
+
+func (m rateOverrides) String() string {
+	entries := make([]string, 0, len(m))
+	for name, n := range m {
+		entries = append(entries, name+"="+strconv.FormatInt(n, 10))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// limits returns the rate and bucket size that apply to user; a rate of 0
+// means no limit.
+func (rl *rateLimiter) limits(user string) (rate, burst float64) {
+	n, ok := (*rl.users.Load())[user]
+	if !ok {
+		n = rl.rate.Load()
+	}
+	b := rl.burst.Load()
+	if b == 0 {
+		b = n
+	}
+	return float64(n), float64(b)
+}
+
+// tokenBucket is a client's rate limit state, guarded by the client's mu.
+type tokenBucket struct {
+	tokens    float64 // negative while soft mode has commands waiting on tokens
+	last      time.Time
+	throttled bool // the last command was delayed or refused
+}
+
+// refill adds the tokens earned since the last command. A new bucket
+// starts full.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+}
+
+// take spends a token on one command. Without one it reports false in
+// hard mode; in soft mode it borrows the token and returns how long to
+// wait for it.
+func (b *tokenBucket) take(now time.Time, rate, burst float64, soft bool) (time.Duration, bool) {
+	b.refill(now, rate, burst)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if !soft {
+		return 0, false
+	}
+	b.tokens--
+	return time.Duration(-b.tokens / rate * float64(time.Second)), true
+}
+
+// throttle applies the rate limit to c's next command, unless c is a
+// no-evict client. It returns false, having written the error, if hard
+// mode refuses the command, and in soft mode sleeps until the command may
+// run.
+func (s *TrieServer) throttle(conn redcon.Conn, c *client, user string) bool {
+	rl := &s.rateLimit
+	rate, burst := rl.limits(user)
+	var wait time.Duration
+	ok := true
+	c.mu.Lock()
+	if rate > 0 && !c.exempt() {
+		wait, ok = c.bucket.take(time.Now(), rate, burst, rl.soft.Load())
+	}
+	if throttled := wait > 0 || !ok; throttled != c.bucket.throttled {
+		c.bucket.throttled = throttled
+		if throttled {
+			rl.throttled.Add(1)
+		} else {
+			rl.throttled.Add(-1)
+		}
+	}
+	c.mu.Unlock()
+	if !ok {
+		conn.WriteError(fmt.Sprintf("RATELIMIT client exceeded %d commands per second", int64(rate)))
+		return false
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return true
+}
+
+// forgetThrottled drops a closed client from the throttled count.
+func (s *TrieServer) forgetThrottled(c *client) {
+	c.mu.Lock()
+	if c.bucket.throttled {
+		c.bucket.throttled = false
+		s.rateLimit.throttled.Add(-1)
+	}
+	c.mu.Unlock()
+}
+
+// bucketInfo formats c's bucket for CLIENT INFO and CLIENT LIST: the rate
+// that applies to it and the tokens it holds now. The caller holds c.mu.
+func (s *TrieServer) bucketInfo(c *client, user string) string {
+	rate, burst := s.rateLimit.limits(user)
+	if rate <= 0 || c.exempt() {
+		return "ratelimit=0 tokens=0 throttled=0"
+	}
+	b := c.bucket
+	b.refill(time.Now(), rate, burst)
+	throttled := 0
+	if b.throttled {
+		throttled = 1
+	}
+	return fmt.Sprintf("ratelimit=%d tokens=%.1f throttled=%d", int64(rate), b.tokens, throttled)
+}
+
+// registerRateLimitConfig exposes the rate limit settings. Changes apply
+// to connected clients from their next command.
+func (s *TrieServer) registerRateLimitConfig() {
+	rl := &s.rateLimit
+	count := func(name string, v *atomic.Int64) {
+		s.addConfig(name,
+			func() string { return strconv.FormatInt(v.Load(), 10) },
+			func(arg string) error {
+				n, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil || n < 0 {
+					return errors.New("argument must be a non-negative number of commands")
+				}
+				v.Store(n)
+				return nil
+			})
+	}
+	count("ratelimit", &rl.rate)
+	count("ratelimit-burst", &rl.burst)
+	s.addConfig("ratelimit-mode",
+		func() string {
+			if rl.soft.Load() {
+				return "soft"
+			}
+			return "hard"
+		},
+		func(v string) error {
+			soft, ok := parseRateLimitMode(v)
+			if !ok {
+				return errors.New("argument must be 'soft' or 'hard'")
+			}
+			rl.soft.Store(soft)
+			return nil
+		})
+	s.addConfig("ratelimit-users",
+		func() string { return rl.users.Load().String() },
+		func(v string) error {
+			m, err := parseRateOverrides(v)
+			if err != nil {
+				return err
+			}
+			rl.users.Store(&m)
+			return nil
+		})
+}
+
+func parseRateLimitMode(v string) (soft, ok bool) {
+	switch strings.ToLower(v) {
+	case "soft":
+		return true, true
+	case "hard":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	base := time.Unix(1000, 0)
+	var b tokenBucket
+	for i, tc := range []struct {
+		at       time.Duration // after base
+		soft     bool
+		wantOK   bool
+		wantWait time.Duration
+	}{
+		{at: 0, wantOK: true}, // a new bucket starts full
+		{at: 0, wantOK: true},
+		{at: 0, wantOK: false},
+		{at: 50 * time.Millisecond, wantOK: false},
+		{at: 100 * time.Millisecond, wantOK: true}, // one token back at 10 per second
+		{at: 100 * time.Millisecond, soft: true, wantOK: true, wantWait: 100 * time.Millisecond},
+		{at: 100 * time.Millisecond, soft: true, wantOK: true, wantWait: 200 * time.Millisecond},
+		{at: 300 * time.Millisecond, wantOK: false}, // the borrowed tokens are repaid first
+		{at: 10 * time.Second, wantOK: true},        // refills to the burst, no further
+		{at: 10 * time.Second, wantOK: true},
+		{at: 10 * time.Second, wantOK: false},
+	} {
+		wait, ok := b.take(base.Add(tc.at), 10, 2, tc.soft)
+		if ok != tc.wantOK || wait.Round(time.Millisecond) != tc.wantWait {
+			t.Errorf("take %d at +%v: %v, %v; want %v, %v", i, tc.at, wait, ok, tc.wantWait, tc.wantOK)
+		}
+	}
+}
+
+func TestParseRateOverrides(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "", want: ""},
+		{in: "lookup=500,loader=0", want: "loader=0,lookup=500"},
+		{in: "a=1 b=2", want: "a=1,b=2"},
+		{in: "loader", wantErr: true},
+		{in: "=5", wantErr: true},
+		{in: "loader=-1", wantErr: true},
+		{in: "loader=fast", wantErr: true},
+	} {
+		m, err := parseRateOverrides(tc.in)
+		if (err != nil) != tc.wantErr || err == nil && m.String() != tc.want {
+			t.Errorf("parseRateOverrides(%q) = %q, %v; want %q", tc.in, m, err, tc.want)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	const limited = "RATELIMIT client exceeded 1 commands per second"
+	for _, tc := range []struct {
+		name   string
+		config []string
+		steps  []replyStep // on a new session
+	}{
+		{
+			name:   "hard",
+			config: []string{"ratelimit", "1", "ratelimit-burst", "3"},
+			steps: []replyStep{
+				{[]string{"PING"}, "PONG"},
+				{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+				{[]string{"GET", "10.0.0.1"}, "a"},
+				{[]string{"GET", "10.0.0.1"}, limited},
+				{[]string{"PING"}, limited},
+			},
+		},
+		{
+			name:   "burst defaults to one second's worth",
+			config: []string{"ratelimit", "2"},
+			steps: []replyStep{
+				{[]string{"PING"}, "PONG"},
+				{[]string{"PING"}, "PONG"},
+				{[]string{"PING"}, "RATELIMIT client exceeded 2 commands per second"},
+			},
+		},
+		{
+			name:   "exempt user",
+			config: []string{"ratelimit", "1", "ratelimit-users", "default=0"},
+			steps: []replyStep{
+				{[]string{"PING"}, "PONG"},
+				{[]string{"PING"}, "PONG"},
+				{[]string{"PING"}, "PONG"},
+			},
+		},
+		{
+			name:   "soft delays instead",
+			config: []string{"ratelimit", "20", "ratelimit-burst", "1", "ratelimit-mode", "soft"},
+			steps: []replyStep{
+				{[]string{"PING"}, "PONG"},
+				{[]string{"PING"}, "PONG"},
+				{[]string{"PING"}, "PONG"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			admin := newTestSession(t, s)
+			mustDo(t, admin, append([]string{"CONFIG", "SET"}, tc.config...)...)
+			start := time.Now()
+			runSteps(t, newTestSession(t, s), tc.steps)
+			if soft := strings.Contains(tc.name, "soft"); soft && time.Since(start) < 90*time.Millisecond {
+				t.Errorf("3 commands at 20 per second with a burst of 1 took %v", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestRateLimitReporting(t *testing.T) {
+	s := newTestServer(t)
+	admin := newTestSession(t, s)
+	// Enough of a burst for the admin session's own commands below.
+	mustDo(t, admin, "CONFIG", "SET", "ratelimit", "1", "ratelimit-burst", "5")
+	ss := newTestSession(t, s)
+	for range 5 {
+		mustDo(t, ss, "PING")
+	}
+	if got := ss.Do("PING").String(); !strings.HasPrefix(got, "RATELIMIT") {
+		t.Fatalf("sixth PING = %q, want it refused", got)
+	}
+	if got := infoFields(mustDo(t, admin, "INFO", "clients").Str)["throttled_clients"]; got != "1" {
+		t.Errorf("throttled_clients = %s, want 1", got)
+	}
+	if got := mustDo(t, admin, "CLIENT", "LIST").Str; !strings.Contains(got, "ratelimit=1 tokens=0.0 throttled=1") {
+		t.Errorf("CLIENT LIST does not show the throttled client:\n%s", got)
+	}
+	if got := infoFields(mustDo(t, admin, "INFO", "commandstats").Str)["cmdstat_ping"]; !strings.HasSuffix(got, "rejected_calls=1") {
+		t.Errorf("cmdstat_ping:%s, want rejected_calls=1", got)
+	}
+	s.closed(ss.conn, nil)
+	if got := infoFields(mustDo(t, admin, "INFO", "clients").Str)["throttled_clients"]; got != "0" {
+		t.Errorf("throttled_clients after the client closed = %s, want 0", got)
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+)
+
+// dbFlags records which databases have a yes/no setting on, such as
+// db-readonly for those that refuse writes. Like a name, the flag belongs
+// to the index, so it survives FLUSHDB, DROPDB and a committed stage
+// replacing the database.
+type dbFlags struct {
+	mu sync.RWMutex
+	on map[int]bool
+}
+
+func newDBFlags() *dbFlags {
+	return &dbFlags{on: make(map[int]bool)}
+}
+
+func (r *dbFlags) has(id int) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.on[id]
+}
+
+func (r *dbFlags) set(id int, on bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if on {
+		r.on[id] = true
+	} else {
+		delete(r.on, id)
+	}
+}
+
+// ids returns the indices with the flag on, in no particular order.
+func (r *dbFlags) ids() []int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]int, 0, len(r.on))
+	for id := range r.on {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// String formats the flags as settings like db-readonly take them, e.g.
+// "0 yes 3 yes".
+func (r *dbFlags) String() string {
+	ids := r.ids()
+	sort.Ints(ids)
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id) + " yes"
+	}
+	return strings.Join(parts, " ")
+}
+
+// Set replaces every flag with spec, a list of "index yes|no" pairs
+// separated by spaces or commas, leaving them unchanged if spec is
+// invalid. Databases not listed have the flag off.
+func (r *dbFlags) Set(spec string) error {
+	fields := strings.FieldsFunc(spec, func(c rune) bool { return c == ' ' || c == ',' })
+	if len(fields)%2 != 0 {
+		return fmt.Errorf("expected index yes|no pairs, e.g. '0 yes'")
+	}
+	on := make(map[int]bool)
+	for i := 0; i < len(fields); i += 2 {
+		id, err := strconv.Atoi(fields[i])
+		if err != nil || id < 0 {
+			return fmt.Errorf("invalid database index '%s'", fields[i])
+		}
+		switch strings.ToLower(fields[i+1]) {
+		case "yes":
+			on[id] = true
+		case "no":
+			delete(on, id)
+		default:
+			return fmt.Errorf("invalid value '%s' for db%d, expected yes or no", fields[i+1], id)
+		}
+	}
+	r.mu.Lock()
+	r.on = on
+	r.mu.Unlock()
+	return nil
+}
+
+// writable returns the READONLY error for writing to database id, or nil
+// if it takes writes.
+func (s *TrieServer) writable(id int) error {
+	if !s.readOnlyDBs.has(id) {
+		return nil
+	}
+	return errorf(ClassReadOnly, "You can't write against read only db%d", id)
+}
+
+// handleDBReadOnly implements DBREADONLY index|name [yes|no]. Without a
+// value it replies 1 if the database is read-only, else 0.
+func (s *TrieServer) handleDBReadOnly(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for 'DBREADONLY'")
+		return
+	}
+	id, err := s.resolveDB(string(cmd.Args[1]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	if len(cmd.Args) == 2 {
+		if s.readOnlyDBs.has(id) {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[2])) {
+	case "yes":
+		s.readOnlyDBs.set(id, true)
+	case "no":
+		s.readOnlyDBs.set(id, false)
+	default:
+		conn.WriteError("ERR argument must be 'yes' or 'no'")
+		return
+	}
+	writeOK(conn)
+}
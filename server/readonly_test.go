@@ -0,0 +1,64 @@
+package server
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestDBReadOnly(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("feed.csv", []byte("10.0.0.0/8,a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ss := newTestSession(t, newTestServer(t))
+	const ro = "READONLY You can't write against read only db2"
+	oneKey := strconv.Itoa(entryOverhead + 1) // the memory of one prefix with a 1-byte value
+	runSteps(t, ss, []replyStep{
+		{[]string{"NAMEDB", "2", "geo"}, "OK"},
+		{[]string{"SELECT", "geo"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"DBREADONLY", "geo"}, "0"},
+		{[]string{"DBREADONLY", "geo", "yes"}, "OK"},
+		{[]string{"DBREADONLY", "2"}, "1"},
+		// Commands on the selected database are checked centrally.
+		{[]string{"SET", "10.0.0.0/8", "b"}, ro},
+		{[]string{"DEL", "10.0.0.0/8"}, ro},
+		{[]string{"HSET", "192.0.2.0/24", "f", "v"}, ro},
+		{[]string{"FLUSHDB"}, ro},
+		{[]string{"GET", "10.1.2.3"}, "a"},
+		{[]string{"SELECT", "0"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "in db0"}, "OK"},
+		// Commands naming the database check it themselves.
+		{[]string{"IMPORT", "feed.csv", "DB", "geo"}, ro},
+		{[]string{"DBMERGE", "0", "geo"}, ro},
+		{[]string{"DBMERGE", "geo", "0"}, "[copied 0 overwritten 1 skipped 0]"},
+		{[]string{"LOADSTAGE", "geo", "feed.csv"}, ro},
+		{[]string{"DROPDB", "geo"}, ro},
+		{[]string{"SHOWDBS"}, "[[db 0 name nil keys 1 memory " + oneKey + " readonly 0] [db 2 name geo keys 1 memory " + oneKey + " readonly 1]]"},
+		{[]string{"CONFIG", "GET", "db-readonly"}, "[db-readonly 2 yes]"},
+		{[]string{"CONFIG", "SET", "db-readonly", "0 yes, 2 no"}, "OK"},
+		{[]string{"CONFIG", "GET", "db-readonly"}, "[db-readonly 0 yes]"},
+		{[]string{"SET", "10.0.0.0/8", "b"}, "READONLY You can't write against read only db0"},
+		{[]string{"LOADSTAGE", "geo", "feed.csv"}, "[lines 1 inserted 1 replaced 0 skipped 0 errors 0 first-errors [] staged-keys4 1 staged-keys6 0 staged-memory " + oneKey + "]"},
+		{[]string{"DBREADONLY", "geo", "yes"}, "OK"},
+		{[]string{"COMMITSTAGE", "geo"}, ro},
+		{[]string{"ABORTSTAGE", "geo"}, "1"}, // always allowed
+		{[]string{"DBREADONLY", "geo", "maybe"}, "ERR argument must be 'yes' or 'no'"},
+		{[]string{"DBREADONLY", "nosuch"}, "ERR unknown database name"},
+		{[]string{"DBREADONLY"}, "ERR wrong number of arguments for 'DBREADONLY'"},
+		{[]string{"CONFIG", "SET", "db-readonly", "0"}, "ERR CONFIG SET failed"},
+		{[]string{"CONFIG", "SET", "db-readonly", "x yes"}, "ERR CONFIG SET failed"},
+		{[]string{"CONFIG", "SET", "db-readonly", "1 perhaps"}, "ERR CONFIG SET failed"},
+		{[]string{"CONFIG", "GET", "db-readonly"}, "[db-readonly 0 yes 2 yes]"}, // unchanged by the failures
+	})
+
+	// The flag belongs to the index, so it outlives the data.
+	runSteps(t, ss, []replyStep{
+		{[]string{"DBREADONLY", "geo", "no"}, "OK"},
+		{[]string{"DROPDB", "geo"}, "1"},
+		{[]string{"DBREADONLY", "geo", "yes"}, "OK"},
+		{[]string{"SELECT", "geo"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "b"}, ro},
+	})
+}
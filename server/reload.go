@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileReloader keeps one database in step with a data file, for
+// deployments that publish a file rather than run a loader. Each check is
+// cheap unless the file's size or modification time moved, and a file
+// rewritten with the same content is not reloaded.
+type fileReloader struct {
+	path     string
+	db       int
+	interval time.Duration
+
+	mu        sync.Mutex // guards the fields below, which INFO reports
+	modTime   time.Time
+	size      int64
+	checksum  string    // sha256 of the file last loaded
+	lastLoad  time.Time // when it was loaded
+	lastKeys  int64     // prefixes it held
+	lastError string    // why the last attempt failed; empty if it did not
+	lastTry   time.Time
+	loads     int64
+	failures  int64
+}
+
+// reload loads the file into a fresh database and swaps it in if it
+// changed. A file that does not parse cleanly leaves the serving data
+// untouched: one bad line fails the whole reload.
+func (s *TrieServer) reload(r *fileReloader) {
+	fi, err := os.Stat(r.path)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil && fi.ModTime().Equal(r.modTime) && fi.Size() == r.size {
+		return
+	}
+	r.lastTry = time.Now()
+	fail := func(err error) {
+		if r.lastError != err.Error() {
+			slog.Error("reload failed, still serving the previous data", "path", r.path, "db", r.db, "err", err)
+		}
+		r.lastError = err.Error()
+		r.failures++
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	r.modTime, r.size = fi.ModTime(), fi.Size()
+	if checksum == r.checksum {
+		r.lastError = ""
+		return
+	}
+
+	start := time.Now()
+	db := newDatabase(r.db, &s.store)
+	in, err := importReader(bytes.NewReader(data))
+	var res importResult
+	if err == nil {
+		res, err = db.importFrom(in, importOptions{path: r.path, format: formatFor(r.path), conflict: conflictReplace})
+	}
+	if err == nil && res.errors > 0 {
+		err = fmt.Errorf("%d bad lines, first %s", res.errors, strings.Join(res.firstErrors[:1], ""))
+	}
+	if err != nil {
+		fail(err) // and wait for the file to change again
+		return
+	}
+	s.swapInDB(r.db, db)
+	r.checksum, r.lastLoad, r.lastKeys, r.lastError = checksum, time.Now(), db.keyCount(), ""
+	r.loads++
+	slog.Info("Reloaded", "path", r.path, "db", r.db, "keys", r.lastKeys, "lines", res.lines,
+		"sha256", checksum, "elapsed", time.Since(start))
+}
+
+// reloadCron checks the file every interval for the life of the server.
+func (s *TrieServer) reloadCron(r *fileReloader) {
+	for range time.Tick(r.interval) {
+		s.reload(r)
+	}
+}
+
+func (s *TrieServer) infoReload(b *strings.Builder) {
+	r := s.reloader
+	if r == nil {
+		fmt.Fprintf(b, "reload_enabled:0\r\n")
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := "ok"
+	if r.lastError != "" {
+		status = "err"
+	}
+	unix := func(t time.Time) int64 {
+		if t.IsZero() {
+			return -1
+		}
+		return t.Unix()
+	}
+	fmt.Fprintf(b, "reload_enabled:1\r\n")
+	fmt.Fprintf(b, "reload_file:%s\r\n", r.path)
+	fmt.Fprintf(b, "reload_db:%d\r\n", r.db)
+	fmt.Fprintf(b, "reload_interval_ms:%d\r\n", r.interval.Milliseconds())
+	fmt.Fprintf(b, "reload_last_status:%s\r\n", status)
+	fmt.Fprintf(b, "reload_last_error:%s\r\n", r.lastError)
+	fmt.Fprintf(b, "reload_last_attempt_time:%d\r\n", unix(r.lastTry))
+	fmt.Fprintf(b, "reload_last_success_time:%d\r\n", unix(r.lastLoad))
+	fmt.Fprintf(b, "reload_last_keys:%d\r\n", r.lastKeys)
+	fmt.Fprintf(b, "reload_checksum:%s\r\n", r.checksum)
+	fmt.Fprintf(b, "reloads:%d\r\n", r.loads)
+	fmt.Fprintf(b, "reload_failures:%d\r\n", r.failures)
+}
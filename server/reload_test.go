@@ -0,0 +1,91 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feed.csv")
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	runSteps(t, ss, []replyStep{{[]string{"SET", "172.16.0.0/12", "before the first load"}, "OK"}})
+	if got := infoFields(mustDo(t, ss, "INFO", "persistence").Str)["reload_enabled"]; got != "0" {
+		t.Errorf("reload_enabled = %s without a reload file", got)
+	}
+	s.reloader = &fileReloader{path: path, db: 0, interval: time.Minute}
+
+	mtime := time.Now().Add(-time.Hour)
+	for _, tc := range []struct {
+		name     string
+		content  string // written with a new modification time; "" leaves the file alone
+		remove   bool
+		status   string
+		reloads  string
+		failures string
+		steps    []replyStep
+	}{
+		{
+			name:   "missing file",
+			remove: true, status: "err", reloads: "0", failures: "1",
+			steps: []replyStep{{[]string{"GET", "172.16.0.1"}, "before the first load"}},
+		},
+		{
+			name:    "first load",
+			content: "10.0.0.0/8,a\n2001:db8::/32,b\n", status: "ok", reloads: "1", failures: "1",
+			steps: []replyStep{{[]string{"GET", "10.1.2.3"}, "a"}, {[]string{"GET", "172.16.0.1"}, "nil"}, {[]string{"DBSIZE"}, "2"}},
+		},
+		{
+			name:   "unchanged file",
+			status: "ok", reloads: "1", failures: "1",
+		},
+		{
+			name:    "same content, new modification time",
+			content: "10.0.0.0/8,a\n2001:db8::/32,b\n", status: "ok", reloads: "1", failures: "1",
+		},
+		{
+			name:    "one bad line keeps the old data",
+			content: "10.0.0.0/8,changed\nnot-a-prefix,x\n", status: "err", reloads: "1", failures: "2",
+			steps: []replyStep{{[]string{"GET", "10.1.2.3"}, "a"}},
+		},
+		{
+			name:   "a failed file is not retried until it changes",
+			status: "err", reloads: "1", failures: "2",
+		},
+		{
+			name:    "fixed file",
+			content: "10.0.0.0/8,changed\n192.0.2.0/24,c\n", status: "ok", reloads: "2", failures: "2",
+			steps: []replyStep{{[]string{"GET", "10.1.2.3"}, "changed"}, {[]string{"GET", "2001:db8::1"}, "nil"}, {[]string{"DBSIZE"}, "2"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			switch {
+			case tc.remove:
+				os.Remove(path)
+			case tc.content != "":
+				if err := os.WriteFile(path, []byte(tc.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				mtime = mtime.Add(time.Second)
+				if err := os.Chtimes(path, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.reload(s.reloader)
+			info := infoFields(mustDo(t, ss, "INFO", "persistence").Str)
+			if info["reload_last_status"] != tc.status || info["reloads"] != tc.reloads || info["reload_failures"] != tc.failures {
+				t.Errorf("status %s, reloads %s, failures %s, want %s, %s and %s (error %q)",
+					info["reload_last_status"], info["reloads"], info["reload_failures"], tc.status, tc.reloads, tc.failures, info["reload_last_error"])
+			}
+			if info["reload_file"] != path || info["reload_db"] != "0" || info["reload_interval_ms"] != "60000" {
+				t.Errorf("INFO persistence = %v", info)
+			}
+			if tc.status == "ok" && (len(info["reload_checksum"]) != 64 || info["reload_last_keys"] != "2") {
+				t.Errorf("checksum %q, keys %s", info["reload_checksum"], info["reload_last_keys"])
+			}
+			runSteps(t, ss, tc.steps)
+		})
+	}
+}
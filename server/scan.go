@@ -0,0 +1,239 @@
+package server
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// scanCursorSlots is how many SCAN cursors are remembered at once.
+const scanCursorSlots = 4096
+
+// scanCursors maps the numeric cursors SCAN hands out to database
+// positions, which do not fit the 64-bit cursor clients expect. Like
+// kvrocks, only the most recent scanCursorSlots cursors are kept; a client
+// presenting an older one gets an error rather than a silently wrong scan.
+type scanCursors struct {
+	mu    sync.Mutex
+	next  uint64
+	slots [scanCursorSlots]struct {
+		id  uint64
+		pos scanPos
+	}
+}
+
+// save returns a new cursor that resumes at pos.
+func (sc *scanCursors) save(pos scanPos) uint64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.next++
+	slot := &sc.slots[sc.next%scanCursorSlots]
+	slot.id, slot.pos = sc.next, pos
+	return sc.next
+}
+
+// load returns the position saved for cursor; 0 is the start.
+func (sc *scanCursors) load(cursor uint64) (scanPos, bool) {
+	if cursor == 0 {
+		return scanPos{}, true
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	slot := &sc.slots[cursor%scanCursorSlots]
+	if slot.id != cursor {
+		return scanPos{}, false
+	}
+	return slot.pos, true
+}
+
+// handleScan implements SCAN cursor [MATCH pattern] [COUNT count]
+// [FAMILY v4|v6] [IDLE seconds]. COUNT is how many prefixes to examine, as
+// in Redis. IDLE keeps only prefixes not accessed for at least that long,
+// for finding dead weight without reading every prefix's OBJECT IDLETIME.
+func (s *TrieServer) handleScan(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'SCAN'")
+		return
+	}
+	cursor, err := strconv.ParseUint(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		conn.WriteError("ERR invalid cursor")
+		return
+	}
+	pattern, count, fam, minIdle := "*", 10, familyAny, uint64(0)
+	for i := 2; i < len(cmd.Args); i += 2 {
+		if i+1 >= len(cmd.Args) {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		arg := string(cmd.Args[i+1])
+		switch strings.ToUpper(string(cmd.Args[i])) {
+		case "MATCH":
+			pattern = arg
+		case "COUNT":
+			if count, err = strconv.Atoi(arg); err != nil || count < 1 {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+		case "FAMILY":
+			var ok bool
+			if fam, ok = parseFamily(arg); !ok {
+				conn.WriteError("ERR FAMILY must be v4 or v6")
+				return
+			}
+		case "IDLE":
+			if minIdle, err = strconv.ParseUint(arg, 10, 32); err != nil {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	pos, ok := s.scanCursors.load(cursor)
+	if !ok {
+		conn.WriteError("ERR invalid cursor")
+		return
+	}
+
+	var keys []string
+	next, done := s.getDB(currentDB(conn)).scan(pos, fam, count, func(p netip.Prefix, v value) {
+		if uint64(v.idle()) < minIdle {
+			return
+		}
+		if k := p.String(); match.Match(k, pattern) {
+			keys = append(keys, k)
+		}
+	})
+	var nextCursor uint64
+	if !done {
+		nextCursor = s.scanCursors.save(next)
+	}
+	conn.WriteArray(2)
+	conn.WriteBulkString(strconv.FormatUint(nextCursor, 10))
+	conn.WriteArray(len(keys))
+	for _, k := range keys {
+		conn.WriteBulkString(k)
+	}
+}
+
+// handleKeys implements KEYS pattern [FAMILY v4|v6] [SORT BY
+// ADDRESS|LENGTH [DESC]]. Like Redis's, it walks the whole database, so
+// SCAN is the better choice on large ones.
+func (s *TrieServer) handleKeys(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'KEYS'")
+		return
+	}
+	pattern, fam := string(cmd.Args[1]), familyAny
+	var order keyOrder
+	for i := 2; i < len(cmd.Args); {
+		switch strings.ToUpper(string(cmd.Args[i])) {
+		case "FAMILY":
+			if i+1 >= len(cmd.Args) {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			var ok bool
+			if fam, ok = parseFamily(string(cmd.Args[i+1])); !ok {
+				conn.WriteError("ERR FAMILY must be v4 or v6")
+				return
+			}
+			i += 2
+		case "SORT":
+			o, n, err := parseKeyOrder(cmd.Args[i:])
+			if err != nil {
+				writeError(conn, err)
+				return
+			}
+			order, i = o, i+n
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	db := s.getDB(currentDB(conn))
+	// Each shard's matches come together and in address order, one list
+	// per shard to merge.
+	var lists [][]netip.Prefix
+	var last *shard
+	pos, done := scanPos{}, false
+	for !done {
+		pos, done = db.scan(pos, fam, 1024, func(p netip.Prefix, _ value) {
+			if c.budget.exceeded() {
+				return
+			}
+			if !match.Match(p.String(), pattern) {
+				return
+			}
+			if sh := db.shardFor(p); sh != last {
+				lists, last = append(lists, nil), sh
+			}
+			lists[len(lists)-1] = append(lists[len(lists)-1], p)
+		})
+		if c.budget.exceeded() {
+			writeError(conn, c.budget.err())
+			return
+		}
+	}
+	self := func(p netip.Prefix) netip.Prefix { return p }
+	keys := arrange(mergeAll(lists, self), order, self)
+	conn.WriteArray(len(keys))
+	for _, k := range keys {
+		conn.WriteBulkString(k.String())
+	}
+}
+
+// handleKeyCursor implements FIRSTKEY [WITHIN cidr] and NEXTKEY cidr
+// [WITHIN cidr]: the first stored prefix, or the first after cidr, in
+// address order with shorter prefixes first, or nil past the last. The
+// cursor is the last prefix seen, which need not still be stored, so a
+// client can checkpoint it and resume on another connection. Prefixes
+// stored after the cursor during an iteration are reached; ones before it
+// are not.
+func (s *TrieServer) handleKeyCursor(conn redcon.Conn, name string, cmd redcon.Command) {
+	args := cmd.Args[1:]
+	if name == "NEXTKEY" {
+		if len(args) == 0 {
+			conn.WriteError("ERR wrong number of arguments for 'NEXTKEY'")
+			return
+		}
+		args = args[1:]
+	}
+	if len(args) != 0 && len(args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "'")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	var after, within netip.Prefix
+	if len(args) == 2 {
+		if !strings.EqualFold(string(args[0]), "WITHIN") {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		p, err := db.parseLookup(string(args[1]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		within = p
+	}
+	if name == "NEXTKEY" {
+		p, err := db.parseLookup(string(cmd.Args[1]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		after = p
+	}
+	if p, ok := db.nextKey(after, within); ok {
+		conn.WriteBulkString(p.String())
+	} else {
+		conn.WriteNull()
+	}
+}
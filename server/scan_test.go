@@ -0,0 +1,224 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeRandom stores n random prefixes of each family, /0s included, and
+// returns them sorted and without duplicates.
+func storeRandom(t *testing.T, ss *testSession, n int) []string {
+	t.Helper()
+	r := rand.New(rand.NewPCG(5, 6))
+	keys := []string{"0.0.0.0/0", "::/0", "10.0.0.0/8"}
+	for range n {
+		keys = append(keys, randomPrefix(r, 4, 0).String(), randomPrefix(r, 16, 0).String())
+	}
+	for _, k := range keys {
+		mustDo(t, ss, "SET", k, "v")
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+func TestScan(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	all := storeRandom(t, ss, 300)
+	for _, tc := range []struct {
+		name string
+		opts []string
+		keep func(string) bool
+	}{
+		{"default count", nil, nil},
+		{"count 1", []string{"COUNT", "1"}, nil},
+		{"count 1000", []string{"COUNT", "1000"}, nil},
+		{"match", []string{"MATCH", "1*", "COUNT", "7"}, func(k string) bool { return strings.HasPrefix(k, "1") }},
+		{"family v4", []string{"FAMILY", "v4", "COUNT", "13"}, func(k string) bool { return !strings.Contains(k, ":") }},
+		{"family ipv6", []string{"family", "ipv6"}, func(k string) bool { return strings.Contains(k, ":") }},
+	} {
+		var want []string
+		for _, k := range all {
+			if tc.keep == nil || tc.keep(k) {
+				want = append(want, k)
+			}
+		}
+		var got []string
+		cursor, calls := "0", 0
+		for {
+			r := mustDo(t, ss, append([]string{"SCAN", cursor}, tc.opts...)...)
+			got = append(got, r.Array[1].strs()...)
+			calls++
+			if cursor = r.Array[0].Str; cursor == "0" || calls > len(all)+1 {
+				break
+			}
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: SCAN returned %d prefixes, want each of %d once", tc.name, len(got), len(want))
+		}
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	storeRandom(t, ss, 10)
+	for _, args := range [][]string{
+		{"SCAN"},
+		{"SCAN", "-1"},
+		{"SCAN", "x"},
+		{"SCAN", "0", "COUNT"},
+		{"SCAN", "0", "COUNT", "0"},
+		{"SCAN", "0", "FAMILY", "v5"},
+		{"SCAN", "0", "SORT", "asc"},
+		{"SCAN", "12345"}, // never handed out
+	} {
+		if err := ss.Do(args...).Err(); err == nil {
+			t.Errorf("%q succeeded", args)
+		}
+	}
+
+	// Cursors older than the ring are refused.
+	first := mustDo(t, ss, "SCAN", "0", "COUNT", "1").Array[0].Str
+	for range scanCursorSlots {
+		mustDo(t, ss, "SCAN", "0", "COUNT", "1")
+	}
+	if err := ss.Do("SCAN", first).Err(); err == nil || err.Error() != "ERR invalid cursor" {
+		t.Errorf("SCAN of a cursor %d cursors old = %v, want ERR invalid cursor", scanCursorSlots, err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, k := range []string{"10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/16", "2001:db8::/32", "::/0"} {
+		mustDo(t, ss, "SET", k, "v")
+	}
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"*", []string{"10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/16", "2001:db8::/32", "::/0"}},
+		{"10.*", []string{"10.0.0.0/8", "10.1.0.0/16"}},
+		{"*/16", []string{"10.1.0.0/16", "192.168.0.0/16"}},
+		{"*:*", []string{"2001:db8::/32", "::/0"}},
+		{"10.?.0.0/16", []string{"10.1.0.0/16"}},
+		{"172.*", nil},
+	} {
+		got := mustDo(t, ss, "KEYS", tc.pattern).strs()
+		slices.Sort(got)
+		want := slices.Sorted(slices.Values(tc.want))
+		if !slices.Equal(got, want) {
+			t.Errorf("KEYS %s = %q, want %q", tc.pattern, got, want)
+		}
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"KEYS", "*", "FAMILY", "v6"}, "[::/0 2001:db8::/32]"},
+		{[]string{"KEYS", "1*", "family", "V4"}, "[10.0.0.0/8 10.1.0.0/16 192.168.0.0/16]"},
+		{[]string{"KEYS", "*", "FAMILY", "v5"}, "ERR FAMILY must be v4 or v6"},
+		{[]string{"KEYS", "*", "TYPE", "v4"}, "ERR syntax error"},
+		{[]string{"KEYS", "*", "FAMILY"}, "ERR syntax error"},
+		{[]string{"KEYS"}, "ERR wrong number of arguments for 'KEYS'"},
+		{[]string{"DBSIZE", "FAMILY", "v4"}, "3"},
+		{[]string{"DBSIZE", "FAMILY", "v6"}, "2"},
+		{[]string{"DBSIZE", "FAMILY", "any"}, "ERR FAMILY must be v4 or v6"},
+		{[]string{"DBSIZE", "v4"}, "ERR syntax error"},
+	})
+	if n := len(mustDo(t, ss, "KEYS", "*").strs()); strconv.Itoa(n) != keyspaceField(t, ss, 0, "keys") {
+		t.Errorf("KEYS * lists %d prefixes, INFO keyspace counts %s", n, keyspaceField(t, ss, 0, "keys"))
+	}
+}
+
+func TestScanFamilyOfWideShard(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	// Short prefixes of both families share the wide shard.
+	for _, k := range []string{"0.0.0.0/1", "::/1", "8000::/2"} {
+		mustDo(t, ss, "SET", k, "v")
+	}
+	r := mustDo(t, ss, "SCAN", "0", "FAMILY", "v6")
+	if got := r.Array[1].strs(); !slices.Equal(got, []string{"::/1", "8000::/2"}) {
+		t.Errorf("SCAN 0 FAMILY v6 = %q", got)
+	}
+}
+
+// mixedKeys stores prefixes of both families across every shard, short
+// ones in the wide shard included, and returns them in address order.
+func mixedKeys(t *testing.T, ss *testSession) []netip.Prefix {
+	t.Helper()
+	r := rand.New(rand.NewPCG(5, 6))
+	keys := []netip.Prefix{
+		netip.MustParsePrefix("::/0"),
+		netip.MustParsePrefix("2000::/3"),
+		netip.MustParsePrefix("2000::/16"),
+		netip.MustParsePrefix("3000::/16"),
+		netip.MustParsePrefix("4000::/16"),
+		netip.MustParsePrefix("4000::/5"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}
+	for range 300 {
+		keys = append(keys, randomPrefix(r, 16, 0), randomPrefix(r, 4, 0))
+	}
+	for _, p := range keys {
+		mustDo(t, ss, "SET", p.String(), "v")
+	}
+	return slices.Compact(slices.SortedFunc(slices.Values(keys), comparePrefixes))
+}
+
+func TestNextKeyWalk(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	all := mixedKeys(t, ss)
+	for _, within := range []string{"", "2000::/2", "::/0", "0.0.0.0/0", "10.0.0.0/8", "192.0.2.0/24"} {
+		var opts []string
+		var want []netip.Prefix
+		for _, p := range all {
+			if within == "" {
+				want = append(want, p)
+			} else if w := netip.MustParsePrefix(within); w.Addr().Is4() == p.Addr().Is4() && w.Bits() <= p.Bits() && w.Contains(p.Addr()) {
+				want = append(want, p)
+			}
+		}
+		if within != "" {
+			opts = []string{"WITHIN", within}
+		}
+		var got []netip.Prefix
+		for r := mustDo(t, ss, append([]string{"FIRSTKEY"}, opts...)...); r.Type != NullReply; r = mustDo(t, ss, append([]string{"NEXTKEY", r.Str}, opts...)...) {
+			got = append(got, netip.MustParsePrefix(r.Str))
+			if len(got) > len(want) {
+				break
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("WITHIN %q: FIRSTKEY and NEXTKEY walked %d prefixes, want %d in order:\n%v", within, len(got), len(want), got)
+		}
+	}
+}
+
+func TestNextKey(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, k := range []string{"10.0.0.0/8", "10.0.0.0/16", "10.1.0.0/16", "::/0"} {
+		mustDo(t, ss, "SET", k, "v")
+	}
+	mustDo(t, ss, "SET", "10.2.0.0/16", "gone", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	runSteps(t, ss, []replyStep{
+		{[]string{"FIRSTKEY"}, "10.0.0.0/8"},
+		{[]string{"NEXTKEY", "10.0.0.0/8"}, "10.0.0.0/16"},
+		{[]string{"NEXTKEY", "10.0.0.0/12"}, "10.0.0.0/16"}, // the cursor need not be stored
+		{[]string{"NEXTKEY", "10.0.5.0/24"}, "10.1.0.0/16"},
+		{[]string{"NEXTKEY", "10.1.0.0/16"}, "::/0"}, // skipping the expired 10.2.0.0/16
+		{[]string{"NEXTKEY", "::/0"}, "nil"},
+		{[]string{"NEXTKEY", "10.1.0.0/16", "WITHIN", "10.0.0.0/8"}, "nil"},
+		{[]string{"NEXTKEY", "9.0.0.0/8", "WITHIN", "10.0.0.0/15"}, "10.0.0.0/16"},
+		{[]string{"FIRSTKEY", "within", "10.1.0.0/16"}, "10.1.0.0/16"},
+		{[]string{"FIRSTKEY", "WITHIN", "192.0.2.0/24"}, "nil"},
+		{[]string{"FIRSTKEY", "WITHIN"}, "ERR wrong number of arguments for 'FIRSTKEY'"},
+		{[]string{"FIRSTKEY", "INSIDE", "10.0.0.0/8"}, "ERR syntax error"},
+		{[]string{"NEXTKEY"}, "ERR wrong number of arguments for 'NEXTKEY'"},
+		{[]string{"NEXTKEY", "nope"}, "ERR"},
+		{[]string{"NEXTKEY", "10.0.0.0/8", "WITHIN", "nope"}, "ERR"},
+	})
+}
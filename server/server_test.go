@@ -0,0 +1,123 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestEmbedded uses a server as a library does: opened, driven through a
+// session and dropped without Start. It must start no goroutines of its
+// own, even with tracing and a reload file configured.
+func TestEmbedded(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.LogSlowerThan = -1
+	o.OTelEndpoint = "127.0.0.1:1"
+	o.ReloadFile = filepath.Join(o.Dir, "prefixes.csv")
+	o.ReloadInterval = time.Millisecond
+	if err := os.WriteFile(o.ReloadFile, []byte("10.0.0.0/8,a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+	s, err := Open(o)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	ss := s.NewSession()
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "192.168.0.0/16", "b"}, "OK"},
+		{[]string{"SET", "192.168.1.0/24", "c", "PX", "1"}, "OK"},
+		{[]string{"GET", "10.1.2.3"}, "a"},
+		{[]string{"GET", "192.168.0.1"}, "b"},
+		{[]string{"SET", "nope", "x"}, "ERR"},
+	})
+	if err := ss.Do("SET", "nope", "x").Err(); err == nil {
+		t.Error("Err of an error reply is nil")
+	}
+	time.Sleep(5 * time.Millisecond)
+	runSteps(t, ss, []replyStep{{[]string{"GET", "192.168.1.1"}, "b"}}) // expired as it is read
+	ss.Close()
+	if n := runtime.NumGoroutine(); n != before {
+		t.Errorf("%d goroutines after Open and a session, want %d", n, before)
+	}
+	o.DBShards = 3
+	if _, err := NewTrieServer(o); err == nil {
+		t.Error("NewTrieServer accepted db-shards 3")
+	}
+}
+
+// TestSaveLoadSnapshot saves a server written through a Session with
+// SaveSnapshot and loads the file into a fresh server with LoadSnapshot.
+func TestSaveLoadSnapshot(t *testing.T) {
+	o := DefaultOptions()
+	o.LogSlowerThan = -1
+	src, err := NewTrieServer(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := src.NewSession()
+	defer ss.Close()
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "ten"}, "OK"},
+		{[]string{"SET", "2001:db8::/32", "doc"}, "OK"},
+		{[]string{"HSET", "192.0.2.0/24", "asn", "64500"}, "1"},
+		{[]string{"SET", "198.51.100.0/24", "brief", "PX", "1"}, "OK"},
+		{[]string{"SETDEFAULT", "0", "unknown"}, "OK"},
+		{[]string{"NAMEDB", "3", "geo"}, "OK"},
+		{[]string{"SELECT", "geo"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "eu"}, "OK"},
+		{[]string{"DBREADONLY", "geo", "yes"}, "OK"},
+	})
+	time.Sleep(5 * time.Millisecond)
+	path := filepath.Join(t.TempDir(), "copy.tdb")
+	if err := src.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	dst, err := NewTrieServer(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	for _, tc := range []struct {
+		name  string
+		steps []replyStep
+	}{
+		{"values", []replyStep{
+			{[]string{"GET", "10.1.2.3"}, "ten"},
+			{[]string{"GET", "2001:db8::1"}, "doc"},
+			{[]string{"HGET", "192.0.2.0/24", "asn"}, "64500"},
+			{[]string{"DBSIZE"}, "3"}, // the expired prefix was not saved
+		}},
+		{"defaults", []replyStep{
+			{[]string{"GET", "198.51.100.1"}, "unknown"},
+			{[]string{"CONFIG", "GET", "db-default-value"}, "[db-default-value 0 unknown]"},
+		}},
+		{"names", []replyStep{
+			{[]string{"SELECT", "geo"}, "OK"},
+			{[]string{"GET", "10.1.2.3"}, "eu"},
+			{[]string{"CONFIG", "GET", "db-names"}, "[db-names 3=geo]"},
+		}},
+		{"read-only flags", []replyStep{
+			{[]string{"CONFIG", "GET", "db-readonly"}, "[db-readonly 3 yes]"},
+			{[]string{"SELECT", "3"}, "OK"},
+			{[]string{"SET", "10.0.0.0/8", "x"}, "READONLY You can't write against read only db3"},
+			{[]string{"SELECT", "0"}, "OK"},
+			{[]string{"SET", "10.0.0.0/8", "x"}, "OK"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := dst.NewSession()
+			defer ss.Close()
+			runSteps(t, ss, tc.steps)
+		})
+	}
+	if err := dst.LoadSnapshot(filepath.Join(t.TempDir(), "missing.tdb")); err == nil {
+		t.Error("LoadSnapshot of a missing file succeeded")
+	}
+}
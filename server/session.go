@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/tidwall/redcon"
+)
+
+// Session is a client of a server in the same process, for embedding
+// triedis without a socket. Its commands take the path a network client's
+// do, with the same checks, statistics and audit records; it has a
+// database SELECTed and appears in CLIENT LIST like one. A Session is not
+// safe for concurrent use; give each goroutine its own.
+type Session struct {
+	s    *TrieServer
+	c    *client
+	conn *sessionConn
+}
+
+// NewSession returns a session of s, on database 0. Close it once done.
+func (s *TrieServer) NewSession() *Session {
+	conn := &sessionConn{}
+	c := s.clients.add(conn, netip.Addr{}, 0)
+	c.out = &outputConn{Conn: conn, s: s, c: c}
+	conn.SetContext(c)
+	return &Session{s: s, c: c, conn: conn}
+}
+
+// Do runs the command args, such as "SET", "10.0.0.0/8", "office", and
+// returns its reply. A command the server refuses or fails answers an
+// ErrorReply; see Reply.Err.
+func (ss *Session) Do(args ...string) Reply {
+	cmd := redcon.Command{Raw: redcon.AppendArray(nil, len(args)), Args: make([][]byte, len(args))}
+	for i, arg := range args {
+		cmd.Raw = redcon.AppendBulkString(cmd.Raw, arg)
+		cmd.Args[i] = []byte(arg)
+	}
+	ss.conn.buf = ss.conn.buf[:0]
+	ss.s.HandleCommand(ss.conn, cmd)
+	ss.c.omem.Store(0) // the reply is as good as flushed
+	_, resp := redcon.ReadNextRESP(ss.conn.buf)
+	return newReply(resp)
+}
+
+// Close ends the session.
+func (ss *Session) Close() {
+	ss.s.closed(ss.conn, nil)
+}
+
+// ReplyType is the RESP type of a reply.
+type ReplyType byte
+
+const (
+	StatusReply ReplyType = redcon.String
+	ErrorReply  ReplyType = redcon.Error
+	IntReply    ReplyType = redcon.Integer
+	BulkReply   ReplyType = redcon.Bulk
+	ArrayReply  ReplyType = redcon.Array
+	NullReply   ReplyType = '_'
+)
+
+// Reply is a command's reply, as a RESP client would read it.
+type Reply struct {
+	Type  ReplyType
+	Str   string  // of a status, error or bulk string
+	Int   int64   // of an integer
+	Array []Reply // of an array
+}
+
+func newReply(resp redcon.RESP) Reply {
+	r := Reply{Type: ReplyType(resp.Type)}
+	switch {
+	case resp.Type == 0, resp.Type == redcon.Bulk && resp.Data == nil, resp.Type == redcon.Array && resp.Count < 0:
+		r.Type = NullReply
+	case resp.Type == redcon.Integer:
+		r.Int = resp.Int()
+	case resp.Type == redcon.Array:
+		r.Array = make([]Reply, 0, resp.Count)
+		resp.ForEach(func(e redcon.RESP) bool {
+			r.Array = append(r.Array, newReply(e))
+			return true
+		})
+	default:
+		r.Str = resp.String()
+	}
+	return r
+}
+
+// Err returns the *Error of an ErrorReply, and nil for any other.
+func (r Reply) Err() error {
+	if r.Type != ErrorReply {
+		return nil
+	}
+	return parseError(r.Str)
+}
+
+// sessionConn is the redcon.Conn of a Session, collecting the reply of
+// the command running in buf.
+type sessionConn struct {
+	buf []byte
+	ctx any
+}
+
+func (sc *sessionConn) RemoteAddr() string             { return "session" }
+func (sc *sessionConn) Close() error                   { return nil }
+func (sc *sessionConn) WriteError(msg string)          { sc.buf = redcon.AppendError(sc.buf, msg) }
+func (sc *sessionConn) WriteString(str string)         { sc.buf = redcon.AppendString(sc.buf, str) }
+func (sc *sessionConn) WriteBulk(bulk []byte)          { sc.buf = redcon.AppendBulk(sc.buf, bulk) }
+func (sc *sessionConn) WriteBulkString(bulk string)    { sc.buf = redcon.AppendBulkString(sc.buf, bulk) }
+func (sc *sessionConn) WriteInt(num int)               { sc.buf = redcon.AppendInt(sc.buf, int64(num)) }
+func (sc *sessionConn) WriteInt64(num int64)           { sc.buf = redcon.AppendInt(sc.buf, num) }
+func (sc *sessionConn) WriteUint64(num uint64)         { sc.buf = redcon.AppendUint(sc.buf, num) }
+func (sc *sessionConn) WriteArray(count int)           { sc.buf = redcon.AppendArray(sc.buf, count) }
+func (sc *sessionConn) WriteNull()                     { sc.buf = redcon.AppendNull(sc.buf) }
+func (sc *sessionConn) WriteRaw(data []byte)           { sc.buf = append(sc.buf, data...) }
+func (sc *sessionConn) WriteAny(v any)                 { sc.buf = redcon.AppendAny(sc.buf, v) }
+func (sc *sessionConn) Context() any                   { return sc.ctx }
+func (sc *sessionConn) SetContext(v any)               { sc.ctx = v }
+func (sc *sessionConn) SetReadBuffer(int)              {}
+func (sc *sessionConn) Detach() redcon.DetachedConn    { panic("triedis: a Session cannot be detached") }
+func (sc *sessionConn) ReadPipeline() []redcon.Command { return nil }
+func (sc *sessionConn) PeekPipeline() []redcon.Command { return nil }
+func (sc *sessionConn) NetConn() net.Conn              { return nil }
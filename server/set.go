@@ -0,0 +1,119 @@
+package server
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/tidwall/redcon"
+)
+
+// writeMembers writes set members as an array.
+func writeMembers(conn redcon.Conn, members []string) {
+	conn.WriteArray(len(members))
+	for _, m := range members {
+		conn.WriteBulkString(m)
+	}
+}
+
+// handleSet implements the set commands:
+//
+//	SADD cidr member [member ...]  members added
+//	SREM cidr member [member ...]  members removed
+//	SMEMBERS cidr
+//	SCARD cidr
+//	SISMEMBER cidr member
+//	SMATCH ip                      union of the sets of every covering prefix
+//
+// SREM of a set's last member deletes the prefix, as in Redis. Members are
+// returned sorted so replies are stable.
+func (s *TrieServer) handleSet(conn redcon.Conn, c *client, name string, cmd redcon.Command) {
+	want := map[string]int{"SADD": 3, "SREM": 3, "SMEMBERS": 2, "SCARD": 2, "SISMEMBER": 3, "SMATCH": 2}[name]
+	variadic := name == "SADD" || name == "SREM"
+	if len(cmd.Args) < want || !variadic && len(cmd.Args) != want {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "'")
+		return
+	}
+	cidr := string(cmd.Args[1])
+	db := s.getDB(currentDB(conn))
+
+	switch name {
+	case "SADD", "SREM":
+		changed := 0
+		err := db.update(cidr, func(old value, ok bool) (value, error) {
+			if ok && !old.isSet() {
+				return value{}, errWrongType
+			}
+			if !ok && name == "SREM" {
+				return value{}, errUnchanged
+			}
+			members := maps.Clone(old.set)
+			if members == nil {
+				members = make(map[string]struct{}, len(cmd.Args)-2)
+			}
+			for _, arg := range cmd.Args[2:] {
+				m := string(arg)
+				_, present := members[m]
+				switch {
+				case name == "SADD" && !present:
+					members[m] = struct{}{}
+					changed++
+				case name == "SREM" && present:
+					delete(members, m)
+					changed++
+				}
+			}
+			switch {
+			case changed == 0:
+				return value{}, errUnchanged
+			case len(members) == 0:
+				return value{}, nil
+			}
+			return value{set: members}, nil
+		})
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		if changed > 0 {
+			db.writes.add(uint64(c.id), 1)
+			s.audit(c, name, cidr)
+		}
+		conn.WriteInt(changed)
+
+	case "SMATCH":
+		matches, err := db.supernets(cidr)
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		union := make(map[string]struct{})
+		for _, e := range matches {
+			maps.Copy(union, e.value.set) // strings and hashes add nothing
+		}
+		if len(union) > 0 {
+			db.hits.add(uint64(c.id), 1)
+		} else {
+			db.misses.add(uint64(c.id), 1)
+		}
+		writeMembers(conn, slices.Sorted(maps.Keys(union)))
+
+	default: // reads of exactly one prefix
+		v, ok := db.lookupExact(cidr)
+		if ok && !v.isSet() {
+			writeError(conn, errWrongType)
+			return
+		}
+		switch name {
+		case "SMEMBERS":
+			writeMembers(conn, v.members())
+		case "SCARD":
+			conn.WriteInt(len(v.set))
+		case "SISMEMBER":
+			if _, found := v.set[string(cmd.Args[2])]; found {
+				conn.WriteInt(1)
+			} else {
+				conn.WriteInt(0)
+			}
+		}
+	}
+}
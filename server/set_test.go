@@ -0,0 +1,61 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetCommands(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ss := newTestSession(t, newTestServer(t))
+	const k = "10.0.0.0/8"
+	for _, tc := range []struct {
+		args []string
+		want string // the reply as Reply.String renders it; an error by its prefix
+	}{
+		{[]string{"SMEMBERS", k}, "[]"},
+		{[]string{"SCARD", k}, "0"},
+		{[]string{"SREM", k, "spam"}, "0"},
+		{[]string{"DBSIZE"}, "0"},
+		{[]string{"SADD", k, "spam", "tor", "spam"}, "2"},
+		{[]string{"SADD", k, "tor", "botnet"}, "1"},
+		{[]string{"TYPE", k}, "set"},
+		{[]string{"SMEMBERS", k}, "[botnet spam tor]"},
+		{[]string{"SCARD", k}, "3"},
+		{[]string{"SISMEMBER", k, "tor"}, "1"},
+		{[]string{"SISMEMBER", k, "vpn"}, "0"},
+		{[]string{"SADD", "10.1.0.0/16", "vpn", "tor"}, "2"},
+		{[]string{"HSET", "10.1.2.0/24", "asn", "64500"}, "1"},
+		{[]string{"SET", "0.0.0.0/0", "default"}, "OK"},
+		{[]string{"SMATCH", "10.1.2.3"}, "[botnet spam tor vpn]"},
+		{[]string{"SMATCH", "10.2.0.1"}, "[botnet spam tor]"},
+		{[]string{"SMATCH", "192.0.2.1"}, "[]"},
+		{[]string{"GET", "10.2.0.1"}, "WRONGTYPE"}, // the longest match is a set
+		{[]string{"EXPORT", "s.csv", "WITHIN", "10.1.0.0/16"}, "2"},
+		{[]string{"SREM", k, "spam", "vpn"}, "1"},
+		{[]string{"SREM", k, "botnet", "tor"}, "2"},
+		{[]string{"TYPE", k}, "none"}, // the last member took the prefix with it
+		{[]string{"SADD", "10.1.2.0/24", "x"}, "WRONGTYPE"},
+		{[]string{"SMEMBERS", "0.0.0.0/0"}, "WRONGTYPE"},
+		{[]string{"HGET", "10.1.0.0/16", "a"}, "WRONGTYPE"},
+		{[]string{"JGET", "10.1.0.0/16"}, "WRONGTYPE"},
+		{[]string{"SADD", k}, "ERR wrong number of arguments for 'SADD'"},
+		{[]string{"SCARD", k, "x"}, "ERR wrong number of arguments for 'SCARD'"},
+		{[]string{"SMATCH", "not-an-ip"}, "ERR invalid"},
+	} {
+		r := ss.Do(tc.args...)
+		got := r.String()
+		if r.Type == ErrorReply {
+			if !strings.HasPrefix(got, tc.want) {
+				t.Errorf("%q = error %q, want %q", tc.args, got, tc.want)
+			}
+		} else if got != tc.want {
+			t.Errorf("%q = %s, want %s", tc.args, got, tc.want)
+		}
+	}
+	want := "10.1.0.0/16,\"[\"\"tor\"\",\"\"vpn\"\"]\"\n10.1.2.0/24,\"{\"\"asn\"\":\"\"64500\"\"}\"\n"
+	if b, err := os.ReadFile("s.csv"); err != nil || string(b) != want {
+		t.Errorf("exported set and hash: %q, %v, want %q", b, err, want)
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/tannerklineintz/triedis/trie"
+	"github.com/tidwall/redcon"
+)
+
+// The shard map assigns address ranges to the nodes of a sharded
+// deployment, e.g.
+//
+//	0.0.0.0/1=node-a,128.0.0.0-191.255.255.255=node-b,192.0.0.0/2=node-c
+//
+// Each range is a CIDR, a first-last address range or a single address.
+// OWNER looks up which node owns a prefix and SHARDMAP lists the map, so
+// that client-side routers resolve ownership the way the server is to
+// enforce it. Nothing is proxied or refused yet. Ranges may not overlap,
+// and a map with any range of a family must cover all of that family, so
+// every address of it has exactly one owner. A prefix whose addresses are
+// owned by more than one node has no owner.
+
+// shardRange is one range of the shard map.
+type shardRange struct {
+	first, last netip.Addr
+	owner       string
+	spec        string // the range as configured
+}
+
+// shardMap is the parsed shard-map setting, each family's ranges sorted
+// by address.
+type shardMap struct {
+	v4, v6 []shardRange
+}
+
+// parseShardMap parses range=owner entries separated by spaces or commas.
+func parseShardMap(s string) (*shardMap, error) {
+	m := &shardMap{}
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		spec, owner, ok := strings.Cut(entry, "=")
+		if !ok || owner == "" {
+			return nil, fmt.Errorf("invalid shard map entry '%s', expected range=node", entry)
+		}
+		r, err := parseShardRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		r.owner = owner
+		if r.first.Is4() {
+			m.v4 = append(m.v4, r)
+		} else {
+			m.v6 = append(m.v6, r)
+		}
+	}
+	for _, family := range []struct {
+		name   string
+		ranges []shardRange
+		lowest netip.Addr
+	}{{"IPv4", m.v4, netip.IPv4Unspecified()}, {"IPv6", m.v6, netip.IPv6Unspecified()}} {
+		rs := family.ranges
+		if len(rs) == 0 {
+			continue
+		}
+		slices.SortFunc(rs, func(a, b shardRange) int { return a.first.Compare(b.first) })
+		next := family.lowest
+		for i, r := range rs {
+			switch {
+			case i > 0 && r.first.Compare(rs[i-1].last) <= 0:
+				return nil, fmt.Errorf("shard ranges %s and %s overlap", rs[i-1].spec, r.spec)
+			case r.first != next:
+				return nil, fmt.Errorf("no shard owns %s-%s", next, r.first.Prev())
+			}
+			next = r.last.Next()
+		}
+		if next.IsValid() {
+			return nil, fmt.Errorf("no shard owns %s and above, the map must cover all of %s", next, family.name)
+		}
+	}
+	return m, nil
+}
+
+// parseShardRange parses a CIDR, a first-last range or a single address.
+func parseShardRange(spec string) (shardRange, error) {
+	r := shardRange{spec: spec}
+	if strings.Contains(spec, "/") {
+		p, err := parsePrefix(spec)
+		if err != nil {
+			return r, fmt.Errorf("invalid shard range '%s'", spec)
+		}
+		r.first, r.last = p.Addr(), trie.LastAddr(p)
+		return r, nil
+	}
+	firstPart, lastPart, isRange := strings.Cut(spec, "-")
+	if !isRange {
+		lastPart = firstPart
+	}
+	first, err1 := netip.ParseAddr(firstPart)
+	last, err2 := netip.ParseAddr(lastPart)
+	if err1 != nil || err2 != nil || first.Zone() != "" || last.Zone() != "" {
+		return r, fmt.Errorf("invalid shard range '%s'", spec)
+	}
+	r.first, r.last = first.Unmap(), last.Unmap()
+	if r.first.Is4() != r.last.Is4() || r.last.Less(r.first) {
+		return r, fmt.Errorf("invalid shard range '%s'", spec)
+	}
+	return r, nil
+}
+
+// String formats the map as CONFIG GET reports it, in address order.
+func (m *shardMap) String() string {
+	var parts []string
+	for _, r := range m.ranges() {
+		parts = append(parts, r.spec+"="+r.owner)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ranges returns every range, IPv4 first.
+func (m *shardMap) ranges() []shardRange {
+	return append(slices.Clip(m.v4), m.v6...)
+}
+
+// owner returns the node that owns every address in p.
+func (m *shardMap) owner(p netip.Prefix) (string, error) {
+	rs, family := m.v4, "IPv4"
+	if p.Addr().Is6() {
+		rs, family = m.v6, "IPv6"
+	}
+	switch {
+	case len(m.v4) == 0 && len(m.v6) == 0:
+		return "", newError(ClassErr, "no shard map is configured")
+	case len(rs) == 0:
+		return "", errorf(ClassErr, "the shard map has no %s ranges", family)
+	}
+	// The map covers the whole family, so some range holds p's first
+	// address, and the ones after it hold the rest.
+	last := trie.LastAddr(p)
+	i, _ := slices.BinarySearchFunc(rs, p.Addr(), func(r shardRange, a netip.Addr) int {
+		if r.last.Less(a) {
+			return -1
+		}
+		return 1
+	})
+	owner := rs[i].owner
+	for j := i; rs[j].last.Less(last); {
+		if j++; rs[j].owner != owner {
+			return "", errorf(ClassCrossShard, "%s spans shards %s and %s", p, owner, rs[j].owner)
+		}
+	}
+	return owner, nil
+}
+
+// handleOwner implements OWNER cidr|ip: the node of the shard map that
+// owns the prefix.
+func (s *TrieServer) handleOwner(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for 'OWNER'")
+		return
+	}
+	p, err := s.getDB(currentDB(conn)).parseLookup(string(cmd.Args[1]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	owner, err := s.shards.Load().owner(p)
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	conn.WriteBulkString(owner)
+}
+
+// handleShardMap implements SHARDMAP: a [first, last, node] triple per
+// range of the shard map, in address order, IPv4 first.
+func (s *TrieServer) handleShardMap(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		conn.WriteError("ERR wrong number of arguments for 'SHARDMAP'")
+		return
+	}
+	ranges := s.shards.Load().ranges()
+	conn.WriteArray(len(ranges))
+	for _, r := range ranges {
+		conn.WriteArray(3)
+		conn.WriteBulkString(r.first.String())
+		conn.WriteBulkString(r.last.String())
+		conn.WriteBulkString(r.owner)
+	}
+}
+
+// registerShardMapConfig exposes shard-map. A new map is checked whole
+// and replaces the old one at once, so OWNER never sees half of it.
+func (s *TrieServer) registerShardMapConfig() {
+	s.addConfig("shard-map",
+		func() string { return s.shards.Load().String() },
+		func(v string) error {
+			m, err := parseShardMap(v)
+			if err != nil {
+				return err
+			}
+			s.shards.Store(m)
+			return nil
+		})
+}
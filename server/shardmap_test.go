@@ -0,0 +1,79 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseShardMap(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want string // String of the map, or the start of the error
+	}{
+		{"", ""},
+		{"0.0.0.0/0=a", "0.0.0.0/0=a"},
+		{"128.0.0.0-255.255.255.255=b 0.0.0.0/1=a", "0.0.0.0/1=a,128.0.0.0-255.255.255.255=b"},
+		{"::/0=v6,0.0.0.0/0=v4", "0.0.0.0/0=v4,::/0=v6"},
+		{"0.0.0.0-9.255.255.255=a,10.0.0.0=b,10.0.0.1-255.255.255.255=a", "0.0.0.0-9.255.255.255=a,10.0.0.0=b,10.0.0.1-255.255.255.255=a"},
+		{"::/1=a,8000::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff=b", "::/1=a,8000::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff=b"},
+		{"0.0.0.0/1=a", "no shard owns 128.0.0.0 and above, the map must cover all of IPv4"},
+		{"0.0.0.0/2=a,128.0.0.0/1=b", "no shard owns 64.0.0.0-127.255.255.255"},
+		{"1.0.0.0-255.255.255.255=a", "no shard owns 0.0.0.0-0.255.255.255"},
+		{"0.0.0.0/1=a,127.0.0.0-255.255.255.255=b", "shard ranges 0.0.0.0/1 and 127.0.0.0-255.255.255.255 overlap"},
+		{"0.0.0.0/0=a,0.0.0.0/0=b", "shard ranges 0.0.0.0/0 and 0.0.0.0/0 overlap"},
+		{"0.0.0.0/0", "invalid shard map entry '0.0.0.0/0', expected range=node"},
+		{"0.0.0.0/0=", "invalid shard map entry"},
+		{"0.0.0.0/33=a", "invalid shard range '0.0.0.0/33'"},
+		{"2.0.0.0-1.0.0.0=a", "invalid shard range '2.0.0.0-1.0.0.0'"},
+		{"0.0.0.0-::1=a", "invalid shard range"},
+		{"fe80::1%eth0=a", "invalid shard range"},
+		{"nope=a", "invalid shard range 'nope'"},
+	} {
+		m, err := parseShardMap(tc.spec)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = m.String()
+		}
+		if got != tc.want && (err == nil || !strings.HasPrefix(got, tc.want)) {
+			t.Errorf("parseShardMap(%q) = %q, want %q", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestOwner(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"OWNER", "10.0.0.1"}, "ERR no shard map is configured"},
+		{[]string{"SHARDMAP"}, "[]"},
+		{[]string{"CONFIG", "SET", "shard-map", "0.0.0.0/1=a,128.0.0.0-191.255.255.255=b,192.0.0.0/2=c"}, "OK"},
+		{[]string{"OWNER", "10.0.0.1"}, "a"},
+		{[]string{"OWNER", "127.255.255.255"}, "a"},
+		{[]string{"OWNER", "128.0.0.0"}, "b"},
+		{[]string{"OWNER", "255.255.255.255"}, "c"},
+		{[]string{"OWNER", "10.0.0.0/8"}, "a"},
+		{[]string{"OWNER", "0.0.0.0/1"}, "a"},
+		{[]string{"OWNER", "128.0.0.0/1"}, "CROSSSHARD 128.0.0.0/1 spans shards b and c"},
+		{[]string{"OWNER", "0.0.0.0/0"}, "CROSSSHARD 0.0.0.0/0 spans shards a and b"},
+		{[]string{"OWNER", "2001:db8::1"}, "ERR the shard map has no IPv6 ranges"},
+		{[]string{"SHARDMAP"}, "[[0.0.0.0 127.255.255.255 a] [128.0.0.0 191.255.255.255 b] [192.0.0.0 255.255.255.255 c]]"},
+		{[]string{"CONFIG", "GET", "shard-map"}, "[shard-map 0.0.0.0/1=a,128.0.0.0-191.255.255.255=b,192.0.0.0/2=c]"},
+
+		// Neighbouring ranges of one node own a prefix spanning them.
+		{[]string{"CONFIG", "SET", "shard-map", "0.0.0.0/0=v4 ::/2=x 4000::/2=z 8000::/2=y c000::/2=y"}, "OK"},
+		{[]string{"OWNER", "8000::/1"}, "y"},
+		{[]string{"OWNER", "::/1"}, "CROSSSHARD ::/1 spans shards x and z"},
+		{[]string{"OWNER", "::ffff:10.0.0.1"}, "v4"},
+		{[]string{"OWNER", "1.2.3.4"}, "v4"},
+
+		// A bad map leaves the old one in place.
+		{[]string{"CONFIG", "SET", "shard-map", "0.0.0.0/1=a"}, "ERR"},
+		{[]string{"OWNER", "1.2.3.4"}, "v4"},
+		{[]string{"OWNER", "nope"}, "ERR"},
+		{[]string{"OWNER"}, "ERR wrong number of arguments for 'OWNER'"},
+		{[]string{"SHARDMAP", "x"}, "ERR wrong number of arguments for 'SHARDMAP'"},
+		{[]string{"CONFIG", "SET", "shard-map", ""}, "OK"},
+		{[]string{"OWNER", "1.2.3.4"}, "ERR no shard map is configured"},
+	})
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"os"
+)
+
+// With rdbcompression on, a snapshot file is compressed whole and wrapped
+// in a container of its own, which loading recognises by its magic:
+//
+//	header   snapshotPackedMagic, codec (byte), level (int8)
+//	payload  the compressed snapshot
+//	trailer  payload length, uncompressed length, then the CRC-64/ECMA
+//	         of the header and payload (uint64 each, big-endian)
+//
+// The checksum covers the compressed bytes, so a damaged file is refused
+// before any of it is decompressed; the snapshot inside keeps its own
+// checksum, which is checked as it is read, as for an uncompressed file.
+// gzip is the only codec, as the standard library has no zstd; the codec
+// byte leaves room for others.
+const (
+	snapshotPackedMagic = "TRIEDIS\x00COMPRESS"
+	snapshotGzip        = 1
+
+	packedHeaderLen  = len(snapshotPackedMagic) + 2
+	packedTrailerLen = 24
+)
+
+// snapshotPacking describes how a snapshot file is stored.
+type snapshotPacking struct {
+	codec     string // "none" or "gzip"
+	level     int
+	size, raw int64 // bytes in the file and of the snapshot inside
+}
+
+// crcWriter writes through to w, keeping a checksum and count of what it
+// wrote.
+type crcWriter struct {
+	w   io.Writer
+	crc hash.Hash64
+	n   int64
+}
+
+func (cw *crcWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.crc.Write(b[:n])
+	cw.n += int64(n)
+	return n, err
+}
+
+// snapshotPacker compresses a snapshot written to it into w, in the
+// container above.
+type snapshotPacker struct {
+	out *crcWriter
+	zw  *gzip.Writer
+	raw int64
+}
+
+func newSnapshotPacker(w io.Writer, level int) (*snapshotPacker, error) {
+	out := &crcWriter{w: w, crc: crc64.New(crcTable)}
+	if _, err := out.Write(append([]byte(snapshotPackedMagic), snapshotGzip, byte(int8(level)))); err != nil {
+		return nil, err
+	}
+	zw, err := gzip.NewWriterLevel(out, level)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotPacker{out: out, zw: zw}, nil
+}
+
+func (p *snapshotPacker) Write(b []byte) (int, error) {
+	n, err := p.zw.Write(b)
+	p.raw += int64(n)
+	return n, err
+}
+
+// Close finishes the payload and writes the trailer.
+func (p *snapshotPacker) Close() error {
+	if err := p.zw.Close(); err != nil {
+		return err
+	}
+	var trailer [packedTrailerLen]byte
+	binary.BigEndian.PutUint64(trailer[0:], uint64(p.out.n-int64(packedHeaderLen)))
+	binary.BigEndian.PutUint64(trailer[8:], uint64(p.raw))
+	binary.BigEndian.PutUint64(trailer[16:], p.out.crc.Sum64())
+	_, err := p.out.w.Write(trailer[:])
+	return err
+}
+
+// unpackSnapshot returns a reader of the snapshot in f, which is either
+// one or a compressed container of one. A container's checksum is
+// verified before it is decompressed.
+func unpackSnapshot(f *os.File) (io.Reader, snapshotPacking, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, snapshotPacking{}, err
+	}
+	pk := snapshotPacking{codec: "none", size: fi.Size(), raw: fi.Size()}
+	var hdr [packedHeaderLen]byte
+	if n, _ := f.ReadAt(hdr[:], 0); n < len(snapshotPackedMagic) || string(hdr[:len(snapshotPackedMagic)]) != snapshotPackedMagic {
+		return f, pk, nil
+	}
+	if pk.size < int64(packedHeaderLen+packedTrailerLen) {
+		return nil, pk, fmt.Errorf("%w: truncated compressed snapshot", errSnapshotCorrupt)
+	}
+	var trailer [packedTrailerLen]byte
+	if _, err := f.ReadAt(trailer[:], pk.size-packedTrailerLen); err != nil {
+		return nil, pk, err
+	}
+	payload := int64(binary.BigEndian.Uint64(trailer[0:]))
+	if payload != pk.size-int64(packedHeaderLen+packedTrailerLen) {
+		return nil, pk, fmt.Errorf("%w: compressed snapshot is %d bytes long, its trailer says %d", errSnapshotCorrupt,
+			pk.size-int64(packedHeaderLen+packedTrailerLen), payload)
+	}
+	crc := crc64.New(crcTable)
+	if _, err := io.Copy(crc, io.NewSectionReader(f, 0, pk.size-packedTrailerLen)); err != nil {
+		return nil, pk, err
+	}
+	if sum, want := binary.BigEndian.Uint64(trailer[16:]), crc.Sum64(); sum != want {
+		return nil, pk, fmt.Errorf("compressed snapshot checksum mismatch: file says %016x, compressed data hashes to %016x", sum, want)
+	}
+	pk.raw, pk.level = int64(binary.BigEndian.Uint64(trailer[8:])), int(int8(hdr[len(hdr)-1]))
+	switch codec := hdr[len(hdr)-2]; codec {
+	case snapshotGzip:
+		pk.codec = "gzip"
+	default:
+		return nil, pk, fmt.Errorf("snapshot compressed with unknown codec %d, load it with a newer triedis", codec)
+	}
+	zr, err := gzip.NewReader(io.NewSectionReader(f, int64(packedHeaderLen), payload))
+	if err != nil {
+		return nil, pk, fmt.Errorf("%w: %v", errSnapshotCorrupt, err)
+	}
+	return zr, pk, nil
+}
+
+// validCompressionLevel reports whether n is a valid rdbcompression-level.
+func validCompressionLevel(n int64) bool {
+	return n >= gzip.BestSpeed && n <= gzip.BestCompression
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/binary"
+	"hash/crc64"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotCompression(t *testing.T) {
+	for _, tc := range []struct {
+		compression string
+		level       string
+		codec       string
+	}{
+		{"no", "6", "none"},
+		{"yes", "1", "gzip"},
+		{"yes", "9", "gzip"},
+	} {
+		t.Run(tc.codec+"-"+tc.level, func(t *testing.T) {
+			dir := t.TempDir()
+			ss := newTestSession(t, newTestServer(t))
+			runSteps(t, ss, []replyStep{
+				{[]string{"CONFIG", "SET", "dir", dir}, "OK"},
+				{[]string{"CONFIG", "SET", "rdbcompression", tc.compression}, "OK"},
+				{[]string{"CONFIG", "SET", "rdbcompression-level", tc.level}, "OK"},
+			})
+			for i := range 500 {
+				mustDo(t, ss, "SET", "10.0."+strconv.Itoa(i/250)+"."+strconv.Itoa(i%250)+"/32", "a repetitive value")
+			}
+			runSteps(t, ss, []replyStep{
+				{[]string{"HSET", "192.0.2.0/24", "asn", "64500"}, "1"},
+				{[]string{"NAMEDB", "3", "geo"}, "OK"},
+				{[]string{"SAVE"}, "OK"},
+			})
+
+			r := mustDo(t, ss, "SNAPSHOTINFO", "dump.tdb")
+			size, raw := infoField(r, "file-bytes").Int, infoField(r, "uncompressed-bytes").Int
+			fi, err := os.Stat(filepath.Join(dir, "dump.tdb"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := infoField(r, "compression").Str; got != tc.codec {
+				t.Errorf("compression %q, want %q", got, tc.codec)
+			}
+			if tc.codec == "none" && (size != raw || size != fi.Size()) || tc.codec == "gzip" && (size >= raw/4 || size != fi.Size()) {
+				t.Errorf("file-bytes %d, uncompressed-bytes %d, the file %d bytes", size, raw, fi.Size())
+			}
+			info := infoFields(mustDo(t, ss, "INFO", "persistence").Str)
+			if want := strconv.FormatInt(size, 10); info["rdb_last_save_bytes"] != want {
+				t.Errorf("rdb_last_save_bytes %s, want %s", info["rdb_last_save_bytes"], want)
+			}
+			if want := strconv.FormatInt(raw, 10); info["rdb_last_save_uncompressed_bytes"] != want {
+				t.Errorf("rdb_last_save_uncompressed_bytes %s, want %s", info["rdb_last_save_uncompressed_bytes"], want)
+			}
+			if info["rdb_compression"] != tc.compression {
+				t.Errorf("rdb_compression %s, want %s", info["rdb_compression"], tc.compression)
+			}
+
+			// Loading does not depend on the setting.
+			s := newTestServer(t)
+			if _, err := loadSnapshotFile(s, filepath.Join(dir, "dump.tdb"), true, true); err != nil {
+				t.Fatal(err)
+			}
+			runSteps(t, newTestSession(t, s), []replyStep{
+				{[]string{"DBSIZE"}, "501"},
+				{[]string{"GET", "10.0.1.9"}, "a repetitive value"},
+				{[]string{"HGET", "192.0.2.0/24", "asn"}, "64500"},
+				{[]string{"SELECT", "geo"}, "OK"},
+			})
+		})
+	}
+	runSteps(t, newTestSession(t, newTestServer(t)), []replyStep{
+		{[]string{"CONFIG", "GET", "rdbcompression-level"}, "[rdbcompression-level 6]"},
+		{[]string{"CONFIG", "SET", "rdbcompression-level", "0"}, "ERR"},
+		{[]string{"CONFIG", "SET", "rdbcompression-level", "10"}, "ERR"},
+		{[]string{"CONFIG", "SET", "rdbcompression", "maybe"}, "ERR"},
+	})
+}
+
+// TestSnapshotCompressionDamage damages a compressed snapshot and checks
+// loading refuses it.
+func TestSnapshotCompressionDamage(t *testing.T) {
+	dir := t.TempDir()
+	runSteps(t, newTestSession(t, newTestServer(t)), []replyStep{
+		{[]string{"CONFIG", "SET", "dir", dir}, "OK"},
+		{[]string{"CONFIG", "SET", "rdbcompression", "yes"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "ten"}, "OK"},
+		{[]string{"SAVE"}, "OK"},
+	})
+	good, err := os.ReadFile(filepath.Join(dir, "dump.tdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// resum rewrites the trailer's checksum to match b.
+	resum := func(b []byte) []byte {
+		binary.BigEndian.PutUint64(b[len(b)-8:], crc64.Checksum(b[:len(b)-packedTrailerLen], crcTable))
+		return b
+	}
+	for _, tc := range []struct {
+		name   string
+		damage func(b []byte) []byte
+		want   string
+	}{
+		{"payload byte", func(b []byte) []byte { b[packedHeaderLen+5] ^= 0xff; return b }, "compressed snapshot checksum mismatch"},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-3] }, "corrupt snapshot: compressed snapshot is"},
+		{"header only", func(b []byte) []byte { return b[:packedHeaderLen] }, "corrupt snapshot: truncated compressed snapshot"},
+		{"unknown codec", func(b []byte) []byte { b[packedHeaderLen-2] = 7; return resum(b) }, "snapshot compressed with unknown codec 7"},
+		{"not gzip", func(b []byte) []byte { b[packedHeaderLen] ^= 0xff; return resum(b) }, "corrupt snapshot: gzip: invalid header"},
+	} {
+		path := filepath.Join(t.TempDir(), "dump.tdb")
+		if err := os.WriteFile(path, tc.damage(append([]byte(nil), good...)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSnapshotFile(newTestServer(t), path, true, true); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,1128 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// A snapshot file holds every database, with its name and flags, as:
+//
+//	header   snapshotMagic, major and minor format version (uint16 each),
+//	         creation time (unix nanoseconds, int64), generating triedis
+//	         version (string)
+//	section  'D', index, name (string, empty if none), flags (byte, bit 0
+//	         read-only, bit 1 a default value follows, bit 2 tombstones
+//	         follow), the default value (string), key count, then that
+//	         many entries, in no particular order, and with bit 2 a
+//	         tombstone count and that many tombstones, oldest first
+//	trailer  'E', then the CRC-64/ECMA of everything before it (uint64)
+//
+// An entry is the address length (4 or 16), the address, the prefix
+// length, a type byte and the value: a string, or a count followed by a
+// hash's field/value strings or a set's members. A type byte with
+// snapshotExpires set is followed by the prefix's deadline (unix
+// milliseconds, int64) and one with snapshotTags by a count and that many
+// tag strings, in that order, before the value. Counts, indices and
+// string lengths are uvarints; fixed-width numbers are big-endian. A
+// tombstone is an entry, its deletion time (unix milliseconds, int64) and
+// the deleting client (string).
+//
+// With rdbcompression on, the file is this encoding compressed, in the
+// container snapshotPacker writes.
+//
+// Readers refuse a newer major version. A minor version bump marks a
+// change that older readers of the same major version still load.
+// Version 2 added deadlines, version 3 tags, version 4 default values and
+// version 5 tombstones, which older readers could not skip.
+const (
+	snapshotMagic = "TRIEDIS\x00SNAPSHOT"
+	snapshotMajor = 5
+	snapshotMinor = 0
+
+	snapshotSection = 'D'
+	snapshotEnd     = 'E'
+
+	snapshotString = 0
+	snapshotHash   = 1
+	snapshotSet    = 2
+
+	snapshotExpires = 1 << 7 // type flag: a deadline follows
+	snapshotTags    = 1 << 6 // type flag: tags follow
+
+	snapshotReadOnly   = 1 << 0
+	snapshotDefault    = 1 << 1
+	snapshotTombstones = 1 << 2
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// snapshotInfo describes a snapshot file, as SNAPSHOTINFO reports it.
+type snapshotInfo struct {
+	major, minor int
+	created      time.Time
+	version      string
+	checksum     uint64
+	packing      snapshotPacking // set when read from a file
+	dbs          []snapshotDB
+}
+
+// snapshotDB is one database section.
+type snapshotDB struct {
+	id       int
+	name     string
+	readOnly bool
+	def      []byte // the default value; nil if none
+	keys     int64
+	graves   int       // tombstones
+	db       *database // the loaded data; nil when only inspecting
+}
+
+// snapshotWriter writes the encoding above, keeping the running checksum.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash64
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (sw *snapshotWriter) write(b []byte) {
+	sw.w.Write(b) // a bufio.Writer keeps its first error for Flush
+	sw.crc.Write(b)
+}
+
+func (sw *snapshotWriter) byte(b byte) { sw.write([]byte{b}) }
+
+func (sw *snapshotWriter) uvarint(n uint64) {
+	sw.write(binary.AppendUvarint(sw.buf[:0], n))
+}
+
+func (sw *snapshotWriter) string(b []byte) {
+	sw.uvarint(uint64(len(b)))
+	sw.write(b)
+}
+
+func (sw *snapshotWriter) entry(e entry) {
+	a := e.prefix.Addr().AsSlice()
+	sw.byte(byte(len(a)))
+	sw.write(a)
+	sw.byte(byte(e.prefix.Bits()))
+	v := e.value
+	typ := byte(snapshotString)
+	switch {
+	case v.isHash():
+		typ = snapshotHash
+	case v.isSet():
+		typ = snapshotSet
+	}
+	flags := typ
+	if v.expireAt != 0 {
+		flags |= snapshotExpires
+	}
+	if len(v.tags) > 0 {
+		flags |= snapshotTags
+	}
+	sw.byte(flags)
+	if v.expireAt != 0 {
+		sw.write(binary.BigEndian.AppendUint64(sw.buf[:0], uint64(v.expireAt)))
+	}
+	if len(v.tags) > 0 {
+		sw.uvarint(uint64(len(v.tags)))
+		for _, t := range v.tags {
+			sw.string([]byte(t))
+		}
+	}
+	switch typ {
+	case snapshotHash:
+		sw.uvarint(uint64(len(v.hash)))
+		for _, f := range slices.Sorted(maps.Keys(v.hash)) {
+			sw.string([]byte(f))
+			sw.string(v.hash[f])
+		}
+	case snapshotSet:
+		sw.uvarint(uint64(len(v.set)))
+		for _, m := range v.members() {
+			sw.string([]byte(m))
+		}
+	default:
+		sw.string(v.str)
+	}
+}
+
+// writeSnapshot saves databases ids to path, those with data as snaps
+// began them, under a temporary name that is synced and renamed into
+// place, so a crash mid-save leaves the last good snapshot. With
+// rdbcompression on it is compressed. It returns how the file is stored.
+func (s *TrieServer) writeSnapshot(path string, ids []int, snaps map[int]*dbSnapshot) (keys int64, pk snapshotPacking, err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return 0, pk, err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	var out io.Writer = tmp
+	var packer *snapshotPacker
+	pk.codec = "none"
+	if st := &s.snapshots; st.compression.Load() {
+		pk.codec, pk.level = "gzip", int(st.compressionLevel.Load())
+		if packer, err = newSnapshotPacker(tmp, pk.level); err != nil {
+			tmp.Close()
+			return 0, pk, err
+		}
+		out = packer
+	}
+	sw := &snapshotWriter{w: bufio.NewWriterSize(out, 1<<16), crc: crc64.New(crcTable)}
+	sw.write([]byte(snapshotMagic))
+	var hdr [12]byte
+	binary.BigEndian.PutUint16(hdr[0:], snapshotMajor)
+	binary.BigEndian.PutUint16(hdr[2:], snapshotMinor)
+	binary.BigEndian.PutUint64(hdr[4:], uint64(time.Now().UnixNano()))
+	sw.write(hdr[:])
+	sw.string([]byte(version))
+
+	for _, id := range ids {
+		ds := snaps[id]
+		var n int64
+		if ds != nil {
+			n = ds.keys
+		}
+		var flags byte
+		if s.readOnlyDBs.has(id) {
+			flags |= snapshotReadOnly
+		}
+		def, hasDef := s.defaults.get(id)
+		if hasDef {
+			flags |= snapshotDefault
+		}
+		var graves []tombstone
+		if ds != nil {
+			graves = ds.graves
+		}
+		if len(graves) > 0 {
+			flags |= snapshotTombstones
+		}
+		sw.byte(snapshotSection)
+		sw.uvarint(uint64(id))
+		sw.string([]byte(s.names.name(id)))
+		sw.byte(flags)
+		if hasDef {
+			sw.string(def)
+		}
+		sw.uvarint(uint64(n))
+		if ds != nil {
+			ds.each(sw.entry)
+		}
+		if len(graves) > 0 {
+			sw.uvarint(uint64(len(graves)))
+			for _, t := range graves {
+				sw.entry(entry{t.prefix, t.value})
+				sw.write(binary.BigEndian.AppendUint64(sw.buf[:0], uint64(t.deletedAt)))
+				sw.string([]byte(t.by))
+			}
+		}
+		keys += n
+	}
+	sw.byte(snapshotEnd)
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], sw.crc.Sum64())
+	sw.w.Write(sum[:])
+
+	if err = sw.w.Flush(); err == nil && packer != nil {
+		err = packer.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = tmp.Stat()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, pk, err
+	}
+	pk.size, pk.raw = fi.Size(), fi.Size()
+	if packer != nil {
+		pk.raw = packer.raw
+	}
+	return keys, pk, os.Rename(tmp.Name(), path)
+}
+
+// snapshotIDs returns, in order, every database index with data,
+// tombstones, a name, a read-only flag or a default value, which are the
+// ones a snapshot keeps.
+func (s *TrieServer) snapshotIDs() []int {
+	var ids []int
+	for _, db := range s.databases() {
+		if db.keyCount() > 0 || db.graves.len() > 0 {
+			ids = append(ids, db.id)
+		}
+	}
+	ids = append(ids, s.names.ids()...)
+	ids = append(ids, s.readOnlyDBs.ids()...)
+	ids = append(ids, s.defaults.ids()...)
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+// errSnapshotCorrupt wraps every structural problem in a snapshot file.
+var errSnapshotCorrupt = errors.New("corrupt snapshot")
+
+// snapshotReader reads the encoding above, keeping the running checksum.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash64
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (sr *snapshotReader) full(b []byte) error {
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		return err
+	}
+	sr.crc.Write(b)
+	return nil
+}
+
+func (sr *snapshotReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(sr)
+}
+
+// maxSnapshotString bounds a string length read from a file, so a damaged
+// length fails cleanly rather than allocating without limit.
+const maxSnapshotString = 512 << 20
+
+func (sr *snapshotReader) string() ([]byte, error) {
+	n, err := sr.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSnapshotString {
+		return nil, errSnapshotCorrupt
+	}
+	b := make([]byte, n)
+	return b, sr.full(b)
+}
+
+func (sr *snapshotReader) entry() (entry, error) {
+	n, err := sr.ReadByte()
+	if err != nil {
+		return entry{}, err
+	}
+	if n != 4 && n != 16 {
+		return entry{}, errSnapshotCorrupt
+	}
+	var raw [18]byte // address, prefix length, type
+	if err := sr.full(raw[:n+2]); err != nil {
+		return entry{}, err
+	}
+	addr, _ := netip.AddrFromSlice(raw[:n])
+	p := netip.PrefixFrom(addr, int(raw[n]))
+	if !p.IsValid() || p != p.Masked() {
+		return entry{}, errSnapshotCorrupt
+	}
+	e := entry{prefix: p}
+	typ := raw[n+1]
+	if typ&snapshotExpires != 0 {
+		var at [8]byte
+		if err := sr.full(at[:]); err != nil {
+			return entry{}, err
+		}
+		if e.value.expireAt = int64(binary.BigEndian.Uint64(at[:])); e.value.expireAt <= 0 {
+			return entry{}, errSnapshotCorrupt
+		}
+		typ &^= snapshotExpires
+	}
+	if typ&snapshotTags != 0 {
+		count, err := sr.uvarint()
+		if err != nil {
+			return entry{}, err
+		}
+		if count == 0 || count > maxSnapshotString {
+			return entry{}, errSnapshotCorrupt
+		}
+		e.value.tags = make([]string, count)
+		for i := range e.value.tags {
+			t, err := sr.string()
+			if err != nil {
+				return entry{}, err
+			}
+			if len(t) == 0 || i > 0 && string(t) <= e.value.tags[i-1] {
+				return entry{}, errSnapshotCorrupt // tags are stored sorted and unique
+			}
+			e.value.tags[i] = string(t)
+		}
+		typ &^= snapshotTags
+	}
+	switch typ {
+	case snapshotString:
+		e.value.str, err = sr.string() // never nil, even when empty
+	case snapshotHash, snapshotSet:
+		var count uint64
+		if count, err = sr.uvarint(); err != nil {
+			break
+		}
+		if count == 0 || count > maxSnapshotString {
+			return entry{}, errSnapshotCorrupt
+		}
+		if typ == snapshotHash {
+			e.value.hash = make(map[string][]byte, count)
+		} else {
+			e.value.set = make(map[string]struct{}, count)
+		}
+		for range count {
+			var f, v []byte
+			if f, err = sr.string(); err != nil {
+				break
+			}
+			if e.value.hash == nil {
+				e.value.set[string(f)] = struct{}{}
+				continue
+			}
+			if v, err = sr.string(); err != nil {
+				break
+			}
+			e.value.hash[string(f)] = v
+		}
+	default:
+		return entry{}, errSnapshotCorrupt
+	}
+	return e, err
+}
+
+// readSnapshot reads a snapshot, loading each section into a new database
+// when load is set and only checking it otherwise. Nothing is returned
+// unless the whole file checks out, so a caller applies all of it or none.
+func (s *TrieServer) readSnapshot(r io.Reader, load bool) (*snapshotInfo, error) {
+	sr := &snapshotReader{r: bufio.NewReaderSize(r, 1<<16), crc: crc64.New(crcTable)}
+	magic := make([]byte, len(snapshotMagic))
+	if err := sr.full(magic); err != nil || string(magic) != snapshotMagic {
+		if bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) {
+			return nil, errors.New("not a triedis snapshot (gzip data); gzipped CSV and TSV files are loaded with IMPORT")
+		}
+		return nil, errors.New("not a triedis snapshot (no snapshot header); CSV and TSV files are loaded with IMPORT")
+	}
+	var hdr [12]byte
+	if err := sr.full(hdr[:]); err != nil {
+		return nil, fmt.Errorf("%w: truncated header", errSnapshotCorrupt)
+	}
+	info := &snapshotInfo{
+		major:   int(binary.BigEndian.Uint16(hdr[0:])),
+		minor:   int(binary.BigEndian.Uint16(hdr[2:])),
+		created: time.Unix(0, int64(binary.BigEndian.Uint64(hdr[4:]))),
+	}
+	if info.major > snapshotMajor {
+		return nil, fmt.Errorf("snapshot format %d.%d is newer than this triedis reads (%d.x), load it with a newer triedis",
+			info.major, info.minor, snapshotMajor)
+	}
+	ver, err := sr.string()
+	if err != nil {
+		return nil, fmt.Errorf("%w: truncated header", errSnapshotCorrupt)
+	}
+	info.version = string(ver)
+
+	for {
+		tag, err := sr.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: truncated", errSnapshotCorrupt)
+		}
+		if tag == snapshotEnd {
+			break
+		}
+		if tag != snapshotSection {
+			return nil, fmt.Errorf("%w: unknown section %q", errSnapshotCorrupt, tag)
+		}
+		sdb, err := s.readSection(sr, load)
+		if err != nil {
+			return nil, fmt.Errorf("%w: db%d: %v", errSnapshotCorrupt, sdb.id, err)
+		}
+		info.dbs = append(info.dbs, sdb)
+	}
+	want := sr.crc.Sum64()
+	var sum [8]byte
+	if _, err := io.ReadFull(sr.r, sum[:]); err != nil {
+		return nil, fmt.Errorf("%w: missing checksum", errSnapshotCorrupt)
+	}
+	if info.checksum = binary.BigEndian.Uint64(sum[:]); info.checksum != want {
+		return nil, fmt.Errorf("snapshot checksum mismatch: file says %016x, contents hash to %016x", info.checksum, want)
+	}
+	if _, err := sr.r.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("%w: data after the checksum", errSnapshotCorrupt)
+	}
+	return info, nil
+}
+
+// readSection reads one database section, the tag already consumed.
+func (s *TrieServer) readSection(sr *snapshotReader, load bool) (snapshotDB, error) {
+	var sdb snapshotDB
+	id, err := sr.uvarint()
+	if err != nil {
+		return sdb, err
+	}
+	sdb.id = int(id)
+	name, err := sr.string()
+	if err != nil {
+		return sdb, err
+	}
+	if sdb.name = string(name); sdb.name != "" {
+		if err := validDBName(sdb.name); err != nil {
+			return sdb, err
+		}
+	}
+	flags, err := sr.ReadByte()
+	if err != nil {
+		return sdb, err
+	}
+	sdb.readOnly = flags&snapshotReadOnly != 0
+	if flags&snapshotDefault != 0 {
+		if sdb.def, err = sr.string(); err != nil {
+			return sdb, err
+		}
+	}
+	keys, err := sr.uvarint()
+	if err != nil {
+		return sdb, err
+	}
+	sdb.keys = int64(keys)
+	if load {
+		sdb.db = newDatabase(sdb.id, &s.store)
+	}
+	for range keys {
+		e, err := sr.entry()
+		if err != nil {
+			return sdb, err
+		}
+		if load && !e.value.expired() {
+			sdb.db.store(e.prefix, e.value, true)
+		}
+	}
+	if flags&snapshotTombstones == 0 {
+		return sdb, nil
+	}
+	count, err := sr.uvarint()
+	if err != nil {
+		return sdb, err
+	}
+	if count == 0 || count > maxSnapshotString {
+		return sdb, errSnapshotCorrupt
+	}
+	sdb.graves = int(count)
+	for range count {
+		e, err := sr.entry()
+		if err != nil {
+			return sdb, err
+		}
+		var at [8]byte
+		if err := sr.full(at[:]); err != nil {
+			return sdb, err
+		}
+		by, err := sr.string()
+		if err != nil {
+			return sdb, err
+		}
+		if load {
+			sdb.db.graves.stones = append(sdb.db.graves.stones, tombstone{prefix: e.prefix, value: e.value,
+				deletedAt: int64(binary.BigEndian.Uint64(at[:])), by: string(by)})
+		}
+	}
+	return sdb, nil
+}
+
+// readSnapshotFile reads the snapshot at path, loading its databases off
+// to the side when load is set.
+func (s *TrieServer) readSnapshotFile(path string, load bool) (*snapshotInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, pk, err := unpackSnapshot(f)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.readSnapshot(r, load)
+	if err != nil {
+		return nil, err
+	}
+	info.packing = pk
+	return info, nil
+}
+
+// installSnapshots makes the databases read from snapshots current, and
+// restores the names, read-only flags and default values they record when
+// names, readOnly and defaults are set.
+func (s *TrieServer) installSnapshots(infos []*snapshotInfo, names, readOnly, defaults bool) error {
+	var nameSpec, readOnlySpec, defaultSpec []string
+	for _, info := range infos {
+		for _, sdb := range info.dbs {
+			if sdb.def != nil {
+				defaultSpec = append(defaultSpec, strconv.Itoa(sdb.id)+" "+quoteArg(sdb.def))
+			}
+			if sdb.name != "" {
+				nameSpec = append(nameSpec, strconv.Itoa(sdb.id)+"="+sdb.name)
+			}
+			if sdb.readOnly {
+				readOnlySpec = append(readOnlySpec, strconv.Itoa(sdb.id)+" yes")
+			}
+		}
+	}
+	if names {
+		if err := s.names.Set(strings.Join(nameSpec, ",")); err != nil {
+			return fmt.Errorf("%w: %v", errSnapshotCorrupt, err)
+		}
+	}
+	if readOnly {
+		s.readOnlyDBs.Set(strings.Join(readOnlySpec, " "))
+	}
+	if defaults {
+		if err := s.defaults.Set(strings.Join(defaultSpec, " ")); err != nil {
+			return fmt.Errorf("%w: %v", errSnapshotCorrupt, err)
+		}
+	}
+	for _, info := range infos {
+		for _, sdb := range info.dbs {
+			if sdb.keys > 0 || sdb.graves > 0 {
+				s.replaceDB(sdb.id, sdb.db)
+			}
+		}
+	}
+	return nil
+}
+
+// loadSnapshots loads the snapshot, or with a per-database dbfilename
+// every database file, found at startup. Every file is read and checked
+// before any is installed, so one bad file fails the whole startup rather
+// than leave some databases restored and others not.
+func (s *TrieServer) loadSnapshots(names, readOnly, defaults bool) ([]string, []*snapshotInfo, error) {
+	st := &s.snapshots
+	var paths []string
+	if !st.perDB() {
+		paths = []string{st.path(-1)}
+	} else {
+		matches, err := filepath.Glob(st.path(-1))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, m := range matches {
+			if _, ok := st.idOf(m); ok {
+				paths = append(paths, m)
+			}
+		}
+	}
+	var found []string
+	var infos []*snapshotInfo
+	for _, path := range paths {
+		info, err := s.readSnapshotFile(path, true)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if id, ok := st.idOf(path); ok && (len(info.dbs) != 1 || info.dbs[0].id != id) {
+			return nil, nil, fmt.Errorf("%s: not a snapshot of db%d alone; per-database and combined snapshots can't be mixed", path, id)
+		}
+		found, infos = append(found, path), append(infos, info)
+	}
+	return found, infos, s.installSnapshots(infos, names, readOnly, defaults)
+}
+
+// snapshotState is what INFO persistence reports about SAVE and BGSAVE.
+type snapshotState struct {
+	saving sync.Mutex // held by the save in progress, so saves take turns
+
+	mu         sync.Mutex
+	dir        string // dir: where snapshots are written
+	dbFilename string // dbfilename: their name in dir, with %d for one per database
+	inProgress bool   // a BGSAVE is running
+	lastSave   time.Time
+	lastStatus string // "ok" or "err", of the last SAVE or BGSAVE
+	lastError  string
+	lastTook   time.Duration
+	lastKeys   int64
+	lastSize   int64 // bytes written by the last successful save
+	lastRaw    int64 // the same uncompressed
+	saves      int64
+
+	compression      atomic.Bool  // rdbcompression
+	compressionLevel atomic.Int64 // rdbcompression-level
+}
+
+// errOutsideDir refuses a file a command names outside dir.
+var errOutsideDir = newError(ClassErr, "path must be relative to dir and stay inside it")
+
+// inDir returns the path of the file name names in dir, for the commands
+// that read or write files a client names. Only local paths, which are
+// relative and never climb out with "..", are allowed, so a client cannot
+// reach past dir.
+func (st *snapshotState) inDir(name string) (string, error) {
+	if !filepath.IsLocal(name) {
+		return "", errOutsideDir
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return filepath.Join(st.dir, name), nil
+}
+
+// perDB reports whether each database is saved to its own file.
+func (st *snapshotState) perDB() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return strings.Contains(st.dbFilename, "%d")
+}
+
+// path returns the file database id is saved to. In the combined mode
+// every id shares one file; with a per-database dbfilename, id -1 gives
+// the glob matching every database's file.
+func (st *snapshotState) path(id int) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	name := st.dbFilename
+	if before, after, per := strings.Cut(name, "%d"); per {
+		if id < 0 {
+			name = before + "*" + after
+		} else {
+			name = before + strconv.Itoa(id) + after
+		}
+	}
+	return filepath.Join(st.dir, name)
+}
+
+// idOf returns the database a per-database snapshot path belongs to.
+func (st *snapshotState) idOf(path string) (int, bool) {
+	st.mu.Lock()
+	before, after, per := strings.Cut(st.dbFilename, "%d")
+	st.mu.Unlock()
+	if !per {
+		return 0, false
+	}
+	digits, ok := strings.CutPrefix(filepath.Base(path), before)
+	if digits, ok = strings.CutSuffix(digits, after); !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(digits)
+	if err != nil || id < 0 || strconv.Itoa(id) != digits {
+		return 0, false
+	}
+	return id, true
+}
+
+// save writes a snapshot of database id, or of every database when id is
+// -1, and records the outcome. With a per-database dbfilename, each
+// database goes to its own file.
+func (s *TrieServer) save(id int) error {
+	st := &s.snapshots
+	st.saving.Lock()
+	defer st.saving.Unlock()
+	start := time.Now()
+	path := st.path(id)
+	ids := []int{id}
+	switch {
+	case !st.perDB():
+		ids = s.snapshotIDs()
+	case id < 0:
+		// Rewrite the file of a database emptied since it was saved too, so
+		// a restart does not bring its old contents back.
+		ids = s.snapshotIDs()
+		matches, _ := filepath.Glob(path)
+		for _, m := range matches {
+			if id, ok := st.idOf(m); ok {
+				ids = append(ids, id)
+			}
+		}
+		slices.Sort(ids)
+		ids = slices.Compact(ids)
+	}
+	var dbs []*database
+	for _, id := range ids {
+		if db := s.existingDB(id); db != nil {
+			dbs = append(dbs, db)
+		}
+	}
+	snaps := beginSnapshot(dbs)
+	defer func() {
+		for _, ds := range snaps {
+			ds.end() // in case a failed write left some unwalked
+		}
+	}()
+
+	var keys, size, raw int64
+	var err error
+	if !st.perDB() {
+		var pk snapshotPacking
+		keys, pk, err = s.writeSnapshot(path, ids, snaps)
+		size, raw = pk.size, pk.raw
+	} else {
+		for _, id := range ids {
+			var n int64
+			var pk snapshotPacking
+			if n, pk, err = s.writeSnapshot(st.path(id), []int{id}, snaps); err != nil {
+				path = st.path(id)
+				break
+			}
+			keys, size, raw = keys+n, size+pk.size, raw+pk.raw
+		}
+	}
+	took := time.Since(start)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastTook = took
+	if err != nil {
+		st.lastStatus, st.lastError = "err", err.Error()
+		slog.Error("snapshot failed", "path", path, "err", err)
+		return err
+	}
+	st.lastStatus, st.lastError = "ok", ""
+	st.lastSave, st.lastKeys, st.lastSize, st.lastRaw = time.Now(), keys, size, raw
+	st.saves++
+	slog.Info("Snapshot saved", "path", path, "keys", keys, "bytes", size, "uncompressed_bytes", raw, "elapsed", took)
+	return nil
+}
+
+// SaveSnapshot writes every database to a snapshot file at path, in the
+// format SAVE writes, whatever dir and dbfilename are. It waits for a
+// SAVE or BGSAVE in progress, but does not count as one in INFO.
+func (s *TrieServer) SaveSnapshot(path string) error {
+	st := &s.snapshots
+	st.saving.Lock()
+	defer st.saving.Unlock()
+	ids := s.snapshotIDs()
+	var dbs []*database
+	for _, id := range ids {
+		if db := s.existingDB(id); db != nil {
+			dbs = append(dbs, db)
+		}
+	}
+	snaps := beginSnapshot(dbs)
+	defer func() {
+		for _, ds := range snaps {
+			ds.end()
+		}
+	}()
+	_, _, err := s.writeSnapshot(path, ids, snaps)
+	return err
+}
+
+// LoadSnapshot replaces the databases the snapshot file at path holds,
+// as SaveSnapshot or SAVE wrote it, with their saved contents, and takes
+// the database names, read-only flags and default values it records, as
+// startup does. The file is read in full and checked before anything is
+// replaced.
+func (s *TrieServer) LoadSnapshot(path string) error {
+	info, err := s.readSnapshotFile(path, true)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return s.installSnapshots([]*snapshotInfo{info}, true, true, true)
+}
+
+// handleSave implements SAVE [db] and BGSAVE [db], which save one
+// database when given one and a per-database dbfilename is set, and
+// LASTSAVE. SAVE replies once the file is written; BGSAVE replies at once
+// and saves in the background, one at a time.
+func (s *TrieServer) handleSave(conn redcon.Conn, name string, cmd redcon.Command) {
+	if len(cmd.Args) > 2 || name == "LASTSAVE" && len(cmd.Args) != 1 {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "'")
+		return
+	}
+	st := &s.snapshots
+	if name == "LASTSAVE" {
+		st.mu.Lock()
+		last := st.lastSave
+		st.mu.Unlock()
+		if last.IsZero() {
+			last = s.started
+		}
+		conn.WriteInt64(last.Unix())
+		return
+	}
+
+	id := -1
+	if len(cmd.Args) == 2 {
+		var err error
+		if id, err = s.resolveDB(string(cmd.Args[1])); err != nil {
+			writeError(conn, err)
+			return
+		}
+		if !st.perDB() {
+			conn.WriteError("ERR saving one database needs a per-database dbfilename, one containing %d")
+			return
+		}
+	}
+	st.mu.Lock()
+	if st.inProgress {
+		st.mu.Unlock()
+		conn.WriteError("ERR Background save already in progress")
+		return
+	}
+	st.inProgress = name == "BGSAVE"
+	st.mu.Unlock()
+	if name == "SAVE" {
+		if err := s.save(id); err != nil {
+			writeError(conn, err)
+			return
+		}
+		writeOK(conn)
+		return
+	}
+	go func() {
+		s.save(id)
+		st.mu.Lock()
+		st.inProgress = false
+		st.mu.Unlock()
+	}()
+	conn.WriteString("Background saving started")
+}
+
+// handleRestoreDB implements RESTOREDB index|name path: load a snapshot of
+// a single database, such as one per-database file, into a new database
+// off to the side and swap it in as database index, leaving every other
+// database alone. The file's name and read-only flag are not applied: they
+// stay with the index. The path is read by the server, relative to dir,
+// and may not lead out of it. It replies with the number of prefixes
+// restored.
+func (s *TrieServer) handleRestoreDB(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for 'RESTOREDB'")
+		return
+	}
+	id, err := s.resolveDB(string(cmd.Args[1]))
+	if err == nil {
+		err = s.writable(id)
+	}
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	path, err := s.snapshots.inDir(string(cmd.Args[2]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	info, err := s.readSnapshotFile(path, true)
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	if len(info.dbs) != 1 {
+		conn.WriteError(fmt.Sprintf("ERR snapshot holds %d databases, RESTOREDB takes a snapshot of one", len(info.dbs)))
+		return
+	}
+	db := info.dbs[0].db
+	db.id = id
+	s.swapInDB(id, db)
+	s.auditDB(c, id, "RESTOREDB")
+	conn.WriteInt64(db.keyCount())
+}
+
+// handleSnapshotInfo implements SNAPSHOTINFO path: the header and sections
+// of a snapshot file, read and checksummed without loading it. The path is
+// read by the server, relative to dir, and may not lead out of it.
+func (s *TrieServer) handleSnapshotInfo(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for 'SNAPSHOTINFO'")
+		return
+	}
+	path, err := s.snapshots.inDir(string(cmd.Args[1]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	info, err := s.readSnapshotFile(path, false)
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	conn.WriteArray(18)
+	conn.WriteBulkString("format-version")
+	conn.WriteBulkString(fmt.Sprintf("%d.%d", info.major, info.minor))
+	conn.WriteBulkString("triedis-version")
+	conn.WriteBulkString(info.version)
+	conn.WriteBulkString("created")
+	conn.WriteInt64(info.created.Unix())
+	conn.WriteBulkString("checksum")
+	conn.WriteBulkString(fmt.Sprintf("%016x", info.checksum))
+	conn.WriteBulkString("compression")
+	conn.WriteBulkString(info.packing.codec)
+	conn.WriteBulkString("compression-level")
+	conn.WriteInt(info.packing.level)
+	conn.WriteBulkString("file-bytes")
+	conn.WriteInt64(info.packing.size)
+	conn.WriteBulkString("uncompressed-bytes")
+	conn.WriteInt64(info.packing.raw)
+	conn.WriteBulkString("dbs")
+	conn.WriteArray(len(info.dbs))
+	for _, sdb := range info.dbs {
+		conn.WriteArray(10)
+		conn.WriteBulkString("db")
+		conn.WriteInt(sdb.id)
+		conn.WriteBulkString("name")
+		if sdb.name != "" {
+			conn.WriteBulkString(sdb.name)
+		} else {
+			conn.WriteNull()
+		}
+		conn.WriteBulkString("readonly")
+		if sdb.readOnly {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+		conn.WriteBulkString("default")
+		if sdb.def != nil {
+			conn.WriteBulk(sdb.def)
+		} else {
+			conn.WriteNull()
+		}
+		conn.WriteBulkString("keys")
+		conn.WriteInt64(sdb.keys)
+	}
+}
+
+// registerSnapshotConfig exposes dir and dbfilename, which take effect
+// from the next save. Switching dbfilename between one file and one per
+// database leaves the old files in place; only those of the mode in force
+// are loaded at startup.
+func (s *TrieServer) registerSnapshotConfig() {
+	st := &s.snapshots
+	str := func(name string, v *string, check func(string) error) {
+		s.addConfig(name,
+			func() string { st.mu.Lock(); defer st.mu.Unlock(); return *v },
+			func(arg string) error {
+				if err := check(arg); err != nil {
+					return err
+				}
+				st.mu.Lock()
+				defer st.mu.Unlock()
+				*v = arg
+				return nil
+			})
+	}
+	str("dir", &st.dir, func(dir string) error {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return errors.New("no such directory")
+		}
+		return nil
+	})
+	str("dbfilename", &st.dbFilename, validDBFilename)
+	s.addConfig("rdbcompression", yesNoGet(&st.compression), yesNoSet(&st.compression))
+	s.addConfig("rdbcompression-level",
+		func() string { return strconv.FormatInt(st.compressionLevel.Load(), 10) },
+		func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || !validCompressionLevel(n) {
+				return errors.New("argument must be a compression level from 1 to 9")
+			}
+			st.compressionLevel.Store(n)
+			return nil
+		})
+}
+
+// validDBFilename reports why name cannot be a dbfilename, if it can't.
+// A %d in it makes each database save to its own file.
+func validDBFilename(name string) error {
+	if name == "" || name != filepath.Base(name) {
+		return errors.New("dbfilename can't be a path, just a filename")
+	}
+	if rest := strings.Replace(name, "%d", "", 1); strings.Contains(rest, "%") || strings.ContainsAny(name, "*?[") {
+		return errors.New("dbfilename may hold one %d, for the database index, and no other % or glob characters")
+	}
+	return nil
+}
+
+func (s *TrieServer) infoPersistence(b *strings.Builder) {
+	st := &s.snapshots
+	st.mu.Lock()
+	status := st.lastStatus
+	if status == "" {
+		status = "ok"
+	}
+	last := st.lastSave
+	if last.IsZero() {
+		last = s.started
+	}
+	inProgress := 0
+	if st.inProgress {
+		inProgress = 1
+	}
+	fmt.Fprintf(b, "rdb_bgsave_in_progress:%d\r\n", inProgress)
+	fmt.Fprintf(b, "rdb_last_save_time:%d\r\n", last.Unix())
+	fmt.Fprintf(b, "rdb_last_bgsave_status:%s\r\n", status)
+	fmt.Fprintf(b, "rdb_last_error:%s\r\n", st.lastError)
+	fmt.Fprintf(b, "rdb_last_save_duration_ms:%d\r\n", st.lastTook.Milliseconds())
+	fmt.Fprintf(b, "rdb_last_save_keys:%d\r\n", st.lastKeys)
+	fmt.Fprintf(b, "rdb_last_save_bytes:%d\r\n", st.lastSize)
+	fmt.Fprintf(b, "rdb_last_save_uncompressed_bytes:%d\r\n", st.lastRaw)
+	fmt.Fprintf(b, "rdb_saves:%d\r\n", st.saves)
+	fmt.Fprintf(b, "rdb_format_version:%d.%d\r\n", snapshotMajor, snapshotMinor)
+	mode := "combined"
+	if strings.Contains(st.dbFilename, "%d") {
+		mode = "per-db"
+	}
+	fmt.Fprintf(b, "rdb_file_mode:%s\r\n", mode)
+	fmt.Fprintf(b, "rdb_compression:%s\r\n", yesNoGet(&st.compression)())
+	st.mu.Unlock()
+	fmt.Fprintf(b, "aof_enabled:0\r\n")
+	s.infoJournal(b)
+	s.infoReload(b)
+}
+
+// handleWaitAOF implements WAITAOF numlocal numreplicas timeout for
+// clients that issue it after every batch. There is no append-only file
+// and no replication, so nothing can be waited for: asking for a local
+// fsync fails as it does in Redis with appendonly off, asking for
+// replicas fails rather than block until the timeout, and WAITAOF 0 0
+// replies [0, 0] at once. Snapshots are the only durability; SAVE
+// returns once one is on disk.
+func (s *TrieServer) handleWaitAOF(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		conn.WriteError("ERR wrong number of arguments for 'WAITAOF'")
+		return
+	}
+	var n [3]int64
+	for i := range n {
+		var ok bool
+		if n[i], ok = parseInteger(cmd.Args[1+i]); !ok {
+			writeError(conn, errNotInteger)
+			return
+		}
+	}
+	switch numLocal, numReplicas, timeout := n[0], n[1], n[2]; {
+	case timeout < 0:
+		conn.WriteError("ERR timeout is negative")
+	case numLocal > 0:
+		conn.WriteError("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	case numReplicas > 0:
+		conn.WriteError("ERR WAITAOF cannot wait for replicas, this server has none")
+	default:
+		conn.WriteArray(2)
+		conn.WriteInt(0)
+		conn.WriteInt(0)
+	}
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotFixture fills a fresh server with each kind of value, a named
+// database and a read-only one, saves it into a new dir, and returns the
+// snapshot's path.
+func snapshotFixture(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "dir", dir}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "ten"}, "OK"},
+		{[]string{"HSET", "192.0.2.0/24", "asn", "64500", "cc", "NO"}, "2"},
+		{[]string{"SADD", "2001:db8::/32", "tor", "vpn"}, "2"},
+		{[]string{"NAMEDB", "3", "geo"}, "OK"},
+		{[]string{"SELECT", "geo"}, "OK"},
+		{[]string{"SET", "172.16.0.0/12", "private"}, "OK"},
+		{[]string{"DBREADONLY", "geo", "yes"}, "OK"},
+		{[]string{"SAVE"}, "OK"},
+	})
+	return filepath.Join(dir, "dump.tdb")
+}
+
+// loadSnapshotFile loads the snapshot at path into s as at startup.
+func loadSnapshotFile(s *TrieServer, path string, names, readOnly bool) ([]*snapshotInfo, error) {
+	s.snapshots.dir, s.snapshots.dbFilename = filepath.Split(path)
+	_, infos, err := s.loadSnapshots(names, readOnly, true)
+	return infos, err
+}
+
+// infoField returns the value of field in r, a SNAPSHOTINFO reply.
+func infoField(r Reply, field string) Reply {
+	for i := 0; i+1 < len(r.Array); i += 2 {
+		if r.Array[i].Str == field {
+			return r.Array[i+1]
+		}
+	}
+	return Reply{}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := snapshotFixture(t)
+	s := newTestServer(t)
+	infos, err := loadSnapshotFile(s, path, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := infos[0]; info.major != snapshotMajor || info.minor != snapshotMinor {
+		t.Errorf("format %d.%d, want %d.%d", info.major, info.minor, snapshotMajor, snapshotMinor)
+	}
+	ss := newTestSession(t, s)
+	runSteps(t, ss, []replyStep{
+		{[]string{"GET", "10.1.2.3"}, "ten"},
+		{[]string{"HGET", "192.0.2.0/24", "cc"}, "NO"},
+		{[]string{"SMEMBERS", "2001:db8::/32"}, "[tor vpn]"},
+		{[]string{"DBREADONLY", "0"}, "0"},
+		{[]string{"DBREADONLY", "geo"}, "1"},
+		{[]string{"SELECT", "geo"}, "OK"},
+		{[]string{"GET", "172.16.1.1"}, "private"},
+		{[]string{"SET", "172.16.0.0/12", "x"}, "READONLY"},
+	})
+	if got, want := showDBs(t, ss), []string{"0:-:3", "3:geo:1"}; !slices.Equal(got, want) {
+		t.Errorf("SHOWDBS %q, want %q", got, want)
+	}
+
+	// Without names and readOnly, the data is loaded but not the flags.
+	s = newTestServer(t)
+	if _, err := loadSnapshotFile(s, path, false, false); err != nil {
+		t.Fatal(err)
+	}
+	runSteps(t, newTestSession(t, s), []replyStep{
+		{[]string{"SELECT", "geo"}, "ERR unknown database name"},
+		{[]string{"SELECT", "3"}, "OK"},
+		{[]string{"SET", "172.16.0.0/12", "x"}, "OK"},
+	})
+}
+
+func TestSnapshotRefused(t *testing.T) {
+	path := snapshotFixture(t)
+	good, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := func(f func(b []byte) []byte) []byte { return f(bytes.Clone(good)) }
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("10.0.0.0/8,a\n"))
+	zw.Close()
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"csv", []byte("10.0.0.0/8,a\n"), "not a triedis snapshot (no snapshot header)"},
+		{"gzip", gz.Bytes(), "not a triedis snapshot (gzip data)"},
+		{"empty", nil, "not a triedis snapshot"},
+		{"newer major version", edit(func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[len(snapshotMagic):], snapshotMajor+1)
+			return b
+		}), fmt.Sprintf("snapshot format %d.0 is newer", snapshotMajor+1)},
+		{"flipped byte", edit(func(b []byte) []byte {
+			b[len(b)-20] ^= 0xff
+			return b
+		}), "corrupt snapshot: db3"},
+		{"bad checksum", edit(func(b []byte) []byte {
+			b[len(b)-1] ^= 0xff
+			return b
+		}), "snapshot checksum mismatch"},
+		{"missing checksum", good[:len(good)-8], "corrupt snapshot: missing checksum"},
+		{"truncated", good[:len(good)/2], "corrupt snapshot: db0"},
+		{"trailing data", append(bytes.Clone(good), 0), "corrupt snapshot: data after the checksum"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "dump.tdb")
+			if err := os.WriteFile(p, tc.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			s := newTestServer(t)
+			ss := newTestSession(t, s)
+			mustDo(t, ss, "SET", "10.0.0.0/8", "kept")
+			_, err := loadSnapshotFile(s, p, true, true)
+			if err == nil || !strings.HasPrefix(err.Error(), p+": "+tc.wantErr) {
+				t.Fatalf("loadSnapshot = %v, want %q", err, tc.wantErr)
+			}
+			runSteps(t, ss, []replyStep{{[]string{"GET", "10.0.0.1"}, "kept"}})
+		})
+	}
+}
+
+func TestSnapshotCommands(t *testing.T) {
+	path := snapshotFixture(t)
+	dir := filepath.Dir(path)
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	mustDo(t, ss, "CONFIG", "SET", "dir", dir)
+	if err := os.WriteFile(filepath.Join(dir, "feed.csv"), []byte("10.0.0.0/8,a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	started := s.started.Unix()
+	runSteps(t, ss, []replyStep{
+		{[]string{"LASTSAVE"}, strconv.FormatInt(started, 10)},
+		{[]string{"SNAPSHOTINFO", "feed.csv"}, "ERR not a triedis snapshot"},
+		{[]string{"SNAPSHOTINFO", "nosuch.tdb"}, "ERR open"},
+		{[]string{"SNAPSHOTINFO", path}, "ERR path must be relative"},
+		{[]string{"SNAPSHOTINFO", "../dump.tdb"}, "ERR path must be relative"},
+		{[]string{"SNAPSHOTINFO"}, "ERR wrong number of arguments for 'SNAPSHOTINFO'"},
+		{[]string{"SAVE", "0", "1"}, "ERR wrong number of arguments for 'SAVE'"},
+		{[]string{"CONFIG", "SET", "dir", filepath.Join(dir, "nosuch")}, "ERR CONFIG SET failed"},
+		{[]string{"CONFIG", "SET", "dbfilename", "sub/dump.tdb"}, "ERR CONFIG SET failed"},
+		{[]string{"CONFIG", "SET", "dbfilename", ""}, "ERR CONFIG SET failed"},
+		{[]string{"CONFIG", "GET", "dbfilename"}, "[dbfilename dump.tdb]"},
+	})
+
+	r := mustDo(t, ss, "SNAPSHOTINFO", "dump.tdb")
+	if got, want := infoField(r, "format-version").Str, fmt.Sprintf("%d.%d", snapshotMajor, snapshotMinor); got != want {
+		t.Errorf("format-version %q, want %q", got, want)
+	}
+	if got := infoField(r, "dbs").String(); got != "[[db 0 name nil readonly 0 default nil keys 3] [db 3 name geo readonly 1 default nil keys 1]]" {
+		t.Errorf("dbs %s", got)
+	}
+
+	// BGSAVE writes the new dbfilename in the background.
+	mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+	mustDo(t, ss, "CONFIG", "SET", "dbfilename", "next.tdb")
+	if got := mustDo(t, ss, "BGSAVE").Str; got != "Background saving started" {
+		t.Fatalf("BGSAVE = %q", got)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		s.snapshots.mu.Lock()
+		busy := s.snapshots.inProgress
+		s.snapshots.mu.Unlock()
+		if !busy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("BGSAVE did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r = mustDo(t, ss, "SNAPSHOTINFO", "next.tdb")
+	if got := infoField(r, "dbs").String(); got != "[[db 0 name nil readonly 0 default nil keys 1]]" {
+		t.Errorf("dbs after BGSAVE %s", got)
+	}
+	if got := mustDo(t, ss, "LASTSAVE").Int; got < started {
+		t.Errorf("LASTSAVE %d before the server started at %d", got, started)
+	}
+	info := infoFields(mustDo(t, ss, "INFO", "persistence").Str)
+	for field, want := range map[string]string{"rdb_saves": "1", "rdb_last_bgsave_status": "ok", "rdb_last_save_keys": "1", "rdb_bgsave_in_progress": "0"} {
+		if info[field] != want {
+			t.Errorf("INFO %s = %q, want %q", field, info[field], want)
+		}
+	}
+}
+
+func TestPerDBSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "dir", dir}, "OK"},
+		{[]string{"SAVE", "0"}, "ERR saving one database needs a per-database dbfilename"},
+		{[]string{"CONFIG", "SET", "dbfilename", "db-%d-%d.tdb"}, "ERR CONFIG SET failed"},
+		{[]string{"CONFIG", "SET", "dbfilename", "db-*.tdb"}, "ERR CONFIG SET failed"},
+		{[]string{"CONFIG", "SET", "dbfilename", "db-%d.tdb"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "zero"}, "OK"},
+		{[]string{"NAMEDB", "2", "geo"}, "OK"},
+		{[]string{"SELECT", "geo"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "two"}, "OK"},
+		{[]string{"SADD", "192.0.2.0/24", "tor"}, "1"},
+		{[]string{"SAVE"}, "OK"},
+		{[]string{"SAVE", "nosuch"}, "ERR unknown database name"},
+	})
+	if got := infoField(mustDo(t, ss, "SNAPSHOTINFO", "db-2.tdb"), "dbs").String(); got != "[[db 2 name geo readonly 0 default nil keys 2]]" {
+		t.Errorf("db-2.tdb holds %s", got)
+	}
+	// Emptying a database rewrites its file on the next full save, while
+	// SAVE db writes that one file alone.
+	runSteps(t, ss, []replyStep{
+		{[]string{"FLUSHDB"}, "OK"},
+		{[]string{"SELECT", "0"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "changed"}, "OK"},
+		{[]string{"SAVE", "0"}, "OK"},
+	})
+	if got := infoField(mustDo(t, ss, "SNAPSHOTINFO", "db-2.tdb"), "dbs").String(); got != "[[db 2 name geo readonly 0 default nil keys 2]]" {
+		t.Errorf("db-2.tdb after SAVE 0 holds %s", got)
+	}
+	mustDo(t, ss, "SAVE")
+	if got := infoField(mustDo(t, ss, "SNAPSHOTINFO", "db-2.tdb"), "dbs").String(); got != "[[db 2 name geo readonly 0 default nil keys 0]]" {
+		t.Errorf("db-2.tdb after emptying holds %s", got)
+	}
+
+	s := newTestServer(t)
+	s.snapshots.dir, s.snapshots.dbFilename = dir, "db-%d.tdb"
+	found, _, err := s.loadSnapshots(true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Errorf("loaded %q, want db-0.tdb and db-2.tdb", found)
+	}
+	runSteps(t, newTestSession(t, s), []replyStep{
+		{[]string{"GET", "10.1.2.3"}, "changed"},
+		{[]string{"SELECT", "geo"}, "OK"},
+		{[]string{"DBSIZE"}, "0"},
+	})
+
+	// A combined snapshot among the per-database files fails the load.
+	if err := os.Rename(filepath.Join(dir, "db-0.tdb"), filepath.Join(dir, "db-5.tdb")); err != nil {
+		t.Fatal(err)
+	}
+	s = newTestServer(t)
+	s.snapshots.dir, s.snapshots.dbFilename = dir, "db-%d.tdb"
+	if _, _, err := s.loadSnapshots(true, true, true); err == nil || !strings.Contains(err.Error(), "not a snapshot of db5 alone") {
+		t.Errorf("loadSnapshots with a misplaced file = %v", err)
+	}
+}
+
+func TestRestoreDB(t *testing.T) {
+	path := snapshotFixture(t)
+	dir := filepath.Dir(path)
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "dir", dir}, "OK"},
+		{[]string{"RESTOREDB", "0", "dump.tdb"}, "ERR snapshot holds 2 databases"},
+		{[]string{"CONFIG", "SET", "dbfilename", "db-%d.tdb"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "saved"}, "OK"},
+		{[]string{"SAVE", "0"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "changed"}, "OK"},
+		{[]string{"SELECT", "1"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "db1"}, "OK"},
+		{[]string{"RESTOREDB", "0", path}, "ERR path must be relative"},
+		{[]string{"RESTOREDB", "0", "../" + filepath.Base(dir) + "/db-0.tdb"}, "ERR path must be relative"},
+		{[]string{"RESTOREDB", "0", "nosuch.tdb"}, "ERR open"},
+		{[]string{"RESTOREDB", "0", "db-0.tdb"}, "1"},
+		{[]string{"GET", "10.1.2.3"}, "db1"}, // other databases are left alone
+		{[]string{"SELECT", "0"}, "OK"},
+		{[]string{"GET", "10.1.2.3"}, "saved"},
+		{[]string{"NAMEDB", "4", "copy"}, "OK"},
+		{[]string{"RESTOREDB", "copy", "db-0.tdb"}, "1"},
+		{[]string{"SELECT", "copy"}, "OK"},
+		{[]string{"GET", "10.1.2.3"}, "saved"},
+		{[]string{"DBREADONLY", "copy", "yes"}, "OK"},
+		{[]string{"RESTOREDB", "copy", "db-0.tdb"}, "READONLY"},
+		{[]string{"RESTOREDB", "nosuch", "db-0.tdb"}, "ERR unknown database name"},
+		{[]string{"RESTOREDB", "0"}, "ERR wrong number of arguments for 'RESTOREDB'"},
+	})
+}
+
+// BenchmarkWriteDuringSave measures SET latency on a database of 1M
+// prefixes while nothing else runs and while it is saved over and over,
+// reporting the 99th percentile and the slowest alongside the mean. It
+// discards the log line of each save, which would garble the results.
+func BenchmarkWriteDuringSave(b *testing.B) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	s := newTestServer(b)
+	s.snapshots.dir = b.TempDir()
+	r := rand.New(rand.NewPCG(11, 12))
+	db := s.getDB(0)
+	keys := make([]string, 1<<20)
+	v := stringValue([]byte("AS64500"))
+	for i := range keys {
+		p := randomPrefix(r, 4, 16)
+		db.store(p, v, true)
+		keys[i] = p.String()
+	}
+	ss := newTestSession(b, s)
+	for _, saving := range []bool{false, true} {
+		name := "idle"
+		if saving {
+			name = "saving"
+		}
+		b.Run(name, func(b *testing.B) {
+			stop, done := make(chan struct{}), make(chan int)
+			go func() {
+				saves := 0
+				for saving {
+					select {
+					case <-stop:
+						done <- saves
+						return
+					default:
+					}
+					if err := s.save(0); err != nil {
+						b.Error(err)
+					}
+					saves++
+				}
+				done <- saves
+			}()
+			lat := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for i := range b.N {
+				start := time.Now()
+				mustDo(b, ss, "SET", keys[r.IntN(len(keys))], "AS64501")
+				lat[i] = time.Since(start)
+			}
+			b.StopTimer()
+			close(stop)
+			saves := <-done
+			slices.Sort(lat)
+			b.ReportMetric(float64(lat[len(lat)*99/100].Nanoseconds()), "p99-ns")
+			b.ReportMetric(float64(lat[len(lat)-1].Nanoseconds()), "max-ns")
+			b.ReportMetric(float64(saves), "saves")
+		})
+	}
+}
+
+func TestWaitAOF(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"WAITAOF", "0", "0", "0"}, "[0 0]"},
+		{[]string{"WAITAOF", "0", "0", "100"}, "[0 0]"},
+		{[]string{"WAITAOF", "1", "0", "100"}, "ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled."},
+		{[]string{"WAITAOF", "0", "1", "0"}, "ERR WAITAOF cannot wait for replicas"},
+		{[]string{"WAITAOF", "0", "0", "-1"}, "ERR timeout is negative"},
+		{[]string{"WAITAOF", "0", "x", "0"}, "ERR value is not an integer or out of range"},
+		{[]string{"WAITAOF", "0", "0"}, "ERR wrong number of arguments for 'WAITAOF'"},
+	})
+	if got := infoFields(mustDo(t, ss, "INFO", "persistence").Str)["aof_enabled"]; got != "0" {
+		t.Errorf("aof_enabled = %q, want 0", got)
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+)
+
+// stage is a database being built by LOADSTAGE. It is not in the server's
+// database map, so no client can SELECT it or see it half loaded.
+type stage struct {
+	mu sync.Mutex // held while loading or committing
+	db *database
+}
+
+// stages are the staged loads in progress, by database id.
+type stages struct {
+	mu   sync.Mutex
+	byID map[int]*stage
+}
+
+// get returns the stage for id, starting one if create is set.
+func (st *stages) get(s *TrieServer, id int, create bool) *stage {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if g := st.byID[id]; g != nil || !create {
+		return g
+	}
+	if st.byID == nil {
+		st.byID = make(map[int]*stage)
+	}
+	g := &stage{db: newDatabase(id, &s.store)}
+	st.byID[id] = g
+	return g
+}
+
+// remove forgets the stage for id if it is still g.
+func (st *stages) remove(id int, g *stage) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.byID[id] == g {
+		delete(st.byID, id)
+	}
+}
+
+// handleStage implements staged loading:
+//
+//	LOADSTAGE db path [FORMAT csv|tsv|json|mrt]  load a file, as IMPORT does, into db's stage
+//	COMMITSTAGE db                               make the stage db, discarding the old data
+//	ABORTSTAGE db                                discard the stage
+//
+// The path is relative to dir and may not lead out of it. Several LOADSTAGEs may fill one stage; later lines replace earlier
+// ones. COMMITSTAGE swaps the whole database in one step, so readers see
+// either all of the old data or all of the new. The access counters carry
+// over.
+func (s *TrieServer) handleStage(conn redcon.Conn, c *client, name string, cmd redcon.Command) {
+	if name == "LOADSTAGE" && len(cmd.Args) != 3 && len(cmd.Args) != 5 || name != "LOADSTAGE" && len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "'")
+		return
+	}
+	id, err := s.resolveDB(string(cmd.Args[1]))
+	if err == nil && name != "ABORTSTAGE" {
+		err = s.writable(id)
+	}
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+
+	switch name {
+	case "LOADSTAGE":
+		path, err := s.snapshots.inDir(string(cmd.Args[2]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		opts := importOptions{path: path, conflict: conflictReplace}
+		opts.format = formatFor(opts.path)
+		if len(cmd.Args) == 5 {
+			if !strings.EqualFold(string(cmd.Args[3]), "FORMAT") {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			opts.format = strings.ToLower(string(cmd.Args[4]))
+			if err := validImportFormat(opts.format); err != nil {
+				writeError(conn, err)
+				return
+			}
+		}
+		g := s.stages.get(s, id, true)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		res, err := g.db.importFile(opts)
+		if err != nil {
+			if g.db.keyCount() == 0 {
+				s.stages.remove(id, g) // don't leave an empty stage behind
+			}
+			writeError(conn, err)
+			return
+		}
+		writeImportResult(conn, res, memField{"staged-keys4", g.db.keys4.Load()},
+			memField{"staged-keys6", g.db.keys6.Load()}, memField{"staged-memory", g.db.datasetBytes()})
+
+	case "COMMITSTAGE":
+		g := s.stages.get(s, id, false)
+		if g == nil {
+			conn.WriteError(fmt.Sprintf("ERR no staged load for db%d", id))
+			return
+		}
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if err := s.commitStage(id, g); err != nil {
+			writeError(conn, err)
+			return
+		}
+		s.auditDB(c, id, name)
+		writeOK(conn)
+
+	case "ABORTSTAGE":
+		g := s.stages.get(s, id, false)
+		if g == nil {
+			conn.WriteInt(0)
+			return
+		}
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if s.stages.get(s, id, false) != g {
+			conn.WriteInt(0) // committed or aborted while we waited
+			return
+		}
+		s.stages.remove(id, g)
+		conn.WriteInt(1)
+	}
+}
+
+// errStageGone is returned when a stage was committed or aborted while
+// the caller waited for it.
+var errStageGone = errors.New("the staged load was committed or aborted meanwhile")
+
+// commitStage swaps g, which the caller holds, in as database id.
+func (s *TrieServer) commitStage(id int, g *stage) error {
+	if s.stages.get(s, id, false) != g {
+		return errStageGone
+	}
+	s.swapInDB(id, g.db)
+	s.stages.remove(id, g)
+	return nil
+}
+
+// swapInDB replaces database id with db, built off to the side, carrying
+// over the access counters and counting the swap as a write.
+func (s *TrieServer) swapInDB(id int, db *database) {
+	if old := s.existingDB(id); old != nil {
+		db.hits.add(0, old.hits.load())
+		db.misses.add(0, old.misses.load())
+		db.writes.add(0, old.writes.load())
+	}
+	db.writes.add(0, 1)
+	s.replaceDB(id, db)
+}
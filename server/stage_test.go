@@ -0,0 +1,85 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStagedLoad(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for name, content := range map[string]string{
+		"next.csv":   "10.0.0.0/8,new\n192.0.2.0/24,b\n",
+		"more.tsv":   "2001:db8::/32\tv6\n10.0.0.0/8\tnewer\n",
+		"broken.csv": "not-a-prefix,x\n",
+	} {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outside := filepath.Join(t.TempDir(), "next.csv")
+	if err := os.WriteFile(outside, []byte("198.51.100.0/24,c\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t)
+	ss, reader := newTestSession(t, s), newTestSession(t, s)
+	mustDo(t, ss, "NAMEDB", "0", "live")
+	mustDo(t, ss, "SET", "10.0.0.0/8", "old")
+	mustDo(t, ss, "SET", "172.16.0.0/12", "gone after the commit")
+	mustDo(t, reader, "GET", "10.1.2.3") // a hit that carries over
+
+	runSteps(t, ss, []replyStep{
+		{[]string{"COMMITSTAGE", "live"}, "ERR no staged load for db0"},
+		{[]string{"ABORTSTAGE", "live"}, "0"},
+		{[]string{"LOADSTAGE", "live", outside}, "ERR path must be relative"},
+		{[]string{"LOADSTAGE", "live", "../next.csv"}, "ERR path must be relative"},
+		{[]string{"LOADSTAGE", "live", "missing.csv"}, "ERR open missing.csv"},
+		{[]string{"COMMITSTAGE", "live"}, "ERR no staged load for db0"}, // no empty stage left behind
+		{[]string{"LOADSTAGE", "live", "next.csv", "FORMAT", "xml"}, "ERR FORMAT must be csv, tsv, json or mrt"},
+		{[]string{"LOADSTAGE", "live", "next.csv", "AS", "csv"}, "ERR syntax error"},
+		{[]string{"LOADSTAGE", "live"}, "ERR wrong number of arguments for 'LOADSTAGE'"},
+		{[]string{"LOADSTAGE", "nosuch", "next.csv"}, "ERR unknown database name"},
+	})
+	r := mustDo(t, ss, "LOADSTAGE", "live", "next.csv")
+	if counts, _ := importFields(t, r); counts["inserted"] != 2 || counts["staged-keys4"] != 2 || counts["staged-memory"] <= 0 {
+		t.Errorf("LOADSTAGE next.csv = %v", counts)
+	}
+	r = mustDo(t, ss, "LOADSTAGE", "0", "more.tsv")
+	if counts, _ := importFields(t, r); counts["inserted"] != 1 || counts["replaced"] != 1 || counts["staged-keys4"] != 2 || counts["staged-keys6"] != 1 {
+		t.Errorf("LOADSTAGE more.tsv = %v", counts)
+	}
+	// Until the commit, everyone sees the live data.
+	runSteps(t, reader, []replyStep{
+		{[]string{"GET", "10.1.2.3"}, "old"},
+		{[]string{"GET", "2001:db8::1"}, "nil"},
+		{[]string{"DBSIZE"}, "2"},
+	})
+	runSteps(t, ss, []replyStep{
+		{[]string{"COMMITSTAGE", "live"}, "OK"},
+		{[]string{"COMMITSTAGE", "live"}, "ERR no staged load for db0"},
+	})
+	runSteps(t, reader, []replyStep{
+		{[]string{"GET", "10.1.2.3"}, "newer"},
+		{[]string{"GET", "2001:db8::1"}, "v6"},
+		{[]string{"GET", "172.16.0.1"}, "nil"},
+		{[]string{"DBSIZE"}, "3"},
+	})
+	if st := dbStats(t, ss, "live"); st["hits"] != 4 || st["misses"] != 2 {
+		t.Errorf("DBSTATS after the commit = %v, want the counters carried over", st)
+	}
+
+	// A stage can also be thrown away.
+	r = mustDo(t, ss, "LOADSTAGE", "1", "more.tsv")
+	if counts, _ := importFields(t, r); counts["staged-keys4"] != 1 || counts["staged-keys6"] != 1 {
+		t.Errorf("LOADSTAGE 1 more.tsv = %v", counts)
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"ABORTSTAGE", "1"}, "1"},
+		{[]string{"COMMITSTAGE", "1"}, "ERR no staged load for db1"},
+		{[]string{"LOADSTAGE", "1", "broken.csv"}, "[lines 1 inserted 0 replaced 0 skipped 0 errors 1 first-errors [line 1: invalid IP/CIDR] staged-keys4 0 staged-keys6 0 staged-memory 0]"},
+		{[]string{"ABORTSTAGE", "1"}, "1"},
+	})
+	if got := showDBs(t, ss, "ALL"); len(got) != 1 {
+		t.Errorf("aborted stages left databases: SHOWDBS ALL = %q", got)
+	}
+}
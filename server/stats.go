@@ -0,0 +1,334 @@
+package server
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in microseconds, of the per-command
+// latency histogram. A final +Inf bucket follows them.
+var latencyBuckets = [...]int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 25000, 100000, 1000000}
+
+// commandStat accumulates calls and latency for one command.
+type commandStat struct {
+	calls    atomic.Int64
+	nanos    atomic.Int64 // total time spent
+	rejected atomic.Int64 // refused before running, e.g. NOPERM
+	buckets  [len(latencyBuckets) + 1]atomic.Int64
+	latency  latencySketch
+}
+
+func (st *commandStat) record(d time.Duration) {
+	st.calls.Add(1)
+	st.nanos.Add(int64(d))
+	us := float64(d) / float64(time.Microsecond)
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return us <= float64(latencyBuckets[i]) })
+	st.buckets[i].Add(1)
+	st.latency.record(d)
+}
+
+func (st *commandStat) reset() {
+	st.calls.Store(0)
+	st.nanos.Store(0)
+	st.rejected.Store(0)
+	for i := range st.buckets {
+		st.buckets[i].Store(0)
+	}
+	st.latency.reset()
+}
+
+// latencySubBits is log2 of how many slots a latencySketch splits each
+// power of two into, which bounds a percentile's error to 1/8 of it.
+const latencySubBits = 3
+
+// latencySlots covers durations up to about 17 minutes, in slots of 1ns
+// below 8ns and an eighth of their power of two above. Longer ones go in
+// the last slot.
+const latencySlots = (41 - latencySubBits) << latencySubBits
+
+// latencyPercentiles are what INFO latencystats and the metrics endpoint
+// report for every command.
+var latencyPercentiles = [...]float64{50, 99, 99.9}
+
+// latencySketch is an HDR-style log-linear histogram of durations in
+// nanoseconds. It takes fixed memory, and recording a duration costs a
+// bit count and one atomic add.
+type latencySketch struct {
+	counts [latencySlots]atomic.Int64
+}
+
+func latencySlot(ns uint64) int {
+	if ns < 1<<latencySubBits {
+		return int(ns)
+	}
+	e := bits.Len64(ns) - 1
+	i := (e-latencySubBits+1)<<latencySubBits | int(ns>>(e-latencySubBits))&(1<<latencySubBits-1)
+	return min(i, latencySlots-1)
+}
+
+// latencySlotMax returns the longest duration slot i holds.
+func latencySlotMax(i int) time.Duration {
+	if i < 1<<latencySubBits {
+		return time.Duration(i)
+	}
+	if i == latencySlots-1 {
+		return math.MaxInt64
+	}
+	e := i>>latencySubBits + latencySubBits - 1
+	low := uint64(1<<latencySubBits|i&(1<<latencySubBits-1)) << (e - latencySubBits)
+	return time.Duration(low + 1<<(e-latencySubBits) - 1)
+}
+
+func (ls *latencySketch) record(d time.Duration) {
+	ls.counts[latencySlot(uint64(max(d, 0)))].Add(1)
+}
+
+func (ls *latencySketch) reset() {
+	for i := range ls.counts {
+		ls.counts[i].Store(0)
+	}
+}
+
+// percentiles returns the duration at or below which each of ps, given
+// in percent, of the recorded durations fall, rounded up to the top of
+// its slot as HDR histograms do; ok is false if nothing was recorded.
+func (ls *latencySketch) percentiles(ps []float64) (out []time.Duration, ok bool) {
+	var counts [latencySlots]int64
+	var total int64
+	for i := range counts {
+		counts[i] = ls.counts[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return nil, false
+	}
+	out = make([]time.Duration, len(ps))
+	for j, p := range ps {
+		rank := max(int64(math.Ceil(p/100*float64(total))), 1)
+		var cum int64
+		for i, n := range counts {
+			if cum += n; cum >= rank {
+				out[j] = latencySlotMax(i)
+				break
+			}
+		}
+	}
+	return out, true
+}
+
+// counterStripes is the number of slots in a stripedCounter.
+const counterStripes = 16
+
+// stripedCounter spreads a hot counter over cache-line-padded slots so
+// connections on different cores do not contend on one word. Writers pick
+// a slot with a stable hint such as their connection id; reads sum them.
+type stripedCounter struct {
+	slots [counterStripes]struct {
+		n atomic.Int64
+		_ [56]byte
+	}
+}
+
+func (c *stripedCounter) add(hint uint64, n int64) {
+	c.slots[hint%counterStripes].n.Add(n)
+}
+
+func (c *stripedCounter) load() int64 {
+	var n int64
+	for i := range c.slots {
+		n += c.slots[i].n.Load()
+	}
+	return n
+}
+
+func (c *stripedCounter) reset() {
+	for i := range c.slots {
+		c.slots[i].n.Store(0)
+	}
+}
+
+// metricSamples is how many samples an instantMetric averages, as in
+// Redis's STATS_METRIC_SAMPLES.
+const metricSamples = 16
+
+// instantMetric turns a monotonically increasing total into a recent
+// per-second rate. It is sampled on a fixed period and reports the mean
+// over the last metricSamples samples, so the figure reflects the last
+// second and a half or so rather than the lifetime average.
+type instantMetric struct {
+	mu        sync.Mutex
+	lastTotal int64
+	lastTime  time.Time
+	samples   [metricSamples]float64
+	next      int
+}
+
+func (m *instantMetric) sample(total int64, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.lastTime.IsZero() {
+		if elapsed := now.Sub(m.lastTime).Seconds(); elapsed > 0 {
+			m.samples[m.next] = float64(total-m.lastTotal) / elapsed
+			m.next = (m.next + 1) % metricSamples
+		}
+	}
+	m.lastTotal, m.lastTime = total, now
+}
+
+func (m *instantMetric) perSecond() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sum float64
+	for _, v := range m.samples {
+		sum += v
+	}
+	return sum / metricSamples
+}
+
+// serverStats are the counters INFO stats reports.
+type serverStats struct {
+	connections   atomic.Int64 // connections accepted
+	rejectedConns atomic.Int64 // connections refused by maxclients or maxclients-per-ip
+	rejectedPerIP atomic.Int64 // connections refused by maxclients-per-ip
+	outputClosed  atomic.Int64 // clients closed by client-output-buffer-limit
+	abortedCmds   atomic.Int64 // commands stopped by their execution budget or CLIENT KILL
+	netInput      stripedCounter
+	netOutput     stripedCounter
+	expiredKeys   atomic.Int64 // prefixes expireCron deleted
+	evictedKeys   atomic.Int64 // prefixes dropped to stay under maxmemory
+	peakMemory    atomic.Int64 // highest heap allocation seen
+
+	opsPerSec    instantMetric
+	inputPerSec  instantMetric
+	outputPerSec instantMetric
+}
+
+// resetStats implements CONFIG RESETSTAT: every counter INFO and the
+// metrics endpoint report goes back to zero. Gauges such as key counts and
+// connected clients are left alone.
+func (s *TrieServer) resetStats() {
+	for _, c := range s.cmdStats {
+		c.reset()
+	}
+	st := &s.stats
+	st.connections.Store(0)
+	st.rejectedConns.Store(0)
+	st.rejectedPerIP.Store(0)
+	st.outputClosed.Store(0)
+	st.abortedCmds.Store(0)
+	st.netInput.reset()
+	st.netOutput.reset()
+	for _, db := range s.databases() {
+		db.resetStats()
+	}
+	st.expiredKeys.Store(0)
+	st.evictedKeys.Store(0)
+	st.peakMemory.Store(heapAlloc())
+	s.idleClosed.Store(0)
+	s.auditLog.dropped.Store(0)
+}
+
+// statsCron samples the instantaneous rates every 100ms, like Redis's
+// serverCron does.
+func (s *TrieServer) statsCron() {
+	for now := range time.Tick(100 * time.Millisecond) {
+		tickAccessClock(now)
+		s.observeMemory(heapAlloc())
+		s.stats.opsPerSec.sample(s.cmdStats.totalCalls(), now)
+		s.stats.inputPerSec.sample(s.stats.netInput.load(), now)
+		s.stats.outputPerSec.sample(s.stats.netOutput.load(), now)
+	}
+}
+
+// peakSlots is how many seconds a recentPeak remembers, matching Redis's
+// CLIENTS_PEAK_MEM_USAGE_SLOTS.
+const peakSlots = 8
+
+// recentPeak tracks the largest value observed over the last peakSlots
+// seconds using one slot per second, so it decays without a timer.
+type recentPeak struct {
+	slots [peakSlots]struct {
+		sec atomic.Int64 // unix second the slot belongs to
+		max atomic.Int64
+	}
+}
+
+func (p *recentPeak) observe(n int64, now time.Time) {
+	sec := now.Unix()
+	slot := &p.slots[sec%peakSlots]
+	if slot.sec.Load() != sec {
+		// A concurrent observer may lose its value to this reset; the
+		// figure is advisory only.
+		slot.sec.Store(sec)
+		slot.max.Store(0)
+	}
+	for {
+		cur := slot.max.Load()
+		if n <= cur || slot.max.CompareAndSwap(cur, n) {
+			return
+		}
+	}
+}
+
+// value returns the peak over the window ending now.
+func (p *recentPeak) value(now time.Time) int64 {
+	sec := now.Unix()
+	var peak int64
+	for i := range p.slots {
+		if sec-p.slots[i].sec.Load() < peakSlots {
+			peak = max(peak, p.slots[i].max.Load())
+		}
+	}
+	return peak
+}
+
+// commandStats holds one commandStat per command in commandTable. It is
+// built once and never modified, so the command path reads it without a
+// lock and only touches atomics.
+type commandStats map[string]*commandStat
+
+func newCommandStats() commandStats {
+	st := make(commandStats, len(commandTable))
+	for name := range commandTable {
+		st[name] = &commandStat{}
+	}
+	return st
+}
+
+// record accounts one execution of name. Unknown commands are ignored.
+func (st commandStats) record(name string, d time.Duration) {
+	if c := st[name]; c != nil {
+		c.record(d)
+	}
+}
+
+// reject accounts one refused call of name.
+func (st commandStats) reject(name string) {
+	if c := st[name]; c != nil {
+		c.rejected.Add(1)
+	}
+}
+
+// totalCalls returns the number of commands processed. Summing the
+// per-command counters on read keeps the command path to one increment.
+func (st commandStats) totalCalls() int64 {
+	var n int64
+	for _, c := range st {
+		n += c.calls.Load()
+	}
+	return n
+}
+
+// names returns the command names in a stable order.
+func (st commandStats) names() []string {
+	names := make([]string, 0, len(st))
+	for name := range st {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
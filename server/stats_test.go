@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"math"
+	"math/rand/v2"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStripedCounter(t *testing.T) {
+	var c stripedCounter
+	for i, hint := range []uint64{0, 1, 15, 16, 17, 1 << 40} {
+		c.add(hint, int64(i+1))
+	}
+	if got := c.load(); got != 21 {
+		t.Errorf("load() = %d, want 21", got)
+	}
+	c.reset()
+	if got := c.load(); got != 0 {
+		t.Errorf("load() after reset = %d, want 0", got)
+	}
+}
+
+func TestInstantMetric(t *testing.T) {
+	base := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		name   string
+		totals []int64 // sampled every 100ms
+		want   float64
+	}{
+		{"no samples", nil, 0},
+		{"one sample", []int64{500}, 0},
+		{"steady", []int64{0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 110, 120, 130, 140, 150, 160}, 100},
+		{"burst then idle", append([]int64{0}, slices.Repeat([]int64{1000}, 18)...), 0},
+	} {
+		var m instantMetric
+		for i, total := range tc.totals {
+			m.sample(total, base.Add(time.Duration(i)*100*time.Millisecond))
+		}
+		if got := m.perSecond(); got != tc.want {
+			t.Errorf("%s: perSecond() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestInfoStatsTraffic(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveTest(t, s)
+	ss := newTestSession(t, s)
+	before := infoFields(mustDo(t, ss, "INFO", "stats").Str)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	in := []byte("SET 10.0.0.0/8 a\r\nGET 10.1.2.3\r\n")
+	if _, err := conn.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	var out int
+	for range 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		out += len(line)
+		if line[0] == '$' {
+			line, _ = r.ReadString('\n')
+			out += len(line)
+		}
+	}
+
+	after := infoFields(mustDo(t, ss, "INFO", "stats").Str)
+	for _, tc := range []struct {
+		field string
+		want  int
+	}{
+		{"total_connections_received", 1},
+		{"total_commands_processed", 3}, // SET, GET and the first INFO
+		{"total_net_input_bytes", len(in)},
+		{"total_net_output_bytes", out},
+		{"rejected_connections", 0},
+	} {
+		b, _ := strconv.Atoi(before[tc.field])
+		a, err := strconv.Atoi(after[tc.field])
+		if err != nil || a-b != tc.want {
+			t.Errorf("%s went from %s to %s, want an increase of %d", tc.field, before[tc.field], after[tc.field], tc.want)
+		}
+	}
+	for _, field := range []string{"instantaneous_ops_per_sec", "instantaneous_input_kbps", "instantaneous_output_kbps", "expired_keys", "evicted_keys", "keyspace_hits", "keyspace_misses"} {
+		if _, ok := after[field]; !ok {
+			t.Errorf("INFO stats lacks %s", field)
+		}
+	}
+}
+
+func TestLatencySketch(t *testing.T) {
+	for i := 1; i < latencySlots; i++ {
+		if latencySlotMax(i) <= latencySlotMax(i-1) {
+			t.Fatalf("slot %d tops out at %v, slot %d at %v", i, latencySlotMax(i), i-1, latencySlotMax(i-1))
+		}
+	}
+	var empty latencySketch
+	if _, ok := empty.percentiles([]float64{50}); ok {
+		t.Error("percentiles of an empty sketch reported ok")
+	}
+	r := rand.New(rand.NewPCG(5, 6))
+	for _, tc := range []struct {
+		name string
+		draw func() time.Duration
+	}{
+		{"constant", func() time.Duration { return 250 * time.Microsecond }},
+		{"tiny", func() time.Duration { return time.Duration(r.IntN(8)) }},
+		{"uniform", func() time.Duration { return time.Duration(r.Int64N(int64(10 * time.Millisecond))) }},
+		{"exponential", func() time.Duration { return time.Duration(r.ExpFloat64() * float64(200*time.Microsecond)) }},
+		{"beyond the last slot", func() time.Duration { return time.Hour }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ls latencySketch
+			ds := make([]time.Duration, 10000)
+			for i := range ds {
+				ds[i] = tc.draw()
+				ls.record(ds[i])
+			}
+			slices.Sort(ds)
+			ps := []float64{50, 99, 99.9}
+			got, ok := ls.percentiles(ps)
+			if !ok {
+				t.Fatal("percentiles reported nothing recorded")
+			}
+			for i, p := range ps {
+				exact := ds[int(math.Ceil(p/100*float64(len(ds))))-1]
+				limit := max(exact+exact/8, exact+1)
+				if exact > latencySlotMax(latencySlots-2) { // in the last, open-ended slot
+					limit = latencySlotMax(latencySlots - 1)
+				}
+				if got[i] < exact || got[i] > limit {
+					t.Errorf("p%v = %v, exact %v; want it within an eighth above", p, got[i], exact)
+				}
+			}
+			ls.reset()
+			if _, ok := ls.percentiles(ps); ok {
+				t.Error("percentiles after reset reported ok")
+			}
+		})
+	}
+}
+
+func TestInfoLatencystats(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+	mustDo(t, ss, "GET", "10.0.0.1")
+	line := regexp.MustCompile(`^p50=\d+\.\d{3},p99=\d+\.\d{3},p99\.9=\d+\.\d{3}$`)
+	for _, tc := range []struct {
+		section string
+		want    []string // fields with latencies
+	}{
+		{"", nil},
+		{"latencystats", []string{"latency_percentiles_usec_get", "latency_percentiles_usec_info", "latency_percentiles_usec_set"}},
+		{"all", []string{"latency_percentiles_usec_get", "latency_percentiles_usec_info", "latency_percentiles_usec_set"}},
+	} {
+		args := []string{"INFO"}
+		if tc.section != "" {
+			args = append(args, tc.section)
+		}
+		var got []string
+		for k, v := range infoFields(mustDo(t, ss, args...).Str) {
+			if strings.HasPrefix(k, "latency_percentiles_usec_") {
+				got = append(got, k)
+				if !line.MatchString(v) {
+					t.Errorf("INFO %s: %s:%s", tc.section, k, v)
+				}
+			}
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("INFO %s reports latencies of %q, want %q", tc.section, got, tc.want)
+		}
+	}
+	mustDo(t, ss, "CONFIG", "RESETSTAT")
+	if got := mustDo(t, ss, "INFO", "latencystats").Str; strings.Contains(got, "usec_get") {
+		t.Errorf("INFO latencystats after RESETSTAT:\n%s", got)
+	}
+}
+
+// BenchmarkLatencyRecording measures what accounting one command costs:
+// the latency sketch alone, all of a command's statistics, and those with
+// the clock reads around a command, from one goroutine and from many
+// recording the same command.
+func BenchmarkLatencyRecording(b *testing.B) {
+	st := newCommandStats()
+	durations := make([]time.Duration, 1024)
+	for i := range durations {
+		durations[i] = time.Duration(i*i*97) % (5 * time.Millisecond)
+	}
+	b.Run("sketch", func(b *testing.B) {
+		var ls latencySketch
+		for i := range b.N {
+			ls.record(durations[i%len(durations)])
+		}
+	})
+	b.Run("command", func(b *testing.B) {
+		for i := range b.N {
+			st.record("GET", durations[i%len(durations)])
+		}
+	})
+	b.Run("timed", func(b *testing.B) {
+		for range b.N {
+			start := time.Now()
+			st.record("GET", time.Since(start))
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				st.record("GET", durations[i%len(durations)])
+			}
+		})
+	})
+}
@@ -0,0 +1,428 @@
+package server
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errNotInteger = newError(ClassErr, "value is not an integer or out of range")
+	errNotFloat   = newError(ClassErr, "value is not a valid float")
+	errOverflow   = newError(ClassErr, "increment or decrement would overflow")
+	errNaN        = newError(ClassErr, "increment would produce NaN or Infinity")
+)
+
+// parseInteger parses b as Redis does an integer: base 10 without a plus
+// sign, spaces or leading zeros, so that a counter's text is canonical.
+func parseInteger(b []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	return n, err == nil && strconv.FormatInt(n, 10) == string(b)
+}
+
+// parseFloat parses b as a finite float.
+func parseFloat(b []byte) (float64, bool) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// handleIncr implements INCR, DECR, INCRBY, DECRBY and INCRBYFLOAT. The
+// stored string is parsed, adjusted and stored back under the shard lock,
+// so concurrent increments never lose an update; a missing prefix counts
+// as 0.
+func (s *TrieServer) handleIncr(conn redcon.Conn, c *client, name string, cmd redcon.Command) {
+	want := 3
+	if name == "INCR" || name == "DECR" {
+		want = 2
+	}
+	if len(cmd.Args) != want {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "'")
+		return
+	}
+	cidr := string(cmd.Args[1])
+	db := s.getDB(currentDB(conn))
+
+	var result []byte // the new value, for INCRBYFLOAT
+	var total int64   // the new value, for the others
+	var err error
+	if name == "INCRBYFLOAT" {
+		delta, ok := parseFloat(cmd.Args[2])
+		if !ok {
+			writeError(conn, errNotFloat)
+			return
+		}
+		err = db.update(cidr, func(old value, ok bool) (value, error) {
+			var f float64
+			if ok {
+				if !old.isString() {
+					return value{}, errWrongType
+				}
+				if f, ok = parseFloat(old.str); !ok {
+					return value{}, errNotFloat
+				}
+			}
+			if f += delta; math.IsNaN(f) || math.IsInf(f, 0) {
+				return value{}, errNaN
+			}
+			result = strconv.AppendFloat(nil, f, 'f', -1, 64)
+			return stringValue(result), nil
+		})
+	} else {
+		delta := int64(1)
+		if want == 3 {
+			var ok bool
+			if delta, ok = parseInteger(cmd.Args[2]); !ok {
+				writeError(conn, errNotInteger)
+				return
+			}
+		}
+		if name == "DECR" || name == "DECRBY" {
+			if delta == math.MinInt64 {
+				conn.WriteError("ERR decrement would overflow")
+				return
+			}
+			delta = -delta
+		}
+		err = db.update(cidr, func(old value, ok bool) (value, error) {
+			var n int64
+			if ok {
+				if !old.isString() {
+					return value{}, errWrongType
+				}
+				if n, ok = parseInteger(old.str); !ok {
+					return value{}, errNotInteger
+				}
+			}
+			if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+				return value{}, errOverflow
+			}
+			total = n + delta
+			return stringValue(strconv.AppendInt(nil, total, 10)), nil
+		})
+	}
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	db.writes.add(uint64(c.id), 1)
+	s.audit(c, name, cidr)
+	if name == "INCRBYFLOAT" {
+		conn.WriteBulk(result)
+	} else {
+		conn.WriteInt64(total)
+	}
+}
+
+// handleAppend implements APPEND cidr suffix, replying with the new
+// length. The result is always a new slice: the stored one may be shared
+// through the intern pool or held by a reader, so it is never grown in
+// place.
+func (s *TrieServer) handleAppend(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for 'APPEND'")
+		return
+	}
+	cidr := string(cmd.Args[1])
+	db := s.getDB(currentDB(conn))
+	var length int
+	err := db.update(cidr, func(old value, ok bool) (value, error) {
+		if ok && !old.isString() {
+			return value{}, errWrongType
+		}
+		str := make([]byte, 0, len(old.str)+len(cmd.Args[2]))
+		str = append(append(str, old.str...), cmd.Args[2]...)
+		length = len(str)
+		return stringValue(str), nil
+	})
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	db.writes.add(uint64(c.id), 1)
+	s.audit(c, "APPEND", cidr)
+	conn.WriteInt(length)
+}
+
+// handleMGet implements MGET ip|cidr [ip|cidr ...]: what GET of each
+// key answers for c, in order, except that a key holding another type
+// reads as nil rather than failing the whole reply, as in Redis.
+func (s *TrieServer) handleMGet(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'MGET'")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	conn.WriteArray(len(cmd.Args) - 1)
+	for _, arg := range cmd.Args[1:] {
+		key := string(arg)
+		v, ok := c.lookupGet(db, key)
+		if !ok {
+			db.misses.add(uint64(c.id), 1)
+			if def, ok := s.missDefault(db, key); ok {
+				conn.WriteBulk(def)
+			} else {
+				conn.WriteNull()
+			}
+			continue
+		}
+		db.hits.add(uint64(c.id), 1)
+		if v.isString() {
+			conn.WriteBulk(v.str)
+		} else {
+			conn.WriteNull()
+		}
+	}
+}
+
+// handleStrlen implements STRLEN cidr: the length of the string stored at
+// exactly cidr, or 0 if there is none.
+func (s *TrieServer) handleStrlen(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		conn.WriteError("ERR wrong number of arguments for 'STRLEN'")
+		return
+	}
+	v, ok := s.getDB(currentDB(conn)).lookupExact(string(cmd.Args[1]))
+	if ok && !v.isString() {
+		writeError(conn, errWrongType)
+		return
+	}
+	conn.WriteInt(len(v.str))
+}
+
+// handleGetRange implements GETRANGE cidr start end: the bytes from start
+// to end, both inclusive, of the string stored at exactly cidr, negative
+// offsets counting from the end as in Redis. A missing prefix is an empty
+// string. Stored strings are never modified in place, so the range is
+// written straight from the stored slice rather than a copy of it.
+func (s *TrieServer) handleGetRange(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		conn.WriteError("ERR wrong number of arguments for 'GETRANGE'")
+		return
+	}
+	start, err1 := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	end, err2 := strconv.ParseInt(string(cmd.Args[3]), 10, 64)
+	if err1 != nil || err2 != nil {
+		conn.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+	v, ok := s.getDB(currentDB(conn)).lookupExact(string(cmd.Args[1]))
+	if ok && !v.isString() {
+		writeError(conn, errWrongType)
+		return
+	}
+	n := int64(len(v.str))
+	if start < 0 && end < 0 && start > end {
+		conn.WriteBulkString("")
+		return
+	}
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = max(n+end, 0)
+	}
+	end = min(end, n-1)
+	if start > end || n == 0 {
+		conn.WriteBulkString("")
+		return
+	}
+	conn.WriteBulk(v.str[start : end+1])
+}
+
+var errSyntax = newError(ClassErr, "syntax error")
+
+// setOptions are SET's flags after the value.
+type setOptions struct {
+	nx, xx, get bool
+	keepTTL     bool
+	expireAt    int64 // unix milliseconds; 0 if the value does not expire
+}
+
+// parseSetOptions parses SET's [NX|XX] [GET] [EX s|PX ms|EXAT s|PXAT ms|
+// KEEPTTL], in any order. A deadline at or before now is allowed and
+// deletes the prefix, as in Redis.
+func parseSetOptions(args [][]byte) (setOptions, error) {
+	var o setOptions
+	ttlSet := false
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX", "XX":
+			if o.nx || o.xx {
+				return o, errSyntax
+			}
+			o.nx, o.xx = opt == "NX", opt == "XX"
+		case "GET":
+			o.get = true
+		case "KEEPTTL":
+			if ttlSet {
+				return o, errSyntax
+			}
+			o.keepTTL, ttlSet = true, true
+		case "EX", "PX", "EXAT", "PXAT":
+			if ttlSet || i+1 == len(args) {
+				return o, errSyntax
+			}
+			i++
+			at, err := parseExpireTime(opt, args[i], "set")
+			if err != nil {
+				return o, err
+			}
+			o.expireAt, ttlSet = at, true
+		default:
+			return o, errSyntax
+		}
+	}
+	return o, nil
+}
+
+// parseExpireTime turns the argument of unit, one of EX, PX, EXAT and
+// PXAT, into a deadline in unix milliseconds. cmd names the command in
+// the error, as Redis does.
+func parseExpireTime(unit string, arg []byte, cmd string) (int64, error) {
+	invalid := newError(ClassErr, "invalid expire time in '"+cmd+"' command")
+	n, ok := parseInteger(arg)
+	if !ok {
+		return 0, errNotInteger
+	}
+	if n <= 0 {
+		return 0, invalid
+	}
+	if unit == "EX" || unit == "EXAT" {
+		if n > math.MaxInt64/1000 {
+			return 0, invalid
+		}
+		n *= 1000
+	}
+	if unit == "EX" || unit == "PX" {
+		now := nowMillis()
+		if n > math.MaxInt64-now {
+			return 0, invalid
+		}
+		n += now
+	}
+	return n, nil
+}
+
+// handleSetString implements SET cidr value [NX|XX] [GET] [EX s|PX ms|
+// EXAT s|PXAT ms|KEEPTTL] and the legacy SETEX cidr seconds value and
+// PSETEX cidr ms value. The condition, the old value GET returns and the
+// new deadline are all settled under the shard lock, so the command is
+// one atomic write.
+func (s *TrieServer) handleSetString(conn redcon.Conn, c *client, name string, cmd redcon.Command) {
+	var o setOptions
+	var val []byte
+	var err error
+	switch name {
+	case "SET":
+		if len(cmd.Args) < 3 {
+			conn.WriteError("ERR wrong number of arguments for 'SET'")
+			return
+		}
+		val = cmd.Args[2]
+		o, err = parseSetOptions(cmd.Args[3:])
+	default:
+		if len(cmd.Args) != 4 {
+			conn.WriteError("ERR wrong number of arguments for '" + name + "'")
+			return
+		}
+		val = cmd.Args[3]
+		o.expireAt, err = parseExpireTime(map[string]string{"SETEX": "EX", "PSETEX": "PX"}[name],
+			cmd.Args[2], strings.ToLower(name))
+	}
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	cidr := string(cmd.Args[1])
+	// redcon reuses its read buffer, so the stored value is a copy.
+	val = bytes.Clone(val)
+	db := s.getDB(currentDB(conn))
+
+	var prev value
+	var existed, stored bool
+	err = db.modify(cidr, false, func(old value, ok bool) (value, error) {
+		if o.get && ok && !old.isString() {
+			return value{}, errWrongType
+		}
+		prev, existed = old, ok
+		if o.nx && ok || o.xx && !ok {
+			return value{}, errUnchanged
+		}
+		stored = true
+		if o.expireAt != 0 && o.expireAt <= nowMillis() {
+			return value{}, nil // already expired
+		}
+		v := stringValue(val)
+		v.expireAt = o.expireAt
+		if o.keepTTL {
+			v.expireAt = old.expireAt
+		}
+		return v, nil
+	})
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	if stored {
+		db.writes.add(uint64(c.id), 1)
+		s.audit(c, name, cidr)
+	}
+	switch {
+	case o.get && existed:
+		conn.WriteBulk(prev.str)
+	case o.get || !stored:
+		conn.WriteNull()
+	default:
+		writeOK(conn)
+	}
+}
+
+// handleSetIf implements SETIF cidr expected value, which sets cidr to
+// value only if exactly cidr holds the string expected, and SETIF cidr
+// ABSENT value, which sets it only if cidr holds nothing, of any type, as
+// SET NX does. An expected value never equals a missing prefix, and
+// comparing one with a value that is not a string is WRONGTYPE. Either
+// replies 1 if it set the value and 0 if not. The comparison and the write happen under
+// the shard lock, so concurrent writers can use it as compare-and-swap.
+// Like SET, it clears any TTL, and the audit log and webhooks record a
+// successful SETIF as the SET it amounts to.
+func (s *TrieServer) handleSetIf(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		conn.WriteError("ERR wrong number of arguments for 'SETIF'")
+		return
+	}
+	cidr := string(cmd.Args[1])
+	absent := strings.EqualFold(string(cmd.Args[2]), "ABSENT")
+	expected := cmd.Args[2]
+	// redcon reuses its read buffer, so the stored value is a copy.
+	val := bytes.Clone(cmd.Args[3])
+	db := s.getDB(currentDB(conn))
+
+	stored := false
+	err := db.modify(cidr, false, func(old value, ok bool) (value, error) {
+		switch {
+		case absent && ok:
+			return value{}, errUnchanged
+		case ok && !old.isString():
+			return value{}, errWrongType
+		case !absent && (!ok || !bytes.Equal(old.str, expected)):
+			return value{}, errUnchanged
+		}
+		stored = true
+		return stringValue(val), nil
+	})
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	if !stored {
+		conn.WriteInt(0)
+		return
+	}
+	db.writes.add(uint64(c.id), 1)
+	s.audit(c, "SET", cidr)
+	conn.WriteInt(1)
+}
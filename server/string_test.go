@@ -0,0 +1,233 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIncr(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	const k = "10.0.0.0/8"
+	for _, tc := range []struct {
+		args []string
+		want string // the reply as Reply.String renders it; an error by its prefix
+	}{
+		{[]string{"INCR", k}, "1"},
+		{[]string{"INCRBY", k, "41"}, "42"},
+		{[]string{"DECR", k}, "41"},
+		{[]string{"DECRBY", k, "-9"}, "50"},
+		{[]string{"GET", "10.1.2.3"}, "50"},
+		{[]string{"INCRBY", k, "+1"}, "ERR value is not an integer"},
+		{[]string{"INCRBY", k, "01"}, "ERR value is not an integer"},
+		{[]string{"INCRBY", k, " 1"}, "ERR value is not an integer"},
+		{[]string{"INCRBY", k, "9223372036854775808"}, "ERR value is not an integer"},
+		{[]string{"INCRBY", k, "9223372036854775807"}, "ERR increment or decrement would overflow"},
+		{[]string{"DECRBY", k, "-9223372036854775808"}, "ERR decrement would overflow"},
+		{[]string{"GET", "10.1.2.3"}, "50"}, // unchanged by the errors
+		{[]string{"INCRBYFLOAT", k, "0.5"}, "50.5"},
+		{[]string{"INCR", k}, "ERR value is not an integer"},
+		{[]string{"INCRBYFLOAT", k, "-50.5"}, "0"},
+		{[]string{"INCRBYFLOAT", k, "1e3"}, "1000"},
+		{[]string{"INCRBYFLOAT", k, "nan"}, "ERR value is not a valid float"},
+		{[]string{"INCRBYFLOAT", k, "1.7976931348623157e308"}, strconv.FormatFloat(1000+math.MaxFloat64, 'f', -1, 64)},
+		{[]string{"INCRBYFLOAT", k, "1.7976931348623157e308"}, "ERR increment would produce NaN or Infinity"},
+		{[]string{"SET", k, "text"}, "OK"},
+		{[]string{"INCR", k}, "ERR value is not an integer"},
+		{[]string{"INCRBYFLOAT", k, "1"}, "ERR value is not a valid float"},
+		{[]string{"SADD", "192.0.2.0/24", "m"}, "1"},
+		{[]string{"INCR", "192.0.2.0/24"}, "WRONGTYPE"},
+		{[]string{"INCR", "not-a-prefix"}, "ERR invalid"},
+		{[]string{"INCR", k, "1"}, "ERR wrong number of arguments for 'INCR'"},
+		{[]string{"INCRBY", k}, "ERR wrong number of arguments for 'INCRBY'"},
+	} {
+		r := ss.Do(tc.args...)
+		got := r.String()
+		if r.Type == ErrorReply {
+			if !strings.HasPrefix(got, tc.want) {
+				t.Errorf("%q = error %q, want %q", tc.args, got, tc.want)
+			}
+		} else if got != tc.want {
+			t.Errorf("%q = %s, want %s", tc.args, got, tc.want)
+		}
+	}
+}
+
+// TestIncrConcurrent increments one counter from several sessions at
+// once and checks that no update was lost.
+func TestIncrConcurrent(t *testing.T) {
+	s := newTestServer(t)
+	const workers, each = 8, 500
+	sessions := make([]*testSession, workers)
+	for i := range sessions {
+		sessions[i] = newTestSession(t, s)
+	}
+	var wg sync.WaitGroup
+	for _, ss := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range each {
+				if err := ss.Do("INCR", "10.0.0.0/8").Err(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := mustDo(t, sessions[0], "GET", "10.0.0.0/8").Str; got != strconv.Itoa(workers*each) {
+		t.Errorf("counter = %s after %d increments", got, workers*each)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	s := newTestServer(t)
+	s.store.interning.Store(true)
+	ss := newTestSession(t, s)
+	for _, tc := range []struct {
+		args []string
+		want string // the reply as Reply.String renders it; an error by its prefix
+	}{
+		{[]string{"APPEND", "10.0.0.0/8", "AS"}, "2"},
+		{[]string{"APPEND", "10.0.0.0/8", "64500"}, "7"},
+		{[]string{"APPEND", "10.0.0.0/8", ""}, "7"},
+		{[]string{"GET", "10.1.2.3"}, "AS64500"},
+		{[]string{"SET", "192.0.2.0/24", "shared"}, "OK"},
+		{[]string{"SET", "198.51.100.0/24", "shared"}, "OK"},
+		{[]string{"APPEND", "192.0.2.0/24", "+more"}, "11"},
+		{[]string{"GET", "192.0.2.1"}, "shared+more"},
+		{[]string{"GET", "198.51.100.1"}, "shared"}, // the interned copy is untouched
+		{[]string{"HSET", "203.0.113.0/24", "f", "v"}, "1"},
+		{[]string{"APPEND", "203.0.113.0/24", "x"}, "WRONGTYPE"},
+		{[]string{"APPEND", "10.0.0.0/8"}, "ERR wrong number of arguments for 'APPEND'"},
+		{[]string{"APPEND", "not-a-prefix", "x"}, "ERR invalid"},
+	} {
+		r := ss.Do(tc.args...)
+		got := r.String()
+		if r.Type == ErrorReply {
+			if !strings.HasPrefix(got, tc.want) {
+				t.Errorf("%q = error %q, want %q", tc.args, got, tc.want)
+			}
+		} else if got != tc.want {
+			t.Errorf("%q = %s, want %s", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestStrlen(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"STRLEN", "10.0.0.0/8"}, "0"},
+		{[]string{"SET", "10.0.0.0/8", "AS64500"}, "OK"},
+		{[]string{"STRLEN", "10.0.0.0/8"}, "7"},
+		{[]string{"STRLEN", "10.0.0.0/16"}, "0"}, // exact, not a longest match
+		{[]string{"STRLEN", "10.1.2.3"}, "0"},
+		{[]string{"SET", "192.0.2.0/24", ""}, "OK"},
+		{[]string{"STRLEN", "192.0.2.0/24"}, "0"},
+		{[]string{"SET", "2001:db8::/32", "a\x00b"}, "OK"},
+		{[]string{"STRLEN", "2001:db8::/32"}, "3"},
+		{[]string{"SADD", "198.51.100.0/24", "m"}, "1"},
+		{[]string{"STRLEN", "198.51.100.0/24"}, "WRONGTYPE"},
+		{[]string{"STRLEN", "not-a-prefix"}, "0"}, // nothing is stored there
+		{[]string{"STRLEN"}, "ERR wrong number of arguments for 'STRLEN'"},
+	})
+}
+
+func TestGetRange(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "This is a string"}, "OK"},
+		{[]string{"GETRANGE", "10.0.0.0/8", "0", "3"}, "This"},
+		{[]string{"GETRANGE", "10.0.0.0/8", "-3", "-1"}, "ing"},
+		{[]string{"GETRANGE", "10.0.0.0/8", "0", "-1"}, "This is a string"},
+		{[]string{"GETRANGE", "10.0.0.0/8", "10", "100"}, "string"},
+		{[]string{"GETRANGE", "10.0.0.0/8", "-100", "1"}, "Th"},
+		{[]string{"GETRANGE", "10.0.0.0/8", "5", "3"}, ""},
+		{[]string{"GETRANGE", "10.0.0.0/8", "-1", "-5"}, ""},
+		{[]string{"GETRANGE", "10.0.0.0/8", "16", "20"}, ""},
+		{[]string{"GETRANGE", "10.0.0.0/8", "15", "15"}, "g"},
+		{[]string{"GETRANGE", "10.0.0.0/16", "0", "-1"}, ""}, // exact, not a longest match
+		{[]string{"GETRANGE", "10.1.2.3", "0", "-1"}, ""},
+		{[]string{"SET", "192.0.2.0/24", ""}, "OK"},
+		{[]string{"GETRANGE", "192.0.2.0/24", "0", "-1"}, ""},
+		{[]string{"GETRANGE", "192.0.2.0/24", "-1", "0"}, ""},
+		{[]string{"SET", "2001:db8::/32", "a\x00b"}, "OK"},
+		{[]string{"GETRANGE", "2001:db8::/32", "1", "2"}, "\x00b"},
+		{[]string{"SADD", "198.51.100.0/24", "m"}, "1"},
+		{[]string{"GETRANGE", "198.51.100.0/24", "0", "1"}, "WRONGTYPE"},
+		{[]string{"GETRANGE", "not-a-prefix", "0", "1"}, ""},
+		{[]string{"GETRANGE", "10.0.0.0/8", "x", "1"}, "ERR value is not an integer or out of range"},
+		{[]string{"GETRANGE", "10.0.0.0/8", "0", "9223372036854775808"}, "ERR value is not an integer or out of range"},
+		{[]string{"GETRANGE", "10.0.0.0/8", "0"}, "ERR wrong number of arguments for 'GETRANGE'"},
+	})
+	if got := ss.Do("GETRANGE", "10.0.0.0/8", "0", "-1").Str; got != "This is a string" {
+		t.Errorf("GETRANGE after the reads = %q, the stored string changed", got)
+	}
+}
+
+func TestSetIf(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"SETIF", "10.0.0.0/8", "old", "new"}, "0"}, // missing equals no expected value
+		{[]string{"SETIF", "10.0.0.0/8", "", "new"}, "0"},
+		{[]string{"GET", "10.0.0.0/8"}, "nil"},
+		{[]string{"SETIF", "10.0.0.0/8", "ABSENT", "v1"}, "1"},
+		{[]string{"SETIF", "10.0.0.0/8", "absent", "v2"}, "0"},
+		{[]string{"GET", "10.0.0.0/8"}, "v1"},
+		{[]string{"SETIF", "10.0.0.0/8", "v0", "v2"}, "0"},
+		{[]string{"SETIF", "10.0.0.0/8", "V1", "v2"}, "0"}, // compared byte for byte
+		{[]string{"SETIF", "10.0.0.0/8", "v1", "v2"}, "1"},
+		{[]string{"GET", "10.1.2.3"}, "v2"},
+		{[]string{"SETIF", "10.1.0.0/16", "v2", "v3"}, "0"}, // exact, not a longest match
+		{[]string{"SET", "192.0.2.0/24", "ttl", "EX", "100"}, "OK"},
+		{[]string{"SETIF", "192.0.2.0/24", "ttl", "kept"}, "1"},
+		{[]string{"TTL", "192.0.2.0/24"}, "-1"}, // like SET, it clears the TTL
+		{[]string{"SET", "192.0.2.0/24", "", "EX", "100"}, "OK"},
+		{[]string{"SETIF", "192.0.2.0/24", "", "was empty"}, "1"},
+		{[]string{"SETIF", "192.0.2.0/24", "was empty", ""}, "1"},
+		{[]string{"GET", "192.0.2.0/24"}, ""},
+		{[]string{"SADD", "198.51.100.0/24", "m"}, "1"},
+		{[]string{"SETIF", "198.51.100.0/24", "m", "v"}, "WRONGTYPE"},
+		{[]string{"SETIF", "198.51.100.0/24", "ABSENT", "v"}, "0"},
+		{[]string{"SMEMBERS", "198.51.100.0/24"}, "[m]"},
+		{[]string{"SETIF", "not-a-prefix", "ABSENT", "v"}, "ERR invalid"},
+		{[]string{"SETIF", "10.0.0.0/8", "v2"}, "ERR wrong number of arguments for 'SETIF'"},
+		{[]string{"SETIF", "10.0.0.0/8", "v2", "v3", "EX"}, "ERR wrong number of arguments for 'SETIF'"},
+		{[]string{"DBREADONLY", "0", "yes"}, "OK"},
+		{[]string{"SETIF", "10.0.0.0/8", "v2", "v3"}, "READONLY"},
+		{[]string{"GET", "10.0.0.0/8"}, "v2"},
+	})
+}
+
+// TestSetIfConcurrent has several sessions increment one counter by
+// compare-and-swap and checks every swap that replied 1 took effect.
+func TestSetIfConcurrent(t *testing.T) {
+	s := newTestServer(t)
+	const workers, each = 8, 200
+	sessions := make([]*testSession, workers)
+	for i := range sessions {
+		sessions[i] = newTestSession(t, s)
+	}
+	mustDo(t, sessions[0], "SET", "10.0.0.0/8", "0")
+	var wg sync.WaitGroup
+	for _, ss := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < each; {
+				old := ss.Do("GET", "10.0.0.0/8").Str
+				n, _ := strconv.Atoi(old)
+				if ss.Do("SETIF", "10.0.0.0/8", old, strconv.Itoa(n+1)).Int == 1 {
+					done++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := mustDo(t, sessions[0], "GET", "10.0.0.0/8").Str; got != strconv.Itoa(workers*each) {
+		t.Errorf("counter = %s after %d swaps", got, workers*each)
+	}
+}
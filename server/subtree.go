@@ -0,0 +1,158 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// SUBNETS and TREEGET list the stored prefixes a CIDR covers, itself
+// included, in address order or the order of SORT BY; TREEGET gives each
+// one's value. Without CURSOR the whole subtree is one reply, refused past
+// subtree-max-entries. With CURSOR it comes in address order a page at a
+// time:
+//
+//	SUBNETS cidr CURSOR 0 COUNT 1000  ->  [next, [prefix ...]]
+//
+// where next is the last prefix of the page, to pass as the following
+// CURSOR, or 0 once the subtree is done. The cursor is a prefix rather
+// than a server-side handle, so it never expires and can be resumed on
+// another connection. Prefixes stored after it mid-iteration are reached;
+// ones before it are not.
+
+// defaultSubtreeCount is the page size of a CURSOR without COUNT.
+const defaultSubtreeCount = 10
+
+// handleSubtree implements SUBNETS and TREEGET cidr [CURSOR token
+// [COUNT n]] [SORT BY ADDRESS|LENGTH [DESC]].
+func (s *TrieServer) handleSubtree(conn redcon.Conn, c *client, name string, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "'")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	within, err := db.parseLookup(string(cmd.Args[1]))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	var after netip.Prefix
+	var order keyOrder
+	paged, counted, count := false, false, defaultSubtreeCount
+	for i := 2; i < len(cmd.Args); i += 2 {
+		if strings.EqualFold(string(cmd.Args[i]), "SORT") {
+			o, n, err := parseKeyOrder(cmd.Args[i:])
+			if err != nil {
+				writeError(conn, err)
+				return
+			}
+			order, i = o, i+n-2
+			continue
+		}
+		if i+1 >= len(cmd.Args) {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		arg := string(cmd.Args[i+1])
+		switch strings.ToUpper(string(cmd.Args[i])) {
+		case "CURSOR":
+			paged = true
+			if arg != "0" {
+				if after, err = db.parseLookup(arg); err != nil {
+					conn.WriteError("ERR invalid cursor")
+					return
+				}
+			}
+		case "COUNT":
+			counted = true
+			if count, err = strconv.Atoi(arg); err != nil || count < 1 {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	maxEntries := int(s.subtreeMax.Load())
+	if !paged {
+		if counted {
+			conn.WriteError("ERR COUNT needs CURSOR")
+			return
+		}
+		limit := maxEntries + 1
+		if maxEntries == 0 {
+			limit = math.MaxInt
+		}
+		entries, err := db.entriesAfter(netip.Prefix{}, within, limit, &c.budget)
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		if maxEntries > 0 && len(entries) > maxEntries {
+			conn.WriteError(fmt.Sprintf("ERR %s %s covers more than %d prefixes (subtree-max-entries), page through it with CURSOR 0 COUNT n",
+				name, within, maxEntries))
+			return
+		}
+		writeSubtree(conn, name, arrange(entries, order, entryPrefix))
+		return
+	}
+	if order != (keyOrder{}) {
+		conn.WriteError("ERR CURSOR pages in address order, SORT BY LENGTH or DESC needs the whole subtree")
+		return
+	}
+	if maxEntries > 0 && count > maxEntries {
+		count = maxEntries
+	}
+	entries, err := db.entriesAfter(after, within, count, &c.budget)
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	conn.WriteArray(2)
+	if len(entries) < count {
+		conn.WriteBulkString("0")
+	} else {
+		conn.WriteBulkString(entries[len(entries)-1].prefix.String())
+	}
+	writeSubtree(conn, name, entries)
+}
+
+// writeSubtree writes the prefixes of entries, and for TREEGET each one's
+// value after it. Hashes and sets have no single value and are nil.
+func writeSubtree(conn redcon.Conn, name string, entries []entry) {
+	if name != "TREEGET" {
+		conn.WriteArray(len(entries))
+		for _, e := range entries {
+			conn.WriteBulkString(e.prefix.String())
+		}
+		return
+	}
+	conn.WriteArray(2 * len(entries))
+	for _, e := range entries {
+		conn.WriteBulkString(e.prefix.String())
+		if e.value.isString() {
+			conn.WriteBulk(e.value.str)
+		} else {
+			conn.WriteNull()
+		}
+	}
+}
+
+// registerSubtreeConfig exposes subtree-max-entries.
+func (s *TrieServer) registerSubtreeConfig() {
+	s.addConfig("subtree-max-entries",
+		func() string { return strconv.FormatInt(s.subtreeMax.Load(), 10) },
+		func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("argument must be a non-negative number of prefixes")
+			}
+			s.subtreeMax.Store(n)
+			return nil
+		})
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSubtree(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", "b"}, "OK"},
+		{[]string{"SET", "10.1.2.0/24", "c"}, "OK"},
+		{[]string{"HSET", "10.2.0.0/16", "f", "v"}, "1"},
+		{[]string{"SET", "11.0.0.0/8", "d"}, "OK"},
+		{[]string{"SET", "10.3.0.0/16", "gone", "PX", "1"}, "OK"},
+		{[]string{"SET", "2001:db8::/32", "e"}, "OK"},
+	})
+	time.Sleep(5 * time.Millisecond)
+	runSteps(t, ss, []replyStep{
+		{[]string{"SUBNETS", "10.0.0.0/8"}, "[10.0.0.0/8 10.1.0.0/16 10.1.2.0/24 10.2.0.0/16]"},
+		{[]string{"SUBNETS", "10.1.0.0/16"}, "[10.1.0.0/16 10.1.2.0/24]"},
+		{[]string{"SUBNETS", "10.1.0.0/17"}, "[10.1.2.0/24]"}, // the CIDR need not be stored
+		{[]string{"SUBNETS", "10.1.2.3"}, "[]"},
+		{[]string{"SUBNETS", "0.0.0.0/0"}, "[10.0.0.0/8 10.1.0.0/16 10.1.2.0/24 10.2.0.0/16 11.0.0.0/8]"},
+		{[]string{"SUBNETS", "::/0"}, "[2001:db8::/32]"},
+		{[]string{"TREEGET", "10.0.0.0/8"}, "[10.0.0.0/8 a 10.1.0.0/16 b 10.1.2.0/24 c 10.2.0.0/16 nil]"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "CURSOR", "0", "COUNT", "2"}, "[10.1.0.0/16 [10.0.0.0/8 10.1.0.0/16]]"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "CURSOR", "10.1.0.0/16", "COUNT", "2"}, "[10.2.0.0/16 [10.1.2.0/24 10.2.0.0/16]]"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "CURSOR", "10.2.0.0/16", "COUNT", "2"}, "[0 []]"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "cursor", "10.1.0.0/16"}, "[0 [10.1.2.0/24 10.2.0.0/16]]"},
+		{[]string{"TREEGET", "10.0.0.0/8", "CURSOR", "10.1.1.0/24", "COUNT", "1"}, "[10.1.2.0/24 [10.1.2.0/24 c]]"},
+		{[]string{"SUBNETS"}, "ERR wrong number of arguments for 'SUBNETS'"},
+		{[]string{"TREEGET", "nope"}, "ERR"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "CURSOR"}, "ERR syntax error"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "CURSOR", "x"}, "ERR invalid cursor"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "CURSOR", "0", "COUNT", "0"}, "ERR value is not an integer or out of range"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "COUNT", "2"}, "ERR COUNT needs CURSOR"},
+		{[]string{"SUBNETS", "10.0.0.0/8", "LIMIT", "2"}, "ERR syntax error"},
+	})
+}
+
+// TestSubtreePaging pages through subtrees of a set spanning every shard
+// at several page sizes and compares the pages with the sorted keys.
+func TestSubtreePaging(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	all := mixedKeys(t, ss)
+	for _, within := range []string{"::/0", "2000::/2", "0.0.0.0/0", "10.0.0.0/8", "192.0.2.0/24"} {
+		w := netip.MustParsePrefix(within)
+		var want []string
+		for _, p := range all {
+			if w.Addr().Is4() == p.Addr().Is4() && w.Bits() <= p.Bits() && w.Contains(p.Addr()) {
+				want = append(want, p.String())
+			}
+		}
+		if got := mustDo(t, ss, "SUBNETS", within).strs(); !slices.Equal(got, want) {
+			t.Errorf("SUBNETS %s = %d prefixes, want %d", within, len(got), len(want))
+		}
+		for _, count := range []int{1, 7, 100, 1000} {
+			var got []string
+			cursor := "0"
+			for pages := 0; pages == 0 || cursor != "0"; pages++ {
+				r := mustDo(t, ss, "SUBNETS", within, "CURSOR", cursor, "COUNT", strconv.Itoa(count))
+				cursor = r.Array[0].Str
+				got = append(got, r.Array[1].strs()...)
+				if pages > len(want) {
+					t.Fatalf("SUBNETS %s COUNT %d is not ending", within, count)
+				}
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("SUBNETS %s COUNT %d paged %d prefixes, want %d in order:\n%v", within, count, len(got), len(want), got)
+			}
+		}
+	}
+}
+
+func TestSubtreeMaxEntries(t *testing.T) {
+	for _, tc := range []struct {
+		max   string
+		args  []string
+		want  string
+		entry int // prefixes in the reply, if not an error
+	}{
+		{"100000", []string{"SUBNETS", "10.0.0.0/8"}, "", 40},
+		{"40", []string{"SUBNETS", "10.0.0.0/8"}, "", 40},
+		{"39", []string{"SUBNETS", "10.0.0.0/8"}, "ERR SUBNETS 10.0.0.0/8 covers more than 39 prefixes (subtree-max-entries), page through it with CURSOR 0 COUNT n", 0},
+		{"39", []string{"TREEGET", "10.0.0.0/8"}, "ERR TREEGET 10.0.0.0/8 covers more than 39 prefixes", 0},
+		{"39", []string{"SUBNETS", "10.0.0.0/9"}, "", 22},
+		{"0", []string{"SUBNETS", "10.0.0.0/8"}, "", 40},
+		{"5", []string{"SUBNETS", "10.0.0.0/8", "CURSOR", "0", "COUNT", "100"}, "", 5}, // COUNT is clamped
+	} {
+		ss := newTestSession(t, newTestServer(t))
+		for i := range 40 {
+			mustDo(t, ss, "SET", "10."+strconv.Itoa(i*6)+".0.0/16", "v")
+		}
+		mustDo(t, ss, "CONFIG", "SET", "subtree-max-entries", tc.max)
+		r := ss.Do(tc.args...)
+		if tc.want != "" {
+			runSteps(t, ss, []replyStep{{tc.args, tc.want}})
+			continue
+		}
+		if err := r.Err(); err != nil {
+			t.Errorf("max %s: %q: %v", tc.max, tc.args, err)
+			continue
+		}
+		if r.Type == '*' && len(r.Array) == 2 && r.Array[1].Type == '*' {
+			r = r.Array[1]
+		}
+		if len(r.Array) != tc.entry {
+			t.Errorf("max %s: %q gave %d prefixes, want %d", tc.max, tc.args, len(r.Array), tc.entry)
+		}
+	}
+	runSteps(t, newTestSession(t, newTestServer(t)), []replyStep{
+		{[]string{"CONFIG", "SET", "subtree-max-entries", "-1"}, "ERR"},
+		{[]string{"CONFIG", "SET", "subtree-max-entries", "7"}, "OK"},
+		{[]string{"CONFIG", "GET", "subtree-max-entries"}, "[subtree-max-entries 7]"},
+	})
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+var errEmptyTag = newError(ClassErr, "tags must not be empty")
+
+// Tags are labels on a prefix kept apart from its value, such as
+// "pending-review" or "customer:acme". They are stored with the value, so
+// they are saved in snapshots and go when the prefix is deleted or
+// expires, and a write that replaces the value keeps them. GET and the
+// other lookups never see them.
+
+// handleTag implements TAG cidr ADD tag [tag ...], replying with how many
+// tags were new, TAG cidr DEL tag [tag ...], with how many were removed,
+// and TAG cidr LIST, with the prefix's tags, sorted. TAG is a read in
+// commandTable so that LIST needs only read access; ADD and DEL check for
+// write access and a writable database here.
+func (s *TrieServer) handleTag(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		conn.WriteError("ERR wrong number of arguments for 'TAG'")
+		return
+	}
+	cidr := string(cmd.Args[1])
+	db := s.getDB(currentDB(conn))
+	switch sub := strings.ToUpper(string(cmd.Args[2])); sub {
+	case "LIST":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'TAG LIST'")
+			return
+		}
+		v, _ := db.peekExact(cidr)
+		conn.WriteArray(len(v.tags))
+		for _, t := range v.tags {
+			conn.WriteBulkString(t)
+		}
+
+	case "ADD", "DEL":
+		if len(cmd.Args) < 4 {
+			conn.WriteError("ERR wrong number of arguments for 'TAG " + sub + "'")
+			return
+		}
+		if user, perm := s.userFor(c); !perm.allows(cmdWrite) {
+			writeError(conn, errNoPerm(user, "tag|"+strings.ToLower(sub)))
+			return
+		}
+		if err := s.writeAllowed(currentDB(conn), cmdWrite); err != nil {
+			writeError(conn, err)
+			return
+		}
+		for _, arg := range cmd.Args[3:] {
+			if len(arg) == 0 {
+				writeError(conn, errEmptyTag)
+				return
+			}
+		}
+		changed := 0
+		err := db.update(cidr, func(old value, ok bool) (value, error) {
+			if !ok {
+				if sub == "DEL" {
+					return value{}, errUnchanged
+				}
+				return value{}, errNoSuchKey
+			}
+			tags := slices.Clone(old.tags)
+			for _, arg := range cmd.Args[3:] {
+				t := string(arg)
+				i, present := slices.BinarySearch(tags, t)
+				switch {
+				case sub == "ADD" && !present:
+					tags = slices.Insert(tags, i, t)
+					changed++
+				case sub == "DEL" && present:
+					tags = slices.Delete(tags, i, i+1)
+					changed++
+				}
+			}
+			if changed == 0 {
+				return value{}, errUnchanged
+			}
+			v := old
+			v.tags = tags
+			if v.tags == nil {
+				v.tags = []string{} // dropping the last tag, see inheritTags
+			}
+			return v, nil
+		})
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		if changed > 0 {
+			db.writes.add(uint64(c.id), 1)
+			s.audit(c, "TAG", cidr)
+		}
+		conn.WriteInt(changed)
+
+	default:
+		conn.WriteError("ERR unknown subcommand '" + sub + "' for 'TAG'")
+	}
+}
+
+// tagKeys returns the unexpired prefixes carrying tag, covered by within
+// unless within is invalid, in comparePrefixes order.
+func (d *database) tagKeys(tag string, within netip.Prefix) []netip.Prefix {
+	ps := d.tags.prefixes(tag)
+	live := ps[:0]
+	for _, p := range ps {
+		if within.IsValid() && !covers(within, p) {
+			continue
+		}
+		sh := d.shardFor(p)
+		sh.mu.RLock()
+		v, ok := sh.trie.Get(p)
+		sh.mu.RUnlock()
+		if _, tagged := slices.BinarySearch(v.tags, tag); ok && tagged && !v.expired() {
+			live = append(live, p)
+		}
+	}
+	slices.SortFunc(live, comparePrefixes)
+	return live
+}
+
+// covers reports whether p lies within outer.
+func covers(outer, p netip.Prefix) bool {
+	return p.Addr().Is4() == outer.Addr().Is4() && p.Bits() >= outer.Bits() && outer.Contains(p.Addr())
+}
+
+// handleTagKeys implements TAGKEYS tag [WITHIN cidr], the prefixes
+// carrying tag, in address order with shorter prefixes first. It reads
+// the tag index rather than walking the database.
+func (s *TrieServer) handleTagKeys(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 && len(cmd.Args) != 4 {
+		conn.WriteError("ERR wrong number of arguments for 'TAGKEYS'")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	var within netip.Prefix
+	if len(cmd.Args) == 4 {
+		if !strings.EqualFold(string(cmd.Args[2]), "WITHIN") {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		p, err := db.parseLookup(string(cmd.Args[3]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		within = p
+	}
+	keys := db.tagKeys(string(cmd.Args[1]), within)
+	conn.WriteArray(len(keys))
+	for _, p := range keys {
+		conn.WriteBulkString(p.String())
+	}
+}
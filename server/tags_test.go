@@ -0,0 +1,160 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTagCommands(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", "b"}, "OK"},
+		{[]string{"SET", "2001:db8::/32", "c"}, "OK"},
+		{[]string{"TAG", "10.0.0.0/8", "LIST"}, "[]"},
+		{[]string{"TAG", "10.0.0.0/8", "ADD", "review", "acme", "review"}, "2"},
+		{[]string{"TAG", "10.0.0.0/8", "add", "acme"}, "0"},
+		{[]string{"TAG", "10.0.0.0/8", "LIST"}, "[acme review]"},
+		{[]string{"GET", "10.0.0.0/8"}, "a"}, // lookups never see tags
+		{[]string{"TAG", "10.1.0.0/16", "ADD", "review"}, "1"},
+		{[]string{"TAG", "2001:db8::/32", "ADD", "review"}, "1"},
+		{[]string{"TAGKEYS", "review"}, "[10.0.0.0/8 10.1.0.0/16 2001:db8::/32]"},
+		{[]string{"TAGKEYS", "review", "WITHIN", "10.1.0.0/16"}, "[10.1.0.0/16]"},
+		{[]string{"TAGKEYS", "review", "within", "::/0"}, "[2001:db8::/32]"},
+		{[]string{"TAGKEYS", "acme"}, "[10.0.0.0/8]"},
+		{[]string{"TAGKEYS", "nobody"}, "[]"},
+
+		// Replacing the value keeps the tags; deleting the prefix drops them.
+		{[]string{"SET", "10.0.0.0/8", "a2"}, "OK"},
+		{[]string{"APPEND", "10.0.0.0/8", "x"}, "3"},
+		{[]string{"TAG", "10.0.0.0/8", "LIST"}, "[acme review]"},
+		{[]string{"DEL", "10.1.0.0/16"}, "1"},
+		{[]string{"TAGKEYS", "review"}, "[10.0.0.0/8 2001:db8::/32]"},
+		{[]string{"SET", "10.1.0.0/16", "b"}, "OK"},
+		{[]string{"TAG", "10.1.0.0/16", "LIST"}, "[]"},
+
+		// Removing the last tag sticks through a later overwrite.
+		{[]string{"TAG", "10.0.0.0/8", "DEL", "acme", "missing"}, "1"},
+		{[]string{"TAG", "10.0.0.0/8", "DEL", "review"}, "1"},
+		{[]string{"TAG", "10.0.0.0/8", "DEL", "review"}, "0"},
+		{[]string{"SET", "10.0.0.0/8", "a3"}, "OK"},
+		{[]string{"TAG", "10.0.0.0/8", "LIST"}, "[]"},
+		{[]string{"TAGKEYS", "acme"}, "[]"},
+
+		{[]string{"TAG", "192.0.2.0/24", "DEL", "x"}, "0"},
+		{[]string{"TAG", "192.0.2.0/24", "ADD", "x"}, "ERR no such key"},
+		{[]string{"TAG", "192.0.2.0/24", "LIST"}, "[]"},
+		{[]string{"TAG", "10.0.0.0/8", "ADD", ""}, "ERR tags must not be empty"},
+		{[]string{"TAG", "10.0.0.0/8", "ADD"}, "ERR wrong number of arguments for 'TAG ADD'"},
+		{[]string{"TAG", "10.0.0.0/8", "LIST", "x"}, "ERR wrong number of arguments for 'TAG LIST'"},
+		{[]string{"TAG", "10.0.0.0/8", "SHOW"}, "ERR unknown subcommand 'SHOW' for 'TAG'"},
+		{[]string{"TAG", "10.0.0.0/8"}, "ERR wrong number of arguments for 'TAG'"},
+		{[]string{"TAGKEYS", "review", "INSIDE", "::/0"}, "ERR syntax error"},
+		{[]string{"TAGKEYS"}, "ERR wrong number of arguments for 'TAGKEYS'"},
+
+		{[]string{"FLUSHDB"}, "OK"},
+		{[]string{"TAGKEYS", "review"}, "[]"},
+	})
+}
+
+// TestTagPermissions checks that TAG LIST needs only read access while
+// ADD and DEL need write access and a writable database.
+func TestTagPermissions(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(s *TrieServer)
+		add   string
+		del   string
+	}{
+		{
+			name:  "admin",
+			setup: func(*TrieServer) {},
+			add:   "1",
+			del:   "1",
+		},
+		{
+			name: "readonly client",
+			setup: func(s *TrieServer) {
+				s.identities.Store(&identityMap{"ops": permAdmin})
+				s.defaultPermission.Store(int32(permReadOnly))
+			},
+			add: "NOPERM User default has no permissions to run the 'tag|add' command",
+			del: "NOPERM User default has no permissions to run the 'tag|del' command",
+		},
+		{
+			name: "readwrite client",
+			setup: func(s *TrieServer) {
+				s.identities.Store(&identityMap{"ops": permAdmin})
+				s.defaultPermission.Store(int32(permReadWrite))
+			},
+			add: "1",
+			del: "1",
+		},
+		{
+			name:  "read-only server",
+			setup: func(s *TrieServer) { s.readOnly.Store(true) },
+			add:   "READONLY You can't write against a read only server",
+			del:   "READONLY You can't write against a read only server",
+		},
+		{
+			name:  "read-only database",
+			setup: func(s *TrieServer) { mustDo(t, newTestSession(t, s), "DBREADONLY", "0", "yes") },
+			add:   "READONLY You can't write against read only db0",
+			del:   "READONLY You can't write against read only db0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			ss := newTestSession(t, s)
+			runSteps(t, ss, []replyStep{
+				{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+				{[]string{"TAG", "10.0.0.0/8", "ADD", "keep"}, "1"},
+			})
+			tc.setup(s)
+			runSteps(t, ss, []replyStep{
+				{[]string{"TAG", "10.0.0.0/8", "LIST"}, "[keep]"},
+				{[]string{"TAG", "10.0.0.0/8", "ADD", "new"}, tc.add},
+				{[]string{"TAG", "10.0.0.0/8", "DEL", "keep"}, tc.del},
+			})
+			want := "[10.0.0.0/8]"
+			if tc.del == "1" {
+				want = "[]"
+			}
+			runSteps(t, ss, []replyStep{{[]string{"TAGKEYS", "keep"}, want}})
+		})
+	}
+}
+
+func TestTagsExpireAndSave(t *testing.T) {
+	s := newTestServer(t)
+	s.snapshots.dir = t.TempDir()
+	ss := newTestSession(t, s)
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"HSET", "10.1.0.0/16", "f", "v"}, "1"},
+		{[]string{"SET", "10.2.0.0/16", "gone", "PX", "20"}, "OK"},
+		{[]string{"TAG", "10.0.0.0/8", "ADD", "x", "y"}, "2"},
+		{[]string{"TAG", "10.1.0.0/16", "ADD", "x"}, "1"},
+		{[]string{"TAG", "10.2.0.0/16", "ADD", "x"}, "1"},
+		{[]string{"SET", "10.3.0.0/16", "untagged"}, "OK"},
+	})
+	time.Sleep(30 * time.Millisecond)
+	runSteps(t, ss, []replyStep{
+		{[]string{"TAGKEYS", "x"}, "[10.0.0.0/8 10.1.0.0/16]"},
+		{[]string{"SAVE"}, "OK"},
+	})
+
+	loaded := newTestServer(t)
+	if _, err := loadSnapshotFile(loaded, filepath.Join(s.snapshots.dir, s.snapshots.dbFilename), true, true); err != nil {
+		t.Fatal(err)
+	}
+	runSteps(t, newTestSession(t, loaded), []replyStep{
+		{[]string{"TAG", "10.0.0.0/8", "LIST"}, "[x y]"},
+		{[]string{"TAG", "10.1.0.0/16", "LIST"}, "[x]"},
+		{[]string{"TAG", "10.3.0.0/16", "LIST"}, "[]"},
+		{[]string{"TAGKEYS", "x"}, "[10.0.0.0/8 10.1.0.0/16]"},
+		{[]string{"TAGKEYS", "y"}, "[10.0.0.0/8]"},
+		{[]string{"HGET", "10.1.0.0/16", "f"}, "v"},
+	})
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// Every command runs within an execution budget: command-timeout
+// milliseconds, or its class's entry in command-timeout-classes, where
+// the classes are admin, write and read by the command's permission. The
+// commands that walk an unbounded part of a database check the budget
+// as they go and, once it has run out, stop and fail with a TIMEOUT
+// error, discarding what they found so far: SUBNETS and TREEGET, KEYS,
+// DBDIFF, PREFIXSTATS of a cidr, and DELVALUE and TREEEXPIRE, which only
+// stop while still finding what to write and never part way through
+// writing it. Commands that write as they walk, such as DBMERGE, run to
+// the end. A command whose client is killed, by CLIENT KILL or any of
+// the limits that close clients, stops the same way, so killing the
+// client frees the locks its command holds.
+
+// budgetPolls is how many checks of a budget go by between readings of
+// the clock.
+const budgetPolls = 256
+
+// commandClasses are the classes command-timeout-classes takes.
+var commandClasses = []string{"read", "write", "admin"}
+
+// classOf returns the index in commandClasses of a command with flags f.
+func classOf(f cmdFlags) int {
+	switch {
+	case f&cmdAdmin != 0:
+		return 2
+	case f&cmdWrite != 0:
+		return 1
+	}
+	return 0
+}
+
+// classTimeouts are the milliseconds of command-timeout-classes by class,
+// -1 for a class that takes command-timeout.
+type classTimeouts [3]int64
+
+func parseClassTimeouts(s string) (*classTimeouts, error) {
+	t := &classTimeouts{-1, -1, -1}
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		class, ms, ok := strings.Cut(entry, "=")
+		i := -1
+		for j, name := range commandClasses {
+			if strings.EqualFold(class, name) {
+				i = j
+			}
+		}
+		n, err := strconv.ParseInt(ms, 10, 64)
+		if !ok || i < 0 || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid entry '%s', expected read, write or admin=milliseconds", entry)
+		}
+		t[i] = n
+	}
+	return t, nil
+}
+
+func (t *classTimeouts) String() string {
+	var parts []string
+	for i, ms := range t {
+		if ms >= 0 {
+			parts = append(parts, commandClasses[i]+"="+strconv.FormatInt(ms, 10))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// budget is the execution budget of the command a client is running.
+// Only the client's own goroutine uses it.
+type budget struct {
+	c        *client
+	limit    time.Duration // 0 for none
+	deadline time.Time
+	polls    int
+	spent    bool
+}
+
+// begin starts the budget of a command with flags f.
+func (s *TrieServer) begin(c *client, f cmdFlags, start time.Time) {
+	ms := s.classTimeouts.Load()[classOf(f)]
+	if ms < 0 {
+		ms = s.cmdTimeout.Load()
+	}
+	c.budget = budget{c: c, limit: time.Duration(ms) * time.Millisecond}
+	c.budget.deadline = start.Add(c.budget.limit)
+}
+
+// exceeded reports whether the command has run out of budget or its
+// client has been killed, for a traversal to check before each step. A
+// nil budget never runs out.
+func (b *budget) exceeded() bool {
+	switch {
+	case b == nil:
+		return false
+	case b.spent:
+		return true
+	case b.c.killed.Load():
+		b.spent = true
+	case b.limit > 0:
+		if b.polls++; b.polls%budgetPolls == 0 && time.Now().After(b.deadline) {
+			b.spent = true
+		}
+	}
+	return b.spent
+}
+
+// err returns the error of a command that stopped on exceeding b.
+func (b *budget) err() error {
+	if b.c.killed.Load() {
+		return newError(ClassTimeout, "command aborted, its client was killed")
+	}
+	return errorf(ClassTimeout, "command aborted after exceeding its %dms execution budget", b.limit.Milliseconds())
+}
+
+// handleClientKill implements CLIENT KILL ip:port, CLIENT KILL ID id and
+// CLIENT KILL ADDR ip:port, which close the matching client, aborting what
+// it is running. The first form replies OK, or an error if there is no
+// such client, and the others the number of clients killed. The calling
+// client is never killed.
+func (s *TrieServer) handleClientKill(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) != 3 && len(cmd.Args) != 4 {
+		conn.WriteError("ERR wrong number of arguments for 'CLIENT KILL'")
+		return
+	}
+	if user, perm := s.userFor(c); perm < permAdmin {
+		writeError(conn, errNoPerm(user, "client|kill"))
+		return
+	}
+	match := func(other *client) bool { return other.addr == string(cmd.Args[2]) }
+	if len(cmd.Args) == 4 {
+		arg := string(cmd.Args[3])
+		switch strings.ToUpper(string(cmd.Args[2])) {
+		case "ID":
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				conn.WriteError("ERR client-id should be greater than 0")
+				return
+			}
+			match = func(other *client) bool { return other.id == id }
+		case "ADDR":
+			match = func(other *client) bool { return other.addr == arg }
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	killed := 0
+	for _, other := range s.clients.list() {
+		if other != c && match(other) && other.netConn != nil && other.killed.CompareAndSwap(false, true) {
+			other.netConn.Close()
+			killed++
+			slog.Info("client killed", "client", other.id, "addr", other.addr, "by", c.id)
+		}
+	}
+	switch {
+	case len(cmd.Args) == 4:
+		conn.WriteInt(killed)
+	case killed == 0:
+		conn.WriteError("ERR No such client")
+	default:
+		writeOK(conn)
+	}
+}
+
+// registerTimeoutConfig exposes command-timeout and
+// command-timeout-classes.
+func (s *TrieServer) registerTimeoutConfig() {
+	s.addConfig("command-timeout",
+		func() string { return strconv.FormatInt(s.cmdTimeout.Load(), 10) },
+		func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("argument must be a non-negative number of milliseconds")
+			}
+			s.cmdTimeout.Store(n)
+			return nil
+		})
+	s.addConfig("command-timeout-classes",
+		func() string { return s.classTimeouts.Load().String() },
+		func(v string) error {
+			t, err := parseClassTimeouts(v)
+			if err != nil {
+				return err
+			}
+			s.classTimeouts.Store(t)
+			return nil
+		})
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseClassTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string // String() of the result, or the start of the error
+	}{
+		{"", ""},
+		{"admin=60000,write=1000", "write=1000,admin=60000"},
+		{"READ=5 write=0", "read=5,write=0"},
+		{"read=1,read=2", "read=2"},
+		{"read", "invalid entry 'read'"},
+		{"sync=5", "invalid entry 'sync=5'"},
+		{"write=-1", "invalid entry 'write=-1'"},
+		{"admin=1s", "invalid entry 'admin=1s'"},
+	} {
+		ct, err := parseClassTimeouts(tc.in)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = ct.String()
+		}
+		if !strings.HasPrefix(got, tc.want) || err == nil && got != tc.want {
+			t.Errorf("parseClassTimeouts(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	past := time.Now().Add(-time.Second)
+	for _, tc := range []struct {
+		name   string
+		b      budget
+		killed bool
+		first  int // checks before exceeded reports true, -1 for never
+		err    string
+	}{
+		{"no limit", budget{deadline: past}, false, -1, ""},
+		{"not yet due", budget{limit: time.Hour, deadline: time.Now().Add(time.Hour)}, false, -1, ""},
+		{"past its deadline", budget{limit: 5 * time.Millisecond, deadline: past}, false, budgetPolls - 1,
+			"TIMEOUT command aborted after exceeding its 5ms execution budget"},
+		{"killed", budget{limit: time.Hour, deadline: time.Now().Add(time.Hour)}, true, 0,
+			"TIMEOUT command aborted, its client was killed"},
+	} {
+		b := tc.b
+		b.c = &client{}
+		b.c.killed.Store(tc.killed)
+		first := -1
+		for i := range 2 * budgetPolls {
+			if b.exceeded() {
+				first = i
+				break
+			}
+		}
+		if first != tc.first {
+			t.Errorf("%s: exceeded after %d checks, want %d", tc.name, first, tc.first)
+		}
+		if first >= 0 && (!b.exceeded() || b.err().Error() != tc.err) {
+			t.Errorf("%s: then %v, %v, want still exceeded with %q", tc.name, b.exceeded(), b.err(), tc.err)
+		}
+	}
+	var none *budget
+	if none.exceeded() {
+		t.Error("a nil budget ran out")
+	}
+}
+
+// TestCommandTimeout runs each covered command over a database far
+// larger than a 1ms budget walks.
+func TestCommandTimeout(t *testing.T) {
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	for i := range 40000 {
+		mustDo(t, ss, "SET", "10."+strconv.Itoa(i/200)+"."+strconv.Itoa(i%200)+".0/24", "a")
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "192.0.2.0/24", "b"}, "OK"},
+		{[]string{"SELECT", "1"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "c"}, "OK"},
+		{[]string{"SELECT", "0"}, "OK"},
+		{[]string{"CONFIG", "SET", "command-timeout", "1"}, "OK"},
+	})
+	const timeout = "TIMEOUT command aborted after exceeding its 1ms execution budget"
+	for i, args := range [][]string{
+		{"SUBNETS", "0.0.0.0/0"},
+		{"TREEGET", "10.0.0.0/8", "CURSOR", "0", "COUNT", "100000"},
+		{"KEYS", "*"},
+		{"DBDIFF", "0", "1", "VALUES"},
+		{"PREFIXSTATS", "10.0.0.0/8"},
+		{"DELVALUE", "a"},
+	} {
+		runSteps(t, ss, []replyStep{
+			{args, timeout},
+			{[]string{"GET", "192.0.2.1"}, "b"}, // a lookup walks nothing
+		})
+		if got := infoFields(mustDo(t, ss, "INFO", "stats").Str)["aborted_commands"]; got != strconv.Itoa(i+1) {
+			t.Errorf("%q: aborted_commands = %s, want %d", args, got, i+1)
+		}
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"DBSIZE"}, "40001"}, // DELVALUE deleted nothing
+		{[]string{"CONFIG", "SET", "command-timeout", "250"}, "OK"},
+		{[]string{"CONFIG", "GET", "command-timeout"}, "[command-timeout 250]"},
+		{[]string{"CONFIG", "SET", "command-timeout", "-1"}, "ERR"},
+		{[]string{"CONFIG", "SET", "command-timeout-classes", "write=10 ADMIN=0"}, "OK"},
+		{[]string{"CONFIG", "GET", "command-timeout-classes"}, "[command-timeout-classes write=10,admin=0]"},
+		{[]string{"CONFIG", "SET", "command-timeout-classes", "slow=1"}, "ERR"},
+		{[]string{"SUBNETS", "10.0.5.0/24"}, "[10.0.5.0/24]"},
+	})
+	for _, tc := range []struct {
+		flags cmdFlags
+		limit time.Duration
+	}{
+		{0, 250 * time.Millisecond},
+		{cmdWrite, 10 * time.Millisecond},
+		{cmdAdmin | cmdWrite, 0},
+	} {
+		c := clientOf(ss.conn)
+		s.begin(c, tc.flags, time.Now())
+		if c.budget.limit != tc.limit {
+			t.Errorf("flags %b: budget %v, want %v", tc.flags, c.budget.limit, tc.limit)
+		}
+	}
+}
+
+func TestClientKill(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveTest(t, s)
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := r.ReadString('\n'); got != "+PONG\r\n" {
+			t.Fatalf("PING: %q, %v", got, err)
+		}
+		return conn, r
+	}
+	for _, tc := range []struct {
+		name string
+		args func(victim net.Conn) []string
+		want string
+	}{
+		{"by address", func(v net.Conn) []string { return []string{"CLIENT", "KILL", v.LocalAddr().String()} }, "OK"},
+		{"ADDR", func(v net.Conn) []string { return []string{"CLIENT", "KILL", "addr", v.LocalAddr().String()} }, "1"},
+		{"ID", func(net.Conn) []string { return []string{"CLIENT", "KILL", "ID", newestID(t, s)} }, "1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			victim, r := dial()
+			runSteps(t, newTestSession(t, s), []replyStep{{tc.args(victim), tc.want}})
+			if line, err := r.ReadString('\n'); err == nil {
+				t.Errorf("killed client read %q", line)
+			}
+		})
+	}
+	runSteps(t, newTestSession(t, s), []replyStep{
+		{[]string{"CLIENT", "KILL", "127.0.0.1:1"}, "ERR No such client"},
+		{[]string{"CLIENT", "KILL", "ADDR", "127.0.0.1:1"}, "0"},
+		{[]string{"CLIENT", "KILL", "ID", "x"}, "ERR client-id should be greater than 0"},
+		{[]string{"CLIENT", "KILL", "USER", "default"}, "ERR syntax error"},
+		{[]string{"CLIENT", "KILL"}, "ERR wrong number of arguments for 'CLIENT KILL'"},
+	})
+	s.identities.Store(&identityMap{"ops": permAdmin})
+	s.defaultPermission.Store(int32(permReadWrite))
+	runSteps(t, newTestSession(t, s), []replyStep{
+		{[]string{"CLIENT", "KILL", "ADDR", "127.0.0.1:1"}, "NOPERM User default has no permissions to run the 'client|kill' command"},
+	})
+}
+
+// newestID returns the id of the newest TCP client of s.
+func newestID(t *testing.T, s *TrieServer) string {
+	t.Helper()
+	var newest *client
+	for _, c := range s.clients.list() {
+		if c.netConn != nil && (newest == nil || c.id > newest.id) {
+			newest = c
+		}
+	}
+	if newest == nil {
+		t.Fatal("no TCP client")
+	}
+	return strconv.FormatInt(newest.id, 10)
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// tlsSettings holds the TLS listener options and the certificate material
+// currently in use. The material can be reloaded at runtime (SIGHUP or
+// CONFIG SET) without restarting the listener.
+type tlsSettings struct {
+	mu          sync.Mutex
+	port        int
+	certFile    string
+	keyFile     string
+	caCertFile  string
+	authClients string // "yes", "no" or "optional", as in Redis
+
+	active atomic.Pointer[tls.Config]
+}
+
+// enabled reports whether a TLS listener was requested.
+func (t *tlsSettings) enabled() bool { return t.port != 0 }
+
+// build loads the configured files into a fresh tls.Config.
+func (t *tlsSettings) build() (*tls.Config, error) {
+	if t.certFile == "" || t.keyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if t.caCertFile != "" {
+		pem, err := os.ReadFile(t.caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading CA certificates: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.caCertFile)
+		}
+		cfg.ClientCAs = pool
+	}
+
+	switch t.authClients {
+	case "yes":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		cfg.ClientAuth = tls.NoClientCert
+	default:
+		return nil, fmt.Errorf("invalid tls-auth-clients %q", t.authClients)
+	}
+	if cfg.ClientAuth != tls.NoClientCert && cfg.ClientCAs == nil {
+		return nil, errors.New("tls-ca-cert-file is required unless tls-auth-clients is no")
+	}
+	return cfg, nil
+}
+
+// reload rebuilds the configuration from disk. New handshakes use it
+// immediately; established connections keep what they negotiated.
+func (t *tlsSettings) reload() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reloadLocked()
+}
+
+func (t *tlsSettings) reloadLocked() error {
+	cfg, err := t.build()
+	if err != nil {
+		return err
+	}
+	t.active.Store(cfg)
+	return nil
+}
+
+// listenerConfig is handed to the TLS listener once; each handshake picks
+// up whatever configuration was most recently loaded.
+func (t *tlsSettings) listenerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.active.Load(), nil
+		},
+	}
+}
+
+// registerConfig exposes the TLS settings through CONFIG GET/SET. Changing
+// a file path reloads the certificates; setting the same path again is the
+// way to pick up files rotated in place.
+func (t *tlsSettings) registerConfig(s *TrieServer) {
+	apply := &configApply{fn: func() error {
+		if !t.enabled() {
+			return nil
+		}
+		return t.reload()
+	}}
+	str := func(field *string) (func() string, func(string) error) {
+		get := func() string {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			return *field
+		}
+		set := func(v string) error {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			*field = v
+			return nil
+		}
+		return get, set
+	}
+
+	s.addConfig("tls-port", func() string { return strconv.Itoa(t.port) }, nil)
+	for name, field := range map[string]*string{
+		"tls-cert-file":    &t.certFile,
+		"tls-key-file":     &t.keyFile,
+		"tls-ca-cert-file": &t.caCertFile,
+	} {
+		get, set := str(field)
+		s.addConfig(name, get, set).apply = apply
+	}
+
+	get, set := str(&t.authClients)
+	s.addConfig("tls-auth-clients", get, func(v string) error {
+		switch v {
+		case "yes", "no", "optional":
+			return set(v)
+		}
+		return fmt.Errorf("argument must be 'yes', 'no' or 'optional'")
+	}).apply = apply
+}
+
+// reloadOnSIGHUP reloads the certificates whenever the process receives
+// SIGHUP, keeping the previous material if the new files are invalid.
+func (t *tlsSettings) reloadOnSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := t.reload(); err != nil {
+			slog.Warn("TLS reload failed, keeping previous certificates", "err", err)
+			continue
+		}
+		slog.Info("TLS certificates reloaded", "cert", t.certFile)
+	}
+}
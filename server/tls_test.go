@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// testCA is a certificate authority issuing test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // the CA certificate, PEM
+	dir  string
+	n    int64
+}
+
+func newTestCA(t testing.TB) *testCA {
+	t.Helper()
+	ca := &testCA{dir: t.TempDir()}
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "triedis test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	ca.cert, ca.key, ca.file, _ = ca.write(t, "ca", tmpl, nil, nil)
+	return ca
+}
+
+// issue writes a certificate for cn signed by ca and its key, returning
+// their paths. A client certificate has the client auth usage, a server
+// one is valid for 127.0.0.1.
+func (ca *testCA) issue(t testing.TB, cn string, client bool) (certFile, keyFile string) {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		tmpl.IPAddresses = nil
+	}
+	_, _, certFile, keyFile = ca.write(t, cn, tmpl, ca.cert, ca.key)
+	return certFile, keyFile
+}
+
+func (ca *testCA) write(t testing.TB, name string, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.n++
+	tmpl.SerialNumber = big.NewInt(ca.n)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(ca.dir, name+ca.suffix()+".crt")
+	keyFile := filepath.Join(ca.dir, name+ca.suffix()+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return cert, key, certFile, keyFile
+}
+
+func (ca *testCA) suffix() string { return "-" + big.NewInt(ca.n).String() }
+
+func writePEM(t testing.TB, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSBuild(t *testing.T) {
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "server", false)
+	for _, tc := range []struct {
+		name     string
+		settings *tlsSettings
+		wantAuth tls.ClientAuthType
+		wantErr  bool
+	}{
+		{name: "required", settings: &tlsSettings{certFile: cert, keyFile: key, caCertFile: ca.file, authClients: "yes"}, wantAuth: tls.RequireAndVerifyClientCert},
+		{name: "optional", settings: &tlsSettings{certFile: cert, keyFile: key, caCertFile: ca.file, authClients: "optional"}, wantAuth: tls.VerifyClientCertIfGiven},
+		{name: "no client certificates", settings: &tlsSettings{certFile: cert, keyFile: key, authClients: "no"}, wantAuth: tls.NoClientCert},
+		{name: "no CA", settings: &tlsSettings{certFile: cert, keyFile: key, authClients: "yes"}, wantErr: true},
+		{name: "no key", settings: &tlsSettings{certFile: cert, caCertFile: ca.file, authClients: "yes"}, wantErr: true},
+		{name: "key of another certificate", settings: &tlsSettings{certFile: cert, keyFile: ca.file, caCertFile: ca.file, authClients: "yes"}, wantErr: true},
+		{name: "CA file without certificates", settings: &tlsSettings{certFile: cert, keyFile: key, caCertFile: key, authClients: "yes"}, wantErr: true},
+		{name: "bad auth mode", settings: &tlsSettings{certFile: cert, keyFile: key, caCertFile: ca.file, authClients: "maybe"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := tc.settings.build()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("build succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ClientAuth != tc.wantAuth {
+				t.Errorf("ClientAuth = %v, want %v", cfg.ClientAuth, tc.wantAuth)
+			}
+			if cfg.MinVersion != tls.VersionTLS12 {
+				t.Errorf("MinVersion = %x, want TLS 1.2", cfg.MinVersion)
+			}
+		})
+	}
+}
+
+// serveTLSTest serves s over TLS on a loopback port until the test ends
+// and returns its address.
+func serveTLSTest(t testing.TB, s *TrieServer) string {
+	t.Helper()
+	if err := s.tls.reload(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", s.tls.listenerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go redcon.Serve(ln, s.HandleCommand, s.accept, s.closed)
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// tlsPing dials addr presenting cert, if any, and returns the reply to a
+// PING and the certificate the server presented.
+func tlsPing(addr string, ca *testCA, cert []tls.Certificate) (string, *x509.Certificate, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, Certificates: cert})
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+		return "", nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	return line, conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestTLSReload(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "before", false)
+	clientCert, clientKey := ca.issue(t, "client", true)
+	client, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t)
+	s.tls.port = 1
+	s.tls.certFile, s.tls.keyFile, s.tls.caCertFile = certFile, keyFile, ca.file
+	addr := serveTLSTest(t, s)
+	ss := newTestSession(t, s)
+
+	if _, _, err := tlsPing(addr, ca, nil); err == nil {
+		t.Error("handshake without a client certificate succeeded with tls-auth-clients yes")
+	}
+	for _, tc := range []struct {
+		name   string
+		config []string // CONFIG SET arguments, if any
+		wantCN string
+	}{
+		{name: "initial", wantCN: "before"},
+		{name: "bad key keeps the old certificate", config: []string{"tls-key-file", ca.file}, wantCN: "before"},
+		{name: "new pair", config: append([]string{"tls-cert-file"}, ca.pair(t, "after")...), wantCN: "after"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.config != nil {
+				ss.Do(append([]string{"CONFIG", "SET"}, tc.config...)...)
+			}
+			reply, cert, err := tlsPing(addr, ca, []tls.Certificate{client})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply != "+PONG\r\n" {
+				t.Errorf("PING = %q, want +PONG", reply)
+			}
+			if cert.Subject.CommonName != tc.wantCN {
+				t.Errorf("server certificate %q, want %q", cert.Subject.CommonName, tc.wantCN)
+			}
+		})
+	}
+}
+
+// pair issues a server certificate for cn and returns its path, then
+// "tls-key-file" and its key's path, as CONFIG SET arguments.
+func (ca *testCA) pair(t testing.TB, cn string) []string {
+	cert, key := ca.issue(t, cn, false)
+	return []string{cert, "tls-key-file", key}
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// In a database with db-tombstones on, DEL and DELVALUE keep what they
+// delete as a tombstone: the prefix, its value, tags and expiry, when it
+// was deleted and by which client. RESTOREKEY puts the latest one of a
+// prefix back and TOMBSTONES lists them. A tombstone is not a stored
+// prefix, so lookups never match it and DBSIZE does not count it. Each
+// database keeps at most tombstone-max-entries, dropping the oldest, and
+// for at most tombstone-max-age seconds; one whose value has since passed
+// its deadline has nothing left to restore and is passed over. Snapshots
+// keep tombstones, so a restart does not end the undo window. FLUSHDB,
+// DROPDB, expiry and eviction leave none.
+
+// tombstone is one deleted prefix.
+type tombstone struct {
+	prefix    netip.Prefix
+	value     value
+	deletedAt int64  // unix milliseconds
+	by        string // the deleting client, as tombstoneBy describes it
+}
+
+// graveyard holds a database's tombstones, oldest first. Deletions add to
+// it under the prefix's shard lock, so a snapshot, which holds every
+// shard, sees it as of the data it saves.
+type graveyard struct {
+	mu     sync.Mutex
+	stones []tombstone
+}
+
+// add keeps t, dropping the oldest tombstones past max.
+func (g *graveyard) add(t tombstone, max int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.stones = append(g.stones, t)
+	g.trimLocked(max)
+}
+
+// trim drops the oldest tombstones past max.
+func (g *graveyard) trim(max int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.trimLocked(max)
+}
+
+func (g *graveyard) trimLocked(max int64) {
+	if over := int64(len(g.stones)) - max; over > 0 {
+		g.stones = slices.Delete(g.stones, 0, int(over))
+	}
+}
+
+// purge drops the tombstones deleted at or before cutoff, in unix
+// milliseconds, which are the oldest.
+func (g *graveyard) purge(cutoff int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for n < len(g.stones) && g.stones[n].deletedAt <= cutoff {
+		n++
+	}
+	g.stones = slices.Delete(g.stones, 0, n)
+}
+
+// latestLocked returns the index of p's latest tombstone with a value
+// still to restore, or -1.
+func (g *graveyard) latestLocked(p netip.Prefix) int {
+	for i := len(g.stones) - 1; i >= 0; i-- {
+		if t := g.stones[i]; t.prefix == p && !t.value.expired() {
+			return i
+		}
+	}
+	return -1
+}
+
+func (g *graveyard) has(p netip.Prefix) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.latestLocked(p) >= 0
+}
+
+// take removes and returns the latest tombstone of p.
+func (g *graveyard) take(p netip.Prefix) (tombstone, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	i := g.latestLocked(p)
+	if i < 0 {
+		return tombstone{}, false
+	}
+	t := g.stones[i]
+	g.stones = slices.Delete(g.stones, i, i+1)
+	return t, true
+}
+
+// list returns the tombstones with a value still to restore of prefixes
+// within within, every one if it is the zero Prefix, oldest first.
+func (g *graveyard) list(within netip.Prefix) []tombstone {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]tombstone, 0, len(g.stones))
+	for _, t := range g.stones {
+		if !t.value.expired() && (!within.IsValid() || covers(within, t.prefix)) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func (g *graveyard) len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.stones)
+}
+
+// purgeTombstones drops d's tombstones past tombstone-max-age.
+func (d *database) purgeTombstones(now time.Time) {
+	if age := d.opts.tombstoneAge.Load(); age > 0 {
+		d.graves.purge(now.Add(-time.Duration(age) * time.Second).UnixMilli())
+	}
+}
+
+// buryLocked deletes p, whose value is old, for callers holding sh, p's
+// shard, write locked, keeping a tombstone of it unless by is empty.
+func (d *database) buryLocked(sh *shard, p netip.Prefix, old value, by string) {
+	d.removeLocked(sh, p, old)
+	if by != "" && !old.expired() {
+		old.access = nil
+		d.graves.add(tombstone{prefix: p, value: old, deletedAt: time.Now().UnixMilli(), by: by},
+			d.opts.tombstoneMax.Load())
+	}
+}
+
+// restore puts back the latest tombstone of p. It reports false if there
+// is none, and errBusyKey if p is stored and replace is not set.
+func (d *database) restore(p netip.Prefix, replace bool) (bool, error) {
+	sh := d.shardFor(p)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	d.purgeTombstones(time.Now())
+	live, ok := sh.trie.Get(p)
+	if ok && !live.expired() && !replace {
+		if d.graves.has(p) {
+			return false, errBusyKey
+		}
+		return false, nil
+	}
+	t, has := d.graves.take(p)
+	if !has {
+		return false, nil
+	}
+	if ok {
+		d.removeLocked(sh, p, live) // so the restored value keeps its own tags
+	}
+	d.storeLocked(sh, p, t.value, true)
+	return true, nil
+}
+
+var errBusyKey = newError(ClassBusyKey, "Target key name already exists.")
+
+// tombstoneBy describes c for the tombstones of its deletions from
+// database id, or returns "" if the database keeps none.
+func (s *TrieServer) tombstoneBy(c *client, id int) string {
+	if !s.tombstoneDBs.has(id) {
+		return ""
+	}
+	user, _ := s.userFor(c)
+	return fmt.Sprintf("id=%d addr=%s user=%s", c.id, c.addr, user)
+}
+
+// handleRestoreKey implements RESTOREKEY cidr [REPLACE]: it undoes the
+// latest deletion of exactly cidr in the current database and replies 1,
+// or 0 if there is no tombstone of it. If cidr has been stored again
+// since, it is replaced with REPLACE and a BUSYKEY error otherwise.
+func (s *TrieServer) handleRestoreKey(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for 'RESTOREKEY'")
+		return
+	}
+	replace := len(cmd.Args) == 3
+	if replace && !strings.EqualFold(string(cmd.Args[2]), "REPLACE") {
+		conn.WriteError("ERR syntax error")
+		return
+	}
+	cidr := string(cmd.Args[1])
+	db := s.getDB(currentDB(conn))
+	p, err := db.parseSetKey(cidr)
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	restored, err := db.restore(p, replace)
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	if !restored {
+		conn.WriteInt(0)
+		return
+	}
+	db.writes.add(uint64(c.id), 1)
+	s.audit(c, "RESTOREKEY", cidr)
+	conn.WriteInt(1)
+}
+
+// handleTombstones implements TOMBSTONES [WITHIN cidr]: the current
+// database's tombstones, of prefixes within cidr if given, latest first.
+// Each is a map of the prefix, its type, its value (nil for a hash or
+// set), its deadline in unix milliseconds (-1 if none), when it was
+// deleted in unix milliseconds and by which client.
+func (s *TrieServer) handleTombstones(conn redcon.Conn, cmd redcon.Command) {
+	var within netip.Prefix
+	switch {
+	case len(cmd.Args) == 3 && strings.EqualFold(string(cmd.Args[1]), "WITHIN"):
+		p, err := parsePrefix(string(cmd.Args[2]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		within = p
+	case len(cmd.Args) != 1:
+		conn.WriteError("ERR syntax error")
+		return
+	}
+	var stones []tombstone
+	if db := s.existingDB(currentDB(conn)); db != nil {
+		db.purgeTombstones(time.Now())
+		stones = db.graves.list(within)
+	}
+	conn.WriteArray(len(stones))
+	for i := len(stones) - 1; i >= 0; i-- {
+		t := stones[i]
+		conn.WriteArray(12)
+		conn.WriteBulkString("prefix")
+		conn.WriteBulkString(t.prefix.String())
+		conn.WriteBulkString("type")
+		conn.WriteBulkString(t.value.typeName())
+		conn.WriteBulkString("value")
+		if t.value.isString() {
+			conn.WriteBulk(t.value.str)
+		} else {
+			conn.WriteNull()
+		}
+		conn.WriteBulkString("expireat")
+		if t.value.expireAt != 0 {
+			conn.WriteInt64(t.value.expireAt)
+		} else {
+			conn.WriteInt(-1)
+		}
+		conn.WriteBulkString("deleted-at")
+		conn.WriteInt64(t.deletedAt)
+		conn.WriteBulkString("deleted-by")
+		conn.WriteBulkString(t.by)
+	}
+}
+
+// registerTombstoneConfig exposes db-tombstones and the tombstone limits.
+func (s *TrieServer) registerTombstoneConfig() {
+	s.addConfig("db-tombstones", s.tombstoneDBs.String, s.tombstoneDBs.Set)
+	s.addConfig("tombstone-max-entries",
+		func() string { return strconv.FormatInt(s.store.tombstoneMax.Load(), 10) },
+		func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 {
+				return fmt.Errorf("argument must be a positive number of tombstones")
+			}
+			s.store.tombstoneMax.Store(n)
+			for _, db := range s.databases() {
+				db.graves.trim(n)
+			}
+			return nil
+		})
+	s.addConfig("tombstone-max-age",
+		func() string { return strconv.FormatInt(s.store.tombstoneAge.Load(), 10) },
+		func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("argument must be a non-negative number of seconds")
+			}
+			s.store.tombstoneAge.Store(n)
+			return nil
+		})
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tombstoneList returns TOMBSTONES on ss as prefix=value strings, the
+// value "<type>" for a hash or set.
+func tombstoneList(t *testing.T, ss *testSession, args ...string) []string {
+	t.Helper()
+	var out []string
+	for _, r := range mustDo(t, ss, append([]string{"TOMBSTONES"}, args...)...).Array {
+		f := make(map[string]Reply)
+		for i := 0; i+1 < len(r.Array); i += 2 {
+			f[r.Array[i].Str] = r.Array[i+1]
+		}
+		v := f["value"].String()
+		if f["type"].Str != "string" {
+			v = "<" + f["type"].Str + ">"
+		}
+		out = append(out, f["prefix"].Str+"="+v)
+	}
+	return out
+}
+
+func TestTombstones(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "db-tombstones", "0 yes"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"TAG", "10.0.0.0/8", "ADD", "edge"}, "1"},
+		{[]string{"SET", "10.1.0.0/16", "b", "EX", "100"}, "OK"},
+		{[]string{"HSET", "192.0.2.0/24", "asn", "64500"}, "1"},
+		{[]string{"DEL", "10.0.0.0/8", "192.0.2.0/24"}, "2"},
+		{[]string{"GET", "10.2.3.4"}, "nil"}, // tombstones never match
+		{[]string{"DBSIZE"}, "1"},
+	})
+	if got, want := tombstoneList(t, ss), []string{"192.0.2.0/24=<hash>", "10.0.0.0/8=a"}; !slices.Equal(got, want) {
+		t.Errorf("TOMBSTONES = %q, want %q", got, want)
+	}
+	if info := infoFields(mustDo(t, ss, "INFO", "keyspace").Str)["db0"]; !strings.Contains(info, ",tombstones=2") {
+		t.Errorf("INFO keyspace db0:%s, want tombstones=2", info)
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"RESTOREKEY", "10.0.0.0/8"}, "1"},
+		{[]string{"GET", "10.2.3.4"}, "a"},
+		{[]string{"TAG", "10.0.0.0/8", "LIST"}, "[edge]"}, // tags come back too
+		{[]string{"RESTOREKEY", "10.0.0.0/8"}, "0"},       // only one deletion to undo
+		{[]string{"RESTOREKEY", "192.0.2.0/24"}, "1"},
+		{[]string{"HGET", "192.0.2.0/24", "asn"}, "64500"},
+
+		// A later deletion is undone first, and a prefix stored again is
+		// only replaced with REPLACE.
+		{[]string{"DEL", "10.1.0.0/16"}, "1"},
+		{[]string{"SET", "10.1.0.0/16", "c"}, "OK"},
+		{[]string{"DEL", "10.1.0.0/16"}, "1"},
+		{[]string{"SET", "10.1.0.0/16", "d"}, "OK"},
+		{[]string{"RESTOREKEY", "10.1.0.0/16"}, "BUSYKEY Target key name already exists."},
+		{[]string{"RESTOREKEY", "10.1.0.0/16", "replace"}, "1"},
+		{[]string{"GET", "10.1.2.3"}, "c"},
+		{[]string{"RESTOREKEY", "10.1.0.0/16", "REPLACE"}, "1"},
+		{[]string{"GET", "10.1.2.3"}, "b"},
+		{[]string{"TTL", "10.1.0.0/16"}, "100"}, // with its deadline
+		{[]string{"RESTOREKEY", "10.1.0.0/16", "REPLACE"}, "0"},
+
+		{[]string{"CONFIG", "SET", "value-index", "yes"}, "OK"},
+		{[]string{"SET", "198.51.100.0/24", "AS1"}, "OK"},
+		{[]string{"SET", "203.0.113.0/24", "AS1"}, "OK"},
+		{[]string{"DELVALUE", "AS1"}, "2"},
+	})
+	if got, want := tombstoneList(t, ss, "WITHIN", "192.0.0.0/3"), []string{"203.0.113.0/24=AS1", "198.51.100.0/24=AS1"}; !slices.Equal(got, want) {
+		t.Errorf("TOMBSTONES WITHIN 192.0.0.0/3 = %q, want %q", got, want)
+	}
+	r := mustDo(t, ss, "TOMBSTONES").Array[0]
+	if by := r.Array[11].Str; !strings.HasPrefix(by, "id=") || !strings.Contains(by, " user=default") {
+		t.Errorf("deleted-by %q", by)
+	}
+	if at := r.Array[9].Int; at < time.Now().Add(-time.Minute).UnixMilli() || r.Array[7].Int != -1 {
+		t.Errorf("TOMBSTONES entry %s", r)
+	}
+
+	mustDo(t, ss, "FLUSHDB") // keeps no tombstones of what it deletes
+	if got := tombstoneList(t, ss); len(got) != 2 {
+		t.Errorf("TOMBSTONES after FLUSHDB = %q, want the two DELVALUE left", got)
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"SELECT", "1"}, "OK"}, // which keeps none
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"DEL", "10.0.0.0/8"}, "1"},
+		{[]string{"TOMBSTONES"}, "[]"},
+		{[]string{"RESTOREKEY", "10.0.0.0/8"}, "0"},
+		{[]string{"RESTOREKEY", "nope"}, "ERR"},
+		{[]string{"RESTOREKEY", "10.0.0.0/8", "NX"}, "ERR syntax error"},
+		{[]string{"RESTOREKEY"}, "ERR wrong number of arguments for 'RESTOREKEY'"},
+		{[]string{"TOMBSTONES", "WITHIN"}, "ERR syntax error"},
+		{[]string{"TOMBSTONES", "WITHIN", "nope"}, "ERR"},
+	})
+}
+
+func TestTombstoneLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config []string
+		sleep  time.Duration
+		want   []string
+	}{
+		{"kept", nil, 0, []string{"10.3.0.0/16=d", "10.2.0.0/16=c", "10.1.0.0/16=b"}},
+		{"max entries drops the oldest", []string{"tombstone-max-entries", "2"}, 0, []string{"10.3.0.0/16=d", "10.2.0.0/16=c"}},
+		{"max age", []string{"tombstone-max-age", "1"}, 1100 * time.Millisecond, nil},
+		{"no max age", []string{"tombstone-max-age", "0"}, 1100 * time.Millisecond, []string{"10.3.0.0/16=d", "10.1.0.0/16=b"}},
+		{"a value past its deadline", nil, 250 * time.Millisecond, []string{"10.3.0.0/16=d", "10.1.0.0/16=b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := newTestSession(t, newTestServer(t))
+			mustDo(t, ss, "CONFIG", "SET", "db-tombstones", "0 yes")
+			mustDo(t, ss, "SET", "10.1.0.0/16", "b")
+			mustDo(t, ss, "SET", "10.2.0.0/16", "c", "PX", "200")
+			mustDo(t, ss, "SET", "10.3.0.0/16", "d")
+			mustDo(t, ss, "DEL", "10.1.0.0/16", "10.2.0.0/16", "10.3.0.0/16")
+			if tc.config != nil {
+				mustDo(t, ss, append([]string{"CONFIG", "SET"}, tc.config...)...)
+			}
+			time.Sleep(tc.sleep)
+			if got := tombstoneList(t, ss); !slices.Equal(got, tc.want) {
+				t.Errorf("TOMBSTONES = %q, want %q", got, tc.want)
+			}
+		})
+	}
+	runSteps(t, newTestSession(t, newTestServer(t)), []replyStep{
+		{[]string{"CONFIG", "SET", "tombstone-max-entries", "0"}, "ERR"},
+		{[]string{"CONFIG", "SET", "tombstone-max-age", "-1"}, "ERR"},
+		{[]string{"CONFIG", "SET", "db-tombstones", "0"}, "ERR"},
+		{[]string{"CONFIG", "GET", "tombstone-max-entries"}, "[tombstone-max-entries 10000]"},
+	})
+}
+
+// TestTombstoneSnapshot checks tombstones outlive a restart, including in
+// a database with no data left.
+func TestTombstoneSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "dir", dir}, "OK"},
+		{[]string{"CONFIG", "SET", "db-tombstones", "0 yes 2 yes"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		{[]string{"SADD", "10.1.0.0/16", "tor"}, "1"},
+		{[]string{"DEL", "10.1.0.0/16"}, "1"},
+		{[]string{"SELECT", "2"}, "OK"},
+		{[]string{"SET", "192.0.2.0/24", "gone"}, "OK"},
+		{[]string{"DEL", "192.0.2.0/24"}, "1"},
+		{[]string{"SAVE"}, "OK"},
+	})
+	s := newTestServer(t)
+	if _, err := loadSnapshotFile(s, filepath.Join(dir, "dump.tdb"), true, true); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newTestSession(t, s)
+	if got := tombstoneList(t, loaded); !slices.Equal(got, []string{"10.1.0.0/16=<set>"}) {
+		t.Errorf("db 0 TOMBSTONES after the load = %q", got)
+	}
+	mustDo(t, loaded, "SELECT", "2")
+	runSteps(t, loaded, []replyStep{
+		{[]string{"DBSIZE"}, "0"},
+		{[]string{"RESTOREKEY", "192.0.2.0/24"}, "1"},
+		{[]string{"GET", "192.0.2.1"}, "gone"},
+	})
+}
@@ -0,0 +1,815 @@
+// Package server is the triedis server: its databases, commands and
+// snapshots. The triedis command wraps it in flags and listeners; another
+// Go program can embed it instead and run commands through a Session,
+// without a socket:
+//
+//	srv, err := server.NewTrieServer(server.DefaultOptions())
+//	if err != nil {
+//		return err
+//	}
+//	sess := srv.NewSession()
+//	defer sess.Close()
+//	sess.Do("SET", "10.0.0.0/8", "office")
+//	r := sess.Do("GET", "10.1.2.3") // r.Str == "office"
+//
+// SaveSnapshot and LoadSnapshot write and read snapshot files, and Open
+// loads the data at startup as the triedis command does.
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// TrieServer maintains one trie per logical DB (matching Redis’s
+// integer‑indexed databases).
+type TrieServer struct {
+	dbsMu        sync.RWMutex // guards dbs; each database locks its own trie
+	dbs          map[int]*database
+	names        *dbNames
+	readOnlyDBs  *dbFlags
+	tombstoneDBs *dbFlags
+	defaults     *dbDefaults
+
+	config   map[string]*configParam
+	configMu sync.Mutex // serializes CONFIG SET
+	tls      *tlsSettings
+
+	clients    *clientRegistry
+	identities atomic.Pointer[identityMap]
+	listeners  []*listener // bound at startup, read-only afterwards
+
+	defaultPermission atomic.Int32 // of clients without a certificate once identities has entries
+
+	maxClientsPerIP atomic.Int64               // connections from one IP beyond this are refused, 0 disables
+	perIPExempt     atomic.Pointer[prefixList] // networks maxclients-per-ip does not apply to
+	noEvictUsers    atomic.Pointer[userSet]    // users whose clients are no-evict
+	shards          atomic.Pointer[shardMap]   // node ownership OWNER reports
+	outputLimits    atomic.Pointer[outputLimits]
+
+	timeout       atomic.Int64 // idle client timeout in seconds, 0 disables
+	tcpKeepAlive  atomic.Int64 // keepalive period for new sockets in seconds, 0 disables
+	writeTimeout  atomic.Int64 // seconds a reply may take to flush, 0 disables
+	idleClosed    atomic.Int64 // clients closed by the idle timeout
+	maxClients    atomic.Int64 // connections beyond this are refused
+	inputPeak     recentPeak   // largest recent command, in bytes
+	outputPeak    recentPeak   // largest recent reply flush, in bytes
+	stats         serverStats
+	cmdStats      commandStats
+	slowLogUsec   atomic.Int64 // log commands slower than this, -1 disables
+	subtreeMax    atomic.Int64 // SUBNETS and TREEGET entries without CURSOR, 0 unlimited
+	cmdTimeout    atomic.Int64 // command execution budget in milliseconds, 0 unlimited
+	classTimeouts atomic.Pointer[classTimeouts]
+	auditLog      *auditLog
+	webhooks      *webhooks
+	journal       *opJournal
+	tracing       tracing
+	preloadState  preloadState
+	debugCommand  string      // enable-debug-command: yes, no or local
+	readOnly      atomic.Bool // refuse every cmdWrite command
+	store         storeOptions
+	scanCursors   scanCursors
+	stages        stages
+	snapshots     snapshotState
+	reloader      *fileReloader // nil without -reload-file
+	lazyFree      *lazyFreer
+	evict         evictor
+	rateLimit     rateLimiter
+
+	started       time.Time
+	startupMemory int64  // heap allocated once the server was built
+	runID         string // random per boot, like Redis's run_id
+	configFile    string // no config file support yet; reported empty
+}
+
+// newTrieServer returns a server with every setting at its zero value,
+// for configure to set.
+func newTrieServer() *TrieServer {
+	s := &TrieServer{
+		dbs:          make(map[int]*database),
+		names:        newDBNames(),
+		readOnlyDBs:  newDBFlags(),
+		tombstoneDBs: newDBFlags(),
+		defaults:     newDBDefaults(),
+		config:       make(map[string]*configParam),
+		tls:          &tlsSettings{authClients: "yes"},
+		clients:      newClientRegistry(),
+		cmdStats:     newCommandStats(),
+		auditLog:     newAuditLog(),
+		snapshots:    snapshotState{dir: ".", dbFilename: "dump.tdb"},
+		webhooks:     newWebhooks(),
+		journal:      newOpJournal(),
+		lazyFree:     newLazyFreer(),
+		started:      time.Now(),
+		runID:        newRunID(),
+	}
+	s.identities.Store(&identityMap{})
+	s.defaultPermission.Store(int32(permReadOnly))
+	s.evict.samples.Store(5)
+	s.store.tombstoneMax.Store(10000)
+	s.snapshots.compressionLevel.Store(6)
+	s.perIPExempt.Store(&prefixList{})
+	s.rateLimit.users.Store(&rateOverrides{})
+	s.noEvictUsers.Store(&userSet{})
+	s.shards.Store(&shardMap{})
+	s.classTimeouts.Store(&classTimeouts{-1, -1, -1})
+	limits, _ := parseOutputLimits(outputLimits{}, defaultOutputLimits)
+	s.outputLimits.Store(&limits)
+	s.tls.registerConfig(s)
+	s.registerAuthConfig()
+	s.registerClientConfig()
+	s.registerRateLimitConfig()
+	s.registerNoEvictConfig()
+	s.registerOutputLimitConfig()
+	s.registerDebugConfig()
+	s.registerDBConfig()
+	s.registerValueIndexConfig()
+	s.registerAuditConfig()
+	s.registerWebhookConfig()
+	s.registerSnapshotConfig()
+	s.registerJournalConfig()
+	s.registerEvictionConfig()
+	s.registerSubtreeConfig()
+	s.registerShardMapConfig()
+	s.registerTombstoneConfig()
+	s.registerQuotaConfig()
+	s.registerTimeoutConfig()
+	s.registerTracingConfig()
+	s.startupMemory = heapAlloc()
+	return s
+}
+
+// newRunID returns 40 random hex characters.
+func newRunID() string {
+	var b [20]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// getDB returns the database for the given id, lazily creating it.
+func (s *TrieServer) getDB(id int) *database {
+	if db := s.existingDB(id); db != nil {
+		return db
+	}
+	s.dbsMu.Lock()
+	defer s.dbsMu.Unlock()
+	db := s.dbs[id]
+	if db == nil { // another client may have created it meanwhile
+		db = newDatabase(id, &s.store)
+		s.dbs[id] = db
+	}
+	return db
+}
+
+// dropDB removes database id, returning it, or nil if it did not exist.
+// Like FLUSHDB, a write racing the drop may land in the removed database
+// and be lost.
+func (s *TrieServer) dropDB(id int) *database {
+	s.dbsMu.Lock()
+	defer s.dbsMu.Unlock()
+	db := s.dbs[id]
+	delete(s.dbs, id)
+	return db
+}
+
+// replaceDB makes db database id, returning the one it replaces, or nil.
+// A command already running against the old one finishes there, so, as
+// with dropDB, a racing write may be lost.
+func (s *TrieServer) replaceDB(id int, db *database) *database {
+	s.dbsMu.Lock()
+	defer s.dbsMu.Unlock()
+	old := s.dbs[id]
+	s.dbs[id] = db
+	return old
+}
+
+// existingDB returns the database for id, or nil if it was never created.
+func (s *TrieServer) existingDB(id int) *database {
+	s.dbsMu.RLock()
+	defer s.dbsMu.RUnlock()
+	return s.dbs[id]
+}
+
+// databases returns every database ordered by id.
+func (s *TrieServer) databases() []*database {
+	s.dbsMu.RLock()
+	out := make([]*database, 0, len(s.dbs))
+	for _, db := range s.dbs {
+		out = append(out, db)
+	}
+	s.dbsMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+// currentDB looks up the database index stored in the connection context.
+func currentDB(conn redcon.Conn) int {
+	if c := clientOf(conn); c != nil {
+		return int(c.db.Load())
+	}
+	return 0 // default DB 0, like Redis
+}
+
+// writeOK writes a simple string "+OK\r\n". redcon adds the "+" and CRLF.
+func writeOK(conn redcon.Conn) {
+	conn.WriteString("OK")
+}
+
+// HandleCommand implements the redcon handler signature. A run of GETs
+// at the head of a pipeline is taken over by handlePipeline.
+func (s *TrieServer) HandleCommand(conn redcon.Conn, cmd redcon.Command) {
+	if c := clientOf(conn); c != nil && isPlainGet(cmd) {
+		if next := conn.PeekPipeline(); len(next) > 0 && isPlainGet(next[0]) {
+			s.handlePipeline(conn, c, append([]redcon.Command{cmd}, conn.ReadPipeline()...))
+			return
+		}
+	}
+	s.handleCommand(conn, cmd)
+}
+
+// handleCommand runs one command of conn.
+func (s *TrieServer) handleCommand(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) == 0 {
+		conn.WriteError("ERR empty command")
+		return
+	}
+	name := commandName(cmd.Args[0])
+
+	c := clientOf(conn)
+	conn = c.out
+	if c.loading != nil {
+		s.loadEntry(conn, c, cmd)
+		return
+	}
+	if !c.identified {
+		s.identify(c)
+	}
+	user, perm := s.userFor(c)
+	s.noteUser(c, user)
+	if !s.throttle(conn, c, user) {
+		s.cmdStats.reject(name)
+		return
+	}
+	start := time.Now()
+	c.lastActive.Store(start.UnixNano())
+	s.inputPeak.observe(int64(len(cmd.Raw)), start)
+	s.extendWriteDeadline(c)
+	if c.lastCmd != name { // only this goroutine writes it, so it is read unlocked
+		c.mu.Lock()
+		c.lastCmd = name
+		c.mu.Unlock()
+	}
+	f := commandTable[name]
+	if !perm.allows(f) {
+		s.cmdStats.reject(name)
+		slog.Warn("permission denied", "client", c.id, "addr", c.addr,
+			"user", user, "identity", c.identity, "cmd", name)
+		writeError(conn, errNoPerm(user, strings.ToLower(name)))
+		return
+	}
+	if f&cmdAdmin == 0 && !journalExempt[name] {
+		if err := s.journal.refusal(currentDB(conn)); err != nil {
+			s.cmdStats.reject(name)
+			writeError(conn, err)
+			return
+		}
+	}
+	if f&cmdWrite != 0 {
+		if err := s.writeAllowed(currentDB(conn), f); err != nil {
+			s.cmdStats.reject(name)
+			writeError(conn, err)
+			return
+		}
+	}
+
+	s.begin(c, f, start)
+	if sp := s.startSpan(conn, c, name, cmd); sp != nil {
+		s.execute(sp, c, name, cmd)
+		s.finish(sp)
+	} else {
+		s.execute(conn, c, name, cmd)
+	}
+	if c.budget.spent {
+		s.stats.abortedCmds.Add(1)
+	}
+	elapsed := time.Since(start)
+	s.cmdStats.record(name, elapsed)
+	if limit := s.slowLogUsec.Load(); limit >= 0 && elapsed.Microseconds() >= limit {
+		slog.Warn("slow command", "client", c.id, "addr", c.addr, "cmd", name,
+			"args", len(cmd.Args)-1, "duration", elapsed)
+	}
+}
+
+// writeAllowed reports why a write with flags f to database id is
+// refused: the server or the database is read-only, or memory is over
+// maxmemory and cannot be freed. A cmdDBArg write checks its database
+// itself.
+func (s *TrieServer) writeAllowed(id int, f cmdFlags) error {
+	err := s.writable(id)
+	if s.readOnly.Load() {
+		err = newError(ClassReadOnly, "You can't write against a read only server")
+	} else if f&cmdDBArg != 0 {
+		err = nil
+	}
+	if err == nil && f&cmdFrees == 0 {
+		err = s.freeMemory()
+	}
+	return err
+}
+
+// execute runs one authorized command.
+func (s *TrieServer) execute(conn redcon.Conn, c *client, name string, cmd redcon.Command) {
+	switch name {
+	case "PING":
+		conn.WriteString("PONG")
+
+	case "ECHO":
+		// redis-cli --pipe ends its stream with ECHO of a random payload
+		// and stops reading replies once that comes back.
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for 'ECHO'")
+			return
+		}
+		conn.WriteBulk(cmd.Args[1])
+
+	case "SELECT":
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for 'SELECT'")
+			return
+		}
+		id, err := s.resolveDB(string(cmd.Args[1]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		c.db.Store(int64(id))
+		writeOK(conn)
+
+	case "SET", "SETEX", "PSETEX":
+		s.handleSetString(conn, c, name, cmd)
+
+	case "SETIF":
+		s.handleSetIf(conn, c, cmd)
+
+	case "TTL", "PTTL":
+		s.handleTTL(conn, name, cmd)
+
+	case "GET":
+		// GET ip [MINLEN n] [MAXLEN n]: the longest stored prefix
+		// containing ip, of those within the given lengths, or the
+		// database's default value if it has one and none does. See
+		// CLIENT LPM for a CIDR without them.
+		if len(cmd.Args) < 2 || len(cmd.Args)%2 != 0 {
+			conn.WriteError("ERR wrong number of arguments for 'GET'")
+			return
+		}
+		key := string(cmd.Args[1])
+		db := s.getDB(currentDB(conn))
+
+		var v value
+		var ok bool
+		if len(cmd.Args) == 2 {
+			v, ok = c.lookupGet(db, key)
+		} else {
+			minLen, maxLen, err := parseLengthBounds(cmd.Args[2:])
+			if err != nil {
+				writeError(conn, err)
+				return
+			}
+			if p, perr := db.parseLookup(key); perr == nil {
+				if maxLen < 0 {
+					maxLen = p.Bits()
+				}
+				if bits := p.Addr().BitLen(); minLen > bits || maxLen > bits {
+					family := "IPv4"
+					if bits == 128 {
+						family = "IPv6"
+					}
+					conn.WriteError(fmt.Sprintf("ERR MINLEN and MAXLEN must be between 0 and %d for %s", bits, family))
+					return
+				}
+				_, v, ok = db.longestMatchWithin(p, minLen, maxLen)
+			}
+		}
+		if ok {
+			db.hits.add(uint64(c.id), 1)
+			if !v.isString() {
+				writeError(conn, errWrongType)
+				return
+			}
+			conn.WriteBulk(v.str)
+		} else {
+			db.misses.add(uint64(c.id), 1)
+			if def, ok := s.missDefault(db, key); ok {
+				conn.WriteBulk(def)
+			} else {
+				conn.WriteNull()
+			}
+		}
+
+	case "MGET":
+		s.handleMGet(conn, c, cmd)
+
+	case "SPM":
+		// SPM ip [WITHPREFIX]: the least specific stored prefix containing
+		// ip, ignoring every more specific one. A miss answers with the
+		// database's default value, if any, whose prefix is nil.
+		withPrefix := len(cmd.Args) == 3 && strings.EqualFold(string(cmd.Args[2]), "WITHPREFIX")
+		if len(cmd.Args) != 2 && !withPrefix {
+			if len(cmd.Args) == 3 {
+				conn.WriteError("ERR syntax error")
+			} else {
+				conn.WriteError("ERR wrong number of arguments for 'SPM'")
+			}
+			return
+		}
+		db := s.getDB(currentDB(conn))
+		p, v, ok := db.shortestMatch(string(cmd.Args[1]))
+		if !ok {
+			db.misses.add(uint64(c.id), 1)
+			def, ok := s.missDefault(db, string(cmd.Args[1]))
+			switch {
+			case !ok:
+				conn.WriteNull()
+			case withPrefix:
+				conn.WriteArray(2)
+				conn.WriteNull()
+				conn.WriteBulk(def)
+			default:
+				conn.WriteBulk(def)
+			}
+			return
+		}
+		db.hits.add(uint64(c.id), 1)
+		if !v.isString() {
+			writeError(conn, errWrongType)
+			return
+		}
+		if withPrefix {
+			conn.WriteArray(2)
+			conn.WriteBulkString(p.String())
+		}
+		conn.WriteBulk(v.str)
+
+	case "DEL":
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for 'DEL'")
+			return
+		}
+		db := s.getDB(currentDB(conn))
+		// Refuse the whole command before deleting anything.
+		for _, raw := range cmd.Args[1:] {
+			if _, err := db.parseKey(string(raw)); errors.Is(err, errBareIP) {
+				writeError(conn, err)
+				return
+			}
+		}
+		var removed []string
+		by := s.tombstoneBy(c, db.id)
+		for _, raw := range cmd.Args[1:] {
+			cidr := string(raw)
+			if db.del(cidr, by) {
+				removed = append(removed, cidr)
+			}
+		}
+		if len(removed) > 0 {
+			db.writes.add(uint64(c.id), 1)
+			s.audit(c, name, removed...)
+		}
+		conn.WriteInt(len(removed))
+
+	case "DBSIZE":
+		fam := familyAny
+		switch {
+		case len(cmd.Args) == 3 && strings.EqualFold(string(cmd.Args[1]), "FAMILY"):
+			var ok bool
+			if fam, ok = parseFamily(string(cmd.Args[2])); !ok {
+				conn.WriteError("ERR FAMILY must be v4 or v6")
+				return
+			}
+		case len(cmd.Args) != 1:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		db := s.getDB(currentDB(conn))
+		switch fam {
+		case family4:
+			conn.WriteInt64(db.keys4.Load())
+		case family6:
+			conn.WriteInt64(db.keys6.Load())
+		default:
+			conn.WriteInt64(db.keyCount())
+		}
+
+	case "FLUSHDB":
+		lazy, ok := s.parseFlushMode(cmd.Args[1:])
+		if !ok {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		db := s.getDB(currentDB(conn))
+		db.flush(s.freer(lazy))
+		db.writes.add(uint64(c.id), 1)
+		s.audit(c, name)
+		writeOK(conn)
+
+	case "FLUSHFAMILY":
+		s.handleFlushFamily(conn, c, cmd)
+
+	case "KEYS":
+		s.handleKeys(conn, c, cmd)
+
+	case "FIRSTKEY", "NEXTKEY":
+		s.handleKeyCursor(conn, name, cmd)
+
+	case "MATCHDBS":
+		s.handleMatchDBs(conn, c, cmd)
+
+	case "OWNER":
+		s.handleOwner(conn, cmd)
+
+	case "TOMBSTONES":
+		s.handleTombstones(conn, cmd)
+
+	case "LCP":
+		s.handleLCP(conn, cmd)
+
+	case "LCPKEYS":
+		s.handleLCPKeys(conn, cmd)
+
+	case "JOURNAL":
+		s.handleJournal(conn, cmd)
+
+	case "RESTOREKEY":
+		s.handleRestoreKey(conn, c, cmd)
+
+	case "SHARDMAP":
+		s.handleShardMap(conn, cmd)
+
+	case "SUBNETS", "TREEGET":
+		s.handleSubtree(conn, c, name, cmd)
+
+	case "TAG":
+		s.handleTag(conn, c, cmd)
+
+	case "TAGKEYS":
+		s.handleTagKeys(conn, cmd)
+
+	case "VKEYS", "VCOUNT":
+		s.handleValueIndex(conn, name, cmd)
+
+	case "DELVALUE":
+		s.handleDelValue(conn, c, cmd)
+
+	case "TREEEXPIRE":
+		s.handleTreeExpire(conn, c, cmd)
+
+	case "SCAN":
+		s.handleScan(conn, cmd)
+
+	case "IMPORT":
+		s.handleImport(conn, c, cmd)
+
+	case "DUMPALL":
+		s.handleDumpAll(conn, c, cmd)
+
+	case "LOADALL":
+		s.handleLoadAll(conn, c, cmd)
+
+	case "EXPORT":
+		s.handleExport(conn, cmd)
+
+	case "JSET", "JGET", "JDEL":
+		s.handleJSON(conn, c, name, cmd)
+
+	case "HSET", "HGET", "HMGET", "HGETALL", "HDEL", "HEXISTS", "HLOOKUP":
+		s.handleHash(conn, c, name, cmd)
+
+	case "SADD", "SREM", "SMEMBERS", "SCARD", "SISMEMBER", "SMATCH":
+		s.handleSet(conn, c, name, cmd)
+
+	case "INCR", "DECR", "INCRBY", "DECRBY", "INCRBYFLOAT":
+		s.handleIncr(conn, c, name, cmd)
+
+	case "APPEND":
+		s.handleAppend(conn, c, cmd)
+
+	case "STRLEN":
+		s.handleStrlen(conn, cmd)
+
+	case "GETRANGE":
+		s.handleGetRange(conn, cmd)
+
+	case "OBJECT":
+		s.handleObject(conn, cmd)
+
+	case "TOUCH":
+		s.handleTouch(conn, cmd)
+
+	case "TYPE":
+		s.handleType(conn, cmd)
+
+	case "DBDIFF":
+		s.handleDBDiff(conn, c, cmd)
+
+	case "DBMERGE":
+		s.handleDBMerge(conn, c, cmd)
+
+	case "LOADSTAGE", "COMMITSTAGE", "ABORTSTAGE":
+		s.handleStage(conn, c, name, cmd)
+
+	case "DROPDB":
+		s.handleDropDB(conn, c, cmd)
+
+	case "SHOWDBS":
+		s.handleShowDBs(conn, cmd)
+
+	case "NAMEDB":
+		s.handleNameDB(conn, cmd)
+
+	case "WAITAOF":
+		s.handleWaitAOF(conn, cmd)
+
+	case "SAVE", "BGSAVE", "LASTSAVE":
+		s.handleSave(conn, name, cmd)
+
+	case "SNAPSHOTINFO":
+		s.handleSnapshotInfo(conn, cmd)
+
+	case "RESTOREDB":
+		s.handleRestoreDB(conn, c, cmd)
+
+	case "DBREADONLY":
+		s.handleDBReadOnly(conn, cmd)
+
+	case "SETDEFAULT":
+		s.handleSetDefault(conn, cmd)
+
+	case "PREFIXSTATS":
+		s.handlePrefixStats(conn, c, cmd)
+
+	case "HOTKEYS":
+		s.handleHotKeys(conn, cmd)
+
+	case "DBSTATS":
+		s.handleDBStats(conn, cmd)
+
+	case "MEMORY":
+		s.handleMemory(conn, cmd)
+
+	case "CONFIG":
+		s.handleConfig(conn, cmd)
+
+	case "DEBUG":
+		s.handleDebug(conn, cmd)
+
+	case "CLIENT":
+		s.handleClient(conn, cmd)
+
+	case "RESET":
+		s.handleReset(conn, c, cmd)
+
+	case "INFO":
+		s.handleInfo(conn, cmd)
+
+	default:
+		conn.WriteError("ERR unknown command '" + name + "'")
+	}
+}
+
+// handleDBStats implements DBSTATS [index|name], replying with field/value
+// pairs for one DB, the current one by default. Every figure comes from
+// counters kept current on writes, so it is cheap on any size of DB.
+func (s *TrieServer) handleDBStats(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) > 2 {
+		conn.WriteError("ERR wrong number of arguments for 'DBSTATS'")
+		return
+	}
+	id := currentDB(conn)
+	if len(cmd.Args) == 2 {
+		n, err := s.resolveDB(string(cmd.Args[1]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		id = n
+	}
+	db := s.existingDB(id)
+	if db == nil {
+		db = &database{lpm: newLPMCache()} // empty; don't create a DB just to report on it
+	}
+	keys4, keys6 := db.keys4.Load(), db.keys6.Load()
+	h, _ := db.histogram(netip.Prefix{}, nil) // kept current, not walked
+	min4, avg4, max4 := lengthSummary(h.v4[:])
+	min6, avg6, max6 := lengthSummary(h.v6[:])
+	writeMemFields(conn, []memField{
+		{"db", int64(id)}, {"keys", keys4 + keys6}, {"keys4", keys4}, {"keys6", keys6},
+		{"memory", db.datasetBytes()}, {"value_bytes", db.valueBytes()},
+		{"max_keys", s.store.maxKeys.get(id)}, {"max_bytes", s.store.maxBytes.get(id)},
+		{"hits", db.hits.load()}, {"misses", db.misses.load()}, {"writes", db.writes.load()},
+		{"last_write", db.lastWrite.Load()}, {"expires", db.expiries.len()},
+		{"lpm_cache_entries", int64(db.lpm.len())}, {"lpm_cache_hits", db.lpm.hits.Load()},
+		{"lpm_cache_misses", db.lpm.misses.Load()},
+		{"minlen4", min4}, {"avglen4", avg4}, {"maxlen4", max4},
+		{"minlen6", min6}, {"avglen6", avg6}, {"maxlen6", max6},
+	})
+}
+
+// handleShowDBs implements SHOWDBS [ALL]: one [db, index, name, name|nil,
+// keys, n, memory, bytes, readonly, 0|1] entry per database, by index.
+// Databases holding no keys, such as those only ever read, are listed
+// only with ALL.
+func (s *TrieServer) handleShowDBs(conn redcon.Conn, cmd redcon.Command) {
+	all := false
+	switch {
+	case len(cmd.Args) == 2 && strings.EqualFold(string(cmd.Args[1]), "ALL"):
+		all = true
+	case len(cmd.Args) != 1:
+		conn.WriteError("ERR syntax error")
+		return
+	}
+	var dbs []*database
+	for _, db := range s.databases() {
+		if all || db.keyCount() > 0 {
+			dbs = append(dbs, db)
+		}
+	}
+	conn.WriteArray(len(dbs))
+	for _, db := range dbs {
+		conn.WriteArray(10)
+		conn.WriteBulkString("db")
+		conn.WriteInt(db.id)
+		conn.WriteBulkString("name")
+		if name := s.names.name(db.id); name != "" {
+			conn.WriteBulkString(name)
+		} else {
+			conn.WriteNull()
+		}
+		conn.WriteBulkString("keys")
+		conn.WriteInt64(db.keyCount())
+		conn.WriteBulkString("memory")
+		conn.WriteInt64(db.datasetBytes())
+		conn.WriteBulkString("readonly")
+		if s.readOnlyDBs.has(db.id) {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+	}
+}
+
+// handleDropDB implements DROPDB index|name [FORCE], replying 1 if the
+// database existed. It is refused while another client has the database
+// SELECTed unless FORCE is given. Clients left pointing at a dropped
+// database, the caller included, keep its index and see a new, empty
+// database there from their next command on. A name stays with its index.
+func (s *TrieServer) handleDropDB(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		conn.WriteError("ERR wrong number of arguments for 'DROPDB'")
+		return
+	}
+	force := len(cmd.Args) == 3
+	if force && !strings.EqualFold(string(cmd.Args[2]), "FORCE") {
+		conn.WriteError("ERR syntax error")
+		return
+	}
+	id, err := s.resolveDB(string(cmd.Args[1]))
+	if err == nil {
+		err = s.writable(id)
+	}
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	if !force {
+		users := 0
+		for _, other := range s.clients.list() {
+			if other != c && other.db.Load() == int64(id) {
+				users++
+			}
+		}
+		if users > 0 {
+			conn.WriteError(fmt.Sprintf("ERR db%d is selected by %d other client(s), use FORCE to drop it anyway", id, users))
+			return
+		}
+	}
+	db := s.dropDB(id)
+	if db == nil {
+		conn.WriteInt(0)
+		return
+	}
+	db.flush(s.freer(s.store.lazyFlush.Load()))
+	s.auditDB(c, id, "DROPDB")
+	conn.WriteInt(1)
+}
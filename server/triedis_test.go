@@ -0,0 +1,388 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// newTestServer returns a new server for a test, with the default
+// options but logging no slow commands.
+func newTestServer(t testing.TB) *TrieServer {
+	t.Helper()
+	o := DefaultOptions()
+	o.LogSlowerThan = -1
+	s, err := NewTrieServer(o)
+	if err != nil {
+		t.Fatalf("NewTrieServer: %v", err)
+	}
+	return s
+}
+
+// testSession runs commands on a server the way a client connection does,
+// without a socket. Unlike a Session, it is accepted as a loopback TCP
+// client is, so per-IP limits and address checks apply to it.
+type testSession struct {
+	s    *TrieServer
+	conn *testConn
+}
+
+// newTestSession returns a session of s, on database 0, connected as a
+// plaintext client is and closed when the test ends.
+func newTestSession(t testing.TB, s *TrieServer) *testSession {
+	t.Helper()
+	conn := &testConn{}
+	if !s.accept(conn) {
+		t.Fatal("test session refused")
+	}
+	t.Cleanup(func() { s.closed(conn, nil) })
+	return &testSession{s: s, conn: conn}
+}
+
+// Do runs the command args and returns its reply.
+func (ss *testSession) Do(args ...string) Reply {
+	cmd := redcon.Command{Raw: redcon.AppendArray(nil, len(args)), Args: make([][]byte, len(args))}
+	for i, arg := range args {
+		cmd.Raw = redcon.AppendBulkString(cmd.Raw, arg)
+		cmd.Args[i] = []byte(arg)
+	}
+	ss.conn.buf = ss.conn.buf[:0]
+	ss.s.HandleCommand(ss.conn, cmd)
+	_, resp := redcon.ReadNextRESP(ss.conn.buf)
+	return newReply(resp)
+}
+
+// String renders r compactly for comparisons in tests: nil for a null,
+// integers in decimal, arrays in brackets and anything else as its text.
+func (r Reply) String() string {
+	switch r.Type {
+	case NullReply:
+		return "nil"
+	case IntReply:
+		return strconv.FormatInt(r.Int, 10)
+	case ArrayReply:
+		parts := make([]string, len(r.Array))
+		for i, e := range r.Array {
+			parts[i] = e.String()
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	return r.Str
+}
+
+// replyStep is a command and its expected reply, as Reply.String
+// renders it, or the prefix of its error.
+type replyStep struct {
+	args []string
+	want string
+}
+
+// doer runs commands: a testSession or a Session.
+type doer interface {
+	Do(args ...string) Reply
+}
+
+// runSteps runs steps on ss in order, checking every reply.
+func runSteps(t testing.TB, ss doer, steps []replyStep) {
+	t.Helper()
+	for _, st := range steps {
+		r := ss.Do(st.args...)
+		got := r.String()
+		if r.Type == ErrorReply {
+			if !strings.HasPrefix(got, st.want) {
+				t.Errorf("%q = error %q, want %q", st.args, got, st.want)
+			}
+		} else if got != st.want {
+			t.Errorf("%q = %s, want %s", st.args, got, st.want)
+		}
+	}
+}
+
+// strs returns the strings of an array reply.
+func (r Reply) strs() []string {
+	out := make([]string, len(r.Array))
+	for i, e := range r.Array {
+		out[i] = e.Str
+	}
+	return out
+}
+
+// mustDo runs args on ss and fails the test on an error reply.
+func mustDo(t testing.TB, ss doer, args ...string) Reply {
+	t.Helper()
+	r := ss.Do(args...)
+	if err := r.Err(); err != nil {
+		t.Fatalf("%q: %v", args, err)
+	}
+	return r
+}
+
+// testConn is the redcon.Conn of a testSession, collecting the reply of
+// the command running in buf.
+type testConn struct {
+	buf []byte
+	ctx any
+}
+
+func (tc *testConn) RemoteAddr() string             { return "127.0.0.1:50000" }
+func (tc *testConn) Close() error                   { return nil }
+func (tc *testConn) WriteError(msg string)          { tc.buf = redcon.AppendError(tc.buf, msg) }
+func (tc *testConn) WriteString(str string)         { tc.buf = redcon.AppendString(tc.buf, str) }
+func (tc *testConn) WriteBulk(bulk []byte)          { tc.buf = redcon.AppendBulk(tc.buf, bulk) }
+func (tc *testConn) WriteBulkString(bulk string)    { tc.buf = redcon.AppendBulkString(tc.buf, bulk) }
+func (tc *testConn) WriteInt(num int)               { tc.buf = redcon.AppendInt(tc.buf, int64(num)) }
+func (tc *testConn) WriteInt64(num int64)           { tc.buf = redcon.AppendInt(tc.buf, num) }
+func (tc *testConn) WriteUint64(num uint64)         { tc.buf = redcon.AppendUint(tc.buf, num) }
+func (tc *testConn) WriteArray(count int)           { tc.buf = redcon.AppendArray(tc.buf, count) }
+func (tc *testConn) WriteNull()                     { tc.buf = redcon.AppendNull(tc.buf) }
+func (tc *testConn) WriteRaw(data []byte)           { tc.buf = append(tc.buf, data...) }
+func (tc *testConn) WriteAny(v any)                 { tc.buf = redcon.AppendAny(tc.buf, v) }
+func (tc *testConn) Context() any                   { return tc.ctx }
+func (tc *testConn) SetContext(v any)               { tc.ctx = v }
+func (tc *testConn) SetReadBuffer(int)              {}
+func (tc *testConn) Detach() redcon.DetachedConn    { panic("test connections cannot be detached") }
+func (tc *testConn) ReadPipeline() []redcon.Command { return nil }
+func (tc *testConn) PeekPipeline() []redcon.Command { return nil }
+func (tc *testConn) NetConn() net.Conn              { return nil }
+
+func TestSimpleStrings(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, args := range [][]string{
+		{"PING"},
+		{"SET", "10.0.0.0/8", "a"},
+		{"SELECT", "1"},
+		{"FLUSHDB"},
+	} {
+		r := mustDo(t, ss, args...)
+		want := "OK"
+		if args[0] == "PING" {
+			want = "PONG"
+		}
+		if r.Type != redcon.String || r.Str != want {
+			t.Errorf("%q = %c%q, want +%q", args, r.Type, r.Str, want)
+		}
+	}
+}
+
+// dbStats returns the fields of a DBSTATS reply by name.
+func dbStats(t testing.TB, ss *testSession, args ...string) map[string]int64 {
+	t.Helper()
+	r := mustDo(t, ss, append([]string{"DBSTATS"}, args...)...)
+	out := make(map[string]int64, len(r.Array)/2)
+	for i := 0; i+1 < len(r.Array); i += 2 {
+		out[r.Array[i].Str] = r.Array[i+1].Int
+	}
+	return out
+}
+
+func TestDBStats(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	for _, tc := range []struct {
+		args []string
+		want string // DBSTATS 0 afterwards
+	}{
+		{[]string{"SET", "10.0.0.0/8", "a"}, "keys=1 keys4=1 keys6=0 hits=0 misses=0 writes=1"},
+		{[]string{"SET", "2001:db8::/32", "b"}, "keys=2 keys4=1 keys6=1 hits=0 misses=0 writes=2"},
+		{[]string{"GET", "10.1.2.3"}, "keys=2 keys4=1 keys6=1 hits=1 misses=0 writes=2"},
+		{[]string{"GET", "192.168.0.1"}, "keys=2 keys4=1 keys6=1 hits=1 misses=1 writes=2"},
+		{[]string{"DEL", "192.168.0.0/16"}, "keys=2 keys4=1 keys6=1 hits=1 misses=1 writes=2"}, // removed nothing
+		{[]string{"DEL", "2001:db8::/32"}, "keys=1 keys4=1 keys6=0 hits=1 misses=1 writes=3"},
+		{[]string{"FLUSHDB"}, "keys=0 keys4=0 keys6=0 hits=1 misses=1 writes=4"},
+		{[]string{"CONFIG", "RESETSTAT"}, "keys=0 keys4=0 keys6=0 hits=0 misses=0 writes=0"},
+		{[]string{"SELECT", "1"}, "keys=0 keys4=0 keys6=0 hits=0 misses=0 writes=0"},
+		{[]string{"GET", "10.1.2.3"}, "keys=0 keys4=0 keys6=0 hits=0 misses=0 writes=0"}, // counted in DB 1
+	} {
+		mustDo(t, ss, tc.args...)
+		st := dbStats(t, ss, "0")
+		var got []string
+		for _, name := range []string{"keys", "keys4", "keys6", "hits", "misses", "writes"} {
+			got = append(got, name+"="+strconv.FormatInt(st[name], 10))
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("after %q: DBSTATS 0 = %s, want %s", tc.args, got, tc.want)
+		}
+	}
+	if st := dbStats(t, ss); st["db"] != 1 || st["misses"] != 1 {
+		t.Errorf("DBSTATS = %v, want db 1 with one miss", st)
+	}
+	if got := keyspaceField(t, ss, 1, "misses"); got != "1" {
+		t.Errorf("INFO keyspace db1 misses = %s, want 1", got)
+	}
+	if err := ss.Do("DBSTATS", "-1").Err(); err == nil {
+		t.Error("DBSTATS -1 succeeded")
+	}
+}
+
+// TestBinaryValues round-trips values no text encoding would keep, over
+// a session and over RESP.
+func TestBinaryValues(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	big := make([]byte, 4<<20)
+	r := rand.New(rand.NewPCG(1, 1))
+	for i := range big {
+		big[i] = byte(r.Uint32())
+	}
+	values := map[string]string{
+		"10.0.0.0/8":    "a\x00b\x00",
+		"10.1.0.0/16":   "\xff\xfe\x80\xc3",
+		"10.2.0.0/16":   string(all),
+		"2001:db8::/32": string(big),
+		"10.3.0.0/16":   "",
+	}
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	for k, v := range values {
+		mustDo(t, ss, "SET", k, v)
+	}
+	for k, v := range values {
+		addr, _, _ := strings.Cut(k, "/")
+		if r := mustDo(t, ss, "GET", addr); r.Type != BulkReply || r.Str != v {
+			t.Errorf("session: GET %s = %d bytes of type %c, want the %d stored", addr, len(r.Str), r.Type, len(v))
+		}
+	}
+
+	conn, err := net.Dial("tcp", serveTest(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for k, v := range values {
+		addr, _, _ := strings.Cut(k, "/")
+		var req []byte
+		for _, args := range [][]string{{"SET", k, v}, {"GET", addr}} {
+			req = redcon.AppendArray(req, len(args))
+			for _, arg := range args {
+				req = redcon.AppendBulkString(req, arg)
+			}
+		}
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		want := "+OK\r\n$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(br, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("RESP: SET and GET %s replied %d bytes, want the %d stored", k, len(got), len(want))
+		}
+	}
+}
+
+func TestDBStatsLengths(t *testing.T) {
+	start := accessClock.Load()
+	t.Cleanup(func() { accessClock.Store(start) })
+	ss := newTestSession(t, newTestServer(t))
+	fields := []string{"minlen4", "avglen4", "maxlen4", "minlen6", "avglen6", "maxlen6", "expires"}
+	for _, tc := range []struct {
+		args []string
+		want string // fields afterwards
+	}{
+		{[]string{"PING"}, "0 0.0000 0 0 0.0000 0 0"},
+		{[]string{"SET", "10.0.0.0/8", "a"}, "8 8.0000 8 0 0.0000 0 0"},
+		{[]string{"SET", "10.1.0.0/16", "a"}, "8 12.0000 16 0 0.0000 0 0"},
+		{[]string{"SET", "192.0.2.1", "a"}, "8 18.6667 32 0 0.0000 0 0"},
+		{[]string{"SET", "2001:db8::/32", "a"}, "8 18.6667 32 32 32.0000 32 0"},
+		{[]string{"SET", "::/0", "a"}, "8 18.6667 32 0 16.0000 32 0"},
+		{[]string{"SET", "10.0.0.0/8", "b"}, "8 18.6667 32 0 16.0000 32 0"}, // a new value, not a new prefix
+		{[]string{"DEL", "192.0.2.1"}, "8 12.0000 16 0 16.0000 32 0"},
+		{[]string{"HSET", "172.16.0.0/12", "f", "v"}, "8 12.0000 16 0 16.0000 32 0"},
+		{[]string{"HDEL", "172.16.0.0/12", "f"}, "8 12.0000 16 0 16.0000 32 0"},
+		{[]string{"FLUSHDB"}, "0 0.0000 0 0 0.0000 0 0"},
+	} {
+		accessClock.Add(10)
+		before := dbStats(t, ss)["last_write"]
+		mustDo(t, ss, tc.args...)
+		r := mustDo(t, ss, "DBSTATS")
+		byName := make(map[string]string)
+		for i := 0; i+1 < len(r.Array); i += 2 {
+			byName[r.Array[i].Str] = r.Array[i+1].String()
+		}
+		var got []string
+		for _, f := range fields {
+			got = append(got, byName[f])
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("after %q: %s = %s, want %s", tc.args, fields, got, tc.want)
+		}
+		lastWrite, _ := strconv.ParseInt(byName["last_write"], 10, 64)
+		if wrote := tc.args[0] != "PING"; wrote != (lastWrite == int64(accessClock.Load())) || !wrote && lastWrite != before {
+			t.Errorf("after %q: last_write %d, clock %d", tc.args, lastWrite, accessClock.Load())
+		}
+		if mem, _ := strconv.ParseInt(byName["memory"], 10, 64); (mem > 0) != (tc.args[0] != "FLUSHDB" && tc.args[0] != "PING") {
+			t.Errorf("after %q: memory %d", tc.args, mem)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	mustDo(t, ss, "SET", "10.0.0.0/8", "a")
+	mustDo(t, ss, "CONFIG", "SET", "read-only", "yes")
+	// Every write is refused before its arguments are looked at.
+	for name, flags := range commandTable {
+		if flags&cmdWrite == 0 {
+			continue
+		}
+		if err := ss.Do(name, "10.0.0.0/8", "x", "y").Err(); err == nil || !strings.HasPrefix(err.Error(), "READONLY ") {
+			t.Errorf("%s in read-only mode: %v, want READONLY", name, err)
+		}
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"GET", "10.1.2.3"}, "a"},
+		{[]string{"DBSIZE"}, "1"},
+		{[]string{"CONFIG", "GET", "read-only"}, "[read-only yes]"},
+		{[]string{"CONFIG", "SET", "read-only", "no"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "b"}, "OK"},
+		{[]string{"GET", "10.1.2.3"}, "b"},
+	})
+	if got := infoFields(mustDo(t, ss, "INFO", "server").Str)["read_only"]; got != "0" {
+		t.Errorf("read_only = %s after turning it off", got)
+	}
+	if got := mustDo(t, ss, "INFO", "commandstats").Str; !strings.Contains(got, "cmdstat_set:calls=2,") || !strings.Contains(got, "rejected_calls=1") {
+		t.Errorf("INFO commandstats does not count the refused SET:\n%s", got)
+	}
+}
+
+func TestSPM(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"SPM", "10.1.2.3"}, "nil"},
+		{[]string{"SET", "10.1.2.0/24", "narrow"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", "middle"}, "OK"},
+		{[]string{"SPM", "10.1.2.3"}, "middle"},
+		{[]string{"SET", "10.0.0.0/8", "wide", "PX", "30"}, "OK"},
+		{[]string{"SPM", "10.1.2.3"}, "wide"},
+		{[]string{"SPM", "10.1.2.3", "withprefix"}, "[10.0.0.0/8 wide]"},
+		{[]string{"SPM", "10.1.2.0/24", "WITHPREFIX"}, "[10.0.0.0/8 wide]"},
+		{[]string{"GET", "10.1.2.3"}, "narrow"},
+		{[]string{"SET", "2001:db8::/32", "six"}, "OK"},
+		{[]string{"SET", "2001:db8:1::/48", "six-narrow"}, "OK"},
+		{[]string{"SPM", "2001:db8:1::1"}, "six"},
+		{[]string{"SPM", "192.0.2.1"}, "nil"},
+		{[]string{"HSET", "172.16.0.0/12", "f", "v"}, "1"},
+		{[]string{"SET", "172.16.1.0/24", "s"}, "OK"},
+		{[]string{"SPM", "172.16.1.1"}, "WRONGTYPE"},
+		{[]string{"SPM", "not-an-ip"}, "nil"},
+		{[]string{"SPM", "10.1.2.3", "NOW"}, "ERR syntax error"},
+		{[]string{"SPM"}, "ERR wrong number of arguments for 'SPM'"},
+	})
+	if hits, misses := keyspaceField(t, ss, 0, "hits"), keyspaceField(t, ss, 0, "misses"); hits != "7" || misses != "3" {
+		t.Errorf("hits=%s misses=%s, want 7 and 3", hits, misses)
+	}
+	time.Sleep(40 * time.Millisecond)
+	runSteps(t, ss, []replyStep{
+		{[]string{"SPM", "10.1.2.3", "WITHPREFIX"}, "[10.1.0.0/16 middle]"}, // the expired /8 is passed over
+	})
+}
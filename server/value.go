@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"slices"
+)
+
+// hashFieldOverhead estimates the bytes one hash field costs beyond its
+// name and value: its map slot and the value's slice header.
+const hashFieldOverhead = 48
+
+// setMemberOverhead estimates the bytes one set member costs beyond its
+// text: its map slot.
+const setMemberOverhead = 32
+
+// tagOverhead estimates the bytes one tag costs beyond its text: its
+// string header and its slot in the tag index.
+const tagOverhead = 64
+
+var errWrongType = newError(ClassWrongType, "Operation against a key holding the wrong kind of value")
+
+// value is what a prefix stores: a string, a hash or a set. Stored values
+// are never modified in place, writes store a new one, so a reader may
+// keep a value after releasing the shard lock. That makes a hash or set
+// write copy its map, which is fine for the handful of entries a prefix
+// carries. Exactly one of str, hash and set is non-nil.
+type value struct {
+	str  []byte              // the string
+	hash map[string][]byte   // the fields of a hash
+	set  map[string]struct{} // the members of a set
+	tags []string            // TAG's labels, sorted; nil if none
+
+	expireAt int64   // unix milliseconds it expires at; 0 if never
+	access   *access // when it was last read or written; set when stored
+}
+
+// stringValue returns a string value holding b.
+func stringValue(b []byte) value {
+	if b == nil {
+		b = []byte{}
+	}
+	return value{str: b}
+}
+
+// isNone reports whether v is the zero value, which stands for no value.
+func (v value) isNone() bool { return v.str == nil && v.hash == nil && v.set == nil }
+
+func (v value) isString() bool { return v.str != nil }
+func (v value) isHash() bool   { return v.hash != nil }
+func (v value) isSet() bool    { return v.set != nil }
+
+// typeName is what TYPE reports for v.
+func (v value) typeName() string {
+	switch {
+	case v.isHash():
+		return "hash"
+	case v.isSet():
+		return "set"
+	}
+	return "string"
+}
+
+// encoding is what DEBUG OBJECT reports for v.
+func (v value) encoding() string {
+	if v.isString() {
+		return "raw"
+	}
+	return "hashtable"
+}
+
+// fieldStrings returns a hash's fields as strings.
+func (v value) fieldStrings() map[string]string {
+	out := make(map[string]string, len(v.hash))
+	for f, fv := range v.hash {
+		out[f] = string(fv)
+	}
+	return out
+}
+
+// fieldsJSON encodes a hash's fields as a JSON object, sorted by name.
+func (v value) fieldsJSON() []byte {
+	out, _ := json.Marshal(v.fieldStrings())
+	return out
+}
+
+// equal reports whether v and w hold the same data.
+func (v value) equal(w value) bool {
+	switch {
+	case v.isString() && w.isString():
+		return bytes.Equal(v.str, w.str)
+	case v.isHash() && w.isHash():
+		return maps.EqualFunc(v.hash, w.hash, bytes.Equal)
+	case v.isSet() && w.isSet():
+		return maps.Equal(v.set, w.set)
+	}
+	return false
+}
+
+// members returns a set's members, sorted.
+func (v value) members() []string {
+	return slices.Sorted(maps.Keys(v.set))
+}
+
+// text is v as a single string, as EXPORT writes it to CSV: a string as
+// itself, a hash as a JSON object and a set as a JSON array.
+func (v value) text() string {
+	switch {
+	case v.isHash():
+		return string(v.fieldsJSON())
+	case v.isSet():
+		out, _ := json.Marshal(v.members())
+		return string(out)
+	}
+	return string(v.str)
+}
+
+// size estimates the bytes v holds.
+func (v value) size() int64 {
+	n := int64(len(v.str))
+	for f, fv := range v.hash {
+		n += hashFieldOverhead + int64(len(f)+len(fv))
+	}
+	for m := range v.set {
+		n += setMemberOverhead + int64(len(m))
+	}
+	for _, t := range v.tags {
+		n += tagOverhead + int64(len(t))
+	}
+	return n
+}
+
+// inheritTags gives v, about to replace old, old's tags, so rewriting a
+// prefix's value keeps its labels. A v with tags of its own keeps them;
+// an empty non-nil slice, which TAG DEL stores to drop the last tag,
+// becomes nil.
+func inheritTags(v, old value) value {
+	switch {
+	case v.tags == nil:
+		v.tags = old.tags
+	case len(v.tags) == 0:
+		v.tags = nil
+	}
+	return v
+}
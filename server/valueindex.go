@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bytes"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tidwall/redcon"
+)
+
+var errIndexDisabled = newError(ClassErr, "value index is disabled, enable it with CONFIG SET value-index yes")
+
+// prefixIndex maps strings to the prefixes carrying them: string values
+// for value-index and tags for TAGKEYS, so those commands need not walk
+// the tries. It is kept current by the same writes that keep the key
+// counters, under the shard lock of the prefix written, and costs a map
+// entry per prefix and a copy of each distinct string. Tags are few, so
+// they are always indexed; values are only with value-index on.
+type prefixIndex struct {
+	mu    sync.Mutex
+	byKey map[string]map[netip.Prefix]struct{}
+
+	distinct atomic.Int64 // strings indexed
+	entries  atomic.Int64 // prefix/string pairs indexed
+}
+
+func newPrefixIndex() *prefixIndex {
+	return &prefixIndex{byKey: make(map[string]map[netip.Prefix]struct{})}
+}
+
+// add records that p carries key.
+func (ix *prefixIndex) add(p netip.Prefix, key string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	set := ix.byKey[key]
+	if set == nil {
+		set = make(map[netip.Prefix]struct{}, 1)
+		ix.byKey[key] = set
+		ix.distinct.Add(1)
+	}
+	if _, ok := set[p]; !ok {
+		set[p] = struct{}{}
+		ix.entries.Add(1)
+	}
+}
+
+// remove records that p no longer carries key.
+func (ix *prefixIndex) remove(p netip.Prefix, key string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	set := ix.byKey[key]
+	if _, ok := set[p]; !ok {
+		return
+	}
+	delete(set, p)
+	ix.entries.Add(-1)
+	if len(set) == 0 {
+		delete(ix.byKey, key)
+		ix.distinct.Add(-1)
+	}
+}
+
+// prefixes returns the prefixes indexed under key, in no particular order.
+func (ix *prefixIndex) prefixes(key string) []netip.Prefix {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	set := ix.byKey[key]
+	out := make([]netip.Prefix, 0, len(set))
+	for p := range set {
+		out = append(out, p)
+	}
+	return out
+}
+
+// has reports whether p is indexed under key.
+func (ix *prefixIndex) has(p netip.Prefix, key string) bool {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	_, ok := ix.byKey[key][p]
+	return ok
+}
+
+// each calls fn for every prefix/string pair indexed, in no particular
+// order. The index is locked only to copy its strings and then each
+// string's prefixes, never while fn runs, so fn may lock shards; pairs
+// added or removed meanwhile may or may not be seen.
+func (ix *prefixIndex) each(fn func(p netip.Prefix, key string)) {
+	ix.mu.Lock()
+	keys := make([]string, 0, len(ix.byKey))
+	for k := range ix.byKey {
+		keys = append(keys, k)
+	}
+	ix.mu.Unlock()
+	for _, k := range keys {
+		for _, p := range ix.prefixes(k) {
+			fn(p, k)
+		}
+	}
+}
+
+// reset empties the index, for FLUSHDB.
+func (ix *prefixIndex) reset() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.byKey = make(map[string]map[netip.Prefix]struct{})
+	ix.distinct.Store(0)
+	ix.entries.Store(0)
+}
+
+// reindex moves p in the indexes from old, the value it had if had is
+// set, to v, which is the zero value when p was removed. The caller holds
+// p's shard write locked.
+func (d *database) reindex(p netip.Prefix, old value, had bool, v value) {
+	if !had || !slices.Equal(old.tags, v.tags) {
+		for _, t := range old.tags {
+			d.tags.remove(p, t)
+		}
+		for _, t := range v.tags {
+			d.tags.add(p, t)
+		}
+	}
+	ix := d.index.Load()
+	if ix == nil {
+		return
+	}
+	if had && old.isString() {
+		ix.remove(p, string(old.str))
+	}
+	if v.isString() {
+		ix.add(p, string(v.str))
+	}
+}
+
+// valueIndex returns d's index, building or dropping it first if
+// value-index was changed since, or nil when it is off.
+func (d *database) valueIndex() *prefixIndex {
+	if !d.opts.valueIndex.Load() {
+		d.index.Store(nil)
+		return nil
+	}
+	if ix := d.index.Load(); ix != nil {
+		return ix
+	}
+	return d.buildIndex()
+}
+
+// buildIndex indexes every stored prefix of d. It holds every shard write
+// locked while it walks them, so no write is missed or indexed twice.
+func (d *database) buildIndex() *prefixIndex {
+	defer d.lockAll()()
+	if ix := d.index.Load(); ix != nil {
+		return ix
+	}
+	ix := newPrefixIndex()
+	for _, sh := range d.allShards() {
+		sh.trie.Walk(func(p netip.Prefix, v value) bool {
+			if v.isString() {
+				ix.add(p, string(v.str))
+			}
+			return true
+		})
+	}
+	d.index.Store(ix)
+	return ix
+}
+
+// valueKeys returns the unexpired prefixes holding the string val, in
+// comparePrefixes order.
+func (d *database) valueKeys(ix *prefixIndex, val []byte) []netip.Prefix {
+	ps := ix.prefixes(string(val))
+	live := ps[:0]
+	for _, p := range ps {
+		sh := d.shardFor(p)
+		sh.mu.RLock()
+		v, ok := sh.trie.Get(p)
+		sh.mu.RUnlock()
+		if ok && !v.expired() && v.isString() && bytes.Equal(v.str, val) {
+			live = append(live, p)
+		}
+	}
+	slices.SortFunc(live, comparePrefixes)
+	return live
+}
+
+// handleValueIndex implements VKEYS value [LIMIT n], the prefixes whose
+// string value is value, in address order with shorter prefixes first,
+// and VCOUNT value, how many there are. Both need value-index on and
+// fail rather than fall back to walking the database.
+func (s *TrieServer) handleValueIndex(conn redcon.Conn, name string, cmd redcon.Command) {
+	limit := -1
+	switch {
+	case len(cmd.Args) == 2:
+	case name == "VKEYS" && len(cmd.Args) == 4:
+		if !strings.EqualFold(string(cmd.Args[2]), "LIMIT") {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		n, err := strconv.Atoi(string(cmd.Args[3]))
+		if err != nil || n < 0 {
+			conn.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		limit = n
+	case name == "VKEYS" && len(cmd.Args) == 3:
+		conn.WriteError("ERR syntax error")
+		return
+	default:
+		conn.WriteError("ERR wrong number of arguments for '" + name + "'")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	ix := db.valueIndex()
+	if ix == nil {
+		writeError(conn, errIndexDisabled)
+		return
+	}
+	keys := db.valueKeys(ix, cmd.Args[1])
+	if name == "VCOUNT" {
+		conn.WriteInt(len(keys))
+		return
+	}
+	if limit >= 0 && limit < len(keys) {
+		keys = keys[:limit]
+	}
+	conn.WriteArray(len(keys))
+	for _, p := range keys {
+		conn.WriteBulkString(p.String())
+	}
+}
+
+// delValueBatch is how many prefixes DELVALUE deletes under one shard
+// lock, and how many it examines per lock when it has to scan.
+const delValueBatch = 256
+
+// valueMatches finds the unexpired prefixes covered by within, unless
+// within is invalid, whose string value is val, in comparePrefixes order.
+// It reads the value index when there is one and scans otherwise, each
+// shard read-locked for only delValueBatch prefixes at a time, and
+// stops with b's error once b runs out.
+func (d *database) valueMatches(val []byte, within netip.Prefix, b *budget) ([]netip.Prefix, error) {
+	if ix := d.valueIndex(); ix != nil {
+		keys := d.valueKeys(ix, val)
+		if within.IsValid() {
+			keys = slices.DeleteFunc(keys, func(p netip.Prefix) bool { return !covers(within, p) })
+		}
+		return keys, nil
+	}
+	var keys []netip.Prefix
+	pos, done := scanPos{}, false
+	for !done {
+		pos, done = d.scan(pos, familyAny, delValueBatch, func(p netip.Prefix, v value) {
+			if b.exceeded() {
+				return
+			}
+			if v.isString() && bytes.Equal(v.str, val) && (!within.IsValid() || covers(within, p)) {
+				keys = append(keys, p)
+			}
+		})
+		if b.exceeded() {
+			return nil, b.err()
+		}
+		runtime.Gosched()
+	}
+	slices.SortFunc(keys, comparePrefixes)
+	return keys, nil
+}
+
+// deleteValue deletes the prefixes in keys that still hold the string
+// val, in order and at most limit of them unless limit is negative, and
+// returns those it deleted, keeping tombstones of them unless by is
+// empty. Consecutive prefixes of one shard are deleted under one lock,
+// delValueBatch at most, so other clients get in between.
+func (d *database) deleteValue(keys []netip.Prefix, val []byte, limit int, by string) []netip.Prefix {
+	var removed []netip.Prefix
+	for i := 0; i < len(keys) && limit != 0; {
+		sh := d.shardFor(keys[i])
+		sh.mu.Lock()
+		for n := 0; i < len(keys) && n < delValueBatch && limit != 0 && d.shardFor(keys[i]) == sh; i, n = i+1, n+1 {
+			p := keys[i]
+			if v, ok := sh.trie.Get(p); ok && !v.expired() && v.isString() && bytes.Equal(v.str, val) {
+				d.buryLocked(sh, p, v, by)
+				removed = append(removed, p)
+				limit--
+			}
+		}
+		sh.mu.Unlock()
+		runtime.Gosched()
+	}
+	return removed
+}
+
+// handleDelValue implements DELVALUE value [WITHIN cidr] [LIMIT n]: it
+// deletes the prefixes whose string value is value, the first n of them
+// in address order with LIMIT, and replies with how many it deleted.
+// Without value-index it has to scan the database for them. Prefixes are
+// deleted in batches, not at one instant, so one stored with the value
+// mid-command may survive it. The audit log names every deleted prefix.
+func (s *TrieServer) handleDelValue(conn redcon.Conn, c *client, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'DELVALUE'")
+		return
+	}
+	db := s.getDB(currentDB(conn))
+	var within netip.Prefix
+	limit := -1
+	for i := 2; i < len(cmd.Args); i += 2 {
+		if i+1 == len(cmd.Args) {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		arg := string(cmd.Args[i+1])
+		switch strings.ToUpper(string(cmd.Args[i])) {
+		case "WITHIN":
+			p, err := db.parseLookup(arg)
+			if err != nil {
+				writeError(conn, err)
+				return
+			}
+			within = p
+		case "LIMIT":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			limit = n
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	val := cmd.Args[1]
+	keys, err := db.valueMatches(val, within, &c.budget)
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	var withinArg, limitArg string
+	if within.IsValid() {
+		withinArg = within.String()
+	}
+	if limit >= 0 {
+		limitArg = strconv.Itoa(limit)
+	}
+	jid, err := s.journal.begin("DELVALUE", db.id, journalParams("value", string(val), "within", withinArg, "limit", limitArg))
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	removed := db.deleteValue(keys, val, limit, s.tombstoneBy(c, db.id))
+	s.journal.end(jid)
+	if len(removed) > 0 {
+		db.writes.add(uint64(c.id), 1)
+		keys := make([]string, len(removed))
+		for i, p := range removed {
+			keys[i] = p.String()
+		}
+		s.audit(c, "DELVALUE", keys...)
+	}
+	conn.WriteInt(len(removed))
+}
+
+// registerValueIndexConfig exposes value-index. Turning it on indexes
+// every database at once, each blocking writes to it while it is walked;
+// turning it off frees the indexes.
+func (s *TrieServer) registerValueIndexConfig() {
+	s.addConfig("value-index", yesNoGet(&s.store.valueIndex), func(v string) error {
+		if err := yesNoSet(&s.store.valueIndex)(v); err != nil {
+			return err
+		}
+		for _, db := range s.databases() {
+			db.valueIndex()
+		}
+		return nil
+	})
+}
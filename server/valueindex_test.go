@@ -0,0 +1,222 @@
+package server
+
+import (
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValueIndexCommands(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"SET", "10.0.0.0/8", "AS1"}, "OK"},
+		{[]string{"VKEYS", "AS1"}, "ERR value index is disabled"},
+		{[]string{"VCOUNT", "AS1"}, "ERR value index is disabled"},
+		{[]string{"CONFIG", "SET", "value-index", "yes"}, "OK"},
+		{[]string{"VKEYS", "AS1"}, "[10.0.0.0/8]"}, // stored before the index was built
+		{[]string{"SET", "2001:db8::/32", "AS1"}, "OK"},
+		{[]string{"SET", "10.0.0.0/16", "AS1"}, "OK"},
+		{[]string{"SET", "9.0.0.0/8", "AS1"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", "AS2"}, "OK"},
+		{[]string{"HSET", "192.0.2.0/24", "asn", "AS1"}, "1"}, // hashes are not indexed
+		{[]string{"VKEYS", "AS1"}, "[9.0.0.0/8 10.0.0.0/8 10.0.0.0/16 2001:db8::/32]"},
+		{[]string{"VKEYS", "AS1", "LIMIT", "2"}, "[9.0.0.0/8 10.0.0.0/8]"},
+		{[]string{"VKEYS", "AS1", "limit", "0"}, "[]"},
+		{[]string{"VCOUNT", "AS1"}, "4"},
+		{[]string{"VCOUNT", "AS2"}, "1"},
+		{[]string{"VCOUNT", "AS3"}, "0"},
+		{[]string{"VKEYS", "AS3"}, "[]"},
+		{[]string{"SET", "10.0.0.0/8", "AS2"}, "OK"},
+		{[]string{"APPEND", "9.0.0.0/8", "0"}, "4"},
+		{[]string{"DEL", "2001:db8::/32"}, "1"},
+		{[]string{"VKEYS", "AS1"}, "[10.0.0.0/16]"},
+		{[]string{"VKEYS", "AS2"}, "[10.0.0.0/8 10.1.0.0/16]"},
+		{[]string{"VKEYS", "AS10"}, "[9.0.0.0/8]"},
+		{[]string{"VKEYS", "AS1", "LIMIT", "-1"}, "ERR"},
+		{[]string{"VKEYS", "AS1", "TOP", "2"}, "ERR syntax error"},
+		{[]string{"VKEYS"}, "ERR wrong number of arguments"},
+		{[]string{"VCOUNT", "AS1", "LIMIT", "2"}, "ERR wrong number of arguments"},
+		{[]string{"CONFIG", "SET", "value-index", "no"}, "OK"},
+		{[]string{"VCOUNT", "AS1"}, "ERR value index is disabled"},
+	})
+}
+
+// checkValueIndex compares VKEYS and VCOUNT of every value in values,
+// and the index entries behind them, with the prefixes holding it in
+// database 0. VKEYS drops entries whose prefix no longer holds the value,
+// so only the entries show one left behind.
+func checkValueIndex(t *testing.T, ss *testSession, values []string, when string) {
+	t.Helper()
+	d := ss.s.getDB(0)
+	want := make(map[string][]string)
+	for _, p := range slices.SortedFunc(slices.Values(storedPrefixes(d)), comparePrefixes) {
+		sh := d.shardFor(p)
+		sh.mu.RLock()
+		v, _ := sh.trie.Get(p)
+		sh.mu.RUnlock()
+		if v.isString() {
+			want[string(v.str)] = append(want[string(v.str)], p.String())
+		}
+	}
+	for _, v := range values {
+		if got := mustDo(t, ss, "VKEYS", v).strs(); !slices.Equal(got, want[v]) {
+			t.Fatalf("%s: VKEYS %s = %q, want %q", when, v, got, want[v])
+		}
+		if n := mustDo(t, ss, "VCOUNT", v).Int; n != int64(len(want[v])) {
+			t.Fatalf("%s: VCOUNT %s = %d, want %d", when, v, n, len(want[v]))
+		}
+		var entries []string
+		for _, p := range slices.SortedFunc(slices.Values(d.valueIndex().prefixes(v)), comparePrefixes) {
+			entries = append(entries, p.String())
+		}
+		if !slices.Equal(entries, want[v]) {
+			t.Fatalf("%s: the index holds %q under %s, want %q", when, entries, v, want[v])
+		}
+	}
+}
+
+// TestValueIndexConsistency keeps the value index checked against the
+// data through overwrites, type changes, deletes, FLUSHDB, turning the
+// index off and on, and a snapshot load.
+func TestValueIndexConsistency(t *testing.T) {
+	s := newTestServer(t)
+	s.snapshots.dir = t.TempDir()
+	ss := newTestSession(t, s)
+	mustDo(t, ss, "CONFIG", "SET", "value-index", "yes")
+	r := rand.New(rand.NewPCG(13, 14))
+	values := []string{"AS1", "AS2", "AS3", "AS4"}
+	var pool []string
+	for range 150 {
+		pool = append(pool, randomPrefix(r, 4, 8).String(), randomPrefix(r, 16, 16).String())
+	}
+	workload := func(steps int) {
+		for range steps {
+			k := pool[r.IntN(len(pool))]
+			switch op := r.IntN(20); {
+			case op < 12:
+				mustDo(t, ss, "SET", k, values[r.IntN(len(values))])
+			case op < 14:
+				ss.Do("HSET", k, "f", "AS1") // fails on a string
+			case op < 18:
+				mustDo(t, ss, "DEL", k)
+			default:
+				ss.Do("APPEND", k, "0") // fails on a hash
+			}
+		}
+	}
+	// APPEND makes values such as AS10, which must leave AS1's prefixes.
+	checked := append(slices.Clone(values), "AS10", "AS20", "AS0")
+	for round := range 6 {
+		workload(300)
+		checkValueIndex(t, ss, checked, "round "+strconv.Itoa(round))
+	}
+
+	mustDo(t, ss, "CONFIG", "SET", "value-index", "no")
+	workload(300)
+	mustDo(t, ss, "CONFIG", "SET", "value-index", "yes")
+	checkValueIndex(t, ss, checked, "after rebuilding the index")
+
+	mustDo(t, ss, "SAVE")
+	loaded := newTestServer(t)
+	loaded.store.valueIndex.Store(true)
+	if _, err := loadSnapshotFile(loaded, filepath.Join(s.snapshots.dir, s.snapshots.dbFilename), true, true); err != nil {
+		t.Fatal(err)
+	}
+	checkValueIndex(t, newTestSession(t, loaded), checked, "after a snapshot load")
+
+	mustDo(t, ss, "FLUSHDB", "SYNC")
+	checkValueIndex(t, ss, checked, "after FLUSHDB")
+	if n := mustDo(t, ss, "VCOUNT", "AS1").Int; n != 0 {
+		t.Fatalf("VCOUNT AS1 after FLUSHDB = %d", n)
+	}
+}
+
+// TestValueIndexSkipsExpired checks that VKEYS and VCOUNT leave out a
+// prefix whose TTL has passed before expireCron deletes it.
+func TestValueIndexSkipsExpired(t *testing.T) {
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "value-index", "yes"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "AS1"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", "AS1", "PX", "20"}, "OK"},
+		{[]string{"VCOUNT", "AS1"}, "2"},
+	})
+	time.Sleep(30 * time.Millisecond)
+	runSteps(t, ss, []replyStep{
+		{[]string{"VKEYS", "AS1"}, "[10.0.0.0/8]"},
+		{[]string{"VCOUNT", "AS1"}, "1"},
+	})
+}
+
+func TestDelValue(t *testing.T) {
+	for _, tc := range []struct {
+		args []string // after DELVALUE
+		want string
+		left string // VKEYS-style list of what keeps AS1 afterwards
+	}{
+		{[]string{"AS1"}, "4", "[]"},
+		{[]string{"AS9"}, "0", "[9.0.0.0/8 10.0.0.0/8 10.1.0.0/16 2001:db8::/32]"},
+		{[]string{"AS1", "WITHIN", "10.0.0.0/8"}, "2", "[9.0.0.0/8 2001:db8::/32]"},
+		{[]string{"AS1", "within", "::/0"}, "1", "[9.0.0.0/8 10.0.0.0/8 10.1.0.0/16]"},
+		{[]string{"AS1", "LIMIT", "3"}, "3", "[2001:db8::/32]"},
+		{[]string{"AS1", "LIMIT", "0"}, "0", "[9.0.0.0/8 10.0.0.0/8 10.1.0.0/16 2001:db8::/32]"},
+		{[]string{"AS1", "WITHIN", "10.0.0.0/8", "LIMIT", "1"}, "1", "[9.0.0.0/8 10.1.0.0/16 2001:db8::/32]"},
+		{[]string{"AS1", "LIMIT", "1", "WITHIN", "10.0.0.0/8"}, "1", "[9.0.0.0/8 10.1.0.0/16 2001:db8::/32]"},
+		{[]string{"AS1", "LIMIT", "-1"}, "ERR value is not an integer or out of range", ""},
+		{[]string{"AS1", "WITHIN"}, "ERR syntax error", ""},
+		{[]string{"AS1", "WHERE", "x"}, "ERR syntax error", ""},
+		{[]string{"AS1", "WITHIN", "nope"}, "ERR", ""},
+		{nil, "ERR wrong number of arguments for 'DELVALUE'", ""},
+	} {
+		for _, indexed := range []string{"no", "yes"} {
+			ss := newTestSession(t, newTestServer(t))
+			runSteps(t, ss, []replyStep{
+				{[]string{"CONFIG", "SET", "value-index", indexed}, "OK"},
+				{[]string{"SET", "10.0.0.0/8", "AS1"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "AS1"}, "OK"},
+				{[]string{"SET", "9.0.0.0/8", "AS1"}, "OK"},
+				{[]string{"SET", "2001:db8::/32", "AS1"}, "OK"},
+				{[]string{"SET", "10.2.0.0/16", "AS2"}, "OK"},
+				{[]string{"SET", "10.3.0.0/16", "AS10"}, "OK"},
+				{[]string{"HSET", "10.4.0.0/16", "asn", "AS1"}, "1"},
+				{[]string{"SET", "10.5.0.0/16", "AS1", "PX", "1"}, "OK"},
+			})
+			time.Sleep(2 * time.Millisecond)
+			runSteps(t, ss, []replyStep{{append([]string{"DELVALUE"}, tc.args...), tc.want}})
+			if tc.left == "" {
+				continue
+			}
+			mustDo(t, ss, "CONFIG", "SET", "value-index", "yes")
+			runSteps(t, ss, []replyStep{
+				{[]string{"VKEYS", "AS1"}, tc.left},
+				{[]string{"VKEYS", "AS2"}, "[10.2.0.0/16]"},
+				{[]string{"VKEYS", "AS10"}, "[10.3.0.0/16]"},
+				{[]string{"HGET", "10.4.0.0/16", "asn"}, "AS1"},
+			})
+		}
+	}
+}
+
+func TestDelValueAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	ss := newTestSession(t, newTestServer(t))
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "audit-log-file", path, "audit-log", "yes"}, "OK"},
+		{[]string{"SET", "2001:db8::/32", "AS1"}, "OK"},
+		{[]string{"SET", "10.1.0.0/16", "AS1"}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "AS1"}, "OK"},
+		{[]string{"DELVALUE", "AS1"}, "3"},
+		{[]string{"DELVALUE", "AS1"}, "0"},
+	})
+	entries := readAudit(t, path, 4)
+	if len(entries) != 4 {
+		t.Fatalf("%d audit entries, want 4", len(entries))
+	}
+	if e := entries[3]; e.Cmd != "DELVALUE" || strings.Join(e.Prefixes, " ") != "10.0.0.0/8 10.1.0.0/16 2001:db8::/32" {
+		t.Errorf("audit entry %+v, want DELVALUE of the three prefixes in order", e)
+	}
+}
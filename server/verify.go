@@ -0,0 +1,335 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// verifyBatch is how many prefixes DEBUG VERIFY and DEBUG DIGEST read
+// under one shard read lock before letting writers in.
+const verifyBatch = 1024
+
+// maxVerifyDetails is how many discrepancies a DEBUG VERIFY reply quotes.
+const maxVerifyDetails = 32
+
+// verifier is the state of one DEBUG VERIFY of a database.
+type verifier struct {
+	d  *database
+	ix *prefixIndex // the value index, if there is one
+
+	keys4, keys6 int64
+	lengths4     [33]int64
+	lengths6     [129]int64
+	bytes        int64
+	deadlines    int64 // prefixes with a TTL
+	expired      int64 // prefixes past their deadline, not yet deleted
+	tagPairs     int64
+	valuePairs   int64
+	interned     map[string]int64 // references to pooled values
+
+	problems int
+	details  []string
+}
+
+// fail records a discrepancy.
+func (vr *verifier) fail(format string, args ...any) {
+	vr.problems++
+	if len(vr.details) < maxVerifyDetails {
+		vr.details = append(vr.details, fmt.Sprintf(format, args...))
+	}
+}
+
+// entry checks p, stored in sh with value v, against the structures kept
+// alongside the trie, and tallies it. The caller holds sh read locked, so
+// no writer is midway through updating them for p.
+func (vr *verifier) entry(sh *shard, p netip.Prefix, v value) {
+	d := vr.d
+	if !p.IsValid() || p != p.Masked() {
+		vr.fail("%s: stored prefix is not masked", p)
+	}
+	if d.shardFor(p) != sh {
+		vr.fail("%s: stored in the wrong shard", p)
+	}
+	kinds := 0
+	for _, is := range []bool{v.isString(), v.isHash(), v.isSet()} {
+		if is {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		vr.fail("%s: value holds %d of string, hash and set", p, kinds)
+	}
+
+	// Deadlines.
+	at, queued := d.expiries.deadline(p)
+	switch {
+	case v.expireAt != 0 && !queued:
+		vr.fail("%s: has a TTL but no expiry record", p)
+	case v.expireAt != 0 && at != v.expireAt:
+		vr.fail("%s: expires at %d but its expiry record says %d", p, v.expireAt, at)
+	case v.expireAt == 0 && queued:
+		vr.fail("%s: has no TTL but an expiry record for %d", p, at)
+	}
+	if v.expireAt != 0 {
+		vr.deadlines++
+		if v.expired() {
+			vr.expired++
+		}
+	}
+
+	// Tags and the value index.
+	uniq := slices.Compact(slices.Clone(v.tags))
+	if !slices.IsSorted(v.tags) || len(uniq) != len(v.tags) {
+		vr.fail("%s: tags are not sorted and unique", p)
+	}
+	for _, t := range uniq {
+		if t == "" {
+			vr.fail("%s: has an empty tag", p)
+		}
+		if !d.tags.has(p, t) {
+			vr.fail("%s: tag '%s' missing from the tag index", p, t)
+		}
+	}
+	vr.tagPairs += int64(len(uniq))
+	if vr.ix != nil && v.isString() {
+		if !vr.ix.has(p, string(v.str)) {
+			vr.fail("%s: value missing from the value index", p)
+		}
+		vr.valuePairs++
+	}
+
+	// Interning.
+	if v.isString() && d.pool.refs(v.str) > 0 {
+		vr.interned[string(v.str)]++
+	}
+
+	// Counters.
+	if p.Addr().Is4() {
+		vr.keys4++
+		vr.lengths4[p.Bits()]++
+	} else {
+		vr.keys6++
+		vr.lengths6[p.Bits()]++
+	}
+	vr.bytes += entrySize(v)
+}
+
+// walk checks every stored prefix.
+func (vr *verifier) walk() {
+	vr.d.walkBatches(vr.entry)
+}
+
+// walkBatches calls fn with every stored prefix, shard by shard, holding
+// the shard read locked verifyBatch prefixes at a time and letting
+// writers in between, so a long walk never stalls them. A prefix written
+// meanwhile may or may not be seen.
+func (d *database) walkBatches(fn func(sh *shard, p netip.Prefix, v value)) {
+	for _, sh := range d.allShards() {
+		var after netip.Prefix
+		for n := verifyBatch; n == verifyBatch; {
+			n = 0
+			sh.mu.RLock()
+			sh.trie.Ascend(after, func(p netip.Prefix, v value) bool {
+				after = p
+				fn(sh, p, v)
+				n++
+				return n < verifyBatch
+			})
+			sh.mu.RUnlock()
+			runtime.Gosched()
+		}
+	}
+}
+
+// stored calls fn with p's stored value, if any, holding p's shard read
+// locked.
+func (vr *verifier) stored(p netip.Prefix, fn func(v value, ok bool)) {
+	sh := vr.d.shardFor(p)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	v, ok := sh.trie.Get(p)
+	fn(v, ok)
+}
+
+// reverse checks that every expiry record and index entry refers to a
+// stored prefix that agrees with it. Each is checked again under its
+// shard's read lock, so one a writer removed meanwhile is not reported.
+func (vr *verifier) reverse() {
+	d := vr.d
+	n := 0
+	yield := func() {
+		if n++; n%verifyBatch == 0 {
+			runtime.Gosched()
+		}
+	}
+	for _, p := range d.expiries.prefixes() {
+		vr.stored(p, func(_ value, ok bool) {
+			if _, queued := d.expiries.deadline(p); queued && !ok {
+				vr.fail("%s: expiry record for a prefix not stored", p) // the walk checked stored ones
+			}
+		})
+		yield()
+	}
+	d.tags.each(func(p netip.Prefix, t string) {
+		vr.stored(p, func(v value, ok bool) {
+			if _, tagged := slices.BinarySearch(v.tags, t); d.tags.has(p, t) && !tagged {
+				vr.fail("%s: tag index lists it under '%s', which it does not carry", p, t)
+			}
+		})
+		yield()
+	})
+	if vr.ix != nil {
+		vr.ix.each(func(p netip.Prefix, val string) {
+			vr.stored(p, func(v value, ok bool) {
+				if vr.ix.has(p, val) && (!v.isString() || string(v.str) != val) {
+					vr.fail("%s: value index lists it under a value it does not hold", p)
+				}
+			})
+			yield()
+		})
+	}
+	for _, idx := range []struct {
+		name string
+		ix   *prefixIndex
+	}{{"tag", d.tags}, {"value", vr.ix}} {
+		name, ix := idx.name, idx.ix
+		if ix == nil {
+			continue
+		}
+		ix.mu.Lock()
+		var entries int64
+		for _, set := range ix.byKey {
+			entries += int64(len(set))
+		}
+		distinct := int64(len(ix.byKey))
+		ix.mu.Unlock()
+		if got := ix.distinct.Load(); got != distinct {
+			vr.fail("%s index counts %d strings but holds %d", name, got, distinct)
+		}
+		if got := ix.entries.Load(); got != entries {
+			vr.fail("%s index counts %d entries but holds %d", name, got, entries)
+		}
+	}
+}
+
+// counters compares the maintained counters with the walk's tallies,
+// which only hold if nothing was written since it began.
+func (vr *verifier) counters() {
+	d := vr.d
+	compare := func(what string, kept, counted int64) {
+		if kept != counted {
+			vr.fail("%s is %d but %d were counted", what, kept, counted)
+		}
+	}
+	compare("keys4", d.keys4.Load(), vr.keys4)
+	compare("keys6", d.keys6.Load(), vr.keys6)
+	var sum4, sum6 int64
+	for i := range d.lengths4 {
+		sum4 += d.lengths4[i].Load()
+		compare(fmt.Sprintf("the count of IPv4 /%d prefixes", i), d.lengths4[i].Load(), vr.lengths4[i])
+	}
+	for i := range d.lengths6 {
+		sum6 += d.lengths6[i].Load()
+		compare(fmt.Sprintf("the count of IPv6 /%d prefixes", i), d.lengths6[i].Load(), vr.lengths6[i])
+	}
+	compare("the sum of the IPv4 length counts", sum4, d.keys4.Load())
+	compare("the sum of the IPv6 length counts", sum6, d.keys6.Load())
+	compare("the dataset size", d.bytes.Load(), vr.bytes)
+	compare("the expiry record count", d.expiries.len(), vr.deadlines)
+	compare("the tag index entry count", d.tags.entries.Load(), vr.tagPairs)
+	if vr.ix != nil {
+		compare("the value index entry count", vr.ix.entries.Load(), vr.valuePairs)
+	}
+
+	refs := d.pool.counts()
+	var saved int64
+	for val, n := range refs {
+		saved += int64(len(val)) * (n - 1)
+		if vr.interned[val] != n {
+			vr.fail("interned value %q has %d references but %d prefixes use it", val, n, vr.interned[val])
+		}
+	}
+	compare("the interned value count", d.pool.distinct.Load(), int64(len(refs)))
+	compare("the bytes saved by interning", d.pool.saved.Load(), saved)
+}
+
+// verifyResult is what DEBUG VERIFY reports.
+type verifyResult struct {
+	keys, expired int64
+	quiet         bool   // no writes during the walk, so counters were compared
+	writes        uint64 // writes during the walk otherwise
+	problems      int
+	details       []string
+}
+
+// verify cross-checks d's trie with its counters, expiry queue, tag and
+// value indexes and intern pool. Shards are read-locked a batch at a time,
+// so writers carry on meanwhile. Every check of a prefix is made under its
+// shard's lock and holds however the database changes; the counters are
+// database-wide, so they are compared only if nothing was written during
+// the walk.
+func (d *database) verify() verifyResult {
+	vr := &verifier{d: d, ix: d.index.Load(), interned: make(map[string]int64)}
+	start := d.changes.Load()
+	vr.walk()
+	vr.reverse()
+	res := verifyResult{keys: vr.keys4 + vr.keys6, expired: vr.expired}
+	if res.writes = d.changes.Load() - start; res.writes == 0 {
+		problems, details := vr.problems, len(vr.details)
+		vr.counters()
+		if res.writes = d.changes.Load() - start; res.writes != 0 {
+			// A write landed while the counters were read, so their
+			// comparison cannot be trusted.
+			vr.problems, vr.details = problems, vr.details[:details]
+		}
+	}
+	res.quiet = res.writes == 0
+	res.problems, res.details = vr.problems, vr.details
+	return res
+}
+
+// handleDebugVerify implements DEBUG VERIFY [DB index|name].
+func (s *TrieServer) handleDebugVerify(conn redcon.Conn, cmd redcon.Command) {
+	id := currentDB(conn)
+	switch {
+	case len(cmd.Args) == 4 && strings.EqualFold(string(cmd.Args[2]), "DB"):
+		n, err := s.resolveDB(string(cmd.Args[3]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		id = n
+	case len(cmd.Args) != 2:
+		conn.WriteError("ERR syntax error")
+		return
+	}
+	res := verifyResult{quiet: true}
+	if db := s.existingDB(id); db != nil {
+		res = db.verify()
+	}
+	conn.WriteArray(12)
+	conn.WriteBulkString("db")
+	conn.WriteInt(id)
+	conn.WriteBulkString("keys")
+	conn.WriteInt64(res.keys)
+	conn.WriteBulkString("expired")
+	conn.WriteInt64(res.expired)
+	conn.WriteBulkString("counters")
+	if res.quiet {
+		conn.WriteBulkString("checked")
+	} else {
+		conn.WriteBulkString(fmt.Sprintf("skipped, %d writes during the walk", res.writes))
+	}
+	conn.WriteBulkString("discrepancies")
+	conn.WriteInt(res.problems)
+	conn.WriteBulkString("details")
+	conn.WriteArray(len(res.details))
+	for _, d := range res.details {
+		conn.WriteBulkString(d)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// verifyReply runs DEBUG VERIFY on ss and returns its fields by name.
+func verifyReply(t *testing.T, ss *testSession) map[string]Reply {
+	t.Helper()
+	r := mustDo(t, ss, "DEBUG", "VERIFY")
+	fields := make(map[string]Reply)
+	for i := 0; i+1 < len(r.Array); i += 2 {
+		fields[r.Array[i].Str] = r.Array[i+1]
+	}
+	return fields
+}
+
+// verifyWorkload runs steps random writes of every kind DEBUG VERIFY
+// cross-checks: strings, hashes, sets, tags, TTLs and deletes.
+func verifyWorkload(ss *testSession, r *rand.Rand, pool []string, steps int) {
+	for range steps {
+		k := pool[r.IntN(len(pool))]
+		v := "AS" + strconv.Itoa(r.IntN(5))
+		switch op := r.IntN(22); {
+		case op < 8:
+			ss.Do("SET", k, v)
+		case op < 10:
+			ss.Do("SET", k, v, "PX", strconv.Itoa(1+r.IntN(20)))
+		case op < 11:
+			ss.Do("SET", k, v, "EX", "100")
+		case op < 12:
+			ss.Do("HSET", k, "f"+strconv.Itoa(r.IntN(3)), v)
+		case op < 13:
+			ss.Do("SADD", k, v)
+		case op < 15:
+			ss.Do("TAG", k, "ADD", "t"+strconv.Itoa(r.IntN(3)))
+		case op < 16:
+			ss.Do("TAG", k, "DEL", "t"+strconv.Itoa(r.IntN(3)))
+		case op < 20:
+			ss.Do("DEL", k)
+		case op < 21:
+			ss.Do("DELVALUE", v, "WITHIN", netip.PrefixFrom(netip.MustParsePrefix(k).Addr(), 3).Masked().String())
+		default:
+			ss.Do("APPEND", k, "x")
+		}
+	}
+}
+
+// TestDebugVerify runs DEBUG VERIFY after rounds of a random workload,
+// with the value index and interning on, and then while writers run.
+func TestDebugVerify(t *testing.T) {
+	s := newTestServer(t)
+	s.store.valueIndex.Store(true)
+	s.store.interning.Store(true)
+	ss := newTestSession(t, s)
+	r := rand.New(rand.NewPCG(15, 16))
+	var pool []string
+	for range 200 {
+		pool = append(pool, randomPrefix(r, 4, 4).String(), randomPrefix(r, 16, 8).String())
+	}
+	for round := range 8 {
+		verifyWorkload(ss, r, pool, 400)
+		if round%2 == 1 {
+			time.Sleep(25 * time.Millisecond) // let the PX prefixes expire unreaped
+		}
+		res := verifyReply(t, ss)
+		if n := res["discrepancies"].Int; n != 0 || res["counters"].Str != "checked" {
+			t.Fatalf("round %d: DEBUG VERIFY found %d discrepancies, counters %s: %q",
+				round, n, res["counters"].Str, res["details"].strs())
+		}
+		if keys, dbsize := res["keys"].Int, mustDo(t, ss, "DBSIZE").Int; keys != dbsize {
+			t.Fatalf("round %d: DEBUG VERIFY walked %d keys, DBSIZE = %d", round, keys, dbsize)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range 3 {
+		ws := newTestSession(t, s)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			verifyWorkload(ws, rand.New(rand.NewPCG(uint64(i), 17)), pool, 1000)
+		}()
+	}
+	for range 5 {
+		if res := verifyReply(t, ss); res["discrepancies"].Int != 0 {
+			t.Fatalf("DEBUG VERIFY during writes: %q", res["details"].strs())
+		}
+	}
+	wg.Wait()
+	if res := verifyReply(t, ss); res["discrepancies"].Int != 0 || res["counters"].Str != "checked" {
+		t.Fatalf("DEBUG VERIFY after the writers: counters %s, %q", res["counters"].Str, res["details"].strs())
+	}
+}
+
+// TestDebugVerifyFindsDamage breaks one piece of bookkeeping at a time
+// and checks DEBUG VERIFY reports it.
+func TestDebugVerifyFindsDamage(t *testing.T) {
+	p := netip.MustParsePrefix("10.1.0.0/16")
+	for _, tc := range []struct {
+		name   string
+		damage func(d *database)
+		want   string // the start of the one detail reported
+	}{
+		{"IPv4 key count", func(d *database) { d.keys4.Add(1) }, "keys4 is 4 but 3 were counted"},
+		{"IPv6 key count", func(d *database) { d.keys6.Add(-1) }, "keys6 is 0 but 1 were counted"},
+		{"dataset size", func(d *database) { d.bytes.Add(7) }, "the dataset size is"},
+		{"lost expiry record", func(d *database) { d.expiries.clear() }, "10.2.0.0/16: has a TTL but no expiry record"},
+		{"wrong deadline", func(d *database) { d.expiries.set(netip.MustParsePrefix("10.2.0.0/16"), 1) }, "10.2.0.0/16: expires at"},
+		{"stray expiry record", func(d *database) { d.expiries.set(p, time.Now().Add(time.Hour).UnixMilli()) }, "10.1.0.0/16: has no TTL but an expiry record"},
+		{"lost tag", func(d *database) { d.tags.remove(p, "edge") }, "10.1.0.0/16: tag 'edge' missing from the tag index"},
+		{"stray tag", func(d *database) { d.tags.add(netip.MustParsePrefix("10.0.0.0/8"), "edge") }, "10.0.0.0/8: tag index lists it under 'edge'"},
+		{"lost value index entry", func(d *database) { d.index.Load().remove(p, "b") }, "10.1.0.0/16: value missing from the value index"},
+		{"stray value index entry", func(d *database) { d.index.Load().add(p, "a") }, "10.1.0.0/16: value index lists it under a value it does not hold"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.store.valueIndex.Store(true)
+			ss := newTestSession(t, s)
+			runSteps(t, ss, []replyStep{
+				{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+				{[]string{"SET", "10.1.0.0/16", "b"}, "OK"},
+				{[]string{"SET", "10.2.0.0/16", "c", "EX", "100"}, "OK"},
+				{[]string{"SET", "2001:db8::/32", "d"}, "OK"},
+				{[]string{"TAG", "10.1.0.0/16", "ADD", "edge"}, "1"},
+			})
+			if res := verifyReply(t, ss); res["discrepancies"].Int != 0 {
+				t.Fatalf("DEBUG VERIFY before the damage: %q", res["details"].strs())
+			}
+			tc.damage(s.getDB(0))
+			res := verifyReply(t, ss)
+			details := res["details"].strs()
+			if res["discrepancies"].Int == 0 || !strings.HasPrefix(strings.Join(details, "\n"), tc.want) {
+				t.Errorf("DEBUG VERIFY reported %q, want %q first", details, tc.want)
+			}
+		})
+	}
+	runSteps(t, newTestSession(t, newTestServer(t)), []replyStep{
+		{[]string{"DEBUG", "VERIFY", "DB", "5"}, "[db 5 keys 0 expired 0 counters checked discrepancies 0 details []]"},
+		{[]string{"DEBUG", "VERIFY", "DB", "nosuch"}, "ERR unknown database name"},
+		{[]string{"DEBUG", "VERIFY", "5"}, "ERR syntax error"},
+	})
+}
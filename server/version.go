@@ -0,0 +1,28 @@
+package server
+
+import "runtime/debug"
+
+// version is the triedis release. gitSHA is normally baked in at build
+// time with
+//
+//	-ldflags "-X github.com/tannerklineintz/triedis/server.gitSHA=$(git rev-parse HEAD)"
+var (
+	version = "0.1.0"
+	gitSHA  = ""
+)
+
+// buildSHA returns gitSHA, falling back to the VCS revision the Go
+// toolchain stamps into binaries built from a checkout.
+func buildSHA() string {
+	if gitSHA != "" {
+		return gitSHA
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, kv := range info.Settings {
+			if kv.Key == "vcs.revision" {
+				return kv.Value
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With webhook-urls set, every successful write is also sent, as a JSON
+// event, to each of the URLs: the command, the database, the prefix and
+// its value after the write (null once deleted, or if it is not a
+// string), and when, in unix milliseconds. A command writing many
+// prefixes sends one event for each; one acting on a whole database, such
+// as FLUSHDB or IMPORT, sends a single event without a prefix. With
+// webhook-filter set, only events of prefixes it covers are sent, and
+// those without a prefix always are. Events are the same writes the
+// audit log records.
+//
+// Each URL has a queue of its own and is posted a JSON array of up to
+// webhook-batch-size events at a time, as many as have queued while the
+// last was being delivered. A failed post is retried webhook-max-retries
+// times, backing off from webhookBackoff, before its events are dropped.
+// Once webhook-max-pending events are queued for a URL, more are dropped,
+// so a sink that is down or slow never blocks a write. INFO counts the
+// events delivered, dropped and pending.
+
+const (
+	// webhookTimeout bounds one post.
+	webhookTimeout = 10 * time.Second
+	// webhookBackoff is the wait before the first retry of a post, which
+	// doubles for each further one up to webhookMaxBackoff.
+	webhookBackoff    = 100 * time.Millisecond
+	webhookMaxBackoff = 10 * time.Second
+)
+
+// webhookEvent is one write, as sinks receive it.
+type webhookEvent struct {
+	Op        string  `json:"op"`
+	DB        int     `json:"db"`
+	Prefix    string  `json:"prefix,omitempty"`
+	Value     *string `json:"value"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// webhooks holds the webhook settings and sinks.
+type webhooks struct {
+	mu     sync.Mutex // serializes changes to sinks
+	sinks  atomic.Pointer[[]*webhookSink]
+	filter atomic.Pointer[prefixList]
+	client *http.Client
+
+	batchSize  atomic.Int64
+	maxPending atomic.Int64
+	maxRetries atomic.Int64
+
+	delivered atomic.Int64
+	dropped   atomic.Int64 // queue full, retries exhausted or sink removed
+	pending   atomic.Int64
+}
+
+func newWebhooks() *webhooks {
+	w := &webhooks{client: &http.Client{Timeout: webhookTimeout}}
+	w.sinks.Store(&[]*webhookSink{})
+	w.filter.Store(&prefixList{})
+	w.batchSize.Store(100)
+	w.maxPending.Store(10000)
+	w.maxRetries.Store(3)
+	return w
+}
+
+// webhookSink is one URL events are posted to, with its queue.
+type webhookSink struct {
+	url     string
+	mu      sync.Mutex
+	queue   []webhookEvent
+	wake    chan struct{} // signalled when events are queued
+	stop    chan struct{} // closed when the URL is removed
+	failing bool          // only the sink's goroutine uses it
+}
+
+// parseWebhookURLs parses URLs separated by spaces or commas.
+func parseWebhookURLs(v string) ([]string, error) {
+	urls := strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid webhook URL '%s', expected an http(s) URL", raw)
+		}
+	}
+	return urls, nil
+}
+
+// setURLs replaces the sinks with one per URL. A sink whose URL is kept
+// keeps its queue; one whose URL is removed drops it.
+func (w *webhooks) setURLs(urls []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old := make(map[string]*webhookSink)
+	for _, sk := range *w.sinks.Load() {
+		old[sk.url] = sk
+	}
+	sinks := make([]*webhookSink, 0, len(urls))
+	for _, u := range urls {
+		sk, ok := old[u]
+		if !ok {
+			sk = &webhookSink{url: u, wake: make(chan struct{}, 1), stop: make(chan struct{})}
+			go w.run(sk)
+		}
+		delete(old, u)
+		sinks = append(sinks, sk)
+	}
+	w.sinks.Store(&sinks)
+	for _, sk := range old {
+		close(sk.stop)
+	}
+}
+
+func (w *webhooks) String() string {
+	sinks := *w.sinks.Load()
+	urls := make([]string, len(sinks))
+	for i, sk := range sinks {
+		urls[i] = sk.url
+	}
+	return strings.Join(urls, " ")
+}
+
+// send queues e for every sink, dropping it for those whose queue is full.
+func (w *webhooks) send(e webhookEvent) {
+	max := int(w.maxPending.Load())
+	for _, sk := range *w.sinks.Load() {
+		sk.mu.Lock()
+		full := len(sk.queue) >= max
+		if !full {
+			sk.queue = append(sk.queue, e)
+		}
+		sk.mu.Unlock()
+		if full {
+			w.dropped.Add(1)
+			continue
+		}
+		w.pending.Add(1)
+		select {
+		case sk.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run delivers sk's events until its URL is removed.
+func (w *webhooks) run(sk *webhookSink) {
+	for {
+		select {
+		case <-sk.stop:
+			sk.mu.Lock()
+			n := int64(len(sk.queue))
+			sk.queue = nil
+			sk.mu.Unlock()
+			w.dropped.Add(n)
+			w.pending.Add(-n)
+			return
+		case <-sk.wake:
+		}
+		for {
+			sk.mu.Lock()
+			n := min(len(sk.queue), int(max(w.batchSize.Load(), 1)))
+			batch := sk.queue[:n:n]
+			sk.queue = sk.queue[n:]
+			sk.mu.Unlock()
+			if n == 0 {
+				break
+			}
+			w.deliver(sk, batch)
+		}
+	}
+}
+
+// deliver posts batch to sk, retrying with backoff. A failing sink is
+// logged when it starts and stops failing, not on every post.
+func (w *webhooks) deliver(sk *webhookSink, batch []webhookEvent) {
+	n := int64(len(batch))
+	defer w.pending.Add(-n)
+	wait := webhookBackoff
+	for attempt := int64(0); ; attempt++ {
+		err := w.post(sk.url, batch)
+		if err == nil {
+			if sk.failing {
+				slog.Info("webhook delivery recovered", "url", sk.url)
+			}
+			sk.failing = false
+			w.delivered.Add(n)
+			return
+		}
+		if attempt >= w.maxRetries.Load() {
+			if !sk.failing {
+				slog.Warn("webhook delivery failed, dropping events until it recovers", "url", sk.url, "err", err)
+			}
+			sk.failing = true
+			w.dropped.Add(n)
+			return
+		}
+		select {
+		case <-sk.stop:
+			w.dropped.Add(n)
+			return
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, webhookMaxBackoff)
+	}
+}
+
+// post sends one batch of events.
+func (w *webhooks) post(u string, batch []webhookEvent) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "triedis/"+version)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyWebhooks sends the events of a successful write to database db,
+// which auditDB reports.
+func (s *TrieServer) notifyWebhooks(db int, cmd string, prefixes []string) {
+	w := s.webhooks
+	if len(*w.sinks.Load()) == 0 {
+		return
+	}
+	now := time.Now().UnixMilli()
+	if len(prefixes) == 0 {
+		w.send(webhookEvent{Op: cmd, DB: db, Timestamp: now})
+		return
+	}
+	filter := *w.filter.Load()
+	d := s.existingDB(db)
+	for _, cidr := range prefixes {
+		p, err := parsePrefix(cidr)
+		if err != nil || !filterCovers(filter, p) {
+			continue
+		}
+		e := webhookEvent{Op: cmd, DB: db, Prefix: p.String(), Timestamp: now}
+		if d != nil {
+			if v, ok := d.peekExact(cidr); ok && v.isString() {
+				str := string(v.str)
+				e.Value = &str
+			}
+		}
+		w.send(e)
+	}
+}
+
+// filterCovers reports whether some network in l covers p, as every
+// prefix is when l is empty.
+func filterCovers(l prefixList, p netip.Prefix) bool {
+	if len(l) == 0 {
+		return true
+	}
+	for _, f := range l {
+		if covers(f, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// registerWebhookConfig exposes the webhook settings.
+func (s *TrieServer) registerWebhookConfig() {
+	w := s.webhooks
+	s.addConfig("webhook-urls", w.String, func(v string) error {
+		urls, err := parseWebhookURLs(v)
+		if err != nil {
+			return err
+		}
+		w.setURLs(urls)
+		return nil
+	})
+	s.addConfig("webhook-filter",
+		func() string { return w.filter.Load().String() },
+		func(v string) error {
+			l, err := parsePrefixList(v)
+			if err != nil {
+				return err
+			}
+			w.filter.Store(&l)
+			return nil
+		})
+	intParam := func(name string, n *atomic.Int64, least int64) {
+		s.addConfig(name,
+			func() string { return strconv.FormatInt(n.Load(), 10) },
+			func(v string) error {
+				i, err := strconv.ParseInt(v, 10, 64)
+				if err != nil || i < least {
+					return errors.New("argument must be an integer of at least " + strconv.FormatInt(least, 10))
+				}
+				n.Store(i)
+				return nil
+			})
+	}
+	intParam("webhook-batch-size", &w.batchSize, 1)
+	intParam("webhook-max-pending", &w.maxPending, 1)
+	intParam("webhook-max-retries", &w.maxRetries, 0)
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseWebhookURLs(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string // the URLs joined by spaces, or the error
+	}{
+		{"", ""},
+		{"http://sink:8080/hook", "http://sink:8080/hook"},
+		{"https://a.example/x, http://b.example", "https://a.example/x http://b.example"},
+		{"ftp://sink/hook", "invalid webhook URL 'ftp://sink/hook', expected an http(s) URL"},
+		{"http:///hook", "invalid webhook URL 'http:///hook', expected an http(s) URL"},
+		{"sink:8080", "invalid webhook URL 'sink:8080', expected an http(s) URL"},
+	} {
+		urls, err := parseWebhookURLs(tc.in)
+		got := strings.Join(urls, " ")
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tc.want {
+			t.Errorf("parseWebhookURLs(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// webhookSinkServer is a sink that collects the events posted to it,
+// failing the first fails posts.
+type webhookSinkServer struct {
+	*httptest.Server
+	fails  atomic.Int64
+	posts  atomic.Int64
+	events chan webhookEvent
+}
+
+func newWebhookSinkServer(t *testing.T) *webhookSinkServer {
+	t.Helper()
+	ws := &webhookSinkServer{events: make(chan webhookEvent, 100)}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws.posts.Add(1)
+		if ws.fails.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("post %s: %v", r.Header.Get("Content-Type"), err)
+		}
+		for _, e := range batch {
+			ws.events <- e
+		}
+	}))
+	t.Cleanup(ws.Close)
+	return ws
+}
+
+// next returns the next event posted to ws.
+func (ws *webhookSinkServer) next(t *testing.T) webhookEvent {
+	t.Helper()
+	select {
+	case e := <-ws.events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook event")
+	}
+	return webhookEvent{}
+}
+
+// eventString is e without its timestamp, as op db prefix value.
+func eventString(e webhookEvent) string {
+	v := "null"
+	if e.Value != nil {
+		v = *e.Value
+	}
+	return strings.Join([]string{e.Op, strconv.Itoa(e.DB), e.Prefix, v}, " ")
+}
+
+func TestWebhooks(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		filter string
+		steps  [][]string
+		want   []string // events, by eventString
+	}{
+		{
+			name:  "writes",
+			steps: [][]string{{"SET", "10.0.0.0/8", "a"}, {"HSET", "192.0.2.0/24", "f", "v"}, {"DEL", "10.0.0.0/8"}},
+			want:  []string{"SET 0 10.0.0.0/8 a", "HSET 0 192.0.2.0/24 null", "DEL 0 10.0.0.0/8 null"},
+		},
+		{
+			name:  "whole database",
+			steps: [][]string{{"SELECT", "2"}, {"FLUSHDB"}, {"SET", "10.0.0.0/8", "b"}},
+			want:  []string{"FLUSHDB 2  null", "SET 2 10.0.0.0/8 b"},
+		},
+		{
+			name:   "filtered",
+			filter: "192.0.2.0/24",
+			steps:  [][]string{{"SET", "10.0.0.0/8", "a"}, {"SET", "192.0.2.128/25", "b"}, {"FLUSHDB"}},
+			want:   []string{"SET 0 192.0.2.128/25 b", "FLUSHDB 0  null"},
+		},
+		{
+			name:  "SETIF as the SET it amounts to",
+			steps: [][]string{{"SETIF", "10.0.0.0/8", "ABSENT", "a"}, {"SETIF", "10.0.0.0/8", "b", "c"}, {"SETIF", "10.0.0.0/8", "a", "d"}},
+			want:  []string{"SET 0 10.0.0.0/8 a", "SET 0 10.0.0.0/8 d"},
+		},
+		{
+			name:  "reads and failed writes send nothing",
+			steps: [][]string{{"GET", "10.1.2.3"}, {"SET", "nope", "a"}, {"DEL", "10.0.0.0/8"}, {"SET", "10.0.0.0/8", "c"}},
+			want:  []string{"SET 0 10.0.0.0/8 c"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ws := newWebhookSinkServer(t)
+			s := newTestServer(t)
+			ss := newTestSession(t, s)
+			runSteps(t, ss, []replyStep{
+				{[]string{"CONFIG", "SET", "webhook-urls", ws.URL}, "OK"},
+				{[]string{"CONFIG", "SET", "webhook-filter", tc.filter}, "OK"},
+			})
+			t.Cleanup(func() { s.webhooks.setURLs(nil) })
+			for _, args := range tc.steps {
+				ss.Do(args...)
+			}
+			for _, want := range tc.want {
+				if got := eventString(ws.next(t)); got != want {
+					t.Errorf("event %q, want %q", got, want)
+				}
+			}
+			select {
+			case e := <-ws.events:
+				t.Errorf("extra event %q", eventString(e))
+			case <-time.After(20 * time.Millisecond):
+			}
+			info := infoFields(mustDo(t, ss, "INFO", "stats").Str)
+			if info["webhook_events_delivered"] != strconv.Itoa(len(tc.want)) || info["webhook_events_pending"] != "0" {
+				t.Errorf("INFO delivered %s, pending %s, want %d and 0",
+					info["webhook_events_delivered"], info["webhook_events_pending"], len(tc.want))
+			}
+		})
+	}
+}
+
+// waitWebhooks waits until no event is pending and returns INFO stats.
+func waitWebhooks(t *testing.T, ss *testSession) map[string]string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info := infoFields(mustDo(t, ss, "INFO", "stats").Str)
+		if info["webhook_events_pending"] == "0" || time.Now().After(deadline) {
+			return info
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	for _, tc := range []struct {
+		retries            string
+		fails, posts       int64
+		delivered, dropped string
+	}{
+		{"3", 2, 3, "1", "0"},
+		{"1", 2, 2, "0", "1"},
+		{"0", 1, 1, "0", "1"},
+	} {
+		ws := newWebhookSinkServer(t)
+		ws.fails.Store(tc.fails)
+		s := newTestServer(t)
+		ss := newTestSession(t, s)
+		runSteps(t, ss, []replyStep{
+			{[]string{"CONFIG", "SET", "webhook-max-retries", tc.retries}, "OK"},
+			{[]string{"CONFIG", "SET", "webhook-urls", ws.URL}, "OK"},
+			{[]string{"SET", "10.0.0.0/8", "a"}, "OK"},
+		})
+		info := waitWebhooks(t, ss)
+		if info["webhook_events_delivered"] != tc.delivered || info["webhook_events_dropped"] != tc.dropped || ws.posts.Load() != tc.posts {
+			t.Errorf("%d failures, %s retries: delivered %s, dropped %s after %d posts, want %s, %s after %d",
+				tc.fails, tc.retries, info["webhook_events_delivered"], info["webhook_events_dropped"], ws.posts.Load(),
+				tc.delivered, tc.dropped, tc.posts)
+		}
+		s.webhooks.setURLs(nil)
+	}
+}
+
+// TestWebhookMaxPending holds a sink's first post open so that later
+// events queue behind it.
+func TestWebhookMaxPending(t *testing.T) {
+	release := make(chan struct{})
+	var posts atomic.Int64
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if posts.Add(1) == 1 {
+			<-release
+		}
+	}))
+	defer sink.Close()
+	s := newTestServer(t)
+	ss := newTestSession(t, s)
+	defer s.webhooks.setURLs(nil)
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "SET", "webhook-max-pending", "3"}, "OK"},
+		{[]string{"CONFIG", "SET", "webhook-batch-size", "2"}, "OK"},
+		{[]string{"CONFIG", "SET", "webhook-urls", sink.URL}, "OK"},
+		{[]string{"SET", "10.0.0.0/8", "held"}, "OK"},
+	})
+	for posts.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, cidr := range []string{"10.1.0.0/16", "10.2.0.0/16", "10.3.0.0/16", "10.4.0.0/16", "10.5.0.0/16"} {
+		mustDo(t, ss, "SET", cidr, "queued")
+	}
+	if info := infoFields(mustDo(t, ss, "INFO", "stats").Str); info["webhook_events_pending"] != "4" || info["webhook_events_dropped"] != "2" {
+		t.Errorf("a held post and 5 more events: pending %s, dropped %s, want 4 and 2",
+			info["webhook_events_pending"], info["webhook_events_dropped"])
+	}
+	close(release)
+	if info := waitWebhooks(t, ss); info["webhook_events_delivered"] != "4" || posts.Load() != 3 {
+		t.Errorf("delivered %s in %d posts, want 4 in 3", info["webhook_events_delivered"], posts.Load())
+	}
+	runSteps(t, ss, []replyStep{
+		{[]string{"CONFIG", "GET", "webhook-urls"}, "[webhook-urls " + sink.URL + "]"},
+		{[]string{"CONFIG", "SET", "webhook-urls", "ftp://x"}, "ERR"},
+		{[]string{"CONFIG", "SET", "webhook-filter", "nope"}, "ERR"},
+		{[]string{"CONFIG", "SET", "webhook-batch-size", "0"}, "ERR"},
+		{[]string{"CONFIG", "SET", "webhook-max-pending", "0"}, "ERR"},
+		{[]string{"CONFIG", "SET", "webhook-max-retries", "-1"}, "ERR"},
+		{[]string{"CONFIG", "SET", "webhook-max-retries", "0"}, "OK"},
+	})
+}
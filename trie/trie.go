@@ -0,0 +1,476 @@
+// Package trie implements a path-compressed binary trie (a Patricia trie)
+// keyed by IP prefixes. IPv4 and IPv6 prefixes live under separate roots,
+// so a v4 prefix never matches a v6 address or the other way round.
+//
+// A Trie is not safe for concurrent use; callers serialize access.
+package trie
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"math/rand/v2"
+	"net/netip"
+)
+
+// node is either a stored prefix or a glue node that only exists to join
+// two subtrees that diverge below its prefix. The value is held apart, so
+// a node fits in one cache line however large V is: lookups read a node
+// at every step down but the value only at the node they return, and
+// glue nodes, about half of all, cost no space for one.
+type node[V any] struct {
+	prefix netip.Prefix // always masked
+	child  [2]*node[V]
+	value  *V // nil for glue nodes
+}
+
+// Trie maps IP prefixes to values of type V.
+type Trie[V any] struct {
+	root4, root6 *node[V]
+	len4, len6   int
+}
+
+// New returns an empty trie.
+func New[V any]() *Trie[V] {
+	return &Trie[V]{}
+}
+
+func (t *Trie[V]) root(p netip.Prefix) **node[V] {
+	if p.Addr().Is4() {
+		return &t.root4
+	}
+	return &t.root6
+}
+
+func (t *Trie[V]) count(p netip.Prefix, delta int) {
+	if p.Addr().Is4() {
+		t.len4 += delta
+	} else {
+		t.len6 += delta
+	}
+}
+
+// Len returns the number of stored prefixes.
+func (t *Trie[V]) Len() int { return t.len4 + t.len6 }
+
+// Len4 returns the number of stored IPv4 prefixes.
+func (t *Trie[V]) Len4() int { return t.len4 }
+
+// Len6 returns the number of stored IPv6 prefixes.
+func (t *Trie[V]) Len6() int { return t.len6 }
+
+// Clear removes every prefix.
+func (t *Trie[V]) Clear() {
+	*t = Trie[V]{}
+}
+
+// Insert stores v at p, returning the value it replaced, if any. p is
+// masked to its prefix length first.
+func (t *Trie[V]) Insert(p netip.Prefix, v V) (old V, replaced bool) {
+	p = p.Masked()
+	link := t.root(p)
+	for {
+		n := *link
+		if n == nil {
+			*link = &node[V]{prefix: p, value: &v}
+			t.count(p, 1)
+			return old, false
+		}
+		common := commonBits(n.prefix, p)
+		switch {
+		case common == n.prefix.Bits() && common == p.Bits():
+			if n.value != nil {
+				old, replaced = *n.value, true
+			} else {
+				t.count(p, 1)
+			}
+			n.value = &v
+			return old, replaced
+		case common == n.prefix.Bits():
+			// n covers p: descend.
+			link = &n.child[bitAt(p.Addr(), common)]
+		case common == p.Bits():
+			// p covers n: p becomes n's parent.
+			leaf := &node[V]{prefix: p, value: &v}
+			leaf.child[bitAt(n.prefix.Addr(), common)] = n
+			*link = leaf
+			t.count(p, 1)
+			return old, false
+		default:
+			// They diverge below common: join them under a glue node.
+			glue := &node[V]{prefix: netip.PrefixFrom(p.Addr(), common).Masked()}
+			leaf := &node[V]{prefix: p, value: &v}
+			glue.child[bitAt(p.Addr(), common)] = leaf
+			glue.child[bitAt(n.prefix.Addr(), common)] = n
+			*link = glue
+			t.count(p, 1)
+			return old, false
+		}
+	}
+}
+
+// find returns the node for exactly p, stored or glue.
+func (t *Trie[V]) find(p netip.Prefix) *node[V] {
+	p = p.Masked()
+	n := *t.root(p)
+	for n != nil {
+		if n.prefix.Bits() > p.Bits() || !n.prefix.Contains(p.Addr()) {
+			return nil
+		}
+		if n.prefix.Bits() == p.Bits() {
+			return n
+		}
+		n = n.child[bitAt(p.Addr(), n.prefix.Bits())]
+	}
+	return nil
+}
+
+// Get returns the value stored at exactly p.
+func (t *Trie[V]) Get(p netip.Prefix) (V, bool) {
+	if n := t.find(p); n != nil && n.value != nil {
+		return *n.value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Delete removes p, returning the value it held.
+func (t *Trie[V]) Delete(p netip.Prefix) (V, bool) {
+	p = p.Masked()
+	var old V
+	var found bool
+	link := t.root(p)
+	*link = t.delete(*link, p, &old, &found)
+	if found {
+		t.count(p, -1)
+	}
+	return old, found
+}
+
+// delete removes p from the subtree at n and returns its new root,
+// collapsing glue nodes left with fewer than two children.
+func (t *Trie[V]) delete(n *node[V], p netip.Prefix, old *V, found *bool) *node[V] {
+	if n == nil || n.prefix.Bits() > p.Bits() || !n.prefix.Contains(p.Addr()) {
+		return n
+	}
+	if n.prefix.Bits() < p.Bits() {
+		b := bitAt(p.Addr(), n.prefix.Bits())
+		n.child[b] = t.delete(n.child[b], p, old, found)
+	} else if n.value != nil {
+		*old, *found = *n.value, true
+		n.value = nil
+	}
+	if n.value != nil {
+		return n
+	}
+	switch {
+	case n.child[0] != nil && n.child[1] != nil:
+		return n
+	case n.child[0] != nil:
+		return n.child[0]
+	default:
+		return n.child[1]
+	}
+}
+
+// LongestMatch returns the most specific stored prefix containing p,
+// which may be p itself.
+func (t *Trie[V]) LongestMatch(p netip.Prefix) (netip.Prefix, V, bool) {
+	p = p.Masked()
+	var best *node[V]
+	for n := *t.root(p); n != nil; {
+		if n.prefix.Bits() > p.Bits() || !n.prefix.Contains(p.Addr()) {
+			break
+		}
+		if n.value != nil {
+			best = n
+		}
+		if n.prefix.Bits() == p.Bits() {
+			break
+		}
+		n = n.child[bitAt(p.Addr(), n.prefix.Bits())]
+	}
+	if best == nil {
+		var zero V
+		return netip.Prefix{}, zero, false
+	}
+	return best.prefix, *best.value, true
+}
+
+// ShortestMatch returns the least specific stored prefix containing p,
+// which may be p itself. It walks down from the root and stops at the
+// first stored node on the way.
+func (t *Trie[V]) ShortestMatch(p netip.Prefix) (netip.Prefix, V, bool) {
+	p = p.Masked()
+	for n := *t.root(p); n != nil; {
+		if n.prefix.Bits() > p.Bits() || !n.prefix.Contains(p.Addr()) {
+			break
+		}
+		if n.value != nil {
+			return n.prefix, *n.value, true
+		}
+		if n.prefix.Bits() == p.Bits() {
+			break
+		}
+		n = n.child[bitAt(p.Addr(), n.prefix.Bits())]
+	}
+	var zero V
+	return netip.Prefix{}, zero, false
+}
+
+// Supernets calls fn for every stored prefix containing p, p included,
+// from the least to the most specific, until fn returns false.
+func (t *Trie[V]) Supernets(p netip.Prefix, fn func(netip.Prefix, V) bool) {
+	p = p.Masked()
+	for n := *t.root(p); n != nil; {
+		if n.prefix.Bits() > p.Bits() || !n.prefix.Contains(p.Addr()) {
+			return
+		}
+		if n.value != nil && !fn(n.prefix, *n.value) {
+			return
+		}
+		if n.prefix.Bits() == p.Bits() {
+			return
+		}
+		n = n.child[bitAt(p.Addr(), n.prefix.Bits())]
+	}
+}
+
+// Parent returns the most specific stored prefix strictly containing p.
+func (t *Trie[V]) Parent(p netip.Prefix) (netip.Prefix, V, bool) {
+	p = p.Masked()
+	var parent netip.Prefix
+	var value V
+	var ok bool
+	t.Supernets(p, func(q netip.Prefix, v V) bool {
+		if q.Bits() < p.Bits() {
+			parent, value, ok = q, v, true
+		}
+		return true
+	})
+	return parent, value, ok
+}
+
+// Neighbors calls fn for every stored prefix other than p, from those
+// sharing the longest prefix with p to those sharing the shortest, until
+// fn returns false. Prefixes sharing as long a prefix come in no
+// particular order. Only the subtrees holding the prefixes visited are
+// walked, so stopping at the first is cheap.
+func (t *Trie[V]) Neighbors(p netip.Prefix, fn func(netip.Prefix, V) bool) {
+	p = p.Masked()
+	neighbors(*t.root(p), p, fn)
+}
+
+func neighbors[V any](n *node[V], p netip.Prefix, fn func(netip.Prefix, V) bool) bool {
+	switch {
+	case n == nil:
+		return true
+	case n.prefix.Bits() > p.Bits() || !n.prefix.Contains(p.Addr()):
+		// Every prefix below n shares exactly commonBits(n.prefix, p) bits.
+		return walk(n, fn)
+	case n.prefix.Bits() == p.Bits():
+		// Every prefix below p shares all of p.
+		return walk(n.child[0], fn) && walk(n.child[1], fn)
+	}
+	// p lies below n: the side holding it shares more of p than n itself
+	// and the other side, which share exactly n's bits.
+	side := bitAt(p.Addr(), n.prefix.Bits())
+	if !neighbors(n.child[side], p, fn) {
+		return false
+	}
+	if n.value != nil && !fn(n.prefix, *n.value) {
+		return false
+	}
+	return walk(n.child[1-side], fn)
+}
+
+// Common returns the longest prefix covering both a and b, which must be
+// of the same family.
+func Common(a, b netip.Prefix) netip.Prefix {
+	return netip.PrefixFrom(a.Addr(), commonBits(a.Masked(), b.Masked())).Masked()
+}
+
+// Depth returns how many nodes, glue included, lie above the node for p,
+// and whether p is stored.
+func (t *Trie[V]) Depth(p netip.Prefix) (int, bool) {
+	p = p.Masked()
+	depth := 0
+	for n := *t.root(p); n != nil; depth++ {
+		if n.prefix.Bits() > p.Bits() || !n.prefix.Contains(p.Addr()) {
+			break
+		}
+		if n.prefix.Bits() == p.Bits() {
+			return depth, n.value != nil
+		}
+		n = n.child[bitAt(p.Addr(), n.prefix.Bits())]
+	}
+	return 0, false
+}
+
+// subtree returns the top node of the subtree holding every prefix
+// covered by p, or nil if there are none.
+func (t *Trie[V]) subtree(p netip.Prefix) *node[V] {
+	p = p.Masked()
+	n := *t.root(p)
+	for n != nil && n.prefix.Bits() < p.Bits() {
+		if !n.prefix.Contains(p.Addr()) {
+			return nil
+		}
+		n = n.child[bitAt(p.Addr(), n.prefix.Bits())]
+	}
+	if n == nil || !p.Contains(n.prefix.Addr()) {
+		return nil
+	}
+	return n
+}
+
+// Subnets calls fn for every stored prefix covered by p, p included, in
+// address order with shorter prefixes first, until fn returns false.
+func (t *Trie[V]) Subnets(p netip.Prefix, fn func(netip.Prefix, V) bool) {
+	walk(t.subtree(p), fn)
+}
+
+// CountSubnets returns how many stored prefixes p strictly covers,
+// stopping once limit is reached. A limit of 0 or less means no limit.
+func (t *Trie[V]) CountSubnets(p netip.Prefix, limit int) int {
+	p = p.Masked()
+	count := 0
+	walk(t.subtree(p), func(q netip.Prefix, _ V) bool {
+		if q != p {
+			count++
+		}
+		return limit <= 0 || count < limit
+	})
+	return count
+}
+
+// SampleLeaf returns a stored prefix with no stored prefixes below it,
+// found by descending from a root picked in proportion to each family's
+// size and taking a random branch at every fork. Leaves under fewer forks
+// are likelier picks, but every leaf can be picked.
+func (t *Trie[V]) SampleLeaf() (netip.Prefix, V, bool) {
+	n := t.root6
+	if t.Len() == 0 {
+		var zero V
+		return netip.Prefix{}, zero, false
+	}
+	if rand.IntN(t.Len()) < t.len4 {
+		n = t.root4
+	}
+	for {
+		switch l, r := n.child[0], n.child[1]; {
+		case l == nil && r == nil:
+			return n.prefix, *n.value, true
+		case l == nil:
+			n = r
+		case r == nil:
+			n = l
+		default:
+			n = n.child[rand.IntN(2)]
+		}
+	}
+}
+
+// Walk calls fn for every stored prefix, IPv4 before IPv6, each family in
+// address order with shorter prefixes first, until fn returns false.
+func (t *Trie[V]) Walk(fn func(netip.Prefix, V) bool) {
+	if walk(t.root4, fn) {
+		walk(t.root6, fn)
+	}
+}
+
+// Ascend calls fn, in Walk order, for every stored prefix that comes after
+// the given one, until fn returns false. An invalid after starts from the
+// beginning. Only the subtrees holding later prefixes are visited, so
+// resuming a walk is cheap.
+func (t *Trie[V]) Ascend(after netip.Prefix, fn func(netip.Prefix, V) bool) {
+	if !after.IsValid() {
+		t.Walk(fn)
+		return
+	}
+	after = after.Masked()
+	if after.Addr().Is4() {
+		if ascend(t.root4, after, fn) {
+			walk(t.root6, fn)
+		}
+		return
+	}
+	ascend(t.root6, after, fn)
+}
+
+func ascend[V any](n *node[V], after netip.Prefix, fn func(netip.Prefix, V) bool) bool {
+	if n == nil || LastAddr(n.prefix).Less(after.Addr()) {
+		return true // the whole subtree sorts before after
+	}
+	if n.value != nil && comesAfter(n.prefix, after) && !fn(n.prefix, *n.value) {
+		return false
+	}
+	return ascend(n.child[0], after, fn) && ascend(n.child[1], after, fn)
+}
+
+// comesAfter reports whether a sorts after b in Walk order: by address,
+// then shorter prefixes first.
+func comesAfter(a, b netip.Prefix) bool {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c > 0
+	}
+	return a.Bits() > b.Bits()
+}
+
+// LastAddr returns the highest address in p.
+func LastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().As16()
+	start := p.Bits()
+	if p.Addr().Is4() {
+		start += 96
+	}
+	for i := start; i < 128; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	a := netip.AddrFrom16(b)
+	if p.Addr().Is4() {
+		return a.Unmap()
+	}
+	return a
+}
+
+// walk visits the subtree at n in order and reports whether fn asked to
+// continue.
+func walk[V any](n *node[V], fn func(netip.Prefix, V) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.value != nil && !fn(n.prefix, *n.value) {
+		return false
+	}
+	return walk(n.child[0], fn) && walk(n.child[1], fn)
+}
+
+// bitAt returns bit i of a, counting from the most significant.
+func bitAt(a netip.Addr, i int) int {
+	if a.Is4() {
+		b := a.As4()
+		return int(b[i/8]>>(7-i%8)) & 1
+	}
+	b := a.As16()
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// commonBits returns the length of the longest prefix shared by a and b,
+// which must be of the same family.
+func commonBits(a, b netip.Prefix) int {
+	limit := min(a.Bits(), b.Bits())
+	var n int
+	if a.Addr().Is4() {
+		x, y := a.Addr().As4(), b.Addr().As4()
+		n = bits.LeadingZeros32(binary.BigEndian.Uint32(x[:]) ^ binary.BigEndian.Uint32(y[:]))
+	} else {
+		x, y := a.Addr().As16(), b.Addr().As16()
+		hi := binary.BigEndian.Uint64(x[:8]) ^ binary.BigEndian.Uint64(y[:8])
+		if hi != 0 {
+			n = bits.LeadingZeros64(hi)
+		} else {
+			n = 64 + bits.LeadingZeros64(binary.BigEndian.Uint64(x[8:])^binary.BigEndian.Uint64(y[8:]))
+		}
+	}
+	return min(n, limit)
+}
@@ -0,0 +1,351 @@
+package trie
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// randomPrefix returns a random IPv4 or IPv6 prefix drawn from a small
+// address space, so that prefixes often nest and collide.
+func randomPrefix(r *rand.Rand) netip.Prefix {
+	if r.IntN(2) == 0 {
+		a := netip.AddrFrom4([4]byte{10, byte(r.IntN(4)), byte(r.IntN(4)), byte(r.IntN(256))})
+		return netip.PrefixFrom(a, 8+r.IntN(25)).Masked()
+	}
+	a := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(r.IntN(4)), byte(r.IntN(4)), 15: byte(r.IntN(256))})
+	return netip.PrefixFrom(a, 32+r.IntN(97)).Masked()
+}
+
+// walkOrder is Walk order: IPv4 before IPv6, then by address, then
+// shorter prefixes first.
+func walkOrder(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// model is the map a Trie must agree with.
+type model map[netip.Prefix]int
+
+func (m model) longestMatch(p netip.Prefix) (netip.Prefix, int, bool) {
+	for bits := p.Bits(); bits >= 0; bits-- {
+		q := netip.PrefixFrom(p.Addr(), bits).Masked()
+		if v, ok := m[q]; ok {
+			return q, v, true
+		}
+	}
+	return netip.Prefix{}, 0, false
+}
+
+func (m model) shortestMatch(p netip.Prefix) (netip.Prefix, int, bool) {
+	for bits := 0; bits <= p.Bits(); bits++ {
+		q := netip.PrefixFrom(p.Addr(), bits).Masked()
+		if v, ok := m[q]; ok {
+			return q, v, true
+		}
+	}
+	return netip.Prefix{}, 0, false
+}
+
+func (m model) sorted() []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(m))
+	for p := range m {
+		out = append(out, p)
+	}
+	slices.SortFunc(out, walkOrder)
+	return out
+}
+
+func collect(t *Trie[int], after netip.Prefix) []netip.Prefix {
+	var out []netip.Prefix
+	t.Ascend(after, func(p netip.Prefix, _ int) bool {
+		out = append(out, p)
+		return true
+	})
+	return out
+}
+
+func TestInsertDeleteMatch(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	tr, m := New[int](), model{}
+	for i := range 20000 {
+		p := randomPrefix(r)
+		if r.IntN(3) == 0 {
+			old, ok := tr.Delete(p)
+			want, wantOK := m[p]
+			if ok != wantOK || old != want {
+				t.Fatalf("Delete(%s) = %d, %v; want %d, %v", p, old, ok, want, wantOK)
+			}
+			delete(m, p)
+		} else {
+			old, replaced := tr.Insert(p, i)
+			want, wantReplaced := m[p]
+			if replaced != wantReplaced || old != want {
+				t.Fatalf("Insert(%s) = %d, %v; want %d, %v", p, old, replaced, want, wantReplaced)
+			}
+			m[p] = i
+		}
+
+		q := randomPrefix(r)
+		got, v, ok := tr.LongestMatch(q)
+		want, wantV, wantOK := m.longestMatch(q)
+		if got != want || v != wantV || ok != wantOK {
+			t.Fatalf("LongestMatch(%s) = %s, %d, %v; want %s, %d, %v", q, got, v, ok, want, wantV, wantOK)
+		}
+		if v, ok := tr.Get(q); v != m[q] || ok != (got == q) {
+			t.Fatalf("Get(%s) = %d, %v; want %d", q, v, ok, m[q])
+		}
+	}
+	var v4 int
+	for p := range m {
+		if p.Addr().Is4() {
+			v4++
+		}
+	}
+	if tr.Len() != len(m) || tr.Len4() != v4 || tr.Len6() != len(m)-v4 {
+		t.Fatalf("Len = %d, %d, %d; want %d, %d, %d", tr.Len(), tr.Len4(), tr.Len6(), len(m), v4, len(m)-v4)
+	}
+}
+
+func TestInsertMasks(t *testing.T) {
+	tr := New[string]()
+	tr.Insert(netip.MustParsePrefix("10.1.2.3/8"), "a")
+	if v, ok := tr.Get(netip.MustParsePrefix("10.0.0.0/8")); !ok || v != "a" {
+		t.Fatalf("Get(10.0.0.0/8) = %q, %v", v, ok)
+	}
+	if _, _, ok := tr.LongestMatch(netip.MustParsePrefix("::ffff:10.1.2.3/128")); ok {
+		t.Fatal("an IPv4 prefix matched an IPv6 address")
+	}
+}
+
+func TestZeroLengthPrefixes(t *testing.T) {
+	tr := New[string]()
+	tr.Insert(netip.MustParsePrefix("0.0.0.0/0"), "v4")
+	tr.Insert(netip.MustParsePrefix("::/0"), "v6")
+	for _, tc := range []struct{ addr, want string }{
+		{"192.0.2.1/32", "v4"},
+		{"2001:db8::1/128", "v6"},
+		{"0.0.0.0/0", "v4"},
+		{"::/0", "v6"},
+	} {
+		if _, v, ok := tr.LongestMatch(netip.MustParsePrefix(tc.addr)); !ok || v != tc.want {
+			t.Errorf("LongestMatch(%s) = %q, %v; want %q", tc.addr, v, ok, tc.want)
+		}
+	}
+	if tr.Len4() != 1 || tr.Len6() != 1 {
+		t.Errorf("Len4, Len6 = %d, %d; want 1, 1", tr.Len4(), tr.Len6())
+	}
+}
+
+func TestWalkAscendOrder(t *testing.T) {
+	r := rand.New(rand.NewPCG(3, 4))
+	tr, m := New[int](), model{}
+	for i := range 3000 {
+		p := randomPrefix(r)
+		tr.Insert(p, i)
+		m[p] = i
+	}
+	want := m.sorted()
+	if got := collect(tr, netip.Prefix{}); !slices.Equal(got, want) {
+		t.Fatalf("Walk order differs from address order")
+	}
+	for range 500 {
+		after := randomPrefix(r)
+		i, _ := slices.BinarySearchFunc(want, after, walkOrder)
+		if i < len(want) && want[i] == after {
+			i++
+		}
+		if got := collect(tr, after); !slices.Equal(got, want[i:]) {
+			t.Fatalf("Ascend(%s) returned %d prefixes, want %d", after, len(got), len(want)-i)
+		}
+	}
+
+	var n int
+	tr.Ascend(netip.Prefix{}, func(netip.Prefix, int) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("Ascend went on for %d prefixes after fn returned false", n-10)
+	}
+}
+
+func TestSubnets(t *testing.T) {
+	r := rand.New(rand.NewPCG(5, 6))
+	tr, m := New[int](), model{}
+	for i := range 3000 {
+		p := randomPrefix(r)
+		tr.Insert(p, i)
+		m[p] = i
+	}
+	for range 200 {
+		within := randomPrefix(r)
+		var want []netip.Prefix
+		for _, p := range m.sorted() {
+			if p.Addr().BitLen() == within.Addr().BitLen() && p.Bits() >= within.Bits() && within.Contains(p.Addr()) {
+				want = append(want, p)
+			}
+		}
+		var got []netip.Prefix
+		tr.Subnets(within, func(p netip.Prefix, _ int) bool {
+			got = append(got, p)
+			return true
+		})
+		if !slices.Equal(got, want) {
+			t.Fatalf("Subnets(%s) = %v, want %v", within, got, want)
+		}
+		strict := len(want)
+		if _, ok := m[within]; ok {
+			strict--
+		}
+		if n := tr.CountSubnets(within, 0); n != strict {
+			t.Fatalf("CountSubnets(%s, 0) = %d, want %d", within, n, strict)
+		}
+		if n := tr.CountSubnets(within, 3); n != min(strict, 3) {
+			t.Fatalf("CountSubnets(%s, 3) = %d, want %d", within, n, min(strict, 3))
+		}
+	}
+}
+
+func TestSupernets(t *testing.T) {
+	r := rand.New(rand.NewPCG(7, 8))
+	tr, m := New[int](), model{}
+	for i := range 3000 {
+		p := randomPrefix(r)
+		tr.Insert(p, i)
+		m[p] = i
+	}
+	for range 200 {
+		p := randomPrefix(r)
+		var want []netip.Prefix
+		for bits := 0; bits <= p.Bits(); bits++ {
+			q := netip.PrefixFrom(p.Addr(), bits).Masked()
+			if _, ok := m[q]; ok {
+				want = append(want, q)
+			}
+		}
+		var got []netip.Prefix
+		tr.Supernets(p, func(q netip.Prefix, _ int) bool {
+			got = append(got, q)
+			return true
+		})
+		if !slices.Equal(got, want) {
+			t.Fatalf("Supernets(%s) = %v, want %v", p, got, want)
+		}
+		parent, _, ok := tr.Parent(p)
+		if strict := slices.DeleteFunc(want, func(q netip.Prefix) bool { return q == p }); ok != (len(strict) > 0) || ok && parent != strict[len(strict)-1] {
+			t.Fatalf("Parent(%s) = %s, %v; want the last of %v", p, parent, ok, strict)
+		}
+	}
+}
+
+func TestShortestMatch(t *testing.T) {
+	r := rand.New(rand.NewPCG(9, 10))
+	tr, m := New[int](), model{}
+	for i := range 2000 {
+		p := randomPrefix(r)
+		tr.Insert(p, i)
+		m[p] = i
+		if i%4 == 0 {
+			q := randomPrefix(r)
+			tr.Delete(q)
+			delete(m, q)
+		}
+	}
+	for range 2000 {
+		p := randomPrefix(r)
+		gotP, gotV, gotOK := tr.ShortestMatch(p)
+		wantP, wantV, wantOK := m.shortestMatch(p)
+		if gotP != wantP || gotV != wantV || gotOK != wantOK {
+			t.Fatalf("ShortestMatch(%s) = %s, %d, %v; want %s, %d, %v", p, gotP, gotV, gotOK, wantP, wantV, wantOK)
+		}
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	r := rand.New(rand.NewPCG(11, 12))
+	tr, m := New[int](), model{}
+	for i := range 2000 {
+		p := randomPrefix(r)
+		tr.Insert(p, i)
+		m[p] = i
+	}
+	for range 200 {
+		p := randomPrefix(r)
+		var want []netip.Prefix
+		for _, q := range m.sorted() {
+			if q != p && q.Addr().BitLen() == p.Addr().BitLen() {
+				want = append(want, q)
+			}
+		}
+		var got []netip.Prefix
+		last := p.Addr().BitLen()
+		tr.Neighbors(p, func(q netip.Prefix, _ int) bool {
+			if bits := Common(p, q).Bits(); bits > last {
+				t.Fatalf("Neighbors(%s) yielded %s, sharing %d bits, after one sharing %d", p, q, bits, last)
+			} else {
+				last = bits
+			}
+			got = append(got, q)
+			return true
+		})
+		slices.SortFunc(got, walkOrder)
+		if !slices.Equal(got, want) {
+			t.Fatalf("Neighbors(%s) = %v, want %v", p, got, want)
+		}
+		n := 0
+		tr.Neighbors(p, func(netip.Prefix, int) bool { n++; return false })
+		if n != min(len(want), 1) {
+			t.Fatalf("Neighbors(%s) went on after fn returned false", p)
+		}
+	}
+}
+
+func TestCommon(t *testing.T) {
+	for _, tc := range []struct{ a, b, want string }{
+		{"10.0.0.0/24", "10.0.3.0/24", "10.0.0.0/22"},
+		{"10.0.0.0/8", "10.1.2.0/24", "10.0.0.0/8"},
+		{"10.1.2.3/32", "10.1.2.3/32", "10.1.2.3/32"},
+		{"10.0.0.0/8", "192.0.2.0/24", "0.0.0.0/0"},
+		{"10.1.2.3/16", "10.1.9.9/24", "10.1.0.0/16"},
+		{"2001:db8::/32", "2001:db9::/32", "2001:db8::/31"},
+	} {
+		if got := Common(netip.MustParsePrefix(tc.a), netip.MustParsePrefix(tc.b)); got.String() != tc.want {
+			t.Errorf("Common(%s, %s) = %s, want %s", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestSampleLeaf(t *testing.T) {
+	if _, _, ok := New[int]().SampleLeaf(); ok {
+		t.Fatal("SampleLeaf of an empty trie found a leaf")
+	}
+	r := rand.New(rand.NewPCG(11, 12))
+	tr, m := New[int](), model{}
+	for i := range 300 {
+		p := randomPrefix(r)
+		tr.Insert(p, i)
+		m[p] = i
+	}
+	leaves := make(map[netip.Prefix]bool)
+	for p := range m {
+		if tr.CountSubnets(p, 1) == 0 {
+			leaves[p] = false
+		}
+	}
+	for range 200 * len(leaves) {
+		p, v, ok := tr.SampleLeaf()
+		if _, leaf := leaves[p]; !ok || !leaf || m[p] != v {
+			t.Fatalf("SampleLeaf() = %s, %d, %v; not a stored leaf", p, v, ok)
+		}
+		leaves[p] = true
+	}
+	for p, seen := range leaves {
+		if !seen {
+			t.Errorf("leaf %s never sampled", p)
+		}
+	}
+}